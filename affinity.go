@@ -0,0 +1,82 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/david415/HoneyBadger/logging"
+)
+
+// ParseCPUList parses a list of CPUs as the kernel writes them, comma
+// separated CPU numbers and ranges of them, such as "0-3,8,10-11".
+func ParseCPUList(list string) ([]int, error) {
+	var cpus []int
+	for _, item := range strings.Split(strings.TrimSpace(list), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		bounds := strings.SplitN(item, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid CPU %q", item)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || last < first {
+				return nil, fmt.Errorf("invalid CPU range %q", item)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// LocalCPUs returns the CPUs of the NUMA node the network interface
+// is attached to, as Linux lists them in sysfs.
+func LocalCPUs(device string) ([]int, error) {
+	list, err := ioutil.ReadFile(filepath.Join("/sys/class/net", device, "device", "local_cpulist"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the CPUs local to %s: %s", device, err)
+	}
+	return ParseCPUList(string(list))
+}
+
+// pinGoroutine binds the calling goroutine, for good, to an OS thread
+// running on the given CPUs, if any; what it runs is named in the warning
+// logged if it cannot be.
+func pinGoroutine(what string, cpus []int) {
+	if len(cpus) == 0 {
+		return
+	}
+	if err := pinThread(cpus); err != nil {
+		logging.Warningf("%s not bound to CPUs %v: %s", what, cpus, err)
+		return
+	}
+	logging.Debugf("%s bound to CPUs %v", what, cpus)
+}
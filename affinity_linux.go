@@ -0,0 +1,41 @@
+//go:build linux
+// +build linux
+
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// pinThread locks the calling goroutine to its OS thread
+// and binds the thread to the given CPUs.
+func pinThread(cpus []int) error {
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	set.Zero()
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(0, &set)
+}
@@ -0,0 +1,41 @@
+package HoneyBadger
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	cpus, err := ParseCPUList("0-2, 8,10-11\n")
+	want := []int{0, 1, 2, 8, 10, 11}
+	if err != nil || len(cpus) != len(want) {
+		t.Fatalf("parsed %v %v", cpus, err)
+	}
+	for n := range want {
+		if cpus[n] != want[n] {
+			t.Errorf("parsed %v, expected %v", cpus, want)
+		}
+	}
+	if cpus, err := ParseCPUList(""); err != nil || cpus != nil {
+		t.Errorf("parsed %v %v from no CPUs", cpus, err)
+	}
+	for _, list := range []string{"a", "3-1", "-1", "1-"} {
+		if _, err := ParseCPUList(list); err == nil {
+			t.Errorf("parsed %q", list)
+		}
+	}
+}
+
+func TestPinThread(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("threads are only bound to CPUs on linux")
+	}
+	done := make(chan error)
+	go func() {
+		// the thread ends with the goroutine locked to it
+		done <- pinThread([]int{0})
+	}()
+	if err := <-done; err != nil {
+		t.Errorf("thread not bound to CPU 0: %s", err)
+	}
+}
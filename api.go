@@ -0,0 +1,317 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+)
+
+// APIServer is a control plane service embedding an HTTP API in a running
+// sensor, so that dashboards and automation may query it as it runs:
+//
+//	GET /api/v1/connections  the connections tracked
+//	GET /api/v1/attacks      the recent attack reports, most recent first
+//	GET /api/v1/stats        the sensor, its connection tracker metrics,
+//	                         analysis errors and the attacks reported
+//	                         since it started
+//	GET /api/v1/evidence     the evidence files of the flow parameter's
+//	                         connection kept in ArchiveDir
+//	GET /evidence/<file>     an evidence file of ArchiveDir
+//	GET /                    the dashboard, a web UI of the above
+//
+// The API has no authentication of its own, so the evidence, the captured
+// traffic of the connections, is only served if ServeEvidence is set.
+//
+// The attack reports, as report-json writes them, are those kept by
+// Attacks, which must be one of the pipeline's attack loggers. They may be
+// selected with the query parameters type, an attack type or detector,
+// flow, a flow of either direction such as 10.0.0.1:5000-10.0.0.2:80,
+// net, a CIDR network either end of the flow is in, since and until,
+// an RFC 3339 time or a duration before now, and limit; type and net
+// may be repeated.
+type APIServer struct {
+	Addr          string
+	Attacks       *logging.RecentAttacks
+	ArchiveDir    string
+	ServeEvidence bool
+
+	dispatcher *Dispatcher
+	server     *http.Server
+	started    time.Time
+}
+
+// NewAPIServer returns a pointer to an APIServer struct which
+// will listen on addr and serve the attack reports kept by attacks.
+func NewAPIServer(addr string, attacks *logging.RecentAttacks) *APIServer {
+	return &APIServer{
+		Addr:    addr,
+		Attacks: attacks,
+	}
+}
+
+// Start starts serving the API of dispatcher; if it fails
+// to listen the error is logged and the API is not served.
+func (a *APIServer) Start(dispatcher *Dispatcher) {
+	a.dispatcher = dispatcher
+	a.started = time.Now()
+	listener, err := net.Listen("tcp", a.Addr)
+	if err != nil {
+		logging.Errorf("HTTP API disabled: %s", err)
+		return
+	}
+	a.server = &http.Server{Handler: a}
+	go func() {
+		if err := a.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logging.Warningf("HTTP API: %s", err)
+		}
+	}()
+}
+
+// Stop closes the listener and the connections of the API's clients.
+func (a *APIServer) Stop() {
+	if a.server != nil {
+		a.server.Close()
+	}
+}
+
+func (a *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		apiError(w, http.StatusMethodNotAllowed, "only GET requests are supported")
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/evidence/") && a.ServeEvidence && a.ArchiveDir != "" {
+		http.StripPrefix("/evidence/", http.FileServer(http.Dir(a.ArchiveDir))).ServeHTTP(w, r)
+		return
+	}
+	switch r.URL.Path {
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, dashboardHTML)
+	case "/api/v1/evidence":
+		if !a.ServeEvidence {
+			apiError(w, http.StatusNotFound, "evidence is not served")
+			return
+		}
+		a.serveEvidence(w, r)
+	case "/api/v1/connections":
+		a.serveConnections(w)
+	case "/api/v1/attacks":
+		a.serveAttacks(w, r)
+	case "/api/v1/stats":
+		a.serveStats(w)
+	default:
+		apiError(w, http.StatusNotFound, "no such resource "+r.URL.Path)
+	}
+}
+
+// apiConnection is a tracked connection as the API serves it.
+type apiConnection struct {
+	Flow      string    `json:"flow"`
+	State     string    `json:"state"`
+	Packets   uint64    `json:"packets"`
+	Bytes     uint64    `json:"bytes"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Age       float64   `json:"age_seconds"`
+}
+
+func (a *APIServer) serveConnections(w http.ResponseWriter) {
+	connections := []apiConnection{}
+	for _, info := range a.dispatcher.LiveConnections() {
+		connections = append(connections, apiConnection{
+			Flow:      info.Flow.String(),
+			State:     info.State,
+			Packets:   info.Packets,
+			Bytes:     info.Bytes,
+			FirstSeen: info.FirstSeen,
+			LastSeen:  info.LastSeen,
+			Age:       info.Age.Seconds(),
+		})
+	}
+	apiResponse(w, connections)
+}
+
+func (a *APIServer) serveAttacks(w http.ResponseWriter, r *http.Request) {
+	query, err := parseAttackQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	reports := []*logging.AttackReport{}
+	if a.Attacks != nil {
+		for _, event := range a.Attacks.Query(*query) {
+			reports = append(reports, logging.NewAttackReport(event))
+		}
+	}
+	apiResponse(w, reports)
+}
+
+// apiStats are the statistics of the sensor the API serves.
+type apiStats struct {
+	Sensor         *logging.ReportSensor `json:"sensor"`
+	Uptime         float64               `json:"uptime_seconds"`
+	Tracker        ConnTrackerMetrics    `json:"tracker"`
+	AnalysisErrors uint64                `json:"analysis_errors"`
+	DroppedPackets uint64                `json:"dropped_packets"`
+	LoadShedding   []string              `json:"load_shedding"`
+	MemoryPressure string                `json:"memory_pressure,omitempty"`
+	Attacks        uint64                `json:"attacks"`
+	AttacksByType  map[string]uint64     `json:"attacks_by_type"`
+}
+
+func (a *APIServer) serveStats(w http.ResponseWriter) {
+	stats := apiStats{
+		Sensor: &logging.ReportSensor{
+			ID:   logging.Sensor,
+			Site: logging.Site,
+			Tags: logging.SensorTags,
+		},
+		Uptime:         time.Since(a.started).Seconds(),
+		Tracker:        a.dispatcher.Metrics(),
+		AnalysisErrors: a.dispatcher.AnalysisErrors(),
+		DroppedPackets: a.dispatcher.DroppedPackets(),
+		LoadShedding:   a.dispatcher.LoadShedding(),
+		MemoryPressure: a.dispatcher.MemoryPressure(),
+		AttacksByType:  map[string]uint64{},
+	}
+	if a.Attacks != nil {
+		stats.Attacks, stats.AttacksByType = a.Attacks.Counts()
+	}
+	apiResponse(w, stats)
+}
+
+// apiEvidence is an evidence file as the API serves it.
+type apiEvidence struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	URL      string    `json:"url"`
+}
+
+// serveEvidence lists the files of ArchiveDir whose path, relative to
+// it, names the flow of either direction: the packet logs, snippets,
+// streams and report files of the connection.
+func (a *APIServer) serveEvidence(w http.ResponseWriter, r *http.Request) {
+	flow := r.URL.Query().Get("flow")
+	if flow == "" {
+		apiError(w, http.StatusBadRequest, "missing flow")
+		return
+	}
+	reverse := flow
+	if i := strings.Index(flow, "-"); i >= 0 {
+		reverse = flow[i+1:] + "-" + flow[:i]
+	}
+	evidence := []apiEvidence{}
+	if a.ArchiveDir == "" {
+		apiResponse(w, evidence)
+		return
+	}
+	err := filepath.Walk(a.ArchiveDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(a.ArchiveDir, path)
+		if err != nil || !(strings.Contains(name, flow) || strings.Contains(name, reverse)) {
+			return nil
+		}
+		name = filepath.ToSlash(name)
+		evidence = append(evidence, apiEvidence{
+			Name:     name,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+			URL:      (&url.URL{Path: "/evidence/" + name}).String(),
+		})
+		return nil
+	})
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apiResponse(w, evidence)
+}
+
+// parseAttackQuery parses the query parameters selecting attack reports.
+func parseAttackQuery(values map[string][]string, now time.Time) (*logging.AttackQuery, error) {
+	filter, err := logging.ParseEventFilter(values["type"], values["net"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid net: %s", err)
+	}
+	query := logging.AttackQuery{
+		Filter: filter,
+	}
+	if flows := values["flow"]; len(flows) > 0 {
+		query.Flow = flows[0]
+	}
+	if query.Since, err = parseQueryTime(values, "since", now); err != nil {
+		return nil, err
+	}
+	if query.Until, err = parseQueryTime(values, "until", now); err != nil {
+		return nil, err
+	}
+	if limits := values["limit"]; len(limits) > 0 {
+		query.Limit, err = strconv.Atoi(limits[0])
+		if err != nil || query.Limit < 0 {
+			return nil, fmt.Errorf("invalid limit: %s", limits[0])
+		}
+	}
+	return &query, nil
+}
+
+// parseQueryTime parses the named query parameter, either an RFC 3339
+// time or a duration before now; it is the zero time if not given.
+func parseQueryTime(values map[string][]string, name string, now time.Time) (time.Time, error) {
+	if len(values[name]) == 0 || values[name][0] == "" {
+		return time.Time{}, nil
+	}
+	value := values[name][0]
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(strings.TrimPrefix(value, "-"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %s is neither an RFC 3339 time nor a duration", name, value)
+	}
+	return now.Add(-d), nil
+}
+
+func apiResponse(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logging.Warningf("HTTP API: %s", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,125 @@
+package HoneyBadger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func apiGet(t *testing.T, api *APIServer, url string, code int, body interface{}) {
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest("GET", url, nil))
+	if recorder.Code != code {
+		t.Fatalf("GET %s: status %d, expected %d: %s", url, recorder.Code, code, recorder.Body)
+	}
+	if body == nil {
+		return
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), body); err != nil {
+		t.Fatalf("GET %s: %s", url, err)
+	}
+}
+
+func TestAPIServer(t *testing.T) {
+	options := DispatcherOptions{
+		Logger:         NewDummyAttackLogger(),
+		MaxRingPackets: 40,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+	_, packet := newTestConnection(options.Logger)
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+
+	recent := logging.NewRecentAttacks(10)
+	api := NewAPIServer("127.0.0.1:0", recent)
+	api.dispatcher = dispatcher
+	api.started = time.Now()
+	ipFlow := gopacket.NewFlow(layers.EndpointIPv4, net.IPv4(1, 2, 3, 4).To4(), net.IPv4(2, 3, 4, 5).To4())
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(1), layers.NewTCPPortEndpoint(2))
+	flow := types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	recent.Log(&types.Event{Type: "handshake-hijack", Time: time.Now().Add(-2 * time.Hour), Flow: flow})
+	recent.Log(&types.Event{Type: "injection", Time: time.Now(), Flow: flow})
+
+	var connections []apiConnection
+	apiGet(t, api, "/api/v1/connections", http.StatusOK, &connections)
+	if len(connections) != 1 || connections[0].Flow != "1.2.3.4:1-2.3.4.5:2" {
+		t.Errorf("served connections %+v", connections)
+	}
+
+	var reports []logging.AttackReport
+	apiGet(t, api, "/api/v1/attacks", http.StatusOK, &reports)
+	if len(reports) != 2 || reports[0].Type != "injection" {
+		t.Errorf("served attacks %+v", reports)
+	}
+	apiGet(t, api, "/api/v1/attacks?type=handshake&flow=2.3.4.5:2-1.2.3.4:1", http.StatusOK, &reports)
+	if len(reports) != 1 || reports[0].Type != "handshake-hijack" {
+		t.Errorf("served filtered attacks %+v", reports)
+	}
+	apiGet(t, api, "/api/v1/attacks?since=1h", http.StatusOK, &reports)
+	if len(reports) != 1 || reports[0].Type != "injection" {
+		t.Errorf("served attacks of the last hour %+v", reports)
+	}
+	apiGet(t, api, "/api/v1/attacks?net=10.0.0.0/8", http.StatusOK, &reports)
+	if len(reports) != 0 {
+		t.Errorf("served attacks of another network %+v", reports)
+	}
+
+	var stats apiStats
+	apiGet(t, api, "/api/v1/stats", http.StatusOK, &stats)
+	if stats.Attacks != 2 || stats.AttacksByType["injection"] != 1 || stats.Tracker.Connections != 1 {
+		t.Errorf("served stats %+v", stats)
+	}
+
+	apiGet(t, api, "/api/v1/attacks?since=yesterday", http.StatusBadRequest, nil)
+	apiGet(t, api, "/api/v1/attacks?limit=-1", http.StatusBadRequest, nil)
+	apiGet(t, api, "/api/v1/nothing", http.StatusNotFound, nil)
+}
+
+func TestAPIServerEvidence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiEvidence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"1.2.3.4:1-2.3.4.5:2.pcap", "2.3.4.5:2-1.2.3.4:1.attack-1.pcap", "1.2.3.4:9-2.3.4.5:2.pcap"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("evidence"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := NewAPIServer("127.0.0.1:0", nil)
+	api.ArchiveDir = dir
+	apiGet(t, api, "/api/v1/evidence?flow=1.2.3.4:1-2.3.4.5:2", http.StatusNotFound, nil)
+	apiGet(t, api, "/evidence/1.2.3.4:1-2.3.4.5:2.pcap", http.StatusNotFound, nil)
+	api.ServeEvidence = true
+
+	var evidence []apiEvidence
+	apiGet(t, api, "/api/v1/evidence?flow=1.2.3.4:1-2.3.4.5:2", http.StatusOK, &evidence)
+	if len(evidence) != 2 || evidence[0].Name != "1.2.3.4:1-2.3.4.5:2.pcap" || evidence[1].Name != "2.3.4.5:2-1.2.3.4:1.attack-1.pcap" {
+		t.Fatalf("served evidence %+v", evidence)
+	}
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest("GET", evidence[0].URL, nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "evidence" {
+		t.Errorf("GET %s: status %d: %q", evidence[0].URL, recorder.Code, recorder.Body)
+	}
+	apiGet(t, api, "/api/v1/evidence", http.StatusBadRequest, nil)
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "/api/v1/attacks") {
+		t.Errorf("dashboard not served: status %d", recorder.Code)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"sync"
+)
+
+// segmentPool recycles the buffers holding the payload copies retained
+// by StreamBuffers. Buffers are pageBytes long which covers any segment
+// off an ethernet link; larger segments get a buffer of their own
+// which is simply left to the garbage collector.
+var segmentPool = sync.Pool{
+	New: func() interface{} {
+		return new([pageBytes]byte)
+	},
+}
+
+// getSegmentBuffer returns a copy of payload backed by a pooled buffer
+// whenever it fits in one.
+func getSegmentBuffer(payload []byte) []byte {
+	if len(payload) > pageBytes {
+		buf := make([]byte, len(payload))
+		copy(buf, payload)
+		return buf
+	}
+	buf := segmentPool.Get().(*[pageBytes]byte)
+	n := copy(buf[:], payload)
+	return buf[:n:pageBytes]
+}
+
+// putSegmentBuffer returns a buffer obtained from getSegmentBuffer to the pool.
+// The caller must not retain any reference to it afterwards.
+func putSegmentBuffer(b []byte) {
+	if cap(b) != pageBytes {
+		return
+	}
+	segmentPool.Put((*[pageBytes]byte)(b[:pageBytes]))
+}
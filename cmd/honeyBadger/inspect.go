@@ -0,0 +1,191 @@
+/*
+ *    HoneyBadger main command line tool
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/david415/HoneyBadger/logging"
+)
+
+// report is an attack report read from a report file.
+type report struct {
+	logging.SerializedEvent
+	file string
+}
+
+// inspect runs the inspect command, listing the attack
+// reports of the given report files and directories.
+func inspect(args []string) {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	var (
+		archiveDir = flags.String("archive_dir", "", "archive directory whose attack reports are listed if no report file or dir is given")
+		outputDir  = flags.String("o", "", `output dir of honeyBadger capture or replay, whose "archive" subdirectory is listed if no report file or dir is given`)
+		attackType = flags.String("type", "", "if set, only list the attack reports of this type")
+	)
+	flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		switch {
+		case *archiveDir != "":
+			paths = []string{*archiveDir}
+		case *outputDir != "":
+			paths = []string{filepath.Join(*outputDir, "archive")}
+		default:
+			log.Fatal("inspect takes the report files or dirs to list, or an archive dir with -archive_dir or -o")
+		}
+	}
+
+	var reports []report
+	files := 0
+	for _, path := range paths {
+		err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !isReportFile(name) {
+				return nil
+			}
+			found, err := readReports(name)
+			if err != nil {
+				return err
+			}
+			files++
+			for _, r := range found {
+				if *attackType == "" || r.Type == *attackType {
+					reports = append(reports, r)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	sort.SliceStable(reports, func(i, j int) bool {
+		return reports[i].Time.Before(reports[j].Time)
+	})
+	counts := make(map[string]int)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTYPE\tFLOW\tPACKET\tOCCURRENCES\tFILE")
+	for _, r := range reports {
+		occurrences := r.Occurrences
+		if occurrences == 0 {
+			occurrences = 1
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", r.Time.UTC().Format("2006-01-02 15:04:05"), r.Type, r.Flow, r.PacketCount, occurrences, r.file)
+		counts[r.Type]++
+	}
+	w.Flush()
+
+	types := make([]string, 0, len(counts))
+	for t := range counts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	summary := make([]string, len(types))
+	for i, t := range types {
+		summary[i] = fmt.Sprintf("%d %s", counts[t], t)
+	}
+	fmt.Printf("\n%d attack report(s) in %d file(s)", len(reports), files)
+	if len(summary) > 0 {
+		fmt.Printf(": %s", strings.Join(summary, ", "))
+	}
+	fmt.Println()
+}
+
+// isReportFile returns true if name is a file of JSON attack reports,
+// one per line, as written by the json, metadata-json and report-json
+// backends; the STIX and EVE files of the other backends are not listed.
+func isReportFile(name string) bool {
+	return strings.HasSuffix(name, ".json") && !strings.HasSuffix(name, ".stix.json") && filepath.Base(name) != "eve.json"
+}
+
+// readReports reads the attack reports of a report file.
+func readReports(name string) ([]report, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var reports []report
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		r, err := parseReport(scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid attack report: %s", name, line, err)
+		}
+		if r.Type == "" {
+			// not an attack report
+			continue
+		}
+		r.file = name
+		reports = append(reports, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return reports, nil
+}
+
+// parseReport parses a JSON attack report, either a SerializedEvent
+// of the json backends or a versioned AttackReport of report-json.
+func parseReport(data []byte) (report, error) {
+	var versioned struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &versioned); err != nil {
+		return report{}, err
+	}
+	if versioned.SchemaVersion == 0 {
+		r := report{}
+		err := json.Unmarshal(data, &r.SerializedEvent)
+		return r, err
+	}
+	attack := logging.AttackReport{}
+	if err := json.Unmarshal(data, &attack); err != nil {
+		return report{}, err
+	}
+	return report{
+		SerializedEvent: logging.SerializedEvent{
+			Type:        attack.Type,
+			Time:        attack.Time,
+			PacketCount: attack.PacketCount,
+			Flow:        fmt.Sprintf("%s:%d-%s:%d", attack.Flow.SrcIP, attack.Flow.SrcPort, attack.Flow.DstIP, attack.Flow.DstPort),
+			Occurrences: attack.Occurrences,
+		},
+	}, nil
+}
@@ -21,49 +21,223 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/david415/HoneyBadger"
+	"github.com/david415/HoneyBadger/config"
 	"github.com/david415/HoneyBadger/logging"
+	_ "github.com/david415/HoneyBadger/response"
 	"github.com/david415/HoneyBadger/types"
 )
 
 func main() {
+	command, args := "capture", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "capture", "replay":
+		capture(command, args)
+	case "inspect":
+		inspect(args)
+	case "collect":
+		collect(args)
+	case "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "honeyBadger: unknown command %q\n\n", command)
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `usage: honeyBadger [command] [flags] [arguments]
+
+The commands are:
+  capture   detect attacks in the packets captured from an interface; the default command
+  replay    detect attacks in the packets of a pcap file: replay [flags] <pcap file>
+  inspect   list the attack reports in an archive dir: inspect [flags] [report file or dir ...]
+  collect   aggregate the attack reports the collector attack loggers of many sensors stream to it
+
+Run "honeyBadger <command> -h" for the flags of a command.
+`)
+}
+
+// capture runs the capture and replay commands, which only differ
+// in where the packets come from.
+func capture(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
 	var (
-		pcapfile                 = flag.String("pcapfile", "", `pcap filename to read packets from rather than a wire interface.
+		configFile               = flags.String("config", "", `YAML or TOML file, named *.toml, of settings for the flags below by section, e.g. "capture:\n  daq: AF_PACKET";
+flags given on the command line take precedence over it. See the config package for its sections and keys.
+On SIGHUP it is reloaded: changes to the filter, detectors, hijack_detection_packets, tracking rules, sampling, attack loggers and
+evidence retention take effect without losing the connections tracked, changes to other settings need a restart.
+On SIGUSR1 a diagnostic dump of the running sensor is written, see -dump_file.`)
+		pcapfile                 = flags.String("pcapfile", "", `pcap filename to read packets from rather than a wire interface.
 This option is to be combined with a -daq= setting of either "pcapgo" OR "libpcap"!`)
-		iface                    = flag.String("i", "eth0", "Interface to get packets from")
-		snaplen                  = flag.Int("s", 65536, "SnapLen for pcap packet capture")
-		filter                   = flag.String("f", "tcp", "BPF filter for pcap")
-		logDir                   = flag.String("l", "", "incoming log dir used initially for pcap files if packet logging is enabled")
-		wireTimeout              = flag.String("w", "3s", "timeout for reading packets off the wire")
-		metadataAttackLog        = flag.Bool("metadata_attack_log", false, "if set to true then attack reports will only include metadata")
-		logPackets               = flag.Bool("log_packets", false, "if set to true then log all packets for each tracked TCP connection")
-		tcpTimeout               = flag.Duration("tcp_idle_timeout", time.Minute*10, "tcp idle timeout duration")
-		maxRingPackets           = flag.Int("max_ring_packets", 40, "Max packets per connection stream ring buffer")
-		detectHijack             = flag.Bool("detect_hijack", true, "Detect handshake hijack attacks")
-		detectInjection          = flag.Bool("detect_injection", true, "Detect injection attacks")
-		detectCoalesceInjection  = flag.Bool("detect_coalesce_injection", true, "Detect coalesce injection attacks")
-		maxConcurrentConnections = flag.Int("max_concurrent_connections", 300, "Maximum number of concurrent connection to track.")
-		bufferedPerConnection    = flag.Int("connection_max_buffer", 100, `
+		iface                    = flags.String("i", HoneyBadger.DEFAULT_INTERFACE, "Interface to get packets from")
+		snaplen                  = flags.Int("s", HoneyBadger.DEFAULT_SNAPLEN, "SnapLen for pcap packet capture")
+		filter                   = flags.String("f", HoneyBadger.DEFAULT_FILTER, "BPF filter for pcap")
+		logDir                   = flags.String("l", "", "incoming log dir used initially for pcap files if packet logging is enabled")
+		wireTimeout              = flags.String("w", HoneyBadger.DEFAULT_WIRE_TIMEOUT.String(), "timeout for reading packets off the wire")
+		captureBatch             = flags.Int("capture_batch", HoneyBadger.SNIFFER_BATCH, "number of packets read off the capture handle and decoded at once")
+		captureFlush             = flags.Duration("capture_flush", HoneyBadger.SNIFFER_FLUSH_INTERVAL, "longest a batch of packets read waits to be decoded, bounding the latency added on quiet links")
+		captureCPUs              = flags.String("capture_cpus", "", `CPUs the threads reading and decoding packets are bound to, such as "2" or "0-1,4"; best those the IRQs of the NIC's queues are bound to`)
+		workerCPUs               = flags.String("worker_cpus", "", `CPUs the threads analysing packets are bound to, one CPU to each worker in turn, such as "4-7"; "nic" for the CPUs of the NUMA node of the capture interface`)
+		metadataAttackLog        = flags.Bool("metadata_attack_log", false, "if set to true then attack reports will only include metadata")
+		attackLoggers            = flags.String("attack_loggers", "", `semicolon separated list of attack report backends, each report is sent to all of them.
+Each is a backend name optionally followed by a colon and comma separated key=value parameters, e.g. "json; cef:file=/var/log/honeybadger.cef".
+The json, metadata-json and report-json backends take a path template like -packet_log_template, which may also use {type}, e.g. "json:path={date}/{sensor}/attacks.json"
+collects each day's reports in one file.
+The file backends take durability=buffered|fsync|group, to leave writing out to the OS, sync each report or sync every commit_interval (100ms), e.g. "json:durability=group,commit_interval=50ms",
+and chain_key=<key file> to HMAC sign and chain each report in a <file>.chain file, see honeybadgerReportTool -verify_key.
+The stix backend writes each report as a STIX 2.1 bundle, one per line, for threat intel platforms; "webhook:urls=<url>,format=stix" posts them instead.
+The collector backend streams the reports to a honeyBadger collect, e.g. "collector:url=https://collector:9443,ca=ca.pem,cert=sensor.pem,key=sensor.key".
+If empty, "json" or "metadata-json" is used depending on metadata_attack_log.`)
+		logConnectionEvents      = flags.Bool("log_connection_events", false, "if set to true then connection-opened and connection-closed events are sent to the attack loggers too")
+		grpcListen               = flags.String("grpc_listen", "", "if set then serve the gRPC event service, streaming attack reports and connection events to subscribers, on this address")
+		grpcCert                 = flags.String("grpc_cert", "", "TLS certificate file of the gRPC event service")
+		grpcKey                  = flags.String("grpc_key", "", "TLS key file of the gRPC event service")
+		controlListen            = flags.String("control_listen", "", "if set then serve the gRPC control service, which changes the filter and detectors, rotates the packet logs, serves the stats and captures flows, on this address")
+		controlCert              = flags.String("control_cert", "", "TLS certificate file of the gRPC control service")
+		controlKey               = flags.String("control_key", "", "TLS key file of the gRPC control service")
+		controlClientCA          = flags.String("control_client_ca", "", "certificate authority file of the client certificates the gRPC control service requires")
+		httpListen               = flags.String("http_listen", "", "if set then serve the HTTP API of the connections tracked, the recent attack reports, their evidence and the sensor's stats, and a web dashboard of them, on this address")
+		httpEvidence             = flags.Bool("http_evidence", false, "if set to true then the HTTP API and dashboard serve the evidence files of the archive dir too; the API has no authentication, so only set it if the API's address is not reachable by others")
+		httpRecentAttacks        = flags.Int("http_recent_attacks", logging.RECENT_ATTACKS, "number of the most recent attack reports the HTTP API keeps")
+		debugListen              = flags.String("debug_listen", "", "if set then serve the Go profiler at /debug/pprof/ and the runtime variables of the sensor, its packet rates, queue depths, detector timings and GC statistics, at /debug/vars on this loopback address, such as localhost:6060; with no host, as in :6060, it listens on localhost")
+		metricsListen            = flags.String("metrics_listen", "", "if set then serve the sensor's counters and histograms, its packets dispatched and dropped, connections by state, attacks by type, detector latencies and attack logger backend errors, in the Prometheus text format at /metrics on this address")
+		statsdAddr               = flags.String("statsd", "", "if set then send the metrics of -metrics_listen to the statsd server of this UDP address, such as localhost:8125")
+		statsdPrefix             = flags.String("statsd_prefix", HoneyBadger.STATSD_PREFIX, "prefix of the names of the metrics sent to statsd")
+		statsdTags               = flags.String("statsd_tags", "", "comma separated list of tags, such as env:prod, of every metric sent to a DogStatsD server")
+		statsdDogStatsD          = flags.Bool("statsd_dogstatsd", false, "if set to true then the statsd server is DogStatsD, which is sent the states, attack types, detectors and backends of metrics as tags rather than in their names")
+		statsdInterval           = flags.Duration("statsd_interval", HoneyBadger.STATSD_INTERVAL, "interval at which metrics are sent to statsd")
+		dumpFile                 = flags.String("dump_file", "", "file a diagnostic dump of the connections tracked, their counts by state, the queue depths, the flows of the most bytes and the recent errors is written to on SIGUSR1, replacing the previous dump; if not set the dump is written to the diagnostic log")
+		summaryPeriod            = flags.String("summary", "", `if set then summarize the attacks by type, the services most attacked, the suspected injectors reporting the most attacks and the traffic analysed every period: "hourly", "daily" or a duration; summaries are logged and written to -summary_dir`)
+		summaryDir               = flags.String("summary_dir", "", "directory the summaries of -summary are written to as JSON")
+		summaryTop               = flags.Int("summary_top", HoneyBadger.SUMMARY_TOP, "number of the services and suspected injectors most attacking a summary lists")
+		logPackets               = flags.Bool("log_packets", false, "if set to true then log all packets for each tracked TCP connection")
+		tcpTimeout               = flags.Duration("tcp_idle_timeout", HoneyBadger.DEFAULT_TCP_IDLE_TIMEOUT, "tcp idle timeout duration")
+		maxRingPackets           = flags.Int("max_ring_packets", HoneyBadger.DEFAULT_MAX_RING_PACKETS, "Max packets per connection stream ring buffer")
+		maxRingBytes             = flags.Int("max_ring_bytes", 0, "Max payload bytes per connection stream ring buffer. If zero, this is infinite.")
+		maxRetainedBytes         = flags.Int("max_retained_bytes", 0, "Max stream payload bytes retained across all connections. If zero, this is infinite.")
+		retentionPolicy          = flags.String("retention_policy", "evict", `What to do once max_retained_bytes is exceeded:
+evict the oldest segments, stop retaining segments or drop the connection; one of "evict", "stop" or "drop".`)
+		retainStreams            = flags.Bool("retain_streams", false, "if set to true then retain the complete streams of tracked TCP connections and archive them when an attack is detected")
+		retainStreamPorts        = flags.String("retain_stream_ports", "", "comma separated list of TCP ports; if set then only streams of connections using one of these ports are retained")
+		streamSpillBytes         = flags.Int("stream_spill_bytes", 1024*1024, "Max bytes of a retained stream kept in memory before it is spilled to the incoming log dir. If zero, this is infinite.")
+		detectHijack             = flags.Bool("detect_hijack", true, "Detect handshake hijack attacks")
+		detectInjection          = flags.Bool("detect_injection", true, "Detect injection attacks")
+		detectCoalesceInjection  = flags.Bool("detect_coalesce_injection", true, "Detect coalesce injection attacks")
+		hijackDetectionPackets   = flags.Int("hijack_detection_packets", HoneyBadger.FIRST_FEW_PACKETS, "number of packets after the handshake of a connection in which handshake hijack attacks are detected")
+		detectorPlugins          = flags.String("detector_plugins", "", `semicolon separated list of out-of-process detectors, each sent the overlapping retransmissions of every connection, and with "+segments" every payload segment, as JSON lines on its stdin and writing its attack reports as JSON lines to its stdout.
+Each is a name followed by "=" and the command running it, e.g. "dns+segments=/usr/local/bin/dns-detector -v; overlaps=overlaps.py"; see HoneyBadger.DetectorPlugin for the protocol`)
+		unidirectional           = flags.Bool("unidirectional", false, "if set to true then expect only one direction of each TCP connection to be visible, as on some taps and span ports")
+		maxConcurrentConnections = flags.Int("max_concurrent_connections", HoneyBadger.DEFAULT_MAX_CONCURRENT_CONNECTIONS, "Maximum number of concurrent connection to track.")
+		workers                  = flags.Int("workers", 1, "number of goroutines analysing packets, each analysing the connections of its share of the flows; a packet is dropped if the queue of the worker which is to analyse it is full")
+		workerQueue              = flags.Int("worker_queue", HoneyBadger.DISPATCHER_WORKER_QUEUE, "number of packets queued for each of the workers")
+		shedLoad                 = flags.String("shed_load", "", `comma separated list of the policies applied to shed load while captured packets are dropped at shed_drop_rate or more:
+"payload" retains only the latest segment of the streams of new connections, "sample" tracks only shed_sample_rate of new connections
+and "detectors" suspends the segment events sent to detector plugins; connections using a priority port or matching an "always" rule are spared`)
+		shedDropRate             = flags.Float64("shed_drop_rate", 0, "captured packets dropped per second from which load is shed; if zero, any packet dropped")
+		shedSampleRate           = flags.Float64("shed_sample_rate", HoneyBadger.LOAD_SHED_SAMPLE_RATE, "fraction of new connections tracked while the \"sample\" policy sheds load")
+		shedInterval             = flags.Duration("shed_interval", HoneyBadger.LOAD_SHED_INTERVAL, "interval at which the captured packets dropped are counted to decide whether to shed load")
+		memoryCeiling            = flags.Int64("memory_ceiling", 0, "bytes of memory, of -memory_source, the process is bounded to: from 80% of it idle connections are closed, from 90% the streams retained shrunk and at the ceiling no new connections tracked. If zero, this is infinite.")
+		memorySource             = flags.String("memory_source", "rss", `memory -memory_ceiling applies to: "rss", the resident set size, or "heap", the Go heap in use`)
+		memoryIdleTimeout        = flags.Duration("memory_idle_timeout", HoneyBadger.MEMORY_IDLE_TIMEOUT, "time connections must have been idle for to be closed once memory reaches 80% of -memory_ceiling")
+		dropAlarmPercent         = flags.Float64("drop_alarm_percent", 0, "percentage of the captured packets dropped by the capture, by the kernel or as decoding falls behind, from which a packet loss alarm is reported to the attack loggers; if zero, no alarm")
+		overflowAlarmPercent     = flags.Float64("overflow_alarm_percent", 0, "percentage of the packets dispatched dropped as the workers' queues overflow from which a queue overflow alarm is reported to the attack loggers; if zero, no alarm")
+		dropAlarmDuration        = flags.Duration("drop_alarm_duration", HoneyBadger.DROP_ALARM_DURATION, "time packets must be dropped above, or below, an alarm's percentage for to raise, or clear, the alarm")
+		teardown                 = flags.Bool("teardown", false, "if set, tear down the connections attacks of at least -teardown_confidence are reported for by sending RSTs forged to both endpoints over raw sockets, before the injected content is consumed. Requires Linux and CAP_NET_RAW.")
+		teardownConfidence       = flags.String("teardown_confidence", "high", `confidence of the attacks -teardown responds to at least: "high", as handshake hijacks and injections are, "medium" or "low"`)
+		teardownRSTs             = flags.Int("teardown_rsts", HoneyBadger.COUNTERMEASURE_RSTS, "number of RSTs sent to each endpoint of a connection torn down")
+		sampleRate               = flags.Float64("sample_rate", 0, "fraction of new connections to track, chosen by a hash of their 4-tuple. If zero, every connection is tracked.")
+		priorityPorts            = flags.String("priority_ports", "", "comma separated list of TCP ports; connections using one of these ports are tracked regardless of sample_rate")
+		trackRules               = flags.String("track_rules", "", `semicolon separated list of rules deciding which connections are tracked, the first matching rule applies.
+Each rule is "always" or "never" followed by the conditions net=<CIDR>[,<CIDR>...] and port=<port|low-high>[,...], e.g.
+"always net=10.0.0.25/32 port=25; never net=10.9.0.0/16"`)
+		tenantRules              = flags.String("tenants", "", `semicolon separated list of tenants, each analysing the packets of its rules apart from the others' and the sensor's, e.g.
+"acme vlan=100,101; globex vni=5001 net=10.1.0.0/16"; a tenant is named followed by the conditions vlan=<ID>[,...], vni=<VXLAN VNI>[,...] and net=<CIDR>[,...]
+and named more than once to match the packets of any of its rules. The packet logs, attack reports and snapshot of a tenant
+are kept apart too: in its subdirectory of the log and archive dirs and in the snapshot_file suffixed with its name`)
+		snapshotFile             = flags.String("snapshot_file", "", "if set then the state of tracked connections is saved to this file on shutdown and restored from it on start")
+		snapshotStreams          = flags.Bool("snapshot_streams", false, "if set to true then connection snapshots include the retained stream data")
+		evictConnections         = flags.Bool("evict_connections", true, "if set to true then the least recently active connection is evicted once max_concurrent_connections are tracked, otherwise new connections are ignored")
+		bufferedPerConnection    = flags.Int("connection_max_buffer", HoneyBadger.DEFAULT_BUFFERED_PER_CONNECTION, `
 Max packets to buffer for a single connection before skipping over a gap in data
 and continuing to stream the connection after the buffer.  If zero or less, this
 is infinite.`)
-		bufferedTotal = flag.Int("total_max_buffer", 1000, `
+		bufferedTotal = flags.Int("total_max_buffer", HoneyBadger.DEFAULT_BUFFERED_TOTAL, `
 Max packets to buffer total before skipping over gaps in connections and
 continuing to stream connection data.  If zero or less, this is infinite`)
-		maxPcapLogSize      = flag.Int("max_pcap_log_size", 10, "maximum pcap size per rotation in megabytes")
-		maxNumPcapRotations = flag.Int("max_pcap_rotations", 100, "maximum number of pcap rotations per connection")
-		archiveDir          = flag.String("archive_dir", "", "archive directory for storing attack logs and related pcap files")
-		daq                 = flag.String("daq", "libpcap", `Data AcQuisition packet source: pcapgo, libpcap, AF_PACKET or BSD_BPF.
+		maxPcapLogSize      = flags.Int("max_pcap_log_size", 10, "maximum pcap size per rotation in megabytes")
+		maxNumPcapRotations = flags.Int("max_pcap_rotations", 100, "maximum number of pcap rotations per connection")
+		maxPcapLogAge       = flags.Duration("max_pcap_log_age", 0, "if set, rotate the pcap file of a connection once it is older than this")
+		pcapng              = flags.Bool("pcapng", false, "if set, log packets as pcapng files in which the packets that triggered attack reports are annotated with comments")
+		duplicateWindow     = flags.Duration("duplicate_report_window", 0, "if set, collapse identical reports of a connection, such as those of retransmitted attack segments, seen within this window of each other into one report with an occurrence count")
+		snippetPackets      = flags.Int("attack_snippet_packets", 0, "if set, write a pcap of this many packets either side of each attack's offending packet to the archive dir and reference it from the report")
+		packetLogTemplate   = flags.String("packet_log_template", "", `path of each connection's packet log within the log and archive dirs, in which {flow}, {sensor},
+{date} and {hour} are replaced; it must contain {flow}. If empty, "{flow}.pcap" or "{flow}.pcapng" is used.`)
+		sensor              = flags.String("sensor", logging.Sensor, "ID of this sensor, included in every attack report and connection event and used for {sensor} in log path templates")
+		site                = flags.String("site", "", "if set, the site of this sensor, included in every attack report and connection event")
+		sensorTags          = flags.String("sensor_tags", "", "comma separated list of key=value tags of this sensor, included in every attack report and connection event")
+		asnRIB              = flags.String("asn_rib", "", "if set, an MRT TABLE_DUMP_V2 routing table dump, optionally gzip or bzip2 compressed, of which the origin AS and prefix of both endpoints are added to attack reports")
+		asnCymru            = flags.Bool("asn_cymru", false, "if set to true then the AS of both endpoints of attack reports, if not found in -asn_rib, is looked up with Team Cymru's IP to ASN DNS service")
+		compressLogs        = flags.String("compress_logs", "", "if set, compress rotated pcap files and archived streams in the background with this compression: gzip, or zstd when built with -tags zstd")
+		pcapRotatePattern   = flags.String("pcap_rotate_pattern", logging.ROTATE_PATTERN, "name pattern of rotated pcap files made of {name}, the pcap file name, {n}, the rotation number, and {time}, the time the file was started")
+		evidenceRetention   = flags.String("evidence_retention", "", `semicolon separated list of rules limiting the evidence kept in the archive dir, enforced in the background.
+Each rule is a kind of evidence, "packets", "streams", "reports" or "all", followed by the conditions type=<type|detector>, age=<duration> and mb=<megabytes>, e.g.
+"packets age=168h mb=10240; all type=handshake age=2160h"; the rules naming a file's attack type take precedence over those naming its kind over "all"`)
+		reapInterval        = flags.Duration("evidence_reap_interval", logging.RETENTION_INTERVAL, "interval between enforcements of evidence_retention")
+		archiveDir          = flags.String("archive_dir", "", "archive directory for storing attack logs and related pcap files")
+		logLevel            = flags.String("log_level", "info", "level of the diagnostic log: debug, info, warning, error or silent")
+		logFile             = flags.String("log_file", "", "if set, append the diagnostic log to this file rather than writing it to stderr")
+		logDebugFlows       = flags.String("log_debug_flows", "", "comma separated list of flows, of either direction such as 10.0.0.1:5000-10.0.0.2:80, whose connections are logged at debug level whatever the log_level")
+		outputDir           = flags.String("o", "", `output dir; if set, the incoming log dir and archive dir default to its "incoming" and "archive" subdirectories,
+which are created if need be`)
+		daq                 = flags.String("daq", HoneyBadger.DEFAULT_DAQ, `Data AcQuisition packet source: pcapgo, libpcap, AF_PACKET or BSD_BPF.
 BSD_BPF is BSD systems only.
 AF_PACKET is Linux only.
 libpcap builds on Linux and FreeBSD and can read every kind of pcap format.
 pcapgo builds on every platform but does not support pcap-ng format, only pcap v2.4.
 `)
 	)
-	flag.Parse()
+	flags.Parse(args)
+
+	var loader *config.Loader
+	if *configFile != "" {
+		loader = config.NewLoader(*configFile, flags)
+		if _, err := loader.Load(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *logFile != "" {
+		file, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logging.SetLogOutput(file)
+	}
+	if err := configureLogging(*logLevel, *logDebugFlows); err != nil {
+		log.Fatal(err)
+	}
+
+	if command == "replay" {
+		if flags.NArg() != 1 {
+			log.Fatal("replay takes the pcap file to read packets from: honeyBadger replay [flags] <pcap file>")
+		}
+		*pcapfile = flags.Arg(0)
+	} else if flags.NArg() != 0 {
+		log.Fatalf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
 
 	if *daq == "pcapgo" && *pcapfile == "" {
 		log.Fatal("must specify a -pcapfile option when using -daq=pcapgo")
@@ -79,8 +253,21 @@ pcapgo builds on every platform but does not support pcap-ng format, only pcap v
 		log.Fatal("only pcapgo and libpcap DAQs supports sniffing pcap files")
 	}
 
+	if *outputDir != "" {
+		if *logDir == "" {
+			*logDir = filepath.Join(*outputDir, "incoming")
+		}
+		if *archiveDir == "" {
+			*archiveDir = filepath.Join(*outputDir, "archive")
+		}
+		for _, dir := range []string{*logDir, *archiveDir} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 	if *archiveDir == "" || *logDir == "" {
-		log.Fatal("must specify both incoming log dir and archive log dir with option flags -l and -archive_dir")
+		log.Fatal("must specify both incoming log dir and archive log dir with option flags -l and -archive_dir, or an output dir with -o")
 	}
 
 	wireDuration, err := time.ParseDuration(*wireTimeout)
@@ -96,61 +283,475 @@ pcapgo builds on every platform but does not support pcap-ng format, only pcap v
 		log.Fatal("connection_max_buffer and total_max_buffer must be set to a non-zero value")
 	}
 
-	var logger types.Logger
+	retention, err := HoneyBadger.ParseRetentionPolicy(*retentionPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if *metadataAttackLog {
-		loggerInstance := logging.NewAttackMetadataJsonLogger(*archiveDir)
-		loggerInstance.Start()
-		defer func() { loggerInstance.Stop() }()
-		logger = loggerInstance
+	streamPorts, err := parsePorts("retain_stream_ports", *retainStreamPorts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	samplePorts, err := parsePorts("priority_ports", *priorityPorts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *sampleRate < 0 || *sampleRate > 1 {
+		log.Fatal("invalid sample_rate: ", *sampleRate)
+	}
+	captureCPUList, err := HoneyBadger.ParseCPUList(*captureCPUs)
+	if err != nil {
+		log.Fatal("invalid capture_cpus: ", err)
+	}
+	var workerCPUList []int
+	if *workerCPUs == "nic" {
+		workerCPUList, err = HoneyBadger.LocalCPUs(*iface)
 	} else {
-		loggerInstance := logging.NewAttackJsonLogger(*archiveDir)
-		loggerInstance.Start()
-		defer func() { loggerInstance.Stop() }()
-		logger = loggerInstance
+		workerCPUList, err = HoneyBadger.ParseCPUList(*workerCPUs)
+	}
+	if err != nil {
+		log.Fatal("invalid worker_cpus: ", err)
+	}
+	memorySourceType, err := HoneyBadger.ParseMemorySource(*memorySource)
+	if err != nil {
+		log.Fatal(err)
+	}
+	countermeasure := HoneyBadger.CountermeasureOptions{RSTs: *teardownRSTs}
+	if countermeasure.Confidence, err = logging.ParseConfidence(*teardownConfidence); err != nil {
+		log.Fatal(err)
+	}
+	if *teardown {
+		if countermeasure.Injector, err = HoneyBadger.NewRawSocketInjector(); err != nil {
+			log.Fatal(err)
+		}
+		defer countermeasure.Injector.Close()
+	}
+	shedPolicies, err := HoneyBadger.ParseShedPolicies(*shedLoad)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *shedSampleRate <= 0 || *shedSampleRate > 1 {
+		log.Fatal("invalid shed_sample_rate: ", *shedSampleRate)
+	}
+	trackingRules, err := HoneyBadger.ParseTrackingRules(*trackRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	plugins, err := HoneyBadger.ParseDetectorPlugins(*detectorPlugins)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tenants, err := HoneyBadger.ParseTenants(*tenantRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logging.Sensor = *sensor
+	logging.Site = *site
+	if logging.SensorTags, err = logging.ParseSensorTags(*sensorTags); err != nil {
+		log.Fatal(err)
+	}
+	backends, err := attackBackends(*attackLoggers, *metadataAttackLog, *archiveDir, *evidenceRetention, *reapInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the backends are swapped on reload, the
+	// gRPC event service below lives on
+	reloadableBackends := logging.NewReloadableLogger(backends)
+	logger := &logging.MultiAttackLogger{}
+	logger.Add("attack_loggers", reloadableBackends)
+	var reportLogger logging.AttackLogger = logger
+	var asnResolvers logging.ASNResolvers
+	if *asnRIB != "" {
+		table, err := logging.LoadMRT(*asnRIB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logging.Infof("loaded %d prefixes from %s", table.Len(), *asnRIB)
+		asnResolvers = append(asnResolvers, table)
+	}
+	if *asnCymru {
+		asnResolvers = append(asnResolvers, logging.NewCymruResolver())
+	}
+	if len(asnResolvers) > 0 {
+		reportLogger = logging.NewASNEnricher(asnResolvers, logger)
+	}
+	var connectionLogger types.Logger
+	if *grpcListen != "" {
+		if *grpcCert == "" || *grpcKey == "" {
+			log.Fatal("the gRPC event service requires both -grpc_cert and -grpc_key")
+		}
+		stream := logging.NewEventStream(1024)
+		logger.Add("grpc", stream)
+		connectionLogger = stream
+		go func() {
+			log.Fatal(logging.NewGRPCServer(stream).ListenAndServeTLS(*grpcListen, *grpcCert, *grpcKey))
+		}()
+	}
+	if *logConnectionEvents {
+		connectionLogger = reportLogger
+	}
+	var controlPlane []HoneyBadger.ControlService
+	if *httpListen != "" {
+		recent := logging.NewRecentAttacks(*httpRecentAttacks)
+		logger.Add("http", recent)
+		api := HoneyBadger.NewAPIServer(*httpListen, recent)
+		api.ArchiveDir = *archiveDir
+		api.ServeEvidence = *httpEvidence
+		controlPlane = append(controlPlane, api)
+	}
+	if *controlListen != "" {
+		if *controlCert == "" || *controlKey == "" || *controlClientCA == "" {
+			log.Fatal("the gRPC control service requires -control_cert, -control_key and -control_client_ca")
+		}
+		controlPlane = append(controlPlane, HoneyBadger.NewControlServer(*controlListen, *controlCert, *controlKey, *controlClientCA))
+	}
+	if *debugListen != "" {
+		controlPlane = append(controlPlane, HoneyBadger.NewDebugServer(*debugListen))
+	}
+	var attackCounts *logging.RecentAttacks
+	if *metricsListen != "" || *statsdAddr != "" {
+		attackCounts = logging.NewRecentAttacks(1)
+		logger.Add("metrics", attackCounts)
+	}
+	if *metricsListen != "" {
+		controlPlane = append(controlPlane, HoneyBadger.NewMetricsServer(*metricsListen, attackCounts))
+	}
+	if *summaryPeriod != "" {
+		period, err := HoneyBadger.ParseSummaryPeriod(*summaryPeriod)
+		if err != nil {
+			log.Fatal(err)
+		}
+		controlPlane = append(controlPlane, HoneyBadger.NewSummaryReporter(HoneyBadger.SummaryOptions{
+			Period: period,
+			Dir:    *summaryDir,
+			Top:    *summaryTop,
+		}))
+	}
+	if *statsdAddr != "" {
+		statsdOptions := HoneyBadger.StatsdOptions{
+			Addr:      *statsdAddr,
+			Prefix:    *statsdPrefix,
+			DogStatsD: *statsdDogStatsD,
+			Interval:  *statsdInterval,
+		}
+		for _, tag := range strings.Split(*statsdTags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				statsdOptions.Tags = append(statsdOptions.Tags, tag)
+			}
+		}
+		controlPlane = append(controlPlane, HoneyBadger.NewStatsdEmitter(statsdOptions, attackCounts))
+	}
+
+	var compressor types.Compressor
+	if *compressLogs != "" {
+		fileCompressor, err := logging.NewFileCompressor(*compressLogs, 2, 1000)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fileCompressor.Stop()
+		compressor = fileCompressor
 	}
 
 	dispatcherOptions := HoneyBadger.DispatcherOptions{
 		BufferedPerConnection:    *bufferedPerConnection,
 		BufferedTotal:            *bufferedTotal,
 		LogDir:                   *logDir,
+		ArchiveDir:               *archiveDir,
 		LogPackets:               *logPackets,
+		RetainStreams:            *retainStreams,
+		RetainStreamPorts:        streamPorts,
+		StreamSpillBytes:         *streamSpillBytes,
+		SnippetPackets:           *snippetPackets,
+		DuplicateWindow:          *duplicateWindow,
+		HijackDetectionPackets:   *hijackDetectionPackets,
+		Compressor:               compressor,
 		MaxPcapLogRotations:      *maxNumPcapRotations,
 		MaxPcapLogSize:           *maxPcapLogSize,
 		TcpIdleTimeout:           *tcpTimeout,
 		MaxRingPackets:           *maxRingPackets,
-		Logger:                   logger,
+		MaxRingBytes:             *maxRingBytes,
+		MaxRetainedBytes:         *maxRetainedBytes,
+		RetentionPolicy:          retention,
+		Logger:                   reportLogger,
+		ConnectionLogger:         connectionLogger,
 		DetectHijack:             *detectHijack,
 		DetectInjection:          *detectInjection,
 		DetectCoalesceInjection:  *detectCoalesceInjection,
+		Unidirectional:           *unidirectional,
 		MaxConcurrentConnections: *maxConcurrentConnections,
+		EvictConnections:         *evictConnections,
+		SampleRate:               *sampleRate,
+		PriorityPorts:            samplePorts,
+		TrackingRules:            trackingRules,
+		SnapshotFile:             *snapshotFile,
+		SnapshotStreams:          *snapshotStreams,
+		DetectorPlugins:          plugins,
+		Workers:                  *workers,
+		WorkerQueue:              *workerQueue,
+		WorkerCPUs:               workerCPUList,
+		LoadShedding: HoneyBadger.LoadSheddingOptions{
+			Policies:   shedPolicies,
+			DropRate:   *shedDropRate,
+			SampleRate: *shedSampleRate,
+			Interval:   *shedInterval,
+		},
+		DropAlarms: HoneyBadger.DropAlarmOptions{
+			DropPercent:     *dropAlarmPercent,
+			OverflowPercent: *overflowAlarmPercent,
+			Duration:        *dropAlarmDuration,
+		},
+		MemoryWatermark: HoneyBadger.MemoryWatermarkOptions{
+			Ceiling:     *memoryCeiling,
+			Source:      memorySourceType,
+			IdleTimeout: *memoryIdleTimeout,
+		},
+		Countermeasure: countermeasure,
 	}
 
 	snifferDriverOptions := types.SnifferDriverOptions{
-		DAQ:          *daq,
-		Device:       *iface,
-		Filename:     *pcapfile,
-		WireDuration: wireDuration,
-		Snaplen:      int32(*snaplen),
-		Filter:       *filter,
+		DAQ:           *daq,
+		Device:        *iface,
+		Filename:      *pcapfile,
+		WireDuration:  wireDuration,
+		Snaplen:       int32(*snaplen),
+		Filter:        *filter,
+		BatchSize:     *captureBatch,
+		FlushInterval: *captureFlush,
+		CPUs:          captureCPUList,
 	}
 
 	connectionFactory := &HoneyBadger.DefaultConnFactory{}
-	var packetLoggerFactory types.PacketLoggerFactory
-	if *logPackets {
-		packetLoggerFactory = logging.NewPcapLoggerFactory(*logDir, *archiveDir, *maxNumPcapRotations, *maxPcapLogSize)
-	} else {
-		packetLoggerFactory = nil
+	// the control service captures flows even if packets are not logged
+	capturePackets := *logPackets || *controlListen != ""
+	newPacketLoggerFactory := func(logDir, archiveDir string) types.PacketLoggerFactory {
+		if !capturePackets {
+			return nil
+		}
+		pcapLoggerFactory := logging.NewPcapLoggerFactory(logDir, archiveDir, *maxNumPcapRotations, *maxPcapLogSize)
+		pcapLoggerFactory.MaxAge = *maxPcapLogAge
+		pcapLoggerFactory.RotatePattern = *pcapRotatePattern
+		pcapLoggerFactory.Compressor = compressor
+		pcapLoggerFactory.Pcapng = *pcapng
+		pcapLoggerFactory.PathTemplate = *packetLogTemplate
+		return pcapLoggerFactory
+	}
+	if capturePackets {
+		if err := logging.ValidRotatePattern(*pcapRotatePattern); err != nil {
+			log.Fatal(err)
+		}
+		if *packetLogTemplate != "" {
+			if err := logging.ValidPathTemplate(*packetLogTemplate, true); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	packetLoggerFactory := newPacketLoggerFactory(*logDir, *archiveDir)
+
+	// each tenant gets the sensor's settings with outputs of its own
+	tenantReloadable := make([]*logging.ReloadableLogger, len(tenants))
+	for i := range tenants {
+		tenant := &tenants[i]
+		tenantLogDir, err := tenantDir(*logDir, tenant.Name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tenantArchiveDir, err := tenantDir(*archiveDir, tenant.Name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backends, err := attackBackends(*attackLoggers, *metadataAttackLog, tenantArchiveDir, *evidenceRetention, *reapInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tenantReloadable[i] = logging.NewReloadableLogger(backends)
+		var tenantLogger logging.AttackLogger = tenantReloadable[i]
+		if len(asnResolvers) > 0 {
+			tenantLogger = logging.NewASNEnricher(asnResolvers, tenantLogger)
+		}
+		tenant.DispatcherOptions = dispatcherOptions
+		tenant.DispatcherOptions.LogDir = tenantLogDir
+		tenant.DispatcherOptions.ArchiveDir = tenantArchiveDir
+		tenant.DispatcherOptions.Logger = tenantLogger
+		tenant.DispatcherOptions.ConnectionLogger = nil
+		if *logConnectionEvents {
+			tenant.DispatcherOptions.ConnectionLogger = tenantLogger
+		}
+		if *snapshotFile != "" {
+			tenant.DispatcherOptions.SnapshotFile = *snapshotFile + "." + tenant.Name
+		}
+		// plugins are run by one dispatcher each
+		if tenant.DispatcherOptions.DetectorPlugins, err = HoneyBadger.ParseDetectorPlugins(*detectorPlugins); err != nil {
+			log.Fatal(err)
+		}
+		tenant.PacketLoggerFactory = newPacketLoggerFactory(tenantLogDir, tenantArchiveDir)
+		tenant.Loggers = []HoneyBadger.Service{tenantLogger}
 	}
 
-	log.Println("HoneyBadger: comprehensive TCP injection attack detection.")
+	logging.Infof("HoneyBadger: comprehensive TCP injection attack detection.")
 	options := HoneyBadger.SupervisorOptions{
 		SnifferDriverOptions: &snifferDriverOptions,
 		DispatcherOptions:    dispatcherOptions,
 		SnifferFactory:       HoneyBadger.NewSniffer,
 		ConnectionFactory:    connectionFactory,
 		PacketLoggerFactory:  packetLoggerFactory,
+		Loggers:              []HoneyBadger.Service{reportLogger},
+		ControlPlane:         controlPlane,
+		DumpFile:             *dumpFile,
+		Tenants:              tenants,
+	}
+	if loader != nil {
+		options.OnReload = func(supervisor *HoneyBadger.Supervisor) error {
+			previousFilter := *filter
+			changed, err := loader.Load()
+			if err != nil {
+				return err
+			}
+			priorityPorts, err := parsePorts("priority_ports", *priorityPorts)
+			if err != nil {
+				return err
+			}
+			if *sampleRate < 0 || *sampleRate > 1 {
+				return fmt.Errorf("invalid sample_rate: %v", *sampleRate)
+			}
+			trackingRules, err := HoneyBadger.ParseTrackingRules(*trackRules)
+			if err != nil {
+				return err
+			}
+			if err := configureLogging(*logLevel, *logDebugFlows); err != nil {
+				return err
+			}
+			reloadBackends := false
+			for _, name := range changed {
+				switch name {
+				case "attack_loggers", "metadata_attack_log", "evidence_retention", "evidence_reap_interval":
+					reloadBackends = true
+				case "f", "detect_hijack", "detect_injection", "detect_coalesce_injection",
+					"hijack_detection_packets", "track_rules", "sample_rate", "priority_ports",
+					"log_level", "log_debug_flows":
+				default:
+					logging.Warningf("-%s changed, restart honeyBadger for it to take effect", name)
+				}
+			}
+			var backends *logging.MultiAttackLogger
+			var reloadedTenantBackends []*logging.MultiAttackLogger
+			if reloadBackends {
+				backends, err = attackBackends(*attackLoggers, *metadataAttackLog, *archiveDir, *evidenceRetention, *reapInterval)
+				if err != nil {
+					return err
+				}
+				for _, tenant := range tenants {
+					tenantArchiveDir, err := tenantDir(*archiveDir, tenant.Name)
+					if err != nil {
+						return err
+					}
+					tenantBackends, err := attackBackends(*attackLoggers, *metadataAttackLog, tenantArchiveDir, *evidenceRetention, *reapInterval)
+					if err != nil {
+						return err
+					}
+					reloadedTenantBackends = append(reloadedTenantBackends, tenantBackends)
+				}
+			}
+
+			if *filter != previousFilter {
+				if err := supervisor.SetFilter(*filter); err != nil {
+					logging.Warningf("filter not changed: %s", err)
+				}
+			}
+			reconfigured := dispatcherOptions
+			reconfigured.DetectHijack = *detectHijack
+			reconfigured.DetectInjection = *detectInjection
+			reconfigured.DetectCoalesceInjection = *detectCoalesceInjection
+			reconfigured.HijackDetectionPackets = *hijackDetectionPackets
+			reconfigured.TrackingRules = trackingRules
+			reconfigured.SampleRate = *sampleRate
+			reconfigured.PriorityPorts = priorityPorts
+			supervisor.Reconfigure(reconfigured)
+			for _, tenant := range tenants {
+				if err := supervisor.ReconfigureTenant(tenant.Name, reconfigured); err != nil {
+					return err
+				}
+			}
+			if backends != nil {
+				reloadableBackends.Reload(backends)
+				for i, tenantBackends := range reloadedTenantBackends {
+					tenantReloadable[i].Reload(tenantBackends)
+				}
+			}
+			logging.Infof("configuration reloaded")
+			return nil
+		}
 	}
 	supervisor := HoneyBadger.NewSupervisor(options)
 	supervisor.Run()
 }
+
+// configureLogging sets the level of the diagnostic log and the
+// flows of the -log_debug_flows list logged at debug level.
+func configureLogging(level, debugFlows string) error {
+	logLevel, err := logging.ParseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logging.SetLogLevel(logLevel)
+	logging.SetDebugFlows(strings.Split(debugFlows, ","))
+	return nil
+}
+
+// attackBackends builds the attack logger backends of the -attack_loggers
+// spec, by default json or metadata-json, and the evidence reaper
+// enforcing the -evidence_retention rules.
+func attackBackends(spec string, metadata bool, archiveDir, retention string, reapInterval time.Duration) (*logging.MultiAttackLogger, error) {
+	if spec == "" {
+		spec = "json"
+		if metadata {
+			spec = "metadata-json"
+		}
+	}
+	backends, err := logging.ParseAttackLoggers(spec, archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	if retention != "" {
+		if archiveDir == "" {
+			return nil, fmt.Errorf("-evidence_retention requires -archive_dir")
+		}
+		rules, err := logging.ParseRetentionRules(retention)
+		if err != nil {
+			return nil, err
+		}
+		reaper := logging.NewEvidenceReaper(archiveDir, rules)
+		reaper.Interval = reapInterval
+		backends.Add("retention", reaper)
+	}
+	return backends, nil
+}
+
+// tenantDir returns the named tenant's subdirectory of dir, creating it
+// if need be, or "" if dir is not set.
+func tenantDir(dir, name string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	dir = filepath.Join(dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// parsePorts parses the comma separated list of TCP ports given as the named flag.
+func parsePorts(name, value string) ([]int, error) {
+	var ports []int
+	if value == "" {
+		return ports, nil
+	}
+	for _, field := range strings.Split(value, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s port: %s", name, field)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
@@ -96,11 +96,41 @@ func expandReport(reportPath string) {
 	}
 }
 
+// verifyReport verifies the chain of a report file and
+// returns false if the report was tampered with.
+func verifyReport(reportPath string, key []byte) bool {
+	count, err := logging.VerifyReportChain(reportPath, key)
+	if err != nil {
+		fmt.Printf("%s: FAILED after %d records: %s\n", reportPath, count, err)
+		return false
+	}
+	fmt.Printf("%s: OK, %d records\n", reportPath, count)
+	return true
+}
+
 func main() {
-	var ()
+	var (
+		verifyKey = flag.String("verify_key", "", "if set, verify the report chains with the chain key in this file rather than expanding the reports")
+	)
 	flag.Parse()
 	reports := flag.Args()
 
+	if *verifyKey != "" {
+		key, err := logging.ReadChainKey(*verifyKey)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		ok := true
+		for i := 0; i < len(reports); i++ {
+			ok = verifyReport(reports[i], key) && ok
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
 	for i := 0; i < len(reports); i++ {
 		expandReport(reports[i])
 	}
@@ -0,0 +1,506 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package config loads honeyBadger's configuration from a YAML or TOML
+// file, so that sensors can be managed with configuration management
+// rather than long flag lists.
+//
+// The file is made of the sections of SECTIONS, each setting one of
+// honeyBadger's flags per key:
+//
+//	capture:
+//	  daq: AF_PACKET
+//	  interface: eth0
+//	logs:
+//	  log_dir: /var/lib/honeybadger/incoming
+//	  archive_dir: /var/lib/honeybadger/archive
+//	output:
+//	  attack_loggers:
+//	    - json
+//	    - "cef:file=/var/log/honeybadger.cef"
+//	sensor:
+//	  id: tap-3
+//	  tags: {rack: b4, env: prod}
+//
+// or, in TOML:
+//
+//	[capture]
+//	daq = "AF_PACKET"
+//	interface = "eth0"
+//
+//	[output]
+//	attack_loggers = ["json", "cef:file=/var/log/honeybadger.cef"]
+//
+// Lists are joined into the separated lists the flags take, and
+// tables into their key=value lists. Flags given on the command line
+// take precedence over the file.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Key is a configuration key and the flag it sets.
+type Key struct {
+	Name string
+	Flag string
+	// Separator joins the items of a list value, if the flag takes a list.
+	Separator string
+	// Pairs is set if the flag takes a list of key=value pairs,
+	// given as a table.
+	Pairs bool
+}
+
+// Section is a section of the configuration file.
+type Section struct {
+	Name string
+	Keys []Key
+}
+
+// SECTIONS are the sections of the configuration file and their keys.
+var SECTIONS = []Section{
+	{"capture", []Key{
+		{Name: "daq", Flag: "daq"},
+		{Name: "interface", Flag: "i"},
+		{Name: "pcapfile", Flag: "pcapfile"},
+		{Name: "snaplen", Flag: "s"},
+		{Name: "filter", Flag: "f"},
+		{Name: "wire_timeout", Flag: "w"},
+		{Name: "batch_size", Flag: "capture_batch"},
+		{Name: "flush_interval", Flag: "capture_flush"},
+		{Name: "cpus", Flag: "capture_cpus"},
+		{Name: "worker_cpus", Flag: "worker_cpus"},
+	}},
+	{"connections", []Key{
+		{Name: "max_concurrent_connections", Flag: "max_concurrent_connections"},
+		{Name: "evict_connections", Flag: "evict_connections"},
+		{Name: "tcp_idle_timeout", Flag: "tcp_idle_timeout"},
+		{Name: "unidirectional", Flag: "unidirectional"},
+		{Name: "workers", Flag: "workers"},
+		{Name: "worker_queue", Flag: "worker_queue"},
+		{Name: "shed_load", Flag: "shed_load", Separator: ","},
+		{Name: "shed_drop_rate", Flag: "shed_drop_rate"},
+		{Name: "shed_sample_rate", Flag: "shed_sample_rate"},
+		{Name: "shed_interval", Flag: "shed_interval"},
+		{Name: "drop_alarm_percent", Flag: "drop_alarm_percent"},
+		{Name: "overflow_alarm_percent", Flag: "overflow_alarm_percent"},
+		{Name: "drop_alarm_duration", Flag: "drop_alarm_duration"},
+		{Name: "memory_ceiling", Flag: "memory_ceiling"},
+		{Name: "memory_source", Flag: "memory_source"},
+		{Name: "memory_idle_timeout", Flag: "memory_idle_timeout"},
+		{Name: "teardown", Flag: "teardown"},
+		{Name: "teardown_confidence", Flag: "teardown_confidence"},
+		{Name: "teardown_rsts", Flag: "teardown_rsts"},
+		{Name: "sample_rate", Flag: "sample_rate"},
+		{Name: "priority_ports", Flag: "priority_ports", Separator: ","},
+		{Name: "track_rules", Flag: "track_rules", Separator: "; "},
+		{Name: "tenants", Flag: "tenants", Separator: "; "},
+		{Name: "snapshot_file", Flag: "snapshot_file"},
+		{Name: "snapshot_streams", Flag: "snapshot_streams"},
+	}},
+	{"buffers", []Key{
+		{Name: "connection_max_buffer", Flag: "connection_max_buffer"},
+		{Name: "total_max_buffer", Flag: "total_max_buffer"},
+		{Name: "max_ring_packets", Flag: "max_ring_packets"},
+		{Name: "max_ring_bytes", Flag: "max_ring_bytes"},
+		{Name: "max_retained_bytes", Flag: "max_retained_bytes"},
+		{Name: "retention_policy", Flag: "retention_policy"},
+		{Name: "retain_streams", Flag: "retain_streams"},
+		{Name: "retain_stream_ports", Flag: "retain_stream_ports", Separator: ","},
+		{Name: "stream_spill_bytes", Flag: "stream_spill_bytes"},
+	}},
+	{"detectors", []Key{
+		{Name: "hijack", Flag: "detect_hijack"},
+		{Name: "injection", Flag: "detect_injection"},
+		{Name: "coalesce_injection", Flag: "detect_coalesce_injection"},
+		{Name: "hijack_detection_packets", Flag: "hijack_detection_packets"},
+		{Name: "plugins", Flag: "detector_plugins", Separator: "; "},
+	}},
+	{"output", []Key{
+		{Name: "attack_loggers", Flag: "attack_loggers", Separator: "; "},
+		{Name: "metadata_attack_log", Flag: "metadata_attack_log"},
+		{Name: "log_connection_events", Flag: "log_connection_events"},
+		{Name: "duplicate_report_window", Flag: "duplicate_report_window"},
+		{Name: "attack_snippet_packets", Flag: "attack_snippet_packets"},
+		{Name: "asn_rib", Flag: "asn_rib"},
+		{Name: "asn_cymru", Flag: "asn_cymru"},
+		{Name: "grpc_listen", Flag: "grpc_listen"},
+		{Name: "grpc_cert", Flag: "grpc_cert"},
+		{Name: "grpc_key", Flag: "grpc_key"},
+		{Name: "control_listen", Flag: "control_listen"},
+		{Name: "control_cert", Flag: "control_cert"},
+		{Name: "control_key", Flag: "control_key"},
+		{Name: "control_client_ca", Flag: "control_client_ca"},
+		{Name: "http_listen", Flag: "http_listen"},
+		{Name: "http_recent_attacks", Flag: "http_recent_attacks"},
+		{Name: "http_evidence", Flag: "http_evidence"},
+		{Name: "debug_listen", Flag: "debug_listen"},
+		{Name: "metrics_listen", Flag: "metrics_listen"},
+		{Name: "statsd", Flag: "statsd"},
+		{Name: "statsd_prefix", Flag: "statsd_prefix"},
+		{Name: "statsd_tags", Flag: "statsd_tags"},
+		{Name: "statsd_dogstatsd", Flag: "statsd_dogstatsd"},
+		{Name: "statsd_interval", Flag: "statsd_interval"},
+		{Name: "dump_file", Flag: "dump_file"},
+	}},
+	{"logs", []Key{
+		{Name: "output_dir", Flag: "o"},
+		{Name: "log_dir", Flag: "l"},
+		{Name: "archive_dir", Flag: "archive_dir"},
+		{Name: "summary", Flag: "summary"},
+		{Name: "summary_dir", Flag: "summary_dir"},
+		{Name: "summary_top", Flag: "summary_top"},
+		{Name: "log_packets", Flag: "log_packets"},
+		{Name: "pcapng", Flag: "pcapng"},
+		{Name: "max_pcap_log_size", Flag: "max_pcap_log_size"},
+		{Name: "max_pcap_rotations", Flag: "max_pcap_rotations"},
+		{Name: "max_pcap_log_age", Flag: "max_pcap_log_age"},
+		{Name: "packet_log_template", Flag: "packet_log_template"},
+		{Name: "pcap_rotate_pattern", Flag: "pcap_rotate_pattern"},
+		{Name: "compress_logs", Flag: "compress_logs"},
+		{Name: "evidence_retention", Flag: "evidence_retention", Separator: "; "},
+		{Name: "evidence_reap_interval", Flag: "evidence_reap_interval"},
+		{Name: "log_level", Flag: "log_level"},
+		{Name: "log_file", Flag: "log_file"},
+		{Name: "debug_flows", Flag: "log_debug_flows", Separator: ","},
+	}},
+	{"sensor", []Key{
+		{Name: "id", Flag: "sensor"},
+		{Name: "site", Flag: "site"},
+		{Name: "tags", Flag: "sensor_tags", Separator: ",", Pairs: true},
+	}},
+}
+
+// Setting is a flag value given by a configuration file.
+type Setting struct {
+	Section string
+	Key     Key
+	Value   string
+	Line    int
+}
+
+// Config is a loaded configuration file.
+type Config struct {
+	Path     string
+	Settings []Setting
+}
+
+// Load reads the configuration file at path, as TOML if it is named
+// *.toml and as YAML otherwise.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %s", err)
+	}
+	format := "yaml"
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		format = "toml"
+	}
+	return Parse(path, data, format)
+}
+
+// Parse parses and validates the configuration in data, in the given
+// format, yaml or toml; name is used in errors.
+func Parse(name string, data []byte, format string) (*Config, error) {
+	var root *node
+	var err error
+	switch format {
+	case "yaml", "yml":
+		root, err = parseYAML(string(data))
+	case "toml":
+		root, err = parseTOML(string(data))
+	default:
+		return nil, fmt.Errorf("%s: unknown config format %s", name, format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s:%s", name, err)
+	}
+	config := Config{
+		Path: name,
+	}
+	if root.kind != TABLE_NODE {
+		return nil, fmt.Errorf("%s:%d: expected sections, found a %s", name, root.line, root.kind)
+	}
+	for _, sectionName := range root.keys {
+		sectionNode := root.fields[sectionName]
+		section := findSection(sectionName)
+		if section == nil {
+			return nil, fmt.Errorf("%s:%d: unknown section %q%s", name, sectionNode.line, sectionName, suggest(sectionName, sectionNames()))
+		}
+		if sectionNode.kind == SCALAR_NODE && sectionNode.scalar == "" {
+			continue
+		}
+		if sectionNode.kind != TABLE_NODE {
+			return nil, fmt.Errorf("%s:%d: section %s must be a table of settings, not a %s", name, sectionNode.line, sectionName, sectionNode.kind)
+		}
+		for _, keyName := range sectionNode.keys {
+			valueNode := sectionNode.fields[keyName]
+			key := section.find(keyName)
+			if key == nil {
+				return nil, fmt.Errorf("%s:%d: unknown key %q in section %s%s", name, valueNode.line, keyName, sectionName, suggestKey(section, keyName))
+			}
+			value, err := key.flagValue(valueNode)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s.%s %s", name, valueNode.line, sectionName, keyName, err)
+			}
+			config.Settings = append(config.Settings, Setting{
+				Section: sectionName,
+				Key:     *key,
+				Value:   value,
+				Line:    valueNode.line,
+			})
+		}
+	}
+	return &config, nil
+}
+
+// Apply sets the flags of flags to the values of the configuration,
+// except those already set on the command line.
+func (c *Config) Apply(flags *flag.FlagSet) error {
+	given := givenFlags(flags)
+	for _, setting := range c.Settings {
+		if given[setting.Key.Flag] {
+			continue
+		}
+		if _, err := c.set(flags, setting); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set sets the flag of setting, returning its previous value.
+func (c *Config) set(flags *flag.FlagSet, setting Setting) (string, error) {
+	f := flags.Lookup(setting.Key.Flag)
+	if f == nil {
+		return "", fmt.Errorf("%s:%d: %s.%s: no such flag -%s", c.Path, setting.Line, setting.Section, setting.Key.Name, setting.Key.Flag)
+	}
+	previous := f.Value.String()
+	value := setting.Value
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		value = yamlBool(value)
+	}
+	if err := flags.Set(setting.Key.Flag, value); err != nil {
+		return "", fmt.Errorf("%s:%d: %s.%s: invalid value %q: %s", c.Path, setting.Line, setting.Section, setting.Key.Name, setting.Value, err)
+	}
+	return previous, nil
+}
+
+func givenFlags(flags *flag.FlagSet) map[string]bool {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	return given
+}
+
+// Loader applies a configuration file to flags each time it is loaded,
+// so that a running program may pick up changes to the file.
+type Loader struct {
+	Path  string
+	flags *flag.FlagSet
+	given map[string]bool
+}
+
+// NewLoader returns a Loader of the configuration file at path; the flags
+// set when it is created, on the command line, take precedence over the file.
+func NewLoader(path string, flags *flag.FlagSet) *Loader {
+	return &Loader{
+		Path:  path,
+		flags: flags,
+		given: givenFlags(flags),
+	}
+}
+
+// Load loads the configuration file and applies it, returning the names
+// of the flags whose values changed. Flags the file no longer sets are
+// reset to their defaults. If the file is invalid no flag is changed.
+func (l *Loader) Load() ([]string, error) {
+	c, err := Load(l.Path)
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]Setting)
+	for _, setting := range c.Settings {
+		settings[setting.Key.Flag] = setting
+	}
+	previous := make(map[string]string)
+	var changed []string
+	for _, section := range SECTIONS {
+		for _, key := range section.Keys {
+			if l.given[key.Flag] {
+				continue
+			}
+			setting, ok := settings[key.Flag]
+			if !ok {
+				f := l.flags.Lookup(key.Flag)
+				if f == nil {
+					continue
+				}
+				setting = Setting{Section: section.Name, Key: key, Value: f.DefValue}
+			}
+			value, err := c.set(l.flags, setting)
+			if err != nil {
+				for name, value := range previous {
+					l.flags.Set(name, value)
+				}
+				return nil, err
+			}
+			if value != l.flags.Lookup(key.Flag).Value.String() {
+				previous[key.Flag] = value
+				changed = append(changed, key.Flag)
+			}
+		}
+	}
+	return changed, nil
+}
+
+// yamlBool returns the YAML 1.1 booleans yes, no, on and off, so often
+// used in configuration files, as true or false.
+func yamlBool(value string) string {
+	switch strings.ToLower(value) {
+	case "yes", "on", "y":
+		return "true"
+	case "no", "off", "n":
+		return "false"
+	}
+	return value
+}
+
+// flagValue returns the flag value given by n.
+func (k *Key) flagValue(n *node) (string, error) {
+	switch n.kind {
+	case SCALAR_NODE:
+		return n.scalar, nil
+	case LIST_NODE:
+		if k.Separator == "" || k.Pairs {
+			return "", fmt.Errorf("takes a single value, not a list")
+		}
+		items := make([]string, len(n.items))
+		for i, item := range n.items {
+			if item.kind != SCALAR_NODE {
+				return "", fmt.Errorf("list items must be single values, found a %s on line %d", item.kind, item.line)
+			}
+			items[i] = item.scalar
+		}
+		return strings.Join(items, k.Separator), nil
+	default:
+		if !k.Pairs {
+			return "", fmt.Errorf("takes a single value, not a table")
+		}
+		pairs := make([]string, len(n.keys))
+		for i, name := range n.keys {
+			value := n.fields[name]
+			if value.kind != SCALAR_NODE {
+				return "", fmt.Errorf("values must be single values, found a %s on line %d", value.kind, value.line)
+			}
+			pairs[i] = name + "=" + value.scalar
+		}
+		return strings.Join(pairs, k.Separator), nil
+	}
+}
+
+func (s *Section) find(name string) *Key {
+	for i := range s.Keys {
+		if s.Keys[i].Name == name {
+			return &s.Keys[i]
+		}
+	}
+	return nil
+}
+
+func findSection(name string) *Section {
+	for i := range SECTIONS {
+		if SECTIONS[i].Name == name {
+			return &SECTIONS[i]
+		}
+	}
+	return nil
+}
+
+func sectionNames() []string {
+	names := make([]string, len(SECTIONS))
+	for i, section := range SECTIONS {
+		names[i] = section.Name
+	}
+	return names
+}
+
+// suggestKey points out where an unknown key of section belongs: the
+// key of the same name or flag in another section, or a similarly named key.
+func suggestKey(section *Section, name string) string {
+	for _, other := range SECTIONS {
+		for _, key := range other.Keys {
+			if key.Name == name || key.Flag == name {
+				if other.Name == section.Name {
+					return fmt.Sprintf(", did you mean %s?", key.Name)
+				}
+				return fmt.Sprintf(", did you mean %s.%s?", other.Name, key.Name)
+			}
+		}
+	}
+	names := make([]string, len(section.Keys))
+	for i, key := range section.Keys {
+		names[i] = key.Name
+	}
+	return suggest(name, names)
+}
+
+// suggest returns a hint naming the closest of names to name, or if none
+// is close all of them.
+func suggest(name string, names []string) string {
+	best, bestDistance := "", len(name)/2+1
+	for _, candidate := range names {
+		if d := editDistance(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	if best != "" {
+		return fmt.Sprintf(", did you mean %s?", best)
+	}
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	return fmt.Sprintf(", expected one of %s", strings.Join(sorted, ", "))
+}
+
+// editDistance returns the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,199 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFlags() (*flag.FlagSet, map[string]interface{}) {
+	flags := flag.NewFlagSet("honeyBadger", flag.ContinueOnError)
+	values := map[string]interface{}{
+		"daq":              flags.String("daq", "libpcap", ""),
+		"i":                flags.String("i", "eth0", ""),
+		"s":                flags.Int("s", 65536, ""),
+		"tcp_idle_timeout": flags.Duration("tcp_idle_timeout", 10*time.Minute, ""),
+		"detect_hijack":    flags.Bool("detect_hijack", true, ""),
+		"sample_rate":      flags.Float64("sample_rate", 0, ""),
+		"attack_loggers":   flags.String("attack_loggers", "", ""),
+		"priority_ports":   flags.String("priority_ports", "", ""),
+		"sensor_tags":      flags.String("sensor_tags", "", ""),
+	}
+	return flags, values
+}
+
+func checkFlags(t *testing.T, values map[string]interface{}) {
+	if *values["daq"].(*string) != "AF_PACKET" || *values["i"].(*string) != "eth0" {
+		t.Errorf("capture daq %s interface %s", *values["daq"].(*string), *values["i"].(*string))
+	}
+	if *values["s"].(*int) != 1500 || *values["sample_rate"].(*float64) != 0.25 {
+		t.Errorf("snaplen %d sample rate %f", *values["s"].(*int), *values["sample_rate"].(*float64))
+	}
+	if *values["tcp_idle_timeout"].(*time.Duration) != time.Minute || *values["detect_hijack"].(*bool) {
+		t.Errorf("idle timeout %s detect hijack %v", *values["tcp_idle_timeout"].(*time.Duration), *values["detect_hijack"].(*bool))
+	}
+	if loggers := *values["attack_loggers"].(*string); loggers != "json; cef:file=/var/log/honeybadger.cef" {
+		t.Errorf("attack loggers %q", loggers)
+	}
+	if ports := *values["priority_ports"].(*string); ports != "22,443" {
+		t.Errorf("priority ports %q", ports)
+	}
+	if tags := *values["sensor_tags"].(*string); tags != "rack=b4,env=prod" {
+		t.Errorf("sensor tags %q", tags)
+	}
+}
+
+func TestYAMLConfig(t *testing.T) {
+	config, err := Parse("honeybadger.yaml", []byte(`---
+# sensor tap-3
+capture:
+  daq: AF_PACKET   # mmap'd capture
+  interface: eth1
+  snaplen: 1500
+connections:
+  tcp_idle_timeout: 1m
+  sample_rate: 0.25
+  priority_ports: [22, 443]
+detectors:
+  hijack: no
+output:
+  attack_loggers:
+  - json
+  - "cef:file=/var/log/honeybadger.cef"
+sensor:
+  tags: {rack: b4, env: 'prod'}
+logs:
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, values := testFlags()
+	if err := flags.Parse([]string{"-i", "eth0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Apply(flags); err != nil {
+		t.Fatal(err)
+	}
+	checkFlags(t, values)
+}
+
+func TestTOMLConfig(t *testing.T) {
+	config, err := Parse("honeybadger.toml", []byte(`
+# sensor tap-3
+[capture]
+daq = "AF_PACKET"
+interface = 'eth1'
+snaplen = 1_500
+
+[connections]
+tcp_idle_timeout = "1m"
+sample_rate = 0.25
+priority_ports = [22, 443]
+
+[detectors]
+hijack = false
+
+[output]
+attack_loggers = [
+  "json",  # the default
+  "cef:file=/var/log/honeybadger.cef",
+]
+
+[sensor]
+tags = { rack = "b4", env = "prod" }
+`), "toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, values := testFlags()
+	if err := flags.Parse([]string{"-i", "eth0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Apply(flags); err != nil {
+		t.Fatal(err)
+	}
+	checkFlags(t, values)
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		format string
+		in     string
+		want   string
+	}{
+		{"yaml", "capture:\n  daq: AF_PACKET\n  daq: libpcap\n", "test:3: duplicate key \"daq\", first given on line 2"},
+		{"yaml", "captrue:\n  daq: AF_PACKET\n", "test:1: unknown section \"captrue\", did you mean capture?"},
+		{"yaml", "capture:\n  detect_hijack: false\n", "test:2: unknown key \"detect_hijack\" in section capture, did you mean detectors.hijack?"},
+		{"yaml", "capture:\n  snaplne: 1500\n", "test:2: unknown key \"snaplne\" in section capture, did you mean snaplen?"},
+		{"yaml", "capture:\n  daq: [AF_PACKET, libpcap]\n", "test:2: capture.daq takes a single value, not a list"},
+		{"yaml", "capture:\n\tdaq: AF_PACKET\n", "test:2: tabs are not allowed in YAML indentation"},
+		{"yaml", "capture:\n  filter: |\n    tcp\n", "test:2: YAML block scalars are not supported, quote the value instead"},
+		{"yaml", "capture:\n  daq: AF_PACKET\n   snaplen: 1500\n", "test:3: unexpected indentation"},
+		{"toml", "daq = \"AF_PACKET\"\n", "test:1: key \"daq\" must be in a [section]"},
+		{"toml", "[capture]\ndaq = AF_PACKET\n", "test:2: invalid value AF_PACKET, strings must be quoted"},
+		{"toml", "[capture]\ndaq = \"AF_PACKET\n", "test:2: unterminated string"},
+		{"toml", "[capture.pcap]\n", "test:1: dotted keys are not supported: capture.pcap"},
+	}
+	for _, test := range tests {
+		_, err := Parse("test", []byte(test.in), test.format)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%s %q: got error %v, expected %s", test.format, test.in, err, test.want)
+		}
+	}
+}
+
+func TestConfigInvalidValue(t *testing.T) {
+	config, err := Parse("test", []byte("connections:\n  tcp_idle_timeout: 10\n"), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, _ := testFlags()
+	err = config.Apply(flags)
+	if err == nil || !strings.HasPrefix(err.Error(), `test:2: connections.tcp_idle_timeout: invalid value "10": `) {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestLoaderReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "honeybadger.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("capture:\n  daq: AF_PACKET\n  interface: eth1\n  snaplen: 1500\n")
+	flags, values := testFlags()
+	if err := flags.Parse([]string{"-i", "eth0"}); err != nil {
+		t.Fatal(err)
+	}
+	loader := NewLoader(path, flags)
+	if _, err := loader.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if *values["daq"].(*string) != "AF_PACKET" || *values["i"].(*string) != "eth0" || *values["s"].(*int) != 1500 {
+		t.Fatalf("loaded daq %s interface %s snaplen %d", *values["daq"].(*string), *values["i"].(*string), *values["s"].(*int))
+	}
+
+	write("capture:\n  daq: AF_PACKET\n  interface: eth2\nconnections:\n  tcp_idle_timeout: 10m\n  sample_rate: 0.5\n")
+	changed, err := loader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(changed, " ") != "s sample_rate" {
+		t.Errorf("changed flags %v", changed)
+	}
+	if *values["s"].(*int) != 65536 || *values["i"].(*string) != "eth0" {
+		t.Errorf("reloaded snaplen %d interface %s", *values["s"].(*int), *values["i"].(*string))
+	}
+
+	write("capture:\n  daq: libpcap\n  snaplen: big\n")
+	if _, err := loader.Load(); err == nil {
+		t.Fatal("invalid config loaded")
+	}
+	if *values["daq"].(*string) != "AF_PACKET" || *values["sample_rate"].(*float64) != 0.5 {
+		t.Errorf("invalid config changed daq to %s, sample rate to %f", *values["daq"].(*string), *values["sample_rate"].(*float64))
+	}
+}
@@ -0,0 +1,280 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseTOML parses the subset of TOML configuration files are written
+// in: tables of key/value pairs whose values are strings, integers,
+// floats, booleans, arrays of those, which may span lines, and inline
+// tables. Nested tables, arrays of tables, dotted keys, multi-line
+// strings and dates are rejected.
+func parseTOML(data string) (*node, error) {
+	root := newTable(1)
+	table := root
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		number := i + 1
+		text, err := stripTOMLComment(strings.TrimRight(lines[i], "\r"))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", number, err)
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "[[") {
+			return nil, fmt.Errorf("%d: arrays of tables are not supported", number)
+		}
+		if text[0] == '[' {
+			if !strings.HasSuffix(text, "]") {
+				return nil, fmt.Errorf("%d: malformed table header %s", number, text)
+			}
+			name, err := tomlKey(strings.TrimSpace(text[1 : len(text)-1]))
+			if err != nil {
+				return nil, fmt.Errorf("%d: %s", number, err)
+			}
+			table = newTable(number)
+			if err := root.set(name, table); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		eq := strings.IndexByte(text, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%d: expected \"key = value\"", number)
+		}
+		key, err := tomlKey(strings.TrimSpace(text[:eq]))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", number, err)
+		}
+		valueText := strings.TrimSpace(text[eq+1:])
+		// arrays may continue over the following lines
+		for strings.HasPrefix(valueText, "[") && !tomlBalanced(valueText) && i+1 < len(lines) {
+			i++
+			more, err := stripTOMLComment(strings.TrimRight(lines[i], "\r"))
+			if err != nil {
+				return nil, fmt.Errorf("%d: %s", i+1, err)
+			}
+			valueText += " " + strings.TrimSpace(more)
+		}
+		value, rest, err := tomlValue(valueText, number)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, fmt.Errorf("%d: unexpected %q after value", number, strings.TrimSpace(rest))
+		}
+		if table == root && value.kind != TABLE_NODE {
+			return nil, fmt.Errorf("%d: key %q must be in a [section]", number, key)
+		}
+		if err := table.set(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return root, nil
+}
+
+// tomlKey returns the name of a bare or quoted key.
+func tomlKey(text string) (string, error) {
+	if text == "" {
+		return "", fmt.Errorf("missing key")
+	}
+	if text[0] == '"' || text[0] == '\'' {
+		value, rest, err := tomlString(text)
+		if err != nil || rest != "" {
+			return "", fmt.Errorf("malformed key %s", text)
+		}
+		return value, nil
+	}
+	for _, c := range text {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			if c == '.' {
+				return "", fmt.Errorf("dotted keys are not supported: %s", text)
+			}
+			return "", fmt.Errorf("malformed key %s", text)
+		}
+	}
+	return text, nil
+}
+
+// tomlValue parses the value at the start of text, returning the text after it.
+func tomlValue(text string, line int) (*node, string, error) {
+	if text == "" {
+		return nil, "", fmt.Errorf("%d: missing value", line)
+	}
+	switch text[0] {
+	case '"', '\'':
+		if strings.HasPrefix(text, `"""`) || strings.HasPrefix(text, "'''") {
+			return nil, "", fmt.Errorf("%d: multi-line strings are not supported", line)
+		}
+		value, rest, err := tomlString(text)
+		if err != nil {
+			return nil, "", fmt.Errorf("%d: %s", line, err)
+		}
+		return &node{kind: SCALAR_NODE, line: line, scalar: value}, rest, nil
+	case '[':
+		list := &node{kind: LIST_NODE, line: line}
+		rest := strings.TrimSpace(text[1:])
+		for {
+			if rest == "" {
+				return nil, "", fmt.Errorf("%d: unterminated array", line)
+			}
+			if rest[0] == ']' {
+				return list, rest[1:], nil
+			}
+			item, after, err := tomlValue(rest, line)
+			if err != nil {
+				return nil, "", err
+			}
+			list.items = append(list.items, item)
+			rest = strings.TrimSpace(after)
+			if rest != "" && rest[0] == ',' {
+				rest = strings.TrimSpace(rest[1:])
+			} else if rest != "" && rest[0] != ']' {
+				return nil, "", fmt.Errorf("%d: expected , or ] in array", line)
+			}
+		}
+	case '{':
+		table := newTable(line)
+		rest := strings.TrimSpace(text[1:])
+		for {
+			if rest == "" {
+				return nil, "", fmt.Errorf("%d: unterminated inline table, inline tables must be on one line", line)
+			}
+			if rest[0] == '}' {
+				return table, rest[1:], nil
+			}
+			eq := strings.IndexByte(rest, '=')
+			if eq < 0 {
+				return nil, "", fmt.Errorf("%d: expected \"key = value\" in inline table", line)
+			}
+			key, err := tomlKey(strings.TrimSpace(rest[:eq]))
+			if err != nil {
+				return nil, "", fmt.Errorf("%d: %s", line, err)
+			}
+			value, after, err := tomlValue(strings.TrimSpace(rest[eq+1:]), line)
+			if err != nil {
+				return nil, "", err
+			}
+			if err := table.set(key, value); err != nil {
+				return nil, "", err
+			}
+			rest = strings.TrimSpace(after)
+			if rest != "" && rest[0] == ',' {
+				rest = strings.TrimSpace(rest[1:])
+			} else if rest != "" && rest[0] != '}' {
+				return nil, "", fmt.Errorf("%d: expected , or } in inline table", line)
+			}
+		}
+	}
+	end := strings.IndexAny(text, ",]}")
+	if end < 0 {
+		end = len(text)
+	}
+	literal := strings.TrimSpace(text[:end])
+	switch {
+	case literal == "true" || literal == "false":
+	case isTOMLNumber(literal):
+		literal = strings.Replace(literal, "_", "", -1)
+	default:
+		return nil, "", fmt.Errorf("%d: invalid value %s, strings must be quoted", line, literal)
+	}
+	return &node{kind: SCALAR_NODE, line: line, scalar: literal}, text[end:], nil
+}
+
+func isTOMLNumber(literal string) bool {
+	plain := strings.Replace(literal, "_", "", -1)
+	if _, err := strconv.ParseInt(plain, 0, 64); err == nil {
+		return true
+	}
+	_, err := strconv.ParseFloat(plain, 64)
+	return err == nil && !strings.ContainsAny(plain, "xXpP")
+}
+
+// tomlString parses the basic or literal string at the start of text,
+// returning the text after it.
+func tomlString(text string) (string, string, error) {
+	end := quotedEnd(text)
+	if text[0] == '\'' {
+		end = strings.IndexByte(text[1:], '\'') + 1
+	}
+	if end <= 0 {
+		return "", "", fmt.Errorf("unterminated string")
+	}
+	if text[0] == '\'' {
+		return text[1:end], text[end+1:], nil
+	}
+	value, err := strconv.Unquote(text[:end+1])
+	if err != nil {
+		return "", "", fmt.Errorf("malformed string %s", text[:end+1])
+	}
+	return value, text[end+1:], nil
+}
+
+// tomlBalanced reports whether the brackets of an array value are closed.
+func tomlBalanced(text string) bool {
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '"', '\'':
+			end := quotedEnd(text[i:])
+			if text[i] == '\'' {
+				end = strings.IndexByte(text[i+1:], '\'') + 1
+			}
+			if end <= 0 {
+				return false
+			}
+			i += end
+		case '[':
+			depth++
+		case ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// stripTOMLComment removes the comment, if any, from a line.
+func stripTOMLComment(line string) (string, error) {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			end := quotedEnd(line[i:])
+			if end < 0 {
+				return "", fmt.Errorf("unterminated string")
+			}
+			i += end
+		case '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated string")
+			}
+			i += end + 1
+		case '#':
+			return line[:i], nil
+		}
+	}
+	return line, nil
+}
@@ -0,0 +1,410 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type nodeKind int
+
+const (
+	SCALAR_NODE nodeKind = iota
+	LIST_NODE
+	TABLE_NODE
+)
+
+func (k nodeKind) String() string {
+	switch k {
+	case SCALAR_NODE:
+		return "single value"
+	case LIST_NODE:
+		return "list"
+	}
+	return "table"
+}
+
+// node is a parsed value of a configuration file, either a scalar,
+// kept as the text the flags parse, a list or a table with its keys in
+// the order given.
+type node struct {
+	kind   nodeKind
+	line   int
+	scalar string
+	items  []*node
+	keys   []string
+	fields map[string]*node
+}
+
+func newTable(line int) *node {
+	return &node{
+		kind:   TABLE_NODE,
+		line:   line,
+		fields: make(map[string]*node),
+	}
+}
+
+// set adds the value of key to the table, rejecting duplicate keys.
+func (n *node) set(key string, value *node) error {
+	if previous, ok := n.fields[key]; ok {
+		return fmt.Errorf("%d: duplicate key %q, first given on line %d", value.line, key, previous.line)
+	}
+	n.keys = append(n.keys, key)
+	n.fields[key] = value
+	return nil
+}
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// parseYAML parses the subset of YAML configuration files are written
+// in: block mappings and sequences, flow sequences and mappings of
+// scalars, plain and quoted scalars and comments. Anchors, tags,
+// block scalars and multiple documents are rejected.
+func parseYAML(data string) (*node, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(data, "\n") {
+		number := i + 1
+		raw = strings.TrimRight(raw, "\r")
+		text, err := stripYAMLComment(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", number, err)
+		}
+		trimmed := strings.TrimLeft(text, " ")
+		if strings.TrimSpace(trimmed) == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("%d: tabs are not allowed in YAML indentation", number)
+		}
+		if trimmed == "---" && len(lines) == 0 {
+			continue
+		}
+		if trimmed == "---" || trimmed == "..." {
+			return nil, fmt.Errorf("%d: only one YAML document is allowed", number)
+		}
+		lines = append(lines, yamlLine{
+			number: number,
+			indent: len(text) - len(trimmed),
+			text:   strings.TrimRight(trimmed, " \t"),
+		})
+	}
+	if len(lines) == 0 {
+		return newTable(1), nil
+	}
+	p := yamlParser{lines: lines}
+	root, err := p.block(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("%d: unexpected indentation", p.lines[p.pos].number)
+	}
+	return root, nil
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// block parses the mapping or sequence whose entries are indented by indent.
+func (p *yamlParser) block(indent int) (*node, error) {
+	first := p.lines[p.pos]
+	if isSequenceEntry(first.text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func isSequenceEntry(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) sequence(indent int) (*node, error) {
+	list := &node{
+		kind: LIST_NODE,
+		line: p.lines[p.pos].number,
+	}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("%d: unexpected indentation", line.number)
+		}
+		if !isSequenceEntry(line.text) {
+			return nil, fmt.Errorf("%d: expected a list item starting with \"- \"", line.number)
+		}
+		p.pos++
+		rest := strings.TrimSpace(strings.TrimPrefix(line.text, "-"))
+		if rest == "" {
+			return nil, fmt.Errorf("%d: empty list item", line.number)
+		}
+		if _, _, ok := splitYAMLKey(rest); ok {
+			return nil, fmt.Errorf("%d: mappings in lists are not supported", line.number)
+		}
+		item, err := yamlValue(rest, line.number)
+		if err != nil {
+			return nil, err
+		}
+		list.items = append(list.items, item)
+	}
+	return list, nil
+}
+
+func (p *yamlParser) mapping(indent int) (*node, error) {
+	table := newTable(p.lines[p.pos].number)
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("%d: unexpected indentation", line.number)
+		}
+		key, rest, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("%d: expected \"key: value\"", line.number)
+		}
+		p.pos++
+		var value *node
+		var err error
+		if rest != "" {
+			value, err = yamlValue(rest, line.number)
+		} else if p.pos < len(p.lines) && (p.lines[p.pos].indent > indent ||
+			(p.lines[p.pos].indent == indent && isSequenceEntry(p.lines[p.pos].text))) {
+			value, err = p.block(p.lines[p.pos].indent)
+		} else {
+			value = &node{kind: SCALAR_NODE, line: line.number}
+		}
+		if err != nil {
+			return nil, err
+		}
+		value.line = line.number
+		if err := table.set(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return table, nil
+}
+
+// splitYAMLKey splits "key: value" into its key and value.
+func splitYAMLKey(text string) (string, string, bool) {
+	var key string
+	rest := text
+	if text[0] == '"' || text[0] == '\'' {
+		end := quotedEnd(text)
+		if end < 0 {
+			return "", "", false
+		}
+		unquoted, err := yamlScalar(text[:end+1])
+		if err != nil {
+			return "", "", false
+		}
+		key, rest = unquoted, text[end+1:]
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", false
+		}
+		rest = rest[1:]
+	} else {
+		i := strings.Index(text, ": ")
+		if i < 0 && strings.HasSuffix(text, ":") {
+			i = len(text) - 1
+		}
+		if i <= 0 || strings.ContainsAny(text[:1], "[{") {
+			return "", "", false
+		}
+		key, rest = strings.TrimSpace(text[:i]), text[i+1:]
+	}
+	if rest != "" && rest[0] != ' ' {
+		return "", "", false
+	}
+	return key, strings.TrimSpace(rest), true
+}
+
+// yamlValue parses the value of a key or list item on one line.
+func yamlValue(text string, line int) (*node, error) {
+	switch text[0] {
+	case '[', '{':
+		value, rest, err := yamlFlow(text, line)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, fmt.Errorf("%d: unexpected %q after %c", line, rest, text[0])
+		}
+		return value, nil
+	case '&', '*', '!':
+		return nil, fmt.Errorf("%d: YAML anchors, aliases and tags are not supported", line)
+	case '|', '>':
+		return nil, fmt.Errorf("%d: YAML block scalars are not supported, quote the value instead", line)
+	}
+	scalar, err := yamlScalar(text)
+	if err != nil {
+		return nil, fmt.Errorf("%d: %s", line, err)
+	}
+	return &node{kind: SCALAR_NODE, line: line, scalar: scalar}, nil
+}
+
+// yamlFlow parses a flow sequence or mapping of scalars at the start of
+// text, returning the text after it.
+func yamlFlow(text string, line int) (*node, string, error) {
+	open := text[0]
+	close := byte(']')
+	value := &node{kind: LIST_NODE, line: line}
+	if open == '{' {
+		close = '}'
+		value = newTable(line)
+	}
+	rest := strings.TrimSpace(text[1:])
+	for {
+		if rest == "" {
+			return nil, "", fmt.Errorf("%d: unterminated %c, flow collections must be on one line", line, open)
+		}
+		if rest[0] == close {
+			return value, rest[1:], nil
+		}
+		end := flowItemEnd(rest, close)
+		if end < 0 {
+			return nil, "", fmt.Errorf("%d: unterminated quoted value", line)
+		}
+		item := strings.TrimSpace(rest[:end])
+		rest = rest[end:]
+		if rest != "" && rest[0] == ',' {
+			rest = strings.TrimSpace(rest[1:])
+		}
+		if item == "" {
+			return nil, "", fmt.Errorf("%d: empty item in %c", line, open)
+		}
+		if open == '[' {
+			if item[0] == '[' || item[0] == '{' {
+				return nil, "", fmt.Errorf("%d: nested collections are not supported", line)
+			}
+			scalar, err := yamlScalar(item)
+			if err != nil {
+				return nil, "", fmt.Errorf("%d: %s", line, err)
+			}
+			value.items = append(value.items, &node{kind: SCALAR_NODE, line: line, scalar: scalar})
+			continue
+		}
+		key, valueText, ok := splitYAMLKey(item)
+		if !ok {
+			return nil, "", fmt.Errorf("%d: expected \"key: value\" in {}", line)
+		}
+		scalar, err := yamlScalar(valueText)
+		if err != nil {
+			return nil, "", fmt.Errorf("%d: %s", line, err)
+		}
+		if err := value.set(key, &node{kind: SCALAR_NODE, line: line, scalar: scalar}); err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+// flowItemEnd returns the index of the comma or closing bracket ending
+// the flow collection item at the start of text.
+func flowItemEnd(text string, close byte) int {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '"', '\'':
+			end := quotedEnd(text[i:])
+			if end < 0 {
+				return -1
+			}
+			i += end
+		case ',', close:
+			return i
+		}
+	}
+	return len(text)
+}
+
+// yamlScalar returns the value of a plain or quoted scalar.
+func yamlScalar(text string) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	switch text[0] {
+	case '"':
+		if quotedEnd(text) != len(text)-1 {
+			return "", fmt.Errorf("malformed quoted value %s", text)
+		}
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return "", fmt.Errorf("malformed quoted value %s", text)
+		}
+		return value, nil
+	case '\'':
+		if quotedEnd(text) != len(text)-1 {
+			return "", fmt.Errorf("malformed quoted value %s", text)
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	}
+	if text == "~" || text == "null" {
+		return "", nil
+	}
+	return text, nil
+}
+
+// quotedEnd returns the index of the quote closing the quoted value at
+// the start of text, or -1 if it is not closed.
+func quotedEnd(text string) int {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case text[i] == quote && quote == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// stripYAMLComment removes the comment, if any, from a line.
+func stripYAMLComment(line string) (string, error) {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '"', '\'':
+			if i > 0 && !strings.ContainsRune(" \t[{,:-", rune(line[i-1])) {
+				continue
+			}
+			end := quotedEnd(line[i:])
+			if end < 0 {
+				return "", fmt.Errorf("unterminated quoted value")
+			}
+			i += end
+		case '#':
+			if i == 0 || line[i-1] == ' ' || line[i-1] == '\t' {
+				return line[:i], nil
+			}
+		}
+	}
+	return line, nil
+}
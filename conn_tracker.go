@@ -0,0 +1,290 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// ConnTracker tracks connections by their 4-tuple. The connections are split
+// into independent shards keyed by a hash of the flow, symmetric so that both
+// directions of a connection belong to the same shard. Each shard has its own
+// lock; workers each handling the connections of distinct shards therefore
+// never contend with one another, and each shard may be garbage collected
+// on its own.
+//
+// If MaxConnections is set each shard tracks at most its share of
+// MaxConnections connections; tracking another connection evicts the shard's
+// least recently active one.
+type ConnTracker struct {
+	// counters, accessed atomically
+	opened    uint64
+	closed    uint64
+	evictions uint64
+	lookups   uint64
+	misses    uint64
+
+	MaxConnections int
+
+	shards []*connTrackerShard
+
+	metricsMutex sync.Mutex
+	metricsTime  time.Time
+	metricsLast  ConnTrackerMetrics
+}
+
+// ConnTrackerMetrics are the runtime metrics of a ConnTracker.
+// Opened, Closed, Evictions, Lookups and Misses count since the
+// tracker was created; OpenedPerSecond and ClosedPerSecond are
+// rates since the previous metrics were taken.
+type ConnTrackerMetrics struct {
+	Connections     int            `json:"connections"`
+	ByState         map[string]int `json:"by_state"`
+	Opened          uint64         `json:"opened"`
+	Closed          uint64         `json:"closed"`
+	Evictions       uint64         `json:"evictions"`
+	Lookups         uint64         `json:"lookups"`
+	Misses          uint64         `json:"misses"`
+	OpenedPerSecond float64        `json:"opened_per_second"`
+	ClosedPerSecond float64        `json:"closed_per_second"`
+}
+
+type trackedConn struct {
+	key  types.FlowKey
+	conn ConnectionInterface
+}
+
+// connTrackerShard keeps its connections in a list ordered by activity,
+// the most recently active connection at the front, and indexed by the
+// connection's canonical flow key.
+type connTrackerShard struct {
+	mutex    sync.Mutex
+	pool     map[types.FlowKey]*list.Element
+	activity *list.List
+}
+
+// NewConnTracker returns a ConnTracker with the given number of shards;
+// at least one.
+func NewConnTracker(shardCount int) *ConnTracker {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	t := ConnTracker{
+		shards:      make([]*connTrackerShard, shardCount),
+		metricsTime: time.Now(),
+	}
+	for n := range t.shards {
+		t.shards[n] = &connTrackerShard{
+			pool:     make(map[types.FlowKey]*list.Element),
+			activity: list.New(),
+		}
+	}
+	return &t
+}
+
+// ShardCount returns the number of shards.
+func (t *ConnTracker) ShardCount() int {
+	return len(t.shards)
+}
+
+// ShardOf returns the index of the shard tracking the given flow's connection.
+// Flows of either direction of a connection map to the same shard.
+func (t *ConnTracker) ShardOf(flow *types.TcpIpFlow) int {
+	ipFlow, tcpFlow := flow.Flows()
+	hash := ipFlow.FastHash()*31 + tcpFlow.FastHash()
+	return int(hash % uint64(len(t.shards)))
+}
+
+// shardCapacity returns the maximum number of connections per shard or 0 if unbounded.
+func (t *ConnTracker) shardCapacity() int {
+	if t.MaxConnections <= 0 {
+		return 0
+	}
+	return (t.MaxConnections + len(t.shards) - 1) / len(t.shards)
+}
+
+// Get returns the connection tracked for the given flow, if any,
+// and marks it as the most recently active of its shard.
+func (t *ConnTracker) Get(flow *types.TcpIpFlow) (ConnectionInterface, bool) {
+	shard := t.shards[t.ShardOf(flow)]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	key, _ := types.NewFlowKey(flow)
+	element := shard.pool[key]
+	atomic.AddUint64(&t.lookups, 1)
+	if element == nil {
+		atomic.AddUint64(&t.misses, 1)
+		return nil, false
+	}
+	shard.activity.MoveToFront(element)
+	return element.Value.(*trackedConn).conn, true
+}
+
+// Put tracks conn as the connection of the given flow. If the flow's shard
+// is full its least recently active connection is no longer tracked and is
+// returned; closing it is left to the caller.
+func (t *ConnTracker) Put(flow *types.TcpIpFlow, conn ConnectionInterface) ConnectionInterface {
+	shard := t.shards[t.ShardOf(flow)]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	key, _ := types.NewFlowKey(flow)
+	if element := shard.pool[key]; element != nil {
+		element.Value.(*trackedConn).conn = conn
+		shard.activity.MoveToFront(element)
+		return nil
+	}
+	var evicted ConnectionInterface
+	if capacity := t.shardCapacity(); capacity > 0 && shard.activity.Len() >= capacity {
+		last := shard.activity.Back().Value.(*trackedConn)
+		t.delete(shard, last.key)
+		atomic.AddUint64(&t.evictions, 1)
+		evicted = last.conn
+	}
+	shard.pool[key] = shard.activity.PushFront(&trackedConn{key: key, conn: conn})
+	atomic.AddUint64(&t.opened, 1)
+	return evicted
+}
+
+// Delete stops tracking the connection of the given flow.
+// An error is returned if no connection is tracked for the flow.
+func (t *ConnTracker) Delete(flow *types.TcpIpFlow) error {
+	shard := t.shards[t.ShardOf(flow)]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	key, _ := types.NewFlowKey(flow)
+	if !t.delete(shard, key) {
+		return fmt.Errorf("no connection tracked for flow %s", flow)
+	}
+	return nil
+}
+
+// Len returns the number of connections tracked by all shards.
+func (t *ConnTracker) Len() int {
+	count := 0
+	for _, shard := range t.shards {
+		shard.mutex.Lock()
+		count += shard.activity.Len()
+		shard.mutex.Unlock()
+	}
+	return count
+}
+
+// Connections returns the connections tracked by all shards.
+func (t *ConnTracker) Connections() []ConnectionInterface {
+	var conns []ConnectionInterface
+	for n := range t.shards {
+		conns = append(conns, t.ShardConnections(n)...)
+	}
+	return conns
+}
+
+// ShardConnections returns the connections tracked by the given shard,
+// the most recently active first.
+func (t *ConnTracker) ShardConnections(n int) []ConnectionInterface {
+	shard := t.shards[n]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	conns := make([]ConnectionInterface, 0, shard.activity.Len())
+	for element := shard.activity.Front(); element != nil; element = element.Next() {
+		conns = append(conns, element.Value.(*trackedConn).conn)
+	}
+	return conns
+}
+
+// Walk calls fn for each tracked connection, shard by shard, until fn returns
+// false. The connections of a shard are collected before fn is called for any
+// of them, fn is therefore free to use the tracker.
+func (t *ConnTracker) Walk(fn func(ConnectionInterface) bool) {
+	for n := range t.shards {
+		for _, conn := range t.ShardConnections(n) {
+			if !fn(conn) {
+				return
+			}
+		}
+	}
+}
+
+// ExpireShard stops tracking the connections of the given shard which have not
+// received a packet since the given time and returns them. Closing them is
+// left to the caller, outside of the shard's lock.
+func (t *ConnTracker) ExpireShard(n int, since time.Time) []ConnectionInterface {
+	shard := t.shards[n]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	var expired []ConnectionInterface
+	for element := shard.activity.Front(); element != nil; {
+		next := element.Next()
+		tracked := element.Value.(*trackedConn)
+		if !tracked.conn.GetLastSeen().After(since) {
+			expired = append(expired, tracked.conn)
+			t.delete(shard, tracked.key)
+		}
+		element = next
+	}
+	return expired
+}
+
+// delete stops tracking the connection of the given key in the shard and
+// returns false if there was none; the shard's lock must be held.
+func (t *ConnTracker) delete(shard *connTrackerShard, key types.FlowKey) bool {
+	element, ok := shard.pool[key]
+	if !ok {
+		return false
+	}
+	shard.activity.Remove(element)
+	delete(shard.pool, key)
+	atomic.AddUint64(&t.closed, 1)
+	return true
+}
+
+// Metrics returns the tracker's runtime metrics. The states of the tracked
+// connections are read unsynchronized; Metrics must be called from the
+// goroutine driving the connections' state machines.
+func (t *ConnTracker) Metrics() ConnTrackerMetrics {
+	metrics := ConnTrackerMetrics{
+		ByState:   make(map[string]int),
+		Opened:    atomic.LoadUint64(&t.opened),
+		Closed:    atomic.LoadUint64(&t.closed),
+		Evictions: atomic.LoadUint64(&t.evictions),
+		Lookups:   atomic.LoadUint64(&t.lookups),
+		Misses:    atomic.LoadUint64(&t.misses),
+	}
+	for _, conn := range t.Connections() {
+		metrics.Connections += 1
+		metrics.ByState[ConnectionStateName(conn.GetState())] += 1
+	}
+
+	t.metricsMutex.Lock()
+	defer t.metricsMutex.Unlock()
+	now := time.Now()
+	if elapsed := now.Sub(t.metricsTime).Seconds(); elapsed > 0 {
+		metrics.OpenedPerSecond = float64(metrics.Opened-t.metricsLast.Opened) / elapsed
+		metrics.ClosedPerSecond = float64(metrics.Closed-t.metricsLast.Closed) / elapsed
+	}
+	t.metricsTime = now
+	t.metricsLast = metrics
+	return metrics
+}
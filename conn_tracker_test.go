@@ -0,0 +1,106 @@
+package HoneyBadger
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+func testFlow(srcPort, dstPort int) *types.TcpIpFlow {
+	ipFlow := gopacket.NewFlow(layers.EndpointIPv4, net.IPv4(1, 2, 3, 4).To4(), net.IPv4(2, 3, 4, 5).To4())
+	tcpSrc := layers.NewTCPPortEndpoint(layers.TCPPort(srcPort))
+	tcpDst := layers.NewTCPPortEndpoint(layers.TCPPort(dstPort))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(tcpSrc, tcpDst)
+	flow := types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	return &flow
+}
+
+func TestConnTrackerShards(t *testing.T) {
+	tracker := NewConnTracker(8)
+	now := time.Now()
+	for port := 1000; port < 1100; port++ {
+		flow := testFlow(port, 80)
+		reverse := flow.Reverse()
+		if tracker.ShardOf(flow) != tracker.ShardOf(&reverse) {
+			t.Fatalf("both directions of %s must map to the same shard", flow)
+		}
+		lastSeen := now
+		if port%2 == 0 {
+			lastSeen = now.Add(-time.Hour)
+		}
+		tracker.Put(flow, MockConnection{clientFlow: *flow, lastSeen: lastSeen})
+	}
+	if tracker.Len() != 100 {
+		t.Fatalf("tracking %d connections, expected 100", tracker.Len())
+	}
+	reverse := testFlow(1000, 80).Reverse()
+	if _, ok := tracker.Get(&reverse); !ok {
+		t.Error("connection not found by its reverse flow")
+	}
+
+	expired := 0
+	for shard := 0; shard < tracker.ShardCount(); shard++ {
+		expired += len(tracker.ExpireShard(shard, now.Add(-time.Minute)))
+	}
+	if expired != 50 || tracker.Len() != 50 || len(tracker.Connections()) != 50 {
+		t.Errorf("expired %d connections leaving %d, expected 50 each", expired, tracker.Len())
+	}
+	if err := tracker.Delete(testFlow(1001, 80)); err != nil {
+		t.Error(err)
+	}
+	if _, ok := tracker.Get(testFlow(1001, 80)); ok || tracker.Len() != 49 {
+		t.Error("deleted connection is still tracked")
+	}
+	if err := tracker.Delete(testFlow(1001, 80)); err == nil {
+		t.Error("deleting an untracked connection did not fail")
+	}
+}
+
+func TestConnTrackerEviction(t *testing.T) {
+	tracker := NewConnTracker(1)
+	tracker.MaxConnections = 3
+	for port := 1; port <= 3; port++ {
+		if evicted := tracker.Put(testFlow(port, 80), MockConnection{clientFlow: *testFlow(port, 80)}); evicted != nil {
+			t.Fatalf("evicted %s below the connection limit", evicted.GetClientFlow())
+		}
+	}
+	// the first connection is active again, leaving the second one idlest
+	tracker.Get(testFlow(1, 80))
+	evicted := tracker.Put(testFlow(4, 80), MockConnection{clientFlow: *testFlow(4, 80)})
+	if evicted == nil || !evicted.GetClientFlow().Equal(testFlow(2, 80)) {
+		t.Fatalf("evicted %v, expected the least recently active connection", evicted)
+	}
+	if _, ok := tracker.Get(testFlow(2, 80)); ok || tracker.Len() != 3 {
+		t.Error("evicted connection is still tracked")
+	}
+}
+
+func TestConnTrackerMetrics(t *testing.T) {
+	tracker := NewConnTracker(1)
+	tracker.MaxConnections = 2
+	for port := 1; port <= 3; port++ {
+		tracker.Put(testFlow(port, 80), MockConnection{clientFlow: *testFlow(port, 80)})
+	}
+	tracker.Get(testFlow(2, 80))
+	tracker.Get(testFlow(4, 80))
+	tracker.Delete(testFlow(3, 80))
+
+	metrics := tracker.Metrics()
+	if metrics.Connections != 1 || metrics.ByState["data-transfer"] != 1 {
+		t.Errorf("%d connections by state %v, expected one in data transfer", metrics.Connections, metrics.ByState)
+	}
+	if metrics.Opened != 3 || metrics.Closed != 2 || metrics.Evictions != 1 || metrics.Lookups != 2 || metrics.Misses != 1 {
+		t.Errorf("metrics %+v", metrics)
+	}
+	if metrics.OpenedPerSecond <= 0 {
+		t.Error("no connections opened per second")
+	}
+	if metrics = tracker.Metrics(); metrics.OpenedPerSecond != 0 {
+		t.Errorf("%f connections opened per second since the previous metrics", metrics.OpenedPerSecond)
+	}
+}
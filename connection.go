@@ -20,19 +20,29 @@
 package HoneyBadger
 
 import (
-	"log"
+	"bytes"
+	"fmt"
+	"encoding/hex"
+	"io"
 	"sync"
 	"time"
 
+	"github.com/david415/HoneyBadger/logging"
 	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket/layers"
 )
 
 const (
 	// Stop looking for handshake hijack after several
 	// packets have traversed the connection after entering
-	// into TCP_DATA_TRANSFER state
+	// into TCP_DATA_TRANSFER state, unless
+	// ConnectionOptions.HijackDetectionPackets says otherwise
 	FIRST_FEW_PACKETS = 12
 
+	// Stream buffers start out with room for this many pages
+	// and grow on demand up to ConnectionOptions.MaxRingPackets
+	INITIAL_RING_PACKETS = 8
+
 	// TCP states
 	TCP_UNKNOWN                = 0
 	TCP_CONNECTION_REQUEST     = 1
@@ -42,17 +52,42 @@ const (
 	TCP_INVALID                = 5
 	TCP_CLOSED                 = 6
 
+	// closing states of either side of the connection;
+	// a side which has neither sent nor received a FIN is established
+	TCP_ESTABLISHED = 0
+
 	// initiating TCP closing finite state machine
-	TCP_FIN_WAIT1 = 0
-	TCP_FIN_WAIT2 = 1
-	TCP_TIME_WAIT = 2
-	TCP_CLOSING   = 3
+	TCP_FIN_WAIT1 = 1
+	TCP_FIN_WAIT2 = 2
+	TCP_TIME_WAIT = 3
+	TCP_CLOSING   = 4
 
 	// initiated TCP closing finite state machine
-	TCP_CLOSE_WAIT = 0
-	TCP_LAST_ACK   = 1
+	TCP_CLOSE_WAIT = 5
+	TCP_LAST_ACK   = 6
 )
 
+// ConnectionStateName returns the name of the given TCP state.
+func ConnectionStateName(state uint8) string {
+	switch state {
+	case TCP_UNKNOWN:
+		return "unknown"
+	case TCP_CONNECTION_REQUEST:
+		return "connection-request"
+	case TCP_CONNECTION_ESTABLISHED:
+		return "connection-established"
+	case TCP_DATA_TRANSFER:
+		return "data-transfer"
+	case TCP_CONNECTION_CLOSING:
+		return "connection-closing"
+	case TCP_INVALID:
+		return "invalid"
+	case TCP_CLOSED:
+		return "closed"
+	}
+	return "unknown"
+}
+
 type ConnectionFactory interface {
 	Build(ConnectionOptions) ConnectionInterface
 }
@@ -66,27 +101,67 @@ func (f *DefaultConnFactory) Build(options ConnectionOptions) ConnectionInterfac
 		ConnectionOptions: options,
 		attackDetected:    false,
 		state:             TCP_UNKNOWN,
-		skipHijackDetectionCount: FIRST_FEW_PACKETS,
+		skipHijackDetectionCount: hijackDetectionPackets(options),
 		clientNextSeq:            types.InvalidSequence,
 		serverNextSeq:            types.InvalidSequence,
-		ClientStreamRing:         types.NewRing(options.MaxRingPackets),
-		ServerStreamRing:         types.NewRing(options.MaxRingPackets),
+		ClientStreamBuffer:       NewStreamBuffer(options.MaxRingPackets, options.MaxRingBytes),
+		ServerStreamBuffer:       NewStreamBuffer(options.MaxRingPackets, options.MaxRingBytes),
 		clientFlow:               &types.TcpIpFlow{},
 		serverFlow:               &types.TcpIpFlow{},
 	}
 
-	conn.ClientCoalesce = NewOrderedCoalesce(conn.AttackLogger, conn.clientFlow, conn.PageCache, conn.ClientStreamRing, conn.MaxBufferedPagesTotal, conn.MaxBufferedPagesPerConnection/2, conn.DetectCoalesceInjection, &conn.attackDetected)
-	conn.ServerCoalesce = NewOrderedCoalesce(conn.AttackLogger, conn.serverFlow, conn.PageCache, conn.ServerStreamRing, conn.MaxBufferedPagesTotal, conn.MaxBufferedPagesPerConnection/2, conn.DetectCoalesceInjection, &conn.attackDetected)
+	conn.ClientStreamBuffer.Budget = options.MemoryBudget
+	conn.ServerStreamBuffer.Budget = options.MemoryBudget
+	if options.RetainStreams {
+		conn.ClientStreamBuffer.Archive = NewStreamArchive(options.StreamSpillBytes, options.LogDir)
+		conn.ServerStreamBuffer.Archive = NewStreamArchive(options.StreamSpillBytes, options.LogDir)
+	}
+	if options.StreamReaders {
+		conn.ClientStreamBuffer.Reader = NewStreamReader(options.StreamReaderMaxBytes)
+		conn.ServerStreamBuffer.Reader = NewStreamReader(options.StreamReaderMaxBytes)
+	}
+
+	conn.snippets = newAttackSnippets(options.SnippetPackets, options.ArchiveDir)
+	conn.duplicates = newDuplicateReports(options.DuplicateWindow, options.AttackLogger)
+
+	conn.ClientCoalesce = NewOrderedCoalesce(coalesceLogger{&conn}, conn.clientFlow, conn.PageCache, conn.ClientStreamBuffer, conn.MaxBufferedPagesTotal, conn.MaxBufferedPagesPerConnection/2, conn.DetectCoalesceInjection, &conn.attackDetected)
+	conn.ServerCoalesce = NewOrderedCoalesce(coalesceLogger{&conn}, conn.serverFlow, conn.PageCache, conn.ServerStreamBuffer, conn.MaxBufferedPagesTotal, conn.MaxBufferedPagesPerConnection/2, conn.DetectCoalesceInjection, &conn.attackDetected)
+	conn.ClientCoalesce.analysisError = conn.analysisError
+	conn.ServerCoalesce.analysisError = conn.analysisError
+	conn.ClientCoalesce.Timings = options.DetectorTimings
+	conn.ServerCoalesce.Timings = options.DetectorTimings
 
 	return &conn
 }
 
+// hijackDetectionPackets returns the number of packets after the
+// handshake in which a connection looks for handshake hijacks.
+func hijackDetectionPackets(options ConnectionOptions) uint64 {
+	if options.HijackDetectionPackets > 0 {
+		return uint64(options.HijackDetectionPackets)
+	}
+	return FIRST_FEW_PACKETS
+}
+
+// initialRingSize returns the number of pages a new stream buffer
+// is allocated with; it never exceeds maxRingPackets unless that is unlimited.
+func initialRingSize(maxRingPackets int) int {
+	if maxRingPackets > 0 && maxRingPackets < INITIAL_RING_PACKETS {
+		return maxRingPackets
+	}
+	return INITIAL_RING_PACKETS
+}
+
 type ConnectionInterface interface {
 	Close()
 	GetClientFlow() *types.TcpIpFlow
 	SetPacketLogger(types.PacketLogger)
 	GetLastSeen() time.Time
+	GetState() uint8
+	Info() ConnectionInfo
 	ReceivePacket(*types.PacketManifest)
+	IsClosed() bool
+	Reconfigure(ConnectionOptions)
 }
 
 type PacketDispatcher interface {
@@ -100,13 +175,28 @@ type ConnectionOptions struct {
 	MaxBufferedPagesTotal         int
 	MaxBufferedPagesPerConnection int
 	MaxRingPackets                int
+	MaxRingBytes                  int
+	MemoryBudget                  *MemoryBudget
 	PageCache                     *pageCache
 	LogDir                        string
+	ArchiveDir                    string
 	LogPackets                    bool
+	RetainStreams                 bool
+	StreamSpillBytes              int
+	StreamCompressor              types.Compressor
+	StreamReaders                 bool
+	StreamReaderMaxBytes          int
+	SnippetPackets                int
+	DuplicateWindow               time.Duration
+	HijackDetectionPackets        int
 	AttackLogger                  types.Logger
+	AnalysisErrors                *uint64
+	DetectorPlugins               []*DetectorPlugin
 	DetectHijack                  bool
 	DetectInjection               bool
 	DetectCoalesceInjection       bool
+	Unidirectional                bool
+	DetectorTimings               *DetectorTimings
 }
 
 // Connection is used to track client and server flows for a given TCP connection.
@@ -115,8 +205,11 @@ type ConnectionOptions struct {
 type Connection struct {
 	ConnectionOptions
 	attackDetected           bool
+	captured                 bool
 	packetCount              uint64
 	skipHijackDetectionCount uint64
+	byteCount                uint64
+	firstSeen                time.Time
 	lastSeen                 time.Time
 	lastSeenMutex            sync.Mutex
 	state                    uint8
@@ -126,27 +219,148 @@ type Connection struct {
 	serverFlow               *types.TcpIpFlow
 	closingFlow              *types.TcpIpFlow
 	closingRST               bool
+	handshakeRST             bool
 	closingFIN               bool
 	closingSeq               types.Sequence
 	clientNextSeq            types.Sequence
 	serverNextSeq            types.Sequence
 	hijackNextAck            types.Sequence
+	firstSynSeq              uint32
 	firstSynAckSeq           uint32
-	ClientStreamRing         *types.Ring
-	ServerStreamRing         *types.Ring
+	synOptions               []layers.TCPOption
+	synAckOptions            []layers.TCPOption
+	windowsTracked           bool
+	clientWindow             receiveWindow
+	serverWindow             receiveWindow
+	sackPermitted            bool
+	clientScoreboard         sackScoreboard
+	serverScoreboard         sackScoreboard
+	stats                    ConnectionStats
+	ClientStreamBuffer       *StreamBuffer
+	ServerStreamBuffer       *StreamBuffer
 	ClientCoalesce           *OrderedCoalesce
 	ServerCoalesce           *OrderedCoalesce
 	PacketLogger             types.PacketLogger
+	snippets                 *attackSnippets
+	duplicates               *duplicateReports
+	clientHello              clientHelloSniffer
+	ingress                  *types.Ingress
 }
 
 func (c *Connection) GetClientFlow() *types.TcpIpFlow {
 	return c.clientFlow
 }
 
+// ClientStream returns a reader over the stream data sent by the client,
+// as reassembled for injection detection. Reading blocks until data
+// arrives or the connection is closed. It returns nil unless the
+// connection was built with the StreamReaders option.
+func (c *Connection) ClientStream() io.Reader {
+	return streamReader(c.ServerStreamBuffer)
+}
+
+// ServerStream returns a reader over the stream data sent by the server;
+// see ClientStream.
+func (c *Connection) ServerStream() io.Reader {
+	return streamReader(c.ClientStreamBuffer)
+}
+
+func streamReader(stream *StreamBuffer) io.Reader {
+	if stream.Reader == nil {
+		return nil
+	}
+	return stream.Reader
+}
+
 func (c *Connection) SetPacketLogger(logger types.PacketLogger) {
 	c.PacketLogger = logger
 }
 
+// CapturePackets makes the connection's packet log, logged with logger
+// from now on, be archived when it closes whether or not an attack
+// was detected.
+func (c *Connection) CapturePackets(logger types.PacketLogger) {
+	c.PacketLogger = logger
+	c.captured = true
+}
+
+// GetPacketLogger returns the logger of the connection's packets, if there is one.
+func (c *Connection) GetPacketLogger() types.PacketLogger {
+	return c.PacketLogger
+}
+
+// ShrinkStreams lowers the number of pages each of the connection's
+// stream buffers retains to maxPages, shedding the oldest.
+func (c *Connection) ShrinkStreams(maxPages int) {
+	c.ClientStreamBuffer.Shrink(maxPages)
+	c.ServerStreamBuffer.Shrink(maxPages)
+}
+
+// OverBudget returns true if either of the connection's stream buffers
+// exceeded the memory budget, whose policy is to drop the connection.
+func (c *Connection) OverBudget() bool {
+	return c.ClientStreamBuffer.Overdrawn() || c.ServerStreamBuffer.Overdrawn()
+}
+
+// Reconfigure applies the detection settings of options, DetectHijack,
+// DetectInjection, DetectCoalesceInjection and HijackDetectionPackets,
+// to the connection from its next packet on. HijackDetectionPackets only
+// applies to a connection still looking for handshake hijacks; one past
+// its first packets does not take it up again.
+func (c *Connection) Reconfigure(options ConnectionOptions) {
+	c.DetectHijack = options.DetectHijack
+	c.DetectInjection = options.DetectInjection
+	c.DetectCoalesceInjection = options.DetectCoalesceInjection
+	c.ClientCoalesce.DetectCoalesceInjection = options.DetectCoalesceInjection
+	c.ServerCoalesce.DetectCoalesceInjection = options.DetectCoalesceInjection
+	c.HijackDetectionPackets = options.HijackDetectionPackets
+	if c.packetCount < c.skipHijackDetectionCount {
+		c.skipHijackDetectionCount = hijackDetectionPackets(options)
+	}
+}
+
+// IsClosed returns true once the connection has been closed, or has
+// reached TIME-WAIT, after which its 4-tuple may be reused by a new connection.
+func (c *Connection) IsClosed() bool {
+	if c.state == TCP_CLOSED {
+		return true
+	}
+	return c.state == TCP_CONNECTION_CLOSING && (c.clientState == TCP_TIME_WAIT || c.serverState == TCP_TIME_WAIT)
+}
+
+// GetState returns the state of the connection's TCP finite state machine.
+func (c *Connection) GetState() uint8 {
+	return c.state
+}
+
+// ConnectionInfo describes a tracked connection.
+type ConnectionInfo struct {
+	Flow      types.TcpIpFlow
+	State     string
+	Packets   uint64
+	Bytes     uint64
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Age       time.Duration
+}
+
+// Info returns a description of the connection; its flow, state, the packets
+// and payload bytes it has received and the time between the first and
+// last of those packets.
+func (c *Connection) Info() ConnectionInfo {
+	c.lastSeenMutex.Lock()
+	defer c.lastSeenMutex.Unlock()
+	return ConnectionInfo{
+		Flow:      *c.clientFlow,
+		State:     ConnectionStateName(c.state),
+		Packets:   c.packetCount,
+		Bytes:     c.byteCount,
+		FirstSeen: c.firstSeen,
+		LastSeen:  c.lastSeen,
+		Age:       c.lastSeen.Sub(c.firstSeen),
+	}
+}
+
 // GetLastSeen returns the lastSeen timestamp after grabbing the lock
 func (c *Connection) GetLastSeen() time.Time {
 	c.lastSeenMutex.Lock()
@@ -161,96 +375,189 @@ func (c *Connection) updateLastSeen(timestamp time.Time) {
 	if c.lastSeen.Before(timestamp) {
 		c.lastSeen = timestamp
 	}
+	if c.firstSeen.IsZero() || c.firstSeen.After(timestamp) {
+		c.firstSeen = timestamp
+	}
 }
 
 // Close can be used by the the connection or the dispatcher to close the connection
 func (c *Connection) Close() {
-	log.Print("Close()")
-	if c.attackDetected == false {
-		if c.PacketLogger != nil {
-			log.Print("no attack detected. removing pcap logs")
+	c.logf(logging.LOG_DEBUG, "", "closing connection")
+	// pending reports go out first; the evidence is kept or discarded
+	// only once the last of them is in and the packet log is closed
+	c.ClientCoalesce.Close()
+	c.ServerCoalesce.Close()
+	c.snippets.flush()
+	c.duplicates.flush()
+	if c.RetainStreams {
+		c.archiveStreams()
+	}
+	c.ClientStreamBuffer.Reader.close()
+	c.ServerStreamBuffer.Reader.close()
+	if c.PacketLogger != nil {
+		c.PacketLogger.Stop()
+		if c.captured {
+			c.logf(logging.LOG_INFO, "", "archiving captured connection's pcap logs")
+			c.PacketLogger.Archive()
+		} else if c.attackDetected == false {
+			c.logf(logging.LOG_DEBUG, "", "no attack detected; removing pcap logs")
 			c.PacketLogger.Remove()
-		}
-	} else {
-		if c.LogPackets {
-			log.Print("attack detected; archiving connection's pcap logs\n")
+		} else {
+			c.logf(logging.LOG_INFO, "", "attack detected; archiving connection's pcap logs")
 			c.PacketLogger.Archive()
 		}
 	}
-	c.ClientCoalesce.Close()
-	c.ServerCoalesce.Close()
-	if c.LogPackets {
-		c.PacketLogger.Stop()
-		c.PacketLogger = nil // just in case the state machine receives another packet...
+	c.ClientStreamBuffer.Reset()
+	c.ServerStreamBuffer.Reset()
+	c.PacketLogger = nil // just in case the state machine receives another packet...
+}
+
+// archiveStreams saves the complete streams of the connection to the
+// archive directory if an attack was detected and then discards them.
+// Each stream file is named after the flow which sent it and the time the
+// connection was first seen, so that a later connection of the same flow
+// does not overwrite it; if there is a StreamCompressor the files are
+// compressed in the background.
+func (c *Connection) archiveStreams() {
+	archives := []struct {
+		flow    *types.TcpIpFlow
+		archive *StreamArchive
+	}{
+		{c.clientFlow, c.ServerStreamBuffer.Archive},
+		{c.serverFlow, c.ClientStreamBuffer.Archive},
+	}
+	for _, a := range archives {
+		if c.attackDetected && a.archive.Size() > 0 {
+			filename := logging.ExpandPathTemplate(c.ArchiveDir, logging.STREAM_LOG_TEMPLATE, a.flow.String(), "", c.firstSeen) + "." + c.firstSeen.UTC().Format(logging.ROTATE_TIME_LAYOUT)
+			if c.StreamCompressor != nil && a.archive.SaveCompressed(c.StreamCompressor, filename+c.StreamCompressor.Extension()) {
+				c.logf(logging.LOG_INFO, "", "attack detected; archiving %d stream bytes to %s", a.archive.Size(), filename+c.StreamCompressor.Extension())
+			} else {
+				c.logf(logging.LOG_INFO, "", "attack detected; archiving %d stream bytes to %s", a.archive.Size(), filename)
+				if err := a.archive.Save(filename); err != nil {
+					c.logf(logging.LOG_WARNING, "", "failed to archive stream %s: %s", filename, err)
+				}
+			}
+		}
+		a.archive.Remove()
 	}
 }
 
 // detectHijack checks for duplicate SYN/ACK indicating handshake hijake
 // and submits a report if an attack was observed
 func (c *Connection) detectHijack(p *types.PacketManifest, flow *types.TcpIpFlow) {
+	defer c.DetectorTimings.done(DETECTOR_HIJACK, c.DetectorTimings.start())
 	// check for duplicate SYN/ACK indicating handshake hijake
 	if !flow.Equal(c.serverFlow) {
 		return
 	}
 	if p.TCP.ACK && p.TCP.SYN {
-		if types.Sequence(p.TCP.Ack).Difference(c.hijackNextAck) == 0 {
+		if types.Sequence(p.TCP.Ack).Equals(c.hijackNextAck) {
 			if p.TCP.Seq != c.firstSynAckSeq {
-				log.Print("handshake hijack detected\n")
-				c.AttackLogger.Log(&types.Event{
-					Time:        time.Now(),
+				c.logf(logging.LOG_INFO, "hijack", "handshake hijack detected")
+				c.logAttack(&types.Event{
+					Time:        p.Timestamp,
 					Type:        "handshake-hijack",
 					PacketCount: c.packetCount,
 					Flow:        *flow,
 					HijackSeq:   p.TCP.Seq,
 					HijackAck:   p.TCP.Ack})
-				c.attackDetected = true
 			} else {
-				log.Print("SYN/ACK retransmission\n")
+				c.logf(logging.LOG_DEBUG, "hijack", "SYN/ACK retransmission")
 			}
 		}
 	}
 }
 
 func (c *Connection) detectInjection(p *types.PacketManifest) {
+	defer c.DetectorTimings.done(DETECTOR_INJECTION, c.DetectorTimings.start())
 
-	var ringPtr *types.Ring
+	var stream *StreamBuffer
 
 	if p.Flow.Equal(c.clientFlow) {
-		ringPtr = c.ServerStreamRing
+		stream = c.ServerStreamBuffer
 	} else {
-		ringPtr = c.ClientStreamRing
+		stream = c.ClientStreamBuffer
 	}
 
 	start := types.Sequence(p.TCP.Seq)
 	end := types.Sequence(p.TCP.Seq).Add(len(p.Payload))
 
 	// injection detection
-	events := checkForInjectionInRing(ringPtr, start, end, p.Payload)
-
-	if len(events) == 0 {
+	events, err := checkForInjection(stream, start, end, p.Payload)
+	if err != nil {
+		c.analysisError(err)
 		return
 	}
 
 	// log events if any
 	for i := 0; i < len(events); i++ {
-		if events[i] == nil {
-			panic("wtf got nil event")
-		} else {
-			if len(events[i].Type) == 0 {
-				events[i].Type = "segment veto or sloppy injection"
+		if len(events[i].Type) == 0 {
+			events[i].Type = "segment veto or sloppy injection"
+			if c.neverAcknowledged(p, events[i].Start, events[i].End) {
+				events[i].Type = "unacknowledged segment injection"
 			}
-			events[i].Base = types.Sequence(p.TCP.Seq)
-			events[i].Time = p.Timestamp
-			events[i].Flow = *p.Flow
-			events[i].Payload = p.Payload
-			events[i].PacketCount = c.packetCount
-			c.AttackLogger.Log(events[i])
-			c.attackDetected = true
-			log.Printf("injection detected in packet # %d\n", c.packetCount)
 		}
+		events[i].Base = types.Sequence(p.TCP.Seq)
+		events[i].Time = p.Timestamp
+		events[i].Flow = *p.Flow
+		events[i].Payload = p.Payload
+		events[i].PacketCount = c.packetCount
+		c.logAttack(events[i])
+		c.logf(logging.LOG_INFO, "injection", "injection detected in packet # %d", c.packetCount)
+		if logging.LogEnabled(logging.LOG_DEBUG, c.clientFlow) {
+			c.logf(logging.LOG_DEBUG, "injection", "race winner stream segment:\n%s", hex.Dump(events[i].Winner))
+			c.logf(logging.LOG_DEBUG, "injection", "race loser stream segment:\n%s", hex.Dump(events[i].Loser))
+		}
+	}
+}
+
+// detectorEvent returns a detector plugin event of the given type about the packet.
+func (c *Connection) detectorEvent(eventType string, p *types.PacketManifest) *DetectorEvent {
+	return &DetectorEvent{
+		Type:        eventType,
+		Flow:        p.Flow.String(),
+		Time:        p.Timestamp,
+		PacketCount: c.packetCount,
+		Seq:         types.Sequence(p.TCP.Seq),
+		Payload:     p.Payload,
+	}
+}
+
+// sendOverlaps sends the detector plugins an overlap event for each
+// range of the packet's payload overlapping the stream reassembled before.
+func (c *Connection) sendOverlaps(p *types.PacketManifest) {
+	if len(c.DetectorPlugins) == 0 {
+		return
+	}
+	defer c.DetectorTimings.done(DETECTOR_PLUGINS, c.DetectorTimings.start())
+	stream := c.ClientStreamBuffer
+	if p.Flow.Equal(c.clientFlow) {
+		stream = c.ServerStreamBuffer
+	}
+	start := types.Sequence(p.TCP.Seq)
+	for _, overlap := range stream.Overlaps(start, start.Add(len(p.Payload))) {
+		event := c.detectorEvent("overlap", p)
+		event.Start = overlap.Block.A
+		event.End = overlap.Block.B
+		event.Payload = p.Payload[start.Difference(overlap.Block.A):start.Difference(overlap.Block.B)]
+		event.Retained = overlap.Bytes
+		sendDetectorEvent(c.DetectorPlugins, event)
 	}
 }
 
+// neverAcknowledged returns true if the receiver of the packet has used SACK
+// to acknowledge stream data beyond the range [start, end) but never the range
+// itself, so the copy of it we reassembled earlier never reached the receiver.
+// That copy rather than the packet retransmitting the range is then the
+// injected one; a segment inserted at our vantage point only.
+func (c *Connection) neverAcknowledged(p *types.PacketManifest, start, end types.Sequence) bool {
+	if !c.sackPermitted {
+		return false
+	}
+	scoreboard := c.receiverScoreboard(p)
+	return scoreboard.valid && scoreboard.highest().GreaterThan(end) && !scoreboard.holds(start, end)
+}
+
 // stateUnknown gets called by our TCP finite state machine runtime
 // and moves us into the TCP_CONNECTION_REQUEST state if we receive
 // a SYN packet... otherwise TCP_DATA_TRANSFER state.
@@ -261,6 +568,8 @@ func (c *Connection) stateUnknown(p *types.PacketManifest) {
 
 	if p.TCP.SYN && !p.TCP.ACK {
 		c.state = TCP_CONNECTION_REQUEST
+		c.firstSynSeq = p.TCP.Seq
+		c.synOptions = copyTCPOptions(p.TCP.Options)
 
 		// Note that TCP SYN and SYN/ACK packets may contain payload data if
 		// a TCP extension is used...
@@ -269,6 +578,17 @@ func (c *Connection) stateUnknown(p *types.PacketManifest) {
 		c.clientNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload) + 1)
 		c.hijackNextAck = c.clientNextSeq
 
+	} else if c.Unidirectional && p.TCP.SYN && p.TCP.ACK {
+		// only the server's side of the handshake is visible;
+		// the client's next sequence is the one the server acknowledges
+		c.serverFlow = p.Flow
+		f := p.Flow.Reverse()
+		c.clientFlow = &f
+		c.state = TCP_DATA_TRANSFER
+		c.skipHijackDetectionCount = 0
+		c.firstSynAckSeq = p.TCP.Seq
+		c.serverNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload) + 1)
+		c.clientNextSeq = types.Sequence(p.TCP.Ack)
 	} else {
 		// else process a connection after handshake
 		c.state = TCP_DATA_TRANSFER
@@ -281,8 +601,7 @@ func (c *Connection) stateUnknown(p *types.PacketManifest) {
 				Bytes: []byte(p.Payload),
 				Seen:  p.Timestamp,
 			}
-			c.ServerStreamRing.Reassembly = &reassembly
-			c.ServerStreamRing = c.ServerStreamRing.Next()
+			c.ServerStreamBuffer.Add(&reassembly)
 			c.clientNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload))
 		}
 		if p.TCP.FIN || p.TCP.RST {
@@ -298,21 +617,47 @@ func (c *Connection) stateUnknown(p *types.PacketManifest) {
 // and moves us into the TCP_CONNECTION_ESTABLISHED state if we receive
 // a SYN/ACK packet.
 func (c *Connection) stateConnectionRequest(p *types.PacketManifest) {
+	if p.TCP.RST {
+		c.handshakeReset(p)
+		return
+	}
+	if c.handshakeRetry(p) {
+		return
+	}
+	if c.Unidirectional && p.Flow.Equal(c.clientFlow) {
+		// the server's SYN/ACK is not visible, the client carrying on
+		// with the handshake means it has been received
+		c.state = TCP_DATA_TRANSFER
+		c.skipHijackDetectionCount = 0
+		c.stateDataTransfer(p)
+		return
+	}
 	if !p.Flow.Equal(c.serverFlow) {
-		log.Print("handshake anomaly")
+		c.anomaly("handshake anomaly")
 		return
 	}
 	if !(p.TCP.SYN && p.TCP.ACK) {
-		log.Print("handshake anomaly")
+		c.anomaly("handshake anomaly")
 		return
 	}
-	if c.clientNextSeq.Difference(types.Sequence(p.TCP.Ack)) != 0 {
-		log.Print("handshake anomaly")
+	if !c.clientNextSeq.Equals(types.Sequence(p.TCP.Ack)) {
+		c.anomaly("handshake anomaly")
 		return
 	}
 	c.state = TCP_CONNECTION_ESTABLISHED
 	c.serverNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload) + 1) // XXX see above comment about TCP extentions
 	c.firstSynAckSeq = p.TCP.Seq
+	c.synAckOptions = copyTCPOptions(p.TCP.Options)
+
+	// window scaling is in effect only if both sides sent the option
+	clientScale, clientOk := windowScale(c.synOptions)
+	serverScale, serverOk := windowScale(c.synAckOptions)
+	if clientOk && serverOk {
+		c.clientWindow.scale = clientScale
+		c.serverWindow.scale = serverScale
+	}
+	c.windowsTracked = true
+	c.sackPermitted = sackPermitted(c.synOptions) && sackPermitted(c.synAckOptions)
 }
 
 // stateConnectionEstablished is called by our TCP FSM runtime and
@@ -327,30 +672,180 @@ func (c *Connection) stateConnectionEstablished(p *types.PacketManifest) {
 			}
 		}
 	}
+	if p.TCP.RST {
+		c.handshakeReset(p)
+		return
+	}
+	if c.handshakeRetry(p) {
+		return
+	}
 	if !p.Flow.Equal(c.clientFlow) {
-		log.Print("handshake anomaly")
+		c.anomaly("handshake anomaly")
 		return
 	}
 	if !p.TCP.ACK || p.TCP.SYN {
-		log.Print("handshake anomaly")
+		c.anomaly("handshake anomaly")
 		return
 	}
-	if types.Sequence(p.TCP.Seq).Difference(c.clientNextSeq) != 0 {
-		log.Print("handshake anomaly")
+	if !types.Sequence(p.TCP.Seq).Equals(c.clientNextSeq) {
+		c.anomaly("handshake anomaly")
 		return
 	}
-	if types.Sequence(p.TCP.Ack).Difference(c.serverNextSeq) != 0 {
-		log.Print("handshake anomaly")
+	if !c.Unidirectional && !types.Sequence(p.TCP.Ack).Equals(c.serverNextSeq) {
+		c.anomaly("handshake anomaly")
 		return
 	}
 	c.state = TCP_DATA_TRANSFER
-	log.Printf("connected %s\n", c.clientFlow.String())
+	c.logf(logging.LOG_DEBUG, "", "connected")
+}
+
+// handshakeRetry returns true if the packet retries a part of the handshake
+// already seen: the client's SYN or, once it has been seen, the server's
+// SYN/ACK. Retransmissions, sent with the same ISN and options as the
+// original, are expected on lossy links and are ignored; retries which
+// diverge from the original are logged as handshake anomalies.
+func (c *Connection) handshakeRetry(p *types.PacketManifest) bool {
+	var same bool
+	if p.TCP.SYN && !p.TCP.ACK && p.Flow.Equal(c.clientFlow) {
+		same = p.TCP.Seq == c.firstSynSeq && sameTCPOptions(p.TCP.Options, c.synOptions)
+	} else if p.TCP.SYN && p.TCP.ACK && p.Flow.Equal(c.serverFlow) && c.state == TCP_CONNECTION_ESTABLISHED {
+		same = p.TCP.Seq == c.firstSynAckSeq && types.Sequence(p.TCP.Ack).Equals(c.clientNextSeq) && sameTCPOptions(p.TCP.Options, c.synAckOptions)
+	} else {
+		return false
+	}
+	if same {
+		c.logf(logging.LOG_DEBUG, "", "handshake retransmission")
+	} else {
+		c.anomaly("handshake anomaly: divergent retry; TCP.Seq %d TCP.Ack %d\n", p.TCP.Seq, p.TCP.Ack)
+	}
+	return true
+}
+
+// copyTCPOptions returns a copy of the options which does
+// not share the packet's buffer.
+func copyTCPOptions(options []layers.TCPOption) []layers.TCPOption {
+	result := make([]layers.TCPOption, len(options))
+	for i, option := range options {
+		result[i] = option
+		result[i].OptionData = append([]byte(nil), option.OptionData...)
+	}
+	return result
+}
+
+// sameTCPOptions returns true if both lists hold the same options in the same order.
+func sameTCPOptions(a, b []layers.TCPOption) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].OptionType != b[i].OptionType || !bytes.Equal(a[i].OptionData, b[i].OptionData) {
+			return false
+		}
+	}
+	return true
+}
+
+// handshakeReset handles a RST received before the handshake has completed.
+// While the SYN is unanswered a RST from the server is accepted if it
+// acknowledges the SYN; otherwise a RST must be sent at the sender's next
+// sequence. A RST which aborts a handshake the server has already accepted
+// with its SYN/ACK is reported, as is a SYN/ACK arriving after a RST refused
+// the connection; SYN flood mitigation boxes and RST injectors do both.
+func (c *Connection) handshakeReset(p *types.PacketManifest) {
+	var valid bool
+	if c.state == TCP_CONNECTION_REQUEST {
+		valid = p.Flow.Equal(c.serverFlow) && p.TCP.ACK && types.Sequence(p.TCP.Ack).Equals(c.clientNextSeq)
+	} else {
+		valid = c.resetAcceptable(p)
+	}
+	if !valid {
+		c.logf(logging.LOG_DEBUG, "", "handshake: ignoring RST with invalid sequence; TCP.Seq %d TCP.Ack %d", p.TCP.Seq, p.TCP.Ack)
+		return
+	}
+	c.logf(logging.LOG_DEBUG, "", "handshake aborted by RST")
+	if c.state == TCP_CONNECTION_ESTABLISHED {
+		c.reportHandshakeReset(p)
+	}
+	c.closingRST = true
+	c.handshakeRST = true
+	c.closingFlow = p.Flow
+	c.closingSeq = types.Sequence(p.TCP.Seq)
+	c.state = TCP_CLOSED
+}
+
+// reportHandshakeReset logs a handshake-reset event for the given packet.
+func (c *Connection) reportHandshakeReset(p *types.PacketManifest) {
+	c.logAttack(&types.Event{
+		Time:        p.Timestamp,
+		Type:        "handshake-reset",
+		PacketCount: c.packetCount,
+		Flow:        *p.Flow,
+		HijackSeq:   p.TCP.Seq,
+		HijackAck:   p.TCP.Ack})
+}
+
+// resetAcceptable returns true if a RST is sent at the next sequence
+// expected from its sender, an exact match as RFC 5961 recommends.
+func (c *Connection) resetAcceptable(p *types.PacketManifest) bool {
+	if p.Flow.Equal(c.clientFlow) {
+		return c.clientNextSeq != types.InvalidSequence && types.Sequence(p.TCP.Seq).Equals(c.clientNextSeq)
+	}
+	return c.serverNextSeq != types.InvalidSequence && types.Sequence(p.TCP.Seq).Equals(c.serverNextSeq)
+}
+
+// ignoreReset logs a RST which was not sent at the sender's next
+// sequence. One which nonetheless falls within the receiver's window
+// is what a blind RST injection attempt looks like.
+func (c *Connection) ignoreReset(p *types.PacketManifest, nextSeq types.Sequence) {
+	if c.windowsTracked && c.receiverWindow(p).contains(types.Sequence(p.TCP.Seq)) {
+		c.anomaly("ignoring in-window RST; possible blind RST injection; got TCP.Seq %d expected %d\n", p.TCP.Seq, nextSeq)
+		return
+	}
+	c.logf(logging.LOG_DEBUG, "", "ignoring RST with invalid sequence; got TCP.Seq %d expected %d", p.TCP.Seq, nextSeq)
+}
+
+// senderWindow returns the receive window advertised by the sender of the packet.
+func (c *Connection) senderWindow(p *types.PacketManifest) *receiveWindow {
+	if p.Flow.Equal(c.clientFlow) {
+		return &c.clientWindow
+	}
+	return &c.serverWindow
+}
+
+// senderScoreboard returns the record of the stream data
+// acknowledged by the sender of the packet.
+func (c *Connection) senderScoreboard(p *types.PacketManifest) *sackScoreboard {
+	if p.Flow.Equal(c.clientFlow) {
+		return &c.clientScoreboard
+	}
+	return &c.serverScoreboard
+}
+
+// receiverScoreboard returns the record of the stream data
+// acknowledged by the receiver of the packet.
+func (c *Connection) receiverScoreboard(p *types.PacketManifest) *sackScoreboard {
+	if p.Flow.Equal(c.clientFlow) {
+		return &c.serverScoreboard
+	}
+	return &c.clientScoreboard
+}
+
+// receiverWindow returns the receive window advertised by the receiver of the packet.
+func (c *Connection) receiverWindow(p *types.PacketManifest) *receiveWindow {
+	if p.Flow.Equal(c.clientFlow) {
+		return &c.serverWindow
+	}
+	return &c.clientWindow
 }
 
 // stateDataTransfer is called by our TCP FSM and processes packets
 // once we are in the TCP_DATA_TRANSFER state
 func (c *Connection) stateDataTransfer(p *types.PacketManifest) {
+	if c.receiveInOrder(p) {
+		return
+	}
 	var closerState, remoteState *uint8
+	var nextSeqPtr, nextAckPtr *types.Sequence
 	var diff int
 
 	isEnd := false
@@ -365,16 +860,25 @@ func (c *Connection) stateDataTransfer(p *types.PacketManifest) {
 		}
 	}
 	if p.Flow.Equal(c.clientFlow) {
-		diff = c.clientNextSeq.Difference(types.Sequence(p.TCP.Seq))
+		nextSeqPtr = &c.clientNextSeq
+		nextAckPtr = &c.serverNextSeq
 		closerState = &c.clientState
 		remoteState = &c.serverState
 	} else if p.Flow.Equal(c.serverFlow) {
-		diff = c.serverNextSeq.Difference(types.Sequence(p.TCP.Seq))
+		nextSeqPtr = &c.serverNextSeq
+		nextAckPtr = &c.clientNextSeq
 		closerState = &c.serverState
 		remoteState = &c.clientState
 	} else {
-		log.Printf("packet flow %s clientflow %s serverflow %s\n", p.Flow, c.clientFlow, c.serverFlow)
-		panic("wtf")
+		c.analysisError(fmt.Errorf("packet flow %s is neither client flow %s nor server flow %s", p.Flow, c.clientFlow, c.serverFlow))
+		return
+	}
+	diff = nextSeqPtr.Difference(types.Sequence(p.TCP.Seq))
+	if diff < 0 {
+		if trimmed := trimRetransmission(p, *nextSeqPtr); trimmed != nil {
+			p = trimmed
+			diff = 0
+		}
 	}
 
 	if diff == 0 { // contiguous
@@ -385,8 +889,8 @@ func (c *Connection) stateDataTransfer(p *types.PacketManifest) {
 				Seen:  p.Timestamp,
 			}
 			if p.Flow.Equal(c.clientFlow) {
-				c.ServerStreamRing.Reassembly = &reassembly
-				c.ServerStreamRing = c.ServerStreamRing.Next()
+				c.clientHello.feed(p.Payload)
+				c.ServerStreamBuffer.Add(&reassembly)
 				c.clientNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload))
 				prev := c.clientNextSeq
 				c.clientNextSeq, isEnd = c.ServerCoalesce.addContiguous(c.clientNextSeq)
@@ -398,8 +902,7 @@ func (c *Connection) stateDataTransfer(p *types.PacketManifest) {
 					return
 				}
 			} else {
-				c.ClientStreamRing.Reassembly = &reassembly
-				c.ClientStreamRing = c.ClientStreamRing.Next()
+				c.ClientStreamBuffer.Add(&reassembly)
 				c.serverNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload))
 				prev := c.serverNextSeq
 				c.serverNextSeq, isEnd = c.ClientCoalesce.addContiguous(c.serverNextSeq)
@@ -413,7 +916,7 @@ func (c *Connection) stateDataTransfer(p *types.PacketManifest) {
 			}
 		}
 		if p.TCP.RST {
-			log.Print("got RST!\n")
+			c.logf(logging.LOG_DEBUG, "", "got RST")
 			c.closingRST = true
 			c.state = TCP_CLOSED
 			c.closingFlow = p.Flow
@@ -423,16 +926,30 @@ func (c *Connection) stateDataTransfer(p *types.PacketManifest) {
 		if p.TCP.FIN {
 			c.closingFIN = true
 			c.closingFlow = p.Flow
+			c.closingSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload))
 			c.state = TCP_CONNECTION_CLOSING
-			*closerState = TCP_FIN_WAIT1
-			*remoteState = TCP_CLOSE_WAIT
+			c.sendFin(p, closerState, remoteState, nextSeqPtr, nextAckPtr)
+			return
+		}
+	} else if p.TCP.RST {
+		c.ignoreReset(p, *nextSeqPtr)
+		return
+	}
+	if diff > 0 { // future-out-of-order packet case
+		if !c.receiverWindow(p).contains(types.Sequence(p.TCP.Seq)) {
+			c.logf(logging.LOG_DEBUG, "", "ignoring segment beyond the receive window; TCP.Seq %d", p.TCP.Seq)
 			return
 		}
-	} else if diff > 0 { // future-out-of-order packet case
+		c.senderStats(p).OutOfOrder += 1
+		var err error
 		if p.Flow.Equal(c.clientFlow) {
-			c.clientNextSeq, isEnd = c.ServerCoalesce.insert(p, c.clientNextSeq)
+			c.clientNextSeq, isEnd, err = c.ServerCoalesce.insert(p, c.clientNextSeq)
 		} else {
-			c.serverNextSeq, isEnd = c.ClientCoalesce.insert(p, c.serverNextSeq)
+			c.serverNextSeq, isEnd, err = c.ClientCoalesce.insert(p, c.serverNextSeq)
+		}
+		if err != nil {
+			c.analysisError(err)
+			return
 		}
 		if isEnd {
 			c.state = TCP_CLOSED
@@ -442,121 +959,131 @@ func (c *Connection) stateDataTransfer(p *types.PacketManifest) {
 	}
 }
 
-// stateFinWait1 handles packets for the FIN-WAIT-1 state
-//func (c *Connection) stateFinWait1(p *types.PacketManifest) {
-func (c *Connection) stateFinWait1(p *types.PacketManifest, flow *types.TcpIpFlow, nextSeqPtr *types.Sequence, nextAckPtr *types.Sequence, statePtr, otherStatePtr *uint8) {
-	c.detectCensorInjection(p)
-	diff := nextSeqPtr.Difference(types.Sequence(p.TCP.Seq))
-	if diff > 0 {
-		// future out of order
-		log.Print("FIN-WAIT-1: ignoring out of order packet")
-		return
-	} else if diff == 0 {
-		if len(p.Payload) > 0 {
-			reassembly := types.Reassembly{
-				Seq:   types.Sequence(p.TCP.Seq),
-				Bytes: []byte(p.Payload),
-				Seen:  p.Timestamp,
-			}
-			if p.Flow.Equal(c.clientFlow) {
-				c.ServerStreamRing.Reassembly = &reassembly
-				c.ServerStreamRing = c.ServerStreamRing.Next()
-				c.clientNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload))
-				c.clientNextSeq, _ = c.ServerCoalesce.addContiguous(c.clientNextSeq)
-			} else {
-				c.ClientStreamRing.Reassembly = &reassembly
-				c.ClientStreamRing = c.ClientStreamRing.Next()
-				c.serverNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload))
-				c.serverNextSeq, _ = c.ClientCoalesce.addContiguous(c.serverNextSeq)
-			}
-		}
-
-		if p.TCP.ACK {
-			*nextAckPtr += 1
-			if p.TCP.FIN {
-				*statePtr = TCP_CLOSING
-				*otherStatePtr = TCP_LAST_ACK
-				*nextSeqPtr = types.Sequence(p.TCP.Seq).Add(len(p.Payload) + 1)
-				if types.Sequence(p.TCP.Ack).Difference(*nextAckPtr) != 0 {
-					log.Printf("FIN-WAIT-1: unexpected ACK: got %d expected %d TCP.Seq %d\n", p.TCP.Ack, *nextAckPtr, p.TCP.Seq)
-					c.closingFlow = p.Flow
-					c.closingSeq = types.Sequence(p.TCP.Seq)
-					return
-				}
-			} else {
-				*statePtr = TCP_FIN_WAIT2
-				*nextSeqPtr = types.Sequence(p.TCP.Seq).Add(len(p.Payload))
-			}
-		} else {
-			log.Print("FIN-WAIT-1: non-ACK packet received.\n")
-			c.closingFlow = p.Flow
-			c.closingSeq = types.Sequence(p.TCP.Seq)
-			return
+// receiveInOrder is the fast path of the data transfer state for its
+// overwhelmingly common packet; the next segment of stream data in its
+// direction, neither closing the connection nor followed by segments
+// queued out of order. The segment is added to the stream buffer and
+// true returned; false is returned for any other packet, left untouched.
+func (c *Connection) receiveInOrder(p *types.PacketManifest) bool {
+	if len(p.Payload) == 0 || p.TCP.FIN || p.TCP.RST || (c.DetectHijack && c.packetCount < c.skipHijackDetectionCount) {
+		return false
+	}
+	nextSeqPtr, stream, coalesce := &c.clientNextSeq, c.ServerStreamBuffer, c.ServerCoalesce
+	fromClient := p.Flow.Equal(c.clientFlow)
+	if !fromClient {
+		nextSeqPtr, stream, coalesce = &c.serverNextSeq, c.ClientStreamBuffer, c.ClientCoalesce
+		if !p.Flow.Equal(c.serverFlow) {
+			return false
 		}
 	}
+	seq := types.Sequence(p.TCP.Seq)
+	if *nextSeqPtr == types.InvalidSequence || *nextSeqPtr != seq || coalesce.first != nil {
+		return false
+	}
+	if fromClient {
+		c.clientHello.feed(p.Payload)
+	}
+	stream.Append(seq, p.Payload, p.Timestamp)
+	*nextSeqPtr = seq.Add(len(p.Payload))
+	return true
 }
 
-// stateFinWait2 handles packets for the FIN-WAIT-2 state
-func (c *Connection) stateFinWait2(p *types.PacketManifest, flow *types.TcpIpFlow, nextSeqPtr *types.Sequence, nextAckPtr *types.Sequence, statePtr *uint8) {
-	c.detectCensorInjection(p)
-	diff := nextSeqPtr.Difference(types.Sequence(p.TCP.Seq))
-	if diff > 0 {
-		// future out of order
-		log.Print("FIN-WAIT-2: out of order packet received.\n")
-		log.Printf("got TCP.Seq %d expected %d\n", p.TCP.Seq, *nextSeqPtr)
-	} else if diff == 0 {
-		// contiguous
-		if p.TCP.ACK && p.TCP.FIN {
-			*nextSeqPtr += 1
-			*statePtr = TCP_TIME_WAIT
-		}
+// trimRetransmission returns the part of a retransmitted packet which lies
+// beyond nextSeq, if the packet carries stream data or a FIN that has not
+// been received yet, or nil otherwise. The retransmitted part has already
+// been checked for injection by ReceivePacket.
+func trimRetransmission(p *types.PacketManifest, nextSeq types.Sequence) *types.PacketManifest {
+	overlap := types.Sequence(p.TCP.Seq).Difference(nextSeq)
+	if overlap > len(p.Payload) || (overlap == len(p.Payload) && !p.TCP.FIN) {
+		return nil
 	}
+	tcp := *p.TCP
+	tcp.Seq = uint32(nextSeq)
+	trimmed := *p
+	trimmed.TCP = &tcp
+	trimmed.Payload = p.Payload[overlap:]
+	return &trimmed
 }
 
-// stateCloseWait represents the TCP FSM's CLOSE-WAIT state
-func (c *Connection) stateCloseWait(p *types.PacketManifest) {
-	var nextSeqPtr *types.Sequence
-	if p.Flow.Equal(c.clientFlow) {
-		nextSeqPtr = &c.clientNextSeq
-	} else {
-		nextSeqPtr = &c.serverNextSeq
-	}
-	diff := types.Sequence(p.TCP.Seq).Difference(*nextSeqPtr)
-	// stream overlap case
-	if diff > 0 {
-		if len(p.Payload) == 0 {
-			c.detectCensorInjection(p)
-		}
+// isKeepAlive returns true if the packet is a TCP keep-alive probe;
+// a bare ACK sent one sequence behind the sender's next sequence,
+// optionally carrying a single garbage byte. The probe elicits an ACK
+// from the peer without being stream data, its garbage byte must not
+// be compared with the stream byte it overlaps.
+func isKeepAlive(p *types.PacketManifest, nextSeq types.Sequence) bool {
+	if p.TCP.SYN || p.TCP.FIN || p.TCP.RST || len(p.Payload) > 1 {
+		return false
 	}
+	return types.Sequence(p.TCP.Seq).Add(1).Equals(nextSeq)
 }
 
-// stateTimeWait represents the TCP FSM's CLOSE-WAIT state
-func (c *Connection) stateTimeWait(p *types.PacketManifest) {
-	log.Print("TIME-WAIT: invalid protocol state\n")
-	c.closingFlow = p.Flow
-	c.closingSeq = types.Sequence(p.TCP.Seq)
+// finSent returns true if a side in the given closing state has sent its FIN.
+func finSent(state uint8) bool {
+	return state != TCP_ESTABLISHED && state != TCP_CLOSE_WAIT
 }
 
-// stateClosing represents the TCP FSM's CLOSING state
-func (c *Connection) stateClosing(p *types.PacketManifest) {
-	log.Print("CLOSING: invalid protocol state\n")
+// receiveContiguous adds the in order payload of a packet to the stream
+// buffer of its direction and advances that direction's next sequence.
+func (c *Connection) receiveContiguous(p *types.PacketManifest) {
+	reassembly := types.Reassembly{
+		Seq:   types.Sequence(p.TCP.Seq),
+		Bytes: []byte(p.Payload),
+		Seen:  p.Timestamp,
+	}
+	if p.Flow.Equal(c.clientFlow) {
+		c.clientHello.feed(p.Payload)
+		c.ServerStreamBuffer.Add(&reassembly)
+		c.clientNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload))
+		c.clientNextSeq, _ = c.ServerCoalesce.addContiguous(c.clientNextSeq)
+	} else {
+		c.ClientStreamBuffer.Add(&reassembly)
+		c.serverNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload))
+		c.serverNextSeq, _ = c.ClientCoalesce.addContiguous(c.serverNextSeq)
+	}
 }
 
-// stateLastAck represents the TCP FSM's LAST-ACK state
-func (c *Connection) stateLastAck(p *types.PacketManifest, flow *types.TcpIpFlow, nextSeqPtr *types.Sequence, nextAckPtr *types.Sequence, statePtr *uint8) {
-	if types.Sequence(p.TCP.Seq).Difference(*nextSeqPtr) == 0 {
-		if p.TCP.ACK && (!p.TCP.FIN && !p.TCP.SYN) {
-			if types.Sequence(p.TCP.Ack).Difference(*nextAckPtr) != 0 {
-				log.Printf("LAST-ACK: out of order ACK packet received. seq %d != nextAck %d\n", p.TCP.Ack, *nextAckPtr)
-			}
+// sendFin handles a FIN sent at the sender's next sequence; the FIN
+// consumes a sequence number. The sender closes, and the receiver, which
+// is assumed to receive the FIN just as it is observed, transitions upon
+// receiving it. A FIN sent before the peer's FIN was received begins a
+// simultaneous close, after which both sides pass through CLOSING.
+func (c *Connection) sendFin(p *types.PacketManifest, senderState, receiverState *uint8, nextSeqPtr, nextAckPtr *types.Sequence) {
+	acksFin := p.TCP.ACK && finSent(*receiverState) && types.Sequence(p.TCP.Ack).GreaterThanOrEqual(*nextAckPtr)
+	switch *senderState {
+	case TCP_ESTABLISHED:
+		*senderState = TCP_FIN_WAIT1
+	case TCP_CLOSE_WAIT:
+		if acksFin {
+			*senderState = TCP_LAST_ACK
 		} else {
-			log.Print("LAST-ACK: protocol anamoly\n")
+			*senderState = TCP_CLOSING
 		}
-	} else {
-		log.Print("LAST-ACK: out of order packet received\n")
-		log.Printf("LAST-ACK: out of order packet received; got %d expected %d\n", p.TCP.Seq, *nextSeqPtr)
+	default:
+		c.anomaly("CLOSING: protocol anomaly; FIN sent twice\n")
+		return
+	}
+	*nextSeqPtr = nextSeqPtr.Add(1)
+
+	switch *receiverState {
+	case TCP_ESTABLISHED:
+		*receiverState = TCP_CLOSE_WAIT
+	case TCP_FIN_WAIT1:
+		*receiverState = TCP_CLOSING
+	case TCP_FIN_WAIT2:
+		*receiverState = TCP_TIME_WAIT
+	}
+}
+
+// receiveFinAck handles an ACK covering the receiver's FIN.
+func (c *Connection) receiveFinAck(receiverState *uint8) {
+	switch *receiverState {
+	case TCP_FIN_WAIT1:
+		*receiverState = TCP_FIN_WAIT2
+	case TCP_CLOSING:
+		*receiverState = TCP_TIME_WAIT
+	case TCP_LAST_ACK:
+		c.state = TCP_CLOSED
 	}
-	c.state = TCP_CLOSED
 }
 
 func (c *Connection) detectCensorInjection(p *types.PacketManifest) {
@@ -576,7 +1103,7 @@ func (c *Connection) detectCensorInjection(p *types.PacketManifest) {
 		attackType = "censor-injection-coalesce_"
 	}
 	if c.closingFlow != nil {
-		if p.Flow.Equal(c.closingFlow) && types.Sequence(p.TCP.Seq).Difference(c.closingSeq) == 0 {
+		if p.Flow.Equal(c.closingFlow) && types.Sequence(p.TCP.Seq).Equals(c.closingSeq) {
 			attackType += "closing-sequence-overlap"
 		} else {
 			return
@@ -587,12 +1114,11 @@ func (c *Connection) detectCensorInjection(p *types.PacketManifest) {
 	event := types.Event{
 		Type:        attackType,
 		PacketCount: c.packetCount,
-		Time:        time.Now(),
+		Time:        p.Timestamp,
 		Flow:        *p.Flow,
 		Start:       types.Sequence(p.TCP.Seq),
 	}
-	c.AttackLogger.Log(&event)
-	c.attackDetected = true
+	c.logAttack(&event)
 }
 
 func (c *Connection) stateClosed(p *types.PacketManifest) {
@@ -602,46 +1128,80 @@ func (c *Connection) stateClosed(p *types.PacketManifest) {
 	} else {
 		nextSeqPtr = &c.serverNextSeq
 	}
+	if c.handshakeRST && p.Flow.Equal(c.serverFlow) && p.TCP.SYN && p.TCP.ACK && types.Sequence(p.TCP.Ack).Equals(c.clientNextSeq) {
+		// the server accepted the connection the RST refused
+		c.logf(logging.LOG_DEBUG, "", "SYN/ACK received after handshake RST")
+		c.handshakeRST = false
+		c.reportHandshakeReset(p)
+		return
+	}
 	if *nextSeqPtr != types.InvalidSequence {
 		c.detectCensorInjection(p)
 	}
 }
 
 // stateConnectionClosing handles all the closing states until the closed state has been reached.
+// The closing state of each side is tracked separately: the sender of a packet transitions upon
+// sending a FIN while the receiver transitions upon the ACK of its own FIN and upon the
+// FIN of its peer, processed in that order just as the receiving TCP would.
 func (c *Connection) stateConnectionClosing(p *types.PacketManifest) {
 	var nextSeqPtr *types.Sequence
 	var nextAckPtr *types.Sequence
-	var statePtr, otherStatePtr *uint8
+	var senderState, receiverState *uint8
 	if c.clientFlow.Equal(p.Flow) {
-		statePtr = &c.clientState
-		otherStatePtr = &c.serverState
+		senderState = &c.clientState
+		receiverState = &c.serverState
 		nextSeqPtr = &c.clientNextSeq
 		nextAckPtr = &c.serverNextSeq
 	} else {
-		statePtr = &c.serverState
-		otherStatePtr = &c.clientState
+		senderState = &c.serverState
+		receiverState = &c.clientState
 		nextSeqPtr = &c.serverNextSeq
 		nextAckPtr = &c.clientNextSeq
 	}
-	if p.Flow.Equal(c.closingFlow) {
-		switch *statePtr {
-		case TCP_CLOSE_WAIT:
-			c.stateCloseWait(p)
-		case TCP_LAST_ACK:
-			c.stateLastAck(p, p.Flow, nextSeqPtr, nextAckPtr, statePtr)
+	c.detectCensorInjection(p)
+	if p.TCP.RST {
+		if !c.resetAcceptable(p) {
+			c.ignoreReset(p, *nextSeqPtr)
+			return
 		}
-	} else {
-		switch *statePtr {
-		case TCP_FIN_WAIT1:
-			c.stateFinWait1(p, p.Flow, nextSeqPtr, nextAckPtr, statePtr, otherStatePtr)
-		case TCP_FIN_WAIT2:
-			c.stateFinWait2(p, p.Flow, nextSeqPtr, nextAckPtr, statePtr)
-		case TCP_TIME_WAIT:
-			c.stateTimeWait(p)
-		case TCP_CLOSING:
-			c.stateClosing(p)
+		c.logf(logging.LOG_DEBUG, "", "closing: got RST")
+		c.closingRST = true
+		c.closingFlow = p.Flow
+		c.closingSeq = types.Sequence(p.TCP.Seq)
+		c.state = TCP_CLOSED
+		return
+	}
+	diff := nextSeqPtr.Difference(types.Sequence(p.TCP.Seq))
+	if diff > 0 {
+		// future out of order
+		c.logf(logging.LOG_DEBUG, "", "closing: ignoring out of order packet; got TCP.Seq %d expected %d", p.TCP.Seq, *nextSeqPtr)
+		return
+	} else if diff < 0 {
+		if trimmed := trimRetransmission(p, *nextSeqPtr); trimmed != nil {
+			p = trimmed
+			diff = 0
 		}
 	}
+	if diff == 0 && len(p.Payload) > 0 {
+		if finSent(*senderState) {
+			c.anomaly("CLOSING: protocol anomaly; data sent after FIN\n")
+			return
+		}
+		c.receiveContiguous(p)
+	}
+	if p.TCP.ACK && finSent(*receiverState) && types.Sequence(p.TCP.Ack).GreaterThanOrEqual(*nextAckPtr) {
+		c.receiveFinAck(receiverState)
+		if c.state == TCP_CLOSED {
+			return
+		}
+	}
+	if diff == 0 && p.TCP.FIN {
+		c.sendFin(p, senderState, receiverState, nextSeqPtr, nextAckPtr)
+	}
+	if *senderState == TCP_TIME_WAIT && *receiverState == TCP_TIME_WAIT {
+		c.state = TCP_CLOSED
+	}
 }
 
 // ReceivePacket implements a TCP finite state machine
@@ -650,10 +1210,16 @@ func (c *Connection) stateConnectionClosing(p *types.PacketManifest) {
 // The goal is to detect all manner of content injection.
 func (c *Connection) ReceivePacket(p *types.PacketManifest) {
 	c.updateLastSeen(p.Timestamp)
-	if c.PacketLogger != nil {
+	c.ingress = p.Ingress
+	if logger, ok := c.PacketLogger.(types.PacketManifestLogger); ok {
+		logger.WritePacketManifest(p)
+	} else if c.PacketLogger != nil {
 		c.PacketLogger.WritePacket(p.RawPacket, p.Timestamp)
 	}
+	c.snippets.record(p)
+	c.duplicates.expire(p.Timestamp)
 	c.packetCount += 1
+	c.byteCount += uint64(len(p.Payload))
 	//log.Printf("packetCount %d\n", c.packetCount)
 
 	if c.state != TCP_UNKNOWN {
@@ -664,16 +1230,24 @@ func (c *Connection) ReceivePacket(p *types.PacketManifest) {
 		} else {
 			nextSeqPtr = &c.serverNextSeq
 		}
-		diff := nextSeqPtr.Difference(types.Sequence(p.TCP.Seq))
-		if diff < 0 {
+		// the next sequence is unknown until that side has sent its SYN
+		if *nextSeqPtr != types.InvalidSequence && types.Sequence(p.TCP.Seq).LessThan(*nextSeqPtr) {
 			// overlap
-			if len(p.Payload) > 0 {
+			if len(p.Payload) > 0 && !isKeepAlive(p, *nextSeqPtr) {
+				c.senderStats(p).Retransmissions += 1
 				c.detectInjection(p)
+				c.sendOverlaps(p)
 			}
 		}
 	}
+	if len(c.DetectorPlugins) > 0 && len(p.Payload) > 0 {
+		started := c.DetectorTimings.start()
+		sendDetectorEvent(c.DetectorPlugins, c.detectorEvent("segment", p))
+		c.DetectorTimings.done(DETECTOR_PLUGINS, started)
+	}
 
 	// simplified TCP state machine
+	state := c.state
 	switch c.state {
 	case TCP_UNKNOWN:
 		c.stateUnknown(p)
@@ -688,4 +1262,38 @@ func (c *Connection) ReceivePacket(p *types.PacketManifest) {
 	case TCP_CLOSED:
 		c.stateClosed(p)
 	}
+
+	sender := c.senderStats(p)
+	sender.Packets += 1
+	sender.Bytes += uint64(len(p.Payload))
+	if c.state != state {
+		c.recordState(p.Timestamp)
+	}
+
+	if c.windowsTracked {
+		c.senderWindow(p).advertise(p.TCP)
+	}
+	if c.sackPermitted && p.TCP.ACK {
+		c.senderScoreboard(p).update(types.Sequence(p.TCP.Ack), sackBlocks(p.TCP.Options))
+	}
+	if c.Unidirectional && p.TCP.ACK {
+		c.inferPeerProgress(p)
+	}
+}
+
+// inferPeerProgress advances the next sequence of the receiver of the packet
+// to the sequence acknowledged by the packet. In unidirectional mode the
+// receiver's own packets may never be seen; its acknowledged progress is
+// then all we know of its stream.
+func (c *Connection) inferPeerProgress(p *types.PacketManifest) {
+	var nextAckPtr *types.Sequence
+	if p.Flow.Equal(c.clientFlow) {
+		nextAckPtr = &c.serverNextSeq
+	} else {
+		nextAckPtr = &c.clientNextSeq
+	}
+	ack := types.Sequence(p.TCP.Ack)
+	if *nextAckPtr == types.InvalidSequence || ack.GreaterThan(*nextAckPtr) {
+		*nextAckPtr = ack
+	}
 }
@@ -0,0 +1,152 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+// MAX_STATE_HISTORY bounds the state transitions recorded per connection.
+const MAX_STATE_HISTORY = 16
+
+// DirectionStats are the statistics of the packets sent by one side of a connection.
+type DirectionStats struct {
+	Packets         uint64
+	Bytes           uint64
+	Retransmissions uint64
+	OutOfOrder      uint64
+}
+
+// StateTransition records the connection entering a TCP state.
+type StateTransition struct {
+	State string
+	Time  time.Time
+}
+
+// ConnectionStats are the statistics of a connection: the packets sent by
+// the client and by the server, the protocol anomalies and attacks detected,
+// the packets which could not be analysed and the TCP states the connection
+// went through, timestamped with the packet causing the transition.
+type ConnectionStats struct {
+	Client         DirectionStats
+	Server         DirectionStats
+	Anomalies      uint64
+	Attacks        uint64
+	AnalysisErrors uint64
+	States         []StateTransition
+}
+
+// Stats returns the statistics of the connection.
+func (c *Connection) Stats() ConnectionStats {
+	stats := c.stats
+	stats.States = append([]StateTransition(nil), c.stats.States...)
+	return stats
+}
+
+// senderStats returns the statistics of the sender of the packet.
+func (c *Connection) senderStats(p *types.PacketManifest) *DirectionStats {
+	if p.Flow.Equal(c.clientFlow) {
+		return &c.stats.Client
+	}
+	return &c.stats.Server
+}
+
+// recordState records a transition into the connection's current state,
+// unless the history is full.
+func (c *Connection) recordState(timestamp time.Time) {
+	if len(c.stats.States) >= MAX_STATE_HISTORY {
+		return
+	}
+	c.stats.States = append(c.stats.States, StateTransition{
+		State: ConnectionStateName(c.state),
+		Time:  timestamp,
+	})
+}
+
+// anomaly logs and counts a protocol anomaly.
+func (c *Connection) anomaly(format string, args ...interface{}) {
+	c.stats.Anomalies += 1
+	c.logf(logging.LOG_DEBUG, "", format, args...)
+}
+
+// logf logs a message about the connection at the given level with its flow,
+// its state and the detector reporting it, if any.
+func (c *Connection) logf(level int, detector string, format string, args ...interface{}) {
+	if !logging.LogEnabled(level, c.clientFlow) {
+		return
+	}
+	logging.Logf(level, &logging.LogFields{
+		Flow:     c.clientFlow,
+		State:    ConnectionStateName(c.state),
+		Detector: detector,
+	}, format, args...)
+}
+
+// analysisError logs and counts a failure to analyse the packet currently
+// received, also in the AnalysisErrors counter shared with other connections
+// if it is set; the packet is not analysed any further.
+func (c *Connection) analysisError(err error) {
+	c.stats.AnalysisErrors += 1
+	if c.AnalysisErrors != nil {
+		atomic.AddUint64(c.AnalysisErrors, 1)
+	}
+	c.logf(logging.LOG_WARNING, "", "analysis error in packet # %d: %s", c.packetCount, err)
+}
+
+// logAttack reports and counts an attack. Reports identical to one
+// still pending in the duplicate window are only counted by that report.
+// Attacks are reported where the packet currently received was seen.
+func (c *Connection) logAttack(event *types.Event) {
+	c.attackDetected = true
+	// the payload is that of the packet received, which is
+	// released once analysed while the report is logged later
+	if event.Payload != nil {
+		event.Payload = append([]byte(nil), event.Payload...)
+	}
+	event.TLS = c.clientHello.hello
+	if event.Ingress == nil {
+		event.Ingress = c.ingress
+	}
+	if !c.duplicates.add(event, c.lastSeen) {
+		return
+	}
+	c.stats.Attacks += 1
+	event.Snippet = c.snippets.open(&event.Flow, c.stats.Attacks)
+	if c.duplicates == nil {
+		c.AttackLogger.Log(event)
+	}
+	if annotator, ok := c.PacketLogger.(types.PacketAnnotator); ok {
+		annotator.AnnotatePacket(event)
+	}
+}
+
+// coalesceLogger routes the reports of a connection's coalescers
+// through logAttack and so accompanies them like its own.
+type coalesceLogger struct {
+	conn *Connection
+}
+
+func (l coalesceLogger) Log(event *types.Event) {
+	l.conn.logAttack(event)
+}
@@ -59,7 +59,7 @@ func TestStateDataTransfer(t *testing.T) {
 		t.Fail()
 	}
 
-	clientRingCount = conn.ClientStreamRing.Prev().Count()
+	clientRingCount = conn.ClientStreamBuffer.Len()
 
 	if clientRingCount != 1 {
 		t.Errorf("clientRingCount %d not correct", clientRingCount)
@@ -86,7 +86,7 @@ func TestStateDataTransfer(t *testing.T) {
 		t.Error("invalid state transition\n")
 		t.Fail()
 	}
-	clientRingCount = conn.ClientStreamRing.Prev().Count()
+	clientRingCount = conn.ClientStreamBuffer.Len()
 	if clientRingCount != 2 {
 		t.Errorf("clientRingCount %d not correct", clientRingCount)
 		t.Fail()
@@ -112,7 +112,7 @@ func TestStateDataTransfer(t *testing.T) {
 		t.Error("invalid state transition\n")
 		t.Fail()
 	}
-	clientRingCount = conn.ClientStreamRing.Prev().Count()
+	clientRingCount = conn.ClientStreamBuffer.Len()
 	if clientRingCount != 2 {
 		t.Errorf("clientRingCount %d not correct", clientRingCount)
 		t.Fail()
@@ -256,13 +256,14 @@ func HelperTestThreeWayClose(isClient bool, t *testing.T) {
 	conn.AttackLogger = attackLogger
 
 	conn.state = TCP_DATA_TRANSFER
-	conn.serverNextSeq = 4666
-	conn.clientNextSeq = 9666
-
 	if isClient {
+		conn.clientNextSeq = 9666
+		conn.serverNextSeq = 4111
 		closerState = &conn.clientState
 		remoteState = &conn.serverState
 	} else {
+		conn.serverNextSeq = 9666
+		conn.clientNextSeq = 4111
 		closerState = &conn.serverState
 		remoteState = &conn.clientState
 	}
@@ -297,9 +298,14 @@ func HelperTestThreeWayClose(isClient bool, t *testing.T) {
 		Payload:   []byte{},
 	}
 
-	conn.clientFlow = &flow
 	ff := flow.Reverse()
-	conn.serverFlow = &ff
+	if isClient {
+		conn.clientFlow = &flow
+		conn.serverFlow = &ff
+	} else {
+		conn.serverFlow = &flow
+		conn.clientFlow = &ff
+	}
 
 	conn.ReceivePacket(&p)
 	log.Print("meow1")
@@ -352,6 +358,14 @@ func HelperTestThreeWayClose(isClient bool, t *testing.T) {
 		t.Error("connection state must transition to TCP_CONNECTION_CLOSING\n")
 		t.Fail()
 	}
+	if *closerState != TCP_TIME_WAIT {
+		t.Error("closer state must be in TCP_TIME_WAIT\n")
+		t.Fail()
+	}
+	if *remoteState != TCP_LAST_ACK {
+		t.Error("remote state must be in TCP_LAST_ACK\n")
+		t.Fail()
+	}
 
 	// next state transition
 	ip = layers.IPv4{
@@ -379,9 +393,101 @@ func HelperTestThreeWayClose(isClient bool, t *testing.T) {
 	}
 
 	conn.ReceivePacket(&p)
+	if conn.state != TCP_CLOSED {
+		t.Error("connection state must transition to TCP_CLOSED\n")
+		t.Fail()
+	}
 	log.Print("freeing page cache")
 }
 
+// newTestConnection returns a connection in the data transfer
+// state and a function building packets sent by the client or server.
+func newTestConnection(attackLogger types.Logger) (*Connection, func(fromClient bool, tcp layers.TCP, payload []byte) *types.PacketManifest) {
+	options := ConnectionOptions{
+		MaxRingPackets: 40,
+		PageCache:      newPageCache(),
+		LogDir:         "fake-log-dir",
+		AttackLogger:   attackLogger,
+	}
+	f := &DefaultConnFactory{}
+	conn := f.Build(options).(*Connection)
+	conn.state = TCP_DATA_TRANSFER
+	conn.clientNextSeq = 100
+	conn.serverNextSeq = 500
+
+	clientIP := layers.IPv4{
+		SrcIP:    net.IP{1, 2, 3, 4},
+		DstIP:    net.IP{2, 3, 4, 5},
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+	}
+	serverIP := clientIP
+	serverIP.SrcIP, serverIP.DstIP = clientIP.DstIP, clientIP.SrcIP
+	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(clientIP.SrcIP), layers.NewIPEndpoint(clientIP.DstIP))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(1)), layers.NewTCPPortEndpoint(layers.TCPPort(2)))
+	flow := types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	clientFlow := &flow
+	serverFlow := flow.Reverse()
+	conn.clientFlow = clientFlow
+	conn.serverFlow = &serverFlow
+
+	packet := func(fromClient bool, tcp layers.TCP, payload []byte) *types.PacketManifest {
+		p := types.PacketManifest{
+			Timestamp: time.Now(),
+			TCP:       &tcp,
+			Payload:   payload,
+		}
+		if fromClient {
+			tcp.SrcPort, tcp.DstPort = 1, 2
+			p.IPv4 = &clientIP
+			p.Flow = clientFlow
+		} else {
+			tcp.SrcPort, tcp.DstPort = 2, 1
+			p.IPv4 = &serverIP
+			p.Flow = &serverFlow
+		}
+		return &p
+	}
+	return conn, packet
+}
+
+func TestSimultaneousClose(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	conn, packet := newTestConnection(attackLogger)
+
+	// both sides send their FIN before receiving the other's
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, FIN: true, ACK: true}, []byte{}))
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 100, FIN: true, ACK: true}, []byte{}))
+	if conn.state != TCP_CONNECTION_CLOSING || conn.clientState != TCP_CLOSING || conn.serverState != TCP_CLOSING {
+		t.Errorf("state %d client state %d server state %d; both sides must be CLOSING", conn.state, conn.clientState, conn.serverState)
+	}
+
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 101, Ack: 501, ACK: true}, []byte{}))
+	if conn.serverState != TCP_TIME_WAIT {
+		t.Errorf("server state %d, expected TIME-WAIT", conn.serverState)
+	}
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 501, Ack: 101, ACK: true}, []byte{}))
+	if conn.state != TCP_CLOSED {
+		t.Errorf("state %d, expected CLOSED", conn.state)
+	}
+	if attackLogger.Count != 0 {
+		t.Errorf("simultaneous close reported %d attacks", attackLogger.Count)
+	}
+}
+
+func TestClosingInjectedFin(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	conn, packet := newTestConnection(attackLogger)
+
+	// an injected FIN followed by the client's genuine data at the FIN's sequence
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, FIN: true, ACK: true}, []byte{}))
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{1, 2, 3}))
+	if attackLogger.Count != 1 {
+		t.Errorf("injected FIN reported %d attacks, expected 1", attackLogger.Count)
+	}
+}
+
 func TestTCPHijack(t *testing.T) {
 	attackLogger := NewDummyAttackLogger()
 	options := ConnectionOptions{
@@ -466,7 +572,9 @@ func TestTCPHijack(t *testing.T) {
 		t.Fail()
 	}
 
-	// test hijack in TCP_CONNECTION_ESTABLISHED state
+	// test hijack in TCP_CONNECTION_ESTABLISHED state,
+	// reported at the time the packet was captured
+	captured := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
 	ip = layers.IPv4{
 		SrcIP:    net.IP{2, 3, 4, 5},
 		DstIP:    net.IP{1, 2, 3, 4},
@@ -483,7 +591,7 @@ func TestTCPHijack(t *testing.T) {
 		DstPort: 1,
 	}
 	p = types.PacketManifest{
-		Timestamp: time.Now(),
+		Timestamp: captured,
 		Flow:      &flowReversed,
 		IPv4:      &ip,
 		TCP:       &tcp,
@@ -495,6 +603,9 @@ func TestTCPHijack(t *testing.T) {
 		t.Error("hijack detection fail")
 		t.Fail()
 	}
+	if !attackLogger.Last.Time.Equal(captured) {
+		t.Errorf("hijack reported at %s, expected the capture time %s", attackLogger.Last.Time, captured)
+	}
 
 	// next state transition test
 	ip = layers.IPv4{
@@ -557,3 +668,302 @@ func TestTCPHijack(t *testing.T) {
 	}
 
 }
+
+func TestFinWithPayload(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	conn, packet := newTestConnection(attackLogger)
+
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, FIN: true, ACK: true}, []byte{1, 2, 3}))
+	if conn.state != TCP_CONNECTION_CLOSING || conn.clientState != TCP_FIN_WAIT1 {
+		t.Errorf("state %d client state %d; expected the client in FIN-WAIT-1", conn.state, conn.clientState)
+	}
+	if conn.ServerStreamBuffer.Bytes() != 3 {
+		t.Errorf("FIN payload was not reassembled; stream has %d bytes", conn.ServerStreamBuffer.Bytes())
+	}
+	if conn.clientNextSeq != 104 {
+		t.Errorf("client next sequence %d, expected 104", conn.clientNextSeq)
+	}
+
+	// the server's FIN retransmits data already received ahead of its own new data
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 104, ACK: true}, []byte{4, 5}))
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 104, FIN: true, ACK: true}, []byte{4, 5, 6}))
+	if conn.ClientStreamBuffer.Bytes() != 3 || conn.serverNextSeq != 504 {
+		t.Errorf("server stream has %d bytes and next sequence %d, expected 3 and 504", conn.ClientStreamBuffer.Bytes(), conn.serverNextSeq)
+	}
+	if conn.clientState != TCP_TIME_WAIT || conn.serverState != TCP_LAST_ACK {
+		t.Errorf("client state %d server state %d; expected TIME-WAIT and LAST-ACK", conn.clientState, conn.serverState)
+	}
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 104, Ack: 504, ACK: true}, []byte{}))
+	if conn.state != TCP_CLOSED {
+		t.Errorf("state %d, expected CLOSED", conn.state)
+	}
+	if attackLogger.Count != 0 {
+		t.Errorf("reported %d attacks, expected none", attackLogger.Count)
+	}
+}
+
+func TestCoalescedFinWithPayload(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	conn, packet := newTestConnection(attackLogger)
+
+	// the FIN arrives ahead of the data preceding it
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 103, Ack: 500, FIN: true, ACK: true}, []byte{4, 5}))
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{1, 2, 3}))
+	if conn.ServerStreamBuffer.Bytes() != 5 {
+		t.Errorf("coalesced FIN payload was not reassembled; stream has %d bytes", conn.ServerStreamBuffer.Bytes())
+	}
+	if conn.clientNextSeq != 106 {
+		t.Errorf("client next sequence %d, expected 106", conn.clientNextSeq)
+	}
+}
+
+// handshake starts a connection with a SYN from the client at 99
+// and, if synAck is set, the server's SYN/ACK at 499.
+func handshake(conn *Connection, packet func(bool, layers.TCP, []byte) *types.PacketManifest, synAck bool) {
+	conn.state = TCP_UNKNOWN
+	conn.clientNextSeq = types.InvalidSequence
+	conn.serverNextSeq = types.InvalidSequence
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	if synAck {
+		conn.ReceivePacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true}, []byte{}))
+	}
+}
+
+func TestHandshakeReset(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	conn, packet := newTestConnection(attackLogger)
+	handshake(conn, packet, true)
+
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 123, RST: true}, []byte{}))
+	if conn.state != TCP_CONNECTION_ESTABLISHED {
+		t.Errorf("RST with an invalid sequence changed state to %d", conn.state)
+	}
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 500, RST: true}, []byte{}))
+	if conn.state != TCP_CLOSED {
+		t.Errorf("state %d, expected CLOSED", conn.state)
+	}
+	if attackLogger.Count != 1 {
+		t.Errorf("handshake reset reported %d attacks, expected 1", attackLogger.Count)
+	}
+}
+
+func TestHandshakeRefusedThenAccepted(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	conn, packet := newTestConnection(attackLogger)
+	handshake(conn, packet, false)
+
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 0, Ack: 99, RST: true, ACK: true}, []byte{}))
+	if conn.state != TCP_CONNECTION_REQUEST {
+		t.Errorf("RST not acknowledging the SYN changed state to %d", conn.state)
+	}
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 0, Ack: 100, RST: true, ACK: true}, []byte{}))
+	if conn.state != TCP_CLOSED || attackLogger.Count != 0 {
+		t.Errorf("state %d and %d attacks after refusal, expected CLOSED and none", conn.state, attackLogger.Count)
+	}
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true}, []byte{}))
+	if attackLogger.Count != 1 {
+		t.Errorf("SYN/ACK after refusal reported %d attacks, expected 1", attackLogger.Count)
+	}
+}
+
+func TestClosingReset(t *testing.T) {
+	conn, packet := newTestConnection(NewDummyAttackLogger())
+
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, FIN: true, ACK: true}, []byte{}))
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 10500, RST: true}, []byte{}))
+	if conn.state != TCP_CONNECTION_CLOSING {
+		t.Errorf("RST with an invalid sequence changed state to %d", conn.state)
+	}
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 500, RST: true}, []byte{}))
+	if conn.state != TCP_CLOSED || !conn.closingRST {
+		t.Errorf("state %d, expected CLOSED by RST", conn.state)
+	}
+}
+
+func TestHandshakeRetransmissions(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	conn, packet := newTestConnection(attackLogger)
+	mss := []layers.TCPOption{{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{5, 180}}}
+
+	conn.state = TCP_UNKNOWN
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true, Options: mss}, []byte{}))
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true, Options: mss}, []byte{}))
+	if conn.state != TCP_CONNECTION_REQUEST {
+		t.Errorf("SYN retransmission changed state to %d", conn.state)
+	}
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true}, []byte{}))
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true}, []byte{}))
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true, Options: mss}, []byte{}))
+	if conn.state != TCP_CONNECTION_ESTABLISHED {
+		t.Errorf("handshake retransmissions changed state to %d", conn.state)
+	}
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{}))
+	if conn.state != TCP_DATA_TRANSFER {
+		t.Errorf("state %d, expected DATA-TRANSFER", conn.state)
+	}
+	if attackLogger.Count != 0 {
+		t.Errorf("handshake retransmissions reported %d attacks", attackLogger.Count)
+	}
+}
+
+func TestHandshakeDivergentRetry(t *testing.T) {
+	conn, packet := newTestConnection(NewDummyAttackLogger())
+	handshake(conn, packet, false)
+	if !conn.handshakeRetry(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{})) {
+		t.Error("SYN retransmission not recognized")
+	}
+	if !conn.handshakeRetry(packet(true, layers.TCP{Seq: 1234, SYN: true}, []byte{})) {
+		t.Error("divergent SYN retry not recognized")
+	}
+	if conn.firstSynSeq != 99 || conn.clientNextSeq != 100 {
+		t.Errorf("divergent SYN retry changed the client ISN to %d", conn.firstSynSeq)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	conn, packet := newTestConnection(attackLogger)
+
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{1, 2, 3}))
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 103, ACK: true}, []byte{}))
+	// a probe carrying a garbage byte and a bare probe, each answered by an ACK
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 102, Ack: 500, ACK: true}, []byte{0}))
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 103, ACK: true}, []byte{}))
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 102, Ack: 500, ACK: true}, []byte{}))
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 103, ACK: true}, []byte{}))
+	if attackLogger.Count != 0 {
+		t.Errorf("reported %d attacks for keep-alive probes, expected none", attackLogger.Count)
+	}
+	if conn.clientNextSeq != 103 || conn.serverNextSeq != 500 || conn.ServerStreamBuffer.Bytes() != 3 {
+		t.Errorf("keep-alive probes changed the next sequences to %d and %d", conn.clientNextSeq, conn.serverNextSeq)
+	}
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 103, Ack: 500, ACK: true}, []byte{4}))
+	if conn.clientNextSeq != 104 {
+		t.Errorf("client next sequence %d after a keep-alive, expected 104", conn.clientNextSeq)
+	}
+
+	// a retransmission of more than the last byte is still checked
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 102, Ack: 500, ACK: true}, []byte{9, 9}))
+	if attackLogger.Count == 0 {
+		t.Error("altered retransmission was not reported")
+	}
+}
+
+func TestUnidirectionalServerSide(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	conn, packet := newTestConnection(attackLogger)
+	conn.state = TCP_UNKNOWN
+	conn.Unidirectional = true
+
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true}, []byte{}))
+	if conn.state != TCP_DATA_TRANSFER || conn.serverNextSeq != 500 || conn.clientNextSeq != 100 {
+		t.Errorf("state %d server next %d client next %d after a lone SYN/ACK", conn.state, conn.serverNextSeq, conn.clientNextSeq)
+	}
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 100, ACK: true}, []byte{1, 2, 3}))
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 503, Ack: 120, ACK: true}, []byte{4, 5, 6}))
+	if conn.serverNextSeq != 506 || conn.clientNextSeq != 120 {
+		t.Errorf("server next %d client next %d, expected 506 and 120", conn.serverNextSeq, conn.clientNextSeq)
+	}
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 120, ACK: true}, []byte{7, 8, 9}))
+	if attackLogger.Count != 1 {
+		t.Errorf("reported %d attacks, expected the injection on the visible side", attackLogger.Count)
+	}
+}
+
+func TestUnidirectionalClientSide(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	conn, packet := newTestConnection(attackLogger)
+	conn.state = TCP_UNKNOWN
+	conn.Unidirectional = true
+
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{}))
+	if conn.state != TCP_DATA_TRANSFER || conn.serverNextSeq != 500 {
+		t.Errorf("state %d server next %d; the handshake ACK must complete the handshake", conn.state, conn.serverNextSeq)
+	}
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 510, ACK: true}, []byte{1, 2, 3}))
+	if conn.clientNextSeq != 103 || conn.serverNextSeq != 510 {
+		t.Errorf("client next %d server next %d, expected 103 and 510", conn.clientNextSeq, conn.serverNextSeq)
+	}
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 510, ACK: true}, []byte{7, 8, 9}))
+	if attackLogger.Count != 1 {
+		t.Errorf("reported %d attacks, expected the injection on the visible side", attackLogger.Count)
+	}
+}
+
+func TestConnectionStats(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	conn, packet := newTestConnection(attackLogger)
+	conn.state = TCP_UNKNOWN
+
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true, Window: 65535}, []byte{}))
+	// an anomalous handshake ACK followed by the valid one
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 600, ACK: true}, []byte{}))
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{}))
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{1, 2, 3}))
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 106, Ack: 500, ACK: true}, []byte{7, 8}))
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{9, 9, 9}))
+
+	stats := conn.Stats()
+	if stats.Client != (DirectionStats{Packets: 6, Bytes: 8, Retransmissions: 1, OutOfOrder: 1}) {
+		t.Errorf("client stats %+v", stats.Client)
+	}
+	if stats.Server != (DirectionStats{Packets: 1}) {
+		t.Errorf("server stats %+v", stats.Server)
+	}
+	if stats.Anomalies != 1 || stats.Attacks != 1 {
+		t.Errorf("%d anomalies and %d attacks, expected one of each", stats.Anomalies, stats.Attacks)
+	}
+	states := []string{"connection-request", "connection-established", "data-transfer"}
+	if len(stats.States) != len(states) {
+		t.Fatalf("state history %+v", stats.States)
+	}
+	for i, state := range states {
+		if stats.States[i].State != state {
+			t.Errorf("state history %+v, expected %v", stats.States, states)
+		}
+	}
+}
+
+// benchmarkConnection feeds the connection b.N packets from the client
+// carrying 512 bytes of stream data each, whose sequence is given by seq.
+func benchmarkConnection(b *testing.B, seq func(n int) uint32) {
+	conn, packet := newTestConnection(NewDummyAttackLogger())
+	p := packet(true, layers.TCP{Ack: 500, ACK: true, PSH: true}, make([]byte, 512))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		p.TCP.Seq = seq(n)
+		conn.ReceivePacket(p)
+	}
+}
+
+func BenchmarkConnectionInOrder(b *testing.B) {
+	benchmarkConnection(b, func(n int) uint32 {
+		return 100 + uint32(n)*512
+	})
+}
+
+func BenchmarkConnectionRetransmission(b *testing.B) {
+	benchmarkConnection(b, func(n int) uint32 {
+		// every other segment is sent again
+		return 100 + uint32(n/2)*512
+	})
+}
+
+func TestConnectionReconfigureHijackWindow(t *testing.T) {
+	conn, _ := newTestConnection(nil)
+	conn.packetCount = 5
+	conn.Reconfigure(ConnectionOptions{HijackDetectionPackets: 20})
+	if conn.skipHijackDetectionCount != 20 {
+		t.Errorf("connection within its first packets looks for hijacks for %d packets", conn.skipHijackDetectionCount)
+	}
+
+	// an established connection is not looked at for hijacks again
+	conn.packetCount = 100
+	conn.Reconfigure(ConnectionOptions{HijackDetectionPackets: 200})
+	if conn.skipHijackDetectionCount != 20 {
+		t.Errorf("connection past its first packets looks for hijacks for %d packets", conn.skipHijackDetectionCount)
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+// The paths of the methods of the honeybadger.Control gRPC service in honeybadger.proto.
+const (
+	CONTROL_SET_FILTER    = "/honeybadger.Control/SetFilter"
+	CONTROL_SET_DETECTORS = "/honeybadger.Control/SetDetectors"
+	CONTROL_ROTATE_LOGS   = "/honeybadger.Control/RotateLogs"
+	CONTROL_GET_STATS     = "/honeybadger.Control/GetStats"
+	CONTROL_CAPTURE_FLOW  = "/honeybadger.Control/CaptureFlow"
+)
+
+// ControlServer is a control plane service serving the honeybadger.Control
+// gRPC service, for managing a fleet of sensors from one console: changing
+// the capture filter, enabling and disabling the detectors, rotating the
+// connections' packet logs, fetching the sensor's statistics and capturing
+// a flow's connection in full; see Dispatcher.CaptureFlow. It is served
+// over TLS to clients presenting a certificate signed by the certificate
+// authority of ClientCAFile only.
+type ControlServer struct {
+	Addr         string
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+
+	supervisor *Supervisor
+	dispatcher *Dispatcher
+	server     *http.Server
+	started    time.Time
+}
+
+// NewControlServer returns a pointer to a ControlServer struct which will
+// listen on addr with the given certificate, key and client CA files.
+func NewControlServer(addr, certFile, keyFile, clientCAFile string) *ControlServer {
+	return &ControlServer{
+		Addr:         addr,
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: clientCAFile,
+	}
+}
+
+func (c *ControlServer) SetSupervisor(supervisor *Supervisor) {
+	c.supervisor = supervisor
+}
+
+// Start starts serving the control service of dispatcher; if it fails
+// to listen the error is logged and the service is not served.
+func (c *ControlServer) Start(dispatcher *Dispatcher) {
+	c.dispatcher = dispatcher
+	c.started = time.Now()
+	config, err := c.tlsConfig()
+	if err != nil {
+		logging.Errorf("control service disabled: %s", err)
+		return
+	}
+	listener, err := net.Listen("tcp", c.Addr)
+	if err != nil {
+		logging.Errorf("control service disabled: %s", err)
+		return
+	}
+	c.server = &http.Server{Handler: c, TLSConfig: config}
+	go func() {
+		if err := c.server.ServeTLS(listener, "", ""); err != nil && err != http.ErrServerClosed {
+			logging.Warningf("control service: %s", err)
+		}
+	}()
+}
+
+func (c *ControlServer) tlsConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := ioutil.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", c.ClientCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// Stop closes the listener and the connections of the service's clients.
+func (c *ControlServer) Stop() {
+	if c.server != nil {
+		c.server.Close()
+	}
+}
+
+// controlError is an error of a control method and its gRPC status code.
+type controlError struct {
+	code    int
+	message string
+}
+
+func (e *controlError) Error() string {
+	return e.message
+}
+
+func (c *ControlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2 POST requests", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	request, err := logging.ReadGRPCMessage(r.Body)
+	var response []byte
+	if err != nil {
+		err = &controlError{logging.GRPC_INVALID_ARGUMENT, err.Error()}
+	} else {
+		response, err = c.call(r.URL.Path, request)
+	}
+	w.WriteHeader(http.StatusOK)
+	if err != nil {
+		code := logging.GRPC_INVALID_ARGUMENT
+		if e, ok := err.(*controlError); ok {
+			code = e.code
+		}
+		logging.WriteGRPCStatus(w, code, err.Error())
+		return
+	}
+	logging.WriteGRPCMessage(w, response)
+	logging.WriteGRPCStatus(w, 0, "")
+}
+
+// call runs a control method with its request message and returns its response message.
+func (c *ControlServer) call(method string, request []byte) ([]byte, error) {
+	var response logging.ProtoMessage
+	switch method {
+	case CONTROL_SET_FILTER:
+		var filter string
+		err := logging.ProtoFields(request, func(field int, varint uint64, contents []byte) error {
+			if field == 1 {
+				filter = string(contents)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if c.supervisor == nil {
+			return nil, &controlError{logging.GRPC_FAILED_PRECONDITION, "no pipeline to set the filter of"}
+		}
+		if err := c.supervisor.SetFilter(filter); err != nil {
+			return nil, &controlError{logging.GRPC_FAILED_PRECONDITION, err.Error()}
+		}
+		logging.Infof("control service: capture filter set to %q", filter)
+	case CONTROL_SET_DETECTORS:
+		options := c.dispatcher.Options()
+		options.DetectHijack, options.DetectInjection, options.DetectCoalesceInjection = false, false, false
+		err := logging.ProtoFields(request, func(field int, varint uint64, contents []byte) error {
+			switch field {
+			case 1:
+				options.DetectHijack = varint != 0
+			case 2:
+				options.DetectInjection = varint != 0
+			case 3:
+				options.DetectCoalesceInjection = varint != 0
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.dispatcher.Reconfigure(options)
+		logging.Infof("control service: detectors set to hijack=%t injection=%t coalesce_injection=%t",
+			options.DetectHijack, options.DetectInjection, options.DetectCoalesceInjection)
+	case CONTROL_ROTATE_LOGS:
+		response.AddUint64(1, uint64(c.dispatcher.RotatePacketLogs()))
+	case CONTROL_GET_STATS:
+		metrics := c.dispatcher.Metrics()
+		response.AddString(1, logging.Sensor)
+		response.AddUint64(2, uint64(time.Since(c.started).Seconds()))
+		response.AddUint64(3, uint64(metrics.Connections))
+		response.AddUint64(4, metrics.Opened)
+		response.AddUint64(5, metrics.Closed)
+		response.AddUint64(6, metrics.Evictions)
+		response.AddUint64(7, metrics.Lookups)
+		response.AddUint64(8, metrics.Misses)
+		response.AddUint64(9, c.dispatcher.AnalysisErrors())
+	case CONTROL_CAPTURE_FLOW:
+		var name string
+		err := logging.ProtoFields(request, func(field int, varint uint64, contents []byte) error {
+			if field == 1 {
+				name = string(contents)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		flow, err := types.ParseTcpIpFlow(name)
+		if err != nil {
+			return nil, err
+		}
+		tracked, err := c.dispatcher.CaptureFlow(flow)
+		if err != nil {
+			return nil, &controlError{logging.GRPC_FAILED_PRECONDITION, err.Error()}
+		}
+		logging.Infof("control service: capturing %s", flow)
+		response.AddBool(1, tracked)
+	default:
+		return nil, &controlError{logging.GRPC_UNIMPLEMENTED, "unknown method " + method}
+	}
+	return response.Marshal(), nil
+}
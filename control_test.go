@@ -0,0 +1,126 @@
+package HoneyBadger
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket/layers"
+)
+
+// controlCall calls a method of the control service, checking its status.
+func controlCall(t *testing.T, control *ControlServer, method string, request *logging.ProtoMessage, status string) []byte {
+	var body bytes.Buffer
+	logging.WriteGRPCMessage(&body, request.Marshal())
+	httpRequest := httptest.NewRequest("POST", method, &body)
+	httpRequest.ProtoMajor = 2
+	recorder := httptest.NewRecorder()
+	control.ServeHTTP(recorder, httpRequest)
+	result := recorder.Result()
+	if got := result.Trailer.Get("Grpc-Status"); got != status {
+		t.Fatalf("%s: status %s, expected %s: %s", method, got, status, result.Trailer.Get("Grpc-Message"))
+	}
+	if status != "0" {
+		return nil
+	}
+	response, err := logging.ReadGRPCMessage(result.Body)
+	if err != nil {
+		t.Fatalf("%s: %s", method, err)
+	}
+	return response
+}
+
+func protoVarint(t *testing.T, message []byte, field int) uint64 {
+	var value uint64
+	err := logging.ProtoFields(message, func(f int, varint uint64, contents []byte) error {
+		if f == field {
+			value = varint
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// capturePacketLogger records what a connection does with its packet log.
+type capturePacketLogger struct {
+	packets   int
+	rotations int
+	archived  bool
+}
+
+func (l *capturePacketLogger) WritePacket(rawPacket []byte, timestamp time.Time) { l.packets++ }
+func (l *capturePacketLogger) Start()                                            {}
+func (l *capturePacketLogger) Stop()                                             {}
+func (l *capturePacketLogger) Remove()                                           {}
+func (l *capturePacketLogger) Archive()                                          { l.archived = true }
+func (l *capturePacketLogger) SetFileWriter(io.WriteCloser)                      {}
+func (l *capturePacketLogger) Rotate()                                           { l.rotations++ }
+
+type capturePacketLoggerFactory struct {
+	logger *capturePacketLogger
+}
+
+func (f capturePacketLoggerFactory) Build(flow *types.TcpIpFlow) types.PacketLogger {
+	return f.logger
+}
+
+func TestControlServer(t *testing.T) {
+	packetLogger := &capturePacketLogger{}
+	options := DispatcherOptions{
+		Logger:          NewDummyAttackLogger(),
+		MaxRingPackets:  40,
+		DetectHijack:    true,
+		DetectInjection: true,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, capturePacketLoggerFactory{packetLogger})
+	dispatcher.Start()
+	control := NewControlServer("127.0.0.1:0", "", "", "")
+	control.dispatcher = dispatcher
+	control.started = time.Now()
+
+	// the flow is captured once its connection is tracked
+	var capture logging.ProtoMessage
+	capture.AddString(1, "1.2.3.4:1-2.3.4.5:2")
+	if response := controlCall(t, control, CONTROL_CAPTURE_FLOW, &capture, "0"); protoVarint(t, response, 1) != 0 {
+		t.Error("untracked connection reported as tracked")
+	}
+	_, packet := newTestConnection(options.Logger)
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+
+	if response := controlCall(t, control, CONTROL_ROTATE_LOGS, &logging.ProtoMessage{}, "0"); protoVarint(t, response, 1) != 1 {
+		t.Errorf("rotated %d packet logs, expected 1", protoVarint(t, response, 1))
+	}
+	if response := controlCall(t, control, CONTROL_GET_STATS, &logging.ProtoMessage{}, "0"); protoVarint(t, response, 3) != 1 {
+		t.Errorf("stats of %d connections, expected 1", protoVarint(t, response, 3))
+	}
+
+	var detectors logging.ProtoMessage
+	detectors.AddBool(2, true)
+	controlCall(t, control, CONTROL_SET_DETECTORS, &detectors, "0")
+	if reconfigured := dispatcher.Options(); reconfigured.DetectHijack || !reconfigured.DetectInjection {
+		t.Errorf("detectors hijack=%t injection=%t", reconfigured.DetectHijack, reconfigured.DetectInjection)
+	}
+
+	var filter logging.ProtoMessage
+	filter.AddString(1, "tcp port 80")
+	controlCall(t, control, CONTROL_SET_FILTER, &filter, "9")
+	controlCall(t, control, "/honeybadger.Control/Reboot", &logging.ProtoMessage{}, "12")
+	recorder := httptest.NewRecorder()
+	control.ServeHTTP(recorder, httptest.NewRequest("GET", CONTROL_GET_STATS, nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("HTTP/1 GET served with status %d", recorder.Code)
+	}
+
+	dispatcher.Stop()
+	if packetLogger.packets != 1 || packetLogger.rotations != 1 || !packetLogger.archived {
+		t.Errorf("captured %d packets, rotated %d times, archived %t", packetLogger.packets, packetLogger.rotations, packetLogger.archived)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// COUNTERMEASURE_RSTS is the default number of RSTs sent to each
+	// endpoint of a connection torn down.
+	COUNTERMEASURE_RSTS = 3
+	// COUNTERMEASURE_RST_STRIDE is how far apart the sequence numbers of
+	// the RSTs sent to an endpoint are, so that one of them still lands on
+	// the sequence the endpoint expects if segments are in flight.
+	COUNTERMEASURE_RST_STRIDE = 1460
+)
+
+// PacketInjector sends forged IP packets to their destination.
+type PacketInjector interface {
+	Inject(packet []byte, dst net.IP) error
+	Close() error
+}
+
+// CountermeasureOptions opt in to an active response to attacks: once
+// an attack of at least the Confidence, by default high, is reported for a
+// connection, the injected content is kept from being consumed by tearing
+// the connection down with RSTs forged to both of its endpoints, RSTs of
+// them, by default COUNTERMEASURE_RSTS, sent by the Injector, such as a
+// raw socket injector. The sensor must be able to reach both endpoints, and
+// its spoofed source addresses must get past any filtering between them.
+// The connection is no longer tracked once torn down, and the tear down is
+// reported as a sensor-rst-teardown event. A nil Injector applies no
+// countermeasure.
+type CountermeasureOptions struct {
+	Injector   PacketInjector
+	Confidence string
+	RSTs       int
+}
+
+// countermeasure holds the connections torn down, for the dispatcher to
+// stop tracking once it has handed them the packet they are analysing.
+type countermeasure struct {
+	mutex sync.Mutex
+	torn  map[ConnectionInterface]bool
+}
+
+// tearDown tears down the connection an attack is reported for, if the
+// countermeasure applies to it, and returns the event reporting it, or nil.
+// Reports of detector plugins, made as they analyse the connection
+// concurrently, are not responded to.
+func (i *Dispatcher) tearDown(event *types.Event, conn ConnectionInterface) *types.Event {
+	options := i.options.Countermeasure
+	connection, ok := conn.(*Connection)
+	if options.Injector == nil || !ok || strings.HasPrefix(event.Type, "plugin-") {
+		return nil
+	}
+	confidence := options.Confidence
+	if confidence == "" {
+		confidence = "high"
+	}
+	if !logging.Confident(event.Type, confidence) {
+		return nil
+	}
+	i.countermeasure.mutex.Lock()
+	defer i.countermeasure.mutex.Unlock()
+	if i.countermeasure.torn[conn] {
+		return nil
+	}
+	rsts := options.RSTs
+	if rsts <= 0 {
+		rsts = COUNTERMEASURE_RSTS
+	}
+
+	sent := 0
+	var failure error
+	// each endpoint is sent RSTs at the sequence it expects next of the other
+	sides := []struct {
+		flow     *types.TcpIpFlow
+		seq, ack types.Sequence
+	}{
+		{connection.clientFlow, connection.clientNextSeq, connection.serverNextSeq},
+		{connection.serverFlow, connection.serverNextSeq, connection.clientNextSeq},
+	}
+	for _, side := range sides {
+		if side.flow == nil || side.seq == types.InvalidSequence {
+			continue
+		}
+		for n := 0; n < rsts; n++ {
+			packet, dst, err := rstPacket(side.flow, side.seq.Add(n*COUNTERMEASURE_RST_STRIDE), side.ack)
+			if err == nil {
+				err = options.Injector.Inject(packet, dst)
+			}
+			if err != nil {
+				failure = err
+				break
+			}
+			sent++
+		}
+	}
+	if failure != nil {
+		logging.Logf(logging.LOG_WARNING, &logging.LogFields{Flow: connection.clientFlow}, "failed to send RSTs tearing down the connection: %s", failure)
+	}
+	if sent == 0 {
+		return nil
+	}
+	if i.countermeasure.torn == nil {
+		i.countermeasure.torn = make(map[ConnectionInterface]bool)
+	}
+	i.countermeasure.torn[conn] = true
+	logging.Logf(logging.LOG_WARNING, &logging.LogFields{Flow: connection.clientFlow}, "%s reported; %d RSTs sent to tear down the connection", event.Type, sent)
+	return &types.Event{
+		Type:        "sensor-rst-teardown",
+		Time:        i.captureNow(),
+		Flow:        *connection.clientFlow,
+		PacketCount: uint64(sent),
+		Payload:     []byte(fmt.Sprintf("%d RSTs sent to tear down the connection after a %s report", sent, event.Type)),
+	}
+}
+
+// tornDown returns true, once, if the connection was torn down.
+func (i *Dispatcher) tornDown(conn ConnectionInterface) bool {
+	if i.options.Countermeasure.Injector == nil {
+		return false
+	}
+	i.countermeasure.mutex.Lock()
+	defer i.countermeasure.mutex.Unlock()
+	if !i.countermeasure.torn[conn] {
+		return false
+	}
+	delete(i.countermeasure.torn, conn)
+	return true
+}
+
+// rstPacket returns the IP packet of a RST of the given flow, sequence and
+// acknowledgement, and the destination it is to be sent to.
+func rstPacket(flow *types.TcpIpFlow, seq, ack types.Sequence) ([]byte, net.IP, error) {
+	ipFlow, tcpFlow := flow.Flows()
+	src, dst := net.IP(ipFlow.Src().Raw()), net.IP(ipFlow.Dst().Raw())
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(binary.BigEndian.Uint16(tcpFlow.Src().Raw())),
+		DstPort: layers.TCPPort(binary.BigEndian.Uint16(tcpFlow.Dst().Raw())),
+		Seq:     uint32(seq),
+		Ack:     uint32(ack),
+		RST:     true,
+		ACK:     true,
+	}
+	var network gopacket.SerializableLayer
+	switch ipFlow.EndpointType() {
+	case layers.EndpointIPv4:
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+		tcp.SetNetworkLayerForChecksum(ip)
+		network = ip
+	case layers.EndpointIPv6:
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+		tcp.SetNetworkLayerForChecksum(ip)
+		network = ip
+	default:
+		return nil, nil, fmt.Errorf("unsupported network of flow %s", flow)
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, network, tcp); err != nil {
+		return nil, nil, err
+	}
+	return buffer.Bytes(), dst, nil
+}
@@ -0,0 +1,111 @@
+package HoneyBadger
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// recordingInjector records the packets it is given to inject.
+type recordingInjector struct {
+	packets []gopacket.Packet
+	dsts    []net.IP
+}
+
+func (r *recordingInjector) Inject(packet []byte, dst net.IP) error {
+	first := layers.LayerTypeIPv4
+	if dst.To4() == nil {
+		first = layers.LayerTypeIPv6
+	}
+	r.packets = append(r.packets, gopacket.NewPacket(packet, first, gopacket.Default))
+	r.dsts = append(r.dsts, dst)
+	return nil
+}
+
+func (r *recordingInjector) Close() error {
+	return nil
+}
+
+func TestRSTPacket(t *testing.T) {
+	flow, err := types.ParseTcpIpFlow("2001:db8::1:1000-2001:db8::2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, dst, err := rstPacket(flow, 7, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dst.Equal(net.ParseIP("2001:db8::2")) {
+		t.Errorf("RST sent to %s", dst)
+	}
+	decoded := gopacket.NewPacket(packet, layers.LayerTypeIPv6, gopacket.Default)
+	tcp, ok := decoded.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok || !tcp.RST || tcp.Seq != 7 || tcp.Ack != 9 || tcp.SrcPort != 1000 || tcp.DstPort != 80 {
+		t.Errorf("RST packet %s", decoded)
+	}
+}
+
+func TestDispatcherCountermeasure(t *testing.T) {
+	logger := NewDummyAttackLogger()
+	injector := &recordingInjector{}
+	options := DispatcherOptions{
+		Logger:         logger,
+		MaxRingPackets: 40,
+		Countermeasure: CountermeasureOptions{Injector: injector},
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	_, packet := newTestConnection(nil)
+	dispatcher.dispatchPacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	dispatcher.dispatchPacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true}, []byte{}))
+	dispatcher.dispatchPacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{}))
+	conn := dispatcher.Connections()[0].(*Connection)
+
+	// only attacks of high confidence are responded to
+	conn.AttackLogger.Log(&types.Event{Type: "censor-injection-RST_data", Flow: *conn.clientFlow})
+	if len(injector.packets) != 0 {
+		t.Fatalf("%d RSTs sent for a medium confidence attack", len(injector.packets))
+	}
+	conn.AttackLogger.Log(&types.Event{Type: "injection", Flow: *conn.clientFlow})
+	if len(injector.packets) != 2*COUNTERMEASURE_RSTS {
+		t.Fatalf("%d RSTs sent", len(injector.packets))
+	}
+	expected := []struct {
+		dst      string
+		src      string
+		seq, ack uint32
+	}{
+		{"2.3.4.5", "1.2.3.4", 100, 500},
+		{"2.3.4.5", "1.2.3.4", 100 + 2*COUNTERMEASURE_RST_STRIDE, 500},
+		{"1.2.3.4", "2.3.4.5", 500, 100},
+	}
+	for _, rst := range expected {
+		found := false
+		for n, p := range injector.packets {
+			ip := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			tcp := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+			if injector.dsts[n].String() == rst.dst && ip.DstIP.String() == rst.dst && ip.SrcIP.String() == rst.src && tcp.RST && tcp.Seq == rst.seq && tcp.Ack == rst.ack {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no RST %+v sent", rst)
+		}
+	}
+	if logger.Count != 3 || logger.Last.Type != "sensor-rst-teardown" || logger.Last.PacketCount != 2*COUNTERMEASURE_RSTS {
+		t.Errorf("%d reports, the last %+v", logger.Count, logger.Last)
+	}
+
+	// a connection is torn down once, and then no longer tracked
+	conn.AttackLogger.Log(&types.Event{Type: "injection", Flow: *conn.clientFlow})
+	if len(injector.packets) != 2*COUNTERMEASURE_RSTS {
+		t.Errorf("%d RSTs sent for the connection torn down", len(injector.packets))
+	}
+	dispatcher.dispatchPacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte("data")))
+	if dispatcher.tracker.Len() != 0 {
+		t.Errorf("%d connections tracked once torn down", dispatcher.tracker.Len())
+	}
+}
@@ -0,0 +1,186 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+// dashboardHTML is the web UI the APIServer serves at /. It polls the
+// API for the sensor's stats, its connections and the recent attacks and
+// shows the connection counts, a timeline of the attacks, the hosts
+// attacked most and the attacks, each with links to its evidence.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>HoneyBadger</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+.counters { display: flex; gap: 1em; flex-wrap: wrap; }
+.counter { border: 1px solid #ccc; border-radius: 4px; padding: 0.5em 1em; min-width: 8em; }
+.counter .value { font-size: 1.6em; font-weight: bold; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.2em 0.8em; border-bottom: 1px solid #eee; font-size: 0.9em; }
+#timeline { display: flex; align-items: flex-end; height: 100px; gap: 1px; border-bottom: 1px solid #999; }
+#timeline div { background: #c33; flex: 1; min-height: 0; }
+.muted { color: #888; }
+</style>
+</head>
+<body>
+<h1>HoneyBadger <span id="sensor" class="muted"></span></h1>
+<div class="counters">
+  <div class="counter"><div class="value" id="connections">-</div>connections tracked</div>
+  <div class="counter"><div class="value" id="opened">-</div>opened per second</div>
+  <div class="counter"><div class="value" id="closed">-</div>closed per second</div>
+  <div class="counter"><div class="value" id="attacks">-</div>attacks reported</div>
+</div>
+
+<h2>Attacks of the last 24 hours</h2>
+<div id="timeline"></div>
+<div class="muted" id="timeline-range"></div>
+
+<h2>Hosts attacked most</h2>
+<table><thead><tr><th>host</th><th>attacks</th></tr></thead><tbody id="hosts"></tbody></table>
+
+<h2>Recent attacks</h2>
+<table>
+<thead><tr><th>time</th><th>type</th><th>flow</th><th>packet</th><th>evidence</th></tr></thead>
+<tbody id="reports"></tbody>
+</table>
+
+<script>
+"use strict";
+var HOURS = 24, TOP_HOSTS = 10, REPORTS = 100;
+// the flows whose evidence is listed, kept listed across refreshes
+var listed = {};
+
+function get(path) {
+  return fetch(path).then(function(response) {
+    if (!response.ok) { throw new Error(path + ": " + response.status); }
+    return response.json();
+  });
+}
+
+function cell(row, text) {
+  var td = document.createElement("td");
+  td.textContent = text;
+  row.appendChild(td);
+  return td;
+}
+
+function flowOf(report) {
+  var f = report.flow;
+  return f.src_ip + ":" + f.src_port + "-" + f.dst_ip + ":" + f.dst_port;
+}
+
+function showEvidence(td, flow) {
+  td.textContent = "...";
+  get("/api/v1/evidence?flow=" + encodeURIComponent(flow)).then(function(files) {
+    td.textContent = files.length ? "" : "none";
+    files.forEach(function(file) {
+      var a = document.createElement("a");
+      a.href = file.url;
+      a.textContent = file.name;
+      td.appendChild(a);
+      td.appendChild(document.createElement("br"));
+    });
+  }).catch(function(err) { td.textContent = err.message; });
+}
+
+function showStats(stats) {
+  document.getElementById("sensor").textContent = stats.sensor.id + (stats.sensor.site ? " @ " + stats.sensor.site : "");
+  document.getElementById("connections").textContent = stats.tracker.connections;
+  document.getElementById("opened").textContent = stats.tracker.opened_per_second.toFixed(1);
+  document.getElementById("closed").textContent = stats.tracker.closed_per_second.toFixed(1);
+  document.getElementById("attacks").textContent = stats.attacks;
+}
+
+function showTimeline(reports) {
+  var now = Date.now(), buckets = [], max = 0, i;
+  for (i = 0; i < HOURS; i++) { buckets.push(0); }
+  reports.forEach(function(report) {
+    var age = Math.floor((now - Date.parse(report.time)) / 3600000);
+    if (age >= 0 && age < HOURS) { buckets[HOURS - 1 - age]++; }
+  });
+  buckets.forEach(function(n) { max = Math.max(max, n); });
+  var timeline = document.getElementById("timeline");
+  timeline.innerHTML = "";
+  buckets.forEach(function(n, hour) {
+    var bar = document.createElement("div");
+    bar.style.height = (max ? 100 * n / max : 0) + "%";
+    bar.title = n + " attack(s), " + (HOURS - hour) + " hour(s) ago";
+    timeline.appendChild(bar);
+  });
+  document.getElementById("timeline-range").textContent = "one bar per hour, at most " + max + " attack(s) an hour";
+}
+
+function showHosts(reports) {
+  var counts = {};
+  reports.forEach(function(report) {
+    counts[report.flow.dst_ip] = (counts[report.flow.dst_ip] || 0) + 1;
+  });
+  var hosts = Object.keys(counts).sort(function(a, b) { return counts[b] - counts[a]; }).slice(0, TOP_HOSTS);
+  var tbody = document.getElementById("hosts");
+  tbody.innerHTML = "";
+  hosts.forEach(function(host) {
+    var row = document.createElement("tr");
+    cell(row, host);
+    cell(row, counts[host]);
+    tbody.appendChild(row);
+  });
+}
+
+function showReports(reports) {
+  var tbody = document.getElementById("reports");
+  tbody.innerHTML = "";
+  reports.slice(0, REPORTS).forEach(function(report) {
+    var row = document.createElement("tr"), flow = flowOf(report);
+    cell(row, new Date(report.time).toISOString().replace("T", " ").replace(/\..*/, ""));
+    cell(row, report.type + (report.occurrences > 1 ? " x" + report.occurrences : ""));
+    cell(row, flow);
+    cell(row, report.packet_count);
+    var td = cell(row, "");
+    if (listed[flow]) {
+      showEvidence(td, flow);
+    } else {
+      var a = document.createElement("a");
+      a.href = "#";
+      a.textContent = "list";
+      a.onclick = function() { listed[flow] = true; showEvidence(td, flow); return false; };
+      td.appendChild(a);
+    }
+    tbody.appendChild(row);
+  });
+}
+
+function refresh() {
+  get("/api/v1/stats").then(showStats).catch(console.error);
+  get("/api/v1/attacks?since=" + HOURS + "h").then(function(reports) {
+    showTimeline(reports);
+    showHosts(reports);
+    showReports(reports);
+  }).catch(console.error);
+}
+
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
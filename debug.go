@@ -0,0 +1,227 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+// DEBUG_RATE_INTERVAL is the interval over which the
+// packet rates the DebugServer publishes are measured.
+const DEBUG_RATE_INTERVAL = time.Second
+
+var (
+	debugVarsOnce sync.Once
+	debugMutex    sync.Mutex
+	debugServing  *DebugServer
+)
+
+// DebugServer is a control plane service serving the Go profiler and the
+// sensor's runtime variables, for profiling a sensor in production:
+//
+//	GET /debug/pprof/  the profiles of net/http/pprof
+//	GET /debug/vars    the variables of expvar as JSON
+//
+// Besides the command line and the memory and GC statistics expvar
+// publishes, the variables hold "honeybadger": the packets dispatched and
+// their rate, the packets dropped, the packets queued for decoding and
+// for each of the workers, the time spent in each detector, see
+// DetectorTimings, and the load shedding policies in effect.
+//
+// The profiles give away the internals of the sensor and may be costly
+// to take, so Addr must be a loopback address such as "localhost:6060";
+// an address without a host, such as ":6060", listens on localhost.
+type DebugServer struct {
+	Addr string
+
+	dispatcher *Dispatcher
+	supervisor *Supervisor
+	timings    *DetectorTimings
+	server     *http.Server
+	mux        *http.ServeMux
+	stopChan   chan bool
+
+	rateMutex   sync.Mutex
+	packets     uint64
+	packetRate  float64
+	rateSampled time.Time
+}
+
+// NewDebugServer returns a DebugServer listening on addr.
+func NewDebugServer(addr string) *DebugServer {
+	d := &DebugServer{
+		Addr:     addr,
+		mux:      http.NewServeMux(),
+		stopChan: make(chan bool),
+	}
+	d.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	d.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	d.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	d.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	d.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	d.mux.Handle("/debug/vars", expvar.Handler())
+	return d
+}
+
+// SetSupervisor hands the server the pipeline whose capture queue it publishes.
+func (d *DebugServer) SetSupervisor(supervisor *Supervisor) {
+	d.supervisor = supervisor
+}
+
+// Start starts timing the detectors of dispatcher and serving; if it
+// fails to listen the error is logged and nothing is served. The
+// variables published are those of the server started last.
+func (d *DebugServer) Start(dispatcher *Dispatcher) {
+	d.dispatcher = dispatcher
+	d.timings = dispatcher.TimeDetectors()
+	d.rateSampled = time.Now()
+	debugVarsOnce.Do(func() {
+		expvar.Publish("honeybadger", expvar.Func(publishDebugVars))
+	})
+	debugMutex.Lock()
+	debugServing = d
+	debugMutex.Unlock()
+	go d.sampleRates()
+
+	addr, err := loopbackAddr(d.Addr)
+	if err != nil {
+		logging.Errorf("debug server disabled: %s", err)
+		return
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		logging.Errorf("debug server disabled: %s", err)
+		return
+	}
+	d.server = &http.Server{Handler: d}
+	go func() {
+		if err := d.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logging.Warningf("debug server: %s", err)
+		}
+	}()
+}
+
+// loopbackAddr returns the address to listen on for addr, which must be
+// that of a loopback interface; one without a host listens on localhost.
+func loopbackAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" || host == "localhost" {
+		return net.JoinHostPort("localhost", port), nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return "", fmt.Errorf("%s is not a loopback address", addr)
+	}
+	return addr, nil
+}
+
+// Stop closes the listener and the connections of the server's clients.
+func (d *DebugServer) Stop() {
+	close(d.stopChan)
+	if d.server != nil {
+		d.server.Close()
+	}
+	debugMutex.Lock()
+	if debugServing == d {
+		debugServing = nil
+	}
+	debugMutex.Unlock()
+}
+
+func (d *DebugServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mux.ServeHTTP(w, r)
+}
+
+// sampleRates measures the packet rate every DEBUG_RATE_INTERVAL until stopped.
+func (d *DebugServer) sampleRates() {
+	ticker := time.NewTicker(DEBUG_RATE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopChan:
+			return
+		case now := <-ticker.C:
+			packets := d.dispatcher.Packets()
+			d.rateMutex.Lock()
+			d.packetRate = float64(packets-d.packets) / now.Sub(d.rateSampled).Seconds()
+			d.packets, d.rateSampled = packets, now
+			d.rateMutex.Unlock()
+		}
+	}
+}
+
+// debugVars are the runtime variables of the sensor a DebugServer publishes.
+type debugVars struct {
+	Packets        uint64                    `json:"packets"`
+	PacketRate     float64                   `json:"packets_per_second"`
+	DroppedPackets uint64                    `json:"dropped_packets"`
+	CaptureDrops   uint64                    `json:"capture_drops"`
+	CaptureQueue   int                       `json:"capture_queue"`
+	WorkerQueues   []int                     `json:"worker_queues"`
+	AnalysisErrors uint64                    `json:"analysis_errors"`
+	Detectors      map[string]DetectorTiming `json:"detectors"`
+	LoadShedding   []string                  `json:"load_shedding"`
+}
+
+// publishDebugVars returns the variables of the server started last.
+func publishDebugVars() interface{} {
+	debugMutex.Lock()
+	d := debugServing
+	debugMutex.Unlock()
+	if d == nil {
+		return nil
+	}
+	return d.vars()
+}
+
+func (d *DebugServer) vars() *debugVars {
+	vars := &debugVars{
+		Packets:        d.dispatcher.Packets(),
+		DroppedPackets: d.dispatcher.DroppedPackets(),
+		WorkerQueues:   d.dispatcher.QueuedPackets(),
+		AnalysisErrors: d.dispatcher.AnalysisErrors(),
+		Detectors:      d.timings.Timings(),
+		LoadShedding:   d.dispatcher.LoadShedding(),
+	}
+	d.rateMutex.Lock()
+	vars.PacketRate = d.packetRate
+	d.rateMutex.Unlock()
+	if d.supervisor != nil {
+		sniffer := d.supervisor.GetSniffer()
+		if queue, ok := sniffer.(interface{ Queued() int }); ok {
+			vars.CaptureQueue = queue.Queued()
+		}
+		if counter, ok := sniffer.(types.DropCounter); ok {
+			vars.CaptureDrops, _ = counter.Drops()
+		}
+	}
+	return vars
+}
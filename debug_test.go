@@ -0,0 +1,70 @@
+package HoneyBadger
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestDebugServer(t *testing.T) {
+	options := DispatcherOptions{
+		Logger:         NewDummyAttackLogger(),
+		MaxRingPackets: 40,
+		DetectHijack:   true,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+	debug := NewDebugServer("127.0.0.1:0")
+	debug.Start(dispatcher)
+	defer debug.Stop()
+
+	_, packet := newTestConnection(options.Logger)
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	dispatcher.ReceivePacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true}, []byte{}))
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{}))
+	dispatcher.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 100, ACK: true}, []byte{1, 2, 3}))
+	dispatcher.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 100, ACK: true}, []byte{1, 2, 3}))
+
+	// the packets have been analysed once the connections are served
+	dispatcher.LiveConnections()
+
+	recorder := httptest.NewRecorder()
+	debug.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/vars", nil))
+	var vars struct {
+		Memstats    map[string]interface{} `json:"memstats"`
+		HoneyBadger debugVars              `json:"honeybadger"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("GET /debug/vars: %s: %s", err, recorder.Body)
+	}
+	if vars.Memstats["NumGC"] == nil || vars.HoneyBadger.Packets != 5 {
+		t.Errorf("variables %+v", vars)
+	}
+	if timing := vars.HoneyBadger.Detectors["injection"]; timing.Calls != 1 || vars.HoneyBadger.Detectors["hijack"].Calls == 0 {
+		t.Errorf("detector timings %+v", vars.HoneyBadger.Detectors)
+	}
+
+	recorder = httptest.NewRecorder()
+	debug.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "goroutine") {
+		t.Errorf("GET /debug/pprof/: status %d", recorder.Code)
+	}
+}
+
+func TestLoopbackAddr(t *testing.T) {
+	for addr, expected := range map[string]string{":6060": "localhost:6060", "localhost:6060": "localhost:6060", "127.0.0.1:6060": "127.0.0.1:6060", "[::1]:6060": "[::1]:6060"} {
+		if got, err := loopbackAddr(addr); err != nil || got != expected {
+			t.Errorf("%s listens on %s, %v", addr, got, err)
+		}
+	}
+	for _, addr := range []string{"0.0.0.0:6060", "[::]:6060", "10.0.0.1:6060", "sensor.example:6060", "6060"} {
+		if _, err := loopbackAddr(addr); err == nil {
+			t.Errorf("%s accepted", addr)
+		}
+	}
+}
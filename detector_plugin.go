@@ -0,0 +1,311 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// DETECTOR_PLUGIN_QUEUE is the number of events queued for a detector
+	// plugin; events sent while its queue is full are dropped.
+	DETECTOR_PLUGIN_QUEUE = 4096
+	// DETECTOR_PLUGIN_STOP_TIMEOUT is how long a detector plugin is given
+	// to write its last reports and exit once its input is closed.
+	DETECTOR_PLUGIN_STOP_TIMEOUT = 5 * time.Second
+	// MAX_DETECTOR_REPORT is the maximum length of a report line.
+	MAX_DETECTOR_REPORT = 1024 * 1024
+)
+
+// DetectorEvent is an event of a connection sent to detector plugins:
+// either a "segment", the payload of a packet, or an "overlap", a packet
+// retransmitting the stream range [Start, End) which was reassembled
+// before; Payload is then the packet's bytes of the range and Retained
+// those reassembled earlier. Seq is the sequence of the packet's payload.
+type DetectorEvent struct {
+	Type        string         `json:"type"`
+	Flow        string         `json:"flow"`
+	Time        time.Time      `json:"time"`
+	PacketCount uint64         `json:"packet_count"`
+	Seq         types.Sequence `json:"seq"`
+	Start       types.Sequence `json:"start,omitempty"`
+	End         types.Sequence `json:"end,omitempty"`
+	Payload     []byte         `json:"payload"`
+	Retained    []byte         `json:"retained,omitempty"`
+}
+
+// DetectorReport is an attack report written by a detector plugin about
+// the connection of Flow; if Time is left out it is the time by the
+// capture clock the report is received at.
+type DetectorReport struct {
+	Flow    string         `json:"flow"`
+	Type    string         `json:"type"`
+	Time    time.Time      `json:"time"`
+	Start   types.Sequence `json:"start"`
+	End     types.Sequence `json:"end"`
+	Payload []byte         `json:"payload"`
+}
+
+// detectorReport is a report received from a plugin.
+type detectorReport struct {
+	plugin *DetectorPlugin
+	report DetectorReport
+}
+
+// DetectorPlugin is a detector run out of process, so that detection logic
+// may be written in any language: the program of Command is started with
+// the dispatcher and sent the connections' events on its standard input,
+// one JSON DetectorEvent per line. Overlap events are always sent, segment
+// events only if Segments is set. It writes its attack reports to its
+// standard output, one JSON DetectorReport per line, which are reported
+// as attacks of type "plugin-<Name>: <type>" by the connection of their
+// flow, or directly if it is no longer tracked. Its standard error is
+// logged. Payloads are base64 encoded, as encoding/json does.
+//
+// Events are queued rather than waited for; if the plugin falls behind
+// those sent while its queue is full are dropped and counted. Once the
+// dispatcher stops the plugin's standard input is closed and it is given
+// DETECTOR_PLUGIN_STOP_TIMEOUT to write its last reports and exit.
+type DetectorPlugin struct {
+	Name     string
+	Command  []string
+	Segments bool
+
+	cmd        *exec.Cmd
+	queue      chan []byte
+	closed     bool
+	dropped    uint64
+	readerDone chan bool
+	stderrDone chan bool
+	suspended  int32
+}
+
+// suspendSegments stops or resumes sending the plugin segment events;
+// they are suspended while the dispatcher sheds load.
+func (p *DetectorPlugin) suspendSegments(suspend bool) {
+	var suspended int32
+	if suspend {
+		suspended = 1
+	}
+	atomic.StoreInt32(&p.suspended, suspended)
+}
+
+// segmentsSuspended returns true if segment events are not sent to the plugin.
+func (p *DetectorPlugin) segmentsSuspended() bool {
+	return atomic.LoadInt32(&p.suspended) != 0
+}
+
+// ParseDetectorPlugins parses a semicolon separated list of detector
+// plugins; each a name, optionally followed by "+segments" if the plugin
+// takes segment events, then "=" and the space separated command running
+// it. For example: "dns+segments=/usr/local/bin/dns-detector -v; tls=tls.py".
+func ParseDetectorPlugins(plugins string) ([]*DetectorPlugin, error) {
+	var result []*DetectorPlugin
+	for _, text := range strings.Split(plugins, ";") {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		fields := strings.SplitN(text, "=", 2)
+		name := strings.TrimSpace(fields[0])
+		if len(fields) != 2 || name == "" || len(strings.Fields(fields[1])) == 0 {
+			return nil, fmt.Errorf("invalid detector plugin %q", strings.TrimSpace(text))
+		}
+		plugin := &DetectorPlugin{
+			Name:    name,
+			Command: strings.Fields(fields[1]),
+		}
+		if strings.HasSuffix(name, "+segments") {
+			plugin.Name = strings.TrimSuffix(name, "+segments")
+			plugin.Segments = true
+		}
+		result = append(result, plugin)
+	}
+	return result, nil
+}
+
+// Dropped returns the number of events dropped as the plugin fell behind.
+func (p *DetectorPlugin) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// start runs the plugin's program, sending the reports it writes to reports.
+func (p *DetectorPlugin) start(reports chan<- *detectorReport) error {
+	if len(p.Command) == 0 {
+		return fmt.Errorf("detector plugin %s: no command", p.Name)
+	}
+	cmd := exec.Command(p.Command[0], p.Command[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("detector plugin %s: %s", p.Name, err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("detector plugin %s: %s", p.Name, err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("detector plugin %s: %s", p.Name, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("detector plugin %s: %s", p.Name, err)
+	}
+	p.cmd = cmd
+	p.queue = make(chan []byte, DETECTOR_PLUGIN_QUEUE)
+	p.readerDone = make(chan bool)
+	p.stderrDone = make(chan bool)
+	go p.writeEvents(stdin)
+	go p.readReports(stdout, reports)
+	go p.logStderr(stderr)
+	logging.Logf(logging.LOG_INFO, &logging.LogFields{Detector: p.Name}, "detector plugin started: %s", strings.Join(p.Command, " "))
+	return nil
+}
+
+// send queues an encoded event for the plugin, dropping it if the
+// queue is full. Events sent before the plugin is started or after
+// its input is closed are ignored.
+func (p *DetectorPlugin) send(line []byte) {
+	if p.queue == nil || p.closed {
+		return
+	}
+	select {
+	case p.queue <- line:
+	default:
+		atomic.AddUint64(&p.dropped, 1)
+	}
+}
+
+func (p *DetectorPlugin) writeEvents(stdin io.WriteCloser) {
+	failed := false
+	for line := range p.queue {
+		if failed {
+			atomic.AddUint64(&p.dropped, 1)
+			continue
+		}
+		if _, err := stdin.Write(line); err != nil {
+			logging.Logf(logging.LOG_WARNING, &logging.LogFields{Detector: p.Name}, "failed to send events to detector plugin: %s", err)
+			failed = true
+			atomic.AddUint64(&p.dropped, 1)
+		}
+	}
+	stdin.Close()
+}
+
+func (p *DetectorPlugin) readReports(stdout io.Reader, reports chan<- *detectorReport) {
+	defer close(p.readerDone)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 4096), MAX_DETECTOR_REPORT)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		report := &detectorReport{plugin: p}
+		if err := json.Unmarshal(scanner.Bytes(), &report.report); err != nil {
+			logging.Logf(logging.LOG_WARNING, &logging.LogFields{Detector: p.Name}, "invalid detector plugin report: %s", err)
+			continue
+		}
+		reports <- report
+	}
+	if err := scanner.Err(); err != nil {
+		logging.Logf(logging.LOG_WARNING, &logging.LogFields{Detector: p.Name}, "failed to read detector plugin reports: %s", err)
+		// keep the plugin from blocking on a full pipe
+		io.Copy(io.Discard, stdout)
+	}
+}
+
+func (p *DetectorPlugin) logStderr(stderr io.Reader) {
+	defer close(p.stderrDone)
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		logging.Logf(logging.LOG_WARNING, &logging.LogFields{Detector: p.Name}, "%s", scanner.Text())
+	}
+	io.Copy(io.Discard, stderr)
+}
+
+// closeInput closes the plugin's standard input once the events
+// queued have been written, telling it to finish.
+func (p *DetectorPlugin) closeInput() {
+	if p.queue == nil || p.closed {
+		return
+	}
+	p.closed = true
+	close(p.queue)
+}
+
+// kill ends the plugin's program.
+func (p *DetectorPlugin) kill() {
+	if p.cmd != nil {
+		p.cmd.Process.Kill()
+	}
+}
+
+// wait waits for the plugin's program to exit, once its output has been read.
+func (p *DetectorPlugin) wait() {
+	if p.cmd == nil {
+		return
+	}
+	<-p.stderrDone
+	fields := &logging.LogFields{Detector: p.Name}
+	if err := p.cmd.Wait(); err != nil {
+		logging.Logf(logging.LOG_WARNING, fields, "detector plugin exited: %s", err)
+	}
+	if dropped := p.Dropped(); dropped != 0 {
+		logging.Logf(logging.LOG_WARNING, fields, "%d event(s) dropped as the detector plugin fell behind", dropped)
+	}
+	p.cmd = nil
+}
+
+// attackReporter is implemented by connections which report the attacks
+// detected by plugins like their own.
+type attackReporter interface {
+	logAttack(event *types.Event)
+}
+
+// detectorPluginType returns the attack type of a report of a plugin.
+func detectorPluginType(plugin *DetectorPlugin, reportType string) string {
+	return fmt.Sprintf("plugin-%s: %s", plugin.Name, reportType)
+}
+
+// sendDetectorEvent sends an event to the plugins taking events of its type.
+func sendDetectorEvent(plugins []*DetectorPlugin, event *DetectorEvent) {
+	var line []byte
+	for _, plugin := range plugins {
+		if event.Type == "segment" && (!plugin.Segments || plugin.segmentsSuspended()) {
+			continue
+		}
+		if line == nil {
+			encoded, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			line = append(encoded, '\n')
+		}
+		plugin.send(line)
+	}
+}
@@ -0,0 +1,114 @@
+package HoneyBadger
+
+import (
+	"encoding/json"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestParseDetectorPlugins(t *testing.T) {
+	plugins, err := ParseDetectorPlugins("dns+segments=/usr/local/bin/dns-detector -v; overlaps = python3 overlaps.py ;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plugins) != 2 {
+		t.Fatalf("%d plugins parsed", len(plugins))
+	}
+	if plugins[0].Name != "dns" || !plugins[0].Segments || len(plugins[0].Command) != 2 || plugins[0].Command[1] != "-v" {
+		t.Errorf("first plugin parsed as %+v", plugins[0])
+	}
+	if plugins[1].Name != "overlaps" || plugins[1].Segments || len(plugins[1].Command) != 2 || plugins[1].Command[0] != "python3" {
+		t.Errorf("second plugin parsed as %+v", plugins[1])
+	}
+	for _, invalid := range []string{"dns", "=detector", "dns= "} {
+		if _, err := ParseDetectorPlugins(invalid); err == nil {
+			t.Errorf("invalid detector plugin %q parsed", invalid)
+		}
+	}
+}
+
+func TestConnectionDetectorEvents(t *testing.T) {
+	conn, packet := newTestConnection(NewDummyAttackLogger())
+	segments := &DetectorPlugin{Name: "segments", Segments: true, queue: make(chan []byte, 10)}
+	overlaps := &DetectorPlugin{Name: "overlaps", queue: make(chan []byte, 10)}
+	conn.DetectorPlugins = []*DetectorPlugin{segments, overlaps}
+
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, ACK: true, Ack: 500}, []byte("hello")))
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 102, ACK: true, Ack: 500}, []byte("LLO!")))
+
+	var events []DetectorEvent
+	for len(segments.queue) > 0 {
+		var event DetectorEvent
+		if err := json.Unmarshal(<-segments.queue, &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 3 || events[0].Type != "segment" || events[1].Type != "overlap" || events[2].Type != "segment" {
+		t.Fatalf("segment plugin sent %+v", events)
+	}
+	overlap := events[1]
+	if overlap.Flow != "1.2.3.4:1-2.3.4.5:2" || overlap.Seq != 102 || overlap.Start != 102 || overlap.End != 105 || overlap.PacketCount != 2 {
+		t.Errorf("overlap event %+v", overlap)
+	}
+	if string(overlap.Payload) != "LLO" || string(overlap.Retained) != "llo" {
+		t.Errorf("overlap of %q over %q", overlap.Payload, overlap.Retained)
+	}
+	if len(overlaps.queue) != 1 {
+		t.Errorf("overlap plugin sent %d events", len(overlaps.queue))
+	}
+}
+
+func TestDispatcherDetectorPlugin(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell to run the detector plugin with")
+	}
+	logger := NewDummyAttackLogger()
+	plugin := &DetectorPlugin{
+		Name:     "test",
+		Segments: true,
+		Command: []string{"sh", "-c", `read event
+echo 'not json'
+echo '{"flow":"bogus","type":"ignored"}'
+echo '{"flow":"2.3.4.5:2-1.2.3.4:1","type":"bad segment","start":100,"end":105}'
+cat > /dev/null
+echo '{"flow":"1.2.3.4:1-2.3.4.5:2","type":"late"}'
+echo 'plugin exiting' >&2`},
+	}
+	options := DispatcherOptions{
+		MaxRingPackets:  40,
+		Logger:          logger,
+		DetectorPlugins: []*DetectorPlugin{plugin},
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	dispatcher.Start()
+	_, packet := newTestConnection(logger)
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 100, ACK: true, Ack: 500}, []byte("hello")))
+
+	var attacks uint64
+	for deadline := time.Now().Add(10 * time.Second); attacks == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		dispatcher.query(func() {
+			if conns := dispatcher.Connections(); len(conns) == 1 {
+				attacks = conns[0].(*Connection).Stats().Attacks
+			}
+		})
+	}
+	if attacks != 1 {
+		t.Fatal("plugin report not reported by its connection")
+	}
+	if logger.Last.Type != "plugin-test: bad segment" || logger.Last.Start != 100 || logger.Last.End != 105 || logger.Last.Time.IsZero() {
+		t.Errorf("plugin report logged as %+v", logger.Last)
+	}
+
+	dispatcher.Stop()
+	if logger.Count != 2 || logger.Last.Type != "plugin-test: late" {
+		t.Errorf("%d reports logged, last %+v", logger.Count, logger.Last)
+	}
+	if plugin.cmd != nil {
+		t.Error("plugin still running once the dispatcher stopped")
+	}
+}
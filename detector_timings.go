@@ -0,0 +1,128 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The detectors whose analysis DetectorTimings accounts for.
+const (
+	DETECTOR_HIJACK = iota
+	DETECTOR_INJECTION
+	DETECTOR_COALESCE_INJECTION
+	DETECTOR_PLUGINS
+	detectorCount
+)
+
+var detectorNames = [detectorCount]string{"hijack", "injection", "coalesce_injection", "plugins"}
+
+// detectorBuckets are the upper bounds of the buckets of the histogram
+// of the time calls into a detector take.
+var detectorBuckets = [...]time.Duration{
+	time.Microsecond,
+	5 * time.Microsecond,
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+// DetectorTimings accounts for the calls into each of the detectors and
+// the time spent in them, by the connections of all workers. A nil
+// DetectorTimings accounts for nothing and costs nothing.
+type DetectorTimings struct {
+	calls       [detectorCount]uint64
+	nanoseconds [detectorCount]uint64
+	buckets     [detectorCount][len(detectorBuckets)]uint64
+}
+
+// DetectorTiming is the number of calls into a detector and the total
+// and mean time they took.
+type DetectorTiming struct {
+	Calls        uint64  `json:"calls"`
+	Seconds      float64 `json:"seconds"`
+	Microseconds float64 `json:"mean_microseconds"`
+}
+
+// start returns the time a call into a detector started.
+func (t *DetectorTimings) start() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// done accounts for a call into the detector which started at started.
+func (t *DetectorTimings) done(detector int, started time.Time) {
+	if t == nil {
+		return
+	}
+	elapsed := time.Since(started)
+	atomic.AddUint64(&t.calls[detector], 1)
+	atomic.AddUint64(&t.nanoseconds[detector], uint64(elapsed))
+	for bucket, bound := range detectorBuckets {
+		if elapsed <= bound {
+			atomic.AddUint64(&t.buckets[detector][bucket], 1)
+			break
+		}
+	}
+}
+
+// histogram returns the number of calls into the detector which took at
+// most each of detectorBuckets, cumulatively.
+func (t *DetectorTimings) histogram(detector int) [len(detectorBuckets)]uint64 {
+	var counts [len(detectorBuckets)]uint64
+	if t == nil {
+		return counts
+	}
+	total := uint64(0)
+	for bucket := range detectorBuckets {
+		total += atomic.LoadUint64(&t.buckets[detector][bucket])
+		counts[bucket] = total
+	}
+	return counts
+}
+
+// Timings returns the timing of each detector, by name.
+func (t *DetectorTimings) Timings() map[string]DetectorTiming {
+	timings := make(map[string]DetectorTiming)
+	if t == nil {
+		return timings
+	}
+	for detector, name := range detectorNames {
+		calls := atomic.LoadUint64(&t.calls[detector])
+		elapsed := time.Duration(atomic.LoadUint64(&t.nanoseconds[detector]))
+		timing := DetectorTiming{
+			Calls:   calls,
+			Seconds: elapsed.Seconds(),
+		}
+		if calls != 0 {
+			timing.Microseconds = float64(elapsed.Microseconds()) / float64(calls)
+		}
+		timings[name] = timing
+	}
+	return timings
+}
@@ -20,11 +20,15 @@
 package HoneyBadger
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/gopacket/layers"
-
+	"github.com/david415/HoneyBadger/logging"
 	"github.com/david415/HoneyBadger/types"
 )
 
@@ -40,16 +44,65 @@ type DispatcherOptions struct {
 	BufferedPerConnection    int
 	BufferedTotal            int
 	LogDir                   string
+	ArchiveDir               string
 	LogPackets               bool
+	RetainStreams            bool
+	RetainStreamPorts        []int
+	StreamSpillBytes         int
+	Compressor               types.Compressor
+	StreamReaders            bool
+	StreamReaderMaxBytes     int
+	SnippetPackets           int
+	DuplicateWindow          time.Duration
+	HijackDetectionPackets   int
 	MaxPcapLogRotations      int
 	MaxPcapLogSize           int
 	TcpIdleTimeout           time.Duration
 	MaxRingPackets           int
+	MaxRingBytes             int
+	MaxRetainedBytes         int
+	RetentionPolicy          int
 	Logger                   types.Logger
+	ConnectionLogger         types.Logger
 	DetectHijack             bool
 	DetectInjection          bool
 	DetectCoalesceInjection  bool
+	Unidirectional           bool
 	MaxConcurrentConnections int
+	EvictConnections         bool
+	SampleRate               float64
+	PriorityPorts            []int
+	TrackingRules            []TrackingRule
+	TrackerShards            int
+	SnapshotFile             string
+	SnapshotStreams          bool
+	Hooks                    Hooks
+	DetectorPlugins          []*DetectorPlugin
+	// Workers is the number of goroutines analysing packets, each the
+	// connections of its share of the tracker's shards; if more than one
+	// the Logger, ConnectionLogger and Hooks must be safe for concurrent
+	// use, and ReceivePacket must not be called concurrently. Packets for
+	// a worker whose queue of WorkerQueue packets is full are dropped and
+	// counted, see Dispatcher.DroppedPackets.
+	Workers     int
+	WorkerQueue int
+	// LoadShedding is how load is shed while captured packets are
+	// dropped, if a drop counter is set; see SetDropCounter.
+	LoadShedding LoadSheddingOptions
+	// WorkerCPUs, if set, are the CPUs the goroutines analysing packets
+	// run on; each worker's thread is bound to the next of them, or the
+	// dispatcher's to the first if there are no Workers.
+	WorkerCPUs []int
+	// DropAlarms are the thresholds of the packet loss alarms reported
+	// to the Logger; see DropAlarmOptions.
+	DropAlarms DropAlarmOptions
+	// MemoryWatermark is the memory ceiling of the process and how
+	// the dispatcher responds to memory pressure; see
+	// MemoryWatermarkOptions.
+	MemoryWatermark MemoryWatermarkOptions
+	// Countermeasure opts in to tearing down the connections attacks
+	// are reported for; see CountermeasureOptions.
+	Countermeasure CountermeasureOptions
 }
 
 // Inquisitor sets up the connection pool and is an abstraction layer for dealing
@@ -60,27 +113,61 @@ type Dispatcher struct {
 	observeConnectionCount int
 	observeConnectionChan  chan bool
 	dispatchPacketChan     chan *types.PacketManifest
-	stopDispatchChan       chan bool
+	cancel                 context.CancelFunc
+	doneChan               chan bool
+	queryChan              chan func()
 	closeConnectionChan    chan ConnectionInterface
 	pageCache              *pageCache
+	memoryBudget           *MemoryBudget
 	PacketLoggerFactory    types.PacketLoggerFactory
-	poolTcpIpv4            map[types.HashedTcpIpv4Flow]ConnectionInterface
-	poolTcpIpv6            map[types.HashedTcpIpv6Flow]ConnectionInterface
+	tracker                *ConnTracker
+	workers                []*dispatchWorker
+	workersPaused          chan bool
+	events                 eventHub
+	analysisErrors         uint64
+	detectorReports        chan *detectorReport
+	packets                uint64
+	payloadBytes           uint64
+	timings                *DetectorTimings
+	// clockMutex guards the capture clock, the connections restored
+	// before it started and the flows to capture, which workers share
+	clockMutex     sync.Mutex
+	captureTime    time.Time
+	captureArrival time.Time
+	restored       []snapshotConnection
+	captureFlows   map[types.FlowKey]bool
+	shedder        loadShedder
+	watchdog       dropWatchdog
+	watermark      memoryWatermark
+	countermeasure countermeasure
 }
 
 // NewInquisitor creates a new Inquisitor struct
 func NewDispatcher(options DispatcherOptions, connectionFactory ConnectionFactory, packetLoggerFactory types.PacketLoggerFactory) *Dispatcher {
+	// each worker owns at least one of the tracker's shards
+	shards := options.TrackerShards
+	if shards < options.Workers {
+		shards = options.Workers
+	}
 	i := Dispatcher{
 		PacketLoggerFactory:   packetLoggerFactory,
 		connectionFactory:     connectionFactory,
 		options:               options,
 		dispatchPacketChan:    make(chan *types.PacketManifest),
-		stopDispatchChan:      make(chan bool),
+		doneChan:              make(chan bool),
+		queryChan:             make(chan func()),
 		closeConnectionChan:   make(chan ConnectionInterface),
 		pageCache:             newPageCache(),
+		memoryBudget:          NewMemoryBudget(int64(options.MaxRetainedBytes), options.RetentionPolicy),
 		observeConnectionChan: make(chan bool, 0),
-		poolTcpIpv4: make(map[types.HashedTcpIpv4Flow]ConnectionInterface),
-		poolTcpIpv6: make(map[types.HashedTcpIpv6Flow]ConnectionInterface),
+		tracker:               NewConnTracker(shards),
+		detectorReports:       make(chan *detectorReport),
+	}
+	if options.EvictConnections {
+		i.tracker.MaxConnections = options.MaxConcurrentConnections
+	}
+	if options.Workers > 1 {
+		i.setupWorkers()
 	}
 	return &i
 }
@@ -92,14 +179,119 @@ func (i *Dispatcher) GetObservedConnectionsChan(count int) chan bool {
 
 // Start... starts the TCP attack inquisition!
 func (i *Dispatcher) Start() {
-	go i.dispatchPackets()
+	i.StartContext(context.Background())
 }
 
-// Stop... stops the TCP attack inquisition!
+// StartContext starts dispatching packets until ctx is cancelled or Stop
+// is called. The detector plugins are started first, a plugin failing to
+// start is logged and left out. If a snapshot file is set the connections
+// saved to it when last stopped are restored next. Once stopped the dispatcher saves its
+// snapshot and closes its connections, reporting any attacks they hold,
+// on the goroutine which dispatched their packets; packets received
+// after that are dropped. If there are Workers they are started
+// last, and analyse the packets they were queued until then.
+func (i *Dispatcher) StartContext(ctx context.Context) {
+	for _, plugin := range i.options.DetectorPlugins {
+		if err := plugin.start(i.detectorReports); err != nil {
+			logging.Warningf("%s", err)
+		}
+	}
+	if i.options.SnapshotFile != "" {
+		count, err := i.LoadSnapshot(i.options.SnapshotFile)
+		if err != nil && !os.IsNotExist(err) {
+			logging.Warningf("failed to restore connections from snapshot: %s", err)
+		} else if err == nil {
+			logging.Infof("%d connection(s) restored from snapshot", count)
+		}
+	}
+	ctx, i.cancel = context.WithCancel(ctx)
+	i.startWorkers()
+	go i.dispatchPackets(ctx)
+}
+
+// Stop... stops the TCP attack inquisition! It returns
+// once the connections have been closed.
 func (i *Dispatcher) Stop() {
-	i.stopDispatchChan <- true
+	if i.cancel == nil {
+		// never started
+		i.shutdown()
+		return
+	}
+	i.cancel()
+	<-i.doneChan
+}
+
+// shutdown saves the snapshot, if a snapshot file is set, closes all
+// connections, stops the detector plugins and then ends the subscriptions.
+func (i *Dispatcher) shutdown() {
+	if i.options.SnapshotFile != "" {
+		if err := i.SaveSnapshot(i.options.SnapshotFile); err != nil {
+			logging.Warningf("failed to save connections snapshot: %s", err)
+		}
+	}
 	closedConns := i.CloseAllConnections()
-	log.Printf("%d connection(s) closed.", closedConns)
+	logging.Infof("%d connection(s) closed", closedConns)
+	i.stopDetectorPlugins()
+	i.events.close()
+}
+
+// stopDetectorPlugins closes the detector plugins' input and reports
+// what they write until they have exited; plugins which have not by
+// DETECTOR_PLUGIN_STOP_TIMEOUT are killed.
+func (i *Dispatcher) stopDetectorPlugins() {
+	for _, plugin := range i.options.DetectorPlugins {
+		plugin.closeInput()
+	}
+	timeout := time.After(DETECTOR_PLUGIN_STOP_TIMEOUT)
+	for _, plugin := range i.options.DetectorPlugins {
+		if plugin.readerDone == nil {
+			continue
+		}
+		for done := false; !done; {
+			select {
+			case report := <-i.detectorReports:
+				i.detectorReport(report)
+			case <-plugin.readerDone:
+				done = true
+			case <-timeout:
+				logging.Warningf("killing detector plugins which have not exited")
+				for _, plugin := range i.options.DetectorPlugins {
+					plugin.kill()
+				}
+			}
+		}
+		plugin.wait()
+	}
+}
+
+// detectorReport reports an attack reported by a detector plugin through
+// the connection of its flow, or directly if it is not tracked.
+func (i *Dispatcher) detectorReport(report *detectorReport) {
+	flow, err := types.ParseTcpIpFlow(report.report.Flow)
+	if err != nil {
+		logging.Logf(logging.LOG_WARNING, &logging.LogFields{Detector: report.plugin.Name}, "invalid detector plugin report: %s", err)
+		return
+	}
+	event := &types.Event{
+		Type:    detectorPluginType(report.plugin, report.report.Type),
+		Time:    report.report.Time,
+		Flow:    *flow,
+		Start:   report.report.Start,
+		End:     report.report.End,
+		Payload: report.report.Payload,
+	}
+	if event.Time.IsZero() {
+		event.Time = i.captureNow()
+	}
+	conn, ok := i.tracker.Get(flow)
+	if reporter, isReporter := conn.(attackReporter); ok && isReporter {
+		event.PacketCount = conn.Info().Packets
+		reporter.logAttack(event)
+		return
+	}
+	logger := i.attackLogger(flow)
+	logger.conn = conn
+	logger.Log(event)
 }
 
 // connectionsLocked returns a slice of Connection pointers.
@@ -108,36 +300,163 @@ func (i *Dispatcher) Connections() []ConnectionInterface {
 }
 
 func (i *Dispatcher) connections() []ConnectionInterface {
-	conns := make([]ConnectionInterface, 0, len(i.poolTcpIpv4) + len(i.poolTcpIpv6))
-	for _, conn := range i.poolTcpIpv4 {
-		conns = append(conns, conn)
-	}
-	for _, conn := range i.poolTcpIpv6 {
-		conns = append(conns, conn)
+	return i.tracker.Connections()
+}
+
+// query runs fn on the goroutine dispatching packets to the connections,
+// where the connections' state may safely be read, and waits for it.
+// Once the dispatcher has stopped fn is run right away.
+func (i *Dispatcher) query(fn func()) {
+	done := make(chan bool)
+	select {
+	case i.queryChan <- func() {
+		fn()
+		done <- true
+	}:
+		<-done
+	case <-i.doneChan:
+		fn()
 	}
-	return conns
 }
 
+// Metrics returns the runtime metrics of the connection tracker.
+func (i *Dispatcher) Metrics() ConnTrackerMetrics {
+	var metrics ConnTrackerMetrics
+	i.query(func() {
+		metrics = i.tracker.Metrics()
+	})
+	return metrics
+}
+
+// Options returns the options of the dispatcher, as last reconfigured.
+func (i *Dispatcher) Options() DispatcherOptions {
+	var options DispatcherOptions
+	i.query(func() {
+		options = i.options
+	})
+	return options
+}
+
+// AnalysisErrors returns the number of packets the dispatcher and its
+// connections failed to analyse and of inconsistencies met closing them.
+func (i *Dispatcher) AnalysisErrors() uint64 {
+	return atomic.LoadUint64(&i.analysisErrors)
+}
+
+// Packets returns the number of packets the dispatcher was handed.
+func (i *Dispatcher) Packets() uint64 {
+	return atomic.LoadUint64(&i.packets)
+}
+
+// PayloadBytes returns the number of TCP payload bytes of the packets
+// the dispatcher was handed.
+func (i *Dispatcher) PayloadBytes() uint64 {
+	return atomic.LoadUint64(&i.payloadBytes)
+}
+
+// TimeDetectors starts accounting for the time the detectors of the
+// connections set up from now on take, and returns their timings.
+func (i *Dispatcher) TimeDetectors() *DetectorTimings {
+	var timings *DetectorTimings
+	i.query(func() {
+		if i.timings == nil {
+			i.timings = &DetectorTimings{}
+		}
+		timings = i.timings
+	})
+	return timings
+}
+
+// LiveConnections returns a description of each connection currently tracked.
+func (i *Dispatcher) LiveConnections() []ConnectionInfo {
+	var infos []ConnectionInfo
+	i.query(func() {
+		i.tracker.Walk(func(conn ConnectionInterface) bool {
+			infos = append(infos, conn.Info())
+			return true
+		})
+	})
+	return infos
+}
+
+// Reconfigure applies the settings of options that may change while the
+// dispatcher runs, keeping the connections it tracks: the detectors and
+// HijackDetectionPackets, which the tracked connections take up too, and
+// the tracking rules, sample rate and priority ports, which decide which
+// new connections are tracked; tracked connections matching a "never"
+// tracking rule are closed. The other options are left as they were.
+func (i *Dispatcher) Reconfigure(options DispatcherOptions) {
+	i.query(func() {
+		i.options.DetectHijack = options.DetectHijack
+		i.options.DetectInjection = options.DetectInjection
+		i.options.DetectCoalesceInjection = options.DetectCoalesceInjection
+		i.options.HijackDetectionPackets = options.HijackDetectionPackets
+		i.options.TrackingRules = options.TrackingRules
+		i.options.SampleRate = options.SampleRate
+		i.options.PriorityPorts = options.PriorityPorts
+
+		detection := ConnectionOptions{
+			DetectHijack:            options.DetectHijack,
+			DetectInjection:         options.DetectInjection,
+			DetectCoalesceInjection: options.DetectCoalesceInjection,
+			HijackDetectionPackets:  options.HijackDetectionPackets,
+		}
+		var untracked []ConnectionInterface
+		i.tracker.Walk(func(conn ConnectionInterface) bool {
+			if action, ok := matchTrackingRules(i.options.TrackingRules, conn.GetClientFlow()); ok && action == TRACK_NEVER {
+				untracked = append(untracked, conn)
+			} else {
+				conn.Reconfigure(detection)
+			}
+			return true
+		})
+		if closed := i.closeConnectionList(untracked); closed != 0 {
+			logging.Infof("closed %d connection(s) no longer tracked", closed)
+		}
+	})
+}
+
+// ReceivePacket hands a packet to the dispatcher, or queues it for the
+// worker analysing its connection if there are Workers, along with the
+// reference to it if it is pooled; it is released once analysed.
 func (i *Dispatcher) ReceivePacket(p *types.PacketManifest) {
-	i.dispatchPacketChan <- p
+	atomic.AddUint64(&i.packets, 1)
+	atomic.AddUint64(&i.payloadBytes, uint64(len(p.Payload)))
+	if i.workers != nil {
+		select {
+		case <-i.doneChan:
+			p.Release()
+		default:
+			i.queuePacket(p)
+		}
+		return
+	}
+	select {
+	case i.dispatchPacketChan <- p:
+	case <-i.doneChan:
+		p.Release()
+	}
 }
 
 // CloseOlderThan takes a Time argument and closes all the connections
 // that have not received packet since that specified time
 func (i *Dispatcher) CloseOlderThan(t time.Time) int {
-	conns := i.connections()
-	if conns == nil {
-		return 0
+	count := 0
+	for shard := 0; shard < i.tracker.ShardCount(); shard++ {
+		count += i.closeShardOlderThan(shard, t)
 	}
+	return count
+}
 
-	closeList := make([]ConnectionInterface,0)
-	for _, conn := range conns {
-		lastSeen := conn.GetLastSeen()
-		if lastSeen.Equal(t) || lastSeen.Before(t) {
-			conns = append(conns, conn)
-		}
+// closeShardOlderThan closes the connections of one of the
+// tracker's shards that have not received a packet since t.
+func (i *Dispatcher) closeShardOlderThan(shard int, t time.Time) int {
+	expired := i.tracker.ExpireShard(shard, t)
+	for _, conn := range expired {
+		i.connectionEvent("connection-closed", conn)
+		conn.Close()
 	}
-	return i.closeConnectionList(closeList)
+	return len(expired)
 }
 
 // CloseAllConnections closes all connections in the pool.
@@ -152,107 +471,467 @@ func (i *Dispatcher) CloseAllConnections() int {
 func (i *Dispatcher) closeConnectionList(conns []ConnectionInterface) int {
 	count := 0
 	for _, conn := range conns {
-		tcpip_flow := conn.GetClientFlow()
-		netFlow, _ := tcpip_flow.Flows()
-		eType := netFlow.EndpointType()
-		if eType == layers.EndpointIPv4 {
-			delete(i.poolTcpIpv4, types.NewHashedTcpIpv4Flow(tcpip_flow))
-			count += 1
-		} else if eType == layers.EndpointIPv6 {
-			delete(i.poolTcpIpv6, types.NewHashedTcpIpv6Flow(tcpip_flow))
-			count += 1
-		} else {
-			panic("wtf")
+		if err := i.tracker.Delete(conn.GetClientFlow()); err != nil {
+			i.analysisError(err)
 		}
+		count += 1
+		i.connectionEvent("connection-closed", conn)
 		conn.Close()
 	}
 	return count
 }
 
+// retainStreams returns true if the complete streams of the given
+// connection should be retained; either every connection's are or, if any
+// ports were specified, those of connections to or from one of those ports.
+func (i *Dispatcher) retainStreams(flow *types.TcpIpFlow) bool {
+	if !i.options.RetainStreams {
+		return false
+	}
+	if len(i.options.RetainStreamPorts) == 0 {
+		return true
+	}
+	return flowHasPort(flow, i.options.RetainStreamPorts)
+}
+
+// sampling returns true if only a fraction of all connections is tracked.
+func (i *Dispatcher) sampling() bool {
+	return i.sampleRate() < 1
+}
+
+// track returns true if a new connection of the given flow should be
+// tracked. The first tracking rule the connection matches decides, otherwise
+// if sampling, connections using a priority port are always tracked.
+func (i *Dispatcher) track(flow *types.TcpIpFlow) bool {
+	if action, ok := matchTrackingRules(i.options.TrackingRules, flow); ok {
+		return action == TRACK_ALWAYS
+	}
+	return i.priority(flow) || sampleFlow(flow, i.sampleRate())
+}
+
+// priority returns true if a connection of the given flow is always tracked
+// as it matches an "always" tracking rule or uses a priority port.
+func (i *Dispatcher) priority(flow *types.TcpIpFlow) bool {
+	if action, ok := matchTrackingRules(i.options.TrackingRules, flow); ok {
+		return action == TRACK_ALWAYS
+	}
+	return flowHasPort(flow, i.options.PriorityPorts)
+}
+
+// attackLogger returns the attack logger for a new connection of the given flow,
+// which calls the attack hooks and publishes to the subscriptions as well;
+// if sampling, reports note the sampling rate the connection was tracked at.
+func (i *Dispatcher) attackLogger(flow *types.TcpIpFlow) *connectionReporter {
+	logger := i.options.Logger
+	if i.sampling() && logger != nil {
+		if i.priority(flow) {
+			logger = sampledLogger{Logger: logger, SampleRate: 1}
+		} else {
+			logger = sampledLogger{Logger: logger, SampleRate: i.sampleRate()}
+		}
+	}
+	return &connectionReporter{Logger: logger, dispatcher: i}
+}
+
+// connectionFor returns the connection tracking the packet's 4-tuple,
+// setting up a new one if there is none yet or if a SYN reuses the 4-tuple
+// of a closed connection. It returns nil if the new connection is not sampled
+// for tracking, if no new connections are tracked under memory pressure
+// or if MaxConcurrentConnections
+// connections are already being tracked, unless EvictConnections is set;
+// the least recently active connection is then evicted instead.
+// opened reports whether the connection was newly set up.
+func (i *Dispatcher) connectionFor(p *types.PacketManifest) (conn ConnectionInterface, opened bool) {
+	conn, ok := i.tracker.Get(p.Flow)
+	if !ok {
+		if !i.track(p.Flow) && !i.captureRequested(p.Flow) {
+			return nil, false
+		}
+		if i.memoryStage(MEMORY_REFUSE_CONNECTIONS) {
+			return nil, false
+		}
+		if !i.options.EvictConnections && i.options.MaxConcurrentConnections != 0 && i.tracker.Len() >= i.options.MaxConcurrentConnections {
+			return nil, false
+		}
+		return i.setupNewConnection(p.Flow), true
+	}
+	if p.TCP.SYN && !p.TCP.ACK && conn.IsClosed() {
+		// the 4-tuple is being reused; don't feed the new
+		// connection into the finished one's state machine
+		logging.Logf(logging.LOG_DEBUG, &logging.LogFields{Flow: p.Flow}, "new connection on closed connection's 4-tuple")
+		i.closeConnectionList([]ConnectionInterface{conn})
+		return i.setupNewConnection(p.Flow), true
+	}
+	return conn, false
+}
+
 func (i *Dispatcher) setupNewConnection(flow *types.TcpIpFlow) ConnectionInterface {
+	reporter := i.attackLogger(flow)
 	options := ConnectionOptions{
 		MaxBufferedPagesTotal:         i.options.BufferedTotal,
 		MaxBufferedPagesPerConnection: i.options.BufferedPerConnection,
 		MaxRingPackets:                i.options.MaxRingPackets,
-		PageCache:                     i.pageCache,
+		MaxRingBytes:                  i.options.MaxRingBytes,
+		MemoryBudget:                  i.memoryBudget,
+		PageCache:                     i.pageCacheOf(flow),
 		LogDir:                        i.options.LogDir,
-		AttackLogger:                  i.options.Logger,
+		ArchiveDir:                    i.options.ArchiveDir,
+		RetainStreams:                 i.retainStreams(flow),
+		StreamSpillBytes:              i.options.StreamSpillBytes,
+		StreamCompressor:              i.options.Compressor,
+		StreamReaders:                 i.options.StreamReaders,
+		StreamReaderMaxBytes:          i.options.StreamReaderMaxBytes,
+		SnippetPackets:                i.options.SnippetPackets,
+		DuplicateWindow:               i.options.DuplicateWindow,
+		HijackDetectionPackets:        i.options.HijackDetectionPackets,
+		AttackLogger:                  reporter,
+		AnalysisErrors:                &i.analysisErrors,
+		DetectorPlugins:               i.options.DetectorPlugins,
+		DetectorTimings:               i.timings,
 		LogPackets:                    i.options.LogPackets,
 		DetectHijack:                  i.options.DetectHijack,
 		DetectInjection:               i.options.DetectInjection,
 		DetectCoalesceInjection:       i.options.DetectCoalesceInjection,
+		Unidirectional:                i.options.Unidirectional,
+	}
+	if i.shedding(SHED_PAYLOAD) && !i.priority(flow) {
+		// the latest segment is kept to compare retransmissions with
+		options.MaxRingPackets = 1
+		options.RetainStreams = false
+		options.StreamReaders = false
+	}
+	if i.memoryStage(MEMORY_SHRINK_RETENTION) && (options.MaxRingPackets <= 0 || options.MaxRingPackets > MEMORY_SHRINK_PAGES) {
+		options.MaxRingPackets = MEMORY_SHRINK_PAGES
 	}
 
 	conn := i.connectionFactory.Build(options)
-	if i.options.LogPackets {
-		packetLogger := i.PacketLoggerFactory.Build(flow)
+	reporter.conn = conn
+	key, _ := types.NewFlowKey(flow)
+	i.clockMutex.Lock()
+	capture := i.captureFlows[key]
+	delete(i.captureFlows, key)
+	i.clockMutex.Unlock()
+	capturing, ok := conn.(capturingConnection)
+	capture = capture && ok && i.PacketLoggerFactory != nil
+	if i.options.LogPackets || capture {
+		packetLogger := i.newPacketLogger(flow)
 		conn.SetPacketLogger(packetLogger)
+		if capture {
+			capturing.CapturePackets(packetLogger)
+		}
 		packetLogger.Start()
 	}
 
-	ipFlow, _ := flow.Flows()
-	eType := ipFlow.EndpointType()
-	if eType == layers.EndpointIPv4 {
-		i.poolTcpIpv4[types.NewHashedTcpIpv4Flow(flow)] = conn
-	} else if eType == layers.EndpointIPv6 {
-		i.poolTcpIpv6[types.NewHashedTcpIpv6Flow(flow)] = conn
-	} else {
-		panic("wtf")
+	if evicted := i.tracker.Put(flow, conn); evicted != nil {
+		i.evictConnection(evicted)
 	}
 
-	if i.observeConnectionCount != 0 && i.observeConnectionCount == len(i.connections()) {
+	if i.observeConnectionCount != 0 && i.observeConnectionCount == i.tracker.Len() {
 		i.observeConnectionChan <- true
 	}
 	return conn
 }
 
-func (i *Dispatcher) dispatchPackets() {
-	var conn ConnectionInterface
-	timeout := i.options.TcpIdleTimeout
-	ticker := time.Tick(timeout)
+// newPacketLogger builds the packet logger of the connection of flow,
+// which reports its errors as analysis errors.
+func (i *Dispatcher) newPacketLogger(flow *types.TcpIpFlow) types.PacketLogger {
+	packetLogger := i.PacketLoggerFactory.Build(flow)
+	if reporter, ok := packetLogger.(types.PacketLogErrorReporter); ok {
+		reporter.SetErrorHandler(i.analysisError)
+	}
+	return packetLogger
+}
 
-	for {
-		select {
-		case <-ticker:
-			closed := i.CloseOlderThan(time.Now().Add(timeout * -1))
-			if closed != 0 {
-				log.Printf("timeout closed %d connections\n", closed)
-			}
-		case <-i.stopDispatchChan:
-			return
-		case packetManifest := <-i.dispatchPacketChan:
-			ipFlow, _ := packetManifest.Flow.Flows()
-			eType := ipFlow.EndpointType()
+// capturingConnection is implemented by connections whose
+// packets may be captured on request; see CaptureFlow.
+type capturingConnection interface {
+	CapturePackets(types.PacketLogger)
+	GetPacketLogger() types.PacketLogger
+}
 
-			if eType == layers.EndpointIPv4 {
-				_, ok := i.poolTcpIpv4[types.NewHashedTcpIpv4Flow(packetManifest.Flow)]
-				if ok {
-					conn = i.poolTcpIpv4[types.NewHashedTcpIpv4Flow(packetManifest.Flow)]
+// CaptureFlow captures the packets of the connection of flow, in either
+// direction, to a packet log whether or not packet logging is enabled,
+// and archives it when the connection closes whether or not an attack
+// was detected. If the connection is not tracked the next connection of
+// the flow is captured, tracked regardless of the tracking rules and
+// sampling. It returns whether the connection was tracked.
+func (i *Dispatcher) CaptureFlow(flow *types.TcpIpFlow) (bool, error) {
+	if i.PacketLoggerFactory == nil {
+		return false, fmt.Errorf("no packet logger to capture with")
+	}
+	tracked := false
+	i.query(func() {
+		if conn, ok := i.tracker.Get(flow); ok && !conn.IsClosed() {
+			if capturing, ok := conn.(capturingConnection); ok {
+				packetLogger := capturing.GetPacketLogger()
+				if packetLogger == nil {
+					packetLogger = i.newPacketLogger(conn.GetClientFlow())
+					capturing.CapturePackets(packetLogger)
+					packetLogger.Start()
 				} else {
-					if i.options.MaxConcurrentConnections != 0 {
-						if len(i.poolTcpIpv4) >= i.options.MaxConcurrentConnections {
-							continue
-						}
-					}
-					conn = i.setupNewConnection(packetManifest.Flow)
+					capturing.CapturePackets(packetLogger)
 				}
-			} else if eType == layers.EndpointIPv6 {
-				connectionHash := types.NewHashedTcpIpv6Flow(packetManifest.Flow)
-				_, ok := i.poolTcpIpv6[connectionHash]
-				if ok {
-					conn = i.poolTcpIpv6[connectionHash]
-				} else {
-					if i.options.MaxConcurrentConnections != 0 {
-						if len(i.poolTcpIpv6) >= i.options.MaxConcurrentConnections {
-							continue
-						}
-					}
-					conn = i.setupNewConnection(packetManifest.Flow)
+				tracked = true
+				return
+			}
+		}
+		key, _ := types.NewFlowKey(flow)
+		i.clockMutex.Lock()
+		defer i.clockMutex.Unlock()
+		if i.captureFlows == nil {
+			i.captureFlows = make(map[types.FlowKey]bool)
+		}
+		i.captureFlows[key] = true
+	})
+	return tracked, nil
+}
+
+// captureRequested returns true if the next connection of flow is to be captured.
+func (i *Dispatcher) captureRequested(flow *types.TcpIpFlow) bool {
+	i.clockMutex.Lock()
+	defer i.clockMutex.Unlock()
+	if len(i.captureFlows) == 0 {
+		return false
+	}
+	key, _ := types.NewFlowKey(flow)
+	return i.captureFlows[key]
+}
+
+// RotatePacketLogs rotates the current file of the packet log of each
+// tracked connection, and returns the number of packet logs rotated.
+func (i *Dispatcher) RotatePacketLogs() int {
+	rotated := 0
+	i.query(func() {
+		i.tracker.Walk(func(conn ConnectionInterface) bool {
+			if capturing, ok := conn.(capturingConnection); ok {
+				if rotator, ok := capturing.GetPacketLogger().(types.PacketLogRotator); ok {
+					rotator.Rotate()
+					rotated++
 				}
-			} else {
-				panic("wtf")
 			}
-			conn.ReceivePacket(packetManifest)
+			return true
+		})
+	})
+	return rotated
+}
+
+// evictConnection closes a connection evicted to make room for a new one
+// and reports the eviction, connections being evicted means that some
+// connections may not be monitored for attacks in full.
+func (i *Dispatcher) evictConnection(conn ConnectionInterface) {
+	logging.Logf(logging.LOG_DEBUG, &logging.LogFields{Flow: conn.GetClientFlow()}, "connection limit reached; evicting connection")
+	reporter := i.attackLogger(conn.GetClientFlow())
+	reporter.conn = conn
+	reporter.Log(&types.Event{
+		Type: "connection-eviction",
+		Time: i.captureNow(),
+		Flow: *conn.GetClientFlow(),
+	})
+	i.connectionEvent("connection-closed", conn)
+	conn.Close()
+}
+
+// advanceCapture moves the capture clock on to the timestamp of a packet.
+// When the clock starts, the connections restored from a snapshot before
+// it did are restamped with its time, before any worker goes on to analyse
+// a packet.
+func (i *Dispatcher) advanceCapture(timestamp time.Time) {
+	i.clockMutex.Lock()
+	defer i.clockMutex.Unlock()
+	if i.captureTime.IsZero() && !timestamp.IsZero() {
+		for _, conn := range i.restored {
+			conn.Restamp(timestamp)
 		}
+		i.restored = nil
+	}
+	if timestamp.After(i.captureTime) {
+		i.captureTime = timestamp
+		i.captureArrival = time.Now()
+	}
+}
+
+// captureNow returns the time by the capture clock: the timestamp of the
+// latest packet dispatched plus the time since it was, so that when reading
+// a pcap file connections time out and events are stamped by capture time
+// rather than by the time of the analysis. Until a packet has been
+// dispatched it is the current time.
+func (i *Dispatcher) captureNow() time.Time {
+	i.clockMutex.Lock()
+	defer i.clockMutex.Unlock()
+	if i.captureTime.IsZero() {
+		return time.Now()
+	}
+	return i.captureTime.Add(time.Since(i.captureArrival))
+}
+
+// connectionEvent reports a connection starting or ceasing to be
+// tracked to the ConnectionLogger, if there is one.
+func (i *Dispatcher) connectionEvent(eventType string, conn ConnectionInterface) {
+	hooks := i.options.Hooks.OnConnectionOpen
+	if eventType == "connection-closed" {
+		hooks = i.options.Hooks.OnConnectionClose
+	}
+	for _, hook := range hooks {
+		hook(conn)
+	}
+	if i.options.ConnectionLogger == nil && !i.events.subscribed() {
+		return
+	}
+	event := &types.Event{
+		Type:        eventType,
+		Time:        i.captureNow(),
+		Flow:        *conn.GetClientFlow(),
+		PacketCount: conn.Info().Packets,
+	}
+	if i.options.ConnectionLogger != nil {
+		i.options.ConnectionLogger.Log(event)
+	}
+	i.events.publish(event)
+}
+
+// Subscribe returns a new subscription to the attack reports and
+// connection events of the dispatcher; see SubscriptionOptions.
+func (i *Dispatcher) Subscribe(options SubscriptionOptions) *Subscription {
+	return i.events.subscribe(options)
+}
+
+// Unsubscribe ends a subscription, closing its Events channel.
+func (i *Dispatcher) Unsubscribe(subscription *Subscription) {
+	i.events.unsubscribe(subscription)
+}
+
+// receivePacket hands a packet to its connection. A panic while the packet
+// is analysed does not take the dispatcher down with it; it is logged and
+// counted as an analysis error and false is returned.
+func (i *Dispatcher) receivePacket(conn ConnectionInterface, p *types.PacketManifest) (received bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			i.analysisError(fmt.Errorf("packet of %s: %v\n%s", p.Flow, r, debug.Stack()))
+			received = false
+		}
+	}()
+	conn.ReceivePacket(p)
+	return true
+}
+
+// budgetedConnection is a connection whose retained streams are charged
+// against the memory budget.
+type budgetedConnection interface {
+	OverBudget() bool
+}
+
+// dropConnection closes a connection whose state can no longer be trusted
+// after it failed to analyse a packet, recovering from a failure to close it.
+func (i *Dispatcher) dropConnection(conn ConnectionInterface) {
+	defer func() {
+		if r := recover(); r != nil {
+			i.analysisError(fmt.Errorf("closing %s: %v", conn.GetClientFlow(), r))
+		}
+	}()
+	logging.Logf(logging.LOG_WARNING, &logging.LogFields{Flow: conn.GetClientFlow()}, "dropping connection")
+	i.closeConnectionList([]ConnectionInterface{conn})
+}
+
+// analysisError logs and counts an analysis error.
+func (i *Dispatcher) analysisError(err error) {
+	atomic.AddUint64(&i.analysisErrors, 1)
+	logging.Warningf("analysis error: %s", err)
+}
+
+func (i *Dispatcher) dispatchPackets(ctx context.Context) {
+	defer close(i.doneChan)
+	if i.workers == nil && len(i.options.WorkerCPUs) > 0 {
+		pinGoroutine("dispatcher", i.options.WorkerCPUs[:1])
+	}
+	timeout := i.options.TcpIdleTimeout
+	var tick <-chan time.Time
+	if timeout > 0 {
+		ticker := time.NewTicker(timeout)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var loadTick <-chan time.Time
+	if interval := i.loadInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		loadTick = ticker.C
+	}
+	var dropTick <-chan time.Time
+	if i.dropAlarmsEnabled() {
+		ticker := time.NewTicker(DROP_ALARM_INTERVAL)
+		defer ticker.Stop()
+		dropTick = ticker.C
+	}
+	var memoryTick <-chan time.Time
+	if interval := i.memoryInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		memoryTick = ticker.C
+	}
+
+	for {
+		select {
+		case <-loadTick:
+			i.checkLoad()
+		case now := <-dropTick:
+			i.checkDrops(now)
+		case <-memoryTick:
+			i.paused(i.checkMemory)
+		case <-tick:
+			i.paused(func() {
+				closed := i.CloseOlderThan(i.captureNow().Add(timeout * -1))
+				if closed != 0 {
+					logging.Infof("timeout closed %d connections", closed)
+				}
+				metrics := i.tracker.Metrics()
+				logging.Infof("tracking %d connections %v; %.1f/s opened %.1f/s closed, %d evictions, %d lookups %d misses, %d analysis errors, %d dropped packets",
+					metrics.Connections, metrics.ByState, metrics.OpenedPerSecond, metrics.ClosedPerSecond,
+					metrics.Evictions, metrics.Lookups, metrics.Misses, i.AnalysisErrors(), i.DroppedPackets())
+			})
+		case fn := <-i.queryChan:
+			i.paused(fn)
+		case report := <-i.detectorReports:
+			i.paused(func() {
+				i.detectorReport(report)
+			})
+		case <-ctx.Done():
+			// the workers analyse the packets queued for them first
+			i.pauseWorkers()
+			i.resumeWorkers(false)
+			i.shutdown()
+			return
+		case packetManifest := <-i.dispatchPacketChan:
+			i.dispatchPacket(packetManifest)
+		}
+	}
+}
+
+// dispatchPacket hands a packet to the connection of its flow, setting
+// one up if need be, on the dispatcher's goroutine or on the worker of
+// the connection, and then releases it.
+func (i *Dispatcher) dispatchPacket(p *types.PacketManifest) {
+	defer p.Release()
+	i.advanceCapture(p.Timestamp)
+	conn, opened := i.connectionFor(p)
+	if conn == nil {
+		return
+	}
+	received := i.receivePacket(conn, p)
+	if opened {
+		// reported once the first packet has set the
+		// connection's client and server flows
+		i.connectionEvent("connection-opened", conn)
+	}
+	if !received {
+		i.dropConnection(conn)
+		return
+	}
+	if i.tornDown(conn) {
+		i.closeConnectionList([]ConnectionInterface{conn})
+		return
+	}
+	if budgeted, ok := conn.(budgetedConnection); ok && budgeted.OverBudget() {
+		logging.Logf(logging.LOG_INFO, &logging.LogFields{Flow: conn.GetClientFlow()}, "memory budget exceeded; dropping connection")
+		i.closeConnectionList([]ConnectionInterface{conn})
 	}
 }
@@ -1,15 +1,19 @@
 package HoneyBadger
 
 import (
+	"context"
 	"io"
 	"log"
 	"net"
 	"os"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/david415/HoneyBadger/logging"
 	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
@@ -25,7 +29,7 @@ func NewMockSniffer(options *types.SnifferDriverOptions, dispatcher PacketDispat
 	return packetSource
 }
 
-func (s *MockSniffer) Start() {
+func (s *MockSniffer) Start(ctx context.Context) {
 	log.Print("MockSniffer Start()")
 	s.startedChan <- true
 }
@@ -66,10 +70,26 @@ func (m MockConnection) GetLastSeen() time.Time {
 	return m.lastSeen
 }
 
+func (m MockConnection) GetState() uint8 {
+	return TCP_DATA_TRANSFER
+}
+
+func (m MockConnection) Info() ConnectionInfo {
+	return ConnectionInfo{Flow: m.clientFlow, State: ConnectionStateName(TCP_DATA_TRANSFER), LastSeen: m.lastSeen}
+}
+
+func (m MockConnection) IsClosed() bool {
+	return false
+}
+
 func (m MockConnection) SetPacketLogger(l types.PacketLogger) {
 	log.Print("MockConnection.SetPacketLogger")
 }
 
+func (m MockConnection) Reconfigure(options ConnectionOptions) {
+	log.Print("MockConnection.Reconfigure")
+}
+
 type mockConnFactory struct {
 }
 
@@ -179,6 +199,82 @@ func TestInquisitorSourceStopped(t *testing.T) {
 	supervisor.Stopped()
 }
 
+// lifecycleRecorder records the order components are started and stopped in.
+type lifecycleRecorder struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (r *lifecycleRecorder) record(event string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, event)
+}
+
+type recordedService struct {
+	name     string
+	recorder *lifecycleRecorder
+}
+
+func (s recordedService) Start() { s.recorder.record("start " + s.name) }
+func (s recordedService) Stop()  { s.recorder.record("stop " + s.name) }
+
+type recordedControl struct {
+	recordedService
+	dispatcher *Dispatcher
+}
+
+func (c *recordedControl) Start(dispatcher *Dispatcher) {
+	c.dispatcher = dispatcher
+	c.recordedService.Start()
+}
+
+func TestSupervisorLifecycle(t *testing.T) {
+	recorder := &lifecycleRecorder{}
+	control := &recordedControl{recordedService: recordedService{"control", recorder}}
+	supervisor := NewSupervisor(SupervisorOptions{
+		SnifferDriverOptions: &types.SnifferDriverOptions{},
+		DispatcherOptions:    DispatcherOptions{MaxConcurrentConnections: 10},
+		SnifferFactory:       NewMockSniffer,
+		ConnectionFactory:    &mockConnFactory{},
+		Loggers:              []Service{recordedService{"attacks", recorder}, recordedService{"events", recorder}},
+		ControlPlane:         []ControlService{control},
+	})
+	go supervisor.Run()
+	<-supervisor.GetSniffer().GetStartedChan()
+	supervisor.Stop()
+	supervisor.Stop()
+
+	expected := []string{"start attacks", "start events", "start control", "stop control", "stop events", "stop attacks"}
+	if !reflect.DeepEqual(recorder.events, expected) {
+		t.Errorf("lifecycle %v, expected %v", recorder.events, expected)
+	}
+	if control.dispatcher != supervisor.GetDispatcher() {
+		t.Error("control plane not handed the dispatcher")
+	}
+}
+
+func TestSupervisorRunContext(t *testing.T) {
+	recorder := &lifecycleRecorder{}
+	supervisor := NewSupervisor(SupervisorOptions{
+		SnifferDriverOptions: &types.SnifferDriverOptions{},
+		DispatcherOptions:    DispatcherOptions{MaxConcurrentConnections: 10},
+		SnifferFactory:       NewMockSniffer,
+		ConnectionFactory:    &mockConnFactory{},
+		Loggers:              []Service{recordedService{"attacks", recorder}},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	go supervisor.RunContext(ctx)
+	<-supervisor.GetSniffer().GetStartedChan()
+	cancel()
+	supervisor.Stop()
+
+	expected := []string{"start attacks", "stop attacks"}
+	if !reflect.DeepEqual(recorder.events, expected) {
+		t.Errorf("lifecycle %v, expected %v", recorder.events, expected)
+	}
+}
+
 func TestInquisitorSourceReceiveOne(t *testing.T) {
 
 	_, dispatcher, sniffer := SetupTestInquisitor()
@@ -341,3 +437,297 @@ func SetupRealConnectionInquisitor() (*Supervisor, PacketDispatcher, types.Packe
 	<-startedChan
 	return supervisor, dispatcher, sniffer
 }
+
+func TestDispatcherReusedTuple(t *testing.T) {
+	options := DispatcherOptions{
+		MaxRingPackets:           40,
+		Logger:                   NewDummyAttackLogger(),
+		MaxConcurrentConnections: 100,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+
+	ip := layers.IPv4{
+		SrcIP:    net.IP{1, 2, 3, 4},
+		DstIP:    net.IP{2, 3, 4, 5},
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := layers.TCP{
+		Seq:     3,
+		SYN:     true,
+		SrcPort: 1,
+		DstPort: 2,
+	}
+	p := types.PacketManifest{
+		Timestamp: time.Now(),
+		Flow:      types.NewTcpIp4FlowFromLayers(ip, tcp),
+		IPv4:      &ip,
+		TCP:       &tcp,
+	}
+
+	first, _ := dispatcher.connectionFor(&p)
+	first.ReceivePacket(&p)
+	if conn, _ := dispatcher.connectionFor(&p); conn != first {
+		t.Fatal("SYN retransmission on an open connection set up a new connection")
+	}
+
+	first.(*Connection).state = TCP_CLOSED
+	second, _ := dispatcher.connectionFor(&p)
+	if second == first {
+		t.Fatal("SYN on a closed connection's 4-tuple did not set up a new connection")
+	}
+	if conns := dispatcher.Connections(); len(conns) != 1 || conns[0] != second {
+		t.Errorf("closed connection was not replaced; %d connections tracked", len(conns))
+	}
+}
+
+func TestDispatcherLiveConnections(t *testing.T) {
+	options := DispatcherOptions{
+		Logger:         NewDummyAttackLogger(),
+		MaxRingPackets: 40,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	dispatcher.Start()
+	_, packet := newTestConnection(options.Logger)
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	dispatcher.ReceivePacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true}, []byte{}))
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{1, 2, 3}))
+
+	infos := dispatcher.LiveConnections()
+	if len(infos) != 1 {
+		t.Fatalf("%d live connections, expected 1", len(infos))
+	}
+	info := infos[0]
+	if info.State != "data-transfer" || info.Packets != 3 || info.Bytes != 3 || info.Flow.String() != "1.2.3.4:1-2.3.4.5:2" {
+		t.Errorf("live connection %+v", info)
+	}
+	if info.Age != info.LastSeen.Sub(info.FirstSeen) || info.Age < 0 {
+		t.Errorf("connection age %s", info.Age)
+	}
+	dispatcher.Stop()
+}
+
+func TestDispatcherReconfigure(t *testing.T) {
+	options := DispatcherOptions{
+		Logger:         NewDummyAttackLogger(),
+		MaxRingPackets: 40,
+		DetectHijack:   true,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+	_, packet := newTestConnection(options.Logger)
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	if len(dispatcher.LiveConnections()) != 1 {
+		t.Fatal("connection not tracked")
+	}
+	conn := dispatcher.Connections()[0].(*Connection)
+
+	rules, err := ParseTrackingRules("never port=9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.DetectHijack = false
+	options.HijackDetectionPackets = 3
+	options.TrackingRules = rules
+	dispatcher.Reconfigure(options)
+	if conn.DetectHijack || conn.skipHijackDetectionCount != 3 {
+		t.Errorf("connection detect hijack %v for %d packets", conn.DetectHijack, conn.skipHijackDetectionCount)
+	}
+	if len(dispatcher.Connections()) != 1 {
+		t.Fatal("reconfiguring dropped the tracked connection")
+	}
+
+	if options.TrackingRules, err = ParseTrackingRules("never net=1.2.3.4/32"); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher.Reconfigure(options)
+	if len(dispatcher.Connections()) != 0 {
+		t.Error("connection matching a never rule still tracked")
+	}
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	if len(dispatcher.LiveConnections()) != 0 {
+		t.Error("new connection matching a never rule tracked")
+	}
+}
+
+func TestDispatcherStartContext(t *testing.T) {
+	options := DispatcherOptions{
+		Logger:         NewDummyAttackLogger(),
+		MaxRingPackets: 40,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	dispatcher.StartContext(ctx)
+	_, packet := newTestConnection(options.Logger)
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	if len(dispatcher.LiveConnections()) != 1 {
+		t.Fatal("connection not tracked")
+	}
+
+	cancel()
+	dispatcher.Stop()
+	if len(dispatcher.Connections()) != 0 {
+		t.Error("connections not closed once the context was cancelled")
+	}
+	// packets arriving after the dispatcher stopped are dropped
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	if len(dispatcher.LiveConnections()) != 0 {
+		t.Error("connection tracked after the dispatcher stopped")
+	}
+}
+
+func TestDispatcherCaptureClock(t *testing.T) {
+	d := NewDispatcher(DispatcherOptions{}, &DefaultConnFactory{}, nil)
+	if time.Since(d.captureNow()) > time.Second {
+		t.Error("capture clock not the current time before any packet")
+	}
+	captured := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	d.advanceCapture(captured)
+	d.advanceCapture(captured.Add(-time.Minute))
+	if now := d.captureNow(); now.Before(captured) || now.Sub(captured) > time.Second {
+		t.Errorf("capture clock at %s, expected %s", now, captured)
+	}
+}
+
+// panickingConnection fails to analyse every packet once the
+// connection has received it.
+type panickingConnection struct {
+	*Connection
+}
+
+func (c panickingConnection) ReceivePacket(p *types.PacketManifest) {
+	c.Connection.ReceivePacket(p)
+	panic("analysis failed")
+}
+
+type panickingConnFactory struct {
+	DefaultConnFactory
+}
+
+func (f *panickingConnFactory) Build(options ConnectionOptions) ConnectionInterface {
+	return panickingConnection{f.DefaultConnFactory.Build(options).(*Connection)}
+}
+
+func TestDispatcherRecoversAnalysisErrors(t *testing.T) {
+	options := DispatcherOptions{
+		Logger:         NewDummyAttackLogger(),
+		MaxRingPackets: 40,
+	}
+	dispatcher := NewDispatcher(options, &panickingConnFactory{}, nil)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+	_, packet := newTestConnection(options.Logger)
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	if len(dispatcher.LiveConnections()) != 0 {
+		t.Error("connection failing to analyse a packet is still tracked")
+	}
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	dispatcher.LiveConnections()
+	if errors := dispatcher.AnalysisErrors(); errors != 2 {
+		t.Errorf("%d analysis errors, expected 2", errors)
+	}
+}
+
+// synPacket returns the SYN of a connection from port to 2.3.4.5:80.
+func synPacket(port int) *types.PacketManifest {
+	ip := layers.IPv4{
+		SrcIP:    net.IP{1, 2, 3, 4},
+		DstIP:    net.IP{2, 3, 4, 5},
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := layers.TCP{
+		Seq:     3,
+		SYN:     true,
+		SrcPort: layers.TCPPort(port),
+		DstPort: 80,
+	}
+	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(ip.SrcIP), layers.NewIPEndpoint(ip.DstIP))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(tcp.SrcPort), layers.NewTCPPortEndpoint(tcp.DstPort))
+	flow := types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	return &types.PacketManifest{
+		Timestamp: time.Now(),
+		Flow:      &flow,
+		IPv4:      &ip,
+		TCP:       &tcp,
+	}
+}
+
+func TestDispatcherWorkers(t *testing.T) {
+	options := DispatcherOptions{
+		MaxRingPackets: 40,
+		Workers:        4,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	if dispatcher.tracker.ShardCount() != 4 {
+		t.Errorf("%d tracker shards for 4 workers", dispatcher.tracker.ShardCount())
+	}
+	dispatcher.Start()
+	for port := 1000; port < 1100; port++ {
+		dispatcher.ReceivePacket(synPacket(port))
+	}
+	// the packets queued are analysed before the query is
+	if infos := dispatcher.LiveConnections(); len(infos) != 100 {
+		t.Errorf("%d live connections, expected 100", len(infos))
+	}
+	for _, conn := range dispatcher.Connections() {
+		if conn.(*Connection).PageCache != dispatcher.workerOf(conn.GetClientFlow()).pageCache {
+			t.Errorf("connection %s not using its worker's page cache", conn.GetClientFlow())
+		}
+	}
+	if dispatcher.DroppedPackets() != 0 {
+		t.Errorf("%d packets dropped", dispatcher.DroppedPackets())
+	}
+	dispatcher.Stop()
+	if len(dispatcher.Connections()) != 0 {
+		t.Error("connections not closed once the dispatcher stopped")
+	}
+}
+
+func TestDispatcherWorkerQueueFull(t *testing.T) {
+	options := DispatcherOptions{
+		MaxRingPackets: 40,
+		Workers:        2,
+		WorkerQueue:    1,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	for n := 0; n < 3; n++ {
+		dispatcher.ReceivePacket(synPacket(1000))
+	}
+	if dispatcher.DroppedPackets() != 2 {
+		t.Errorf("%d packets dropped, expected 2", dispatcher.DroppedPackets())
+	}
+	dispatcher.Start()
+	defer dispatcher.Stop()
+	infos := dispatcher.LiveConnections()
+	if len(infos) != 1 || infos[0].Packets != 1 {
+		t.Errorf("live connections %+v, expected one of 1 packet", infos)
+	}
+}
+
+func TestDispatcherDropsConnectionOverBudget(t *testing.T) {
+	options := DispatcherOptions{
+		MaxRingPackets:   40,
+		MaxRetainedBytes: 100,
+		RetentionPolicy:  RETENTION_DROP_CONNECTION,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	_, packet := newTestConnection(nil)
+	dispatcher.dispatchPacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	dispatcher.dispatchPacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true}, []byte{}))
+	dispatcher.dispatchPacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{}))
+
+	// the budget is exceeded by the stream data of other connections
+	dispatcher.memoryBudget.charge(200)
+	dispatcher.dispatchPacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{}))
+	if dispatcher.tracker.Len() != 1 {
+		t.Fatal("connection retaining nothing dropped over budget")
+	}
+	dispatcher.dispatchPacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte("data")))
+	if dispatcher.tracker.Len() != 0 {
+		t.Error("connection retaining stream data over budget not dropped")
+	}
+}
@@ -22,6 +22,8 @@
 package drivers
 
 import (
+	"time"
+
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/afpacket"
 
@@ -37,7 +39,16 @@ type AfpacketHandle struct {
 }
 
 func NewAfpacketHandle(options *types.SnifferDriverOptions) (types.PacketDataSourceCloser, error) {
-	afpacketHandle, err := afpacket.NewTPacket(afpacket.OptInterface(options.Device))
+	opts := []interface{}{afpacket.OptInterface(options.Device)}
+	if timeout := readTimeout(options); timeout > 0 {
+		// wake up regularly so that the capture can be stopped
+		opts = append(opts, afpacket.OptPollTimeout(timeout))
+	}
+	if options.FlushInterval >= time.Millisecond {
+		// blocks are handed over once full or after the flush interval
+		opts = append(opts, afpacket.OptBlockTimeout(options.FlushInterval))
+	}
+	afpacketHandle, err := afpacket.NewTPacket(opts...)
 	return &AfpacketHandle{
 		afpacketHandle: afpacketHandle,
 	}, err
@@ -47,6 +58,23 @@ func (a *AfpacketHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo,
 	return a.afpacketHandle.ReadPacketData()
 }
 
+// ZeroCopyReadPacketData returns the next packet in the current TPACKET
+// block, reading the next block once it is exhausted; the data is only
+// valid until the next call.
+func (a *AfpacketHandle) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	return a.afpacketHandle.ZeroCopyReadPacketData()
+}
+
+// Drops returns the number of packets the kernel dropped
+// as the ring of the socket was full.
+func (a *AfpacketHandle) Drops() (uint64, error) {
+	stats, statsV3, err := a.afpacketHandle.SocketStats()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stats.Drops() + statsV3.Drops()), nil
+}
+
 func (a *AfpacketHandle) Close() error {
 	a.afpacketHandle.Close()
 	return nil
@@ -22,6 +22,8 @@
 package drivers
 
 import (
+	"syscall"
+
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/bsdbpf"
 
@@ -38,7 +40,18 @@ type BPFHandle struct {
 
 func NewBPFHandle(options *types.SnifferDriverOptions) (types.PacketDataSourceCloser, error) {
 	// XXX TODO pass more options...
-	bpfSniffer, err := bsdbpf.NewBPFSniffer(options.Device, nil)
+	bpfOptions := bsdbpf.Options{
+		ReadBufLen:       32767,
+		Promisc:          true,
+		Immediate:        true,
+		PreserveLinkAddr: true,
+	}
+	if wireTimeout := readTimeout(options); wireTimeout > 0 {
+		// wake up regularly so that the capture can be stopped
+		timeout := syscall.NsecToTimeval(wireTimeout.Nanoseconds())
+		bpfOptions.Timeout = &timeout
+	}
+	bpfSniffer, err := bsdbpf.NewBPFSniffer(options.Device, &bpfOptions)
 	return &BPFHandle{
 		bpfSniffer: bpfSniffer,
 	}, err
@@ -45,7 +45,7 @@ func NewPcapSniffer(options *types.SnifferDriverOptions) (types.PacketDataSource
 		}
 		return &pcapHandle, err
 	} else {
-		pcapWireHandle, err := pcap.OpenLive(options.Device, options.Snaplen, true, options.WireDuration)
+		pcapWireHandle, err := pcap.OpenLive(options.Device, options.Snaplen, true, readTimeout(options))
 		pcapHandle := PcapHandle{
 			handle: pcapWireHandle,
 		}
@@ -75,6 +75,28 @@ func (p *PcapHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err
 	return p.handle.ReadPacketData()
 }
 
+// ZeroCopyReadPacketData returns the next packet of the buffer libpcap
+// last read, reading the next buffer once it is exhausted; the data is
+// only valid until the next call.
+func (p *PcapHandle) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	return p.handle.ZeroCopyReadPacketData()
+}
+
+// SetFilter replaces the BPF filter of the capture.
+func (p *PcapHandle) SetFilter(filter string) error {
+	return p.handle.SetBPFFilter(filter)
+}
+
+// Drops returns the number of packets dropped by the kernel
+// or the interface as they were not read in time.
+func (p *PcapHandle) Drops() (uint64, error) {
+	stats, err := p.handle.Stats()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stats.PacketsDropped + stats.PacketsIfDropped), nil
+}
+
 func (p *PcapHandle) Close() error {
 	p.handle.Close()
 	return nil
@@ -61,6 +61,12 @@ func (a *PcapgoHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
 	return data, ci, err
 }
 
+// ZeroCopyReadPacketData returns the next packet of the file;
+// the data is only valid until the next call.
+func (a *PcapgoHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return a.reader.ZeroCopyReadPacketData()
+}
+
 func (a *PcapgoHandle) Close() error {
 	return a.fileReader.Close()
 }
@@ -20,11 +20,23 @@
 package drivers
 
 import (
+	"time"
+
 	"github.com/david415/HoneyBadger/types"
 )
 
 var Drivers = map[string]func(*types.SnifferDriverOptions) (types.PacketDataSourceCloser, error){}
 
+// readTimeout returns how long reading off the wire may block: the wire
+// timeout, or the flush interval of the batches of packets read if that is
+// shorter, so that a batch read off a quiet link is not held up for long.
+func readTimeout(options *types.SnifferDriverOptions) time.Duration {
+	if options.FlushInterval > 0 && (options.WireDuration <= 0 || options.FlushInterval < options.WireDuration) {
+		return options.FlushInterval
+	}
+	return options.WireDuration
+}
+
 // Register makes a ethernet sniffer driver available by the provided name.
 // If Register is called twice with the same name or if driver is nil, it panics.
 func SnifferRegister(name string, packetDataSourceCloserFactory func(*types.SnifferDriverOptions) (types.PacketDataSourceCloser, error)) {
@@ -0,0 +1,161 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// DROP_ALARM_INTERVAL is the interval packets dropped are counted
+	// at for the drop alarms.
+	DROP_ALARM_INTERVAL = time.Second
+	// DROP_ALARM_DURATION is the default time packets must be dropped
+	// above a threshold for, or below it, to raise or clear an alarm.
+	DROP_ALARM_DURATION = 10 * time.Second
+)
+
+// DropAlarmOptions are the thresholds of the dispatcher's drop alarms:
+// DropPercent, the percentage of the captured packets the capture drops,
+// by the kernel or as decoding falls behind, and OverflowPercent, that of
+// the packets dispatched which overflow the workers' queues. An alarm is
+// raised once packets have been dropped at or above its threshold for
+// Duration, by default DROP_ALARM_DURATION, and cleared once they have been
+// dropped below it for as long; a threshold of zero disables its alarm.
+//
+// Packet loss is a detection failure which is otherwise silent, so alarms
+// are reported to the Logger like attacks are, as events of detector
+// "sensor": "sensor-packet-loss" and "sensor-queue-overflow" when raised,
+// with "-cleared" appended when cleared. Their PacketCount is the number
+// of packets dropped while the threshold was exceeded and their Payload
+// describes the alarm.
+type DropAlarmOptions struct {
+	DropPercent     float64
+	OverflowPercent float64
+	Duration        time.Duration
+}
+
+// dropAlarm is the state of one of the drop alarms.
+type dropAlarm struct {
+	raised bool
+	// since is when packets were first dropped on the other side of the
+	// threshold than the alarm's state, zero if they are not
+	since   time.Time
+	dropped uint64
+}
+
+// dropWatchdog counts the packets dropped for the drop alarms.
+type dropWatchdog struct {
+	captured  uint64
+	drops     uint64
+	overflows uint64
+	counted   time.Time
+	capture   dropAlarm
+	queue     dropAlarm
+}
+
+// dropAlarmsEnabled returns true if any drop alarm is configured.
+func (i *Dispatcher) dropAlarmsEnabled() bool {
+	alarms := i.options.DropAlarms
+	return (alarms.DropPercent > 0 && i.shedder.counter != nil) || alarms.OverflowPercent > 0
+}
+
+// checkDrops counts the packets dropped since last checked, raising or
+// clearing the drop alarms.
+func (i *Dispatcher) checkDrops(now time.Time) {
+	w := &i.watchdog
+	dispatched := i.Packets()
+	overflows := i.DroppedPackets()
+	drops := w.drops
+	if i.shedder.counter != nil {
+		var err error
+		if drops, err = i.shedder.counter.Drops(); err != nil {
+			logging.Debugf("failed to count dropped packets: %s", err)
+			drops = w.drops
+		}
+	}
+	if !w.counted.IsZero() {
+		newDispatched, newDrops, newOverflows := dispatched-w.captured, drops-w.drops, overflows-w.overflows
+		if i.shedder.counter != nil {
+			i.updateDropAlarm(&w.capture, "sensor-packet-loss", "of the captured packets dropped by the capture",
+				i.options.DropAlarms.DropPercent, newDrops, newDispatched+newDrops, w.counted, now)
+		}
+		i.updateDropAlarm(&w.queue, "sensor-queue-overflow", "of the packets dispatched dropped as the workers' queues overflowed",
+			i.options.DropAlarms.OverflowPercent, newOverflows, newDispatched, w.counted, now)
+	}
+	w.captured, w.drops, w.overflows, w.counted = dispatched, drops, overflows, now
+}
+
+// updateDropAlarm raises or clears an alarm, reported as events of the
+// given type, as dropped of total packets were dropped since last checked;
+// what describes the packets dropped.
+func (i *Dispatcher) updateDropAlarm(alarm *dropAlarm, eventType, what string, threshold float64, dropped, total uint64, counted, now time.Time) {
+	if threshold <= 0 {
+		return
+	}
+	percent := 0.0
+	if total > 0 {
+		percent = 100 * float64(dropped) / float64(total)
+	}
+	if percent >= threshold {
+		alarm.dropped += dropped
+	}
+	if (percent >= threshold) == alarm.raised {
+		// the alarm's state holds
+		alarm.since = time.Time{}
+		if !alarm.raised {
+			alarm.dropped = 0
+		}
+		return
+	}
+	if alarm.since.IsZero() {
+		alarm.since = counted
+	}
+	duration := i.options.DropAlarms.Duration
+	if duration <= 0 {
+		duration = DROP_ALARM_DURATION
+	}
+	if now.Sub(alarm.since) < duration {
+		return
+	}
+	alarm.raised = !alarm.raised
+	alarm.since = time.Time{}
+	event := &types.Event{
+		Type:        eventType,
+		Time:        i.captureNow(),
+		PacketCount: alarm.dropped,
+	}
+	if alarm.raised {
+		logging.Warningf("%.1f%% %s for %s", percent, what, duration)
+		event.Payload = []byte(fmt.Sprintf("%.1f%% %s, at least %.1f%% for %s", percent, what, threshold, duration))
+	} else {
+		logging.Infof("%.1f%% %s, below %.1f%% for %s; alarm cleared", percent, what, threshold, duration)
+		event.Type += "-cleared"
+		event.Payload = []byte(fmt.Sprintf("%.1f%% %s, below %.1f%% for %s", percent, what, threshold, duration))
+		alarm.dropped = 0
+	}
+	if i.options.Logger != nil {
+		i.options.Logger.Log(event)
+	}
+}
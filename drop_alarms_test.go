@@ -0,0 +1,65 @@
+package HoneyBadger
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDispatcherDropAlarms(t *testing.T) {
+	logger := NewDummyAttackLogger()
+	options := DispatcherOptions{
+		Logger: logger,
+		DropAlarms: DropAlarmOptions{
+			DropPercent: 5,
+			Duration:    3 * time.Second,
+		},
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	if dispatcher.dropAlarmsEnabled() {
+		t.Error("capture drop alarm enabled without a drop counter")
+	}
+	counter := &dropCounter{}
+	dispatcher.SetDropCounter(counter)
+	if !dispatcher.dropAlarmsEnabled() {
+		t.Fatal("capture drop alarm disabled")
+	}
+
+	now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	second := func(dispatched, dropped uint64) {
+		atomic.AddUint64(&dispatcher.packets, dispatched)
+		counter.drops += dropped
+		now = now.Add(time.Second)
+		dispatcher.checkDrops(now)
+	}
+	second(0, 0)
+	// 10% of the packets captured are dropped, for less than the duration
+	second(90, 10)
+	second(90, 10)
+	second(100, 0)
+	second(90, 10)
+	second(90, 10)
+	if logger.Count != 0 {
+		t.Fatalf("alarm raised early: %+v", logger.Last)
+	}
+	second(90, 10)
+	if logger.Count != 1 || logger.Last.Type != "sensor-packet-loss" || logger.Last.PacketCount != 30 {
+		t.Fatalf("alarm reported as %+v", logger.Last)
+	}
+	if description := string(logger.Last.Payload); !strings.HasPrefix(description, "10.0% of the captured packets dropped") {
+		t.Errorf("alarm described as %q", description)
+	}
+
+	// the alarm is raised once and cleared once drops subside for the duration
+	second(90, 10)
+	second(99, 1)
+	second(99, 1)
+	if logger.Count != 1 {
+		t.Fatalf("alarm cleared early: %+v", logger.Last)
+	}
+	second(99, 1)
+	if logger.Count != 2 || logger.Last.Type != "sensor-packet-loss-cleared" || logger.Last.PacketCount != 40 {
+		t.Errorf("alarm cleared as %+v", logger.Last)
+	}
+}
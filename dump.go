@@ -0,0 +1,213 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// DUMP_TOP_FLOWS is the number of connections, those of the most bytes,
+	// a diagnostic dump lists.
+	DUMP_TOP_FLOWS = 20
+	// DUMP_QUERY_TIMEOUT is how long a diagnostic dump waits for a
+	// dispatcher to list its connections before it gives up on it.
+	DUMP_QUERY_TIMEOUT = 5 * time.Second
+)
+
+// Dump writes a diagnostic dump of the running pipeline to w, for
+// debugging a stuck sensor: the packets dispatched and dropped, the depth
+// of the capture and worker queues, the most recent warnings and errors
+// logged and then the connections tracked by state and the DUMP_TOP_FLOWS
+// connections of the most bytes, for the pipeline's dispatcher and those
+// of its tenants.
+//
+// The connections are listed by the goroutine of each dispatcher, which
+// may be what is stuck, so they are dumped last, once the rest is written,
+// and a dispatcher which has not listed them within DUMP_QUERY_TIMEOUT is
+// dumped as unresponsive.
+func (b *Supervisor) Dump(w io.Writer) error {
+	tenants := []string{""}
+	dispatchers := []*Dispatcher{b.dispatcher}
+	if b.router != nil {
+		for _, tenant := range b.router.tenants {
+			tenants = append(tenants, tenant.name)
+			dispatchers = append(dispatchers, tenant.dispatcher)
+		}
+	}
+	listed := make([]chan []byte, len(dispatchers))
+	for n, dispatcher := range dispatchers {
+		listed[n] = make(chan []byte, 1)
+		go func(dispatcher *Dispatcher, result chan []byte) {
+			var out bytes.Buffer
+			dumpConnections(&out, dispatcher)
+			result <- out.Bytes()
+		}(dispatcher, listed[n])
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "honeyBadger diagnostic dump at %s\n", time.Now().UTC().Format(time.RFC3339))
+	if queue, ok := b.sniffer.(interface{ Queued() int }); ok {
+		fmt.Fprintf(&out, "capture queue: %d packets\n", queue.Queued())
+	}
+	if counter, ok := b.sniffer.(types.DropCounter); ok {
+		drops, err := counter.Drops()
+		if err != nil {
+			fmt.Fprintf(&out, "capture drops: %s\n", err)
+		} else {
+			fmt.Fprintf(&out, "capture drops: %d packets\n", drops)
+		}
+	}
+	if b.router != nil {
+		fmt.Fprintf(&out, "unrouted: %d packets\n", b.router.Unrouted())
+	}
+	for n, dispatcher := range dispatchers {
+		fmt.Fprintf(&out, "\n%s\n", dispatcherName(tenants[n]))
+		dumpDispatcher(&out, dispatcher)
+	}
+	errors := logging.RecentErrors()
+	fmt.Fprintf(&out, "\nrecent errors: %d\n", len(errors))
+	for _, message := range errors {
+		fmt.Fprintf(&out, "  %s\n", message)
+	}
+	if _, err := w.Write(out.Bytes()); err != nil {
+		return err
+	}
+
+	deadline := time.NewTimer(b.dumpTimeout)
+	defer deadline.Stop()
+	expired := false
+	for n := range dispatchers {
+		out.Reset()
+		fmt.Fprintf(&out, "\nconnections of the %s\n", dispatcherName(tenants[n]))
+		var connections []byte
+		if !expired {
+			select {
+			case connections = <-listed[n]:
+			case <-deadline.C:
+				expired = true
+			}
+		} else {
+			select {
+			case connections = <-listed[n]:
+			default:
+			}
+		}
+		if connections == nil {
+			out.WriteString("  dispatcher unresponsive\n")
+		}
+		out.Write(connections)
+		if _, err := w.Write(out.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dispatcherName names the dispatcher of the given
+// tenant, or the pipeline's own if tenant is empty.
+func dispatcherName(tenant string) string {
+	if tenant == "" {
+		return "dispatcher"
+	}
+	return "dispatcher of tenant " + tenant
+}
+
+// dumpDispatcher writes the part of a diagnostic dump about a dispatcher
+// which is read without waiting on the dispatcher's goroutine.
+func dumpDispatcher(out *bytes.Buffer, dispatcher *Dispatcher) {
+	fmt.Fprintf(out, "  packets: %d dispatched, %d dropped\n", dispatcher.Packets(), dispatcher.DroppedPackets())
+	fmt.Fprintf(out, "  worker queues: %v\n", dispatcher.QueuedPackets())
+	fmt.Fprintf(out, "  analysis errors: %d\n", dispatcher.AnalysisErrors())
+	if shedding := dispatcher.LoadShedding(); len(shedding) != 0 {
+		fmt.Fprintf(out, "  load shedding: %v\n", shedding)
+	}
+	if pressure := dispatcher.MemoryPressure(); pressure != "" {
+		fmt.Fprintf(out, "  memory pressure: %s\n", pressure)
+	}
+}
+
+// dumpConnections writes the part of a diagnostic dump about the
+// connections of a dispatcher, which are listed by its goroutine.
+func dumpConnections(out *bytes.Buffer, dispatcher *Dispatcher) {
+	metrics := dispatcher.Metrics()
+	fmt.Fprintf(out, "  connections: %d tracked, %d opened, %d closed, %d evicted\n", metrics.Connections, metrics.Opened, metrics.Closed, metrics.Evictions)
+	for _, state := range sortedKeys(metrics.ByState) {
+		fmt.Fprintf(out, "    %-16s %d\n", state, metrics.ByState[state])
+	}
+
+	connections := dispatcher.LiveConnections()
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].Bytes > connections[j].Bytes
+	})
+	if len(connections) > DUMP_TOP_FLOWS {
+		connections = connections[:DUMP_TOP_FLOWS]
+	}
+	fmt.Fprintf(out, "  top flows by bytes:\n")
+	for _, info := range connections {
+		fmt.Fprintf(out, "    %s %s %d bytes %d packets, age %s, last seen %s\n", info.Flow.String(), info.State, info.Bytes, info.Packets,
+			info.Age.Round(time.Millisecond), info.LastSeen.UTC().Format(time.RFC3339))
+	}
+}
+
+// dump writes a diagnostic dump to the dump file, replacing the previous
+// dump, or to the diagnostic log if there is none.
+func (b *Supervisor) dump() {
+	if b.dumpFile == "" {
+		b.Dump(diagnosticsWriter{})
+		return
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(b.dumpFile), ".dump")
+	if err != nil {
+		logging.Warningf("failed to write diagnostic dump: %s", err)
+		return
+	}
+	err = b.Dump(temp)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), b.dumpFile)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		logging.Warningf("failed to write diagnostic dump: %s", err)
+		return
+	}
+	logging.Infof("diagnostic dump written to %s", b.dumpFile)
+}
+
+// diagnosticsWriter writes to the diagnostic log.
+type diagnosticsWriter struct{}
+
+func (diagnosticsWriter) Write(p []byte) (int, error) {
+	logging.WriteDiagnostics(p)
+	return len(p), nil
+}
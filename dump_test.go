@@ -0,0 +1,91 @@
+package HoneyBadger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+func TestSupervisorDump(t *testing.T) {
+	dumpFile := filepath.Join(t.TempDir(), "dump.txt")
+	logger := NewDummyAttackLogger()
+	supervisor := NewSupervisor(SupervisorOptions{
+		SnifferDriverOptions: &types.SnifferDriverOptions{},
+		DispatcherOptions:    DispatcherOptions{Logger: logger, MaxRingPackets: 40},
+		SnifferFactory:       NewPacketFeed,
+		ConnectionFactory:    &DefaultConnFactory{},
+		DumpFile:             dumpFile,
+	})
+	supervisor.dispatcher.Start()
+	defer supervisor.dispatcher.Stop()
+
+	_, packet := newTestConnection(logger)
+	supervisor.dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	supervisor.dispatcher.ReceivePacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true}, []byte{}))
+	supervisor.dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{1, 2, 3, 4}))
+	logging.SetLogOutput(ioutil.Discard)
+	defer logging.SetLogOutput(os.Stderr)
+	logging.Warningf("stuck in a test")
+
+	supervisor.dump()
+	data, err := ioutil.ReadFile(dumpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := string(data)
+	for _, line := range []string{
+		"  packets: 3 dispatched, 0 dropped\n",
+		"  connections: 1 tracked, 1 opened, 0 closed, 0 evicted\n",
+		"    data-transfer    1\n",
+		"    1.2.3.4:1-2.3.4.5:2 data-transfer 4 bytes 3 packets",
+		`msg="stuck in a test"`,
+	} {
+		if !strings.Contains(dump, line) {
+			t.Errorf("dump lacks %q:\n%s", line, dump)
+		}
+	}
+
+	// without a dump file the dump is written to the diagnostic log
+	var out bytes.Buffer
+	logging.SetLogOutput(&out)
+	supervisor.dumpFile = ""
+	supervisor.dump()
+	if !strings.HasPrefix(out.String(), "honeyBadger diagnostic dump at ") {
+		t.Errorf("logged %q", out.String())
+	}
+}
+
+func TestSupervisorDumpUnresponsive(t *testing.T) {
+	supervisor := NewSupervisor(SupervisorOptions{
+		SnifferDriverOptions: &types.SnifferDriverOptions{},
+		DispatcherOptions:    DispatcherOptions{Logger: NewDummyAttackLogger(), MaxRingPackets: 40},
+		SnifferFactory:       NewPacketFeed,
+		ConnectionFactory:    &DefaultConnFactory{},
+	})
+	supervisor.dumpTimeout = 10 * time.Millisecond
+
+	// the dispatcher's goroutine, not started, never lists its connections
+	var out bytes.Buffer
+	if err := supervisor.Dump(&out); err != nil {
+		t.Fatal(err)
+	}
+	dump := out.String()
+	for _, line := range []string{
+		"  packets: 0 dispatched, 0 dropped\n",
+		"\nrecent errors: ",
+		"\nconnections of the dispatcher\n  dispatcher unresponsive\n",
+	} {
+		if !strings.Contains(dump, line) {
+			t.Errorf("dump lacks %q:\n%s", line, dump)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// reportKey identifies a report by its defining fields: the type, the
+// flow, the sequence range and a digest of the injected and overlapped bytes.
+type reportKey struct {
+	eventType string
+	flow      types.TcpIpFlow
+	digest    [sha256.Size]byte
+}
+
+// newReportKey returns the key of an event. Fields such as the packet count
+// and time which vary between retransmissions are not part of it.
+func newReportKey(event *types.Event) reportKey {
+	var buf [4]byte
+	hash := sha256.New()
+	for _, n := range []uint32{event.HijackSeq, event.HijackAck, uint32(event.Base), uint32(event.Start), uint32(event.End)} {
+		binary.BigEndian.PutUint32(buf[:], n)
+		hash.Write(buf[:])
+	}
+	for _, b := range [][]byte{event.Payload, event.Winner, event.Loser} {
+		binary.BigEndian.PutUint32(buf[:], uint32(len(b)))
+		hash.Write(buf[:])
+		hash.Write(b)
+	}
+	key := reportKey{
+		eventType: event.Type,
+		flow:      event.Flow,
+	}
+	hash.Sum(key.digest[:0])
+	return key
+}
+
+// pendingReport is the first of a run of identical reports,
+// held back while its retransmissions are still being counted.
+type pendingReport struct {
+	event    *types.Event
+	lastSeen time.Time
+}
+
+// duplicateReports collapses identical reports, such as those caused by an
+// attacker retransmitting its segments, into one report carrying the
+// number of occurrences. A report is held back until no identical one has
+// been seen for the window, measured in packet time, or until flush.
+type duplicateReports struct {
+	window  time.Duration
+	logger  types.Logger
+	pending map[reportKey]*pendingReport
+	order   []reportKey
+}
+
+// newDuplicateReports returns duplicateReports logging to logger.
+// It returns nil, which logs every report at once, if window <= 0.
+func newDuplicateReports(window time.Duration, logger types.Logger) *duplicateReports {
+	if window <= 0 {
+		return nil
+	}
+	return &duplicateReports{
+		window:  window,
+		logger:  logger,
+		pending: make(map[reportKey]*pendingReport),
+	}
+}
+
+// add records a report seen at the given time. It returns false if the report
+// duplicates one already pending, in which case only that report's count is incremented.
+func (d *duplicateReports) add(event *types.Event, now time.Time) bool {
+	if d == nil {
+		return true
+	}
+	key := newReportKey(event)
+	if report, ok := d.pending[key]; ok {
+		report.event.Occurrences += 1
+		if now.After(report.lastSeen) {
+			report.lastSeen = now
+		}
+		return false
+	}
+	event.Occurrences = 1
+	d.pending[key] = &pendingReport{event: event, lastSeen: now}
+	d.order = append(d.order, key)
+	return true
+}
+
+// expire logs the pending reports whose window has passed by now.
+func (d *duplicateReports) expire(now time.Time) {
+	if d == nil || len(d.order) == 0 {
+		return
+	}
+	remaining := d.order[:0]
+	for _, key := range d.order {
+		report := d.pending[key]
+		if now.Sub(report.lastSeen) > d.window {
+			delete(d.pending, key)
+			d.logger.Log(report.event)
+			continue
+		}
+		remaining = append(remaining, key)
+	}
+	d.order = remaining
+}
+
+// flush logs all pending reports, in the order they were first seen.
+func (d *duplicateReports) flush() {
+	if d == nil {
+		return
+	}
+	for _, key := range d.order {
+		d.logger.Log(d.pending[key].event)
+		delete(d.pending, key)
+	}
+	d.order = d.order[:0]
+}
@@ -0,0 +1,66 @@
+package HoneyBadger
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+func TestDuplicateReports(t *testing.T) {
+	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.IPv4(1, 2, 3, 4)), layers.NewIPEndpoint(net.IPv4(2, 3, 4, 5)))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(1)), layers.NewTCPPortEndpoint(layers.TCPPort(2)))
+	flow := types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	report := func(packetCount uint64, winner string) *types.Event {
+		return &types.Event{
+			Type:        "injection",
+			Flow:        flow,
+			PacketCount: packetCount,
+			Start:       10,
+			End:         15,
+			Winner:      []byte(winner),
+			Loser:       []byte("hello"),
+		}
+	}
+
+	logger := NewDummyAttackLogger()
+	duplicates := newDuplicateReports(time.Second, logger)
+	start := time.Unix(1, 0)
+	if !duplicates.add(report(1, "world"), start) {
+		t.Fatal("first report collapsed")
+	}
+	// retransmissions of the same attack segment, each within the window of the last
+	for i := 1; i <= 3; i++ {
+		now := start.Add(time.Duration(i) * 800 * time.Millisecond)
+		duplicates.expire(now)
+		if duplicates.add(report(uint64(i+1), "world"), now) {
+			t.Fatalf("retransmission %d not collapsed", i)
+		}
+	}
+	if !duplicates.add(report(5, "WORLD"), start.Add(3*time.Second)) {
+		t.Fatal("report with different injected bytes collapsed")
+	}
+	if logger.Count != 0 {
+		t.Fatalf("%d reports logged within the window", logger.Count)
+	}
+
+	duplicates.expire(start.Add(3500 * time.Millisecond))
+	if logger.Count != 1 {
+		t.Fatalf("%d reports logged after the window, expected 1", logger.Count)
+	}
+	if logger.Last.Occurrences != 4 || logger.Last.PacketCount != 1 {
+		t.Errorf("got %d occurrences of packet %d, expected 4 of packet 1", logger.Last.Occurrences, logger.Last.PacketCount)
+	}
+
+	duplicates.flush()
+	if logger.Count != 2 || logger.Last.Occurrences != 1 {
+		t.Errorf("flush logged %d reports, the last with %d occurrences", logger.Count, logger.Last.Occurrences)
+	}
+	if newDuplicateReports(0, logger) != nil {
+		t.Error("duplicate suppression enabled without a window")
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/gopacket"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+// PacketFeed is a packet source fed by the program embedding HoneyBadger
+// rather than by a DAQ, for programs which already capture packets
+// themselves. They hand each packet to the feed, or to the Supervisor
+// running it; see WithPacketFeed. Packets are only accepted while the
+// feed runs, and once Stop returns no more packets reach the dispatcher.
+type PacketFeed struct {
+	options    *types.SnifferDriverOptions
+	supervisor types.Supervisor
+	dispatcher PacketDispatcher
+
+	mutex   sync.Mutex
+	decoder *packetDecoder
+	running bool
+	cancel  context.CancelFunc
+}
+
+// NewPacketFeed creates a new PacketFeed struct; packets fed to it are
+// recorded as seen on the options' Device, unless it is empty.
+// It may be used as a SupervisorOptions SnifferFactory.
+func NewPacketFeed(options *types.SnifferDriverOptions, dispatcher PacketDispatcher) types.PacketSource {
+	return &PacketFeed{
+		options:    options,
+		dispatcher: dispatcher,
+		decoder:    newPacketDecoder(options.Device),
+	}
+}
+
+func (f *PacketFeed) SetSupervisor(supervisor types.Supervisor) {
+	f.supervisor = supervisor
+}
+
+func (f *PacketFeed) GetStartedChan() chan bool {
+	return make(chan bool)
+}
+
+// Start starts accepting packets until ctx is cancelled or Stop is called.
+func (f *PacketFeed) Start(ctx context.Context) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.running = true
+	logging.Infof("Starting packet feed")
+	ctx, f.cancel = context.WithCancel(ctx)
+	go func() {
+		<-ctx.Done()
+		f.Stop()
+	}()
+}
+
+// Stop stops accepting packets and returns once the
+// packets already accepted have been handed to the dispatcher.
+func (f *PacketFeed) Stop() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.running {
+		logging.Infof("packet feed: stopping")
+		f.cancel()
+	}
+	f.running = false
+}
+
+// ReceivePacketData decodes a captured Ethernet frame and hands it to the
+// dispatcher. data is copied, so the caller is free to reuse it. Frames
+// which do not carry a TCP/IP packet are ignored.
+func (f *PacketFeed) ReceivePacketData(data []byte, ci gopacket.CaptureInfo) error {
+	timedPacket := TimedRawPacket{
+		Timestamp: ci.Timestamp,
+		RawPacket: data,
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.running {
+		return fmt.Errorf("packet feed not running")
+	}
+	if packetManifest := f.decoder.decode(timedPacket); packetManifest != nil {
+		f.dispatcher.ReceivePacket(packetManifest)
+	}
+	return nil
+}
+
+// ReceiveManifest hands a packet the caller has decoded itself to the
+// dispatcher, which takes ownership of it. Its Flow and TCP layer must be
+// set, Payload to the TCP payload, and RawPacket too if packets are logged.
+func (f *PacketFeed) ReceiveManifest(packetManifest *types.PacketManifest) error {
+	if packetManifest.Flow == nil || packetManifest.TCP == nil {
+		return fmt.Errorf("packet manifest without a TCP/IP flow and TCP layer")
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.running {
+		return fmt.Errorf("packet feed not running")
+	}
+	f.dispatcher.ReceivePacket(packetManifest)
+	return nil
+}
@@ -0,0 +1,100 @@
+package HoneyBadger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// recordingDispatcher records the packets it receives.
+type recordingDispatcher struct {
+	packets []*types.PacketManifest
+}
+
+func (d *recordingDispatcher) ReceivePacket(p *types.PacketManifest) {
+	d.packets = append(d.packets, p)
+}
+
+func (d *recordingDispatcher) GetObservedConnectionsChan(count int) chan bool {
+	return make(chan bool)
+}
+
+func (d *recordingDispatcher) Connections() []ConnectionInterface {
+	return nil
+}
+
+func (d *recordingDispatcher) Stop() {}
+
+func TestPacketFeed(t *testing.T) {
+	dispatcher := &recordingDispatcher{}
+	feed := NewPacketFeed(&types.SnifferDriverOptions{Device: "tap0"}, dispatcher).(*PacketFeed)
+	ethernet := &layers.Ethernet{SrcMAC: ingressMAC, DstMAC: ingressMAC, EthernetType: layers.EthernetTypeIPv4}
+	frame := serializeIngressPacket(t, append([]gopacket.SerializableLayer{ethernet}, innerTCPLayers()...)...)
+	captured := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	ci := gopacket.CaptureInfo{Timestamp: captured, CaptureLength: len(frame), Length: len(frame)}
+
+	if err := feed.ReceivePacketData(frame, ci); err == nil {
+		t.Error("packet accepted before the feed started")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	feed.Start(ctx)
+	if err := feed.ReceivePacketData(frame, ci); err != nil {
+		t.Fatal(err)
+	}
+	if err := feed.ReceivePacketData([]byte{1, 2, 3}, ci); err != nil {
+		t.Errorf("undecodable frame: %s", err)
+	}
+	frame[len(frame)-1] = 'X'
+	if len(dispatcher.packets) != 1 {
+		t.Fatalf("dispatched %d packets, expected 1", len(dispatcher.packets))
+	}
+	p := dispatcher.packets[0]
+	if p.Flow.String() != "1.2.3.4:1-2.3.4.5:2" || !p.Timestamp.Equal(captured) || p.Ingress == nil || p.Ingress.Interface != "tap0" {
+		t.Errorf("dispatched %s at %s seen on %+v", p.Flow, p.Timestamp, p.Ingress)
+	}
+	if p.RawPacket[len(p.RawPacket)-1] == 'X' {
+		t.Error("packet data not copied")
+	}
+
+	if err := feed.ReceiveManifest(&types.PacketManifest{}); err == nil {
+		t.Error("manifest without a flow accepted")
+	}
+	if err := feed.ReceiveManifest(p); err != nil || len(dispatcher.packets) != 2 {
+		t.Errorf("manifest not dispatched: %v", err)
+	}
+
+	feed.Stop()
+	if err := feed.ReceivePacketData(frame, ci); err == nil {
+		t.Error("packet accepted after the feed stopped")
+	}
+}
+
+func TestSupervisorPacketFeed(t *testing.T) {
+	logger := &recordedAttackLogger{recordedService: recordedService{"attacks", &lifecycleRecorder{}}}
+	supervisor, err := New(WithPacketFeed(""), WithAttackLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := supervisor.GetSniffer().(*PacketFeed); !ok {
+		t.Fatalf("packet source %T", supervisor.GetSniffer())
+	}
+	if err := supervisor.ReceiveManifest(&types.PacketManifest{}); err == nil {
+		t.Error("invalid manifest accepted")
+	}
+
+	supervisor = NewSupervisor(SupervisorOptions{
+		SnifferDriverOptions: &types.SnifferDriverOptions{},
+		DispatcherOptions:    DispatcherOptions{MaxConcurrentConnections: 10},
+		SnifferFactory:       NewMockSniffer,
+		ConnectionFactory:    &mockConnFactory{},
+	})
+	if err := supervisor.ReceivePacketData([]byte{}, gopacket.CaptureInfo{}); err == nil {
+		t.Error("packet fed to a supervisor without a packet feed")
+	}
+}
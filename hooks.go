@@ -0,0 +1,84 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"strings"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// ConnectionHook is called with a connection as it is opened or closed.
+type ConnectionHook func(conn ConnectionInterface)
+
+// AttackHook is called with each attack reported and the connection reporting
+// it, which is nil for a detector plugin's report of a connection no longer tracked.
+type AttackHook func(event *types.Event, conn ConnectionInterface)
+
+// Hooks are the callbacks of the dispatcher, for custom behavior short of
+// an attack logger backend. They are called in the order given, on the
+// goroutine dispatching packets, so they may read the connection they
+// are given but hold up the dispatcher until they return:
+// OnConnectionOpen once a new connection is tracked, OnConnectionClose
+// before a connection is closed and OnAttack before an attack report
+// is handed to the attack loggers, which see any changes made to it.
+type Hooks struct {
+	OnConnectionOpen  []ConnectionHook
+	OnConnectionClose []ConnectionHook
+	OnAttack          []AttackHook
+}
+
+// isConnectionEvent returns true if eventType is one of the events the
+// dispatcher reports about connections rather than an attack.
+func isConnectionEvent(eventType string) bool {
+	return strings.HasPrefix(eventType, "connection-")
+}
+
+// connectionReporter is the attack logger of a connection: it applies the
+// countermeasure, calls the attack hooks, logs the reports and publishes
+// them to the subscriptions.
+type connectionReporter struct {
+	types.Logger
+	dispatcher *Dispatcher
+	conn       ConnectionInterface
+}
+
+func (r *connectionReporter) Log(event *types.Event) {
+	var teardown *types.Event
+	if !isConnectionEvent(event.Type) {
+		// the connection is torn down before the report is handled
+		teardown = r.dispatcher.tearDown(event, r.conn)
+		for _, hook := range r.dispatcher.options.Hooks.OnAttack {
+			hook(event, r.conn)
+		}
+	}
+	r.report(event)
+	if teardown != nil {
+		r.report(teardown)
+	}
+}
+
+// report logs an event and publishes it to the subscriptions.
+func (r *connectionReporter) report(event *types.Event) {
+	if r.Logger != nil {
+		r.Logger.Log(event)
+	}
+	r.dispatcher.events.publish(event)
+}
@@ -0,0 +1,56 @@
+package HoneyBadger
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+func TestDispatcherHooks(t *testing.T) {
+	var calls []string
+	logger := &recordedAttackLogger{recordedService: recordedService{"attacks", &lifecycleRecorder{}}}
+	supervisor, err := New(
+		WithAttackLogger(logger),
+		WithMaxConnections(1, true),
+		WithOnConnectionOpen(func(conn ConnectionInterface) {
+			calls = append(calls, "open "+conn.GetClientFlow().String())
+		}),
+		WithOnConnectionClose(func(conn ConnectionInterface) {
+			calls = append(calls, "close "+conn.GetClientFlow().String())
+		}),
+		WithOnAttack(func(event *types.Event, conn ConnectionInterface) {
+			if logger.count != 0 {
+				t.Error("attack hook called after the report was logged")
+			}
+			calls = append(calls, "attack "+event.Type)
+			event.Type = "tagged " + event.Type
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := supervisor.dispatcher
+	dispatcher.Start()
+	_, packet := newTestConnection(dispatcher.options.Logger)
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	dispatcher.LiveConnections()
+	conn := dispatcher.Connections()[0].(*Connection)
+	conn.AttackLogger.Log(&types.Event{Type: "injection", Flow: *conn.clientFlow})
+	dispatcher.Stop()
+
+	expected := []string{"open 1.2.3.4:1-2.3.4.5:2", "attack injection", "close 1.2.3.4:1-2.3.4.5:2"}
+	if len(calls) != len(expected) {
+		t.Fatalf("hooks called %v, expected %v", calls, expected)
+	}
+	for i := range expected {
+		if calls[i] != expected[i] {
+			t.Errorf("hooks called %v, expected %v", calls, expected)
+			break
+		}
+	}
+	if logger.count != 1 {
+		t.Errorf("%d reports logged", logger.count)
+	}
+}
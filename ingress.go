@@ -0,0 +1,316 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// MAX_TUNNEL_DEPTH bounds the tunnels decapsulated from one packet.
+const MAX_TUNNEL_DEPTH = 4
+
+// Encapsulations recognized by decapsulate.
+const (
+	GRE_PROTOCOL_ERSPAN = 0x88be
+	GRE_PROTOCOL_TEB    = 0x6558
+	VXLAN_PORT          = 4789
+)
+
+// frameVLANs returns the VLAN IDs an Ethernet frame is tagged
+// with, outermost first, including 802.1ad service tags.
+func frameVLANs(frame []byte) []uint16 {
+	var vlans []uint16
+	for offset := 12; offset+4 <= len(frame); offset += 4 {
+		switch binary.BigEndian.Uint16(frame[offset:]) {
+		case 0x8100, 0x88a8, 0x9100:
+			vlans = append(vlans, binary.BigEndian.Uint16(frame[offset+2:])&0x0fff)
+		default:
+			return vlans
+		}
+	}
+	return vlans
+}
+
+// tunnelPayload is the packet carried by a tunnel.
+type tunnelPayload struct {
+	tunnel string
+	id     uint32
+	data   []byte
+	first  gopacket.LayerType
+}
+
+// etherTypeLayer returns the layer type of the given EtherType
+// carried by a tunnel, or LayerTypeZero if it is not IP or Ethernet.
+func etherTypeLayer(etherType uint16) gopacket.LayerType {
+	switch layers.EthernetType(etherType) {
+	case layers.EthernetTypeIPv4:
+		return layers.LayerTypeIPv4
+	case layers.EthernetTypeIPv6:
+		return layers.LayerTypeIPv6
+	case GRE_PROTOCOL_TEB:
+		return layers.LayerTypeEthernet
+	}
+	return gopacket.LayerTypeZero
+}
+
+// decapsulate returns the packet carried by an IP tunnel, IP in IP, GRE,
+// ERSPAN type II or VXLAN, given the IP protocol and payload of the outer
+// packet; ok is false if the payload is not a tunnel it recognizes.
+func decapsulate(protocol layers.IPProtocol, payload []byte) (inner tunnelPayload, ok bool) {
+	switch protocol {
+	case layers.IPProtocolIPv4:
+		return tunnelPayload{tunnel: "ipip", data: payload, first: layers.LayerTypeIPv4}, true
+	case layers.IPProtocolIPv6:
+		return tunnelPayload{tunnel: "ipip", data: payload, first: layers.LayerTypeIPv6}, true
+	case layers.IPProtocolGRE:
+		if len(payload) < 4 {
+			return inner, false
+		}
+		flags := binary.BigEndian.Uint16(payload)
+		etherType := binary.BigEndian.Uint16(payload[2:])
+		offset := 4
+		if flags&0x8000 != 0 { // checksum present
+			offset += 4
+		}
+		inner.tunnel = "gre"
+		if flags&0x2000 != 0 { // key present
+			if len(payload) < offset+4 {
+				return inner, false
+			}
+			inner.id = binary.BigEndian.Uint32(payload[offset:])
+			offset += 4
+		}
+		if flags&0x1000 != 0 { // sequence number present
+			offset += 4
+		}
+		if etherType == GRE_PROTOCOL_ERSPAN {
+			// the ERSPAN type II header carries the session ID
+			if len(payload) < offset+8 {
+				return inner, false
+			}
+			inner.tunnel = "erspan"
+			inner.id = uint32(binary.BigEndian.Uint16(payload[offset+2:]) & 0x03ff)
+			inner.data = payload[offset+8:]
+			inner.first = layers.LayerTypeEthernet
+			return inner, true
+		}
+		if len(payload) < offset {
+			return inner, false
+		}
+		inner.data = payload[offset:]
+		inner.first = etherTypeLayer(etherType)
+		return inner, inner.first != gopacket.LayerTypeZero
+	case layers.IPProtocolUDP:
+		// a VXLAN header follows the UDP header
+		if len(payload) < 16 || binary.BigEndian.Uint16(payload[2:]) != VXLAN_PORT || payload[8]&0x08 == 0 {
+			return inner, false
+		}
+		return tunnelPayload{
+			tunnel: "vxlan",
+			id:     binary.BigEndian.Uint32(payload[12:]) >> 8,
+			data:   payload[16:],
+			first:  layers.LayerTypeEthernet,
+		}, true
+	}
+	return inner, false
+}
+
+// tunnelIPv4 and tunnelIPv6 decode IP layers like layers.IPv4 and
+// layers.IPv6 do but leave the packets they carry over IP in IP
+// undecoded, so that decode sees the tunnel.
+type tunnelIPv4 struct{ layers.IPv4 }
+type tunnelIPv6 struct{ layers.IPv6 }
+
+func (ip *tunnelIPv4) NextLayerType() gopacket.LayerType {
+	if ip.Protocol == layers.IPProtocolIPv4 || ip.Protocol == layers.IPProtocolIPv6 {
+		return gopacket.LayerTypeZero
+	}
+	return ip.IPv4.NextLayerType()
+}
+
+func (ip *tunnelIPv6) NextLayerType() gopacket.LayerType {
+	if ip.NextHeader == layers.IPProtocolIPv4 || ip.NextHeader == layers.IPProtocolIPv6 {
+		return gopacket.LayerTypeZero
+	}
+	return ip.IPv6.NextLayerType()
+}
+
+// packetDecoder decodes captured packets into PacketManifests, looking
+// through VLAN tags and tunnels to the TCP/IP packet they carry.
+type packetDecoder struct {
+	eth     layers.Ethernet
+	dot1q   layers.Dot1Q
+	ip4     tunnelIPv4
+	ip6     tunnelIPv6
+	tcp     layers.TCP
+	payload gopacket.Payload
+	parsers map[gopacket.LayerType]*gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+	ingress *types.Ingress
+}
+
+// newPacketDecoder returns a packetDecoder of the packets captured on
+// the given interface, which is empty if they were read from a file.
+func newPacketDecoder(iface string) *packetDecoder {
+	d := &packetDecoder{
+		parsers: make(map[gopacket.LayerType]*gopacket.DecodingLayerParser),
+		decoded: make([]gopacket.LayerType, 0, 8),
+	}
+	for _, first := range []gopacket.LayerType{layers.LayerTypeEthernet, layers.LayerTypeIPv4, layers.LayerTypeIPv6} {
+		d.parsers[first] = gopacket.NewDecodingLayerParser(first, &d.eth, &d.dot1q, &d.ip4, &d.ip6, &d.tcp, &d.payload)
+	}
+	if iface != "" {
+		d.ingress = &types.Ingress{Interface: iface}
+	}
+	return d
+}
+
+// decode returns the pooled PacketManifest of a copy of a captured
+// Ethernet frame or nil if it does not carry a TCP/IP packet.
+func (d *packetDecoder) decode(timedRawPacket TimedRawPacket) *types.PacketManifest {
+	p := types.GetPacketManifest(timedRawPacket.RawPacket)
+	p.Timestamp = timedRawPacket.Timestamp
+	if !d.decodeManifest(p) {
+		p.Release()
+		return nil
+	}
+	return p
+}
+
+// decodeBatch decodes a batch of pooled PacketManifests in place and
+// returns those carrying a TCP/IP packet, releasing the others.
+func (d *packetDecoder) decodeBatch(batch []*types.PacketManifest) []*types.PacketManifest {
+	decoded := batch[:0]
+	for _, p := range batch {
+		if d.decodeManifest(p) {
+			decoded = append(decoded, p)
+		} else {
+			p.Release()
+		}
+	}
+	return decoded
+}
+
+// decodeManifest decodes the captured Ethernet frame of a pooled
+// PacketManifest into its layers, looking through VLAN tags and tunnels,
+// copying them out of the decoder's, which are reused for the next packet;
+// the packets decoded may be queued for analysis in the meantime.
+// It returns false if the frame does not carry a TCP/IP packet.
+func (d *packetDecoder) decodeManifest(p *types.PacketManifest) bool {
+	ingress := d.ingress
+	if vlans := frameVLANs(p.RawPacket); len(vlans) > 0 {
+		ingress = d.ingressCopy(ingress)
+		ingress.VLANs = vlans
+	}
+	data, first := p.RawPacket, layers.LayerTypeEthernet
+	for depth := 0; ; depth++ {
+		d.payload = nil
+		err := d.parsers[first].DecodeLayers(data, &d.decoded)
+		if len(d.decoded) == 0 {
+			return false
+		}
+		// a tunnel is an IP layer followed by one that was not decoded
+		var protocol layers.IPProtocol
+		var contents []byte
+		var src, dst string
+		switch d.decoded[len(d.decoded)-1] {
+		case layers.LayerTypeIPv4:
+			protocol, contents = d.ip4.Protocol, d.ip4.Payload
+			src, dst = d.ip4.SrcIP.String(), d.ip4.DstIP.String()
+		case layers.LayerTypeIPv6:
+			protocol, contents = d.ip6.NextHeader, d.ip6.Payload
+			src, dst = d.ip6.SrcIP.String(), d.ip6.DstIP.String()
+		default:
+			if err != nil {
+				return false
+			}
+		}
+		if contents == nil {
+			break
+		}
+		if depth == MAX_TUNNEL_DEPTH {
+			return false
+		}
+		inner, ok := decapsulate(protocol, contents)
+		if !ok {
+			return false
+		}
+		if ingress == nil || ingress.Tunnel == "" {
+			ingress = d.ingressCopy(ingress)
+			ingress.Tunnel = inner.tunnel
+			ingress.TunnelID = inner.id
+			ingress.TunnelSrc = src
+			ingress.TunnelDst = dst
+		}
+		data, first = inner.data, inner.first
+	}
+
+	foundNetLayer, ipv4 := false, false
+	for _, typ := range d.decoded {
+		switch typ {
+		case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+			foundNetLayer = true
+			ipv4 = typ == layers.LayerTypeIPv4
+		case layers.LayerTypeTCP:
+			if !foundNetLayer {
+				return false
+			}
+			d.fill(p, ingress, ipv4)
+			return true
+		}
+	}
+	return false
+}
+
+// fill sets the layers of a pooled PacketManifest to those
+// of the TCP/IP packet just decoded, over IPv4 or IPv6.
+func (d *packetDecoder) fill(p *types.PacketManifest, ingress *types.Ingress, ipv4 bool) {
+	p.Ingress = ingress
+	p.Payload = d.payload
+	if ipv4 {
+		*p.IPv4 = d.ip4.IPv4
+		p.IPv4.Options = nil
+		if len(d.ip4.Options) != 0 {
+			p.IPv4.Options = append([]layers.IPv4Option(nil), d.ip4.Options...)
+		}
+		*p.Flow = types.NewTcpIpFlowFromFlows(d.ip4.NetworkFlow(), d.tcp.TransportFlow())
+	} else {
+		*p.IPv6 = d.ip6.IPv6
+		*p.Flow = types.NewTcpIpFlowFromFlows(d.ip6.NetworkFlow(), d.tcp.TransportFlow())
+	}
+	// the TCP options are copied into the room the pooled layer has for them
+	options := p.TCP.Options[:0]
+	*p.TCP = d.tcp
+	p.TCP.Options = append(options, d.tcp.Options...)
+}
+
+// ingressCopy returns a copy of ingress, which is shared, to modify.
+func (d *packetDecoder) ingressCopy(ingress *types.Ingress) *types.Ingress {
+	if ingress == nil {
+		return &types.Ingress{}
+	}
+	c := *ingress
+	return &c
+}
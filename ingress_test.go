@@ -0,0 +1,154 @@
+package HoneyBadger
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+var ingressMAC = net.HardwareAddr{0, 1, 2, 3, 4, 5}
+
+func serializeIngressPacket(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, l...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// innerTCPLayers returns the layers of a TCP/IP packet from 1.2.3.4:1 to 2.3.4.5:2.
+func innerTCPLayers() []gopacket.SerializableLayer {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.IPv4(1, 2, 3, 4), DstIP: net.IPv4(2, 3, 4, 5)}
+	tcp := &layers.TCP{SrcPort: 1, DstPort: 2, Seq: 3, ACK: true, Ack: 4, Window: 10}
+	tcp.SetNetworkLayerForChecksum(ip)
+	return []gopacket.SerializableLayer{ip, tcp, gopacket.Payload("injected")}
+}
+
+func outerIPv4(protocol layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, TTL: 64, Protocol: protocol,
+		SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)}
+}
+
+func TestPacketDecoderIngress(t *testing.T) {
+	ethernet := func(etherType layers.EthernetType) *layers.Ethernet {
+		return &layers.Ethernet{SrcMAC: ingressMAC, DstMAC: ingressMAC, EthernetType: etherType}
+	}
+	inner := serializeIngressPacket(t, append([]gopacket.SerializableLayer{ethernet(layers.EthernetTypeIPv4)}, innerTCPLayers()...)...)
+	udp := &layers.UDP{SrcPort: 1234, DstPort: VXLAN_PORT}
+	udp.SetNetworkLayerForChecksum(outerIPv4(layers.IPProtocolUDP))
+
+	tests := []struct {
+		name    string
+		iface   string
+		packet  []gopacket.SerializableLayer
+		ingress *types.Ingress
+	}{
+		{
+			name:   "untagged file capture",
+			packet: append([]gopacket.SerializableLayer{ethernet(layers.EthernetTypeIPv4)}, innerTCPLayers()...),
+		},
+		{
+			name:    "untagged",
+			iface:   "eth0",
+			packet:  append([]gopacket.SerializableLayer{ethernet(layers.EthernetTypeIPv4)}, innerTCPLayers()...),
+			ingress: &types.Ingress{Interface: "eth0"},
+		},
+		{
+			name:  "q-in-q",
+			iface: "eth0",
+			packet: append([]gopacket.SerializableLayer{ethernet(layers.EthernetTypeQinQ),
+				&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeDot1Q},
+				&layers.Dot1Q{VLANIdentifier: 200, Type: layers.EthernetTypeIPv4}}, innerTCPLayers()...),
+			ingress: &types.Ingress{Interface: "eth0", VLANs: []uint16{100, 200}},
+		},
+		{
+			name:  "ipip",
+			iface: "eth0",
+			packet: append([]gopacket.SerializableLayer{ethernet(layers.EthernetTypeIPv4),
+				outerIPv4(layers.IPProtocolIPv4)}, innerTCPLayers()...),
+			ingress: &types.Ingress{Interface: "eth0", Tunnel: "ipip", TunnelSrc: "10.0.0.1", TunnelDst: "10.0.0.2"},
+		},
+		{
+			name:  "gre with key",
+			iface: "eth0",
+			packet: append([]gopacket.SerializableLayer{ethernet(layers.EthernetTypeIPv4),
+				outerIPv4(layers.IPProtocolGRE),
+				&layers.GRE{KeyPresent: true, Key: 42, Protocol: layers.EthernetTypeIPv4}}, innerTCPLayers()...),
+			ingress: &types.Ingress{Interface: "eth0", Tunnel: "gre", TunnelID: 42, TunnelSrc: "10.0.0.1", TunnelDst: "10.0.0.2"},
+		},
+		{
+			name:  "erspan",
+			iface: "eth0",
+			packet: []gopacket.SerializableLayer{ethernet(layers.EthernetTypeIPv4),
+				outerIPv4(layers.IPProtocolGRE),
+				&layers.GRE{SeqPresent: true, Seq: 7, Protocol: GRE_PROTOCOL_ERSPAN},
+				gopacket.Payload(append([]byte{0x10, 0, 0x03, 0x07, 0, 0, 0, 0}, inner...))},
+			ingress: &types.Ingress{Interface: "eth0", Tunnel: "erspan", TunnelID: 0x307, TunnelSrc: "10.0.0.1", TunnelDst: "10.0.0.2"},
+		},
+		{
+			name:  "vxlan",
+			iface: "eth0",
+			packet: []gopacket.SerializableLayer{ethernet(layers.EthernetTypeIPv4),
+				outerIPv4(layers.IPProtocolUDP), udp,
+				gopacket.Payload(append([]byte{0x08, 0, 0, 0, 0x00, 0x10, 0x00, 0}, inner...))},
+			ingress: &types.Ingress{Interface: "eth0", Tunnel: "vxlan", TunnelID: 4096, TunnelSrc: "10.0.0.1", TunnelDst: "10.0.0.2"},
+		},
+	}
+	for _, test := range tests {
+		decoder := newPacketDecoder(test.iface)
+		raw := serializeIngressPacket(t, test.packet...)
+		p := decoder.decode(TimedRawPacket{Timestamp: time.Unix(1, 0), RawPacket: raw})
+		if p == nil {
+			t.Errorf("%s: packet not decoded", test.name)
+			continue
+		}
+		if !reflect.DeepEqual(p.Ingress, test.ingress) {
+			t.Errorf("%s: ingress %+v, expected %+v", test.name, p.Ingress, test.ingress)
+		}
+		if p.Flow.String() != "1.2.3.4:1-2.3.4.5:2" || string(p.Payload) != "injected" {
+			t.Errorf("%s: decoded %s %q", test.name, p.Flow, p.Payload)
+		}
+	}
+	if decoder := newPacketDecoder("eth0"); decoder.decode(TimedRawPacket{RawPacket: inner[:20]}) != nil {
+		t.Error("truncated packet decoded")
+	}
+}
+
+func TestPacketDecoderAllocations(t *testing.T) {
+	ethernet := &layers.Ethernet{SrcMAC: ingressMAC, DstMAC: ingressMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip, tcp := outerIPv4(layers.IPProtocolTCP), &layers.TCP{SrcPort: 1, DstPort: 2, Seq: 3, SYN: true, Window: 10,
+		Options: []layers.TCPOption{{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{5, 0xb4}}}}
+	tcp.SetNetworkLayerForChecksum(ip)
+	syn := serializeIngressPacket(t, ethernet, ip, tcp)
+	ack := serializeIngressPacket(t, append([]gopacket.SerializableLayer{ethernet}, innerTCPLayers()...)...)
+
+	decoder := newPacketDecoder("eth0")
+	first := decoder.decode(TimedRawPacket{RawPacket: syn})
+	second := decoder.decode(TimedRawPacket{RawPacket: ack})
+	if first == nil || second == nil {
+		t.Fatal("packets not decoded")
+	}
+	// decoding the next packet leaves the layers of the first as they were
+	if len(first.TCP.Options) != 1 || first.TCP.Options[0].OptionType != layers.TCPOptionKindMSS || !first.TCP.SYN {
+		t.Errorf("first packet's TCP layer overwritten: %+v", first.TCP)
+	}
+	if first.Flow.String() != "10.0.0.1:1-10.0.0.2:2" || second.Flow.String() != "1.2.3.4:1-2.3.4.5:2" {
+		t.Errorf("flows %s and %s", first.Flow, second.Flow)
+	}
+
+	// pooled packets released once analysed are decoded into again
+	allocs := testing.AllocsPerRun(100, func() {
+		decoder.decode(TimedRawPacket{RawPacket: syn}).Release()
+	})
+	if allocs >= 1 {
+		t.Errorf("%.1f allocations decoding a packet, expected none", allocs)
+	}
+}
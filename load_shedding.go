@@ -0,0 +1,237 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+// The load shedding policies the dispatcher may apply while captured
+// packets are being dropped, see LoadSheddingOptions. They spare the
+// connections using a priority port or matching an "always" tracking rule.
+const (
+	// SHED_PAYLOAD retains only the latest segment of the streams of new
+	// connections, retransmissions of earlier segments are not compared,
+	SHED_PAYLOAD = 1 << iota
+	// SHED_SAMPLE tracks only LoadSheddingOptions.SampleRate of new connections,
+	SHED_SAMPLE
+	// SHED_DETECTORS suspends the segment events sent to detector plugins.
+	SHED_DETECTORS
+)
+
+// LOAD_SHED_INTERVAL is the default interval at which captured packets
+// dropped are counted, LOAD_SHED_RECOVERY the number of intervals in a row
+// they must be dropped at a lower rate before shedding stops and
+// LOAD_SHED_SAMPLE_RATE the default fraction of new connections sampled.
+const (
+	LOAD_SHED_INTERVAL    = 5 * time.Second
+	LOAD_SHED_RECOVERY    = 6
+	LOAD_SHED_SAMPLE_RATE = 0.1
+)
+
+var shedPolicyNames = []struct {
+	policy int
+	name   string
+}{
+	{SHED_PAYLOAD, "payload"},
+	{SHED_SAMPLE, "sample"},
+	{SHED_DETECTORS, "detectors"},
+}
+
+// ParseShedPolicies returns the load shedding policies of a comma
+// separated list of their names; "payload", "sample" and "detectors".
+func ParseShedPolicies(names string) (int, error) {
+	policies := 0
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, named := range shedPolicyNames {
+			if named.name == name {
+				policies |= named.policy
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown load shedding policy %q", name)
+		}
+	}
+	return policies, nil
+}
+
+// shedPolicyList returns the names of the given load shedding policies.
+func shedPolicyList(policies int) []string {
+	var names []string
+	for _, named := range shedPolicyNames {
+		if policies&named.policy != 0 {
+			names = append(names, named.name)
+		}
+	}
+	return names
+}
+
+// LoadSheddingOptions are the options of the dispatcher's load shedding.
+// Once the packet source counts captured packets being dropped at
+// DropRate per second or more, by the kernel or as decoding falls behind,
+// the dispatcher applies the load shedding Policies, a combination of
+// the SHED_ policies, until packets have been dropped at a lower rate for
+// LOAD_SHED_RECOVERY intervals in a row. Drops are counted every Interval,
+// by default LOAD_SHED_INTERVAL; SampleRate is the fraction of new
+// connections sampled by SHED_SAMPLE, by default LOAD_SHED_SAMPLE_RATE.
+// Starting and ceasing to shed load is logged and published to the
+// subscriptions as a LoadShedding event, so detection gaps are visible.
+type LoadSheddingOptions struct {
+	Policies   int
+	DropRate   float64
+	SampleRate float64
+	Interval   time.Duration
+}
+
+// loadShedder tracks the rate at which captured packets are dropped.
+// Only active is read by the workers.
+type loadShedder struct {
+	counter types.DropCounter
+	drops   uint64
+	counted time.Time
+	calm    int
+	active  int32
+}
+
+// SetDropCounter sets the counter of the captured packets dropped,
+// by which the dispatcher sheds load; it must be called before Start.
+func (i *Dispatcher) SetDropCounter(counter types.DropCounter) {
+	i.shedder.counter = counter
+}
+
+// LoadShedding returns the names of the load shedding
+// policies currently applied, none unless shedding load.
+func (i *Dispatcher) LoadShedding() []string {
+	if atomic.LoadInt32(&i.shedder.active) == 0 {
+		return nil
+	}
+	return shedPolicyList(i.options.LoadShedding.Policies)
+}
+
+// shedding returns true if the given load shedding policy is applied.
+func (i *Dispatcher) shedding(policy int) bool {
+	return i.options.LoadShedding.Policies&policy != 0 && atomic.LoadInt32(&i.shedder.active) != 0
+}
+
+// sampleRate returns the fraction of new connections tracked, lowered to
+// the load shedding sample rate while SHED_SAMPLE is applied.
+func (i *Dispatcher) sampleRate() float64 {
+	rate := i.options.SampleRate
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+	if i.shedding(SHED_SAMPLE) {
+		shedRate := i.options.LoadShedding.SampleRate
+		if shedRate <= 0 {
+			shedRate = LOAD_SHED_SAMPLE_RATE
+		}
+		if shedRate < rate {
+			rate = shedRate
+		}
+	}
+	return rate
+}
+
+// loadInterval returns the interval at which captured packets dropped
+// are counted, or zero if the dispatcher does not shed load.
+func (i *Dispatcher) loadInterval() time.Duration {
+	if i.shedder.counter == nil || i.options.LoadShedding.Policies == 0 {
+		return 0
+	}
+	if i.options.LoadShedding.Interval > 0 {
+		return i.options.LoadShedding.Interval
+	}
+	return LOAD_SHED_INTERVAL
+}
+
+// checkLoad counts the captured packets dropped since last checked
+// and starts or stops shedding load depending on the rate they were
+// dropped at.
+func (i *Dispatcher) checkLoad() {
+	s := &i.shedder
+	drops, err := s.counter.Drops()
+	if err != nil {
+		logging.Debugf("failed to count dropped packets: %s", err)
+		return
+	}
+	now := time.Now()
+	rate := 0.0
+	if !s.counted.IsZero() && drops > s.drops {
+		rate = float64(drops-s.drops) / now.Sub(s.counted).Seconds()
+	}
+	s.drops, s.counted = drops, now
+	active := atomic.LoadInt32(&s.active) != 0
+	if rate > 0 && rate >= i.options.LoadShedding.DropRate {
+		s.calm = 0
+		if !active {
+			i.shedLoad(true, rate)
+		}
+	} else if active {
+		s.calm++
+		if s.calm >= LOAD_SHED_RECOVERY {
+			i.shedLoad(false, rate)
+		}
+	}
+}
+
+// shedLoad starts or stops applying the load shedding policies and
+// reports it; packets were last dropped at rate per second.
+func (i *Dispatcher) shedLoad(active bool, rate float64) {
+	var flag int32
+	if active {
+		flag = 1
+	}
+	atomic.StoreInt32(&i.shedder.active, flag)
+	if i.options.LoadShedding.Policies&SHED_DETECTORS != 0 {
+		for _, plugin := range i.options.DetectorPlugins {
+			plugin.suspendSegments(active)
+		}
+	}
+	policies := shedPolicyList(i.options.LoadShedding.Policies)
+	eventType := "load-shedding-stopped"
+	if active {
+		eventType = "load-shedding-started"
+		logging.Warningf("%.1f captured packets/s dropped; shedding load, detection degraded by policies %s", rate, strings.Join(policies, ", "))
+	} else {
+		logging.Infof("%.1f captured packets/s dropped; no longer shedding load", rate)
+	}
+	i.events.publishEvent(LoadShedding{
+		event: &types.Event{
+			Type:       eventType,
+			Time:       i.captureNow(),
+			SampleRate: i.sampleRate(),
+		},
+		Active:   active,
+		DropRate: rate,
+		Policies: policies,
+	})
+}
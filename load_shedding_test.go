@@ -0,0 +1,96 @@
+package HoneyBadger
+
+import (
+	"testing"
+)
+
+// dropCounter counts the packets it is told were dropped.
+type dropCounter struct {
+	drops uint64
+}
+
+func (c *dropCounter) Drops() (uint64, error) {
+	return c.drops, nil
+}
+
+func TestParseShedPolicies(t *testing.T) {
+	policies, err := ParseShedPolicies("payload, detectors")
+	if err != nil || policies != SHED_PAYLOAD|SHED_DETECTORS {
+		t.Errorf("parsed %d %v", policies, err)
+	}
+	if policies, err := ParseShedPolicies(""); err != nil || policies != 0 {
+		t.Errorf("parsed %d %v from no policies", policies, err)
+	}
+	if _, err := ParseShedPolicies("payload,everything"); err == nil {
+		t.Error("unknown policy parsed")
+	}
+}
+
+func TestDispatcherLoadShedding(t *testing.T) {
+	plugin := &DetectorPlugin{Name: "segments", Segments: true}
+	options := DispatcherOptions{
+		PriorityPorts:   []int{1000},
+		DetectorPlugins: []*DetectorPlugin{plugin},
+		LoadShedding: LoadSheddingOptions{
+			Policies: SHED_PAYLOAD | SHED_SAMPLE | SHED_DETECTORS,
+			DropRate: 10,
+		},
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	counter := &dropCounter{}
+	dispatcher.SetDropCounter(counter)
+	subscription := dispatcher.Subscribe(SubscriptionOptions{})
+	tracked := func() int {
+		count := 0
+		for port := 2000; port < 3000; port++ {
+			if dispatcher.track(synPacket(port).Flow) {
+				count++
+			}
+		}
+		return count
+	}
+	ringPackets := func(port int) int {
+		conn := dispatcher.setupNewConnection(synPacket(port).Flow).(*Connection)
+		return conn.ClientStreamBuffer.MaxPages
+	}
+
+	dispatcher.checkLoad()
+	dispatcher.checkLoad()
+	if dispatcher.LoadShedding() != nil || tracked() != 1000 || ringPackets(2000) != 0 {
+		t.Fatal("load shed before packets were dropped")
+	}
+	counter.drops = 1000
+	dispatcher.checkLoad()
+	event, ok := (<-subscription.Events).(LoadShedding)
+	if !ok || !event.Active || event.DropRate < 10 || len(event.Policies) != 3 || event.Raw().Type != "load-shedding-started" {
+		t.Fatalf("load shedding reported as %+v", event)
+	}
+	if shed := dispatcher.LoadShedding(); len(shed) != 3 || shed[0] != "payload" {
+		t.Errorf("shedding policies %v", shed)
+	}
+	if count := tracked(); count < 50 || count > 150 {
+		t.Errorf("%d of 1000 new connections tracked while sampling %.2f", count, LOAD_SHED_SAMPLE_RATE)
+	}
+	if !dispatcher.track(synPacket(1000).Flow) || ringPackets(1000) != 0 {
+		t.Error("priority connection not spared")
+	}
+	if ringPackets(2001) != 1 || !plugin.segmentsSuspended() {
+		t.Error("payload retained or segment events sent while shedding load")
+	}
+
+	// shedding goes on until drops have subsided long enough
+	for n := 0; n < LOAD_SHED_RECOVERY-1; n++ {
+		dispatcher.checkLoad()
+	}
+	if dispatcher.LoadShedding() == nil {
+		t.Fatal("load shedding stopped early")
+	}
+	dispatcher.checkLoad()
+	event, ok = (<-subscription.Events).(LoadShedding)
+	if !ok || event.Active || event.Raw().Type != "load-shedding-stopped" {
+		t.Fatalf("load shedding reported as %+v", event)
+	}
+	if dispatcher.LoadShedding() != nil || tracked() != 1000 || ringPackets(2002) != 0 || plugin.segmentsSuspended() {
+		t.Error("load still shed once drops subsided")
+	}
+}
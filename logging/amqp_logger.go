@@ -0,0 +1,502 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// This file holds an AMQP 0-9-1 publisher, the small subset of the
+// protocol needed to publish to a RabbitMQ exchange with publisher confirms.
+
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xce
+
+	amqpConnection = 10
+	amqpChannel    = 20
+	amqpExchange   = 40
+	amqpBasic      = 60
+	amqpConfirm    = 85
+)
+
+// amqpMethodID identifies a method by its class and method number.
+type amqpMethodID struct {
+	class, method uint16
+}
+
+var (
+	amqpConnectionStart   = amqpMethodID{amqpConnection, 10}
+	amqpConnectionStartOk = amqpMethodID{amqpConnection, 11}
+	amqpConnectionTune    = amqpMethodID{amqpConnection, 30}
+	amqpConnectionTuneOk  = amqpMethodID{amqpConnection, 31}
+	amqpConnectionOpen    = amqpMethodID{amqpConnection, 40}
+	amqpConnectionOpenOk  = amqpMethodID{amqpConnection, 41}
+	amqpConnectionClose   = amqpMethodID{amqpConnection, 50}
+	amqpChannelOpen       = amqpMethodID{amqpChannel, 10}
+	amqpChannelOpenOk     = amqpMethodID{amqpChannel, 11}
+	amqpChannelClose      = amqpMethodID{amqpChannel, 40}
+	amqpExchangeDeclare   = amqpMethodID{amqpExchange, 10}
+	amqpExchangeDeclareOk = amqpMethodID{amqpExchange, 11}
+	amqpBasicPublish      = amqpMethodID{amqpBasic, 40}
+	amqpBasicAck          = amqpMethodID{amqpBasic, 80}
+	amqpBasicNack         = amqpMethodID{amqpBasic, 120}
+	amqpConfirmSelect     = amqpMethodID{amqpConfirm, 10}
+	amqpConfirmSelectOk   = amqpMethodID{amqpConfirm, 11}
+)
+
+type amqpEncoder struct {
+	bytes.Buffer
+}
+
+func (e *amqpEncoder) octet(v uint8)         { e.WriteByte(v) }
+func (e *amqpEncoder) short(v uint16)        { binary.Write(e, binary.BigEndian, v) }
+func (e *amqpEncoder) long(v uint32)         { binary.Write(e, binary.BigEndian, v) }
+func (e *amqpEncoder) longlong(v uint64)     { binary.Write(e, binary.BigEndian, v) }
+func (e *amqpEncoder) method(m amqpMethodID) { e.short(m.class); e.short(m.method) }
+
+func (e *amqpEncoder) shortstr(s string) {
+	e.octet(uint8(len(s)))
+	e.WriteString(s)
+}
+
+func (e *amqpEncoder) longstr(s string) {
+	e.long(uint32(len(s)))
+	e.WriteString(s)
+}
+
+// table encodes a field table of string values.
+func (e *amqpEncoder) table(fields map[string]string) {
+	var t amqpEncoder
+	for key, value := range fields {
+		t.shortstr(key)
+		t.octet('S')
+		t.longstr(value)
+	}
+	e.long(uint32(t.Len()))
+	e.Write(t.Bytes())
+}
+
+// amqpFrame is a single frame read off the connection.
+type amqpFrame struct {
+	kind    uint8
+	channel uint16
+	payload []byte
+}
+
+func (f *amqpFrame) method() amqpMethodID {
+	if f.kind != amqpFrameMethod || len(f.payload) < 4 {
+		return amqpMethodID{}
+	}
+	return amqpMethodID{binary.BigEndian.Uint16(f.payload), binary.BigEndian.Uint16(f.payload[2:])}
+}
+
+func readAMQPFrame(r io.Reader) (*amqpFrame, error) {
+	var header [7]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[3:])
+	if size > 16*1024*1024 {
+		return nil, fmt.Errorf("amqp: frame of %d bytes is too large", size)
+	}
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if payload[size] != amqpFrameEnd {
+		return nil, fmt.Errorf("amqp: invalid frame end")
+	}
+	return &amqpFrame{kind: header[0], channel: binary.BigEndian.Uint16(header[1:]), payload: payload[:size]}, nil
+}
+
+func writeAMQPFrame(w io.Writer, kind uint8, channel uint16, payload []byte) error {
+	var frame amqpEncoder
+	frame.octet(kind)
+	frame.short(channel)
+	frame.long(uint32(len(payload)))
+	frame.Write(payload)
+	frame.octet(amqpFrameEnd)
+	_, err := w.Write(frame.Bytes())
+	return err
+}
+
+// AMQPAttackLogger publishes attack reports, rendered by Format, to an AMQP
+// 0-9-1 exchange such as RabbitMQ's. The routing key is RoutingKey with
+// "{type}" and "{detector}" replaced by those of the report.
+//
+// Persistent messages are marked for delivery mode 2 so a durable queue
+// keeps them across broker restarts. With Confirm set every publish waits
+// for the broker's publisher confirm. A failed publish is retried on a
+// new connection up to Retries times.
+type AMQPAttackLogger struct {
+	Address  string
+	VHost    string
+	Username string
+	Password string
+	TLS      *tls.Config
+	Exchange string
+	// ExchangeType, if set, is the type of the durable exchange declared on connecting.
+	ExchangeType string
+	RoutingKey   string
+	Persistent   bool
+	Confirm      bool
+	Format       ReportFormatter
+	ContentType  string
+	Timeout      time.Duration
+	Retries      int
+
+	conn             net.Conn
+	reader           *bufio.Reader
+	frameMax         uint32
+	deliveryTag      uint64
+	stopChan         chan bool
+	attackReportChan chan *types.Event
+}
+
+func init() {
+	AttackLoggerRegister("amqp", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewAMQPAttackLoggerFromOptions(options)
+	})
+}
+
+// NewAMQPAttackLogger returns a pointer to an AMQPAttackLogger struct
+// publishing to exchange through the broker at address.
+func NewAMQPAttackLogger(address, exchange string) *AMQPAttackLogger {
+	return &AMQPAttackLogger{
+		Address:          address,
+		VHost:            "/",
+		Username:         "guest",
+		Password:         "guest",
+		Exchange:         exchange,
+		RoutingKey:       "honeybadger.{detector}",
+		Persistent:       true,
+		Confirm:          true,
+		Format:           FormatJSON,
+		ContentType:      "application/json",
+		Timeout:          10 * time.Second,
+		Retries:          3,
+		stopChan:         make(chan bool),
+		attackReportChan: make(chan *types.Event, 1000),
+	}
+}
+
+// NewAMQPAttackLoggerFromOptions returns an AMQPAttackLogger configured by the
+// backend parameters address, vhost, username, password, tls, exchange,
+// exchange_type, routing_key, persistent, confirm, format, timeout and retries.
+func NewAMQPAttackLoggerFromOptions(options *AttackLoggerOptions) (*AMQPAttackLogger, error) {
+	a := NewAMQPAttackLogger(options.Param("address", "localhost:5672"), options.Param("exchange", "honeybadger"))
+	a.VHost = options.Param("vhost", a.VHost)
+	a.Username = options.Param("username", a.Username)
+	a.Password = options.Param("password", a.Password)
+	a.ExchangeType = options.Param("exchange_type", "")
+	a.RoutingKey = options.Param("routing_key", a.RoutingKey)
+	a.Persistent = options.Param("persistent", "true") == "true"
+	a.Confirm = options.Param("confirm", "true") == "true"
+	if options.Param("tls", "") == "true" {
+		host, _, err := net.SplitHostPort(a.Address)
+		if err != nil {
+			return nil, err
+		}
+		a.TLS = &tls.Config{ServerName: host}
+	}
+	format := options.Param("format", "json")
+	var err error
+	if a.Format, err = reportFormat(format); err != nil {
+		return nil, err
+	}
+	a.ContentType = reportContentTypes[format]
+	if a.Timeout, err = time.ParseDuration(options.Param("timeout", a.Timeout.String())); err != nil {
+		return nil, fmt.Errorf("amqp: invalid timeout: %s", err)
+	}
+	if a.Retries, err = strconv.Atoi(options.Param("retries", strconv.Itoa(a.Retries))); err != nil {
+		return nil, fmt.Errorf("amqp: invalid retries: %s", err)
+	}
+	return a, nil
+}
+
+func (a *AMQPAttackLogger) Start() {
+	go a.receiveReports()
+}
+
+func (a *AMQPAttackLogger) Stop() {
+	a.stopChan <- true
+}
+
+func (a *AMQPAttackLogger) Log(event *types.Event) {
+	a.attackReportChan <- event
+}
+
+func (a *AMQPAttackLogger) receiveReports() {
+	for {
+		select {
+		case <-a.stopChan:
+			a.close()
+			return
+		case event := <-a.attackReportChan:
+			if err := a.send(event); err != nil {
+				backendWarningf("amqp", "%s\n", err)
+			}
+		}
+	}
+}
+
+func (a *AMQPAttackLogger) routingKey(eventType string) string {
+	return strings.NewReplacer("{type}", eventType, "{detector}", detectorOf(eventType)).Replace(a.RoutingKey)
+}
+
+func (a *AMQPAttackLogger) send(event *types.Event) error {
+	body, err := a.Format(event)
+	if err != nil {
+		return err
+	}
+	routingKey := a.routingKey(event.Type)
+	for attempt := 0; ; attempt++ {
+		if a.conn == nil {
+			err = a.connect()
+		}
+		if err == nil {
+			if err = a.publish(routingKey, body); err == nil {
+				return nil
+			}
+			a.close()
+		}
+		if attempt >= a.Retries {
+			return err
+		}
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+}
+
+// call sends a method on a channel and waits for the expected reply method.
+func (a *AMQPAttackLogger) call(channel uint16, request *amqpEncoder, reply amqpMethodID) (*amqpFrame, error) {
+	if err := writeAMQPFrame(a.conn, amqpFrameMethod, channel, request.Bytes()); err != nil {
+		return nil, err
+	}
+	return a.expect(reply)
+}
+
+// expect reads frames until the given method arrives, failing if the
+// broker closes the connection or channel instead.
+func (a *AMQPAttackLogger) expect(methods ...amqpMethodID) (*amqpFrame, error) {
+	for {
+		frame, err := readAMQPFrame(a.reader)
+		if err != nil {
+			return nil, err
+		}
+		if frame.kind == amqpFrameHeartbeat {
+			continue
+		}
+		method := frame.method()
+		for _, expected := range methods {
+			if method == expected {
+				return frame, nil
+			}
+		}
+		if method == amqpConnectionClose || method == amqpChannelClose {
+			reason := ""
+			if len(frame.payload) > 7 && int(frame.payload[6]) <= len(frame.payload)-7 {
+				reason = string(frame.payload[7 : 7+int(frame.payload[6])])
+			}
+			if method == amqpConnectionClose {
+				return nil, fmt.Errorf("broker closed the connection: %s", reason)
+			}
+			return nil, fmt.Errorf("broker closed the channel: %s", reason)
+		}
+	}
+}
+
+func (a *AMQPAttackLogger) connect() error {
+	conn, err := net.DialTimeout("tcp", a.Address, a.Timeout)
+	if err != nil {
+		return err
+	}
+	if a.TLS != nil {
+		tlsConn := tls.Client(conn, a.TLS)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+	a.conn = conn
+	a.reader = bufio.NewReader(conn)
+	a.deliveryTag = 0
+	if err := a.handshake(); err != nil {
+		a.close()
+		return err
+	}
+	return nil
+}
+
+func (a *AMQPAttackLogger) handshake() error {
+	a.conn.SetDeadline(time.Now().Add(a.Timeout))
+	defer a.conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(a.conn, "AMQP\x00\x00\x09\x01"); err != nil {
+		return err
+	}
+	if _, err := a.expect(amqpConnectionStart); err != nil {
+		return err
+	}
+	var startOk amqpEncoder
+	startOk.method(amqpConnectionStartOk)
+	startOk.table(map[string]string{"product": DEVICE_PRODUCT, "version": DEVICE_VERSION})
+	startOk.shortstr("PLAIN")
+	startOk.longstr("\x00" + a.Username + "\x00" + a.Password)
+	startOk.shortstr("en_US")
+	tune, err := a.call(0, &startOk, amqpConnectionTune)
+	if err != nil {
+		return err
+	}
+	if len(tune.payload) < 12 {
+		return fmt.Errorf("amqp: short Connection.Tune")
+	}
+	channelMax := binary.BigEndian.Uint16(tune.payload[4:])
+	a.frameMax = binary.BigEndian.Uint32(tune.payload[6:])
+	if a.frameMax == 0 || a.frameMax > 131072 {
+		a.frameMax = 131072
+	}
+	var tuneOk amqpEncoder
+	tuneOk.method(amqpConnectionTuneOk)
+	tuneOk.short(channelMax)
+	tuneOk.long(a.frameMax)
+	tuneOk.short(0) // no heartbeats
+	if err := writeAMQPFrame(a.conn, amqpFrameMethod, 0, tuneOk.Bytes()); err != nil {
+		return err
+	}
+	var open amqpEncoder
+	open.method(amqpConnectionOpen)
+	open.shortstr(a.VHost)
+	open.shortstr("")
+	open.octet(0)
+	if _, err := a.call(0, &open, amqpConnectionOpenOk); err != nil {
+		return err
+	}
+	var channelOpen amqpEncoder
+	channelOpen.method(amqpChannelOpen)
+	channelOpen.shortstr("")
+	if _, err := a.call(1, &channelOpen, amqpChannelOpenOk); err != nil {
+		return err
+	}
+	if a.ExchangeType != "" {
+		var declare amqpEncoder
+		declare.method(amqpExchangeDeclare)
+		declare.short(0)
+		declare.shortstr(a.Exchange)
+		declare.shortstr(a.ExchangeType)
+		declare.octet(1 << 1) // durable
+		declare.table(nil)
+		if _, err := a.call(1, &declare, amqpExchangeDeclareOk); err != nil {
+			return err
+		}
+	}
+	if a.Confirm {
+		var selectConfirms amqpEncoder
+		selectConfirms.method(amqpConfirmSelect)
+		selectConfirms.octet(0)
+		if _, err := a.call(1, &selectConfirms, amqpConfirmSelectOk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *AMQPAttackLogger) publish(routingKey string, body []byte) error {
+	a.conn.SetDeadline(time.Now().Add(a.Timeout))
+	defer a.conn.SetDeadline(time.Time{})
+	var publish amqpEncoder
+	publish.method(amqpBasicPublish)
+	publish.short(0)
+	publish.shortstr(a.Exchange)
+	publish.shortstr(routingKey)
+	publish.octet(0)
+	if err := writeAMQPFrame(a.conn, amqpFrameMethod, 1, publish.Bytes()); err != nil {
+		return err
+	}
+
+	var header amqpEncoder
+	header.short(amqpBasic)
+	header.short(0) // weight
+	header.longlong(uint64(len(body)))
+	deliveryMode := uint8(1)
+	if a.Persistent {
+		deliveryMode = 2
+	}
+	header.short(1<<15 | 1<<12) // content-type and delivery-mode
+	header.shortstr(a.ContentType)
+	header.octet(deliveryMode)
+	if err := writeAMQPFrame(a.conn, amqpFrameHeader, 1, header.Bytes()); err != nil {
+		return err
+	}
+	chunk := int(a.frameMax) - 8
+	for len(body) > 0 {
+		n := chunk
+		if n > len(body) {
+			n = len(body)
+		}
+		if err := writeAMQPFrame(a.conn, amqpFrameBody, 1, body[:n]); err != nil {
+			return err
+		}
+		body = body[n:]
+	}
+	if !a.Confirm {
+		return nil
+	}
+	a.deliveryTag++
+	for {
+		frame, err := a.expect(amqpBasicAck, amqpBasicNack)
+		if err != nil {
+			return err
+		}
+		if len(frame.payload) < 13 {
+			return fmt.Errorf("amqp: short publisher confirm")
+		}
+		tag := binary.BigEndian.Uint64(frame.payload[4:])
+		multiple := frame.payload[12]&1 != 0
+		if tag != a.deliveryTag && !(multiple && tag > a.deliveryTag) {
+			continue
+		}
+		if frame.method() == amqpBasicNack {
+			return fmt.Errorf("broker refused the message")
+		}
+		return nil
+	}
+}
+
+func (a *AMQPAttackLogger) close() {
+	if a.conn != nil {
+		a.conn.Close()
+		a.conn = nil
+	}
+}
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// amqpPublish is a message a fakeAMQPBroker received.
+type amqpPublish struct {
+	routingKey   string
+	deliveryMode uint8
+	body         []byte
+}
+
+// serveFakeAMQP answers the connection handshake of a publisher,
+// confirms each message and sends it on published.
+func serveFakeAMQP(t *testing.T, listener net.Listener, published chan amqpPublish) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil || string(header) != "AMQP\x00\x00\x09\x01" {
+		t.Errorf("unexpected protocol header %q", header)
+		return
+	}
+	reply := func(channel uint16, m amqpMethodID, args ...byte) {
+		var e amqpEncoder
+		e.method(m)
+		e.Write(args)
+		writeAMQPFrame(conn, amqpFrameMethod, channel, e.Bytes())
+	}
+	reply(0, amqpConnectionStart)
+	var current amqpPublish
+	var tag, size uint64
+	for {
+		frame, err := readAMQPFrame(conn)
+		if err != nil {
+			return
+		}
+		switch frame.kind {
+		case amqpFrameHeader:
+			// class, weight, body size, property flags, content type
+			size = binary.BigEndian.Uint64(frame.payload[4:])
+			typeLength := int(frame.payload[14])
+			current.deliveryMode = frame.payload[15+typeLength]
+			continue
+		case amqpFrameBody:
+			current.body = append(current.body, frame.payload...)
+			if uint64(len(current.body)) < size {
+				continue
+			}
+			tag++
+			var ack amqpEncoder
+			ack.longlong(tag)
+			ack.octet(0)
+			reply(1, amqpBasicAck, ack.Bytes()...)
+			published <- current
+			current = amqpPublish{}
+			continue
+		}
+		switch frame.method() {
+		case amqpConnectionStartOk:
+			var tune amqpEncoder
+			tune.short(0)
+			tune.long(4096)
+			tune.short(0)
+			reply(0, amqpConnectionTune, tune.Bytes()...)
+		case amqpConnectionOpen:
+			reply(0, amqpConnectionOpenOk, 0)
+		case amqpChannelOpen:
+			reply(1, amqpChannelOpenOk, 0, 0, 0, 0)
+		case amqpExchangeDeclare:
+			reply(1, amqpExchangeDeclareOk)
+		case amqpConfirmSelect:
+			reply(1, amqpConfirmSelectOk)
+		case amqpBasicPublish:
+			keyLength := int(frame.payload[6+int(frame.payload[6])+1])
+			exchangeEnd := 7 + int(frame.payload[6])
+			current.routingKey = string(frame.payload[exchangeEnd+1 : exchangeEnd+1+keyLength])
+		}
+	}
+}
+
+func TestAMQPAttackLogger(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	published := make(chan amqpPublish, 1)
+	go serveFakeAMQP(t, listener, published)
+
+	logger, err := NewAMQPAttackLoggerFromOptions(&AttackLoggerOptions{
+		Params: map[string]string{
+			"address":       listener.Addr().String(),
+			"exchange_type": "topic",
+			"routing_key":   "hb.{detector}.{type}",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a body larger than a frame is split over several body frames
+	event := testReportEvent()
+	event.Payload = bytes.Repeat([]byte{1}, 5000)
+	if err := logger.send(event); err != nil {
+		t.Fatal(err)
+	}
+	logger.close()
+
+	message := <-published
+	if message.routingKey != "hb.handshake.handshake-hijack" || message.deliveryMode != 2 {
+		t.Errorf("unexpected publish %q delivery mode %d", message.routingKey, message.deliveryMode)
+	}
+	if !bytes.HasPrefix(message.body, []byte(`{"schema_version":1`)) || !bytes.HasSuffix(message.body, []byte("}")) {
+		t.Errorf("unexpected body of %d bytes", len(message.body))
+	}
+}
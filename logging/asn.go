@@ -0,0 +1,315 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	CYMRU_ORIGIN_ZONE  = "origin.asn.cymru.com"
+	CYMRU_ORIGIN6_ZONE = "origin6.asn.cymru.com"
+	CYMRU_ASN_ZONE     = "asn.cymru.com"
+	CYMRU_TIMEOUT      = 2 * time.Second
+	CYMRU_CACHE_TTL    = 24 * time.Hour
+	CYMRU_CACHE_SIZE   = 65536
+	ASN_QUEUE_SIZE     = 1024
+)
+
+// ASNResolver finds the autonomous system an address is routed to.
+type ASNResolver interface {
+	// LookupASN returns the AS of ip or nil if it is not known.
+	LookupASN(ip net.IP) *types.AutonomousSystem
+}
+
+// ASNResolvers consults each of its resolvers in turn,
+// returning the first AS found.
+type ASNResolvers []ASNResolver
+
+func (r ASNResolvers) LookupASN(ip net.IP) *types.AutonomousSystem {
+	for _, resolver := range r {
+		if as := resolver.LookupASN(ip); as != nil {
+			return as
+		}
+	}
+	return nil
+}
+
+type cymruEntry struct {
+	as      *types.AutonomousSystem
+	expires time.Time
+}
+
+// CymruResolver looks addresses up with Team Cymru's IP to ASN DNS
+// service, origin.asn.cymru.com, and the AS names with asn.cymru.com.
+// Answers, including the absence of one, are cached for TTL;
+// the cache holds at most MaxEntries addresses and AS names.
+type CymruResolver struct {
+	Timeout    time.Duration
+	TTL        time.Duration
+	MaxEntries int
+
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
+	mutex     sync.Mutex
+	cache     map[string]cymruEntry
+}
+
+// NewCymruResolver returns a CymruResolver using the system's DNS resolver.
+func NewCymruResolver() *CymruResolver {
+	return &CymruResolver{
+		Timeout:    CYMRU_TIMEOUT,
+		TTL:        CYMRU_CACHE_TTL,
+		MaxEntries: CYMRU_CACHE_SIZE,
+		lookupTXT:  net.DefaultResolver.LookupTXT,
+		cache:      make(map[string]cymruEntry),
+	}
+}
+
+// cymruName returns the origin query name of ip: its reversed
+// octets, or for IPv6 its reversed nibbles, in the origin zone.
+func cymruName(addr netip.Addr) string {
+	var labels []string
+	if addr.Is4() {
+		b := addr.As4()
+		for i := len(b) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(b[i])))
+		}
+		return strings.Join(append(labels, CYMRU_ORIGIN_ZONE), ".")
+	}
+	b := addr.As16()
+	for i := len(b) - 1; i >= 0; i-- {
+		labels = append(labels, strconv.FormatUint(uint64(b[i]&0xf), 16), strconv.FormatUint(uint64(b[i]>>4), 16))
+	}
+	return strings.Join(append(labels, CYMRU_ORIGIN6_ZONE), ".")
+}
+
+// cymruFields splits a Team Cymru TXT answer into its fields.
+func cymruFields(txt string) []string {
+	fields := strings.Split(txt, "|")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields
+}
+
+// parseCymruOrigin returns the AS of the most specific prefix of the
+// answers to an origin query, "15169 | 8.8.8.0/24 | US | arin | 2014-03-14".
+// Prefixes originated by several ASes are attributed to the first.
+func parseCymruOrigin(answers []string) *types.AutonomousSystem {
+	var best *types.AutonomousSystem
+	bestBits := -1
+	for _, answer := range answers {
+		fields := cymruFields(answer)
+		if len(fields) < 3 {
+			continue
+		}
+		origins := strings.Fields(fields[0])
+		if len(origins) == 0 {
+			continue
+		}
+		number, err := strconv.ParseUint(origins[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(fields[1])
+		if err != nil || prefix.Bits() <= bestBits {
+			continue
+		}
+		best = &types.AutonomousSystem{Number: uint32(number), Prefix: prefix.String(), Country: fields[2]}
+		bestBits = prefix.Bits()
+	}
+	return best
+}
+
+// expired returns whether a cache entry is missing or out of date.
+func (e cymruEntry) expired(ok bool, now time.Time) bool {
+	return !ok || now.After(e.expires)
+}
+
+func (c *CymruResolver) lookup(name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	answers, err := c.lookupTXT(ctx, name)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	return answers, err
+}
+
+// LookupASN returns the AS of ip, querying Team Cymru unless it is cached.
+// Lookups which fail are logged and not cached.
+func (c *CymruResolver) LookupASN(ip net.IP) *types.AutonomousSystem {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil
+	}
+	addr = addr.Unmap()
+	key := addr.String()
+	now := time.Now()
+	c.mutex.Lock()
+	entry, ok := c.cache[key]
+	c.mutex.Unlock()
+	if !entry.expired(ok, now) {
+		return entry.as
+	}
+
+	answers, err := c.lookup(cymruName(addr))
+	if err != nil {
+		Warningf("asn: %s: %s\n", key, err)
+		return nil
+	}
+	as := parseCymruOrigin(answers)
+	if as != nil {
+		as.Name = c.asName(as.Number, now)
+	}
+	c.mutex.Lock()
+	c.evict(now)
+	c.cache[key] = cymruEntry{as: as, expires: now.Add(c.TTL)}
+	c.mutex.Unlock()
+	return as
+}
+
+// asName returns the name of an AS, querying Team Cymru unless it is cached,
+// "15169 | US | arin | 2000-03-30 | GOOGLE - Google LLC, US".
+func (c *CymruResolver) asName(number uint32, now time.Time) string {
+	key := fmt.Sprintf("AS%d", number)
+	c.mutex.Lock()
+	entry, ok := c.cache[key]
+	c.mutex.Unlock()
+	if !entry.expired(ok, now) {
+		return entry.as.Name
+	}
+	answers, err := c.lookup(key + "." + CYMRU_ASN_ZONE)
+	if err != nil {
+		Warningf("asn: AS%d: %s\n", number, err)
+		return ""
+	}
+	name := ""
+	for _, answer := range answers {
+		if fields := cymruFields(answer); len(fields) >= 5 {
+			name = fields[4]
+			break
+		}
+	}
+	c.mutex.Lock()
+	c.evict(now)
+	c.cache[key] = cymruEntry{as: &types.AutonomousSystem{Number: number, Name: name}, expires: now.Add(c.TTL)}
+	c.mutex.Unlock()
+	return name
+}
+
+// evict makes room for an entry in a full cache, dropping the expired
+// entries or, if none are, an arbitrary one. The mutex must be held.
+func (c *CymruResolver) evict(now time.Time) {
+	if c.MaxEntries <= 0 || len(c.cache) < c.MaxEntries {
+		return
+	}
+	for key, entry := range c.cache {
+		if now.After(entry.expires) {
+			delete(c.cache, key)
+		}
+	}
+	for key := range c.cache {
+		if len(c.cache) < c.MaxEntries {
+			return
+		}
+		delete(c.cache, key)
+	}
+}
+
+// ASNEnricher annotates both endpoints of attack reports with their
+// autonomous systems before handing the reports on to Logger; connection
+// events are handed on as they are. Lookups, which may query the network,
+// are made by the enricher's own goroutine; should its queue fill,
+// reports are handed on without them rather than held up.
+type ASNEnricher struct {
+	Resolver ASNResolver
+	Logger   AttackLogger
+
+	events   chan *types.Event
+	doneChan chan bool
+}
+
+// NewASNEnricher returns an ASNEnricher of the reports for logger.
+func NewASNEnricher(resolver ASNResolver, logger AttackLogger) *ASNEnricher {
+	return &ASNEnricher{
+		Resolver: resolver,
+		Logger:   logger,
+		events:   make(chan *types.Event, ASN_QUEUE_SIZE),
+		doneChan: make(chan bool),
+	}
+}
+
+func (e *ASNEnricher) Start() {
+	e.Logger.Start()
+	go e.receiveEvents()
+}
+
+// Stop hands on the queued reports and then stops Logger.
+func (e *ASNEnricher) Stop() {
+	close(e.events)
+	<-e.doneChan
+	e.Logger.Stop()
+}
+
+func (e *ASNEnricher) Log(event *types.Event) {
+	select {
+	case e.events <- event:
+	default:
+		e.Logger.Log(event)
+	}
+}
+
+func (e *ASNEnricher) receiveEvents() {
+	for event := range e.events {
+		e.enrich(event)
+		e.Logger.Log(event)
+	}
+	e.doneChan <- true
+}
+
+// enrich looks up the endpoints of an attack report;
+// private and other unroutable addresses are not looked up.
+func (e *ASNEnricher) enrich(event *types.Event) {
+	if detectorOf(event.Type) == "dispatcher" {
+		return
+	}
+	ipFlow, _ := event.Flow.Flows()
+	src, dst := net.IP(ipFlow.Src().Raw()), net.IP(ipFlow.Dst().Raw())
+	if routable(src) {
+		event.SrcAS = e.Resolver.LookupASN(src)
+	}
+	if routable(dst) {
+		event.DstAS = e.Resolver.LookupASN(dst)
+	}
+}
+
+func routable(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
@@ -0,0 +1,167 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+func mrtRecord(subtype uint16, body []byte) []byte {
+	record := make([]byte, 12, 12+len(body))
+	binary.BigEndian.PutUint16(record[4:], MRT_TABLE_DUMP_V2)
+	binary.BigEndian.PutUint16(record[6:], subtype)
+	binary.BigEndian.PutUint32(record[8:], uint32(len(body)))
+	return append(record, body...)
+}
+
+// mrtRIB returns a RIB record of a prefix with one entry for each AS path.
+func mrtRIB(subtype uint16, prefix []byte, bits int, extended bool, paths ...[]uint32) []byte {
+	body := []byte{0, 0, 0, 1, byte(bits)}
+	body = append(body, prefix[:(bits+7)/8]...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(paths)))
+	for _, path := range paths {
+		origin := []byte{0x40, 1, 1, 0} // ORIGIN IGP
+		asPath := []byte{BGP_AS_SEQUENCE, byte(len(path))}
+		for _, asn := range path {
+			asPath = binary.BigEndian.AppendUint32(asPath, asn)
+		}
+		attributes := append(origin, 0x40, BGP_ATTRIBUTE_AS_PATH)
+		if extended {
+			attributes[len(attributes)-2] |= 0x10
+			attributes = binary.BigEndian.AppendUint16(attributes, uint16(len(asPath)))
+		} else {
+			attributes = append(attributes, byte(len(asPath)))
+		}
+		attributes = append(attributes, asPath...)
+		body = append(body, 0, 0, 0, 0, 0, 0)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(attributes)))
+		body = append(body, attributes...)
+	}
+	return mrtRecord(subtype, body)
+}
+
+func TestReadMRT(t *testing.T) {
+	var dump bytes.Buffer
+	dump.Write(mrtRecord(1, []byte{1, 2, 3, 4, 0, 0, 0, 0})) // PEER_INDEX_TABLE
+	dump.Write(mrtRIB(MRT_RIB_IPV4_UNICAST, net.IPv4(8, 0, 0, 0).To4(), 8, false, []uint32{174, 3356}))
+	dump.Write(mrtRIB(MRT_RIB_IPV4_UNICAST, net.IPv4(8, 8, 8, 0).To4(), 24, false, []uint32{3356, 15169}, []uint32{64496}))
+	dump.Write(mrtRIB(MRT_RIB_IPV6_UNICAST, net.ParseIP("2001:db8::"), 32, true, []uint32{64500}))
+
+	table := NewASNTable()
+	if err := table.ReadMRT(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if table.Len() != 3 {
+		t.Fatalf("read %d prefixes, expected 3", table.Len())
+	}
+	tests := []struct {
+		ip     string
+		origin uint32
+		prefix string
+	}{
+		{"8.8.8.8", 15169, "8.8.8.0/24"},
+		{"8.8.4.4", 3356, "8.0.0.0/8"},
+		{"2001:db8::1", 64500, "2001:db8::/32"},
+		{"9.9.9.9", 0, ""},
+	}
+	for _, test := range tests {
+		as := table.LookupASN(net.ParseIP(test.ip))
+		if test.origin == 0 {
+			if as != nil {
+				t.Errorf("%s: found %+v", test.ip, as)
+			}
+			continue
+		}
+		if as == nil || as.Number != test.origin || as.Prefix != test.prefix {
+			t.Errorf("%s: found %+v, expected AS%d %s", test.ip, as, test.origin, test.prefix)
+		}
+	}
+
+	if err := NewASNTable().ReadMRT(bytes.NewReader(mrtRIB(MRT_RIB_IPV4_UNICAST, net.IPv4(8, 0, 0, 0).To4(), 8, false, []uint32{1})[:20])); err == nil {
+		t.Error("truncated dump read")
+	}
+}
+
+func TestCymruResolver(t *testing.T) {
+	answers := map[string][]string{
+		"8.8.8.8.origin.asn.cymru.com": {"15169 | 8.0.0.0/9 | US | arin | 1992-12-01", "15169 | 8.8.8.0/24 | US | arin | 2014-03-14"},
+		"AS15169.asn.cymru.com":        {"15169 | US | arin | 2000-03-30 | GOOGLE - Google LLC, US"},
+	}
+	queries := 0
+	resolver := NewCymruResolver()
+	resolver.lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		queries++
+		if answer, ok := answers[name]; ok {
+			return answer, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	for i := 0; i < 2; i++ {
+		as := resolver.LookupASN(net.ParseIP("8.8.8.8"))
+		expected := types.AutonomousSystem{Number: 15169, Prefix: "8.8.8.0/24", Name: "GOOGLE - Google LLC, US", Country: "US"}
+		if as == nil || *as != expected {
+			t.Fatalf("found %+v, expected %+v", as, expected)
+		}
+	}
+	if queries != 2 {
+		t.Errorf("%d queries, expected 2 with the answers cached", queries)
+	}
+	if as := resolver.LookupASN(net.ParseIP("2001:db8::1")); as != nil {
+		t.Errorf("found %+v for an unrouted address", as)
+	}
+	if name := cymruName(netipAddr(t, "2001:db8::1")); name != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.origin6.asn.cymru.com" {
+		t.Errorf("IPv6 query name %s", name)
+	}
+}
+
+func TestASNEnricher(t *testing.T) {
+	table := NewASNTable()
+	table.Add(netipPrefix(t, "1.2.3.0/24"), 64496)
+	table.Add(netipPrefix(t, "2.3.0.0/16"), 64497)
+	next := &testAttackLogger{}
+	enricher := NewASNEnricher(ASNResolvers{table}, next)
+	enricher.Start()
+	enricher.Log(testReportEvent())
+	private := testReportEvent()
+	ipFlow := gopacket.NewFlow(layers.EndpointIPv4, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(2, 3, 4, 5).To4())
+	_, tcpFlow := private.Flow.Flows()
+	private.Flow = types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	enricher.Log(private)
+	enricher.Stop()
+
+	if !next.started || len(next.events) != 2 {
+		t.Fatalf("started %v, %d reports handed on", next.started, len(next.events))
+	}
+	report := NewAttackReport(next.events[0])
+	if report.Flow.SrcAS == nil || report.Flow.SrcAS.Number != 64496 || report.Flow.DstAS == nil || report.Flow.DstAS.Prefix != "2.3.0.0/16" {
+		t.Errorf("enriched flow %+v", report.Flow)
+	}
+	if next.events[1].SrcAS != nil || next.events[1].DstAS == nil {
+		t.Errorf("private source enriched: %+v %+v", next.events[1].SrcAS, next.events[1].DstAS)
+	}
+}
+
+func netipAddr(t *testing.T, s string) netip.Addr {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func netipPrefix(t *testing.T, s string) netip.Prefix {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefix
+}
@@ -24,9 +24,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/david415/HoneyBadger/types"
-	"io"
-	"os"
-	"path/filepath"
 	"time"
 )
 
@@ -41,20 +38,45 @@ type SerializedEvent struct {
 	Winner                   string
 	Loser                    string
 	Base, Start, End         types.Sequence
+	SampleRate               float64   `json:",omitempty"`
+	Diff                     []DiffRun `json:",omitempty"`
+	Occurrences              uint64    `json:",omitempty"`
+	TLS                      *types.TLSClientHello `json:",omitempty"`
+	Ingress                  *types.Ingress `json:",omitempty"`
+	SrcAS                    *types.AutonomousSystem `json:",omitempty"`
+	DstAS                    *types.AutonomousSystem `json:",omitempty"`
+	Sensor                   *ReportSensor         `json:",omitempty"`
 }
 
 // AttackJsonLogger is responsible for recording all attack reports as JSON objects in a file.
+// The file is named by PathTemplate within the archive directory.
 type AttackJsonLogger struct {
-	writer           io.WriteCloser
 	ArchiveDir       string
+	PathTemplate     string
+	Files            *LogFileWriter
 	stopChan         chan bool
 	attackReportChan chan *types.Event
 }
 
+func init() {
+	AttackLoggerRegister("json", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		a := NewAttackJsonLogger(options.ArchiveDir)
+		a.PathTemplate = options.Param("path", a.PathTemplate)
+		files, err := NewLogFileWriterFromOptions(options)
+		if err != nil {
+			return nil, fmt.Errorf("json: %s", err)
+		}
+		a.Files = files
+		return a, ValidPathTemplate(a.PathTemplate, false)
+	})
+}
+
 // NewAttackJsonLogger returns a pointer to a AttackJsonLogger struct
 func NewAttackJsonLogger(archiveDir string) *AttackJsonLogger {
 	a := AttackJsonLogger{
 		ArchiveDir:       archiveDir,
+		PathTemplate:     ATTACK_LOG_TEMPLATE,
+		Files:            NewLogFileWriter(),
 		stopChan:         make(chan bool),
 		attackReportChan: make(chan *types.Event),
 	}
@@ -70,12 +92,23 @@ func (a *AttackJsonLogger) Stop() {
 }
 
 func (a *AttackJsonLogger) receiveReports() {
+	commit, stopCommits := a.Files.commitTicks()
+	defer stopCommits()
 	for {
 		select {
 		case <-a.stopChan:
+			if err := a.Files.Commit(); err != nil {
+				backendWarningf("json", "%s\n", err)
+			}
 			return
+		case <-commit:
+			if err := a.Files.Commit(); err != nil {
+				backendWarningf("json", "%s\n", err)
+			}
 		case unserializedReport := <-a.attackReportChan:
-			a.SerializeAndWrite(unserializedReport)
+			if err := a.SerializeAndWrite(unserializedReport); err != nil {
+				backendWarningf("json", "%s\n", err)
+			}
 		}
 	}
 }
@@ -84,7 +117,7 @@ func (a *AttackJsonLogger) Log(event *types.Event) {
 	a.attackReportChan <- event
 }
 
-func (a *AttackJsonLogger) SerializeAndWrite(event *types.Event) {
+func (a *AttackJsonLogger) SerializeAndWrite(event *types.Event) error {
 	serialized := &SerializedEvent{
 		Type:         event.Type,
 		PacketCount:  event.PacketCount,
@@ -98,18 +131,24 @@ func (a *AttackJsonLogger) SerializeAndWrite(event *types.Event) {
 		Base:         event.Base,
 		Start:        event.Start,
 		End:          event.End,
+		SampleRate:   event.SampleRate,
+		Diff:         eventDiff(event),
+		Occurrences:  event.Occurrences,
+		TLS:          event.TLS,
+		Ingress:      event.Ingress,
+		SrcAS:        event.SrcAS,
+		DstAS:        event.DstAS,
+		Sensor:       reportSensor(),
 	}
-	a.Publish(serialized)
+	return a.Publish(serialized)
 }
 
 // Publish writes a JSON report to the attack-report file for that flow.
-func (a *AttackJsonLogger) Publish(event *SerializedEvent) {
+func (a *AttackJsonLogger) Publish(event *SerializedEvent) error {
 	b, err := json.Marshal(event)
-	logName := filepath.Join(a.ArchiveDir, fmt.Sprintf("%s.attackreport.json", event.Flow))
-	a.writer, err = os.OpenFile(logName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	logName := ExpandPathTemplate(a.ArchiveDir, a.PathTemplate, event.Flow, event.Type, event.Time)
 	if err != nil {
-		panic(fmt.Sprintf("error opening file: %v", err))
+		return err
 	}
-	defer a.writer.Close()
-	a.writer.Write([]byte(fmt.Sprintf("%s\n", string(b))))
+	return a.Files.Append(logName, append(b, '\n'))
 }
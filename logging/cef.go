@@ -0,0 +1,154 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	DEVICE_VENDOR  = "HoneyBadger"
+	DEVICE_PRODUCT = "HoneyBadger"
+	DEVICE_VERSION = "1.0"
+)
+
+// detectorSeverities is the 0 to 10 SIEM severity of the reports of each detector.
+var detectorSeverities = map[string]int{
+	"handshake":          8,
+	"injection":          9,
+	"coalesce-injection": 9,
+	"censorship":         7,
+	"dispatcher":         3,
+}
+
+func reportSeverity(detector string) int {
+	if severity, ok := detectorSeverities[detector]; ok {
+		return severity
+	}
+	return 5
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+	leefEscaper         = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ", "|", " ")
+)
+
+// reportFields returns the key/value pairs common to the CEF and LEEF
+// records of a report, keyed by CEF extension key.
+func reportFields(report *AttackReport) [][2]string {
+	fields := [][2]string{
+		{"rt", fmt.Sprintf("%d", report.Time.UnixNano()/1e6)},
+		{"src", report.Flow.SrcIP},
+		{"spt", fmt.Sprintf("%d", report.Flow.SrcPort)},
+		{"dst", report.Flow.DstIP},
+		{"dpt", fmt.Sprintf("%d", report.Flow.DstPort)},
+		{"proto", "TCP"},
+		{"cnt", fmt.Sprintf("%d", report.PacketCount)},
+		{"cat", report.Detector},
+		{"dvchost", report.Sensor.ID},
+	}
+	if report.Sensor.Site != "" {
+		fields = append(fields,
+			[2]string{"cs3Label", "site"}, [2]string{"cs3", report.Sensor.Site})
+	}
+	if len(report.Sensor.Tags) > 0 {
+		fields = append(fields,
+			[2]string{"cs4Label", "sensorTags"}, [2]string{"cs4", formatSensorTags(report.Sensor.Tags)})
+	}
+	if report.Hijack != nil {
+		fields = append(fields,
+			[2]string{"cn1Label", "hijackSeq"}, [2]string{"cn1", fmt.Sprintf("%d", report.Hijack.Seq)},
+			[2]string{"cn2Label", "hijackAck"}, [2]string{"cn2", fmt.Sprintf("%d", report.Hijack.Ack)})
+	}
+	if report.Sequence != nil {
+		fields = append(fields,
+			[2]string{"cs1Label", "sequenceRange"},
+			[2]string{"cs1", fmt.Sprintf("%d-%d", report.Sequence.Start, report.Sequence.End)})
+	}
+	if report.TLS != nil {
+		if report.TLS.ServerName != "" {
+			fields = append(fields, [2]string{"dhost", report.TLS.ServerName})
+		}
+		fields = append(fields,
+			[2]string{"cs2Label", "ja3"}, [2]string{"cs2", report.TLS.JA3Hash})
+	}
+	if report.Ingress != nil {
+		if report.Ingress.Interface != "" {
+			fields = append(fields, [2]string{"deviceInboundInterface", report.Ingress.Interface})
+		}
+		if len(report.Ingress.VLANs) > 0 {
+			vlans := make([]string, len(report.Ingress.VLANs))
+			for i, vlan := range report.Ingress.VLANs {
+				vlans[i] = fmt.Sprintf("%d", vlan)
+			}
+			fields = append(fields,
+				[2]string{"cs5Label", "vlan"}, [2]string{"cs5", strings.Join(vlans, ",")})
+		}
+		if report.Ingress.Tunnel != "" {
+			fields = append(fields,
+				[2]string{"cs6Label", "tunnel"},
+				[2]string{"cs6", fmt.Sprintf("%s %d %s>%s", report.Ingress.Tunnel, report.Ingress.TunnelID,
+					report.Ingress.TunnelSrc, report.Ingress.TunnelDst)})
+		}
+	}
+	return fields
+}
+
+// FormatCEF renders an attack report as an ArcSight Common Event Format record.
+func FormatCEF(event *types.Event) ([]byte, error) {
+	report := NewAttackReport(event)
+	record := fmt.Sprintf("CEF:0|%s|%s|%s|%s|%s|%d|",
+		cefHeaderEscaper.Replace(DEVICE_VENDOR), cefHeaderEscaper.Replace(DEVICE_PRODUCT),
+		cefHeaderEscaper.Replace(DEVICE_VERSION), cefHeaderEscaper.Replace(report.Type),
+		cefHeaderEscaper.Replace(report.Type), reportSeverity(report.Detector))
+	var extension []string
+	for _, field := range reportFields(report) {
+		extension = append(extension, field[0]+"="+cefExtensionEscaper.Replace(field[1]))
+	}
+	return []byte(record + strings.Join(extension, " ")), nil
+}
+
+// leefKeys renames the CEF keys which differ in LEEF.
+var leefKeys = map[string]string{
+	"rt":  "devTime",
+	"spt": "srcPort",
+	"dpt": "dstPort",
+}
+
+// FormatLEEF renders an attack report as a QRadar Log Event Extended Format 1.0 record.
+func FormatLEEF(event *types.Event) ([]byte, error) {
+	report := NewAttackReport(event)
+	record := fmt.Sprintf("LEEF:1.0|%s|%s|%s|%s|",
+		leefEscaper.Replace(DEVICE_VENDOR), leefEscaper.Replace(DEVICE_PRODUCT),
+		leefEscaper.Replace(DEVICE_VERSION), leefEscaper.Replace(report.Type))
+	attributes := []string{fmt.Sprintf("sev=%d", reportSeverity(report.Detector))}
+	for _, field := range reportFields(report) {
+		key := field[0]
+		if renamed, ok := leefKeys[key]; ok {
+			key = renamed
+		}
+		attributes = append(attributes, key+"="+leefEscaper.Replace(field[1]))
+	}
+	return []byte(record + strings.Join(attributes, "\t")), nil
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func testReportEvent() *types.Event {
+	ipFlow := gopacket.NewFlow(layers.EndpointIPv4, net.IPv4(1, 2, 3, 4).To4(), net.IPv4(2, 3, 4, 5).To4())
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(1), layers.NewTCPPortEndpoint(2))
+	return &types.Event{
+		Type:      "handshake-hijack",
+		Time:      time.Unix(1, 0),
+		Flow:      types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow),
+		HijackSeq: 7,
+		HijackAck: 9,
+	}
+}
+
+func TestFormatCEF(t *testing.T) {
+	sensor, site, tags := Sensor, Site, SensorTags
+	Sensor, Site, SensorTags = "sensor1", "dc1", map[string]string{"rack": "4", "env": "prod"}
+	defer func() { Sensor, Site, SensorTags = sensor, site, tags }()
+
+	record, err := FormatCEF(testReportEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "CEF:0|HoneyBadger|HoneyBadger|1.0|handshake-hijack|handshake-hijack|8|rt=1000 src=1.2.3.4 spt=1 dst=2.3.4.5 dpt=2 proto=TCP cnt=0 cat=handshake dvchost=sensor1 cs3Label=site cs3=dc1 cs4Label=sensorTags cs4=env\\=prod,rack\\=4 cn1Label=hijackSeq cn1=7 cn2Label=hijackAck cn2=9"
+	if string(record) != want {
+		t.Errorf("got %q, want %q", record, want)
+	}
+	if escaped := cefExtensionEscaper.Replace(`a=b\c`); escaped != `a\=b\\c` {
+		t.Errorf("extension value escaped as %q", escaped)
+	}
+
+	event := testReportEvent()
+	event.TLS = &types.TLSClientHello{ServerName: "example.com", JA3Hash: "0123"}
+	record, err = FormatCEF(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(record), " dhost=example.com cs2Label=ja3 cs2=0123") {
+		t.Errorf("TLS ClientHello missing from %q", record)
+	}
+}
+
+func TestFormatLEEF(t *testing.T) {
+	record, err := FormatLEEF(testReportEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Split(string(record), "\t")
+	if fields[0] != "LEEF:1.0|HoneyBadger|HoneyBadger|1.0|handshake-hijack|sev=8" {
+		t.Errorf("unexpected LEEF header %q", fields[0])
+	}
+	if fields[1] != "devTime=1000" || fields[3] != "srcPort=1" {
+		t.Errorf("unexpected LEEF attributes %q", fields)
+	}
+}
@@ -0,0 +1,184 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CHAIN_EXTENSION is appended to the name of a log file to name its chain,
+// the file of links making the log file's records tamper evident.
+const CHAIN_EXTENSION = ".chain"
+
+// A chain link is the line "<offset> <length> <hash> <mac>" recording
+// where in the log file a record was written, the hex SHA-256 of the
+// previous link's hash followed by the record, and the hex HMAC-SHA256 of
+// that hash under the chain key. A record cannot be modified, removed or
+// inserted without breaking every later link, nor the links be rebuilt
+// without the key.
+
+// chainLink returns the hash and MAC linking a record to the previous hash.
+func chainLink(key, previous, record []byte) ([]byte, []byte) {
+	h := sha256.New()
+	h.Write(previous)
+	h.Write(record)
+	hash := h.Sum(nil)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(hash)
+	return hash, mac.Sum(nil)
+}
+
+func formatChainLink(offset int64, length int, hash, mac []byte) []byte {
+	return []byte(fmt.Sprintf("%d %d %x %x\n", offset, length, hash, mac))
+}
+
+// parseChainLink parses a chain link line without its newline.
+func parseChainLink(line string) (offset int64, length int, hash, mac []byte, err error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return 0, 0, nil, nil, fmt.Errorf("malformed link %q", line)
+	}
+	if offset, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return
+	}
+	if length, err = strconv.Atoi(fields[1]); err != nil {
+		return
+	}
+	if hash, err = hex.DecodeString(fields[2]); err != nil {
+		return
+	}
+	mac, err = hex.DecodeString(fields[3])
+	return
+}
+
+// lastChainHash returns the hash of the last link of a chain
+// file or nil if it does not exist or is empty.
+func lastChainHash(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	// a link is well within a kilobyte
+	start := size - 1024
+	if start < 0 {
+		start = 0
+	}
+	tail := make([]byte, size-start)
+	if _, err := f.ReadAt(tail, start); err != nil {
+		return nil, err
+	}
+	lines := bytes.Split(bytes.TrimRight(tail, "\n"), []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		return nil, nil
+	}
+	_, _, hash, _, err := parseChainLink(string(lines[len(lines)-1]))
+	if err != nil {
+		return nil, fmt.Errorf("chain %s: %s", name, err)
+	}
+	return hash, nil
+}
+
+// ReadChainKey reads a chain key from a file, ignoring surrounding whitespace.
+func ReadChainKey(name string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(contents)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("chain key file %s is empty", name)
+	}
+	return key, nil
+}
+
+// VerifyReportChain verifies the records of a log file against its chain
+// with the given key and returns the number of records verified. It fails
+// on the first record which was modified, removed or inserted, on a link
+// not made with the key and on records appended without a link. Records
+// written before the chain was started are not covered.
+func VerifyReportChain(name string, key []byte) (int, error) {
+	log, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer log.Close()
+	chain, err := os.Open(name + CHAIN_EXTENSION)
+	if err != nil {
+		return 0, err
+	}
+	defer chain.Close()
+
+	var previous []byte
+	next := int64(-1)
+	count := 0
+	scanner := bufio.NewScanner(chain)
+	for scanner.Scan() {
+		offset, length, hash, mac, err := parseChainLink(scanner.Text())
+		if err != nil {
+			return count, fmt.Errorf("link %d: %s", count+1, err)
+		}
+		if next >= 0 && offset != next {
+			return count, fmt.Errorf("record %d at offset %d: expected at offset %d", count+1, offset, next)
+		}
+		record := make([]byte, length)
+		if _, err := log.ReadAt(record, offset); err != nil {
+			return count, fmt.Errorf("record %d at offset %d: %s", count+1, offset, err)
+		}
+		expectedHash, expectedMAC := chainLink(key, previous, record)
+		if !hmac.Equal(hash, expectedHash) {
+			return count, fmt.Errorf("record %d at offset %d: modified", count+1, offset)
+		}
+		if !hmac.Equal(mac, expectedMAC) {
+			return count, fmt.Errorf("record %d at offset %d: link not signed with the key", count+1, offset)
+		}
+		previous = hash
+		next = offset + int64(length)
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+	info, err := log.Stat()
+	if err != nil {
+		return count, err
+	}
+	if next >= 0 && info.Size() != next {
+		return count, fmt.Errorf("%d bytes after record %d are not in the chain", info.Size()-next, count)
+	}
+	return count, nil
+}
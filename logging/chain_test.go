@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReportChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reportChain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := []byte("secret")
+	name := filepath.Join(dir, "attacks.json")
+	// records written before the chain was started are not covered
+	if err := ioutil.WriteFile(name, []byte("unchained\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := NewLogFileWriter()
+	w.ChainKey = key
+	for _, record := range []string{"one\n", "two\n", "three\n"} {
+		if err := w.Append(name, []byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a restarted writer continues the chain
+	w = NewLogFileWriter()
+	w.ChainKey = key
+	if err := w.Append(name, []byte("four\n")); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := VerifyReportChain(name, key); err != nil || count != 4 {
+		t.Fatalf("verified %d records: %v", count, err)
+	}
+	if _, err := VerifyReportChain(name, []byte("guess")); err == nil {
+		t.Error("chain verified with the wrong key")
+	}
+
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tampered := range []string{
+		strings.Replace(string(contents), "two", "TWO", 1),
+		strings.Replace(string(contents), "two\n", "", 1),
+		string(contents) + "five\n",
+	} {
+		if err := ioutil.WriteFile(name, []byte(tampered), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifyReportChain(name, key); err == nil {
+			t.Errorf("tampered log %q verified", tampered)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// reportConfidence returns how likely a report is a real attack rather than
+// a misbehaving network, following the severities of the detectors.
+func reportConfidence(detector string) string {
+	switch severity := reportSeverity(detector); {
+	case severity >= 8:
+		return "high"
+	case severity >= 6:
+		return "medium"
+	}
+	return "low"
+}
+
+// ChatAttackLogger posts a short summary of each attack report to a Slack
+// or Mattermost incoming webhook. Posts are rate limited to Rate per minute
+// with bursts of up to Burst; reports arriving while the limit is reached
+// are counted by type and summarized in a single post once it allows.
+//
+// If EvidenceURL is set it is linked from each post with {flow} and {type}
+// replaced by the flow and type of the report, for instance to point at
+// the archived pcap files of the flow.
+type ChatAttackLogger struct {
+	URL         string
+	Channel     string
+	Username    string
+	EvidenceURL string
+	Rate        int
+	Burst       int
+	Client      *http.Client
+
+	tokens           float64
+	refilled         time.Time
+	suppressed       map[string]int
+	stopChan         chan bool
+	attackReportChan chan *types.Event
+}
+
+// chatMessage is the incoming webhook payload accepted by both Slack and Mattermost.
+type chatMessage struct {
+	Text     string `json:"text"`
+	Channel  string `json:"channel,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+func init() {
+	for _, name := range []string{"slack", "mattermost"} {
+		AttackLoggerRegister(name, func(options *AttackLoggerOptions) (AttackLogger, error) {
+			return NewChatAttackLoggerFromOptions(options)
+		})
+	}
+}
+
+// NewChatAttackLogger returns a pointer to a ChatAttackLogger struct posting to url.
+func NewChatAttackLogger(url string) *ChatAttackLogger {
+	return &ChatAttackLogger{
+		URL:              url,
+		Username:         "HoneyBadger",
+		Rate:             6,
+		Burst:            3,
+		Client:           &http.Client{Timeout: 10 * time.Second},
+		suppressed:       make(map[string]int),
+		stopChan:         make(chan bool),
+		attackReportChan: make(chan *types.Event, 100),
+	}
+}
+
+// NewChatAttackLoggerFromOptions returns a ChatAttackLogger configured by the
+// backend parameters url, channel, username, evidence_url, rate, burst and timeout.
+func NewChatAttackLoggerFromOptions(options *AttackLoggerOptions) (*ChatAttackLogger, error) {
+	c := NewChatAttackLogger(options.Param("url", ""))
+	if c.URL == "" {
+		return nil, fmt.Errorf("chat: no webhook url given")
+	}
+	c.Channel = options.Param("channel", "")
+	c.Username = options.Param("username", c.Username)
+	c.EvidenceURL = options.Param("evidence_url", "")
+	var err error
+	if c.Rate, err = strconv.Atoi(options.Param("rate", strconv.Itoa(c.Rate))); err != nil || c.Rate <= 0 {
+		return nil, fmt.Errorf("chat: invalid rate: %s", options.Param("rate", ""))
+	}
+	if c.Burst, err = strconv.Atoi(options.Param("burst", strconv.Itoa(c.Burst))); err != nil || c.Burst <= 0 {
+		return nil, fmt.Errorf("chat: invalid burst: %s", options.Param("burst", ""))
+	}
+	if c.Client.Timeout, err = time.ParseDuration(options.Param("timeout", c.Client.Timeout.String())); err != nil {
+		return nil, fmt.Errorf("chat: invalid timeout: %s", err)
+	}
+	return c, nil
+}
+
+func (c *ChatAttackLogger) Start() {
+	c.tokens = float64(c.Burst)
+	c.refilled = time.Now()
+	go c.receiveReports()
+}
+
+func (c *ChatAttackLogger) Stop() {
+	c.stopChan <- true
+}
+
+// Log queues a report to be posted; reports are dropped rather than
+// holding up the detectors if the webhook falls far behind.
+func (c *ChatAttackLogger) Log(event *types.Event) {
+	select {
+	case c.attackReportChan <- event:
+	default:
+		backendWarningf("chat", "queue full, report dropped\n")
+	}
+}
+
+func (c *ChatAttackLogger) receiveReports() {
+	ticker := time.NewTicker(time.Minute / time.Duration(c.Rate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopChan:
+			return
+		case <-ticker.C:
+			if len(c.suppressed) > 0 && c.allow(time.Now()) {
+				c.post(c.Summary())
+			}
+		case event := <-c.attackReportChan:
+			if len(c.suppressed) == 0 && c.allow(time.Now()) {
+				c.post(c.Message(event))
+			} else {
+				c.suppressed[event.Type]++
+			}
+		}
+	}
+}
+
+// allow reports whether the rate limit allows a post at the given time,
+// taking a token from the bucket if it does.
+func (c *ChatAttackLogger) allow(now time.Time) bool {
+	c.tokens += now.Sub(c.refilled).Minutes() * float64(c.Rate)
+	c.refilled = now
+	if c.tokens > float64(c.Burst) {
+		c.tokens = float64(c.Burst)
+	}
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+// Message returns the text posted for a report.
+func (c *ChatAttackLogger) Message(event *types.Event) string {
+	report := NewAttackReport(event)
+	text := fmt.Sprintf(":rotating_light: *%s* detected by the %s detector (%s confidence)\nflow `%s:%d -> %s:%d` at %s, %d packets",
+		report.Type, report.Detector, reportConfidence(report.Detector),
+		report.Flow.SrcIP, report.Flow.SrcPort, report.Flow.DstIP, report.Flow.DstPort,
+		report.Time.UTC().Format(time.RFC3339), report.PacketCount)
+	if c.EvidenceURL != "" {
+		link := strings.NewReplacer("{flow}", url.PathEscape(event.Flow.String()), "{type}", url.PathEscape(event.Type)).Replace(c.EvidenceURL)
+		text += fmt.Sprintf("\n<%s|evidence>", link)
+	}
+	return text
+}
+
+// Summary returns the text posted for the suppressed reports and resets their counts.
+func (c *ChatAttackLogger) Summary() string {
+	eventTypes := make([]string, 0, len(c.suppressed))
+	total := 0
+	for eventType, count := range c.suppressed {
+		eventTypes = append(eventTypes, eventType)
+		total += count
+	}
+	sort.Strings(eventTypes)
+	counts := make([]string, len(eventTypes))
+	for i, eventType := range eventTypes {
+		counts[i] = fmt.Sprintf("%d %s", c.suppressed[eventType], eventType)
+	}
+	c.suppressed = make(map[string]int)
+	return fmt.Sprintf(":rotating_light: %d more attack reports: %s", total, strings.Join(counts, ", "))
+}
+
+func (c *ChatAttackLogger) post(text string) {
+	body, err := json.Marshal(chatMessage{
+		Text:     text,
+		Channel:  c.Channel,
+		Username: c.Username,
+	})
+	if err != nil {
+		backendWarningf("chat", "%s\n", err)
+		return
+	}
+	response, err := c.Client.Post(c.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		backendWarningf("chat", "%s\n", err)
+		return
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode >= 300 {
+		backendWarningf("chat", "webhook returned %s\n", response.Status)
+	}
+}
@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChatAttackLogger(t *testing.T) {
+	posts := make(chan chatMessage, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message chatMessage
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			t.Error(err)
+		}
+		posts <- message
+	}))
+	defer server.Close()
+
+	logger, err := NewChatAttackLoggerFromOptions(&AttackLoggerOptions{
+		Params: map[string]string{
+			"url":          server.URL,
+			"channel":      "#security",
+			"evidence_url": "https://archive.example/{flow}.pcap",
+			"rate":         "1",
+			"burst":        "1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	logger.refilled = now
+	logger.tokens = 1
+	if !logger.allow(now) || logger.allow(now.Add(time.Second)) || !logger.allow(now.Add(time.Minute)) {
+		t.Error("rate limit not applied")
+	}
+
+	logger.post(logger.Message(testReportEvent()))
+	message := <-posts
+	if message.Channel != "#security" || message.Username != "HoneyBadger" {
+		t.Errorf("unexpected message %+v", message)
+	}
+	for _, part := range []string{"*handshake-hijack*", "handshake detector (high confidence)", "1.2.3.4:1 -> 2.3.4.5:2", "<https://archive.example/1.2.3.4:1-2.3.4.5:2.pcap|evidence>"} {
+		if !strings.Contains(message.Text, part) {
+			t.Errorf("message %q does not contain %q", message.Text, part)
+		}
+	}
+
+	logger.suppressed["injection"] = 2
+	logger.suppressed["handshake-hijack"] = 1
+	if summary := logger.Summary(); !strings.HasSuffix(summary, "3 more attack reports: 1 handshake-hijack, 2 injection") {
+		t.Errorf("unexpected summary %q", summary)
+	}
+	if len(logger.suppressed) != 0 {
+		t.Error("suppressed counts not reset")
+	}
+}
@@ -0,0 +1,537 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// GRPC_COLLECT_METHOD is the path of the client streaming method
+	// Collect of the honeybadger.Collector service in honeybadger.proto.
+	GRPC_COLLECT_METHOD = "/honeybadger.Collector/Collect"
+
+	// COLLECTOR_WINDOW is how long after an attack was first reported
+	// the same attack reported by other sensors is taken as a sighting of it.
+	COLLECTOR_WINDOW = time.Minute
+
+	// COLLECTOR_ATTACKS is the number of attacks a Collector keeps by default.
+	COLLECTOR_ATTACKS = 10000
+
+	// COLLECTOR_MAX_REPORT is the size of the largest report
+	// a Collector accepts posted to /api/v1/reports.
+	COLLECTOR_MAX_REPORT = 16 << 20
+)
+
+// CollectedAttack is an attack as a Collector aggregates it: the report
+// of the sensor which reported it first and a sighting by each sensor
+// which reported it.
+type CollectedAttack struct {
+	Report    *AttackReport       `json:"report"`
+	Sightings []CollectorSighting `json:"sightings"`
+
+	event *types.Event
+	key   string
+}
+
+// CollectorSighting is a sensor reporting an attack.
+type CollectorSighting struct {
+	Sensor *ReportSensor `json:"sensor"`
+	Time   time.Time     `json:"time"`
+}
+
+// CollectorSensor is a sensor which streamed events to a Collector.
+type CollectorSensor struct {
+	Sensor   *ReportSensor `json:"sensor"`
+	LastSeen time.Time     `json:"last_seen"`
+	Events   uint64        `json:"events"`
+	Attacks  uint64        `json:"attacks"`
+}
+
+// Collector is the aggregation point of many sensors: an http.Handler
+// serving the honeybadger.Collector gRPC service, which the sensors'
+// collector attack loggers stream their events to, and a REST API of
+// the aggregate:
+//
+//	GET /api/v1/attacks   the attacks collected, most recent first
+//	GET /api/v1/sensors   the sensors which streamed events
+//	POST /api/v1/reports  collects the honeybadger.Event message posted,
+//	                      as the sensors' spool attack loggers upload them
+//
+// The attacks may be selected with the query parameters type, net and
+// flow, as those of a sensor's API, sensor, the ID of a sensor which
+// sighted them, and limit.
+//
+// The same attack reported by several sensors, the same flow, type
+// and sequence range within Window of the first report, is collected
+// once with a sighting by each sensor. Only the first report of an
+// attack is handed to Logger, if it is set, to be stored; the backends
+// record it as reported by the collector. The most recent Size attacks
+// are kept for the API.
+type Collector struct {
+	Window time.Duration
+	Size   int
+	Logger AttackLogger
+
+	mutex   sync.Mutex
+	attacks []*CollectedAttack
+	index   map[string]*CollectedAttack
+	sensors map[string]*CollectorSensor
+}
+
+// NewCollector returns a pointer to a Collector struct handing the
+// attacks it collects to logger, which may be nil.
+func NewCollector(logger AttackLogger) *Collector {
+	return &Collector{
+		Window:  COLLECTOR_WINDOW,
+		Size:    COLLECTOR_ATTACKS,
+		Logger:  logger,
+		index:   make(map[string]*CollectedAttack),
+		sensors: make(map[string]*CollectorSensor),
+	}
+}
+
+// ListenAndServeTLS serves the collector on addr until it fails. If
+// clientCAFile is set, sensors must present a certificate it signed.
+func (c *Collector) ListenAndServeTLS(addr, certFile, keyFile, clientCAFile string) error {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: c,
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", filename)
+	}
+	return pool, nil
+}
+
+// collectorKey identifies an attack across sensors: its type,
+// its flow regardless of direction and its sequence range.
+func collectorKey(event *types.Event) string {
+	flow := event.Flow.String()
+	if reverse := event.Flow.Reverse(); reverse.String() < flow {
+		flow = reverse.String()
+	}
+	return fmt.Sprintf("%s|%s|%d|%d|%d", event.Type, flow, event.Start, event.End, event.HijackSeq)
+}
+
+// Collect aggregates an event streamed by sensor;
+// connection events only count towards the sensor's events.
+func (c *Collector) Collect(event *types.Event, sensor *ReportSensor) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	known, ok := c.sensors[sensor.ID]
+	if !ok {
+		known = &CollectorSensor{}
+		c.sensors[sensor.ID] = known
+	}
+	known.Sensor = sensor
+	known.LastSeen = time.Now()
+	known.Events++
+	if detectorOf(event.Type) == "dispatcher" {
+		return
+	}
+	known.Attacks++
+
+	sighting := CollectorSighting{Sensor: sensor, Time: event.Time}
+	key := collectorKey(event)
+	if attack, ok := c.index[key]; ok && event.Time.Sub(attack.event.Time) < c.Window {
+		for _, seen := range attack.Sightings {
+			if seen.Sensor.ID == sensor.ID {
+				return
+			}
+		}
+		attack.Sightings = append(attack.Sightings, sighting)
+		return
+	}
+	report := NewAttackReport(event)
+	report.Sensor = sensor
+	attack := &CollectedAttack{
+		Report:    report,
+		Sightings: []CollectorSighting{sighting},
+		event:     event,
+		key:       key,
+	}
+	c.index[key] = attack
+	c.attacks = append(c.attacks, attack)
+	if c.Size > 0 && len(c.attacks) > c.Size {
+		oldest := c.attacks[0]
+		c.attacks = c.attacks[1:]
+		if c.index[oldest.key] == oldest {
+			delete(c.index, oldest.key)
+		}
+	}
+	if c.Logger != nil {
+		c.Logger.Log(event)
+	}
+}
+
+// Attacks returns the collected attacks the query selects, most recent
+// first; if sensor is set, only those it sighted.
+func (c *Collector) Attacks(query AttackQuery, sensor string) []CollectedAttack {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var attacks []CollectedAttack
+	for i := len(c.attacks) - 1; i >= 0; i-- {
+		attack := c.attacks[i]
+		if !query.Matches(attack.event) || !attack.sightedBy(sensor) {
+			continue
+		}
+		copied := *attack
+		copied.Sightings = append([]CollectorSighting(nil), attack.Sightings...)
+		attacks = append(attacks, copied)
+		if query.Limit > 0 && len(attacks) == query.Limit {
+			break
+		}
+	}
+	return attacks
+}
+
+func (a *CollectedAttack) sightedBy(sensor string) bool {
+	if sensor == "" {
+		return true
+	}
+	for _, sighting := range a.Sightings {
+		if sighting.Sensor.ID == sensor {
+			return true
+		}
+	}
+	return false
+}
+
+// Sensors returns the sensors which streamed events to the collector.
+func (c *Collector) Sensors() []CollectorSensor {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	sensors := make([]CollectorSensor, 0, len(c.sensors))
+	for _, sensor := range c.sensors {
+		sensors = append(sensors, *sensor)
+	}
+	return sensors
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && r.URL.Path == "/api/v1/reports" {
+		c.serveReport(w, r)
+		return
+	}
+	if r.Method == "POST" {
+		c.serveCollect(w, r)
+		return
+	}
+	switch r.URL.Path {
+	case "/api/v1/attacks":
+		values := r.URL.Query()
+		filter, err := ParseEventFilter(values["type"], values["net"])
+		query := AttackQuery{Filter: filter, Flow: values.Get("flow")}
+		if err == nil && values.Get("limit") != "" {
+			query.Limit, err = strconv.Atoi(values.Get("limit"))
+		}
+		if err != nil {
+			collectorResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		attacks := c.Attacks(query, values.Get("sensor"))
+		if attacks == nil {
+			attacks = []CollectedAttack{}
+		}
+		collectorResponse(w, http.StatusOK, attacks)
+	case "/api/v1/sensors":
+		collectorResponse(w, http.StatusOK, c.Sensors())
+	default:
+		collectorResponse(w, http.StatusNotFound, map[string]string{"error": "no such resource " + r.URL.Path})
+	}
+}
+
+func collectorResponse(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// serveReport collects the event of a honeybadger.Event message a
+// sensor's spool attack logger uploads.
+func (c *Collector) serveReport(w http.ResponseWriter, r *http.Request) {
+	message, err := ioutil.ReadAll(io.LimitReader(r.Body, COLLECTOR_MAX_REPORT+1))
+	if err == nil && len(message) > COLLECTOR_MAX_REPORT {
+		err = fmt.Errorf("report exceeds %d bytes", COLLECTOR_MAX_REPORT)
+	}
+	var event *types.Event
+	var sensor *ReportSensor
+	if err == nil {
+		event, sensor, err = DecodeEventProto(message)
+	}
+	if err != nil {
+		collectorResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	c.Collect(event, sensor)
+	collectorResponse(w, http.StatusOK, map[string]int{"received": 1})
+}
+
+// serveCollect receives the events a sensor streams until it ends the call.
+func (c *Collector) serveCollect(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2 POST requests", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	if r.URL.Path != GRPC_COLLECT_METHOD {
+		w.WriteHeader(http.StatusOK)
+		WriteGRPCStatus(w, GRPC_UNIMPLEMENTED, "unknown method "+r.URL.Path)
+		return
+	}
+	received := uint64(0)
+	for {
+		message, err := ReadGRPCMessage(r.Body)
+		if err == io.EOF {
+			break
+		}
+		var event *types.Event
+		var sensor *ReportSensor
+		if err == nil {
+			event, sensor, err = DecodeEventProto(message)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusOK)
+			WriteGRPCStatus(w, GRPC_INVALID_ARGUMENT, err.Error())
+			return
+		}
+		c.Collect(event, sensor)
+		received++
+	}
+	w.WriteHeader(http.StatusOK)
+	var response protoEncoder
+	response.uint64(1, received)
+	WriteGRPCMessage(w, response.b)
+	WriteGRPCStatus(w, 0, "")
+}
+
+// CollectorAttackLogger streams the attack reports and connection events
+// it is handed to a Collector over a Collect call held open, which is
+// reopened after Backoff if it fails. Events are queued, as many as
+// fit in its queue, while it is not connected; those arriving at a full
+// queue are dropped and counted.
+type CollectorAttackLogger struct {
+	URL     string
+	Client  *http.Client
+	Backoff time.Duration
+
+	queue    chan []byte
+	stopChan chan bool
+	dropped  int
+	wg       sync.WaitGroup
+}
+
+func init() {
+	AttackLoggerRegister("collector", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewCollectorAttackLoggerFromOptions(options)
+	})
+}
+
+// NewCollectorAttackLogger returns a pointer to a CollectorAttackLogger
+// struct streaming to the collector at url with a queue of the given size.
+func NewCollectorAttackLogger(url string, queue int) *CollectorAttackLogger {
+	return &CollectorAttackLogger{
+		URL:      url,
+		Client:   &http.Client{Transport: &http.Transport{ForceAttemptHTTP2: true}},
+		Backoff:  5 * time.Second,
+		queue:    make(chan []byte, queue),
+		stopChan: make(chan bool),
+	}
+}
+
+// NewCollectorAttackLoggerFromOptions returns a CollectorAttackLogger
+// configured by the backend parameters url, the https URL of the
+// collector, ca, the file of the certificate authority its certificate
+// is verified with instead of the system's, cert and key, the files of
+// the sensor's client certificate, queue and backoff.
+func NewCollectorAttackLoggerFromOptions(options *AttackLoggerOptions) (*CollectorAttackLogger, error) {
+	url := options.Param("url", "")
+	if url == "" {
+		return nil, fmt.Errorf("collector: no url given")
+	}
+	queue, err := strconv.Atoi(options.Param("queue", "10000"))
+	if err != nil {
+		return nil, fmt.Errorf("collector: invalid queue: %s", err)
+	}
+	c := NewCollectorAttackLogger(url, queue)
+	if c.Backoff, err = time.ParseDuration(options.Param("backoff", c.Backoff.String())); err != nil {
+		return nil, fmt.Errorf("collector: invalid backoff: %s", err)
+	}
+	config, err := clientTLSConfig(options)
+	if err != nil {
+		return nil, fmt.Errorf("collector: %s", err)
+	}
+	c.Client.Transport.(*http.Transport).TLSClientConfig = config
+	return c, nil
+}
+
+// clientTLSConfig returns the TLS configuration of a sensor connecting to
+// a collector given by the backend parameters ca, the file of the
+// certificate authority the collector's certificate is verified with
+// instead of the system's, and cert and key, the files of the sensor's
+// client certificate.
+func clientTLSConfig(options *AttackLoggerOptions) (*tls.Config, error) {
+	config := &tls.Config{}
+	if ca := options.Param("ca", ""); ca != "" {
+		var err error
+		if config.RootCAs, err = loadCertPool(ca); err != nil {
+			return nil, err
+		}
+	}
+	cert, key := options.Param("cert", ""), options.Param("key", "")
+	if cert != "" || key != "" {
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+func (c *CollectorAttackLogger) Start() {
+	c.wg.Add(1)
+	go c.stream()
+}
+
+// Stop streams the queued events, unless the collector cannot be
+// reached, and ends the call.
+func (c *CollectorAttackLogger) Stop() {
+	close(c.stopChan)
+	close(c.queue)
+	c.wg.Wait()
+}
+
+func (c *CollectorAttackLogger) Log(event *types.Event) {
+	select {
+	case c.queue <- EncodeEventProto(event):
+	default:
+		c.dropped++
+		if c.dropped == 1 || c.dropped%100 == 0 {
+			backendWarningf("collector", "queue full, %d events dropped\n", c.dropped)
+		}
+	}
+}
+
+// collectorCall is a Collect call in progress; the events are written
+// to body and done receives the outcome once the collector responds.
+type collectorCall struct {
+	body *io.PipeWriter
+	done chan error
+}
+
+func (c *CollectorAttackLogger) call() *collectorCall {
+	reader, writer := io.Pipe()
+	call := &collectorCall{body: writer, done: make(chan error, 1)}
+	go func() {
+		err := c.post(reader)
+		reader.CloseWithError(fmt.Errorf("collector call ended: %v", err))
+		call.done <- err
+	}()
+	return call
+}
+
+func (c *CollectorAttackLogger) post(body io.Reader) error {
+	request, err := http.NewRequest("POST", c.URL+GRPC_COLLECT_METHOD, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+	response, err := c.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", response.Status)
+	}
+	if status := response.Trailer.Get("Grpc-Status"); status != "0" {
+		return fmt.Errorf("gRPC status %s: %s", status, response.Trailer.Get("Grpc-Message"))
+	}
+	return nil
+}
+
+// stream writes the queued events to a Collect call, making a new call
+// with the event that could not be written if the call fails.
+func (c *CollectorAttackLogger) stream() {
+	defer c.wg.Done()
+	var pending []byte
+	for {
+		call := c.call()
+		for {
+			if pending == nil {
+				message, ok := <-c.queue
+				if !ok {
+					call.body.Close()
+					if err := <-call.done; err != nil {
+						backendWarningf("collector", "%s\n", err)
+					}
+					return
+				}
+				pending = message
+			}
+			if err := WriteGRPCMessage(call.body, pending); err != nil {
+				break
+			}
+			pending = nil
+		}
+		backendWarningf("collector", "%s; reconnecting in %s\n", <-call.done, c.Backoff)
+		select {
+		case <-time.After(c.Backoff):
+		case <-c.stopChan:
+			backendWarningf("collector", "stopped with %d events undelivered\n", len(c.queue)+1)
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCollector(t *testing.T) {
+	sensor := Sensor
+	Sensor = "sensor1"
+	defer func() { Sensor = sensor }()
+
+	stored := &testAttackLogger{}
+	collector := NewCollector(stored)
+	server := httptest.NewUnstartedServer(collector)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	logger := NewCollectorAttackLogger(server.URL, 10)
+	logger.Client = server.Client()
+	logger.Start()
+	connection := testReportEvent()
+	connection.Type = "connection-opened"
+	logger.Log(connection)
+	logger.Log(testReportEvent())
+	logger.Stop()
+
+	// another sensor sights the same attack from the other end of the connection
+	event := testReportEvent()
+	event.Flow = event.Flow.Reverse()
+	event.Time = event.Time.Add(time.Second)
+	collector.Collect(event, &ReportSensor{ID: "sensor2"})
+	// and a sensor reports a different attack
+	other := testReportEvent()
+	other.Type = "injection"
+	collector.Collect(other, &ReportSensor{ID: "sensor2"})
+
+	attacks := collector.Attacks(AttackQuery{}, "sensor1")
+	if len(attacks) != 1 {
+		t.Fatalf("%d attacks sighted by sensor1, expected 1", len(attacks))
+	}
+	if attacks[0].Report.Sensor.ID != "sensor1" || len(attacks[0].Sightings) != 2 || attacks[0].Sightings[1].Sensor.ID != "sensor2" {
+		t.Errorf("collected %+v", attacks[0])
+	}
+	if len(stored.events) != 2 {
+		t.Errorf("stored %d attacks, expected 2", len(stored.events))
+	}
+
+	response, err := server.Client().Get(server.URL + "/api/v1/attacks?type=injection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var served []CollectedAttack
+	if err := json.NewDecoder(response.Body).Decode(&served); err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("status %s: %v", response.Status, err)
+	}
+	if len(served) != 1 || served[0].Report.Type != "injection" {
+		t.Errorf("served %+v", served)
+	}
+	for _, sensor := range collector.Sensors() {
+		if sensor.Sensor.ID == "sensor1" && (sensor.Events != 2 || sensor.Attacks != 1) {
+			t.Errorf("sensor1 streamed %d events, %d attacks", sensor.Events, sensor.Attacks)
+		}
+	}
+}
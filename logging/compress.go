@@ -0,0 +1,146 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Compression is a compressed file format available to FileCompressor.
+type Compression struct {
+	Extension string
+	NewWriter func(io.Writer) (io.WriteCloser, error)
+}
+
+var Compressions = map[string]Compression{}
+
+// CompressionRegister makes a compressed file format available by the provided name.
+// If CompressionRegister is called twice with the same name it panics.
+func CompressionRegister(name string, compression Compression) {
+	if _, dup := Compressions[name]; dup {
+		panic("logging: CompressionRegister called twice for compression " + name)
+	}
+	Compressions[name] = compression
+}
+
+func init() {
+	CompressionRegister("gzip", Compression{
+		Extension: ".gz",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+	})
+}
+
+type compressJob struct {
+	src  io.ReadCloser
+	dst  string
+	done func(error)
+}
+
+// FileCompressor implements types.Compressor with a pool of worker
+// goroutines fed by a bounded queue.
+type FileCompressor struct {
+	compression Compression
+	jobs        chan compressJob
+	wg          sync.WaitGroup
+}
+
+// NewFileCompressor returns a pointer to a FileCompressor struct writing the
+// named compression with the given number of workers and queued files.
+func NewFileCompressor(name string, workers, queue int) (*FileCompressor, error) {
+	compression, ok := Compressions[name]
+	if !ok {
+		return nil, fmt.Errorf("compression %q not available in this build", name)
+	}
+	c := FileCompressor{
+		compression: compression,
+		jobs:        make(chan compressJob, queue),
+	}
+	for i := 0; i < workers; i++ {
+		c.wg.Add(1)
+		go c.work()
+	}
+	return &c, nil
+}
+
+func (c *FileCompressor) Extension() string {
+	return c.compression.Extension
+}
+
+func (c *FileCompressor) Compress(src io.ReadCloser, dst string, done func(error)) bool {
+	select {
+	case c.jobs <- compressJob{src, dst, done}:
+		return true
+	default:
+		Warningf("compressor queue full, not compressing %s\n", dst)
+		return false
+	}
+}
+
+// Stop compresses the queued files and returns once they are done.
+func (c *FileCompressor) Stop() {
+	close(c.jobs)
+	c.wg.Wait()
+}
+
+func (c *FileCompressor) work() {
+	defer c.wg.Done()
+	for job := range c.jobs {
+		err := c.compress(job.src, job.dst)
+		job.src.Close()
+		if err != nil {
+			Warningf("failed to compress %s: %s\n", job.dst, err)
+		}
+		if job.done != nil {
+			job.done(err)
+		}
+	}
+}
+
+// compress writes to a temporary file renamed to dst once
+// it is complete so that dst is never seen half written.
+func (c *FileCompressor) compress(src io.Reader, dst string) error {
+	tmp := dst + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w, err := c.compression.NewWriter(f)
+	if err == nil {
+		if _, err = io.Copy(w, src); err == nil {
+			err = w.Close()
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"fmt"
+)
+
+// confidenceLevels order the confidences of attack reports.
+var confidenceLevels = map[string]int{"low": 0, "medium": 1, "high": 2}
+
+// EventConfidence returns how likely a report of the given type is a real
+// attack: "high", "medium" or "low".
+func EventConfidence(eventType string) string {
+	return reportConfidence(detectorOf(eventType))
+}
+
+// ParseConfidence checks a confidence of attack reports: low, medium or high.
+func ParseConfidence(confidence string) (string, error) {
+	if _, ok := confidenceLevels[confidence]; !ok {
+		return "", fmt.Errorf("unknown confidence %q; low, medium or high", confidence)
+	}
+	return confidence, nil
+}
+
+// Confident returns true if a report of the given type
+// is of at least the given confidence.
+func Confident(eventType, confidence string) bool {
+	return confidenceLevels[EventConfidence(eventType)] >= confidenceLevels[confidence]
+}
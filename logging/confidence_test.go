@@ -0,0 +1,17 @@
+package logging
+
+import (
+	"testing"
+)
+
+func TestParseConfidence(t *testing.T) {
+	if confidence, err := ParseConfidence("medium"); err != nil || confidence != "medium" {
+		t.Errorf("medium parsed as %q, %v", confidence, err)
+	}
+	if _, err := ParseConfidence("certain"); err == nil {
+		t.Error("unknown confidence accepted")
+	}
+	if !Confident("injection", "high") || Confident("censor-injection-RST_data", "high") || !Confident("censor-injection-RST_data", "low") {
+		t.Error("confidences misordered")
+	}
+}
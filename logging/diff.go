@@ -0,0 +1,90 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"encoding/hex"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// DiffRun is a run of consecutive stream bytes at which the two sides of an
+// injection differ: Winner, the content already accepted for the stream,
+// and Loser, the content of the reported packet, both hex encoded. Offset
+// is from the start of the overlap and Seq the sequence of the first byte.
+type DiffRun struct {
+	Offset int    `json:"offset"`
+	Seq    uint32 `json:"seq"`
+	Length int    `json:"length"`
+	Winner string `json:"winner"`
+	Loser  string `json:"loser"`
+}
+
+// ByteDiff returns the runs at which winner and loser differ; start is the
+// sequence of their first byte. If one is longer than the other the bytes
+// beyond the shorter one differ, with nothing on the shorter side.
+func ByteDiff(winner, loser []byte, start types.Sequence) []DiffRun {
+	var runs []DiffRun
+	length := len(winner)
+	if len(loser) > length {
+		length = len(loser)
+	}
+	differs := func(i int) bool {
+		return i >= len(winner) || i >= len(loser) || winner[i] != loser[i]
+	}
+	for i := 0; i < length; {
+		if !differs(i) {
+			i++
+			continue
+		}
+		j := i
+		for j < length && differs(j) {
+			j++
+		}
+		runs = append(runs, DiffRun{
+			Offset: i,
+			Seq:    uint32(start.Add(i)),
+			Length: j - i,
+			Winner: hex.EncodeToString(diffSide(winner, i, j)),
+			Loser:  hex.EncodeToString(diffSide(loser, i, j)),
+		})
+		i = j
+	}
+	return runs
+}
+
+// diffSide returns the part of b within [i, j).
+func diffSide(b []byte, i, j int) []byte {
+	if i >= len(b) {
+		return nil
+	}
+	if j > len(b) {
+		j = len(b)
+	}
+	return b[i:j]
+}
+
+// eventDiff returns the diff of an injection report, or nil for other reports.
+func eventDiff(event *types.Event) []DiffRun {
+	if len(event.Winner) == 0 && len(event.Loser) == 0 {
+		return nil
+	}
+	return ByteDiff(event.Winner, event.Loser, event.Start)
+}
@@ -0,0 +1,30 @@
+package logging
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestByteDiff(t *testing.T) {
+	tests := []struct {
+		winner, loser string
+		want          []DiffRun
+	}{
+		{"GET /", "GET /", nil},
+		{"GET /index", "GET /evil!", []DiffRun{
+			{Offset: 5, Seq: 105, Length: 5, Winner: "696e646578", Loser: "6576696c21"},
+		}},
+		{"abcdef", "xbcdey", []DiffRun{
+			{Offset: 0, Seq: 100, Length: 1, Winner: "61", Loser: "78"},
+			{Offset: 5, Seq: 105, Length: 1, Winner: "66", Loser: "79"},
+		}},
+		{"ab", "abcd", []DiffRun{
+			{Offset: 2, Seq: 102, Length: 2, Winner: "", Loser: "6364"},
+		}},
+	}
+	for _, test := range tests {
+		if got := ByteDiff([]byte(test.winner), []byte(test.loser), 100); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("diff of %q and %q: got %+v, expected %+v", test.winner, test.loser, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Write durability modes of the file based attack loggers:
+const (
+	// records are left to the operating system to write out,
+	DURABILITY_BUFFERED = "buffered"
+	// each record is synced to disk before the next is written,
+	DURABILITY_FSYNC = "fsync"
+	// or the records written are synced together every commit interval.
+	DURABILITY_GROUP = "group"
+)
+
+// COMMIT_INTERVAL is the default interval between group commits.
+const COMMIT_INTERVAL = 100 * time.Millisecond
+
+// LogFileWriter appends records to log files with a durability mode
+// deciding how soon, at the cost of a sync, they are safe from power
+// failure. Syncing a new file also syncs its directory, so that the file
+// itself survives. If ChainKey is set, each record is also linked to the
+// previous one in the file's chain; see VerifyReportChain.
+// A LogFileWriter must only be used by one goroutine.
+type LogFileWriter struct {
+	Durability     string
+	CommitInterval time.Duration
+	ChainKey       []byte
+
+	uncommitted map[string]*os.File
+	newDirs     map[string]bool
+}
+
+// NewLogFileWriter returns a buffered LogFileWriter.
+func NewLogFileWriter() *LogFileWriter {
+	return &LogFileWriter{
+		Durability:     DURABILITY_BUFFERED,
+		CommitInterval: COMMIT_INTERVAL,
+		uncommitted:    make(map[string]*os.File),
+		newDirs:        make(map[string]bool),
+	}
+}
+
+// NewLogFileWriterFromOptions returns a LogFileWriter configured by the
+// "durability", "commit_interval" and "chain_key", the file holding the
+// chain key, parameters of an attack logger backend.
+func NewLogFileWriterFromOptions(options *AttackLoggerOptions) (*LogFileWriter, error) {
+	w := NewLogFileWriter()
+	w.Durability = options.Param("durability", w.Durability)
+	switch w.Durability {
+	case DURABILITY_BUFFERED, DURABILITY_FSYNC, DURABILITY_GROUP:
+	default:
+		return nil, fmt.Errorf("unknown durability %q; one of %s, %s, %s", w.Durability, DURABILITY_BUFFERED, DURABILITY_FSYNC, DURABILITY_GROUP)
+	}
+	interval, err := time.ParseDuration(options.Param("commit_interval", w.CommitInterval.String()))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid commit_interval %q", options.Param("commit_interval", ""))
+	}
+	w.CommitInterval = interval
+	if keyFile := options.Param("chain_key", ""); keyFile != "" {
+		if w.ChainKey, err = ReadChainKey(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Append appends a record to the named file, creating it and its
+// directory if need be, links it in the file's chain if there is a
+// chain key and syncs both as the durability mode requires.
+func (w *LogFileWriter) Append(name string, record []byte) error {
+	if w.ChainKey == nil {
+		return w.append(name, record, nil)
+	}
+	previous, err := lastChainHash(name + CHAIN_EXTENSION)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	if err := w.append(name, record, &offset); err != nil {
+		return err
+	}
+	hash, mac := chainLink(w.ChainKey, previous, record)
+	return w.append(name+CHAIN_EXTENSION, formatChainLink(offset, len(record), hash, mac), nil)
+}
+
+// append appends a record to the named file and, if offset is not
+// nil, stores the offset at which it was written there.
+func (w *LogFileWriter) append(name string, record []byte, offset *int64) error {
+	f, ok := w.uncommitted[name]
+	if !ok {
+		created := false
+		if w.Durability != DURABILITY_BUFFERED {
+			_, err := os.Stat(name)
+			created = os.IsNotExist(err)
+		}
+		var err error
+		f, err = openLogFile(name)
+		if err != nil {
+			return err
+		}
+		if created {
+			w.newDirs[filepath.Dir(name)] = true
+		}
+	}
+	var err error
+	if offset != nil {
+		*offset, err = f.Seek(0, io.SeekEnd)
+	}
+	if err == nil {
+		_, err = f.Write(record)
+	}
+	switch w.Durability {
+	case DURABILITY_GROUP:
+		w.uncommitted[name] = f
+		return err
+	case DURABILITY_FSYNC:
+		if err == nil {
+			err = f.Sync()
+		}
+		if err == nil {
+			err = w.syncDirs()
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Commit syncs and closes the files written since the last commit.
+// It is only needed in group durability mode.
+func (w *LogFileWriter) Commit() error {
+	var result error
+	for name, f := range w.uncommitted {
+		if err := f.Sync(); err != nil && result == nil {
+			result = err
+		}
+		if err := f.Close(); err != nil && result == nil {
+			result = err
+		}
+		delete(w.uncommitted, name)
+	}
+	if err := w.syncDirs(); err != nil && result == nil {
+		result = err
+	}
+	return result
+}
+
+// commitTicks returns the channel on which group commits are due and
+// the function stopping it; the channel is nil unless in group mode.
+func (w *LogFileWriter) commitTicks() (<-chan time.Time, func()) {
+	if w.Durability != DURABILITY_GROUP {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(w.CommitInterval)
+	return ticker.C, ticker.Stop
+}
+
+// syncDirs syncs the directories in which files were created.
+func (w *LogFileWriter) syncDirs() error {
+	for dir := range w.newDirs {
+		delete(w.newDirs, dir)
+		d, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		err = d.Sync()
+		d.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
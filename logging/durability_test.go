@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogFileWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logFileWriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, durability := range []string{DURABILITY_BUFFERED, DURABILITY_FSYNC, DURABILITY_GROUP} {
+		w, err := NewLogFileWriterFromOptions(&AttackLoggerOptions{Params: map[string]string{"durability": durability}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join(dir, durability, "attacks.json")
+		for _, record := range []string{"one\n", "two\n"} {
+			if err := w.Append(name, []byte(record)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if durability == DURABILITY_GROUP && len(w.uncommitted) != 1 {
+			t.Errorf("group durability kept %d files open, expected 1", len(w.uncommitted))
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if len(w.uncommitted) != 0 || len(w.newDirs) != 0 {
+			t.Errorf("%s durability left files uncommitted", durability)
+		}
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != "one\ntwo\n" {
+			t.Errorf("%s durability wrote %q", durability, contents)
+		}
+	}
+
+	for _, params := range []map[string]string{{"durability": "eventually"}, {"durability": "group", "commit_interval": "0s"}} {
+		if _, err := NewAttackLogger("json", &AttackLoggerOptions{ArchiveDir: dir, Params: params}); err == nil {
+			t.Errorf("json attack logger accepted %v", params)
+		}
+	}
+}
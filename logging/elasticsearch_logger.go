@@ -0,0 +1,315 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// ElasticsearchAttackLogger bulk indexes attack reports as AttackReport
+// documents into Elasticsearch or OpenSearch.
+//
+// Reports are queued and sent in batches of BatchSize or every
+// FlushInterval, whichever comes first. Documents the cluster rejects as
+// overloaded are retried up to Retries times with exponential backoff.
+// Once Queue reports are waiting Log blocks, pushing back on the caller,
+// unless Drop is set in which case further reports are dropped and counted.
+type ElasticsearchAttackLogger struct {
+	URL           string
+	Index         string
+	Username      string
+	Password      string
+	Template      []byte
+	BatchSize     int
+	FlushInterval time.Duration
+	Retries       int
+	Backoff       time.Duration
+	Drop          bool
+	Client        *http.Client
+
+	dropped          int
+	stopChan         chan bool
+	doneChan         chan bool
+	attackReportChan chan *types.Event
+}
+
+func init() {
+	AttackLoggerRegister("elasticsearch", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewElasticsearchAttackLoggerFromOptions(options)
+	})
+}
+
+// NewElasticsearchAttackLogger returns a pointer to an ElasticsearchAttackLogger
+// struct indexing into the given index of the cluster at url. The index name may
+// contain a Go time layout in braces, e.g. "honeybadger-{2006.01.02}", which is
+// replaced by the report's time to give time based indices.
+func NewElasticsearchAttackLogger(url, index string, queue int) *ElasticsearchAttackLogger {
+	return &ElasticsearchAttackLogger{
+		URL:              strings.TrimRight(url, "/"),
+		Index:            index,
+		BatchSize:        500,
+		FlushInterval:    5 * time.Second,
+		Retries:          5,
+		Backoff:          time.Second,
+		Client:           &http.Client{Timeout: 30 * time.Second},
+		stopChan:         make(chan bool),
+		doneChan:         make(chan bool),
+		attackReportChan: make(chan *types.Event, queue),
+	}
+}
+
+// NewElasticsearchAttackLoggerFromOptions returns an ElasticsearchAttackLogger
+// configured by the backend parameters url, index, username, password,
+// template (a file holding an index template installed on Start),
+// batch_size, flush_interval, retries, backoff, queue and overflow
+// ("block" or "drop").
+func NewElasticsearchAttackLoggerFromOptions(options *AttackLoggerOptions) (*ElasticsearchAttackLogger, error) {
+	queue, err := strconv.Atoi(options.Param("queue", "10000"))
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch: invalid queue: %s", err)
+	}
+	e := NewElasticsearchAttackLogger(options.Param("url", "http://localhost:9200"),
+		options.Param("index", "honeybadger-{2006.01.02}"), queue)
+	e.Username = options.Param("username", "")
+	e.Password = options.Param("password", "")
+	if e.BatchSize, err = strconv.Atoi(options.Param("batch_size", strconv.Itoa(e.BatchSize))); err != nil {
+		return nil, fmt.Errorf("elasticsearch: invalid batch_size: %s", err)
+	}
+	if e.Retries, err = strconv.Atoi(options.Param("retries", strconv.Itoa(e.Retries))); err != nil {
+		return nil, fmt.Errorf("elasticsearch: invalid retries: %s", err)
+	}
+	if e.FlushInterval, err = time.ParseDuration(options.Param("flush_interval", e.FlushInterval.String())); err != nil {
+		return nil, fmt.Errorf("elasticsearch: invalid flush_interval: %s", err)
+	}
+	if e.Backoff, err = time.ParseDuration(options.Param("backoff", e.Backoff.String())); err != nil {
+		return nil, fmt.Errorf("elasticsearch: invalid backoff: %s", err)
+	}
+	switch overflow := options.Param("overflow", "block"); overflow {
+	case "block":
+	case "drop":
+		e.Drop = true
+	default:
+		return nil, fmt.Errorf("elasticsearch: invalid overflow %q; one of block, drop", overflow)
+	}
+	if template := options.Param("template", ""); template != "" {
+		if e.Template, err = ioutil.ReadFile(template); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (e *ElasticsearchAttackLogger) Start() {
+	if e.Template != nil {
+		if err := e.installTemplate(); err != nil {
+			backendWarningf("elasticsearch", "failed to install index template: %s\n", err)
+		}
+	}
+	go e.receiveReports()
+}
+
+// Stop flushes the queued reports and returns once they are sent.
+func (e *ElasticsearchAttackLogger) Stop() {
+	e.stopChan <- true
+	<-e.doneChan
+}
+
+func (e *ElasticsearchAttackLogger) Log(event *types.Event) {
+	if !e.Drop {
+		e.attackReportChan <- event
+		return
+	}
+	select {
+	case e.attackReportChan <- event:
+	default:
+		e.dropped++
+		if e.dropped == 1 || e.dropped%1000 == 0 {
+			backendWarningf("elasticsearch", "queue full, %d reports dropped\n", e.dropped)
+		}
+	}
+}
+
+func (e *ElasticsearchAttackLogger) receiveReports() {
+	ticker := time.NewTicker(e.FlushInterval)
+	defer ticker.Stop()
+	var batch []*types.Event
+	for {
+		select {
+		case <-e.stopChan:
+			for len(e.attackReportChan) > 0 {
+				batch = append(batch, <-e.attackReportChan)
+			}
+			e.flush(batch)
+			e.doneChan <- true
+			return
+		case event := <-e.attackReportChan:
+			batch = append(batch, event)
+			if len(batch) >= e.BatchSize {
+				e.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+// index returns the name of the index a report of the given time goes to.
+func (e *ElasticsearchAttackLogger) index(t time.Time) string {
+	start := strings.Index(e.Index, "{")
+	end := strings.Index(e.Index, "}")
+	if start < 0 || end < start {
+		return e.Index
+	}
+	return e.Index[:start] + t.UTC().Format(e.Index[start+1:end]) + e.Index[end+1:]
+}
+
+// flush sends a batch of reports, retrying the documents rejected as
+// overloaded; reports still not indexed once the retries run out are logged and dropped.
+func (e *ElasticsearchAttackLogger) flush(batch []*types.Event) {
+	backoff := e.Backoff
+	for attempt := 0; len(batch) > 0; attempt++ {
+		retry, err := e.bulk(batch)
+		if err != nil {
+			backendWarningf("elasticsearch", "bulk request failed: %s\n", err)
+		} else if len(retry) < len(batch) {
+			// progress was made; start backing off afresh
+			backoff = e.Backoff
+		}
+		batch = retry
+		if len(batch) == 0 {
+			return
+		}
+		if attempt >= e.Retries {
+			backendWarningf("elasticsearch", "giving up on %d reports\n", len(batch))
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+	} `json:"items"`
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// bulk sends a single bulk request and returns the reports to be retried.
+// Reports rejected for any other reason than load are logged and dropped.
+func (e *ElasticsearchAttackLogger) bulk(batch []*types.Event) ([]*types.Event, error) {
+	var body bytes.Buffer
+	for _, event := range batch {
+		action := map[string]map[string]string{"index": {"_index": e.index(event.Time)}}
+		a, err := json.Marshal(action)
+		if err != nil {
+			return nil, err
+		}
+		d, err := json.Marshal(NewAttackReport(event))
+		if err != nil {
+			return nil, err
+		}
+		body.Write(a)
+		body.WriteByte('\n')
+		body.Write(d)
+		body.WriteByte('\n')
+	}
+	response, err := e.do("POST", "/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return batch, err
+	}
+	defer response.Body.Close()
+	if retryableStatus(response.StatusCode) {
+		return batch, fmt.Errorf("status %s", response.Status)
+	}
+	if response.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(response.Body)
+		backendWarningf("elasticsearch", "dropping %d reports, status %s: %s\n", len(batch), response.Status, message)
+		return nil, nil
+	}
+	var result bulkResponse
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+	var retry []*types.Event
+	rejected := 0
+	for i, item := range result.Items {
+		for _, outcome := range item {
+			if outcome.Status < 300 || i >= len(batch) {
+				continue
+			}
+			if retryableStatus(outcome.Status) {
+				retry = append(retry, batch[i])
+			} else {
+				rejected++
+			}
+		}
+	}
+	if rejected > 0 {
+		backendWarningf("elasticsearch", "%d reports rejected\n", rejected)
+	}
+	return retry, nil
+}
+
+func (e *ElasticsearchAttackLogger) installTemplate() error {
+	name := e.Index
+	if i := strings.Index(name, "{"); i > 0 {
+		name = strings.TrimRight(name[:i], "-_.")
+	}
+	response, err := e.do("PUT", "/_index_template/"+name, "application/json", e.Template)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("status %s", response.Status)
+	}
+	return nil
+}
+
+func (e *ElasticsearchAttackLogger) do(method, path, contentType string, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, e.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", contentType)
+	if e.Username != "" {
+		request.SetBasicAuth(e.Username, e.Password)
+	}
+	return e.Client.Do(request)
+}
@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestElasticsearchAttackLogger(t *testing.T) {
+	var mutex sync.Mutex
+	var requests int
+	var indexed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.URL.Path != "/_bulk" {
+			t.Errorf("unexpected request path %s", r.URL.Path)
+		}
+		requests++
+		var lines []string
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		// reject the second document of the first request as overloaded
+		var items []string
+		for i := 0; i < len(lines)/2; i++ {
+			status := 201
+			if requests == 1 && i == 1 {
+				status = 429
+			} else {
+				indexed = append(indexed, lines[2*i])
+			}
+			items = append(items, fmt.Sprintf(`{"index":{"status":%d}}`, status))
+		}
+		fmt.Fprintf(w, `{"errors":%v,"items":[%s]}`, requests == 1, strings.Join(items, ","))
+	}))
+	defer server.Close()
+
+	logger, err := NewElasticsearchAttackLoggerFromOptions(&AttackLoggerOptions{
+		Params: map[string]string{
+			"url":            server.URL,
+			"index":          "hb-{2006}",
+			"batch_size":     "2",
+			"flush_interval": "1h",
+			"backoff":        "1ms",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Start()
+	for i := 0; i < 3; i++ {
+		event := testReportEvent()
+		event.Time = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+		logger.Log(event)
+	}
+	logger.Stop()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(indexed) != 3 {
+		t.Fatalf("expected 3 indexed reports, got %d in %d requests", len(indexed), requests)
+	}
+	if indexed[0] != `{"index":{"_index":"hb-2015"}}` {
+		t.Errorf("unexpected bulk action %s", indexed[0])
+	}
+}
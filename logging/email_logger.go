@@ -0,0 +1,346 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// EmailAttackLogger mails attack reports through an SMTP relay.
+//
+// A report is only mailed once Threshold reports of its type have been
+// seen within Window; Thresholds overrides Threshold by report type or
+// detector, the type taking precedence. Reports are mailed one per message
+// unless Digest is set, in which case the reports reaching their threshold
+// are collected and mailed together every Digest, which then also serves
+// as the threshold window.
+//
+// TLS is one of "starttls", the default, which refuses servers without
+// STARTTLS, "tls" for implicit TLS or "none". Username and Password are
+// sent with the PLAIN mechanism if set.
+type EmailAttackLogger struct {
+	Server    string
+	From      string
+	To        []string
+	Subject   string
+	Username  string
+	Password  string
+	TLS       string
+	TLSConfig *tls.Config
+
+	Threshold  int
+	Thresholds map[string]int
+	Window     time.Duration
+	Digest     time.Duration
+	DigestMax  int
+
+	counts           map[string]int
+	windowStart      time.Time
+	digest           []*AttackReport
+	digestSkipped    int
+	stopChan         chan bool
+	doneChan         chan bool
+	attackReportChan chan *types.Event
+}
+
+func init() {
+	AttackLoggerRegister("email", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewEmailAttackLoggerFromOptions(options)
+	})
+}
+
+// NewEmailAttackLogger returns a pointer to an EmailAttackLogger struct
+// mailing every report from from to the given recipients through server.
+func NewEmailAttackLogger(server, from string, to []string) *EmailAttackLogger {
+	host, _, _ := net.SplitHostPort(server)
+	return &EmailAttackLogger{
+		Server:           server,
+		From:             from,
+		To:               to,
+		Subject:          "HoneyBadger",
+		TLS:              "starttls",
+		TLSConfig:        &tls.Config{ServerName: host},
+		Threshold:        1,
+		Thresholds:       make(map[string]int),
+		Window:           time.Hour,
+		DigestMax:        100,
+		counts:           make(map[string]int),
+		stopChan:         make(chan bool),
+		doneChan:         make(chan bool),
+		attackReportChan: make(chan *types.Event, 100),
+	}
+}
+
+// NewEmailAttackLoggerFromOptions returns an EmailAttackLogger configured by the
+// backend parameters server, from, to (separated by "|"), subject, username,
+// password, tls, ca, threshold, threshold.<type or detector>, window, digest
+// and digest_max.
+func NewEmailAttackLoggerFromOptions(options *AttackLoggerOptions) (*EmailAttackLogger, error) {
+	var to []string
+	for _, address := range strings.Split(options.Param("to", ""), "|") {
+		if address = strings.TrimSpace(address); address != "" {
+			to = append(to, address)
+		}
+	}
+	if len(to) == 0 {
+		return nil, fmt.Errorf("email: no recipients given")
+	}
+	e := NewEmailAttackLogger(options.Param("server", "localhost:25"), options.Param("from", "honeybadger@localhost"), to)
+	e.Subject = options.Param("subject", e.Subject)
+	e.Username = options.Param("username", "")
+	e.Password = options.Param("password", "")
+	switch e.TLS = options.Param("tls", e.TLS); e.TLS {
+	case "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("email: unsupported tls mode %q", e.TLS)
+	}
+	if ca := options.Param("ca", ""); ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		e.TLSConfig.RootCAs = x509.NewCertPool()
+		if !e.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("email: no certificates found in %s", ca)
+		}
+	}
+	for key, value := range options.Params {
+		var err error
+		switch {
+		case key == "threshold":
+			e.Threshold, err = strconv.Atoi(value)
+		case strings.HasPrefix(key, "threshold."):
+			e.Thresholds[strings.TrimPrefix(key, "threshold.")], err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("email: invalid %s: %s", key, err)
+		}
+	}
+	var err error
+	if e.Window, err = time.ParseDuration(options.Param("window", e.Window.String())); err != nil {
+		return nil, fmt.Errorf("email: invalid window: %s", err)
+	}
+	if e.Digest, err = time.ParseDuration(options.Param("digest", "0s")); err != nil {
+		return nil, fmt.Errorf("email: invalid digest: %s", err)
+	}
+	if e.DigestMax, err = strconv.Atoi(options.Param("digest_max", strconv.Itoa(e.DigestMax))); err != nil {
+		return nil, fmt.Errorf("email: invalid digest_max: %s", err)
+	}
+	if e.Digest > 0 {
+		e.Window = e.Digest
+	}
+	return e, nil
+}
+
+func (e *EmailAttackLogger) Start() {
+	e.windowStart = time.Now()
+	go e.receiveReports()
+}
+
+// Stop mails the queued reports and any pending digest before returning.
+func (e *EmailAttackLogger) Stop() {
+	e.stopChan <- true
+	<-e.doneChan
+}
+
+// Log queues a report; reports are dropped rather than holding
+// up the detectors if the relay falls far behind.
+func (e *EmailAttackLogger) Log(event *types.Event) {
+	select {
+	case e.attackReportChan <- event:
+	default:
+		backendWarningf("email", "queue full, report dropped\n")
+	}
+}
+
+func (e *EmailAttackLogger) receiveReports() {
+	var digestChan <-chan time.Time
+	if e.Digest > 0 {
+		ticker := time.NewTicker(e.Digest)
+		defer ticker.Stop()
+		digestChan = ticker.C
+	}
+	for {
+		select {
+		case <-e.stopChan:
+			for len(e.attackReportChan) > 0 {
+				e.handle(<-e.attackReportChan)
+			}
+			e.flushDigest()
+			e.doneChan <- true
+			return
+		case <-digestChan:
+			e.flushDigest()
+		case event := <-e.attackReportChan:
+			e.handle(event)
+		}
+	}
+}
+
+func (e *EmailAttackLogger) handle(event *types.Event) {
+	report := NewAttackReport(event)
+	if !e.alert(report, time.Now()) {
+		return
+	}
+	if e.Digest > 0 {
+		if len(e.digest) < e.DigestMax {
+			e.digest = append(e.digest, report)
+		} else {
+			e.digestSkipped++
+		}
+		return
+	}
+	subject := fmt.Sprintf("%s: %s from %s", e.Subject, report.Type, report.Flow.SrcIP)
+	if err := e.sendMail(subject, emailReport(report)); err != nil {
+		backendWarningf("email", "%s\n", err)
+	}
+}
+
+// threshold returns the number of reports of a type needed within the window before they are mailed.
+func (e *EmailAttackLogger) threshold(report *AttackReport) int {
+	if threshold, ok := e.Thresholds[report.Type]; ok {
+		return threshold
+	}
+	if threshold, ok := e.Thresholds[report.Detector]; ok {
+		return threshold
+	}
+	return e.Threshold
+}
+
+// alert counts a report against its type and reports
+// whether the threshold of its type has been reached.
+func (e *EmailAttackLogger) alert(report *AttackReport, now time.Time) bool {
+	if now.Sub(e.windowStart) >= e.Window {
+		e.counts = make(map[string]int)
+		e.windowStart = now
+	}
+	e.counts[report.Type]++
+	return e.counts[report.Type] >= e.threshold(report)
+}
+
+func (e *EmailAttackLogger) flushDigest() {
+	if len(e.digest) == 0 {
+		return
+	}
+	counts := make(map[string]int)
+	for _, report := range e.digest {
+		counts[report.Type]++
+	}
+	eventTypes := make([]string, 0, len(counts))
+	for eventType := range counts {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Strings(eventTypes)
+	var body bytes.Buffer
+	for _, eventType := range eventTypes {
+		fmt.Fprintf(&body, "%d %s\n", counts[eventType], eventType)
+	}
+	if e.digestSkipped > 0 {
+		fmt.Fprintf(&body, "%d further reports not listed\n", e.digestSkipped)
+	}
+	for _, report := range e.digest {
+		body.WriteString("\n")
+		body.WriteString(emailReport(report))
+	}
+	subject := fmt.Sprintf("%s: %d attack reports", e.Subject, len(e.digest)+e.digestSkipped)
+	if err := e.sendMail(subject, body.String()); err != nil {
+		backendWarningf("email", "%s\n", err)
+	}
+	e.digest = nil
+	e.digestSkipped = 0
+}
+
+// emailReport returns the plain text description of a report.
+func emailReport(report *AttackReport) string {
+	return fmt.Sprintf("%s %s (%s detector, %s confidence)\nflow %s:%d -> %s:%d, %d packets\n",
+		report.Time.UTC().Format(time.RFC3339), report.Type, report.Detector, reportConfidence(report.Detector),
+		report.Flow.SrcIP, report.Flow.SrcPort, report.Flow.DstIP, report.Flow.DstPort, report.PacketCount)
+}
+
+// sendMail sends a plain text message to the recipients.
+func (e *EmailAttackLogger) sendMail(subject, body string) error {
+	var client *smtp.Client
+	if e.TLS == "tls" {
+		conn, err := tls.Dial("tcp", e.Server, e.TLSConfig)
+		if err != nil {
+			return err
+		}
+		if client, err = smtp.NewClient(conn, e.TLSConfig.ServerName); err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		var err error
+		if client, err = smtp.Dial(e.Server); err != nil {
+			return err
+		}
+	}
+	defer client.Close()
+	if hostname, err := os.Hostname(); err == nil {
+		if err := client.Hello(hostname); err != nil {
+			return err
+		}
+	}
+	if e.TLS == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", e.Server)
+		}
+		if err := client.StartTLS(e.TLSConfig); err != nil {
+			return err
+		}
+	}
+	if e.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", e.Username, e.Password, e.TLSConfig.ServerName)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(e.From); err != nil {
+		return err
+	}
+	for _, to := range e.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n",
+		e.From, strings.Join(e.To, ", "), subject, time.Now().Format(time.RFC1123Z))
+	w.Write([]byte(strings.Replace(body, "\n", "\r\n", -1)))
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
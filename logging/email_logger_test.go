@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// serveFakeSMTP accepts one SMTP session and sends the message data it receives on messages.
+func serveFakeSMTP(listener net.Listener, messages chan string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		switch command := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); command {
+		case "EHLO", "HELO", "MAIL", "RCPT":
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			data, err := text.ReadDotLines()
+			if err != nil {
+				return
+			}
+			messages <- strings.Join(data, "\n")
+			text.PrintfLine("250 queued")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 unsupported")
+		}
+	}
+}
+
+func TestEmailAttackLoggerDigest(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	messages := make(chan string, 1)
+	go serveFakeSMTP(listener, messages)
+
+	logger, err := NewEmailAttackLoggerFromOptions(&AttackLoggerOptions{
+		Params: map[string]string{
+			"server":              listener.Addr().String(),
+			"to":                  "soc@example.org|oncall@example.org",
+			"tls":                 "none",
+			"digest":              "1h",
+			"threshold.handshake": "2",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Start()
+	for i := 0; i < 3; i++ {
+		logger.Log(testReportEvent())
+	}
+	logger.Stop()
+
+	message := <-messages
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(message + "\n")))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Subject") != "HoneyBadger: 2 attack reports" || header.Get("To") != "soc@example.org, oncall@example.org" {
+		t.Errorf("unexpected header %v", header)
+	}
+	if !strings.Contains(message, "2 handshake-hijack\n") || !strings.Contains(message, "flow 1.2.3.4:1 -> 2.3.4.5:2") {
+		t.Errorf("unexpected message %q", message)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"encoding/json"
+	"hash/fnv"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// EVE_SIGNATURE_BASE is the first of the Suricata signature IDs
+// allotted to HoneyBadger report types.
+const EVE_SIGNATURE_BASE = 9000000
+
+// EveTimeFormat is the timestamp layout of Suricata's EVE JSON output.
+const EveTimeFormat = "2006-01-02T15:04:05.000000-0700"
+
+// EveEvent is an attack report in the structure of a Suricata EVE JSON
+// alert; the full AttackReport is included under "honeybadger".
+type EveEvent struct {
+	Timestamp   string        `json:"timestamp"`
+	Host        string        `json:"host"`
+	InIface     string        `json:"in_iface,omitempty"`
+	VLAN        []uint16      `json:"vlan,omitempty"`
+	FlowID      uint64        `json:"flow_id"`
+	EventType   string        `json:"event_type"`
+	SrcIP       string        `json:"src_ip"`
+	SrcPort     uint16        `json:"src_port"`
+	DestIP      string        `json:"dest_ip"`
+	DestPort    uint16        `json:"dest_port"`
+	Proto       string        `json:"proto"`
+	Alert       EveAlert      `json:"alert"`
+	TLS         *EveTLS       `json:"tls,omitempty"`
+	HoneyBadger *AttackReport `json:"honeybadger"`
+}
+
+// EveTLS is the tls object of an EVE event, of the connection's ClientHello.
+type EveTLS struct {
+	SNI     string `json:"sni,omitempty"`
+	Version string `json:"version"`
+	JA3     EveJA3 `json:"ja3"`
+}
+
+// EveJA3 is the JA3 fingerprint of an EVE tls object.
+type EveJA3 struct {
+	Hash   string `json:"hash"`
+	String string `json:"string"`
+}
+
+// EveAlert is the alert object of an EVE alert event.
+type EveAlert struct {
+	Action      string `json:"action"`
+	GID         int    `json:"gid"`
+	SignatureID uint32 `json:"signature_id"`
+	Rev         int    `json:"rev"`
+	Signature   string `json:"signature"`
+	Category    string `json:"category"`
+	Severity    int    `json:"severity"`
+}
+
+// eveSignatureID returns the stable signature ID of a report type.
+func eveSignatureID(eventType string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(eventType))
+	return EVE_SIGNATURE_BASE + h.Sum32()%100000
+}
+
+// eveSeverity maps a 0 to 10 report severity onto
+// Suricata's 1 (high) to 3 (low) alert severities.
+func eveSeverity(severity int) int {
+	switch {
+	case severity >= 8:
+		return 1
+	case severity >= 5:
+		return 2
+	}
+	return 3
+}
+
+// NewEveEvent returns the EVE alert event of an attack report.
+func NewEveEvent(event *types.Event) *EveEvent {
+	report := NewAttackReport(event)
+	var tls *EveTLS
+	if report.TLS != nil {
+		tls = &EveTLS{
+			SNI:     report.TLS.ServerName,
+			Version: report.TLS.Version,
+			JA3:     EveJA3{Hash: report.TLS.JA3Hash, String: report.TLS.JA3},
+		}
+	}
+	eve := &EveEvent{
+		Timestamp: report.Time.Format(EveTimeFormat),
+		Host:      report.Sensor.ID,
+		FlowID:    flowID(&event.Flow),
+		EventType: "alert",
+		SrcIP:     report.Flow.SrcIP,
+		SrcPort:   report.Flow.SrcPort,
+		DestIP:    report.Flow.DstIP,
+		DestPort:  report.Flow.DstPort,
+		Proto:     "TCP",
+		Alert: EveAlert{
+			Action:      "allowed",
+			GID:         1,
+			SignatureID: eveSignatureID(report.Type),
+			Rev:         1,
+			Signature:   "HoneyBadger " + report.Type,
+			Category:    "TCP " + report.Detector,
+			Severity:    eveSeverity(reportSeverity(report.Detector)),
+		},
+		TLS:         tls,
+		HoneyBadger: report,
+	}
+	if report.Ingress != nil {
+		eve.InIface = report.Ingress.Interface
+		eve.VLAN = report.Ingress.VLANs
+	}
+	return eve
+}
+
+// FormatEVE renders an attack report as a Suricata EVE JSON alert.
+func FormatEVE(event *types.Event) ([]byte, error) {
+	return json.Marshal(NewEveEvent(event))
+}
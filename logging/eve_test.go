@@ -0,0 +1,34 @@
+package logging
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFormatEVE(t *testing.T) {
+	event := testReportEvent()
+	record, err := FormatEVE(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(record, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["event_type"] != "alert" || decoded["src_ip"] != "1.2.3.4" || decoded["dest_port"].(float64) != 2 {
+		t.Errorf("unexpected EVE event %s", record)
+	}
+	alert := decoded["alert"].(map[string]interface{})
+	if alert["signature"] != "HoneyBadger handshake-hijack" || alert["severity"].(float64) != 1 {
+		t.Errorf("unexpected EVE alert %v", alert)
+	}
+	if _, ok := decoded["honeybadger"].(map[string]interface{}); !ok {
+		t.Error("attack report missing from EVE event")
+	}
+
+	reverse := *event
+	reverse.Flow = event.Flow.Reverse()
+	if flowID(&event.Flow) != flowID(&reverse.Flow) {
+		t.Error("flow_id differs between the directions of a connection")
+	}
+}
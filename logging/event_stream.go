@@ -0,0 +1,155 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// EventFilter selects the events a subscriber receives. An event matches
+// if its type or detector is one of Types and either end of its flow is in
+// one of Networks; an empty list matches every event.
+type EventFilter struct {
+	Types    []string
+	Networks []*net.IPNet
+}
+
+// ParseEventFilter returns the filter of the given types and CIDR networks.
+func ParseEventFilter(eventTypes, networks []string) (*EventFilter, error) {
+	filter := EventFilter{Types: eventTypes}
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(network))
+		if err != nil {
+			return nil, err
+		}
+		filter.Networks = append(filter.Networks, ipNet)
+	}
+	return &filter, nil
+}
+
+// Matches returns true if the filter selects the event.
+func (f *EventFilter) Matches(event *types.Event) bool {
+	if len(f.Types) > 0 {
+		detector := detectorOf(event.Type)
+		matched := false
+		for _, eventType := range f.Types {
+			if eventType == event.Type || eventType == detector {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(f.Networks) == 0 {
+		return true
+	}
+	ipFlow, _ := event.Flow.Flows()
+	src, dst := net.IP(ipFlow.Src().Raw()), net.IP(ipFlow.Dst().Raw())
+	for _, network := range f.Networks {
+		if network.Contains(src) || network.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription receives the events of an EventStream its filter matches.
+type Subscription struct {
+	Events  chan *types.Event
+	filter  *EventFilter
+	dropped int
+}
+
+// EventStream is an attack logger which hands every event it is given to
+// its current subscribers. A subscriber too slow to keep up is not waited
+// for; events which would overflow its buffer are dropped.
+type EventStream struct {
+	Buffer int
+
+	mutex       sync.Mutex
+	subscribers map[*Subscription]bool
+}
+
+// NewEventStream returns a pointer to an EventStream struct whose
+// subscribers buffer up to the given number of events.
+func NewEventStream(buffer int) *EventStream {
+	return &EventStream{
+		Buffer:      buffer,
+		subscribers: make(map[*Subscription]bool),
+	}
+}
+
+// Subscribe returns a new subscription to the events the filter matches.
+func (s *EventStream) Subscribe(filter *EventFilter) *Subscription {
+	subscription := &Subscription{
+		Events: make(chan *types.Event, s.Buffer),
+		filter: filter,
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.subscribers[subscription] = true
+	return subscription
+}
+
+// Unsubscribe ends a subscription, closing its Events channel.
+func (s *EventStream) Unsubscribe(subscription *Subscription) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.subscribers[subscription] {
+		delete(s.subscribers, subscription)
+		close(subscription.Events)
+	}
+}
+
+func (s *EventStream) Start() {}
+
+// Stop ends all subscriptions.
+func (s *EventStream) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for subscription := range s.subscribers {
+		delete(s.subscribers, subscription)
+		close(subscription.Events)
+	}
+}
+
+func (s *EventStream) Log(event *types.Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for subscription := range s.subscribers {
+		if !subscription.filter.Matches(event) {
+			continue
+		}
+		select {
+		case subscription.Events <- event:
+		default:
+			subscription.dropped++
+			if subscription.dropped == 1 || subscription.dropped%1000 == 0 {
+				Warningf("event stream: slow subscriber, %d events dropped\n", subscription.dropped)
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// ReportFormatter renders an attack report as a single record.
+type ReportFormatter func(event *types.Event) ([]byte, error)
+
+// ReportFormats are the record formats attack reports can be written in by name.
+var ReportFormats = map[string]ReportFormatter{
+	"json":     FormatJSON,
+	"cef":      FormatCEF,
+	"leef":     FormatLEEF,
+	"eve":      FormatEVE,
+	"protobuf": FormatProtobuf,
+	"stix":     FormatSTIX,
+}
+
+// reportContentTypes are the MIME types of the records of each format.
+var reportContentTypes = map[string]string{
+	"json":     "application/json",
+	"cef":      "text/plain",
+	"leef":     "text/plain",
+	"eve":      "application/json",
+	"protobuf": "application/x-protobuf",
+	"stix":     "application/stix+json;version=2.1",
+}
+
+// reportFiles are the default file names of the per format report file backends.
+var reportFiles = map[string]string{
+	"cef":  "attacks.cef",
+	"leef": "attacks.leef",
+	"eve":  "eve.json",
+	"stix": "attacks.stix.json",
+}
+
+// FormatJSON renders an attack report as AttackReport JSON.
+func FormatJSON(event *types.Event) ([]byte, error) {
+	return json.Marshal(NewAttackReport(event))
+}
+
+// reportFormat returns the named ReportFormatter.
+func reportFormat(name string) (ReportFormatter, error) {
+	if formatter, ok := ReportFormats[name]; ok {
+		return formatter, nil
+	}
+	var names []string
+	for registered := range ReportFormats {
+		names = append(names, registered)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown report format %q; one of %s", name, strings.Join(names, ", "))
+}
+
+// ReportFileLogger appends attack reports, one record per line in
+// the given format, to a single file for a SIEM or log shipper to collect.
+type ReportFileLogger struct {
+	Filename         string
+	Format           ReportFormatter
+	Files            *LogFileWriter
+	stopChan         chan bool
+	attackReportChan chan *types.Event
+}
+
+func init() {
+	for name := range reportFiles {
+		format := name
+		AttackLoggerRegister(format, func(options *AttackLoggerOptions) (AttackLogger, error) {
+			filename := options.Param("file", filepath.Join(options.ArchiveDir, reportFiles[format]))
+			files, err := NewLogFileWriterFromOptions(options)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", format, err)
+			}
+			r := NewReportFileLogger(filename, ReportFormats[format])
+			r.Files = files
+			return r, nil
+		})
+	}
+}
+
+// NewReportFileLogger returns a pointer to a ReportFileLogger struct
+func NewReportFileLogger(filename string, format ReportFormatter) *ReportFileLogger {
+	return &ReportFileLogger{
+		Filename:         filename,
+		Format:           format,
+		Files:            NewLogFileWriter(),
+		stopChan:         make(chan bool),
+		attackReportChan: make(chan *types.Event),
+	}
+}
+
+func (r *ReportFileLogger) Start() {
+	go r.receiveReports()
+}
+
+func (r *ReportFileLogger) Stop() {
+	r.stopChan <- true
+}
+
+func (r *ReportFileLogger) receiveReports() {
+	commit, stopCommits := r.Files.commitTicks()
+	defer stopCommits()
+	for {
+		select {
+		case <-r.stopChan:
+			if err := r.Files.Commit(); err != nil {
+				Warningf("report file logger %s: %s\n", r.Filename, err)
+			}
+			return
+		case <-commit:
+			if err := r.Files.Commit(); err != nil {
+				Warningf("report file logger %s: %s\n", r.Filename, err)
+			}
+		case event := <-r.attackReportChan:
+			if err := r.write(event); err != nil {
+				Warningf("report file logger %s: %s\n", r.Filename, err)
+			}
+		}
+	}
+}
+
+func (r *ReportFileLogger) Log(event *types.Event) {
+	r.attackReportChan <- event
+}
+
+func (r *ReportFileLogger) write(event *types.Event) error {
+	record, err := r.Format(event)
+	if err != nil {
+		return err
+	}
+	return r.Files.Append(r.Filename, append(record, '\n'))
+}
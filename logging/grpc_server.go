@@ -0,0 +1,162 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// GRPC_SUBSCRIBE_METHOD is the path of the server streaming method
+// Subscribe of the honeybadger.Events service in honeybadger.proto.
+const GRPC_SUBSCRIBE_METHOD = "/honeybadger.Events/Subscribe"
+
+// GRPCServer is an http.Handler serving the honeybadger.Events gRPC
+// service, pushing the events of an EventStream to subscribed clients.
+// gRPC needs HTTP/2, which net/http only serves over TLS;
+// see ListenAndServeTLS.
+type GRPCServer struct {
+	Stream *EventStream
+}
+
+// NewGRPCServer returns a pointer to a GRPCServer struct serving the events of stream.
+func NewGRPCServer(stream *EventStream) *GRPCServer {
+	return &GRPCServer{Stream: stream}
+}
+
+// ListenAndServeTLS serves the gRPC service on addr until it fails.
+func (g *GRPCServer) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: g,
+	}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// WriteGRPCStatus ends a response with a gRPC status in its trailers.
+func WriteGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Grpc-Status", fmt.Sprintf("%d", code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", message)
+	}
+}
+
+// The gRPC status codes of the errors of the services.
+const (
+	GRPC_INVALID_ARGUMENT    = 3
+	GRPC_NOT_FOUND           = 5
+	GRPC_FAILED_PRECONDITION = 9
+	GRPC_UNIMPLEMENTED       = 12
+)
+
+// ReadGRPCMessage reads a single length prefixed message of a gRPC request.
+func ReadGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("compressed messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > 1024*1024 {
+		return nil, fmt.Errorf("message of %d bytes is too large", length)
+	}
+	message := make([]byte, length)
+	_, err := io.ReadFull(r, message)
+	return message, err
+}
+
+// WriteGRPCMessage writes a single length prefixed message of a gRPC call.
+func WriteGRPCMessage(w io.Writer, message []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(message)
+	return err
+}
+
+func (g *GRPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2 POST requests", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	if r.URL.Path != GRPC_SUBSCRIBE_METHOD {
+		w.WriteHeader(http.StatusOK)
+		WriteGRPCStatus(w, GRPC_UNIMPLEMENTED, "unknown method "+r.URL.Path)
+		return
+	}
+	request, err := ReadGRPCMessage(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusOK)
+		WriteGRPCStatus(w, GRPC_INVALID_ARGUMENT, err.Error())
+		return
+	}
+	var eventTypes, networks []string
+	err = ProtoFields(request, func(field int, varint uint64, contents []byte) error {
+		switch field {
+		case 1:
+			eventTypes = append(eventTypes, string(contents))
+		case 2:
+			networks = append(networks, string(contents))
+		}
+		return nil
+	})
+	var filter *EventFilter
+	if err == nil {
+		filter, err = ParseEventFilter(eventTypes, networks)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusOK)
+		WriteGRPCStatus(w, GRPC_INVALID_ARGUMENT, err.Error())
+		return
+	}
+
+	subscription := g.Stream.Subscribe(filter)
+	defer g.Stream.Unsubscribe(subscription)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-subscription.Events:
+			if !ok {
+				WriteGRPCStatus(w, 0, "")
+				return
+			}
+			if err := WriteGRPCMessage(w, EncodeEventProto(event)); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
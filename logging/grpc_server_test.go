@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGRPCServer(t *testing.T) {
+	stream := NewEventStream(10)
+	server := httptest.NewUnstartedServer(NewGRPCServer(stream))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	var request protoEncoder
+	request.string(1, "handshake")
+	request.string(2, "2.3.4.0/24")
+	var body bytes.Buffer
+	WriteGRPCMessage(&body, request.b)
+	httpRequest, _ := http.NewRequest("POST", server.URL+GRPC_SUBSCRIBE_METHOD, &body)
+	httpRequest.Header.Set("Content-Type", "application/grpc")
+	response, err := server.Client().Do(httpRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got %s", response.Proto)
+	}
+
+	// the response headers are flushed once the subscription is made
+	excluded := testReportEvent()
+	excluded.Type = "segment veto or sloppy injection"
+	stream.Log(excluded)
+	stream.Log(testReportEvent())
+
+	done := make(chan []byte)
+	go func() {
+		message, err := ReadGRPCMessage(response.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- message
+	}()
+	select {
+	case message := <-done:
+		attack := protoField(t, message, 2)
+		eventType := string(protoField(t, attack, 1))
+		if eventType != "handshake-hijack" {
+			t.Errorf("streamed event of type %q", eventType)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event streamed")
+	}
+}
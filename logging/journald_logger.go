@@ -0,0 +1,257 @@
+//go:build linux
+// +build linux
+
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// JOURNALD_SOCKET is the socket of the native protocol of systemd-journald.
+const JOURNALD_SOCKET = "/run/systemd/journal/socket"
+
+// JournaldAttackLogger writes attack reports to the systemd journal over
+// its native protocol, as entries whose structured fields can be filtered
+// on by journalctl without a separate log pipeline, for instance
+//
+//	journalctl SYSLOG_IDENTIFIER=honeybadger DETECTOR=handshake CONFIDENCE=high
+//
+// Each entry has a MESSAGE summarizing the report, the fields ATTACK_TYPE,
+// DETECTOR, CONFIDENCE, FLOW, SRC_IP, SRC_PORT, DST_IP, DST_PORT,
+// PACKET_COUNT and SENSOR, and a REPORT field holding the report rendered
+// by Format, AttackReport JSON unless set otherwise. The PRIORITY of a
+// report is that set for its type, else that of its detector, else Priority.
+type JournaldAttackLogger struct {
+	Socket     string
+	Identifier string
+	Format     ReportFormatter
+	Priority   int
+	Priorities map[string]int
+
+	conn             *net.UnixConn
+	stopChan         chan bool
+	attackReportChan chan *types.Event
+}
+
+func init() {
+	AttackLoggerRegister("journald", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewJournaldAttackLoggerFromOptions(options)
+	})
+}
+
+// NewJournaldAttackLogger returns a pointer to a JournaldAttackLogger struct
+// writing to the journal's socket with the priority alert.
+func NewJournaldAttackLogger() *JournaldAttackLogger {
+	return &JournaldAttackLogger{
+		Socket:           JOURNALD_SOCKET,
+		Identifier:       "honeybadger",
+		Format:           FormatJSON,
+		Priority:         syslogSeverities["alert"],
+		Priorities:       make(map[string]int),
+		stopChan:         make(chan bool),
+		attackReportChan: make(chan *types.Event),
+	}
+}
+
+// NewJournaldAttackLoggerFromOptions returns a JournaldAttackLogger configured
+// by the backend parameters socket, identifier, format, priority and
+// priority.<type or detector>; priorities are named as syslog severities.
+func NewJournaldAttackLoggerFromOptions(options *AttackLoggerOptions) (*JournaldAttackLogger, error) {
+	j := NewJournaldAttackLogger()
+	j.Socket = options.Param("socket", j.Socket)
+	j.Identifier = options.Param("identifier", j.Identifier)
+	format, err := reportFormat(options.Param("format", "json"))
+	if err != nil {
+		return nil, err
+	}
+	j.Format = format
+	for key, value := range options.Params {
+		if key != "priority" && !strings.HasPrefix(key, "priority.") {
+			continue
+		}
+		priority, ok := syslogSeverities[value]
+		if !ok {
+			return nil, fmt.Errorf("journald: unknown priority %q", value)
+		}
+		if key == "priority" {
+			j.Priority = priority
+		} else {
+			j.Priorities[strings.TrimPrefix(key, "priority.")] = priority
+		}
+	}
+	return j, nil
+}
+
+func (j *JournaldAttackLogger) Start() {
+	go j.receiveReports()
+}
+
+func (j *JournaldAttackLogger) Stop() {
+	j.stopChan <- true
+}
+
+func (j *JournaldAttackLogger) receiveReports() {
+	for {
+		select {
+		case <-j.stopChan:
+			if j.conn != nil {
+				j.conn.Close()
+				j.conn = nil
+			}
+			return
+		case event := <-j.attackReportChan:
+			if err := j.send(event); err != nil {
+				backendWarningf("journald", "%s\n", err)
+			}
+		}
+	}
+}
+
+func (j *JournaldAttackLogger) Log(event *types.Event) {
+	j.attackReportChan <- event
+}
+
+// priority returns the PRIORITY of a report of the given type.
+func (j *JournaldAttackLogger) priority(eventType string) int {
+	if priority, ok := j.Priorities[eventType]; ok {
+		return priority
+	}
+	if priority, ok := j.Priorities[detectorOf(eventType)]; ok {
+		return priority
+	}
+	return j.Priority
+}
+
+// Entry returns the journal entry of an attack report
+// serialized in the journal's native protocol.
+func (j *JournaldAttackLogger) Entry(event *types.Event) ([]byte, error) {
+	record, err := j.Format(event)
+	if err != nil {
+		return nil, err
+	}
+	report := NewAttackReport(event)
+	flow := logFlowName(&event.Flow)
+	confidence := reportConfidence(report.Detector)
+	fields := [][2]string{
+		{"MESSAGE", fmt.Sprintf("%s detected by the %s detector (%s confidence) on %s, %d packets",
+			report.Type, report.Detector, confidence, flow, report.PacketCount)},
+		{"PRIORITY", strconv.Itoa(j.priority(event.Type))},
+		{"SYSLOG_IDENTIFIER", j.Identifier},
+		{"ATTACK_TYPE", report.Type},
+		{"DETECTOR", report.Detector},
+		{"CONFIDENCE", confidence},
+		{"FLOW", flow},
+		{"SRC_IP", report.Flow.SrcIP},
+		{"SRC_PORT", strconv.Itoa(int(report.Flow.SrcPort))},
+		{"DST_IP", report.Flow.DstIP},
+		{"DST_PORT", strconv.Itoa(int(report.Flow.DstPort))},
+		{"PACKET_COUNT", strconv.FormatUint(report.PacketCount, 10)},
+		{"SENSOR", report.Sensor.ID},
+		{"REPORT", string(record)},
+	}
+	var entry bytes.Buffer
+	for _, field := range fields {
+		journalField(&entry, field[0], field[1])
+	}
+	return entry.Bytes(), nil
+}
+
+// journalField appends a field to a journal entry, as KEY=value unless
+// its value spans lines; it is then prefixed by its length instead.
+func journalField(entry *bytes.Buffer, key, value string) {
+	entry.WriteString(key)
+	if strings.Contains(value, "\n") {
+		entry.WriteByte('\n')
+		binary.Write(entry, binary.LittleEndian, uint64(len(value)))
+	} else {
+		entry.WriteByte('=')
+	}
+	entry.WriteString(value)
+	entry.WriteByte('\n')
+}
+
+// send writes a report to the journal, connecting or, once,
+// reconnecting as needed.
+func (j *JournaldAttackLogger) send(event *types.Event) error {
+	entry, err := j.Entry(event)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		if j.conn == nil {
+			if j.conn, err = net.DialUnix("unixgram", nil, &net.UnixAddr{Name: j.Socket, Net: "unixgram"}); err != nil {
+				return err
+			}
+		}
+		_, err = j.conn.Write(entry)
+		if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+			return j.sendFile(entry)
+		}
+		if err == nil || attempt > 0 {
+			return err
+		}
+		j.conn.Close()
+		j.conn = nil
+	}
+}
+
+// sendFile passes an entry too large for a datagram to the journal as
+// the descriptor of an unlinked temporary file holding it, as
+// sd_journal_send does.
+func (j *JournaldAttackLogger) sendFile(entry []byte) error {
+	dir := "/dev/shm"
+	if _, err := os.Stat(dir); err != nil {
+		dir = ""
+	}
+	file, err := ioutil.TempFile(dir, "honeybadger-journal")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	os.Remove(file.Name())
+	if _, err := file.Write(entry); err != nil {
+		return err
+	}
+	raw, err := j.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	rights := syscall.UnixRights(int(file.Fd()))
+	if controlErr := raw.Write(func(fd uintptr) bool {
+		err = syscall.Sendmsg(int(fd), nil, rights, nil, 0)
+		return err != syscall.EAGAIN
+	}); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
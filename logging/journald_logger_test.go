@@ -0,0 +1,146 @@
+//go:build linux
+// +build linux
+
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// parseJournalEntry parses an entry of the journal's native protocol.
+func parseJournalEntry(t *testing.T, entry []byte) map[string]string {
+	fields := make(map[string]string)
+	for len(entry) > 0 {
+		end := bytes.IndexAny(entry, "=\n")
+		if end < 0 {
+			t.Fatalf("truncated journal entry %q", entry)
+		}
+		key := string(entry[:end])
+		if entry[end] == '=' {
+			value := entry[end+1:]
+			eol := bytes.IndexByte(value, '\n')
+			fields[key], entry = string(value[:eol]), value[eol+1:]
+			continue
+		}
+		size := binary.LittleEndian.Uint64(entry[end+1 : end+9])
+		value := entry[end+9:]
+		fields[key], entry = string(value[:size]), value[size+1:]
+	}
+	return fields
+}
+
+// receiveJournalEntry reads an entry from a journal socket,
+// whether sent as a datagram or as a file descriptor.
+func receiveJournalEntry(t *testing.T, server *net.UnixConn) map[string]string {
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1<<16)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := server.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oobn == 0 {
+		return parseJournalEntry(t, buf[:n])
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := os.NewFile(uintptr(fds[0]), "journal entry")
+	defer file.Close()
+	// the journal reads the file from its start; its offset,
+	// shared with the sender, is at its end
+	if _, err := file.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseJournalEntry(t, entry)
+}
+
+func TestJournaldAttackLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journald")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "socket")
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	logger, err := NewJournaldAttackLoggerFromOptions(&AttackLoggerOptions{
+		Params: map[string]string{
+			"socket":             socket,
+			"priority":           "warning",
+			"priority.handshake": "crit",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Start()
+	defer logger.Stop()
+
+	logger.Log(testReportEvent())
+	fields := receiveJournalEntry(t, server)
+	expected := map[string]string{
+		"PRIORITY":          "2",
+		"SYSLOG_IDENTIFIER": "honeybadger",
+		"ATTACK_TYPE":       "handshake-hijack",
+		"DETECTOR":          "handshake",
+		"CONFIDENCE":        "high",
+		"FLOW":              "1.2.3.4:1-2.3.4.5:2",
+		"SRC_IP":            "1.2.3.4",
+		"DST_PORT":          "2",
+		"SENSOR":            Sensor,
+	}
+	for key, value := range expected {
+		if fields[key] != value {
+			t.Errorf("field %s is %q, expected %q", key, fields[key], value)
+		}
+	}
+	if !strings.HasPrefix(fields["MESSAGE"], "handshake-hijack detected by the handshake detector (high confidence) on 1.2.3.4:1-2.3.4.5:2") {
+		t.Errorf("unexpected message %q", fields["MESSAGE"])
+	}
+	if !strings.HasPrefix(fields["REPORT"], "{\"schema_version\":1") {
+		t.Errorf("unexpected report %q", fields["REPORT"])
+	}
+
+	// fields spanning lines are length prefixed
+	var entry bytes.Buffer
+	journalField(&entry, "PAYLOAD", "honey\nbadger")
+	journalField(&entry, "ATTACK_TYPE", "handshake-hijack")
+	if fields := parseJournalEntry(t, entry.Bytes()); fields["PAYLOAD"] != "honey\nbadger" || fields["ATTACK_TYPE"] != "handshake-hijack" {
+		t.Errorf("multi-line field entry %q", entry.Bytes())
+	}
+
+	// entries too large for a datagram are passed as a file
+	event := testReportEvent()
+	event.Payload = bytes.Repeat([]byte{'A'}, 1<<20)
+	logger.Log(event)
+	if fields := receiveJournalEntry(t, server); fields["ATTACK_TYPE"] != "handshake-hijack" || len(fields["REPORT"]) < 1<<20 {
+		t.Errorf("large entry sent with a %d byte report", len(fields["REPORT"]))
+	}
+
+	if _, err := NewJournaldAttackLoggerFromOptions(&AttackLoggerOptions{Params: map[string]string{"priority": "bogus"}}); err == nil {
+		t.Error("expected an error for an unknown priority")
+	}
+}
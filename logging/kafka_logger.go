@@ -0,0 +1,355 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// KafkaAttackLogger publishes attack reports, rendered by Format as
+// AttackReport JSON unless set otherwise, to a Kafka topic. Messages are keyed by flow and partitioned by a hash of
+// the connection, so the reports of a connection stay in order on one
+// partition. Connection events, such as evictions, are only published if
+// ConnectionTopic is set, to that topic.
+//
+// Acks sets the delivery guarantee: 0 sends without waiting for the broker
+// (at most once), 1 waits for the partition leader and -1 for all in sync
+// replicas. Batches which are not acknowledged are retried up to Retries
+// times, refreshing the cluster metadata in between.
+type KafkaAttackLogger struct {
+	Brokers         []string
+	Topic           string
+	ConnectionTopic string
+	ClientID        string
+	Acks            int16
+	Timeout         time.Duration
+	TLS             *tls.Config
+	SASLUsername    string
+	SASLPassword    string
+	BatchSize       int
+	FlushInterval   time.Duration
+	Retries         int
+	Backoff         time.Duration
+	Format          ReportFormatter
+
+	metadata         *kafkaMetadata
+	conns            map[int32]*kafkaConn
+	stopChan         chan bool
+	doneChan         chan bool
+	attackReportChan chan *types.Event
+}
+
+func init() {
+	AttackLoggerRegister("kafka", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewKafkaAttackLoggerFromOptions(options)
+	})
+}
+
+// NewKafkaAttackLogger returns a pointer to a KafkaAttackLogger struct
+// publishing to topic through the given bootstrap brokers.
+func NewKafkaAttackLogger(brokers []string, topic string) *KafkaAttackLogger {
+	return &KafkaAttackLogger{
+		Brokers:          brokers,
+		Topic:            topic,
+		ClientID:         "honeybadger",
+		Acks:             -1,
+		Timeout:          10 * time.Second,
+		BatchSize:        500,
+		FlushInterval:    time.Second,
+		Retries:          5,
+		Backoff:          500 * time.Millisecond,
+		Format:           FormatJSON,
+		conns:            make(map[int32]*kafkaConn),
+		stopChan:         make(chan bool),
+		doneChan:         make(chan bool),
+		attackReportChan: make(chan *types.Event, 10000),
+	}
+}
+
+// NewKafkaAttackLoggerFromOptions returns a KafkaAttackLogger configured by the
+// backend parameters brokers (separated by "|"), topic, connection_topic,
+// format, client_id, acks (0, 1 or all), timeout, tls, ca, sasl_username,
+// sasl_password, batch_size, flush_interval, retries and backoff.
+func NewKafkaAttackLoggerFromOptions(options *AttackLoggerOptions) (*KafkaAttackLogger, error) {
+	k := NewKafkaAttackLogger(strings.Split(options.Param("brokers", "localhost:9092"), "|"),
+		options.Param("topic", "honeybadger"))
+	k.ConnectionTopic = options.Param("connection_topic", "")
+	k.ClientID = options.Param("client_id", k.ClientID)
+	k.SASLUsername = options.Param("sasl_username", "")
+	k.SASLPassword = options.Param("sasl_password", "")
+	switch acks := options.Param("acks", "all"); acks {
+	case "all", "-1":
+		k.Acks = -1
+	case "0":
+		k.Acks = 0
+	case "1":
+		k.Acks = 1
+	default:
+		return nil, fmt.Errorf("kafka: invalid acks %q; one of 0, 1, all", acks)
+	}
+	var err error
+	if k.Format, err = reportFormat(options.Param("format", "json")); err != nil {
+		return nil, err
+	}
+	if k.BatchSize, err = strconv.Atoi(options.Param("batch_size", strconv.Itoa(k.BatchSize))); err != nil {
+		return nil, fmt.Errorf("kafka: invalid batch_size: %s", err)
+	}
+	if k.Retries, err = strconv.Atoi(options.Param("retries", strconv.Itoa(k.Retries))); err != nil {
+		return nil, fmt.Errorf("kafka: invalid retries: %s", err)
+	}
+	if k.Timeout, err = time.ParseDuration(options.Param("timeout", k.Timeout.String())); err != nil {
+		return nil, fmt.Errorf("kafka: invalid timeout: %s", err)
+	}
+	if k.FlushInterval, err = time.ParseDuration(options.Param("flush_interval", k.FlushInterval.String())); err != nil {
+		return nil, fmt.Errorf("kafka: invalid flush_interval: %s", err)
+	}
+	if k.Backoff, err = time.ParseDuration(options.Param("backoff", k.Backoff.String())); err != nil {
+		return nil, fmt.Errorf("kafka: invalid backoff: %s", err)
+	}
+	if options.Param("tls", "") == "true" || options.Param("ca", "") != "" {
+		k.TLS = &tls.Config{}
+		if ca := options.Param("ca", ""); ca != "" {
+			pem, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return nil, err
+			}
+			k.TLS.RootCAs = x509.NewCertPool()
+			if !k.TLS.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("kafka: no certificates found in %s", ca)
+			}
+		}
+	}
+	return k, nil
+}
+
+func (k *KafkaAttackLogger) Start() {
+	go k.receiveReports()
+}
+
+// Stop flushes the queued reports and returns once they are sent.
+func (k *KafkaAttackLogger) Stop() {
+	k.stopChan <- true
+	<-k.doneChan
+}
+
+func (k *KafkaAttackLogger) Log(event *types.Event) {
+	k.attackReportChan <- event
+}
+
+func (k *KafkaAttackLogger) receiveReports() {
+	ticker := time.NewTicker(k.FlushInterval)
+	defer ticker.Stop()
+	var batch []*types.Event
+	for {
+		select {
+		case <-k.stopChan:
+			for len(k.attackReportChan) > 0 {
+				batch = append(batch, <-k.attackReportChan)
+			}
+			k.flush(batch)
+			k.closeConns()
+			k.doneChan <- true
+			return
+		case event := <-k.attackReportChan:
+			batch = append(batch, event)
+			if len(batch) >= k.BatchSize {
+				k.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			k.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+// kafkaMessage is a report waiting to be published.
+type kafkaMessage struct {
+	topic  string
+	hash   uint64
+	record kafkaRecord
+}
+
+// messages returns the messages to be published for a batch of reports.
+func (k *KafkaAttackLogger) messages(batch []*types.Event) []kafkaMessage {
+	var messages []kafkaMessage
+	for _, event := range batch {
+		topic := k.Topic
+		if detectorOf(event.Type) == "dispatcher" {
+			if k.ConnectionTopic == "" {
+				continue
+			}
+			topic = k.ConnectionTopic
+		}
+		value, err := k.Format(event)
+		if err != nil {
+			backendWarningf("kafka", "%s\n", err)
+			continue
+		}
+		timestamp := event.Time
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+		messages = append(messages, kafkaMessage{
+			topic: topic,
+			hash:  flowID(&event.Flow),
+			record: kafkaRecord{
+				Key:   []byte(event.Flow.String()),
+				Value: value,
+				Time:  timestamp,
+			},
+		})
+	}
+	return messages
+}
+
+func (k *KafkaAttackLogger) flush(batch []*types.Event) {
+	messages := k.messages(batch)
+	for attempt := 0; len(messages) > 0; attempt++ {
+		var err error
+		messages, err = k.publish(messages)
+		if err != nil {
+			backendWarningf("kafka", "%s\n", err)
+		}
+		if len(messages) == 0 {
+			return
+		}
+		// the cluster layout may have changed
+		k.metadata = nil
+		k.closeConns()
+		if attempt >= k.Retries {
+			backendWarningf("kafka", "giving up on %d reports\n", len(messages))
+			return
+		}
+		time.Sleep(k.Backoff << uint(attempt))
+	}
+}
+
+// publish sends the messages to their partition leaders and returns the messages not acknowledged.
+func (k *KafkaAttackLogger) publish(messages []kafkaMessage) ([]kafkaMessage, error) {
+	if k.metadata == nil {
+		if err := k.refreshMetadata(); err != nil {
+			return messages, err
+		}
+	}
+	pending := make(map[kafkaPartition][]kafkaMessage)
+	for _, message := range messages {
+		leaders := k.metadata.Leaders[message.topic]
+		if len(leaders) == 0 {
+			return messages, fmt.Errorf("topic %s has no partitions", message.topic)
+		}
+		p := kafkaPartition{Topic: message.topic, Partition: int32(message.hash % uint64(len(leaders)))}
+		pending[p] = append(pending[p], message)
+	}
+	byLeader := make(map[int32]map[kafkaPartition][]byte)
+	for p, partitionMessages := range pending {
+		leader := k.metadata.Leaders[p.Topic][p.Partition]
+		if byLeader[leader] == nil {
+			byLeader[leader] = make(map[kafkaPartition][]byte)
+		}
+		records := make([]kafkaRecord, len(partitionMessages))
+		for i := range partitionMessages {
+			records[i] = partitionMessages[i].record
+		}
+		byLeader[leader][p] = encodeRecordBatch(records)
+	}
+	var retry []kafkaMessage
+	var lastErr error
+	for leader, batches := range byLeader {
+		failed, err := k.produce(leader, batches)
+		if err != nil {
+			lastErr = err
+			for p := range batches {
+				retry = append(retry, pending[p]...)
+			}
+			continue
+		}
+		for _, p := range failed {
+			retry = append(retry, pending[p]...)
+		}
+	}
+	return retry, lastErr
+}
+
+func (k *KafkaAttackLogger) produce(leader int32, batches map[kafkaPartition][]byte) ([]kafkaPartition, error) {
+	conn, ok := k.conns[leader]
+	if !ok {
+		address, ok := k.metadata.Brokers[leader]
+		if !ok {
+			return nil, fmt.Errorf("no address for broker %d", leader)
+		}
+		var err error
+		if conn, err = k.dial(address); err != nil {
+			return nil, err
+		}
+		k.conns[leader] = conn
+	}
+	return conn.produce(k.Acks, k.Timeout, batches)
+}
+
+func (k *KafkaAttackLogger) dial(address string) (*kafkaConn, error) {
+	conn, err := dialKafka(address, k.ClientID, k.Timeout, k.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if k.SASLUsername != "" {
+		if err := conn.saslPlain(k.SASLUsername, k.SASLPassword); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// refreshMetadata fetches the cluster layout from the first bootstrap broker that answers.
+func (k *KafkaAttackLogger) refreshMetadata() error {
+	topics := []string{k.Topic}
+	if k.ConnectionTopic != "" {
+		topics = append(topics, k.ConnectionTopic)
+	}
+	var err error
+	for _, address := range k.Brokers {
+		var conn *kafkaConn
+		if conn, err = k.dial(strings.TrimSpace(address)); err != nil {
+			continue
+		}
+		k.metadata, err = conn.metadata(topics)
+		conn.Close()
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no bootstrap broker answered: %v", err)
+}
+
+func (k *KafkaAttackLogger) closeConns() {
+	for id, conn := range k.conns {
+		conn.Close()
+		delete(k.conns, id)
+	}
+}
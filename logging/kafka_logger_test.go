@@ -0,0 +1,166 @@
+package logging
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeKafkaBroker answers Metadata requests with a single broker leading
+// both partitions of every topic and records the messages it is sent.
+type fakeKafkaBroker struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	messages map[kafkaPartition][]string
+}
+
+func newFakeKafkaBroker(t *testing.T) *fakeKafkaBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeKafkaBroker{
+		listener: listener,
+		messages: make(map[kafkaPartition][]string),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(t, &kafkaConn{conn: conn})
+		}
+	}()
+	return b
+}
+
+func (b *fakeKafkaBroker) serve(t *testing.T, conn *kafkaConn) {
+	defer conn.Close()
+	for {
+		payload, err := conn.read()
+		if err != nil {
+			return
+		}
+		d := &kafkaDecoder{b: payload}
+		apiKey := d.int16()
+		d.int16() // version
+		correlation := d.int32()
+		d.string() // client id
+
+		var response kafkaEncoder
+		response.int32(correlation)
+		switch apiKey {
+		case KAFKA_API_METADATA:
+			host, port, _ := net.SplitHostPort(b.listener.Addr().String())
+			portNumber, _ := strconv.Atoi(port)
+			response.int32(1)
+			response.int32(0)
+			response.string(host)
+			response.int32(int32(portNumber))
+			topics := d.array()
+			response.int32(int32(topics))
+			for i := 0; i < topics; i++ {
+				response.int16(0)
+				response.string(d.string())
+				response.int32(2)
+				for partition := int32(0); partition < 2; partition++ {
+					response.int16(0)
+					response.int32(partition)
+					response.int32(0)
+					response.int32(0)
+					response.int32(0)
+				}
+			}
+		case KAFKA_API_PRODUCE:
+			d.int16() // transactional id
+			d.int16() // acks
+			d.int32() // timeout
+			topics := d.array()
+			response.int32(int32(topics))
+			for i := 0; i < topics; i++ {
+				topic := d.string()
+				response.string(topic)
+				partitions := d.array()
+				response.int32(int32(partitions))
+				for j := 0; j < partitions; j++ {
+					partition := d.int32()
+					batch := d.next(int(d.int32()))
+					b.record(t, kafkaPartition{Topic: topic, Partition: partition}, batch)
+					response.int32(partition)
+					response.int16(0)
+					response.int64(0)
+					response.int64(-1)
+				}
+			}
+			response.int32(0)
+		}
+		var frame kafkaEncoder
+		frame.bytes(response.Bytes())
+		conn.conn.Write(frame.Bytes())
+	}
+}
+
+func (b *fakeKafkaBroker) record(t *testing.T, p kafkaPartition, batch []byte) {
+	if crc := binary.BigEndian.Uint32(batch[17:21]); crc != crc32.Checksum(batch[21:], castagnoli) {
+		t.Error("record batch checksum mismatch")
+	}
+	count := int(binary.BigEndian.Uint32(batch[57:61]))
+	records := batch[61:]
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i := 0; i < count; i++ {
+		length, n := binary.Varint(records)
+		record := records[n : n+int(length)]
+		records = records[n+int(length):]
+		record = record[1:] // attributes
+		for field := 0; field < 2; field++ {
+			_, n = binary.Varint(record)
+			record = record[n:]
+		}
+		keyLength, n := binary.Varint(record)
+		record = record[n+int(keyLength):]
+		valueLength, n := binary.Varint(record)
+		b.messages[p] = append(b.messages[p], string(record[n:n+int(valueLength)]))
+	}
+}
+
+func TestKafkaAttackLogger(t *testing.T) {
+	broker := newFakeKafkaBroker(t)
+	defer broker.listener.Close()
+
+	logger, err := NewKafkaAttackLoggerFromOptions(&AttackLoggerOptions{
+		Params: map[string]string{
+			"brokers":        broker.listener.Addr().String(),
+			"topic":          "attacks",
+			"flush_interval": "1h",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Start()
+	event := testReportEvent()
+	reverse := *event
+	reverse.Flow = event.Flow.Reverse()
+	logger.Log(event)
+	logger.Log(&reverse)
+	connectionEvent := *event
+	connectionEvent.Type = "connection-eviction"
+	logger.Log(&connectionEvent)
+	logger.Stop()
+
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	if len(broker.messages) != 1 {
+		t.Fatalf("expected the reports of a connection on a single partition, got %v", broker.messages)
+	}
+	for p, messages := range broker.messages {
+		if p.Topic != "attacks" || len(messages) != 2 {
+			t.Errorf("unexpected messages on %v: %v", p, messages)
+		}
+	}
+}
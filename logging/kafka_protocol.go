@@ -0,0 +1,363 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+)
+
+// This file holds the small subset of the Kafka protocol a producer needs:
+// Metadata v0, Produce v3 with version 2 record batches and, for SASL
+// PLAIN authentication, SaslHandshake v0.
+
+const (
+	KAFKA_API_PRODUCE        = 0
+	KAFKA_API_METADATA       = 3
+	KAFKA_API_SASL_HANDSHAKE = 17
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8)   { e.WriteByte(byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { binary.Write(e, binary.BigEndian, v) }
+func (e *kafkaEncoder) int32(v int32) { binary.Write(e, binary.BigEndian, v) }
+func (e *kafkaEncoder) int64(v int64) { binary.Write(e, binary.BigEndian, v) }
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.Write(b)
+}
+
+func (e *kafkaEncoder) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+func (e *kafkaEncoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.Write(b)
+}
+
+var errKafkaShort = errors.New("kafka: short response")
+
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = errKafkaShort
+		return make([]byte, n)
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int16() int16 { return int16(binary.BigEndian.Uint16(d.next(2))) }
+func (d *kafkaDecoder) int32() int32 { return int32(binary.BigEndian.Uint32(d.next(4))) }
+func (d *kafkaDecoder) int64() int64 { return int64(binary.BigEndian.Uint64(d.next(8))) }
+
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// array returns the length of an array, bounded so that
+// a corrupt length can not exhaust memory.
+func (d *kafkaDecoder) array() int {
+	n := d.int32()
+	if n < 0 || int(n) > len(d.b) {
+		if n > 0 {
+			d.err = errKafkaShort
+		}
+		return 0
+	}
+	return int(n)
+}
+
+// kafkaRecord is a single message of a record batch.
+type kafkaRecord struct {
+	Key, Value []byte
+	Time       time.Time
+}
+
+// encodeRecordBatch returns the records as an uncompressed version 2 record batch.
+func encodeRecordBatch(records []kafkaRecord) []byte {
+	first := records[0].Time.UnixNano() / 1e6
+	last := first
+	var body kafkaEncoder
+	for i, record := range records {
+		timestamp := record.Time.UnixNano() / 1e6
+		if timestamp > last {
+			last = timestamp
+		}
+		var r kafkaEncoder
+		r.int8(0) // attributes
+		r.varint(timestamp - first)
+		r.varint(int64(i))
+		r.varbytes(record.Key)
+		r.varbytes(record.Value)
+		r.varint(0) // headers
+		body.varint(int64(r.Len()))
+		body.Write(r.Bytes())
+	}
+
+	var crcd kafkaEncoder
+	crcd.int16(0) // attributes: no compression, CreateTime
+	crcd.int32(int32(len(records) - 1))
+	crcd.int64(first)
+	crcd.int64(last)
+	crcd.int64(-1) // producer id
+	crcd.int16(-1) // producer epoch
+	crcd.int32(-1) // base sequence
+	crcd.int32(int32(len(records)))
+	crcd.Write(body.Bytes())
+
+	var batch kafkaEncoder
+	batch.int64(0) // base offset
+	batch.int32(int32(4 + 1 + 4 + crcd.Len()))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(crcd.Bytes(), castagnoli)))
+	batch.Write(crcd.Bytes())
+	return batch.Bytes()
+}
+
+// kafkaConn is a connection to a single broker.
+type kafkaConn struct {
+	conn        net.Conn
+	clientID    string
+	correlation int32
+	timeout     time.Duration
+}
+
+func dialKafka(address, clientID string, timeout time.Duration, tlsConfig *tls.Config) (*kafkaConn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{conn: conn, clientID: clientID, timeout: timeout}, nil
+}
+
+func (k *kafkaConn) Close() error {
+	return k.conn.Close()
+}
+
+// request sends a request and, if a response is expected, returns its body.
+func (k *kafkaConn) request(apiKey, version int16, body []byte, response bool) (*kafkaDecoder, error) {
+	k.correlation++
+	var header kafkaEncoder
+	header.int16(apiKey)
+	header.int16(version)
+	header.int32(k.correlation)
+	header.string(k.clientID)
+
+	var frame kafkaEncoder
+	frame.int32(int32(header.Len() + len(body)))
+	frame.Write(header.Bytes())
+	frame.Write(body)
+	k.conn.SetDeadline(time.Now().Add(k.timeout))
+	if _, err := k.conn.Write(frame.Bytes()); err != nil {
+		return nil, err
+	}
+	if !response {
+		return nil, nil
+	}
+	payload, err := k.read()
+	if err != nil {
+		return nil, err
+	}
+	d := &kafkaDecoder{b: payload}
+	if correlation := d.int32(); correlation != k.correlation {
+		return nil, fmt.Errorf("kafka: response correlation id %d, expected %d", correlation, k.correlation)
+	}
+	return d, nil
+}
+
+func (k *kafkaConn) read() ([]byte, error) {
+	var size int32
+	if err := binary.Read(k.conn, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 0 || size > 64*1024*1024 {
+		return nil, fmt.Errorf("kafka: invalid response size %d", size)
+	}
+	payload := make([]byte, size)
+	_, err := io.ReadFull(k.conn, payload)
+	return payload, err
+}
+
+// saslPlain authenticates the connection with the SASL PLAIN mechanism.
+func (k *kafkaConn) saslPlain(username, password string) error {
+	var body kafkaEncoder
+	body.string("PLAIN")
+	d, err := k.request(KAFKA_API_SASL_HANDSHAKE, 0, body.Bytes(), true)
+	if err != nil {
+		return err
+	}
+	if code := d.int16(); code != 0 {
+		return fmt.Errorf("kafka: SASL handshake failed with error code %d", code)
+	}
+	var token kafkaEncoder
+	token.bytes([]byte("\x00" + username + "\x00" + password))
+	k.conn.SetDeadline(time.Now().Add(k.timeout))
+	if _, err := k.conn.Write(token.Bytes()); err != nil {
+		return err
+	}
+	if _, err := k.read(); err != nil {
+		return fmt.Errorf("kafka: SASL authentication failed: %s", err)
+	}
+	return nil
+}
+
+// kafkaMetadata is the cluster layout a Metadata response describes.
+type kafkaMetadata struct {
+	Brokers map[int32]string
+	// Leaders holds, for each topic, the leader of each partition;
+	// the partitions being numbered from zero.
+	Leaders map[string][]int32
+}
+
+func (k *kafkaConn) metadata(topics []string) (*kafkaMetadata, error) {
+	var body kafkaEncoder
+	body.int32(int32(len(topics)))
+	for _, topic := range topics {
+		body.string(topic)
+	}
+	d, err := k.request(KAFKA_API_METADATA, 0, body.Bytes(), true)
+	if err != nil {
+		return nil, err
+	}
+	m := kafkaMetadata{
+		Brokers: make(map[int32]string),
+		Leaders: make(map[string][]int32),
+	}
+	for i, n := 0, d.array(); i < n; i++ {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		m.Brokers[id] = net.JoinHostPort(host, fmt.Sprintf("%d", port))
+	}
+	for i, n := 0, d.array(); i < n; i++ {
+		code := d.int16()
+		topic := d.string()
+		partitions := d.array()
+		leaders := make([]int32, partitions)
+		for j := 0; j < partitions; j++ {
+			d.int16() // partition error code
+			partition := d.int32()
+			leader := d.int32()
+			for r, replicas := 0, d.array(); r < replicas; r++ {
+				d.int32()
+			}
+			for r, isr := 0, d.array(); r < isr; r++ {
+				d.int32()
+			}
+			if partition >= 0 && int(partition) < partitions {
+				leaders[partition] = leader
+			}
+		}
+		if code != 0 {
+			return nil, fmt.Errorf("kafka: metadata for topic %s has error code %d", topic, code)
+		}
+		m.Leaders[topic] = leaders
+	}
+	return &m, d.err
+}
+
+// kafkaPartition names a partition of a topic.
+type kafkaPartition struct {
+	Topic     string
+	Partition int32
+}
+
+// produce sends record batches to the partitions this broker leads and
+// returns the partitions whose batches were not accepted. With acks 0 the
+// broker sends no response and every batch is assumed accepted.
+func (k *kafkaConn) produce(acks int16, timeout time.Duration, batches map[kafkaPartition][]byte) ([]kafkaPartition, error) {
+	topics := make(map[string][]kafkaPartition)
+	for p := range batches {
+		topics[p.Topic] = append(topics[p.Topic], p)
+	}
+	var body kafkaEncoder
+	body.int16(-1) // transactional id
+	body.int16(acks)
+	body.int32(int32(timeout / time.Millisecond))
+	body.int32(int32(len(topics)))
+	for topic, partitions := range topics {
+		body.string(topic)
+		body.int32(int32(len(partitions)))
+		for _, p := range partitions {
+			body.int32(p.Partition)
+			body.bytes(batches[p])
+		}
+	}
+	d, err := k.request(KAFKA_API_PRODUCE, 3, body.Bytes(), acks != 0)
+	if err != nil || d == nil {
+		return nil, err
+	}
+	var failed []kafkaPartition
+	for i, n := 0, d.array(); i < n; i++ {
+		topic := d.string()
+		for j, partitions := 0, d.array(); j < partitions; j++ {
+			partition := d.int32()
+			code := d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+			if code != 0 {
+				failed = append(failed, kafkaPartition{Topic: topic, Partition: partition})
+			}
+		}
+	}
+	return failed, d.err
+}
@@ -0,0 +1,234 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// Levels of the diagnostic log, in increasing order of severity:
+	// the detail of the analysis of each packet,
+	LOG_DEBUG = 0
+	// the sensor's operation,
+	LOG_INFO = 1
+	// problems the sensor recovers from,
+	LOG_WARNING = 2
+	// and failures. Logging at LOG_SILENT discards every message.
+	LOG_ERROR  = 3
+	LOG_SILENT = 4
+)
+
+var logLevelNames = []string{"debug", "info", "warning", "error", "silent"}
+
+// RECENT_ERRORS is the number of warning and error messages kept for RecentErrors.
+const RECENT_ERRORS = 100
+
+// ParseLogLevel returns the log level for the given name;
+// one of "debug", "info", "warning", "error" or "silent".
+func ParseLogLevel(name string) (int, error) {
+	for level, levelName := range logLevelNames {
+		if name == levelName {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// LogFields are the structured fields of a diagnostic log message:
+// the connection it is about, the connection's TCP state and the
+// detector reporting it. Fields left empty are not logged.
+type LogFields struct {
+	Flow     *types.TcpIpFlow
+	State    string
+	Detector string
+}
+
+// diagnostics is the destination of the diagnostic log and holds the
+// most recent warning and error messages logged.
+var diagnostics = struct {
+	sync.Mutex
+	out        io.Writer
+	debugFlows map[string]bool
+	errors     []string
+	nextError  int
+}{out: os.Stderr}
+
+var (
+	logLevel       int32 = LOG_INFO
+	debugFlowCount int32
+)
+
+// SetLogLevel discards the diagnostic log messages below the given level.
+func SetLogLevel(level int) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+// SetLogOutput sends the diagnostic log, and that of the standard
+// library's log package, to w.
+func SetLogOutput(w io.Writer) {
+	diagnostics.Lock()
+	defer diagnostics.Unlock()
+	diagnostics.out = w
+	log.SetOutput(w)
+}
+
+// SetDebugFlows raises the connections of the given flows, of either
+// direction such as 10.0.0.1:5000-10.0.0.2:80, to the debug level:
+// all of their messages are logged whatever the log level.
+func SetDebugFlows(flows []string) {
+	diagnostics.Lock()
+	defer diagnostics.Unlock()
+	diagnostics.debugFlows = make(map[string]bool)
+	for _, flow := range flows {
+		if flow = strings.TrimSpace(flow); flow != "" {
+			diagnostics.debugFlows[flow] = true
+		}
+	}
+	atomic.StoreInt32(&debugFlowCount, int32(len(diagnostics.debugFlows)))
+}
+
+// LogEnabled returns true if messages of the given level about the
+// given flow, which may be nil, are logged. Callers logging for every
+// packet check it before preparing their message.
+func LogEnabled(level int, flow *types.TcpIpFlow) bool {
+	if level >= int(atomic.LoadInt32(&logLevel)) {
+		return true
+	}
+	if flow == nil || atomic.LoadInt32(&debugFlowCount) == 0 {
+		return false
+	}
+	name := logFlowName(flow)
+	reverse := flow.Reverse()
+	diagnostics.Lock()
+	defer diagnostics.Unlock()
+	return diagnostics.debugFlows[name] || diagnostics.debugFlows[logFlowName(&reverse)]
+}
+
+// Logf logs a message at the given level with the given fields,
+// which may be nil, unless messages of that level are discarded.
+func Logf(level int, fields *LogFields, format string, args ...interface{}) {
+	var flow *types.TcpIpFlow
+	if fields != nil {
+		flow = fields.Flow
+	}
+	if level < LOG_DEBUG || level >= LOG_SILENT || !LogEnabled(level, flow) {
+		return
+	}
+	var line bytes.Buffer
+	line.WriteString(time.Now().UTC().Format("2006-01-02T15:04:05.000Z"))
+	writeLogField(&line, "level", logLevelNames[level])
+	if fields != nil {
+		if fields.Flow != nil {
+			writeLogField(&line, "flow", logFlowName(fields.Flow))
+		}
+		writeLogField(&line, "state", fields.State)
+		writeLogField(&line, "detector", fields.Detector)
+	}
+	writeLogField(&line, "msg", strings.TrimRight(fmt.Sprintf(format, args...), "\n"))
+	line.WriteByte('\n')
+
+	diagnostics.Lock()
+	defer diagnostics.Unlock()
+	diagnostics.out.Write(line.Bytes())
+	if level >= LOG_WARNING {
+		message := strings.TrimRight(line.String(), "\n")
+		if len(diagnostics.errors) < RECENT_ERRORS {
+			diagnostics.errors = append(diagnostics.errors, message)
+		} else {
+			diagnostics.errors[diagnostics.nextError] = message
+			diagnostics.nextError = (diagnostics.nextError + 1) % RECENT_ERRORS
+		}
+	}
+}
+
+// RecentErrors returns the most recent warning and error messages
+// logged, up to RECENT_ERRORS of them, oldest first.
+func RecentErrors() []string {
+	diagnostics.Lock()
+	defer diagnostics.Unlock()
+	errors := make([]string, 0, len(diagnostics.errors))
+	for i := range diagnostics.errors {
+		errors = append(errors, diagnostics.errors[(diagnostics.nextError+i)%len(diagnostics.errors)])
+	}
+	return errors
+}
+
+// WriteDiagnostics writes p to the diagnostic log as is, whatever the log level.
+func WriteDiagnostics(p []byte) {
+	diagnostics.Lock()
+	defer diagnostics.Unlock()
+	diagnostics.out.Write(p)
+}
+
+// logFlowName returns the name of a flow, or "invalid" if its endpoints,
+// such as those of a malformed packet, cannot be formatted.
+func logFlowName(flow *types.TcpIpFlow) (name string) {
+	defer func() {
+		if recover() != nil {
+			name = "invalid"
+		}
+	}()
+	return flow.String()
+}
+
+// writeLogField appends a key=value field to a log line, quoting the
+// value if it is not a single word.
+func writeLogField(line *bytes.Buffer, key, value string) {
+	if value == "" {
+		return
+	}
+	line.WriteByte(' ')
+	line.WriteString(key)
+	line.WriteByte('=')
+	if strings.ContainsAny(value, " =\"\\\t\r\n") || !strconv.CanBackquote(value) {
+		value = strconv.Quote(value)
+	}
+	line.WriteString(value)
+}
+
+// Debugf, Infof, Warningf and Errorf log a message without fields at
+// their level.
+func Debugf(format string, args ...interface{}) {
+	Logf(LOG_DEBUG, nil, format, args...)
+}
+
+func Infof(format string, args ...interface{}) {
+	Logf(LOG_INFO, nil, format, args...)
+}
+
+func Warningf(format string, args ...interface{}) {
+	Logf(LOG_WARNING, nil, format, args...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	Logf(LOG_ERROR, nil, format, args...)
+}
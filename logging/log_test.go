@@ -0,0 +1,79 @@
+package logging
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+func TestDiagnosticLog(t *testing.T) {
+	if level, err := ParseLogLevel("warning"); err != nil || level != LOG_WARNING {
+		t.Errorf("parsed level %d error %v", level, err)
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("unknown log level accepted")
+	}
+
+	var out bytes.Buffer
+	SetLogOutput(&out)
+	defer SetLogOutput(os.Stderr)
+	defer SetLogLevel(LOG_INFO)
+	defer SetDebugFlows(nil)
+
+	ipFlow := gopacket.NewFlow(layers.EndpointIPv4, net.IPv4(1, 2, 3, 4).To4(), net.IPv4(2, 3, 4, 5).To4())
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(1), layers.NewTCPPortEndpoint(2))
+	flow := types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	fields := &LogFields{Flow: &flow, State: "data-transfer", Detector: "injection"}
+
+	SetLogLevel(LOG_INFO)
+	Debugf("discarded")
+	Logf(LOG_INFO, fields, "injection detected in packet # %d\n", 3)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 || !strings.HasSuffix(lines[0], ` level=info flow=1.2.3.4:1-2.3.4.5:2 state=data-transfer detector=injection msg="injection detected in packet # 3"`) {
+		t.Fatalf("logged %q", out.String())
+	}
+
+	out.Reset()
+	SetLogLevel(LOG_SILENT)
+	Errorf("discarded")
+	SetDebugFlows([]string{"2.3.4.5:2-1.2.3.4:1"})
+	if !LogEnabled(LOG_DEBUG, &flow) || LogEnabled(LOG_DEBUG, nil) {
+		t.Error("debug level not raised for the flow only")
+	}
+	Logf(LOG_DEBUG, &LogFields{Flow: &flow}, "raised")
+	if !strings.HasSuffix(out.String(), " level=debug flow=1.2.3.4:1-2.3.4.5:2 msg=raised\n") {
+		t.Errorf("logged %q", out.String())
+	}
+}
+
+func TestRecentErrors(t *testing.T) {
+	var out bytes.Buffer
+	SetLogOutput(&out)
+	defer SetLogOutput(os.Stderr)
+
+	Infof("not an error")
+	for i := 0; i < RECENT_ERRORS+2; i++ {
+		Warningf("warning %d", i)
+	}
+	Errorf("last error")
+	errors := RecentErrors()
+	if len(errors) != RECENT_ERRORS {
+		t.Fatalf("%d recent errors", len(errors))
+	}
+	if !strings.HasSuffix(errors[0], `msg="warning 3"`) || !strings.HasSuffix(errors[len(errors)-1], `level=error msg="last error"`) {
+		t.Errorf("recent errors from %q to %q", errors[0], errors[len(errors)-1])
+	}
+
+	out.Reset()
+	WriteDiagnostics([]byte("as is\n"))
+	if out.String() != "as is\n" {
+		t.Errorf("wrote %q", out.String())
+	}
+}
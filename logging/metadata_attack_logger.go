@@ -23,24 +23,37 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/david415/HoneyBadger/types"
-	"io"
-	"os"
-	"path/filepath"
 )
 
 // AttackMetadataJsonLogger is responsible for recording all attack reports as JSON objects in a file.
 // This attack logger only logs metadata... but ouch code duplication.
 type AttackMetadataJsonLogger struct {
-	writer           io.WriteCloser
 	ArchiveDir       string
+	PathTemplate     string
+	Files            *LogFileWriter
 	stopChan         chan bool
 	attackReportChan chan *types.Event
 }
 
+func init() {
+	AttackLoggerRegister("metadata-json", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		a := NewAttackMetadataJsonLogger(options.ArchiveDir)
+		a.PathTemplate = options.Param("path", a.PathTemplate)
+		files, err := NewLogFileWriterFromOptions(options)
+		if err != nil {
+			return nil, fmt.Errorf("metadata-json: %s", err)
+		}
+		a.Files = files
+		return a, ValidPathTemplate(a.PathTemplate, false)
+	})
+}
+
 // NewAttackMetadataJsonLogger returns a pointer to a AttackMetadataJsonLogger struct
 func NewAttackMetadataJsonLogger(archiveDir string) *AttackMetadataJsonLogger {
 	a := AttackMetadataJsonLogger{
 		ArchiveDir:       archiveDir,
+		PathTemplate:     METADATA_LOG_TEMPLATE,
+		Files:            NewLogFileWriter(),
 		stopChan:         make(chan bool),
 		attackReportChan: make(chan *types.Event),
 	}
@@ -56,12 +69,23 @@ func (a *AttackMetadataJsonLogger) Stop() {
 }
 
 func (a *AttackMetadataJsonLogger) receiveReports() {
+	commit, stopCommits := a.Files.commitTicks()
+	defer stopCommits()
 	for {
 		select {
 		case <-a.stopChan:
+			if err := a.Files.Commit(); err != nil {
+				backendWarningf("metadata-json", "%s\n", err)
+			}
 			return
+		case <-commit:
+			if err := a.Files.Commit(); err != nil {
+				backendWarningf("metadata-json", "%s\n", err)
+			}
 		case event := <-a.attackReportChan:
-			a.SerializeAndWrite(event)
+			if err := a.SerializeAndWrite(event); err != nil {
+				backendWarningf("metadata-json", "%s\n", err)
+			}
 		}
 	}
 }
@@ -70,7 +94,7 @@ func (a *AttackMetadataJsonLogger) Log(event *types.Event) {
 	a.attackReportChan <- event
 }
 
-func (a *AttackMetadataJsonLogger) SerializeAndWrite(event *types.Event) {
+func (a *AttackMetadataJsonLogger) SerializeAndWrite(event *types.Event) error {
 	publishableEvent := &SerializedEvent{
 		Type:         event.Type,
 		PacketCount:  event.PacketCount,
@@ -81,18 +105,18 @@ func (a *AttackMetadataJsonLogger) SerializeAndWrite(event *types.Event) {
 		Base:         event.Base,
 		Start:        event.Start,
 		End:          event.End,
+		SampleRate:   event.SampleRate,
+		Sensor:       reportSensor(),
 	}
-	a.Publish(publishableEvent)
+	return a.Publish(publishableEvent)
 }
 
 // Publish writes a JSON report to the attack-report file for that flow.
-func (a *AttackMetadataJsonLogger) Publish(event *SerializedEvent) {
+func (a *AttackMetadataJsonLogger) Publish(event *SerializedEvent) error {
 	b, err := json.Marshal(*event)
-	logName := filepath.Join(a.ArchiveDir, fmt.Sprintf("%s.metadata-attackreport.json", event.Flow))
-	a.writer, err = os.OpenFile(logName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	logName := ExpandPathTemplate(a.ArchiveDir, a.PathTemplate, event.Flow, event.Type, event.Time)
 	if err != nil {
-		panic(fmt.Sprintf("error opening file: %v", err))
+		return err
 	}
-	defer a.writer.Close()
-	a.writer.Write([]byte(fmt.Sprintf("%s\n", string(b))))
+	return a.Files.Append(logName, append(b, '\n'))
 }
@@ -0,0 +1,469 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// MISP_GROUP_KEYS are the report properties MISP events can be grouped by.
+var MISP_GROUP_KEYS = map[string]bool{
+	"type": true, "detector": true, "payload": true, "sni": true,
+	"ja3": true, "src": true, "dst": true, "dst_port": true, "sensor": true,
+}
+
+// MISPAttackLogger submits attack reports to a MISP instance through its
+// REST API. Reports are grouped into MISP events, one per injection
+// campaign, by the fingerprint of the attacker: a hash of the report
+// properties named in GroupBy, by default its type and injected payload.
+// The first report of a campaign creates its event, or finds the event
+// created by an earlier run, and each report adds its endpoints to it
+// along with its payload and the pcap snippet of the attack as
+// attachments. Snippets are attached once written, if that happens
+// within AttachmentWait. Connection events are not submitted.
+//
+// Reports arriving at a full queue are dropped and counted. Failed
+// requests are retried up to Retries times with exponential backoff.
+type MISPAttackLogger struct {
+	URL            string
+	Key            string
+	GroupBy        []string
+	Distribution   int
+	ThreatLevel    int
+	Analysis       int
+	Tags           []string
+	MaxAttachment  int64
+	AttachmentWait time.Duration
+	Retries        int
+	Backoff        time.Duration
+	Client         *http.Client
+
+	events      map[string]string
+	attachments []*mispAttachment
+	dropped     int
+	queue       chan *types.Event
+	doneChan    chan bool
+}
+
+// mispAttachment is a snippet waiting to be written before it is attached.
+type mispAttachment struct {
+	eventID  string
+	filename string
+	comment  string
+	deadline time.Time
+}
+
+type mispAttribute struct {
+	Type     string `json:"type"`
+	Category string `json:"category"`
+	Value    string `json:"value"`
+	Data     string `json:"data,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+	ToIDS    bool   `json:"to_ids"`
+}
+
+type mispTag struct {
+	Name string `json:"name"`
+}
+
+type mispEvent struct {
+	ID           string    `json:"id,omitempty"`
+	Info         string    `json:"info"`
+	Date         string    `json:"date,omitempty"`
+	Distribution string    `json:"distribution,omitempty"`
+	ThreatLevel  string    `json:"threat_level_id,omitempty"`
+	Analysis     string    `json:"analysis,omitempty"`
+	Tags         []mispTag `json:"Tag,omitempty"`
+}
+
+type mispEventEnvelope struct {
+	Event mispEvent `json:"Event"`
+}
+
+func init() {
+	AttackLoggerRegister("misp", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewMISPAttackLoggerFromOptions(options)
+	})
+}
+
+// NewMISPAttackLogger returns a pointer to a MISPAttackLogger struct
+// submitting to the MISP instance at url with the given API key.
+func NewMISPAttackLogger(url, key string, queue int) *MISPAttackLogger {
+	return &MISPAttackLogger{
+		URL:            strings.TrimRight(url, "/"),
+		Key:            key,
+		GroupBy:        []string{"type", "payload"},
+		ThreatLevel:    2,
+		MaxAttachment:  10 << 20,
+		AttachmentWait: time.Minute,
+		Retries:        5,
+		Backoff:        time.Second,
+		Client:         &http.Client{Timeout: 30 * time.Second},
+		events:         make(map[string]string),
+		queue:          make(chan *types.Event, queue),
+		doneChan:       make(chan bool),
+	}
+}
+
+// NewMISPAttackLoggerFromOptions returns a MISPAttackLogger configured by the
+// backend parameters url, key, or key_file holding the key, group_by (report
+// properties separated by "|": type, detector, payload, sni, ja3, src, dst,
+// dst_port and sensor), distribution, threat_level, analysis, tags (separated
+// by "|"), max_attachment (bytes), attachment_wait, queue, retries and backoff.
+func NewMISPAttackLoggerFromOptions(options *AttackLoggerOptions) (*MISPAttackLogger, error) {
+	url := options.Param("url", "")
+	if url == "" {
+		return nil, fmt.Errorf("misp: no url given")
+	}
+	key := options.Param("key", "")
+	if keyFile := options.Param("key_file", ""); keyFile != "" {
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("misp: %s", err)
+		}
+		key = strings.TrimSpace(string(b))
+	}
+	if key == "" {
+		return nil, fmt.Errorf("misp: no key or key_file given")
+	}
+	queue, err := strconv.Atoi(options.Param("queue", "1000"))
+	if err != nil {
+		return nil, fmt.Errorf("misp: invalid queue: %s", err)
+	}
+	m := NewMISPAttackLogger(url, key, queue)
+	if groupBy := options.Param("group_by", ""); groupBy != "" {
+		m.GroupBy = nil
+		for _, property := range strings.Split(groupBy, "|") {
+			property = strings.TrimSpace(property)
+			if !MISP_GROUP_KEYS[property] {
+				return nil, fmt.Errorf("misp: invalid group_by property %q", property)
+			}
+			m.GroupBy = append(m.GroupBy, property)
+		}
+	}
+	for _, tag := range strings.Split(options.Param("tags", "honeybadger"), "|") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			m.Tags = append(m.Tags, tag)
+		}
+	}
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{
+		{"distribution", &m.Distribution},
+		{"threat_level", &m.ThreatLevel},
+		{"analysis", &m.Analysis},
+		{"retries", &m.Retries},
+	} {
+		if *param.value, err = strconv.Atoi(options.Param(param.name, strconv.Itoa(*param.value))); err != nil {
+			return nil, fmt.Errorf("misp: invalid %s: %s", param.name, err)
+		}
+	}
+	if m.MaxAttachment, err = strconv.ParseInt(options.Param("max_attachment", strconv.FormatInt(m.MaxAttachment, 10)), 10, 64); err != nil {
+		return nil, fmt.Errorf("misp: invalid max_attachment: %s", err)
+	}
+	if m.AttachmentWait, err = time.ParseDuration(options.Param("attachment_wait", m.AttachmentWait.String())); err != nil {
+		return nil, fmt.Errorf("misp: invalid attachment_wait: %s", err)
+	}
+	if m.Backoff, err = time.ParseDuration(options.Param("backoff", m.Backoff.String())); err != nil {
+		return nil, fmt.Errorf("misp: invalid backoff: %s", err)
+	}
+	return m, nil
+}
+
+func (m *MISPAttackLogger) Start() {
+	go m.receiveReports()
+}
+
+// Stop submits the queued reports, and the snippets already written,
+// and returns once they are submitted or given up on.
+func (m *MISPAttackLogger) Stop() {
+	close(m.queue)
+	<-m.doneChan
+}
+
+func (m *MISPAttackLogger) Log(event *types.Event) {
+	if detectorOf(event.Type) == "dispatcher" {
+		return
+	}
+	select {
+	case m.queue <- event:
+	default:
+		m.dropped++
+		if m.dropped == 1 || m.dropped%100 == 0 {
+			backendWarningf("misp", "queue full, %d reports dropped\n", m.dropped)
+		}
+	}
+}
+
+func (m *MISPAttackLogger) receiveReports() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-m.queue:
+			if !ok {
+				m.attachSnippets(time.Now(), true)
+				m.doneChan <- true
+				return
+			}
+			if err := m.submit(event); err != nil {
+				backendWarningf("misp", "giving up on a report: %s\n", err)
+			}
+		case now := <-ticker.C:
+			m.attachSnippets(now, false)
+		}
+	}
+}
+
+// fingerprint returns the attacker fingerprint of a report.
+func (m *MISPAttackLogger) fingerprint(report *AttackReport) string {
+	return ReportFingerprint(report, m.GroupBy)
+}
+
+// ReportFingerprint returns a fingerprint of the attacker of a report: a
+// hash of the named report properties, those of MISP_GROUP_KEYS, such
+// that reports of the same injector, say of the same type and payload,
+// have the same fingerprint.
+func ReportFingerprint(report *AttackReport, properties []string) string {
+	h := sha256.New()
+	for _, property := range properties {
+		var value string
+		switch property {
+		case "type":
+			value = report.Type
+		case "detector":
+			value = report.Detector
+		case "payload":
+			value = string(report.Payload)
+		case "src":
+			value = report.Flow.SrcIP
+		case "dst":
+			value = report.Flow.DstIP
+		case "dst_port":
+			value = strconv.Itoa(int(report.Flow.DstPort))
+		case "sensor":
+			value = report.Sensor.ID
+		case "sni", "ja3":
+			if report.TLS != nil && property == "sni" {
+				value = report.TLS.ServerName
+			} else if report.TLS != nil {
+				value = report.TLS.JA3Hash
+			}
+		}
+		fmt.Fprintf(h, "%s=%d:%s;", property, len(value), value)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// submit adds a report to the MISP event of its campaign.
+func (m *MISPAttackLogger) submit(event *types.Event) error {
+	report := NewAttackReport(event)
+	fingerprint := m.fingerprint(report)
+	eventID, ok := m.events[fingerprint]
+	if !ok {
+		var err error
+		if eventID, err = m.campaign(report, fingerprint); err != nil {
+			return err
+		}
+		m.events[fingerprint] = eventID
+	}
+
+	comment := fmt.Sprintf("%s at %s", report.Type, report.Time.UTC().Format(time.RFC3339Nano))
+	attributes := []mispAttribute{
+		{Type: "ip-src|port", Category: "Network activity", Value: fmt.Sprintf("%s|%d", report.Flow.SrcIP, report.Flow.SrcPort), Comment: comment},
+		{Type: "ip-dst|port", Category: "Network activity", Value: fmt.Sprintf("%s|%d", report.Flow.DstIP, report.Flow.DstPort), Comment: comment},
+	}
+	if report.TLS != nil && report.TLS.ServerName != "" {
+		attributes = append(attributes, mispAttribute{Type: "domain", Category: "Network activity", Value: report.TLS.ServerName, Comment: comment})
+	}
+	if len(report.Payload) > 0 {
+		attributes = append(attributes, mispAttribute{
+			Type:     "attachment",
+			Category: "Payload delivery",
+			Value:    fmt.Sprintf("%s.payload", report.Type),
+			Data:     base64.StdEncoding.EncodeToString(report.Payload),
+			Comment:  comment,
+		})
+	}
+	if err := m.retry(func() error { return m.addAttributes(eventID, attributes) }); err != nil {
+		return err
+	}
+	if report.Snippet != "" {
+		m.attachments = append(m.attachments, &mispAttachment{
+			eventID:  eventID,
+			filename: report.Snippet,
+			comment:  comment,
+			deadline: time.Now().Add(m.AttachmentWait),
+		})
+	}
+	return nil
+}
+
+// campaign returns the ID of the MISP event of a campaign, which is
+// found by its info or, if there is none yet, created.
+func (m *MISPAttackLogger) campaign(report *AttackReport, fingerprint string) (string, error) {
+	info := fmt.Sprintf("HoneyBadger %s campaign %s", report.Detector, fingerprint)
+	var eventID string
+	err := m.retry(func() error {
+		var err error
+		eventID, err = m.findEvent(info)
+		return err
+	})
+	if err != nil || eventID != "" {
+		return eventID, err
+	}
+	event := mispEventEnvelope{Event: mispEvent{
+		Info:         info,
+		Date:         report.Time.UTC().Format("2006-01-02"),
+		Distribution: strconv.Itoa(m.Distribution),
+		ThreatLevel:  strconv.Itoa(m.ThreatLevel),
+		Analysis:     strconv.Itoa(m.Analysis),
+	}}
+	for _, tag := range m.Tags {
+		event.Event.Tags = append(event.Event.Tags, mispTag{Name: tag})
+	}
+	err = m.retry(func() error {
+		var created mispEventEnvelope
+		if err := m.do("/events/add", event, &created); err != nil {
+			return err
+		}
+		if eventID = created.Event.ID; eventID == "" {
+			return fmt.Errorf("no event ID in response")
+		}
+		return nil
+	})
+	return eventID, err
+}
+
+// findEvent returns the ID of the MISP event with the given info, if any.
+func (m *MISPAttackLogger) findEvent(info string) (string, error) {
+	var found struct {
+		Response []mispEventEnvelope `json:"response"`
+	}
+	query := map[string]interface{}{"returnFormat": "json", "eventinfo": info, "limit": 1, "metadata": true}
+	if err := m.do("/events/restSearch", query, &found); err != nil {
+		return "", err
+	}
+	for _, event := range found.Response {
+		if event.Event.Info == info {
+			return event.Event.ID, nil
+		}
+	}
+	return "", nil
+}
+
+func (m *MISPAttackLogger) addAttributes(eventID string, attributes []mispAttribute) error {
+	return m.do("/attributes/add/"+eventID, attributes, nil)
+}
+
+// attachSnippets attaches the snippets which have been written to their
+// MISP events; those still not written by their deadline, or by now if
+// all is set, are given up on.
+func (m *MISPAttackLogger) attachSnippets(now time.Time, all bool) {
+	var waiting []*mispAttachment
+	for _, attachment := range m.attachments {
+		info, err := os.Stat(attachment.filename)
+		written := err == nil && (all || now.Sub(info.ModTime()) >= time.Second)
+		if !written {
+			if !all && now.Before(attachment.deadline) {
+				waiting = append(waiting, attachment)
+			} else {
+				backendWarningf("misp", "snippet %s not written, not attaching it\n", attachment.filename)
+			}
+			continue
+		}
+		if info.Size() > m.MaxAttachment {
+			backendWarningf("misp", "snippet %s is too large to attach\n", attachment.filename)
+			continue
+		}
+		data, err := ioutil.ReadFile(attachment.filename)
+		if err == nil {
+			err = m.retry(func() error {
+				return m.addAttributes(attachment.eventID, []mispAttribute{{
+					Type:     "attachment",
+					Category: "Network activity",
+					Value:    filepath.Base(attachment.filename),
+					Data:     base64.StdEncoding.EncodeToString(data),
+					Comment:  attachment.comment,
+				}})
+			})
+		}
+		if err != nil {
+			backendWarningf("misp", "failed to attach snippet %s: %s\n", attachment.filename, err)
+		}
+	}
+	m.attachments = waiting
+}
+
+// retry calls fn until it succeeds or has failed Retries times more.
+func (m *MISPAttackLogger) retry(fn func() error) error {
+	backoff := m.Backoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= m.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// do POSTs request as JSON to the API path and decodes the response into response.
+func (m *MISPAttackLogger) do(path string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest("POST", m.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", m.Key)
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("Content-Type", "application/json")
+	result, err := m.Client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+	if result.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(result.Body)
+		return fmt.Errorf("%s: status %s: %s", path, result.Status, bytes.TrimSpace(message))
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(result.Body).Decode(response)
+}
@@ -0,0 +1,108 @@
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMISPAttackLogger(t *testing.T) {
+	var mutex sync.Mutex
+	created := map[string]string{}
+	attributes := map[string][]mispAttribute{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Header.Get("Authorization") != "k3y" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch {
+		case r.URL.Path == "/events/restSearch":
+			var query map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&query)
+			var found []mispEventEnvelope
+			if id, ok := created[query["eventinfo"].(string)]; ok {
+				found = append(found, mispEventEnvelope{Event: mispEvent{ID: id, Info: query["eventinfo"].(string)}})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"response": found})
+		case r.URL.Path == "/events/add":
+			var event mispEventEnvelope
+			json.NewDecoder(r.Body).Decode(&event)
+			if len(event.Event.Tags) != 1 || event.Event.Tags[0].Name != "honeybadger" {
+				t.Errorf("event tags %v", event.Event.Tags)
+			}
+			event.Event.ID = strconv.Itoa(len(created) + 1)
+			created[event.Event.Info] = event.Event.ID
+			json.NewEncoder(w).Encode(event)
+		case filepath.Dir(r.URL.Path) == "/attributes/add":
+			var added []mispAttribute
+			json.NewDecoder(r.Body).Decode(&added)
+			id := filepath.Base(r.URL.Path)
+			attributes[id] = append(attributes[id], added...)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	snippet := filepath.Join(t.TempDir(), "attack-1.pcap")
+	if err := os.WriteFile(snippet, []byte("pcap"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := &AttackLoggerOptions{Params: map[string]string{"url": server.URL, "key": "k3y", "backoff": "1ms"}}
+	logger, err := NewMISPAttackLoggerFromOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Start()
+	first := testReportEvent()
+	first.Type = "injection"
+	first.Payload = []byte("injected")
+	first.Snippet = snippet
+	logger.Log(first)
+	same := testReportEvent()
+	same.Type = "injection"
+	same.Payload = []byte("injected")
+	logger.Log(same)
+	logger.Log(testReportEvent())
+	connection := testReportEvent()
+	connection.Type = "connection-opened"
+	logger.Log(connection)
+	logger.Stop()
+
+	// a later run adds to the campaigns already in MISP
+	logger, _ = NewMISPAttackLoggerFromOptions(options)
+	logger.Start()
+	logger.Log(testReportEvent())
+	logger.Stop()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(created) != 2 {
+		t.Fatalf("%d MISP events created, expected one for each of the 2 campaigns: %v", len(created), created)
+	}
+	injection := attributes[created["HoneyBadger injection campaign "+logger.fingerprint(NewAttackReport(first))]]
+	attachments := 0
+	for _, attribute := range injection {
+		if attribute.Type == "attachment" {
+			attachments++
+		}
+	}
+	if len(injection) != 7 || attachments != 3 {
+		t.Errorf("injection campaign attributes %+v", injection)
+	}
+	if handshake := attributes[created["HoneyBadger handshake campaign "+logger.fingerprint(NewAttackReport(testReportEvent()))]]; len(handshake) != 4 {
+		t.Errorf("handshake campaign attributes %+v", handshake)
+	}
+
+	options.Params["group_by"] = "type|ttl"
+	if _, err := NewMISPAttackLoggerFromOptions(options); err == nil {
+		t.Error("invalid group_by accepted")
+	}
+}
@@ -0,0 +1,339 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect = 1
+	mqttConnack = 2
+	mqttPublish = 3
+	mqttPuback  = 4
+	mqttPubrec  = 5
+	mqttPubrel  = 6
+	mqttPubcomp = 7
+)
+
+// MQTTAttackLogger publishes attack reports, rendered by Format as compact
+// protocol buffer messages unless set otherwise, to an MQTT 3.1.1 broker.
+// The topic is Topic with "{host}", "{type}" and "{detector}" replaced by
+// the sensor's host name and those of the report. QoS 1 and 2 publishes wait
+// for the broker's acknowledgement and are retried on a new connection,
+// cheaply re-establishing a dropped link, up to Retries times.
+type MQTTAttackLogger struct {
+	Address  string
+	ClientID string
+	Username string
+	Password string
+	TLS      *tls.Config
+	Topic    string
+	QoS      int
+	Retain   bool
+	Format   ReportFormatter
+	Timeout  time.Duration
+	Retries  int
+
+	hostname         string
+	conn             net.Conn
+	reader           *bufio.Reader
+	packetID         uint16
+	stopChan         chan bool
+	attackReportChan chan *types.Event
+}
+
+func init() {
+	AttackLoggerRegister("mqtt", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewMQTTAttackLoggerFromOptions(options)
+	})
+}
+
+// NewMQTTAttackLogger returns a pointer to an MQTTAttackLogger struct
+// publishing to the broker at address with QoS 1.
+func NewMQTTAttackLogger(address string) *MQTTAttackLogger {
+	hostname := Sensor
+	return &MQTTAttackLogger{
+		Address:          address,
+		ClientID:         "honeybadger-" + hostname,
+		Topic:            "honeybadger/{host}/{detector}",
+		QoS:              1,
+		Format:           FormatProtobuf,
+		Timeout:          30 * time.Second,
+		Retries:          3,
+		hostname:         hostname,
+		stopChan:         make(chan bool),
+		attackReportChan: make(chan *types.Event, 100),
+	}
+}
+
+// NewMQTTAttackLoggerFromOptions returns an MQTTAttackLogger configured by the
+// backend parameters address, client_id, username, password, tls, topic,
+// qos, retain, format, timeout and retries.
+func NewMQTTAttackLoggerFromOptions(options *AttackLoggerOptions) (*MQTTAttackLogger, error) {
+	m := NewMQTTAttackLogger(options.Param("address", "localhost:1883"))
+	m.ClientID = options.Param("client_id", m.ClientID)
+	m.Username = options.Param("username", "")
+	m.Password = options.Param("password", "")
+	m.Topic = options.Param("topic", m.Topic)
+	m.Retain = options.Param("retain", "") == "true"
+	if options.Param("tls", "") == "true" {
+		host, _, err := net.SplitHostPort(m.Address)
+		if err != nil {
+			return nil, err
+		}
+		m.TLS = &tls.Config{ServerName: host}
+	}
+	var err error
+	if m.QoS, err = strconv.Atoi(options.Param("qos", strconv.Itoa(m.QoS))); err != nil || m.QoS < 0 || m.QoS > 2 {
+		return nil, fmt.Errorf("mqtt: invalid qos %q; one of 0, 1, 2", options.Param("qos", ""))
+	}
+	if m.Format, err = reportFormat(options.Param("format", "protobuf")); err != nil {
+		return nil, err
+	}
+	if m.Timeout, err = time.ParseDuration(options.Param("timeout", m.Timeout.String())); err != nil {
+		return nil, fmt.Errorf("mqtt: invalid timeout: %s", err)
+	}
+	if m.Retries, err = strconv.Atoi(options.Param("retries", strconv.Itoa(m.Retries))); err != nil {
+		return nil, fmt.Errorf("mqtt: invalid retries: %s", err)
+	}
+	return m, nil
+}
+
+func (m *MQTTAttackLogger) Start() {
+	go m.receiveReports()
+}
+
+func (m *MQTTAttackLogger) Stop() {
+	m.stopChan <- true
+}
+
+func (m *MQTTAttackLogger) Log(event *types.Event) {
+	m.attackReportChan <- event
+}
+
+func (m *MQTTAttackLogger) receiveReports() {
+	for {
+		select {
+		case <-m.stopChan:
+			if m.conn != nil {
+				// DISCONNECT
+				m.conn.Write([]byte{0xe0, 0})
+				m.close()
+			}
+			return
+		case event := <-m.attackReportChan:
+			if err := m.send(event); err != nil {
+				backendWarningf("mqtt", "%s\n", err)
+			}
+		}
+	}
+}
+
+func (m *MQTTAttackLogger) topic(eventType string) string {
+	return strings.NewReplacer("{host}", m.hostname, "{type}", eventType, "{detector}", detectorOf(eventType)).Replace(m.Topic)
+}
+
+func (m *MQTTAttackLogger) send(event *types.Event) error {
+	payload, err := m.Format(event)
+	if err != nil {
+		return err
+	}
+	topic := m.topic(event.Type)
+	for attempt := 0; ; attempt++ {
+		if m.conn == nil {
+			err = m.connect()
+		}
+		if err == nil {
+			if err = m.publish(topic, payload, attempt > 0); err == nil {
+				return nil
+			}
+			m.close()
+		}
+		if attempt >= m.Retries {
+			return err
+		}
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+}
+
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// writePacket writes a control packet with its remaining length encoded.
+func (m *MQTTAttackLogger) writePacket(header byte, body []byte) error {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := m.conn.Write(append(packet, body...))
+	return err
+}
+
+// readPacket returns the type and body of the next control packet.
+func (m *MQTTAttackLogger) readPacket() (byte, []byte, error) {
+	header, err := m.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := m.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, fmt.Errorf("mqtt: invalid remaining length")
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(m.reader, body)
+	return header >> 4, body, err
+}
+
+func (m *MQTTAttackLogger) connect() error {
+	conn, err := net.DialTimeout("tcp", m.Address, m.Timeout)
+	if err != nil {
+		return err
+	}
+	if m.TLS != nil {
+		tlsConn := tls.Client(conn, m.TLS)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+	m.conn = conn
+	m.reader = bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(m.Timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	flags := byte(0x02) // clean session
+	if m.Username != "" {
+		flags |= 0x80 | 0x40
+	}
+	body := mqttString(nil, "MQTT")
+	body = append(body, 4, flags, 0, 0) // protocol level 4, no keep alive
+	body = mqttString(body, m.ClientID)
+	if m.Username != "" {
+		body = mqttString(body, m.Username)
+		body = mqttString(body, m.Password)
+	}
+	if err := m.writePacket(mqttConnect<<4, body); err != nil {
+		m.close()
+		return err
+	}
+	kind, ack, err := m.readPacket()
+	if err == nil && (kind != mqttConnack || len(ack) != 2) {
+		err = fmt.Errorf("mqtt: expected CONNACK")
+	}
+	if err == nil && ack[1] != 0 {
+		err = fmt.Errorf("mqtt: broker refused connection with return code %d", ack[1])
+	}
+	if err != nil {
+		m.close()
+	}
+	return err
+}
+
+// publish sends a PUBLISH and completes the acknowledgement flow of its QoS.
+func (m *MQTTAttackLogger) publish(topic string, payload []byte, duplicate bool) error {
+	m.conn.SetDeadline(time.Now().Add(m.Timeout))
+	defer m.conn.SetDeadline(time.Time{})
+	header := byte(mqttPublish<<4) | byte(m.QoS<<1)
+	if m.Retain {
+		header |= 1
+	}
+	if duplicate && m.QoS > 0 {
+		header |= 0x08
+	}
+	body := mqttString(nil, topic)
+	if m.QoS > 0 {
+		m.packetID++
+		if m.packetID == 0 {
+			m.packetID = 1
+		}
+		body = binary.BigEndian.AppendUint16(body, m.packetID)
+	}
+	if err := m.writePacket(header, append(body, payload...)); err != nil {
+		return err
+	}
+	switch m.QoS {
+	case 1:
+		return m.await(mqttPuback)
+	case 2:
+		if err := m.await(mqttPubrec); err != nil {
+			return err
+		}
+		if err := m.writePacket(mqttPubrel<<4|0x02, binary.BigEndian.AppendUint16(nil, m.packetID)); err != nil {
+			return err
+		}
+		return m.await(mqttPubcomp)
+	}
+	return nil
+}
+
+// await reads packets until the acknowledgement of the given kind for the current packet ID.
+func (m *MQTTAttackLogger) await(kind byte) error {
+	for {
+		received, body, err := m.readPacket()
+		if err != nil {
+			return err
+		}
+		if received == kind && len(body) >= 2 && binary.BigEndian.Uint16(body) == m.packetID {
+			return nil
+		}
+	}
+}
+
+func (m *MQTTAttackLogger) close() {
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+}
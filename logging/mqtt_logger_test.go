@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// serveFakeMQTT accepts a client, acknowledges its QoS 2 publishes and sends their topics.
+func serveFakeMQTT(t *testing.T, listener net.Listener, topics chan string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	broker := &MQTTAttackLogger{conn: conn, reader: bufio.NewReader(conn)}
+	for {
+		kind, body, err := broker.readPacket()
+		if err != nil {
+			return
+		}
+		switch kind {
+		case mqttConnect:
+			broker.writePacket(mqttConnack<<4, []byte{0, 0})
+		case mqttPublish:
+			topicLength := int(binary.BigEndian.Uint16(body))
+			packetID := body[2+topicLength : 4+topicLength]
+			broker.writePacket(mqttPubrec<<4, packetID)
+			topics <- string(body[2 : 2+topicLength])
+		case mqttPubrel:
+			broker.writePacket(mqttPubcomp<<4, body)
+		}
+	}
+}
+
+func TestMQTTAttackLogger(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	topics := make(chan string, 1)
+	go serveFakeMQTT(t, listener, topics)
+
+	logger, err := NewMQTTAttackLoggerFromOptions(&AttackLoggerOptions{
+		Params: map[string]string{
+			"address": listener.Addr().String(),
+			"qos":     "2",
+			"topic":   "hb/{detector}/{type}",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.send(testReportEvent()); err != nil {
+		t.Fatal(err)
+	}
+	logger.close()
+	if topic := <-topics; topic != "hb/handshake/handshake-hijack" {
+		t.Errorf("published to topic %s", topic)
+	}
+
+	if _, err := NewMQTTAttackLoggerFromOptions(&AttackLoggerOptions{Params: map[string]string{"qos": "3"}}); err == nil {
+		t.Error("expected an error for an invalid QoS")
+	}
+}
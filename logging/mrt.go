@@ -0,0 +1,253 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// MRT record types and TABLE_DUMP_V2 subtypes, see RFC 6396.
+const (
+	MRT_TABLE_DUMP_V2     = 13
+	MRT_RIB_IPV4_UNICAST  = 2
+	MRT_RIB_IPV6_UNICAST  = 4
+	BGP_ATTRIBUTE_AS_PATH = 2
+	BGP_AS_SEQUENCE       = 2
+)
+
+// ASNTable maps routed prefixes to their origin AS numbers, as
+// loaded from the routing table dump of a BGP collector.
+type ASNTable struct {
+	origins map[netip.Prefix]uint32
+	lengths [2][]int
+}
+
+// NewASNTable returns an empty ASNTable.
+func NewASNTable() *ASNTable {
+	return &ASNTable{origins: make(map[netip.Prefix]uint32)}
+}
+
+// Add records the origin AS of a prefix.
+func (t *ASNTable) Add(prefix netip.Prefix, origin uint32) {
+	prefix = prefix.Masked()
+	if _, ok := t.origins[prefix]; !ok {
+		family := 0
+		if prefix.Addr().Is6() {
+			family = 1
+		}
+		lengths := t.lengths[family]
+		i := sort.Search(len(lengths), func(i int) bool { return lengths[i] <= prefix.Bits() })
+		if i == len(lengths) || lengths[i] != prefix.Bits() {
+			lengths = append(lengths, 0)
+			copy(lengths[i+1:], lengths[i:])
+			lengths[i] = prefix.Bits()
+			t.lengths[family] = lengths
+		}
+	}
+	t.origins[prefix] = origin
+}
+
+// Len returns the number of prefixes in the table.
+func (t *ASNTable) Len() int {
+	return len(t.origins)
+}
+
+// LookupASN returns the origin of the most specific prefix
+// covering ip or nil if no prefix does.
+func (t *ASNTable) LookupASN(ip net.IP) *types.AutonomousSystem {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil
+	}
+	addr = addr.Unmap()
+	family := 0
+	if addr.Is6() {
+		family = 1
+	}
+	for _, bits := range t.lengths[family] {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if origin, ok := t.origins[prefix]; ok {
+			return &types.AutonomousSystem{Number: origin, Prefix: prefix.String()}
+		}
+	}
+	return nil
+}
+
+// LoadMRT returns the ASNTable of an MRT TABLE_DUMP_V2 routing table dump
+// such as those published by RouteViews and RIPE RIS, optionally gzip or
+// bzip2 compressed. Each prefix is attributed to the origin of the first
+// AS path recorded for it; records of other types are skipped.
+func LoadMRT(path string) (*ASNTable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var r io.Reader = bufio.NewReader(file)
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		if r, err = gzip.NewReader(r); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	case strings.HasSuffix(path, ".bz2"):
+		r = bzip2.NewReader(r)
+	}
+	table := NewASNTable()
+	if err := table.ReadMRT(r); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return table, nil
+}
+
+// ReadMRT adds the prefixes of the RIB records of an MRT stream to the table.
+func (t *ASNTable) ReadMRT(r io.Reader) error {
+	header := make([]byte, 12)
+	var body []byte
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		recordType := binary.BigEndian.Uint16(header[4:])
+		subtype := binary.BigEndian.Uint16(header[6:])
+		length := binary.BigEndian.Uint32(header[8:])
+		if int(length) > cap(body) {
+			body = make([]byte, length)
+		}
+		body = body[:length]
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		if recordType != MRT_TABLE_DUMP_V2 {
+			continue
+		}
+		var err error
+		switch subtype {
+		case MRT_RIB_IPV4_UNICAST:
+			err = t.addRIB(body, 4)
+		case MRT_RIB_IPV6_UNICAST:
+			err = t.addRIB(body, 16)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var errMRTShort = errors.New("truncated MRT RIB record")
+
+// addRIB adds the prefix of a RIB_IPV4_UNICAST or RIB_IPV6_UNICAST
+// record, whose addresses are of the given size, to the table.
+func (t *ASNTable) addRIB(body []byte, size int) error {
+	if len(body) < 5 {
+		return errMRTShort
+	}
+	bits := int(body[4])
+	n := (bits + 7) / 8
+	if bits > size*8 || len(body) < 5+n+2 {
+		return errMRTShort
+	}
+	addr := make([]byte, size)
+	copy(addr, body[5:5+n])
+	ip, _ := netip.AddrFromSlice(addr)
+	prefix := netip.PrefixFrom(ip, bits)
+	count := int(binary.BigEndian.Uint16(body[5+n:]))
+	entries := body[5+n+2:]
+	for i := 0; i < count; i++ {
+		if len(entries) < 8 {
+			return errMRTShort
+		}
+		attributesLength := int(binary.BigEndian.Uint16(entries[6:]))
+		if len(entries) < 8+attributesLength {
+			return errMRTShort
+		}
+		if origin, ok := pathOrigin(entries[8 : 8+attributesLength]); ok {
+			t.Add(prefix, origin)
+			return nil
+		}
+		entries = entries[8+attributesLength:]
+	}
+	return nil
+}
+
+// pathOrigin returns the origin AS, the last AS of the AS_PATH, of the BGP
+// path attributes of a RIB entry; they always hold four octet AS numbers.
+func pathOrigin(attributes []byte) (uint32, bool) {
+	for len(attributes) >= 3 {
+		flags, code := attributes[0], attributes[1]
+		var length, offset int
+		if flags&0x10 != 0 { // extended length
+			if len(attributes) < 4 {
+				return 0, false
+			}
+			length, offset = int(binary.BigEndian.Uint16(attributes[2:])), 4
+		} else {
+			length, offset = int(attributes[2]), 3
+		}
+		if len(attributes) < offset+length {
+			return 0, false
+		}
+		if code == BGP_ATTRIBUTE_AS_PATH {
+			return lastASN(attributes[offset : offset+length])
+		}
+		attributes = attributes[offset+length:]
+	}
+	return 0, false
+}
+
+// lastASN returns the last AS of the final segment of an AS_PATH,
+// or for an AS_SET, which has no order, its first AS.
+func lastASN(path []byte) (uint32, bool) {
+	origin, found := uint32(0), false
+	for len(path) >= 2 {
+		segmentType, count := path[0], int(path[1])
+		if len(path) < 2+count*4 {
+			return 0, false
+		}
+		if count > 0 {
+			if segmentType == BGP_AS_SEQUENCE {
+				origin = binary.BigEndian.Uint32(path[2+(count-1)*4:])
+			} else {
+				origin = binary.BigEndian.Uint32(path[2:])
+			}
+			found = true
+		}
+		path = path[2+count*4:]
+	}
+	return origin, found
+}
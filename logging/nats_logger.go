@@ -0,0 +1,381 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// NatsAttackLogger publishes attack reports and connection events, rendered
+// by Format, to NATS subjects. The subject of an event is the one set for
+// its type, else the one set for its detector, else Subject.
+//
+// If JetStream is set each publish waits for the JetStream acknowledgement
+// that the message has been persisted by a stream and is retried, on a
+// new connection, if none arrives in time.
+type NatsAttackLogger struct {
+	URL       string
+	Subject   string
+	Subjects  map[string]string
+	Format    ReportFormatter
+	JetStream bool
+	Username  string
+	Password  string
+	Token     string
+	TLS       *tls.Config
+	Timeout   time.Duration
+	Retries   int
+
+	conn             *natsConn
+	stopChan         chan bool
+	attackReportChan chan *types.Event
+}
+
+func init() {
+	AttackLoggerRegister("nats", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewNatsAttackLoggerFromOptions(options)
+	})
+}
+
+// NewNatsAttackLogger returns a pointer to a NatsAttackLogger struct
+// publishing to subject on the NATS server at address.
+func NewNatsAttackLogger(address, subject string) *NatsAttackLogger {
+	return &NatsAttackLogger{
+		URL:              address,
+		Subject:          subject,
+		Subjects:         make(map[string]string),
+		Format:           FormatJSON,
+		Timeout:          5 * time.Second,
+		Retries:          3,
+		stopChan:         make(chan bool),
+		attackReportChan: make(chan *types.Event, 1000),
+	}
+}
+
+// NewNatsAttackLoggerFromOptions returns a NatsAttackLogger configured by the
+// backend parameters address, subject, subject.<type or detector>, format,
+// jetstream, username, password, token, tls, timeout and retries.
+func NewNatsAttackLoggerFromOptions(options *AttackLoggerOptions) (*NatsAttackLogger, error) {
+	n := NewNatsAttackLogger(options.Param("address", "localhost:4222"), options.Param("subject", "honeybadger.events"))
+	n.JetStream = options.Param("jetstream", "") == "true"
+	n.Username = options.Param("username", "")
+	n.Password = options.Param("password", "")
+	n.Token = options.Param("token", "")
+	if options.Param("tls", "") == "true" {
+		host, _, err := net.SplitHostPort(n.URL)
+		if err != nil {
+			return nil, err
+		}
+		n.TLS = &tls.Config{ServerName: host}
+	}
+	for key, value := range options.Params {
+		if strings.HasPrefix(key, "subject.") {
+			n.Subjects[strings.TrimPrefix(key, "subject.")] = value
+		}
+	}
+	var err error
+	if n.Format, err = reportFormat(options.Param("format", "json")); err != nil {
+		return nil, err
+	}
+	if n.Timeout, err = time.ParseDuration(options.Param("timeout", n.Timeout.String())); err != nil {
+		return nil, fmt.Errorf("nats: invalid timeout: %s", err)
+	}
+	if n.Retries, err = strconv.Atoi(options.Param("retries", strconv.Itoa(n.Retries))); err != nil {
+		return nil, fmt.Errorf("nats: invalid retries: %s", err)
+	}
+	return n, nil
+}
+
+func (n *NatsAttackLogger) Start() {
+	go n.receiveReports()
+}
+
+func (n *NatsAttackLogger) Stop() {
+	n.stopChan <- true
+}
+
+func (n *NatsAttackLogger) Log(event *types.Event) {
+	n.attackReportChan <- event
+}
+
+func (n *NatsAttackLogger) receiveReports() {
+	for {
+		select {
+		case <-n.stopChan:
+			if n.conn != nil {
+				n.conn.Close()
+				n.conn = nil
+			}
+			return
+		case event := <-n.attackReportChan:
+			if err := n.send(event); err != nil {
+				backendWarningf("nats", "%s\n", err)
+			}
+		}
+	}
+}
+
+// subject returns the subject events of the given type are published to.
+func (n *NatsAttackLogger) subject(eventType string) string {
+	if subject, ok := n.Subjects[eventType]; ok {
+		return subject
+	}
+	if subject, ok := n.Subjects[detectorOf(eventType)]; ok {
+		return subject
+	}
+	return n.Subject
+}
+
+func (n *NatsAttackLogger) send(event *types.Event) error {
+	message, err := n.Format(event)
+	if err != nil {
+		return err
+	}
+	subject := n.subject(event.Type)
+	for attempt := 0; ; attempt++ {
+		if n.conn == nil {
+			n.conn, err = dialNats(n)
+		}
+		if err == nil {
+			err = n.conn.publish(subject, message, n.JetStream, n.Timeout)
+			if err == nil {
+				return nil
+			}
+			n.conn.Close()
+			n.conn = nil
+		}
+		if attempt >= n.Retries {
+			return err
+		}
+		time.Sleep(time.Duration(attempt+1) * 100 * time.Millisecond)
+	}
+}
+
+// natsConn is a connection to a NATS server. A reader goroutine answers
+// the server's PINGs and hands replies to the publish awaiting them.
+type natsConn struct {
+	conn    net.Conn
+	mutex   sync.Mutex
+	replies chan []byte
+	errors  chan error
+	inbox   string
+	nonce   int
+	// maxPayload is the largest message the server accepts
+	maxPayload int
+}
+
+// natsInfo holds the fields of the server's INFO message a publisher needs.
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	MaxPayload  int  `json:"max_payload"`
+}
+
+func dialNats(n *NatsAttackLogger) (*natsConn, error) {
+	conn, err := net.DialTimeout("tcp", n.URL, n.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(n.Timeout))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if info.TLSRequired || n.TLS != nil {
+		config := n.TLS
+		if config == nil {
+			host, _, _ := net.SplitHostPort(n.URL)
+			config = &tls.Config{ServerName: host}
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(conn)
+	}
+	options := map[string]interface{}{
+		"verbose":      false,
+		"pedantic":     false,
+		"name":         "honeybadger",
+		"lang":         "go",
+		"version":      DEVICE_VERSION,
+		"protocol":     1,
+		"tls_required": n.TLS != nil || info.TLSRequired,
+	}
+	if n.Username != "" {
+		options["user"] = n.Username
+		options["pass"] = n.Password
+	}
+	if n.Token != "" {
+		options["auth_token"] = n.Token
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &natsConn{
+		conn:       conn,
+		maxPayload: info.MaxPayload,
+		replies:    make(chan []byte, 1),
+		errors:     make(chan error, 1),
+		inbox:      fmt.Sprintf("_INBOX.honeybadger.%d", time.Now().UnixNano()),
+	}
+	// a PING after CONNECT is answered with a PONG, or an -ERR if CONNECT was refused
+	fmt.Fprintf(conn, "CONNECT %s\r\nSUB %s.* 1\r\nPING\r\n", connect, c.inbox)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, fmt.Errorf("server refused connection: %s", strings.TrimSpace(line))
+		}
+		if strings.HasPrefix(line, "PONG") {
+			break
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	go c.read(reader)
+	return c, nil
+}
+
+func (c *natsConn) read(reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			c.mutex.Lock()
+			io.WriteString(c.conn, "PONG\r\n")
+			c.mutex.Unlock()
+		case strings.HasPrefix(line, "MSG "):
+			fields := strings.Fields(line)
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				c.fail(err)
+				return
+			}
+			select {
+			case c.replies <- payload[:size]:
+			default:
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			c.fail(fmt.Errorf("server error: %s", strings.TrimSpace(line)))
+		}
+	}
+}
+
+func (c *natsConn) fail(err error) {
+	select {
+	case c.errors <- err:
+	default:
+	}
+}
+
+// jetStreamAck is the JetStream reply to a publish.
+type jetStreamAck struct {
+	Stream string `json:"stream"`
+	Error  *struct {
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// publish sends a message; with jetStream set it waits for
+// the acknowledgement that a stream has persisted it.
+func (c *natsConn) publish(subject string, message []byte, jetStream bool, timeout time.Duration) error {
+	select {
+	case err := <-c.errors:
+		return err
+	default:
+	}
+	if c.maxPayload > 0 && len(message) > c.maxPayload {
+		return fmt.Errorf("message of %d bytes exceeds the server's maximum payload", len(message))
+	}
+	reply := ""
+	if jetStream {
+		c.nonce++
+		reply = fmt.Sprintf(" %s.%d", c.inbox, c.nonce)
+		// drain a late reply to an earlier publish
+		select {
+		case <-c.replies:
+		default:
+		}
+	}
+	c.mutex.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := fmt.Fprintf(c.conn, "PUB %s%s %d\r\n%s\r\n", subject, reply, len(message), message)
+	c.mutex.Unlock()
+	if err != nil || !jetStream {
+		return err
+	}
+	select {
+	case payload := <-c.replies:
+		var ack jetStreamAck
+		if err := json.Unmarshal(payload, &ack); err != nil {
+			return fmt.Errorf("invalid JetStream acknowledgement: %s", err)
+		}
+		if ack.Error != nil {
+			return fmt.Errorf("JetStream: %s", ack.Error.Description)
+		}
+		return nil
+	case err := <-c.errors:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no JetStream acknowledgement for subject %s", subject)
+	}
+}
+
+func (c *natsConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serveFakeNats speaks just enough of the NATS protocol for a publisher,
+// acknowledging publishes with a reply subject as JetStream would,
+// and sends the subject of each message published.
+func serveFakeNats(t *testing.T, listener net.Listener, subjects chan string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io.WriteString(conn, `INFO {"server_id":"test","max_payload":1048576}`+"\r\n")
+	reader := bufio.NewReader(conn)
+	inbox := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "SUB":
+			inbox = strings.TrimSuffix(fields[1], "*")
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			io.ReadFull(reader, make([]byte, size+2))
+			if len(fields) == 4 {
+				if !strings.HasPrefix(fields[2], inbox) {
+					t.Errorf("reply subject %s outside of inbox %s", fields[2], inbox)
+				}
+				ack := `{"stream":"HONEYBADGER","seq":1}`
+				fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", fields[2], len(ack), ack)
+			}
+			subjects <- fields[1]
+		}
+	}
+}
+
+func TestNatsAttackLogger(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	subjects := make(chan string, 2)
+	go serveFakeNats(t, listener, subjects)
+
+	logger, err := NewNatsAttackLoggerFromOptions(&AttackLoggerOptions{
+		Params: map[string]string{
+			"address":            listener.Addr().String(),
+			"jetstream":          "true",
+			"subject.dispatcher": "honeybadger.connections",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := testReportEvent()
+	if err := logger.send(event); err != nil {
+		t.Fatal(err)
+	}
+	event.Type = "connection-opened"
+	if err := logger.send(event); err != nil {
+		t.Fatal(err)
+	}
+	logger.conn.Close()
+	if subject := <-subjects; subject != "honeybadger.events" {
+		t.Errorf("attack report published to %s", subject)
+	}
+	if subject := <-subjects; subject != "honeybadger.connections" {
+		t.Errorf("connection event published to %s", subject)
+	}
+}
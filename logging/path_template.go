@@ -0,0 +1,84 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Default path templates of the files written per flow.
+const (
+	ATTACK_LOG_TEMPLATE   = "{flow}.attackreport.json"
+	METADATA_LOG_TEMPLATE = "{flow}.metadata-attackreport.json"
+	REPORT_LOG_TEMPLATE   = "{flow}.report.json"
+	PCAP_LOG_TEMPLATE     = "{flow}.pcap"
+	PCAPNG_LOG_TEMPLATE   = "{flow}.pcapng"
+	STREAM_LOG_TEMPLATE   = "{flow}.stream"
+)
+
+// pathEscaper keeps template values from adding path elements.
+var pathEscaper = strings.NewReplacer("/", "_", `\`, "_")
+
+// ExpandPathTemplate returns the path under dir named by a template in
+// which {flow}, {type}, {sensor}, {date} and {hour} are replaced by the
+// flow and type of what is logged, Sensor and the UTC date (2006-01-02)
+// and hour (15) of the given time. A template without {flow} collects
+// all flows in one file, for instance "{date}/{sensor}/attacks.json"
+// collects each day's reports.
+func ExpandPathTemplate(dir, template, flow, eventType string, t time.Time) string {
+	t = t.UTC()
+	return filepath.Join(dir, strings.NewReplacer(
+		"{flow}", pathEscaper.Replace(flow),
+		"{type}", pathEscaper.Replace(eventType),
+		"{sensor}", pathEscaper.Replace(Sensor),
+		"{date}", t.Format("2006-01-02"),
+		"{hour}", t.Format("15"),
+	).Replace(template))
+}
+
+// ValidPathTemplate returns an error if the template names a path outside
+// of the directory it is expanded in, or, if perFlow is set, does not name
+// a file for each flow.
+func ValidPathTemplate(template string, perFlow bool) error {
+	if filepath.IsAbs(template) || strings.HasPrefix(filepath.Clean(template), "..") {
+		return fmt.Errorf("path template %q leaves its directory", template)
+	}
+	if perFlow && !strings.Contains(template, "{flow}") {
+		return fmt.Errorf("path template %q has no {flow}", template)
+	}
+	return nil
+}
+
+// openLogFile opens the named file for appending,
+// creating it and its parent directories if need be.
+func openLogFile(name string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, fmt.Errorf("error creating log directory: %v", err)
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+	return f, nil
+}
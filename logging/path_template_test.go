@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandPathTemplate(t *testing.T) {
+	sensor := Sensor
+	Sensor = "edge/1"
+	defer func() { Sensor = sensor }()
+
+	when := time.Date(2016, 3, 4, 5, 6, 7, 0, time.UTC)
+	got := ExpandPathTemplate("/archive", "{date}/{hour}/{sensor}/{flow}.{type}.json", "1.2.3.4:1-2.3.4.5:2", "handshake-hijack", when)
+	if want := "/archive/2016-03-04/05/edge_1/1.2.3.4:1-2.3.4.5:2.handshake-hijack.json"; got != want {
+		t.Errorf("got %s, expected %s", got, want)
+	}
+
+	for _, test := range []struct {
+		template string
+		perFlow  bool
+		valid    bool
+	}{
+		{"{date}/attacks.json", false, true},
+		{"{date}/attacks.json", true, false},
+		{"{date}/{flow}.pcap", true, true},
+		{"../{flow}.pcap", true, false},
+		{"/tmp/{flow}.pcap", true, false},
+	} {
+		if err := ValidPathTemplate(test.template, test.perFlow); (err == nil) != test.valid {
+			t.Errorf("template %q per flow %v: got %v", test.template, test.perFlow, err)
+		}
+	}
+}
+
+func TestAttackJsonLoggerPathTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pathTemplate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, err := NewAttackLogger("json", &AttackLoggerOptions{
+		ArchiveDir: dir,
+		Params:     map[string]string{"path": "{date}/attacks.json"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := testReportEvent()
+	if err := logger.(*AttackJsonLogger).SerializeAndWrite(event); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.(*AttackJsonLogger).SerializeAndWrite(event); err != nil {
+		t.Fatal(err)
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*", "attacks.json"))
+	if err != nil || len(names) != 1 {
+		t.Fatalf("expected one dated attack log, got %v %v", names, err)
+	}
+	contents, err := ioutil.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(contents, []byte("\n")); lines != 2 {
+		t.Errorf("got %d reports, expected 2", lines)
+	}
+}
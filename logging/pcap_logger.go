@@ -33,75 +33,150 @@ import (
 	"github.com/david415/HoneyBadger/types"
 )
 
+// packetFileWriter writes packets in a capture file format.
+type packetFileWriter interface {
+	WriteFileHeader(snaplen uint32, linkType layers.LinkType) error
+	WritePacket(ci gopacket.CaptureInfo, data []byte) error
+}
+
 type TimedPacket struct {
 	RawPacket []byte
 	Timestamp time.Time
+	// released once written, if set
+	manifest *types.PacketManifest
 }
 
-// PcapLogger struct is used to log packets to a pcap file
+// PcapLogger struct is used to log packets to a pcap file, or to a
+// pcapng file whose packets are annotated with the attacks they triggered.
+// Once writing a packet fails the error is reported, to the error handler
+// if one is set and otherwise to the diagnostic log, and the packets
+// of the connection are no longer logged.
 type PcapLogger struct {
-	packetChan chan TimedPacket
-	stopChan   chan bool
-	AckChan    *chan bool
-	LogDir     string
-	ArchiveDir string
-	Flow       *types.TcpIpFlow
-	writer     *pcapgo.Writer
-	FileWriter io.WriteCloser
-	pcapLogNum int
-	pcapQuota  int
-	basename   string
+	packetChan   chan TimedPacket
+	annotateChan chan string
+	rotateChan   chan bool
+	stopChan     chan bool
+	doneChan     chan bool
+	AckChan      *chan bool
+	LogDir       string
+	ArchiveDir   string
+	Flow         *types.TcpIpFlow
+	writer       packetFileWriter
+	pcapng       bool
+	FileWriter   io.WriteCloser
+	pcapLogNum   int
+	pcapQuota    int
+	basename     string
+	rotator      *RotatingQuotaWriter
+	onError      func(error)
+	failed       bool
 }
 
 func NewPcapLogger(logDir, archiveDir string, flow *types.TcpIpFlow, pcapLogNum int, pcapQuota int) *PcapLogger {
+	return newPcapLogger(logDir, archiveDir, flow, pcapLogNum, pcapQuota, false, PCAP_LOG_TEMPLATE)
+}
+
+// NewPcapngLogger returns a PcapLogger writing pcapng files.
+func NewPcapngLogger(logDir, archiveDir string, flow *types.TcpIpFlow, pcapLogNum int, pcapQuota int) *PcapLogger {
+	return newPcapLogger(logDir, archiveDir, flow, pcapLogNum, pcapQuota, true, PCAPNG_LOG_TEMPLATE)
+}
+
+func newPcapLogger(logDir, archiveDir string, flow *types.TcpIpFlow, pcapLogNum int, pcapQuota int, pcapng bool, template string) *PcapLogger {
 	p := PcapLogger{
-		packetChan: make(chan TimedPacket),
-		stopChan:   make(chan bool),
-		AckChan: nil,
-		Flow:       flow,
-		LogDir:     logDir,
-		ArchiveDir: archiveDir,
-		pcapLogNum: pcapLogNum,
-		pcapQuota:  pcapQuota,
+		packetChan:   make(chan TimedPacket),
+		annotateChan: make(chan string),
+		rotateChan:   make(chan bool),
+		stopChan:     make(chan bool),
+		doneChan:     make(chan bool),
+		AckChan:      nil,
+		Flow:         flow,
+		LogDir:       logDir,
+		ArchiveDir:   archiveDir,
+		pcapLogNum:   pcapLogNum,
+		pcapQuota:    pcapQuota,
+		pcapng:       pcapng,
 	}
 
-	p.basename = filepath.Join(p.LogDir, fmt.Sprintf("%s.pcap", p.Flow))
-	p.FileWriter = NewRotatingQuotaWriter(p.basename, p.pcapQuota, p.pcapLogNum, p.WriteHeader)
-	p.writer = pcapgo.NewWriter(p.FileWriter)
+	p.basename = ExpandPathTemplate(p.LogDir, template, p.Flow.String(), "", time.Now())
+	p.rotator = NewRotatingQuotaWriter(p.basename, p.pcapQuota, p.pcapLogNum, p.WriteHeader)
+	p.SetFileWriter(p.rotator)
 
 	return &p
 }
 
+// PcapLoggerFactory builds the PcapLoggers of connections. Each connection's
+// pcap files are rotated once they reach their share of PcapQuota or, if
+// MaxAge is set, once they are older than MaxAge; at most PcapLogNum files
+// are retained, the rotated ones named by RotatePattern and, if Compressor
+// is set, compressed. If Pcapng is set the files are written as pcapng.
+// PathTemplate, if set, names the files within the log and archive
+// directories; it must contain {flow}.
 type PcapLoggerFactory struct {
-	LogDir     string
-	ArchiveDir string
-	PcapLogNum int
-	PcapQuota  int
+	LogDir        string
+	ArchiveDir    string
+	PcapLogNum    int
+	PcapQuota     int
+	MaxAge        time.Duration
+	RotatePattern string
+	Compressor    types.Compressor
+	Pcapng        bool
+	PathTemplate  string
 }
 
 func NewPcapLoggerFactory(logDir, archiveDir string, pcapLogNum, pcapQuota int) PcapLoggerFactory {
 	return PcapLoggerFactory{
-		LogDir:     logDir,
-		ArchiveDir: archiveDir,
-		PcapLogNum: pcapLogNum,
-		PcapQuota:  pcapQuota,
+		LogDir:        logDir,
+		ArchiveDir:    archiveDir,
+		PcapLogNum:    pcapLogNum,
+		PcapQuota:     pcapQuota,
+		RotatePattern: ROTATE_PATTERN,
 	}
 }
 
 func (f PcapLoggerFactory) Build(flow *types.TcpIpFlow) types.PacketLogger {
-	return NewPcapLogger(f.LogDir, f.ArchiveDir, flow, f.PcapLogNum, f.PcapQuota)
+	template := f.PathTemplate
+	if template == "" {
+		template = PCAP_LOG_TEMPLATE
+		if f.Pcapng {
+			template = PCAPNG_LOG_TEMPLATE
+		}
+	}
+	p := newPcapLogger(f.LogDir, f.ArchiveDir, flow, f.PcapLogNum, f.PcapQuota, f.Pcapng, template)
+	p.rotator.MaxAge = f.MaxAge
+	p.rotator.Compressor = f.Compressor
+	if f.RotatePattern != "" {
+		p.rotator.Pattern = f.RotatePattern
+	}
+	return p
 }
 
 func (p *PcapLogger) SetFileWriter(writer io.WriteCloser) {
 	p.FileWriter = writer
-	p.writer = pcapgo.NewWriter(p.FileWriter)
+	if p.pcapng {
+		p.writer = NewPcapngWriter(p.FileWriter)
+	} else {
+		p.writer = pcapgo.NewWriter(p.FileWriter)
+	}
 }
 
-func (p *PcapLogger) WriteHeader() {
-	err := p.writer.WriteFileHeader(65536, layers.LinkTypeEthernet)
-	if err != nil {
-		panic(err)
+func (p *PcapLogger) WriteHeader() error {
+	return p.writer.WriteFileHeader(65536, layers.LinkTypeEthernet)
+}
+
+// SetErrorHandler sets the function the errors met writing packets are reported to.
+func (p *PcapLogger) SetErrorHandler(handler func(error)) {
+	p.onError = handler
+}
+
+// writeError reports an error writing the packet log, after which no more packets are logged.
+func (p *PcapLogger) writeError(err error) {
+	p.failed = true
+	err = fmt.Errorf("packet log %s: %s", p.basename, err)
+	if p.onError != nil {
+		p.onError(err)
+		return
 	}
+	Warningf("%s", err)
 }
 
 func (p *PcapLogger) Start() {
@@ -110,14 +185,20 @@ func (p *PcapLogger) Start() {
 
 func (p *PcapLogger) Stop() {
 	p.stopChan <- true
+	<-p.doneChan
 	p.FileWriter.Close()
 }
 
+// Archive moves the current and the rotated pcap files to
+// the same paths within the archive directory.
 func (p *PcapLogger) Archive() {
-	newBasename := filepath.Join(p.ArchiveDir, filepath.Base(p.basename))
-	os.Rename(p.basename, newBasename)
-	for i := 1; i < p.pcapLogNum+1; i++ {
-		os.Rename(filepath.Join(p.LogDir, fmt.Sprintf("%s.pcap.%d", p.Flow.String(), i)), fmt.Sprintf("%s.%d", newBasename, i))
+	for _, name := range p.rotator.Files() {
+		archived := filepath.Join(p.ArchiveDir, filepath.Base(name))
+		if rel, err := filepath.Rel(p.LogDir, name); err == nil {
+			archived = filepath.Join(p.ArchiveDir, rel)
+		}
+		os.MkdirAll(filepath.Dir(archived), 0755)
+		os.Rename(name, archived)
 	}
 }
 
@@ -125,9 +206,33 @@ func (p *PcapLogger) logPackets() {
 	for {
 		select {
 		case <-p.stopChan:
+			if w, ok := p.writer.(*PcapngWriter); ok {
+				if err := w.Flush(); err != nil && !p.failed {
+					p.writeError(err)
+				}
+			}
+			p.doneChan <- true
 			return
+		case <-p.rotateChan:
+			if w, ok := p.writer.(*PcapngWriter); ok && !p.failed {
+				if err := w.Flush(); err != nil {
+					p.writeError(err)
+				}
+			}
+			if w, ok := p.FileWriter.(*RotatingQuotaWriter); ok && !p.failed {
+				if err := w.Rotate(); err != nil {
+					p.writeError(err)
+				}
+			}
+		case comment := <-p.annotateChan:
+			if w, ok := p.writer.(*PcapngWriter); ok {
+				w.Annotate(comment)
+			}
 		case timedPacket := <-p.packetChan:
 			p.WritePacketToFile(timedPacket.RawPacket, timedPacket.Timestamp)
+			if timedPacket.manifest != nil {
+				timedPacket.manifest.Release()
+			}
 			if p.AckChan != nil {
 				c := p.AckChan
 				*c <- true
@@ -137,9 +242,8 @@ func (p *PcapLogger) logPackets() {
 }
 
 func (p *PcapLogger) Remove() {
-	os.Remove(p.basename)
-	for i := 1; i < p.pcapLogNum+1; i++ {
-		os.Remove(filepath.Join(p.LogDir, fmt.Sprintf("%s.pcap.%d", p.Flow, i)))
+	for _, name := range p.rotator.Files() {
+		os.Remove(name)
 	}
 }
 
@@ -150,7 +254,42 @@ func (p *PcapLogger) WritePacket(rawPacket []byte, timestamp time.Time) {
 	}
 }
 
+// WritePacketManifest writes the raw packet of a manifest,
+// retaining the manifest until it has been written.
+func (p *PcapLogger) WritePacketManifest(manifest *types.PacketManifest) {
+	manifest.Retain()
+	p.packetChan <- TimedPacket{
+		RawPacket: manifest.RawPacket,
+		Timestamp: manifest.Timestamp,
+		manifest:  manifest,
+	}
+}
+
+// Rotate rotates the current pcap file, as if it had reached its quota.
+func (p *PcapLogger) Rotate() {
+	p.rotateChan <- true
+}
+
+// AnnotatePacket marks the most recently written packet as having
+// triggered the reported attack; only pcapng files record this.
+func (p *PcapLogger) AnnotatePacket(event *types.Event) {
+	if !p.pcapng {
+		return
+	}
+	p.annotateChan <- fmt.Sprintf("HoneyBadger %s detector: %s", detectorOf(event.Type), event.Type)
+}
+
 func (p *PcapLogger) WritePacketToFile(rawPacket []byte, timestamp time.Time) {
+	if p.failed {
+		return
+	}
+	if w, ok := p.FileWriter.(*RotatingQuotaWriter); ok && !p.pcapng {
+		// the record header and packet are written separately
+		if err := w.Reserve(16 + len(rawPacket)); err != nil {
+			p.writeError(err)
+			return
+		}
+	}
 	err := p.writer.WritePacket(gopacket.CaptureInfo{
 		Timestamp:     timestamp,
 		CaptureLength: len(rawPacket),
@@ -158,6 +297,6 @@ func (p *PcapLogger) WritePacketToFile(rawPacket []byte, timestamp time.Time) {
 	}, rawPacket)
 
 	if err != nil {
-		panic(err)
+		p.writeError(err)
 	}
 }
@@ -5,8 +5,11 @@ import (
 	"github.com/david415/HoneyBadger/types"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"encoding/hex"
 	"time"
@@ -97,3 +100,35 @@ func TestPcapLogger(t *testing.T) {
 
 	pcapLogger.Stop()
 }
+
+func TestPcapLoggerWriteError(t *testing.T) {
+	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.IPv4(1, 2, 3, 4)), layers.NewIPEndpoint(net.IPv4(2, 3, 4, 5)))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(1)), layers.NewTCPPortEndpoint(layers.TCPPort(2)))
+	flow := types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+
+	// the log dir cannot be created under a regular file
+	file, err := ioutil.TempFile("", "pcap-logger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	pcapLogger := NewPcapLogger(filepath.Join(file.Name(), "log-dir"), "archive-dir", &flow, 1, 10)
+	ackChan := make(chan bool)
+	pcapLogger.AckChan = &ackChan
+	var errors []error
+	pcapLogger.SetErrorHandler(func(err error) {
+		errors = append(errors, err)
+	})
+	pcapLogger.Start()
+	pcapLogger.WritePacket(makeTestPacket(), time.Now())
+	<-ackChan
+	pcapLogger.WritePacket(makeTestPacket(), time.Now())
+	<-ackChan
+	pcapLogger.Stop()
+
+	if len(errors) != 1 {
+		t.Errorf("%d errors reported: %v", len(errors), errors)
+	}
+}
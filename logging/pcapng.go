@@ -0,0 +1,142 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pcapng block types and options, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+const (
+	pcapngSectionHeaderBlock    = 0x0a0d0d0a
+	pcapngInterfaceBlock        = 0x00000001
+	pcapngEnhancedPacketBlock   = 0x00000006
+	pcapngByteOrderMagic        = 0x1a2b3c4d
+	pcapngOptionEnd             = 0
+	pcapngOptionComment         = 1
+	pcapngOptionUserApplication = 4
+	pcapngOptionTimeResolution  = 9
+)
+
+// PcapngWriter writes packets in the pcapng format with a single
+// interface and nanosecond timestamps. Packets may be annotated with
+// comments, which Wireshark shows alongside them; a packet is therefore
+// only written once the next one is, or when Flush is called.
+type PcapngWriter struct {
+	w        io.Writer
+	pending  []byte
+	captured gopacket.CaptureInfo
+	comments []string
+	buffered bool
+}
+
+// NewPcapngWriter returns a pointer to a PcapngWriter struct writing to w.
+func NewPcapngWriter(w io.Writer) *PcapngWriter {
+	return &PcapngWriter{w: w}
+}
+
+// pcapngOption appends an option padded to 32 bits.
+func pcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, (4-len(value)%4)%4)...)
+}
+
+// writeBlock writes a block of the given type with body, which must be
+// padded to 32 bits, in a single Write so that it is never split by rotation.
+func (p *PcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	b := make([]byte, 0, length)
+	b = binary.LittleEndian.AppendUint32(b, blockType)
+	b = binary.LittleEndian.AppendUint32(b, length)
+	b = append(b, body...)
+	b = binary.LittleEndian.AppendUint32(b, length)
+	_, err := p.w.Write(b)
+	return err
+}
+
+// WriteFileHeader writes the section header and interface description
+// blocks which begin every file.
+func (p *PcapngWriter) WriteFileHeader(snaplen uint32, linkType layers.LinkType) error {
+	shb := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // minor version
+	shb = binary.LittleEndian.AppendUint64(shb, 0xffffffffffffffff)
+	shb = pcapngOption(shb, pcapngOptionUserApplication, []byte("HoneyBadger"))
+	shb = pcapngOption(shb, pcapngOptionEnd, nil)
+	if err := p.writeBlock(pcapngSectionHeaderBlock, shb); err != nil {
+		return err
+	}
+	idb := binary.LittleEndian.AppendUint16(nil, uint16(linkType))
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, snaplen)
+	idb = pcapngOption(idb, pcapngOptionTimeResolution, []byte{9})
+	idb = pcapngOption(idb, pcapngOptionEnd, nil)
+	return p.writeBlock(pcapngInterfaceBlock, idb)
+}
+
+// WritePacket writes the previous packet and holds on to a copy of this one
+// until the next is written so that it may still be annotated.
+func (p *PcapngWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	err := p.Flush()
+	p.pending = append(p.pending[:0], data...)
+	p.captured = ci
+	p.comments = p.comments[:0]
+	p.buffered = true
+	return err
+}
+
+// Annotate adds a comment to the most recently written packet.
+func (p *PcapngWriter) Annotate(comment string) {
+	if p.buffered {
+		p.comments = append(p.comments, comment)
+	}
+}
+
+// Flush writes the packet held back by WritePacket.
+func (p *PcapngWriter) Flush() error {
+	if !p.buffered {
+		return nil
+	}
+	p.buffered = false
+	timestamp := uint64(p.captured.Timestamp.UnixNano())
+	epb := binary.LittleEndian.AppendUint32(nil, 0) // interface
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(timestamp>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(timestamp))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(p.captured.CaptureLength))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(p.captured.Length))
+	epb = append(epb, p.pending...)
+	for len(epb)%4 != 0 {
+		epb = append(epb, 0)
+	}
+	if len(p.comments) > 0 {
+		for _, comment := range p.comments {
+			epb = pcapngOption(epb, pcapngOptionComment, []byte(comment))
+		}
+		epb = pcapngOption(epb, pcapngOptionEnd, nil)
+	}
+	return p.writeBlock(pcapngEnhancedPacketBlock, epb)
+}
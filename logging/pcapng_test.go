@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func parsePcapngBlocks(t *testing.T, b []byte) []pcapngBlock {
+	var blocks []pcapngBlock
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block %x", b)
+		}
+		length := binary.LittleEndian.Uint32(b[4:])
+		if length%4 != 0 || int(length) > len(b) || binary.LittleEndian.Uint32(b[length-4:]) != length {
+			t.Fatalf("bad block length %d", length)
+		}
+		blocks = append(blocks, pcapngBlock{binary.LittleEndian.Uint32(b), b[8 : length-4]})
+		b = b[length:]
+	}
+	return blocks
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewPcapngWriter(&buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	packet := []byte{1, 2, 3, 4, 5}
+	ci := gopacket.CaptureInfo{Timestamp: time.Unix(1, 5), CaptureLength: len(packet), Length: len(packet)}
+	w.WritePacket(ci, packet)
+	w.Annotate("handshake-hijack")
+	w.WritePacket(ci, packet)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := parsePcapngBlocks(t, buf.Bytes())
+	expected := []uint32{pcapngSectionHeaderBlock, pcapngInterfaceBlock, pcapngEnhancedPacketBlock, pcapngEnhancedPacketBlock}
+	if len(blocks) != len(expected) {
+		t.Fatalf("got %d blocks, expected %d", len(blocks), len(expected))
+	}
+	for i := range blocks {
+		if blocks[i].blockType != expected[i] {
+			t.Errorf("block %d has type %x, expected %x", i, blocks[i].blockType, expected[i])
+		}
+	}
+	epb := blocks[2].body
+	if timestamp := uint64(binary.LittleEndian.Uint32(epb[4:]))<<32 | uint64(binary.LittleEndian.Uint32(epb[8:])); timestamp != 1000000005 {
+		t.Errorf("got timestamp %d", timestamp)
+	}
+	if !bytes.Equal(epb[20:25], packet) {
+		t.Errorf("got packet %x", epb[20:25])
+	}
+	comment := append(binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint16(nil, pcapngOptionComment), 16), "handshake-hijack"...)
+	if !bytes.Equal(epb[28:28+len(comment)], comment) {
+		t.Errorf("first packet not annotated: %x", epb[28:])
+	}
+	if len(blocks[3].body) != 28 {
+		t.Errorf("second packet has options: %x", blocks[3].body)
+	}
+}
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+func TestPcapngLoggerAnnotation(t *testing.T) {
+	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.IPv4(1, 2, 3, 4)), layers.NewIPEndpoint(net.IPv4(2, 3, 4, 5)))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(1)), layers.NewTCPPortEndpoint(layers.TCPPort(2)))
+	flow := types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+
+	logger := NewPcapngLogger("log-dir", "archive-dir", &flow, 1, 10)
+	ackChan := make(chan bool)
+	logger.AckChan = &ackChan
+	buf := &bufferCloser{}
+	logger.SetFileWriter(buf)
+	logger.Start()
+	logger.WritePacket(makeTestPacket(), time.Now())
+	<-ackChan
+	logger.AnnotatePacket(testReportEvent())
+	logger.Stop()
+
+	blocks := parsePcapngBlocks(t, buf.Bytes())
+	if len(blocks) != 1 || !bytes.Contains(blocks[0].body, []byte("HoneyBadger handshake detector: handshake-hijack")) {
+		t.Errorf("packet not annotated: %x", buf.Bytes())
+	}
+}
@@ -0,0 +1,574 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// This file holds a hand written encoder and decoder for the protocol buffer
+// messages of honeybadger.proto, the wire schema shared by the binary
+// transports, avoiding a dependency on generated code.
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+type protoEncoder struct {
+	b []byte
+}
+
+func (e *protoEncoder) tag(field, wireType int) {
+	e.b = binary.AppendUvarint(e.b, uint64(field<<3|wireType))
+}
+
+// uint64 encodes a varint field, omitting it if it holds the default value.
+func (e *protoEncoder) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, protoVarint)
+	e.b = binary.AppendUvarint(e.b, v)
+}
+
+func (e *protoEncoder) int64(field int, v int64) {
+	e.uint64(field, uint64(v))
+}
+
+func (e *protoEncoder) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, protoFixed64)
+	e.b = binary.LittleEndian.AppendUint64(e.b, math.Float64bits(v))
+}
+
+func (e *protoEncoder) bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	e.tag(field, protoBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(v)))
+	e.b = append(e.b, v...)
+}
+
+func (e *protoEncoder) string(field int, v string) {
+	e.bytes(field, []byte(v))
+}
+
+var errProtoTruncated = errors.New("protobuf: truncated message")
+
+// ProtoFields calls fn with each field of a message, the value being the
+// varint value for varint fields and the contents for length delimited ones.
+func ProtoFields(b []byte, fn func(field int, varint uint64, contents []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		var varint uint64
+		var contents []byte
+		switch key & 7 {
+		case protoVarint:
+			if varint, n = binary.Uvarint(b); n <= 0 {
+				return errProtoTruncated
+			}
+			b = b[n:]
+		case protoFixed64:
+			if len(b) < 8 {
+				return errProtoTruncated
+			}
+			varint = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case protoBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return errProtoTruncated
+			}
+			contents = b[n : n+int(length)]
+			b = b[n+int(length):]
+		case 5: // fixed32
+			if len(b) < 4 {
+				return errProtoTruncated
+			}
+			varint = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return errors.New("protobuf: unsupported wire type")
+		}
+		if err := fn(field, varint, contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProtoMessage builds a protocol buffer message of the fields added to it,
+// for the messages of the services of other packages; fields holding
+// the default value are omitted.
+type ProtoMessage struct {
+	e protoEncoder
+}
+
+func (m *ProtoMessage) AddUint64(field int, v uint64) {
+	m.e.uint64(field, v)
+}
+
+func (m *ProtoMessage) AddBool(field int, v bool) {
+	if v {
+		m.e.uint64(field, 1)
+	}
+}
+
+func (m *ProtoMessage) AddString(field int, v string) {
+	m.e.string(field, v)
+}
+
+func (m *ProtoMessage) AddMessage(field int, v *ProtoMessage) {
+	m.e.message(field, &v.e)
+}
+
+// Marshal returns the encoded message.
+func (m *ProtoMessage) Marshal() []byte {
+	return m.e.b
+}
+
+// message encodes a nested message field.
+func (e *protoEncoder) message(field int, m *protoEncoder) {
+	e.tag(field, protoBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(m.b)))
+	e.b = append(e.b, m.b...)
+}
+
+func (e *protoEncoder) time(field int, t time.Time) {
+	if !t.IsZero() {
+		e.int64(field, t.UnixNano())
+	}
+}
+
+// PROTO_SCHEMA_VERSION is the version of the honeybadger.proto schema.
+const PROTO_SCHEMA_VERSION = REPORT_SCHEMA_VERSION
+
+func encodeFlowProto(flow *types.TcpIpFlow) *protoEncoder {
+	ipFlow, tcpFlow := flow.Flows()
+	var e protoEncoder
+	e.string(1, ipFlow.Src().String())
+	e.uint64(2, uint64(endpointPort(tcpFlow.Src().Raw())))
+	e.string(3, ipFlow.Dst().String())
+	e.uint64(4, uint64(endpointPort(tcpFlow.Dst().Raw())))
+	return &e
+}
+
+func encodeAttackReportProto(event *types.Event) *protoEncoder {
+	var e protoEncoder
+	e.string(1, event.Type)
+	e.string(2, detectorOf(event.Type))
+	e.time(3, event.Time)
+	e.message(4, encodeFlowProto(&event.Flow))
+	e.uint64(5, event.PacketCount)
+	e.uint64(6, uint64(event.HijackSeq))
+	e.uint64(7, uint64(event.HijackAck))
+	e.uint64(8, uint64(event.Base))
+	e.uint64(9, uint64(event.Start))
+	e.uint64(10, uint64(event.End))
+	e.bytes(11, event.Payload)
+	e.bytes(12, event.Winner)
+	e.bytes(13, event.Loser)
+	e.double(14, event.SampleRate)
+	e.string(15, event.Snippet)
+	e.uint64(16, event.Occurrences)
+	if event.TLS != nil {
+		e.message(17, encodeTLSProto(event.TLS))
+	}
+	if event.Ingress != nil {
+		e.message(18, encodeIngressProto(event.Ingress))
+	}
+	if event.SrcAS != nil {
+		e.message(19, encodeASProto(event.SrcAS))
+	}
+	if event.DstAS != nil {
+		e.message(20, encodeASProto(event.DstAS))
+	}
+	return &e
+}
+
+func encodeTLSProto(hello *types.TLSClientHello) *protoEncoder {
+	var e protoEncoder
+	e.string(1, hello.ServerName)
+	for _, protocol := range hello.ALPN {
+		e.string(2, protocol)
+	}
+	e.string(3, hello.Version)
+	e.string(4, hello.JA3)
+	e.string(5, hello.JA3Hash)
+	return &e
+}
+
+func encodeIngressProto(ingress *types.Ingress) *protoEncoder {
+	var e protoEncoder
+	e.string(1, ingress.Interface)
+	var vlans []byte
+	for _, vlan := range ingress.VLANs {
+		vlans = binary.AppendUvarint(vlans, uint64(vlan))
+	}
+	e.bytes(2, vlans)
+	e.string(3, ingress.Tunnel)
+	e.uint64(4, uint64(ingress.TunnelID))
+	e.string(5, ingress.TunnelSrc)
+	e.string(6, ingress.TunnelDst)
+	return &e
+}
+
+func encodeASProto(as *types.AutonomousSystem) *protoEncoder {
+	var e protoEncoder
+	e.uint64(1, uint64(as.Number))
+	e.string(2, as.Prefix)
+	e.string(3, as.Name)
+	e.string(4, as.Country)
+	return &e
+}
+
+func encodeConnectionEventProto(event *types.Event) *protoEncoder {
+	var e protoEncoder
+	e.string(1, event.Type)
+	e.time(2, event.Time)
+	e.message(3, encodeFlowProto(&event.Flow))
+	e.uint64(4, event.PacketCount)
+	return &e
+}
+
+// EncodeEventProto returns the honeybadger.Event message, see honeybadger.proto,
+// of an event; connection events, those of the dispatcher, are encoded as
+// ConnectionEvents and all others as AttackReports.
+func EncodeEventProto(event *types.Event) []byte {
+	var e protoEncoder
+	e.uint64(1, PROTO_SCHEMA_VERSION)
+	if detectorOf(event.Type) == "dispatcher" {
+		e.message(3, encodeConnectionEventProto(event))
+	} else {
+		e.message(2, encodeAttackReportProto(event))
+	}
+	e.message(5, encodeSensorProto())
+	return e.b
+}
+
+func encodeSensorProto() *protoEncoder {
+	var e protoEncoder
+	e.string(1, Sensor)
+	e.string(2, Site)
+	keys := make([]string, 0, len(SensorTags))
+	for key := range SensorTags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var entry protoEncoder
+		entry.string(1, key)
+		entry.string(2, SensorTags[key])
+		e.message(3, &entry)
+	}
+	return &e
+}
+
+// TCP flag bits of PacketSummary.flags.
+const (
+	PROTO_TCP_FIN = 1 << iota
+	PROTO_TCP_SYN
+	PROTO_TCP_RST
+	PROTO_TCP_PSH
+	PROTO_TCP_ACK
+	PROTO_TCP_URG
+)
+
+// EncodePacketProto returns the honeybadger.Event message carrying
+// the PacketSummary of a packet.
+func EncodePacketProto(p *types.PacketManifest) []byte {
+	flags := uint64(0)
+	for _, flag := range []struct {
+		set bool
+		bit uint64
+	}{
+		{p.TCP.FIN, PROTO_TCP_FIN}, {p.TCP.SYN, PROTO_TCP_SYN}, {p.TCP.RST, PROTO_TCP_RST},
+		{p.TCP.PSH, PROTO_TCP_PSH}, {p.TCP.ACK, PROTO_TCP_ACK}, {p.TCP.URG, PROTO_TCP_URG},
+	} {
+		if flag.set {
+			flags |= flag.bit
+		}
+	}
+	var summary protoEncoder
+	summary.time(1, p.Timestamp)
+	summary.message(2, encodeFlowProto(p.Flow))
+	summary.uint64(3, uint64(p.TCP.Seq))
+	summary.uint64(4, uint64(p.TCP.Ack))
+	summary.uint64(5, flags)
+	summary.uint64(6, uint64(p.TCP.Window))
+	summary.uint64(7, uint64(len(p.Payload)))
+
+	var e protoEncoder
+	e.uint64(1, PROTO_SCHEMA_VERSION)
+	e.message(4, &summary)
+	return e.b
+}
+
+// FormatProtobuf renders an attack report as a honeybadger.Event message.
+func FormatProtobuf(event *types.Event) ([]byte, error) {
+	return EncodeEventProto(event), nil
+}
+
+// DecodeEventProto decodes a honeybadger.Event message carrying an
+// AttackReport or a ConnectionEvent, returning the event and the sensor
+// which sent it; events carrying a PacketSummary are refused.
+func DecodeEventProto(b []byte) (*types.Event, *ReportSensor, error) {
+	var event *types.Event
+	sensor := &ReportSensor{}
+	err := ProtoFields(b, func(field int, varint uint64, contents []byte) error {
+		var err error
+		switch field {
+		case 1:
+			if varint > PROTO_SCHEMA_VERSION {
+				return fmt.Errorf("protobuf: unsupported schema version %d", varint)
+			}
+		case 2:
+			event, err = decodeAttackReportProto(contents)
+		case 3:
+			event, err = decodeConnectionEventProto(contents)
+		case 4:
+			return errors.New("protobuf: packet summaries are not events")
+		case 5:
+			sensor, err = decodeSensorProto(contents)
+		}
+		return err
+	})
+	if err == nil && event == nil {
+		err = errors.New("protobuf: event message without an event")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return event, sensor, nil
+}
+
+func decodeTimeProto(varint uint64) time.Time {
+	return time.Unix(0, int64(varint)).UTC()
+}
+
+func decodeFlowProto(b []byte) (types.TcpIpFlow, error) {
+	var srcIP, dstIP string
+	var srcPort, dstPort uint64
+	err := ProtoFields(b, func(field int, varint uint64, contents []byte) error {
+		switch field {
+		case 1:
+			srcIP = string(contents)
+		case 2:
+			srcPort = varint
+		case 3:
+			dstIP = string(contents)
+		case 4:
+			dstPort = varint
+		}
+		return nil
+	})
+	if err != nil {
+		return types.TcpIpFlow{}, err
+	}
+	flow, err := types.ParseTcpIpFlow(fmt.Sprintf("%s:%d-%s:%d", srcIP, srcPort, dstIP, dstPort))
+	if err != nil {
+		return types.TcpIpFlow{}, fmt.Errorf("protobuf: %s", err)
+	}
+	return *flow, nil
+}
+
+func decodeAttackReportProto(b []byte) (*types.Event, error) {
+	event := types.Event{}
+	err := ProtoFields(b, func(field int, varint uint64, contents []byte) error {
+		var err error
+		switch field {
+		case 1:
+			event.Type = string(contents)
+		case 3:
+			event.Time = decodeTimeProto(varint)
+		case 4:
+			event.Flow, err = decodeFlowProto(contents)
+		case 5:
+			event.PacketCount = varint
+		case 6:
+			event.HijackSeq = uint32(varint)
+		case 7:
+			event.HijackAck = uint32(varint)
+		case 8:
+			event.Base = types.Sequence(varint)
+		case 9:
+			event.Start = types.Sequence(varint)
+		case 10:
+			event.End = types.Sequence(varint)
+		case 11:
+			event.Payload = append([]byte(nil), contents...)
+		case 12:
+			event.Winner = append([]byte(nil), contents...)
+		case 13:
+			event.Loser = append([]byte(nil), contents...)
+		case 14:
+			event.SampleRate = math.Float64frombits(varint)
+		case 15:
+			event.Snippet = string(contents)
+		case 16:
+			event.Occurrences = varint
+		case 17:
+			event.TLS, err = decodeTLSProto(contents)
+		case 18:
+			event.Ingress, err = decodeIngressProto(contents)
+		case 19:
+			event.SrcAS, err = decodeASProto(contents)
+		case 20:
+			event.DstAS, err = decodeASProto(contents)
+		}
+		return err
+	})
+	return &event, err
+}
+
+func decodeTLSProto(b []byte) (*types.TLSClientHello, error) {
+	hello := types.TLSClientHello{}
+	err := ProtoFields(b, func(field int, varint uint64, contents []byte) error {
+		switch field {
+		case 1:
+			hello.ServerName = string(contents)
+		case 2:
+			hello.ALPN = append(hello.ALPN, string(contents))
+		case 3:
+			hello.Version = string(contents)
+		case 4:
+			hello.JA3 = string(contents)
+		case 5:
+			hello.JA3Hash = string(contents)
+		}
+		return nil
+	})
+	return &hello, err
+}
+
+func decodeIngressProto(b []byte) (*types.Ingress, error) {
+	ingress := types.Ingress{}
+	err := ProtoFields(b, func(field int, varint uint64, contents []byte) error {
+		switch field {
+		case 1:
+			ingress.Interface = string(contents)
+		case 2:
+			for len(contents) > 0 {
+				vlan, n := binary.Uvarint(contents)
+				if n <= 0 {
+					return errProtoTruncated
+				}
+				ingress.VLANs = append(ingress.VLANs, uint16(vlan))
+				contents = contents[n:]
+			}
+		case 3:
+			ingress.Tunnel = string(contents)
+		case 4:
+			ingress.TunnelID = uint32(varint)
+		case 5:
+			ingress.TunnelSrc = string(contents)
+		case 6:
+			ingress.TunnelDst = string(contents)
+		}
+		return nil
+	})
+	return &ingress, err
+}
+
+func decodeASProto(b []byte) (*types.AutonomousSystem, error) {
+	as := types.AutonomousSystem{}
+	err := ProtoFields(b, func(field int, varint uint64, contents []byte) error {
+		switch field {
+		case 1:
+			as.Number = uint32(varint)
+		case 2:
+			as.Prefix = string(contents)
+		case 3:
+			as.Name = string(contents)
+		case 4:
+			as.Country = string(contents)
+		}
+		return nil
+	})
+	return &as, err
+}
+
+func decodeConnectionEventProto(b []byte) (*types.Event, error) {
+	event := types.Event{}
+	err := ProtoFields(b, func(field int, varint uint64, contents []byte) error {
+		var err error
+		switch field {
+		case 1:
+			event.Type = string(contents)
+		case 2:
+			event.Time = decodeTimeProto(varint)
+		case 3:
+			event.Flow, err = decodeFlowProto(contents)
+		case 4:
+			event.PacketCount = varint
+		}
+		return err
+	})
+	return &event, err
+}
+
+func decodeSensorProto(b []byte) (*ReportSensor, error) {
+	sensor := ReportSensor{}
+	err := ProtoFields(b, func(field int, varint uint64, contents []byte) error {
+		switch field {
+		case 1:
+			sensor.ID = string(contents)
+		case 2:
+			sensor.Site = string(contents)
+		case 3:
+			var key, value string
+			err := ProtoFields(contents, func(field int, varint uint64, contents []byte) error {
+				switch field {
+				case 1:
+					key = string(contents)
+				case 2:
+					value = string(contents)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if sensor.Tags == nil {
+				sensor.Tags = make(map[string]string)
+			}
+			sensor.Tags[key] = value
+		}
+		return nil
+	})
+	return &sensor, err
+}
@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket/layers"
+)
+
+// protoField returns the contents of a length delimited field of a message.
+func protoField(t *testing.T, message []byte, field int) []byte {
+	var found []byte
+	err := ProtoFields(message, func(f int, varint uint64, contents []byte) error {
+		if f == field {
+			found = contents
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func protoVarintField(t *testing.T, message []byte, field int) uint64 {
+	var found uint64
+	err := ProtoFields(message, func(f int, varint uint64, contents []byte) error {
+		if f == field {
+			found = varint
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestEncodeEventProto(t *testing.T) {
+	attack := EncodeEventProto(testReportEvent())
+	if protoVarintField(t, attack, 1) != PROTO_SCHEMA_VERSION {
+		t.Error("schema version missing")
+	}
+	report := protoField(t, attack, 2)
+	if string(protoField(t, report, 1)) != "handshake-hijack" || protoVarintField(t, report, 6) != 7 {
+		t.Error("unexpected attack report")
+	}
+	flow := protoField(t, report, 4)
+	if string(protoField(t, flow, 1)) != "1.2.3.4" || protoVarintField(t, flow, 4) != 2 {
+		t.Error("unexpected flow")
+	}
+
+	connectionEvent := testReportEvent()
+	connectionEvent.Type = "connection-opened"
+	if protoField(t, EncodeEventProto(connectionEvent), 3) == nil {
+		t.Error("connection event not encoded as a ConnectionEvent")
+	}
+}
+
+func TestEncodePacketProto(t *testing.T) {
+	event := testReportEvent()
+	p := types.PacketManifest{
+		Flow:    &event.Flow,
+		TCP:     &layers.TCP{SYN: true, ACK: true, Seq: 3, Window: 512},
+		Payload: []byte{1, 2},
+	}
+	summary := protoField(t, EncodePacketProto(&p), 4)
+	if protoVarintField(t, summary, 3) != 3 || protoVarintField(t, summary, 5) != PROTO_TCP_SYN|PROTO_TCP_ACK ||
+		protoVarintField(t, summary, 6) != 512 || protoVarintField(t, summary, 7) != 2 {
+		t.Error("unexpected packet summary")
+	}
+}
+
+func TestDecodeEventProto(t *testing.T) {
+	sensor, tags := Sensor, SensorTags
+	Sensor, SensorTags = "sensor1", map[string]string{"rack": "4"}
+	defer func() { Sensor, SensorTags = sensor, tags }()
+
+	event := testReportEvent()
+	event.Start, event.End = 10, 20
+	event.Payload = []byte("injected")
+	event.SampleRate = 0.5
+	event.TLS = &types.TLSClientHello{ServerName: "example.com", ALPN: []string{"h2", "http/1.1"}}
+	event.Ingress = &types.Ingress{Interface: "eth0", VLANs: []uint16{100, 200}}
+	decoded, decodedSensor, err := DecodeEventProto(EncodeEventProto(event))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Flow.Equal(&event.Flow) {
+		t.Errorf("decoded flow %s, expected %s", decoded.Flow, event.Flow)
+	}
+	decoded.Flow = event.Flow
+	event.Time = event.Time.UTC()
+	if !reflect.DeepEqual(decoded, event) {
+		t.Errorf("decoded %+v, expected %+v", decoded, event)
+	}
+	if decodedSensor.ID != "sensor1" || decodedSensor.Tags["rack"] != "4" {
+		t.Errorf("decoded sensor %+v", decodedSensor)
+	}
+
+	p := types.PacketManifest{Flow: &event.Flow, TCP: &layers.TCP{ACK: true}}
+	if _, _, err := DecodeEventProto(EncodePacketProto(&p)); err == nil {
+		t.Error("decoded a packet summary as an event")
+	}
+}
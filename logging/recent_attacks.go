@@ -0,0 +1,136 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"sync"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// RECENT_ATTACKS is the default number of attack reports a RecentAttacks keeps.
+const RECENT_ATTACKS = 1000
+
+// AttackQuery selects attack reports of a RecentAttacks: those Filter
+// matches, of the connection of Flow, in either direction, if it is set,
+// reported within [Since, Until), if they are set. At most Limit reports
+// are returned if it is greater than zero.
+type AttackQuery struct {
+	Filter *EventFilter
+	Flow   string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// Matches returns true if the query selects the event.
+func (q *AttackQuery) Matches(event *types.Event) bool {
+	if q.Filter != nil && !q.Filter.Matches(event) {
+		return false
+	}
+	if q.Flow != "" && event.Flow.String() != q.Flow && event.Flow.Reverse().String() != q.Flow {
+		return false
+	}
+	if !q.Since.IsZero() && event.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !event.Time.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// RecentAttacks is an attack logger keeping the most recent attack
+// reports in memory, such that a running sensor may be asked for them;
+// the oldest report is forgotten once it holds Size reports.
+// Connection events are not kept.
+type RecentAttacks struct {
+	Size int
+
+	mutex  sync.Mutex
+	events []*types.Event
+	next   int
+	total  uint64
+	counts map[string]uint64
+}
+
+// NewRecentAttacks returns a pointer to a RecentAttacks struct
+// keeping up to size reports, or RECENT_ATTACKS if size <= 0.
+func NewRecentAttacks(size int) *RecentAttacks {
+	if size <= 0 {
+		size = RECENT_ATTACKS
+	}
+	return &RecentAttacks{
+		Size:   size,
+		counts: make(map[string]uint64),
+	}
+}
+
+func (r *RecentAttacks) Start() {}
+
+func (r *RecentAttacks) Stop() {}
+
+func (r *RecentAttacks) Log(event *types.Event) {
+	if detectorOf(event.Type) == "dispatcher" {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.total++
+	r.counts[event.Type]++
+	if len(r.events) < r.Size {
+		r.events = append(r.events, event)
+		return
+	}
+	r.events[r.next] = event
+	r.next = (r.next + 1) % r.Size
+}
+
+// Query returns the kept attack reports the query selects, most recent first.
+func (r *RecentAttacks) Query(query AttackQuery) []*types.Event {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	result := []*types.Event{}
+	for i := len(r.events) - 1; i >= 0; i-- {
+		event := r.events[(r.next+i)%len(r.events)]
+		if !query.Matches(event) {
+			continue
+		}
+		result = append(result, event)
+		if query.Limit > 0 && len(result) == query.Limit {
+			break
+		}
+	}
+	return result
+}
+
+// Counts returns the number of attack reports logged since the
+// RecentAttacks was created, in total and by attack type,
+// including those no longer kept.
+func (r *RecentAttacks) Counts() (uint64, map[string]uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	counts := make(map[string]uint64, len(r.counts))
+	for eventType, count := range r.counts {
+		counts[eventType] = count
+	}
+	return r.total, counts
+}
@@ -0,0 +1,45 @@
+package logging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecentAttacks(t *testing.T) {
+	recent := NewRecentAttacks(2)
+	for i, eventType := range []string{"handshake-hijack", "injection", "ordered coalesce 2", "connection-opened"} {
+		event := testReportEvent()
+		event.Type = eventType
+		event.Time = time.Unix(int64(i+1), 0)
+		recent.Log(event)
+	}
+
+	events := recent.Query(AttackQuery{})
+	if len(events) != 2 || events[0].Type != "ordered coalesce 2" || events[1].Type != "injection" {
+		t.Fatalf("kept %v, expected the two most recent attacks", events)
+	}
+	total, counts := recent.Counts()
+	if total != 3 || counts["handshake-hijack"] != 1 || counts["connection-opened"] != 0 {
+		t.Errorf("counted %d attacks, %v", total, counts)
+	}
+
+	filter, _ := ParseEventFilter([]string{"injection"}, nil)
+	if events := recent.Query(AttackQuery{Filter: filter}); len(events) != 1 || events[0].Type != "injection" {
+		t.Errorf("type filter selected %v", events)
+	}
+	if events := recent.Query(AttackQuery{Flow: "2.3.4.5:2-1.2.3.4:1"}); len(events) != 2 {
+		t.Errorf("reverse flow selected %d attacks", len(events))
+	}
+	if events := recent.Query(AttackQuery{Flow: "1.2.3.4:9-2.3.4.5:2"}); len(events) != 0 {
+		t.Errorf("other flow selected %d attacks", len(events))
+	}
+	if events := recent.Query(AttackQuery{Since: time.Unix(3, 0)}); len(events) != 1 {
+		t.Errorf("since selected %d attacks", len(events))
+	}
+	if events := recent.Query(AttackQuery{Until: time.Unix(3, 0)}); len(events) != 1 || events[0].Type != "injection" {
+		t.Errorf("until selected %v", events)
+	}
+	if events := recent.Query(AttackQuery{Limit: 1}); len(events) != 1 || events[0].Type != "ordered coalesce 2" {
+		t.Errorf("limit selected %v", events)
+	}
+}
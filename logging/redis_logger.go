@@ -0,0 +1,314 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// RedisAttackLogger sends attack reports to Redis: published, rendered by
+// Format, on the pub/sub Channel and/or appended with XADD to the Stream,
+// whose entries hold the type, detector and flow of the report beside the
+// formatted report itself. Channel and Stream may contain "{type}" and
+// "{detector}", replaced by those of the report. Streams are capped near
+// MaxLen entries; if Group is set the consumer group is created on the
+// stream on connecting, so consumers can read it with XREADGROUP.
+type RedisAttackLogger struct {
+	Address  string
+	Username string
+	Password string
+	DB       int
+	TLS      *tls.Config
+	Channel  string
+	Stream   string
+	Group    string
+	MaxLen   int
+	Format   ReportFormatter
+	Timeout  time.Duration
+	Retries  int
+
+	conn             net.Conn
+	reader           *bufio.Reader
+	groups           map[string]bool
+	stopChan         chan bool
+	attackReportChan chan *types.Event
+}
+
+func init() {
+	AttackLoggerRegister("redis", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewRedisAttackLoggerFromOptions(options)
+	})
+}
+
+// NewRedisAttackLogger returns a pointer to a RedisAttackLogger struct
+// sending to the Redis server at address.
+func NewRedisAttackLogger(address string) *RedisAttackLogger {
+	return &RedisAttackLogger{
+		Address:          address,
+		MaxLen:           100000,
+		Format:           FormatJSON,
+		Timeout:          5 * time.Second,
+		Retries:          3,
+		groups:           make(map[string]bool),
+		stopChan:         make(chan bool),
+		attackReportChan: make(chan *types.Event, 1000),
+	}
+}
+
+// NewRedisAttackLoggerFromOptions returns a RedisAttackLogger configured by the
+// backend parameters address, username, password, db, tls, channel, stream,
+// group, maxlen, format, timeout and retries. Without a channel or stream
+// reports are published on the channel "honeybadger".
+func NewRedisAttackLoggerFromOptions(options *AttackLoggerOptions) (*RedisAttackLogger, error) {
+	r := NewRedisAttackLogger(options.Param("address", "localhost:6379"))
+	r.Username = options.Param("username", "")
+	r.Password = options.Param("password", "")
+	r.Channel = options.Param("channel", "")
+	r.Stream = options.Param("stream", "")
+	r.Group = options.Param("group", "")
+	if r.Channel == "" && r.Stream == "" {
+		r.Channel = "honeybadger"
+	}
+	if options.Param("tls", "") == "true" {
+		host, _, err := net.SplitHostPort(r.Address)
+		if err != nil {
+			return nil, err
+		}
+		r.TLS = &tls.Config{ServerName: host}
+	}
+	var err error
+	if r.DB, err = strconv.Atoi(options.Param("db", "0")); err != nil {
+		return nil, fmt.Errorf("redis: invalid db: %s", err)
+	}
+	if r.MaxLen, err = strconv.Atoi(options.Param("maxlen", strconv.Itoa(r.MaxLen))); err != nil {
+		return nil, fmt.Errorf("redis: invalid maxlen: %s", err)
+	}
+	if r.Format, err = reportFormat(options.Param("format", "json")); err != nil {
+		return nil, err
+	}
+	if r.Timeout, err = time.ParseDuration(options.Param("timeout", r.Timeout.String())); err != nil {
+		return nil, fmt.Errorf("redis: invalid timeout: %s", err)
+	}
+	if r.Retries, err = strconv.Atoi(options.Param("retries", strconv.Itoa(r.Retries))); err != nil {
+		return nil, fmt.Errorf("redis: invalid retries: %s", err)
+	}
+	return r, nil
+}
+
+func (r *RedisAttackLogger) Start() {
+	go r.receiveReports()
+}
+
+func (r *RedisAttackLogger) Stop() {
+	r.stopChan <- true
+}
+
+func (r *RedisAttackLogger) Log(event *types.Event) {
+	r.attackReportChan <- event
+}
+
+func (r *RedisAttackLogger) receiveReports() {
+	for {
+		select {
+		case <-r.stopChan:
+			r.close()
+			return
+		case event := <-r.attackReportChan:
+			if err := r.send(event); err != nil {
+				backendWarningf("redis", "%s\n", err)
+			}
+		}
+	}
+}
+
+func (r *RedisAttackLogger) key(template, eventType string) string {
+	return strings.NewReplacer("{type}", eventType, "{detector}", detectorOf(eventType)).Replace(template)
+}
+
+// redisError is an error reply of the server; the connection remains usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+func (r *RedisAttackLogger) send(event *types.Event) error {
+	report, err := r.Format(event)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		if r.conn == nil {
+			err = r.connect()
+		}
+		if err == nil {
+			if err = r.write(event, report); err == nil {
+				return nil
+			}
+			if _, ok := err.(redisError); ok {
+				return err
+			}
+			r.close()
+		}
+		if attempt >= r.Retries {
+			return err
+		}
+		time.Sleep(time.Duration(attempt+1) * 100 * time.Millisecond)
+	}
+}
+
+func (r *RedisAttackLogger) write(event *types.Event, report []byte) error {
+	if r.Stream != "" {
+		stream := r.key(r.Stream, event.Type)
+		if r.Group != "" && !r.groups[stream] {
+			_, err := r.command("XGROUP", "CREATE", stream, r.Group, "$", "MKSTREAM")
+			if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+				return err
+			}
+			r.groups[stream] = true
+		}
+		args := []string{"XADD", stream}
+		if r.MaxLen > 0 {
+			args = append(args, "MAXLEN", "~", strconv.Itoa(r.MaxLen))
+		}
+		args = append(args, "*",
+			"type", event.Type,
+			"detector", detectorOf(event.Type),
+			"flow", event.Flow.String(),
+			"report", string(report))
+		if _, err := r.command(args...); err != nil {
+			return err
+		}
+	}
+	if r.Channel != "" {
+		if _, err := r.command("PUBLISH", r.key(r.Channel, event.Type), string(report)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RedisAttackLogger) connect() error {
+	conn, err := net.DialTimeout("tcp", r.Address, r.Timeout)
+	if err != nil {
+		return err
+	}
+	if r.TLS != nil {
+		tlsConn := tls.Client(conn, r.TLS)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+	r.conn = conn
+	r.reader = bufio.NewReader(conn)
+	r.groups = make(map[string]bool)
+	if r.Password != "" {
+		args := []string{"AUTH", r.Password}
+		if r.Username != "" {
+			args = []string{"AUTH", r.Username, r.Password}
+		}
+		if _, err := r.command(args...); err != nil {
+			r.close()
+			return err
+		}
+	}
+	if r.DB != 0 {
+		if _, err := r.command("SELECT", strconv.Itoa(r.DB)); err != nil {
+			r.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// command sends a command and returns its reply, a simple string, integer or
+// bulk string; an array reply is flattened into its elements joined by spaces.
+func (r *RedisAttackLogger) command(args ...string) (string, error) {
+	r.conn.SetDeadline(time.Now().Add(r.Timeout))
+	defer r.conn.SetDeadline(time.Time{})
+	request := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		request += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(r.conn, request); err != nil {
+		return "", err
+	}
+	return r.reply()
+}
+
+func (r *RedisAttackLogger) reply() (string, error) {
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", redisError(line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return "", err
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(r.reader, value); err != nil {
+			return "", err
+		}
+		return string(value[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", err
+		}
+		var elements []string
+		for i := 0; i < count; i++ {
+			element, err := r.reply()
+			if err != nil {
+				return "", err
+			}
+			elements = append(elements, element)
+		}
+		return strings.Join(elements, " "), nil
+	}
+	return "", fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func (r *RedisAttackLogger) close() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+}
@@ -0,0 +1,71 @@
+package logging
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// serveFakeRedis answers the commands of a client and sends each command received.
+func serveFakeRedis(listener net.Listener, commands chan []string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	client := &RedisAttackLogger{conn: conn, reader: bufio.NewReader(conn)}
+	for {
+		// a request is an array of bulk strings, just like a reply
+		request, err := client.reply()
+		if err != nil {
+			return
+		}
+		command := strings.SplitN(request, " ", 2)
+		switch command[0] {
+		case "XGROUP":
+			conn.Write([]byte("-BUSYGROUP Consumer Group name already exists\r\n"))
+		case "XADD":
+			conn.Write([]byte("$15\r\n1526919030474-0\r\n"))
+		default:
+			conn.Write([]byte(":1\r\n"))
+		}
+		commands <- command
+	}
+}
+
+func TestRedisAttackLogger(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	commands := make(chan []string, 10)
+	go serveFakeRedis(listener, commands)
+
+	logger, err := NewRedisAttackLoggerFromOptions(&AttackLoggerOptions{
+		Params: map[string]string{
+			"address":  listener.Addr().String(),
+			"password": "secret",
+			"channel":  "hb.{detector}",
+			"stream":   "hb-events",
+			"group":    "dashboards",
+			"maxlen":   "1000",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.send(testReportEvent()); err != nil {
+		t.Fatal(err)
+	}
+	logger.close()
+
+	expected := []string{"AUTH secret", "XGROUP CREATE hb-events dashboards $ MKSTREAM", "XADD hb-events MAXLEN ~ 1000 * type handshake-hijack", "PUBLISH hb.handshake {"}
+	for _, prefix := range expected {
+		command := strings.Join(<-commands, " ")
+		if !strings.HasPrefix(command, prefix) {
+			t.Errorf("got command %q, expected %q", command, prefix)
+		}
+	}
+}
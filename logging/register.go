@@ -0,0 +1,255 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// AttackLogger is an attack report backend. Reports are handed to it with
+// Log between Start and Stop; a backend failing to record a report must
+// not hold up the reports of other backends.
+type AttackLogger interface {
+	types.Logger
+	Start()
+	Stop()
+}
+
+// AttackLoggerOptions are the options an attack logger backend is built with:
+// the archive directory and the backend's own parameters.
+type AttackLoggerOptions struct {
+	ArchiveDir string
+	Params     map[string]string
+}
+
+// Param returns the named backend parameter, or def if it is not set.
+func (o *AttackLoggerOptions) Param(name, def string) string {
+	if value, ok := o.Params[name]; ok {
+		return value
+	}
+	return def
+}
+
+var AttackLoggers = map[string]func(*AttackLoggerOptions) (AttackLogger, error){}
+
+// AttackLoggerRegister makes an attack logger backend available by the provided name.
+// If AttackLoggerRegister is called twice with the same name or if factory is nil, it panics.
+func AttackLoggerRegister(name string, factory func(*AttackLoggerOptions) (AttackLogger, error)) {
+	if factory == nil {
+		panic("logging: attack logger factory is nil")
+	}
+	if _, dup := AttackLoggers[name]; dup {
+		panic("logging: AttackLoggerRegister called twice for attack logger " + name)
+	}
+	AttackLoggers[name] = factory
+}
+
+// NewAttackLogger returns the named attack logger backend built with the given options.
+func NewAttackLogger(name string, options *AttackLoggerOptions) (AttackLogger, error) {
+	factory, ok := AttackLoggers[name]
+	if !ok {
+		var names []string
+		for registered := range AttackLoggers {
+			names = append(names, registered)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown attack logger %q; one of %s", name, strings.Join(names, ", "))
+	}
+	return factory(options)
+}
+
+// ParseAttackLoggers builds the attack logger backends of a semicolon
+// separated list; each the name of a backend, optionally followed by a colon
+// and the backend's comma separated key=value parameters.
+// For example: "json; syslog:address=localhost:514,facility=local0".
+func ParseAttackLoggers(spec string, archiveDir string) (*MultiAttackLogger, error) {
+	multi := &MultiAttackLogger{}
+	for _, field := range strings.Split(spec, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		options := AttackLoggerOptions{
+			ArchiveDir: archiveDir,
+			Params:     make(map[string]string),
+		}
+		parts := strings.SplitN(field, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) == 2 {
+			for _, param := range strings.Split(parts[1], ",") {
+				keyValue := strings.SplitN(param, "=", 2)
+				if len(keyValue) != 2 {
+					return nil, fmt.Errorf("attack logger %s: invalid parameter %q", name, param)
+				}
+				options.Params[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+			}
+		}
+		logger, err := NewAttackLogger(name, &options)
+		if err != nil {
+			return nil, err
+		}
+		multi.Add(name, logger)
+	}
+	return multi, nil
+}
+
+type namedAttackLogger struct {
+	name   string
+	logger AttackLogger
+}
+
+// MultiAttackLogger fans each attack report out to all of its backends.
+// A backend panicking while handling a report is logged and
+// does not prevent the report from reaching the other backends.
+type MultiAttackLogger struct {
+	loggers []namedAttackLogger
+}
+
+// Add attaches a backend under the given name.
+func (m *MultiAttackLogger) Add(name string, logger AttackLogger) {
+	m.loggers = append(m.loggers, namedAttackLogger{name: name, logger: logger})
+}
+
+// Len returns the number of attached backends.
+func (m *MultiAttackLogger) Len() int {
+	return len(m.loggers)
+}
+
+func (m *MultiAttackLogger) Start() {
+	for _, l := range m.loggers {
+		safely(l.name, "start", l.logger.Start)
+	}
+}
+
+func (m *MultiAttackLogger) Stop() {
+	for _, l := range m.loggers {
+		safely(l.name, "stop", l.logger.Stop)
+	}
+}
+
+func (m *MultiAttackLogger) Log(event *types.Event) {
+	for _, l := range m.loggers {
+		logger := l.logger
+		safely(l.name, "log", func() { logger.Log(event) })
+	}
+}
+
+// ReloadableLogger is an AttackLogger whose backends may be replaced while
+// it runs, so that reports keep flowing to the loggers holding it.
+type ReloadableLogger struct {
+	// lifecycle serializes Start, Stop and Reload; mutex guards logger
+	// which is only replaced while holding both.
+	lifecycle sync.Mutex
+	mutex     sync.RWMutex
+	logger    AttackLogger
+	started   bool
+}
+
+// NewReloadableLogger returns a ReloadableLogger sending reports to logger.
+func NewReloadableLogger(logger AttackLogger) *ReloadableLogger {
+	return &ReloadableLogger{
+		logger: logger,
+	}
+}
+
+func (r *ReloadableLogger) Start() {
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+	r.started = true
+	r.logger.Start()
+}
+
+func (r *ReloadableLogger) Stop() {
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+	r.started = false
+	r.logger.Stop()
+}
+
+func (r *ReloadableLogger) Log(event *types.Event) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	r.logger.Log(event)
+}
+
+// Reload sends reports to logger from now on. If running, logger is
+// started before it takes over and the logger it replaces is stopped,
+// delivering the reports queued for it, once it no longer receives any.
+func (r *ReloadableLogger) Reload(logger AttackLogger) {
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+	if r.started {
+		logger.Start()
+	}
+	r.mutex.Lock()
+	previous := r.logger
+	r.logger = logger
+	r.mutex.Unlock()
+	if r.started {
+		previous.Stop()
+	}
+}
+
+// safely calls fn, logging rather than propagating a panic of the named backend.
+func safely(name, operation string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			countBackendError(name)
+			Errorf("attack logger %s failed to %s: %v\n", name, operation, r)
+		}
+	}()
+	fn()
+}
+
+// backendErrors counts the errors each attack logger backend has logged.
+var backendErrors = struct {
+	sync.Mutex
+	counts map[string]uint64
+}{counts: make(map[string]uint64)}
+
+func countBackendError(name string) {
+	backendErrors.Lock()
+	backendErrors.counts[name]++
+	backendErrors.Unlock()
+}
+
+// backendWarningf logs a warning of the named attack logger backend,
+// counting it as one of the backend's errors.
+func backendWarningf(name, format string, args ...interface{}) {
+	countBackendError(name)
+	Warningf(name+" attack logger: "+format, args...)
+}
+
+// BackendErrors returns the number of errors logged by each attack logger
+// backend since start, by backend name.
+func BackendErrors() map[string]uint64 {
+	backendErrors.Lock()
+	defer backendErrors.Unlock()
+	counts := make(map[string]uint64, len(backendErrors.counts))
+	for name, count := range backendErrors.counts {
+		counts[name] = count
+	}
+	return counts
+}
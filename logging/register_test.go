@@ -0,0 +1,96 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+type testAttackLogger struct {
+	options *AttackLoggerOptions
+	started bool
+	stopped bool
+	events  []*types.Event
+	broken  bool
+}
+
+func (l *testAttackLogger) Start() { l.started = true }
+func (l *testAttackLogger) Stop()  { l.stopped = true }
+func (l *testAttackLogger) Log(event *types.Event) {
+	if l.broken {
+		panic("broken backend")
+	}
+	l.events = append(l.events, event)
+}
+
+var testAttackLoggers []*testAttackLogger
+
+func init() {
+	AttackLoggerRegister("test", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		l := &testAttackLogger{
+			options: options,
+			broken:  options.Param("broken", "") == "true",
+		}
+		testAttackLoggers = append(testAttackLoggers, l)
+		return l, nil
+	})
+}
+
+func TestParseAttackLoggers(t *testing.T) {
+	testAttackLoggers = nil
+	multi, err := ParseAttackLoggers("test:broken=true,name=a; test", "archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if multi.Len() != 2 || len(testAttackLoggers) != 2 {
+		t.Fatalf("expected 2 backends, got %d", multi.Len())
+	}
+	if testAttackLoggers[0].options.Param("name", "") != "a" || testAttackLoggers[1].options.ArchiveDir != "archives" {
+		t.Fatal("backend options not parsed")
+	}
+
+	errors := BackendErrors()["test"]
+	multi.Start()
+	multi.Log(&types.Event{Type: "injection"})
+	for i, l := range testAttackLoggers {
+		if !l.started {
+			t.Errorf("backend %d not started", i)
+		}
+	}
+	if len(testAttackLoggers[1].events) != 1 {
+		t.Error("report not fanned out past a failing backend")
+	}
+	if BackendErrors()["test"] != errors+1 {
+		t.Errorf("backend errors %v", BackendErrors())
+	}
+
+	if _, err := ParseAttackLoggers("nonexistent", ""); err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+	if _, err := ParseAttackLoggers("test:broken", ""); err == nil {
+		t.Error("expected an error for a malformed parameter")
+	}
+}
+
+func TestReloadableLogger(t *testing.T) {
+	first, second, third := &testAttackLogger{}, &testAttackLogger{}, &testAttackLogger{}
+	reloadable := NewReloadableLogger(first)
+	reloadable.Reload(second)
+	if second.started || first.stopped {
+		t.Error("backends started or stopped before the logger is")
+	}
+	reloadable.Start()
+	reloadable.Log(&types.Event{Type: "injection"})
+	reloadable.Reload(third)
+	reloadable.Log(&types.Event{Type: "injection"})
+	if !second.started || !second.stopped || len(second.events) != 1 {
+		t.Errorf("replaced backend started %v stopped %v with %d reports", second.started, second.stopped, len(second.events))
+	}
+	if !third.started || third.stopped || len(third.events) != 1 {
+		t.Errorf("new backend started %v stopped %v with %d reports", third.started, third.stopped, len(third.events))
+	}
+	reloadable.Stop()
+	if !third.stopped || len(first.events) != 0 {
+		t.Error("backend not stopped")
+	}
+}
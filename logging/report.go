@@ -0,0 +1,298 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// REPORT_SCHEMA_VERSION is the version of the AttackReport JSON schema;
+// it is incremented whenever a field changes meaning or is removed.
+const REPORT_SCHEMA_VERSION = 1
+
+// AttackReport is the versioned JSON form of an attack report, the same for
+// every report type. Byte fields are encoded as base64 strings; fields
+// which do not apply to a report type are omitted.
+type AttackReport struct {
+	SchemaVersion int             `json:"schema_version"`
+	Type          string          `json:"type"`
+	Detector      string          `json:"detector"`
+	Time          time.Time       `json:"time"`
+	Flow          ReportFlow      `json:"flow"`
+	PacketCount   uint64          `json:"packet_count"`
+	Hijack        *ReportHijack   `json:"hijack,omitempty"`
+	Sequence      *ReportSequence `json:"sequence,omitempty"`
+	Payload       []byte          `json:"payload,omitempty"`
+	Winner        []byte          `json:"winner,omitempty"`
+	Loser         []byte          `json:"loser,omitempty"`
+	SampleRate    float64         `json:"sample_rate,omitempty"`
+	Snippet       string          `json:"snippet,omitempty"`
+	Diff          []DiffRun       `json:"diff,omitempty"`
+	Occurrences   uint64          `json:"occurrences,omitempty"`
+	TLS           *ReportTLS      `json:"tls,omitempty"`
+	Ingress       *ReportIngress  `json:"ingress,omitempty"`
+	Sensor        *ReportSensor   `json:"sensor"`
+}
+
+// ReportFlow is the TCP/IP 4-tuple of the reported packet.
+type ReportFlow struct {
+	SrcIP   string    `json:"src_ip"`
+	SrcPort uint16    `json:"src_port"`
+	DstIP   string    `json:"dst_ip"`
+	DstPort uint16    `json:"dst_port"`
+	SrcAS   *ReportAS `json:"src_as,omitempty"`
+	DstAS   *ReportAS `json:"dst_as,omitempty"`
+}
+
+// ReportAS is the autonomous system an endpoint is routed to.
+type ReportAS struct {
+	Number  uint32 `json:"asn"`
+	Prefix  string `json:"prefix,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// reportAS returns the ReportAS of as, nil if as is.
+func reportAS(as *types.AutonomousSystem) *ReportAS {
+	if as == nil {
+		return nil
+	}
+	return &ReportAS{Number: as.Number, Prefix: as.Prefix, Name: as.Name, Country: as.Country}
+}
+
+// ReportHijack holds the sequence and acknowledgement numbers of a handshake packet.
+type ReportHijack struct {
+	Seq uint32 `json:"seq"`
+	Ack uint32 `json:"ack"`
+}
+
+// ReportTLS is the TLS ClientHello the client of the connection sent.
+type ReportTLS struct {
+	ServerName string   `json:"sni,omitempty"`
+	ALPN       []string `json:"alpn,omitempty"`
+	Version    string   `json:"version"`
+	JA3        string   `json:"ja3"`
+	JA3Hash    string   `json:"ja3_hash"`
+}
+
+// ReportIngress is where the reported packet was seen: the capture
+// interface, its VLAN IDs and the outermost tunnel it was carried in.
+type ReportIngress struct {
+	Interface string   `json:"interface,omitempty"`
+	VLANs     []uint16 `json:"vlan,omitempty"`
+	Tunnel    string   `json:"tunnel,omitempty"`
+	TunnelID  uint32   `json:"tunnel_id,omitempty"`
+	TunnelSrc string   `json:"tunnel_src,omitempty"`
+	TunnelDst string   `json:"tunnel_dst,omitempty"`
+}
+
+// ReportSequence is the stream range [Start, End) a report covers
+// and Base, the sequence the stream started at.
+type ReportSequence struct {
+	Base  uint32 `json:"base"`
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+}
+
+// detectorOf returns the name of the detector which produces reports of the given type.
+// Detector plugins are named by the "plugin-<name>" prefix of their reports' type.
+func detectorOf(eventType string) string {
+	switch {
+	case strings.HasPrefix(eventType, "plugin-") && strings.Contains(eventType, ": "):
+		return eventType[:strings.Index(eventType, ": ")]
+	case strings.HasPrefix(eventType, "handshake-"):
+		return "handshake"
+	case strings.HasPrefix(eventType, "censor-injection-"):
+		return "censorship"
+	case strings.HasPrefix(eventType, "ordered coalesce"):
+		return "coalesce-injection"
+	case strings.HasSuffix(eventType, "injection"):
+		return "injection"
+	case strings.HasPrefix(eventType, "connection-"):
+		return "dispatcher"
+	case strings.HasPrefix(eventType, "sensor-"):
+		return "sensor"
+	}
+	return "unknown"
+}
+
+func endpointPort(endpoint []byte) uint16 {
+	if len(endpoint) != 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(endpoint)
+}
+
+// flowID returns an ID for the connection of the flow, the same for
+// both of its directions; it fits in a signed 64 bit integer.
+func flowID(flow *types.TcpIpFlow) uint64 {
+	key, _ := types.NewFlowKey(flow)
+	h := fnv.New64a()
+	h.Write(key.A[:])
+	h.Write(key.B[:])
+	return h.Sum64() & 0x7fffffffffffffff
+}
+
+// NewAttackReport returns the AttackReport of an event.
+func NewAttackReport(event *types.Event) *AttackReport {
+	ipFlow, tcpFlow := event.Flow.Flows()
+	report := AttackReport{
+		SchemaVersion: REPORT_SCHEMA_VERSION,
+		Type:          event.Type,
+		Detector:      detectorOf(event.Type),
+		Time:          event.Time,
+		Flow: ReportFlow{
+			SrcIP:   ipFlow.Src().String(),
+			SrcPort: endpointPort(tcpFlow.Src().Raw()),
+			DstIP:   ipFlow.Dst().String(),
+			DstPort: endpointPort(tcpFlow.Dst().Raw()),
+			SrcAS:   reportAS(event.SrcAS),
+			DstAS:   reportAS(event.DstAS),
+		},
+		PacketCount: event.PacketCount,
+		Payload:     event.Payload,
+		Winner:      event.Winner,
+		Loser:       event.Loser,
+		SampleRate:  event.SampleRate,
+		Snippet:     event.Snippet,
+		Diff:        eventDiff(event),
+		Occurrences: event.Occurrences,
+		Sensor:      reportSensor(),
+	}
+	if event.TLS != nil {
+		report.TLS = &ReportTLS{
+			ServerName: event.TLS.ServerName,
+			ALPN:       event.TLS.ALPN,
+			Version:    event.TLS.Version,
+			JA3:        event.TLS.JA3,
+			JA3Hash:    event.TLS.JA3Hash,
+		}
+	}
+	if event.Ingress != nil {
+		report.Ingress = &ReportIngress{
+			Interface: event.Ingress.Interface,
+			VLANs:     event.Ingress.VLANs,
+			Tunnel:    event.Ingress.Tunnel,
+			TunnelID:  event.Ingress.TunnelID,
+			TunnelSrc: event.Ingress.TunnelSrc,
+			TunnelDst: event.Ingress.TunnelDst,
+		}
+	}
+	if event.HijackSeq != 0 || event.HijackAck != 0 {
+		report.Hijack = &ReportHijack{
+			Seq: event.HijackSeq,
+			Ack: event.HijackAck,
+		}
+	}
+	if event.Base != 0 || event.Start != event.End {
+		report.Sequence = &ReportSequence{
+			Base:  uint32(event.Base),
+			Start: uint32(event.Start),
+			End:   uint32(event.End),
+		}
+	}
+	return &report
+}
+
+// AttackReportJsonLogger records attack reports as AttackReport JSON objects,
+// one per line, in the file named by PathTemplate in the archive directory;
+// by default a report file per flow.
+type AttackReportJsonLogger struct {
+	ArchiveDir       string
+	PathTemplate     string
+	Files            *LogFileWriter
+	stopChan         chan bool
+	attackReportChan chan *types.Event
+}
+
+func init() {
+	AttackLoggerRegister("report-json", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		a := NewAttackReportJsonLogger(options.ArchiveDir)
+		a.PathTemplate = options.Param("path", a.PathTemplate)
+		files, err := NewLogFileWriterFromOptions(options)
+		if err != nil {
+			return nil, fmt.Errorf("report-json: %s", err)
+		}
+		a.Files = files
+		return a, ValidPathTemplate(a.PathTemplate, false)
+	})
+}
+
+// NewAttackReportJsonLogger returns a pointer to a AttackReportJsonLogger struct
+func NewAttackReportJsonLogger(archiveDir string) *AttackReportJsonLogger {
+	return &AttackReportJsonLogger{
+		ArchiveDir:       archiveDir,
+		PathTemplate:     REPORT_LOG_TEMPLATE,
+		Files:            NewLogFileWriter(),
+		stopChan:         make(chan bool),
+		attackReportChan: make(chan *types.Event),
+	}
+}
+
+func (a *AttackReportJsonLogger) Start() {
+	go a.receiveReports()
+}
+
+func (a *AttackReportJsonLogger) Stop() {
+	a.stopChan <- true
+}
+
+func (a *AttackReportJsonLogger) receiveReports() {
+	commit, stopCommits := a.Files.commitTicks()
+	defer stopCommits()
+	for {
+		select {
+		case <-a.stopChan:
+			if err := a.Files.Commit(); err != nil {
+				backendWarningf("report-json", "%s\n", err)
+			}
+			return
+		case <-commit:
+			if err := a.Files.Commit(); err != nil {
+				backendWarningf("report-json", "%s\n", err)
+			}
+		case event := <-a.attackReportChan:
+			if err := a.Publish(NewAttackReport(event), event.Flow.String()); err != nil {
+				backendWarningf("report-json", "%s\n", err)
+			}
+		}
+	}
+}
+
+func (a *AttackReportJsonLogger) Log(event *types.Event) {
+	a.attackReportChan <- event
+}
+
+// Publish appends a JSON report to the report file of the named flow.
+func (a *AttackReportJsonLogger) Publish(report *AttackReport, flow string) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	logName := ExpandPathTemplate(a.ArchiveDir, a.PathTemplate, flow, report.Type, report.Time)
+	return a.Files.Append(logName, append(b, '\n'))
+}
@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestNewAttackReport(t *testing.T) {
+	ipFlow := gopacket.NewFlow(layers.EndpointIPv4, net.IPv4(1, 2, 3, 4).To4(), net.IPv4(2, 3, 4, 5).To4())
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(1), layers.NewTCPPortEndpoint(2))
+	event := types.Event{
+		Type:    "segment veto or sloppy injection",
+		Time:    time.Unix(1, 0).UTC(),
+		Flow:    types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow),
+		Base:    100,
+		Start:   110,
+		End:     113,
+		Payload: []byte{1, 2, 3},
+	}
+	b, err := json.Marshal(NewAttackReport(&event))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["schema_version"].(float64) != REPORT_SCHEMA_VERSION || decoded["detector"] != "injection" {
+		t.Errorf("unexpected report header %s", b)
+	}
+	flow := decoded["flow"].(map[string]interface{})
+	if flow["src_ip"] != "1.2.3.4" || flow["src_port"].(float64) != 1 || flow["dst_ip"] != "2.3.4.5" || flow["dst_port"].(float64) != 2 {
+		t.Errorf("unexpected flow %v", flow)
+	}
+	if decoded["payload"] != "AQID" {
+		t.Errorf("payload not base64 encoded: %v", decoded["payload"])
+	}
+	if _, ok := decoded["hijack"]; ok {
+		t.Error("hijack included in an injection report")
+	}
+	sequence := decoded["sequence"].(map[string]interface{})
+	if sequence["start"].(float64) != 110 || sequence["end"].(float64) != 113 {
+		t.Errorf("unexpected sequence range %v", sequence)
+	}
+}
@@ -0,0 +1,458 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// Kinds of evidence a retention rule applies to.
+const (
+	EVIDENCE_ALL     = "all"
+	EVIDENCE_PACKETS = "packets"
+	EVIDENCE_STREAMS = "streams"
+	EVIDENCE_REPORTS = "reports"
+)
+
+// RETENTION_INDEX is the file, within the reaped directory, in which the
+// reaper keeps the attack types reported for each flow across restarts.
+const RETENTION_INDEX = ".retention-index.json"
+
+// RETENTION_INTERVAL is the default interval between reaps.
+const RETENTION_INTERVAL = 10 * time.Minute
+
+// RetentionRule limits how long, MaxAge, or how much disk, MaxBytes, the
+// evidence of a kind may use; zero limits are not enforced. If Type is set,
+// a report type or detector name, the rule only applies to the evidence of
+// flows for which such an attack was reported.
+type RetentionRule struct {
+	Kind     string
+	Type     string
+	MaxAge   time.Duration
+	MaxBytes int64
+}
+
+// ParseRetentionRules parses a semicolon separated list of retention rules;
+// each a kind of evidence, "packets", "streams", "reports" or "all", followed
+// by the space separated conditions "type=<type|detector>", "age=<duration>"
+// and "mb=<megabytes>". For example:
+// "packets age=168h mb=10240; all type=handshake age=2160h; reports age=720h".
+func ParseRetentionRules(rules string) ([]RetentionRule, error) {
+	var result []RetentionRule
+	for _, text := range strings.Split(rules, ";") {
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		rule := RetentionRule{Kind: fields[0]}
+		switch rule.Kind {
+		case EVIDENCE_ALL, EVIDENCE_PACKETS, EVIDENCE_STREAMS, EVIDENCE_REPORTS:
+		default:
+			return nil, fmt.Errorf("unknown kind of evidence %q", rule.Kind)
+		}
+		for _, field := range fields[1:] {
+			var err error
+			switch {
+			case strings.HasPrefix(field, "type="):
+				rule.Type = strings.TrimPrefix(field, "type=")
+			case strings.HasPrefix(field, "age="):
+				rule.MaxAge, err = time.ParseDuration(strings.TrimPrefix(field, "age="))
+				if err == nil && rule.MaxAge <= 0 {
+					err = fmt.Errorf("invalid retention age %q", field)
+				}
+			case strings.HasPrefix(field, "mb="):
+				var mb int
+				mb, err = strconv.Atoi(strings.TrimPrefix(field, "mb="))
+				if err == nil && mb <= 0 {
+					err = fmt.Errorf("invalid retention size %q", field)
+				}
+				rule.MaxBytes = int64(mb) * 1024 * 1024
+			default:
+				err = fmt.Errorf("unknown retention rule condition %q", field)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if rule.MaxAge == 0 && rule.MaxBytes == 0 {
+			return nil, fmt.Errorf("retention rule %q sets neither age nor mb", strings.TrimSpace(text))
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+// evidenceKind returns the kind of evidence a file holds, by its name
+// once any compression extension is removed.
+func evidenceKind(name string) string {
+	for _, compression := range Compressions {
+		name = strings.TrimSuffix(name, compression.Extension)
+	}
+	// rotated packet logs and timestamped stream
+	// files keep their extension within the name
+	switch {
+	case strings.Contains(name, ".pcap"):
+		return EVIDENCE_PACKETS
+	case strings.Contains(name, ".stream"):
+		return EVIDENCE_STREAMS
+	}
+	return EVIDENCE_REPORTS
+}
+
+// specificity ranks the rules matching a file: those naming one of its
+// attack types over those naming its kind over those for all evidence.
+// It returns -1 if the rule does not match.
+func (r *RetentionRule) specificity(kind string, attackTypes []string) int {
+	score := 0
+	if r.Kind == kind {
+		score += 1
+	} else if r.Kind != EVIDENCE_ALL {
+		return -1
+	}
+	if r.Type == "" {
+		return score
+	}
+	for _, t := range attackTypes {
+		if r.Type == t || r.Type == detectorOf(t) {
+			return score + 2
+		}
+	}
+	return -1
+}
+
+// retainedFlow is the index entry of a connection for which attacks were
+// reported, named by the flow strings of both of its directions.
+type retainedFlow struct {
+	Flows [2]string
+	Types []string
+	Seen  time.Time
+}
+
+// evidenceFile is a file found while reaping.
+type evidenceFile struct {
+	path    string
+	kind    string
+	size    int64
+	modTime time.Time
+	types   []string
+	removed bool
+}
+
+// EvidenceReaper enforces retention rules on the archive directory:
+// every Interval it removes the packet logs, stream files and attack
+// reports which are older, or which together use more disk, than their
+// rules allow, and logs what it removed. For age and for size alike, a
+// file is governed by its most specific matching rules; if several are
+// equally specific, the longest age and each of the quotas apply.
+//
+// The reaper is an attack logger backend so as to learn which attacks
+// were reported for each flow; the evidence of a flow is recognized by
+// the flow appearing in its path as the default file names have it.
+type EvidenceReaper struct {
+	Dir      string
+	Rules    []RetentionRule
+	Interval time.Duration
+
+	mutex    sync.Mutex
+	flows    map[string]*retainedFlow
+	dirty    bool
+	lastReap time.Time
+	stopChan chan bool
+	doneChan chan bool
+}
+
+// NewEvidenceReaper returns an EvidenceReaper of the given directory.
+func NewEvidenceReaper(dir string, rules []RetentionRule) *EvidenceReaper {
+	return &EvidenceReaper{
+		Dir:      dir,
+		Rules:    rules,
+		Interval: RETENTION_INTERVAL,
+		flows:    make(map[string]*retainedFlow),
+	}
+}
+
+// Start loads the index and starts reaping in the background.
+func (r *EvidenceReaper) Start() {
+	r.loadIndex()
+	r.stopChan = make(chan bool)
+	r.doneChan = make(chan bool)
+	go r.run()
+}
+
+// Stop stops reaping and saves the index.
+func (r *EvidenceReaper) Stop() {
+	close(r.stopChan)
+	<-r.doneChan
+	r.saveIndex()
+}
+
+func (r *EvidenceReaper) run() {
+	defer close(r.doneChan)
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	r.Reap(time.Now())
+	for {
+		select {
+		case <-r.stopChan:
+			return
+		case now := <-ticker.C:
+			r.Reap(now)
+		}
+	}
+}
+
+// Log notes the attack type reported for the event's flow.
+func (r *EvidenceReaper) Log(event *types.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := event.Flow.String()
+	entry, ok := r.flows[key]
+	if !ok {
+		entry = &retainedFlow{Flows: [2]string{key, event.Flow.Reverse().String()}}
+		r.flows[entry.Flows[0]] = entry
+		r.flows[entry.Flows[1]] = entry
+	}
+	entry.Seen = time.Now()
+	r.dirty = true
+	for _, t := range entry.Types {
+		if t == event.Type {
+			return
+		}
+	}
+	entry.Types = append(entry.Types, event.Type)
+}
+
+// flowOf returns the index entry of the flow appearing in
+// a path, either as a directory or as a file name prefix.
+func (r *EvidenceReaper) flowOf(rel string) *retainedFlow {
+	for _, element := range strings.Split(rel, string(filepath.Separator)) {
+		if entry, ok := r.flows[element]; ok {
+			return entry
+		}
+		for i := 0; i < len(element); i++ {
+			if element[i] != '.' {
+				continue
+			}
+			if entry, ok := r.flows[element[:i]]; ok {
+				return entry
+			}
+		}
+	}
+	return nil
+}
+
+// scan returns the evidence files in the directory.
+func (r *EvidenceReaper) scan() ([]*evidenceFile, map[*retainedFlow]bool) {
+	var files []*evidenceFile
+	found := make(map[*retainedFlow]bool)
+	walkEvidence(r.Dir, func(path, rel string, info os.FileInfo) {
+		file := &evidenceFile{
+			path:    path,
+			kind:    evidenceKind(info.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		}
+		if entry := r.flowOf(rel); entry != nil {
+			file.types = entry.Types
+			found[entry] = true
+		}
+		files = append(files, file)
+	})
+	return files, found
+}
+
+// walkEvidence calls fn with the path, the path relative to dir and the info
+// of each evidence file in dir, skipping hidden files and those still being
+// written by a compressor.
+func walkEvidence(dir string, fn func(path, rel string, info os.FileInfo)) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".tmp") || strings.Contains(name, ".compressing-") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil
+		}
+		fn(path, rel, info)
+		return nil
+	})
+}
+
+// governing returns the indexes of the most specific rules matching
+// a file among those for which limited returns true.
+func (r *EvidenceReaper) governing(file *evidenceFile, limited func(*RetentionRule) bool) []int {
+	var result []int
+	best := -1
+	for i := range r.Rules {
+		if !limited(&r.Rules[i]) {
+			continue
+		}
+		score := r.Rules[i].specificity(file.kind, file.types)
+		switch {
+		case score < 0 || score < best:
+		case score > best:
+			best = score
+			result = append(result[:0], i)
+		default:
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// Reap removes the evidence which, by now, the rules no longer allow
+// to be retained and returns the paths of the removed files.
+// The index is saved afterwards.
+func (r *EvidenceReaper) Reap(now time.Time) []string {
+	r.mutex.Lock()
+	files, found := r.scan()
+	r.mutex.Unlock()
+
+	var removed []string
+	remove := func(file *evidenceFile, reason string) {
+		if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+			Warningf("retention: failed to remove %s: %s\n", file.path, err)
+			return
+		}
+		file.removed = true
+		removed = append(removed, file.path)
+		Infof("retention: removed %s (%d bytes): %s\n", file.path, file.size, reason)
+		removeEmptyDirs(r.Dir, filepath.Dir(file.path))
+	}
+
+	quotas := make(map[int][]*evidenceFile)
+	for _, file := range files {
+		var maxAge time.Duration
+		for _, i := range r.governing(file, func(rule *RetentionRule) bool { return rule.MaxAge > 0 }) {
+			if r.Rules[i].MaxAge > maxAge {
+				maxAge = r.Rules[i].MaxAge
+			}
+		}
+		if maxAge > 0 && now.Sub(file.modTime) > maxAge {
+			remove(file, fmt.Sprintf("older than %s", maxAge))
+			continue
+		}
+		for _, i := range r.governing(file, func(rule *RetentionRule) bool { return rule.MaxBytes > 0 }) {
+			quotas[i] = append(quotas[i], file)
+		}
+	}
+	for i, governed := range quotas {
+		sort.Slice(governed, func(a, b int) bool { return governed[a].modTime.Before(governed[b].modTime) })
+		var total int64
+		for _, file := range governed {
+			if !file.removed {
+				total += file.size
+			}
+		}
+		for _, file := range governed {
+			if total <= r.Rules[i].MaxBytes {
+				break
+			}
+			if file.removed {
+				continue
+			}
+			total -= file.size
+			remove(file, fmt.Sprintf("%s exceed %d MB", r.Rules[i].Kind, r.Rules[i].MaxBytes/(1024*1024)))
+		}
+	}
+
+	r.mutex.Lock()
+	// forget the flows whose evidence is gone, unless it may not be archived yet
+	for key, entry := range r.flows {
+		if !found[entry] && entry.Seen.Before(r.lastReap) {
+			delete(r.flows, key)
+			r.dirty = true
+		}
+	}
+	r.lastReap = now
+	r.mutex.Unlock()
+	r.saveIndex()
+	return removed
+}
+
+// removeEmptyDirs removes dir and its parents within root as long as
+// they are empty, such as the dated directories of path templates.
+func removeEmptyDirs(root, dir string) {
+	for dir != filepath.Clean(root) && strings.HasPrefix(dir, filepath.Clean(root)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (r *EvidenceReaper) loadIndex() {
+	contents, err := ioutil.ReadFile(filepath.Join(r.Dir, RETENTION_INDEX))
+	if err != nil {
+		return
+	}
+	var entries []*retainedFlow
+	if err := json.Unmarshal(contents, &entries); err != nil {
+		Warningf("retention: ignoring invalid index: %s\n", err)
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, entry := range entries {
+		r.flows[entry.Flows[0]] = entry
+		r.flows[entry.Flows[1]] = entry
+	}
+}
+
+func (r *EvidenceReaper) saveIndex() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.dirty {
+		return
+	}
+	var entries []*retainedFlow
+	for key, entry := range r.flows {
+		if key == entry.Flows[0] {
+			entries = append(entries, entry)
+		}
+	}
+	contents, err := json.Marshal(entries)
+	if err == nil {
+		name := filepath.Join(r.Dir, RETENTION_INDEX)
+		if err = ioutil.WriteFile(name+".tmp", contents, 0644); err == nil {
+			err = os.Rename(name+".tmp", name)
+		}
+	}
+	if err != nil {
+		Warningf("retention: failed to save index: %s\n", err)
+		return
+	}
+	r.dirty = false
+}
@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionRules(t *testing.T) {
+	rules, err := ParseRetentionRules("packets age=168h mb=10; all type=handshake age=2160h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].MaxAge != 168*time.Hour || rules[0].MaxBytes != 10*1024*1024 || rules[1].Type != "handshake" {
+		t.Errorf("got %+v", rules)
+	}
+	for _, invalid := range []string{"pcaps age=1h", "packets", "reports age=-1h", "streams mb=lots", "reports size=1"} {
+		if _, err := ParseRetentionRules(invalid); err == nil {
+			t.Errorf("rules %q accepted", invalid)
+		}
+	}
+}
+
+func TestEvidenceReaper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "evidenceReaper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	event := testReportEvent()
+	flow := event.Flow.String()
+	now := time.Now()
+	write := func(name string, size int, age time.Duration) {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the hijacked connection's evidence is kept for longer, within its own quota
+	write(flow+".pcap", 10, 3*time.Hour)
+	write(event.Flow.Reverse().String()+".stream", 10, 3*time.Hour)
+	write("5.6.7.8:1-6.7.8.9:2.pcap.1.gz", 10, 3*time.Hour)
+	write("5.6.7.8:1-6.7.8.9:2.pcap", 10, time.Minute)
+	write("2016-03-04/attacks.json", 10, 3*time.Hour)
+	// the packet quota removes the oldest packet logs first
+	write("6.7.8.9:1-7.8.9.10:2.pcap", 1024*1024, 30*time.Minute)
+	write("7.8.9.10:1-8.9.10.11:2.pcap", 1024*1024, 20*time.Minute)
+
+	rules, err := ParseRetentionRules("packets age=2h mb=2; all type=handshake age=24h; packets type=handshake mb=1; reports age=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reaper := NewEvidenceReaper(dir, rules)
+	reaper.Log(event)
+	removed := reaper.Reap(now)
+	for i := range removed {
+		removed[i], _ = filepath.Rel(dir, removed[i])
+	}
+	sort.Strings(removed)
+	expected := []string{"2016-03-04/attacks.json", "5.6.7.8:1-6.7.8.9:2.pcap.1.gz", "6.7.8.9:1-7.8.9.10:2.pcap"}
+	if len(removed) != len(expected) {
+		t.Fatalf("removed %v, expected %v", removed, expected)
+	}
+	for i := range expected {
+		if removed[i] != expected[i] {
+			t.Errorf("removed %v, expected %v", removed, expected)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2016-03-04")); !os.IsNotExist(err) {
+		t.Error("empty dated directory not removed")
+	}
+
+	// the index survives a restart
+	restarted := NewEvidenceReaper(dir, rules)
+	restarted.loadIndex()
+	if entry := restarted.flowOf(flow + ".pcap"); entry == nil || len(entry.Types) != 1 || entry.Types[0] != event.Type {
+		t.Errorf("flow not restored from the index: %+v", entry)
+	}
+}
@@ -23,29 +23,70 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
 )
 
+// ROTATE_PATTERN is the default name pattern of rotated log files.
+const ROTATE_PATTERN = "{name}.{n}"
+
+// ROTATE_TIME_LAYOUT is the layout of the {time} part of rotated log file names.
+const ROTATE_TIME_LAYOUT = "20060102T150405.000000"
+
+type rotatedLog struct {
+	id      int
+	name    string
+	suffix  string
+	started time.Time
+}
+
 type RotatingQuotaWriter struct {
+	// MaxAge, if set, is how long a file is written to before it is rotated.
+	MaxAge time.Duration
+	// Pattern names rotated files: {name} is replaced by the starting
+	// filename, {n} by the position of the file counting from 1 for the
+	// most recently rotated and {time} by the time the file was started.
+	Pattern string
+	// OnRotate, if set, is called with the name of each rotated file
+	// once it has been given its final name.
+	OnRotate func(name string)
+	// Compressor, if set, compresses rotated files in the background; once
+	// compressed a file is replaced by one named with the extension added.
+	Compressor types.Compressor
+
 	filename        string
 	fp              *os.File
 	numLogs         int
 	logSize         int
 	quotaSizeBytes  int
 	sizes           []int
-	headerFunc      func()
+	started         time.Time
+	fresh           bool
+	reserved        int
+	rotations       int
+	rotated         []rotatedLog
+	rotatedMutex    sync.Mutex
+	compressing     sync.WaitGroup
+	headerFunc      func() error
 	mustWriteHeader bool
 }
 
 // NewRotatingQuotaWriter takes a "starting filename" and a quota size in bytes...
 // and guarantees to behave as an io.Writer who will write no more than quotaSize
 // bytes to disk. `headerFunc` is executed upon the new file, after each rotation.
-func NewRotatingQuotaWriter(filename string, quotaSize int, numLogs int, headerFunc func()) *RotatingQuotaWriter {
+func NewRotatingQuotaWriter(filename string, quotaSize int, numLogs int, headerFunc func() error) *RotatingQuotaWriter {
 	quotaSizeBytes := quotaSize * 1024 * 1024
 	logSize := int(math.Floor(float64(quotaSizeBytes) / float64(numLogs)))
 	if logSize*numLogs > quotaSizeBytes {
 		panic("wtf: logSize * numLogs > quotaSize")
 	}
 	w := &RotatingQuotaWriter{
+		Pattern:         ROTATE_PATTERN,
 		filename:        filename,
 		numLogs:         numLogs,
 		logSize:         logSize,
@@ -58,82 +99,222 @@ func NewRotatingQuotaWriter(filename string, quotaSize int, numLogs int, headerF
 	return w
 }
 
+// ValidRotatePattern returns an error if rotated files named
+// by pattern would overwrite each other.
+func ValidRotatePattern(pattern string) error {
+	if !strings.Contains(pattern, "{n}") && !strings.Contains(pattern, "{time}") {
+		return fmt.Errorf("rotate pattern %q has neither {n} nor {time}", pattern)
+	}
+	return nil
+}
+
+// Write writes output to the current file, rotating it first if need be.
+// An error opening or rotating the file is returned without writing anything.
 func (w *RotatingQuotaWriter) Write(output []byte) (int, error) {
-	var err error
 	if w.fp == nil {
-		w.fp, err = os.Create(w.filename)
-		if err != nil {
-			panic(err)
+		if err := w.open(); err != nil {
+			return 0, err
 		}
-		w.mustWriteHeader = true
-		w.headerFunc()
-		w.sizes[0] += len(output)
-		return w.fp.Write(output)
 	}
 	if w.mustWriteHeader {
 		w.mustWriteHeader = false
 		w.sizes[0] += len(output)
 		return w.fp.Write(output)
 	}
-	if w.sizes[0]+len(output) > w.logSize {
-		w.rotate()
-		// pop
-		w.sizes = w.sizes[0 : len(w.sizes)-1]
-		// push
-		new := make([]int, 1, 10)
-		new[0] = len(output)
-		w.sizes = append(new, w.sizes...)
-		w.fp, err = os.Create(w.filename)
-		if err != nil {
-			panic(err)
-		}
+	if len(output) <= w.reserved {
+		w.reserved -= len(output)
 	} else {
-		w.sizes[0] += len(output)
+		w.reserved = 0
+		if err := w.rotateIfNeeded(len(output)); err != nil {
+			return 0, err
+		}
 	}
+	w.fresh = false
+	w.sizes[0] += len(output)
 	return w.fp.Write(output)
 }
 
+// Reserve rotates now if the next size bytes would not fit the current
+// file, and otherwise guarantees that they are written to it, so that a
+// record written with several calls to Write is never split across files.
+func (w *RotatingQuotaWriter) Reserve(size int) error {
+	if w.fp == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	if err := w.rotateIfNeeded(size); err != nil {
+		return err
+	}
+	w.reserved = size
+	return nil
+}
+
+// open creates the file and writes its header.
+func (w *RotatingQuotaWriter) open() error {
+	err := os.MkdirAll(filepath.Dir(w.filename), 0755)
+	if err != nil {
+		return err
+	}
+	fp, err := os.Create(w.filename)
+	if err != nil {
+		return err
+	}
+	w.fp = fp
+	w.started = time.Now()
+	w.fresh = true
+	w.mustWriteHeader = true
+	err = w.headerFunc()
+	w.mustWriteHeader = false
+	if err != nil {
+		return fmt.Errorf("failed to write the header of %s: %s", w.filename, err)
+	}
+	return nil
+}
+
+// rotateIfNeeded rotates if the next size bytes would exceed the size limit
+// of the current file or if it is older than MaxAge. A file holding nothing
+// but its header is never rotated.
+func (w *RotatingQuotaWriter) rotateIfNeeded(size int) error {
+	if w.fresh || (w.sizes[0]+size <= w.logSize && (w.MaxAge <= 0 || time.Since(w.started) < w.MaxAge)) {
+		return nil
+	}
+	if err := w.rotate(); err != nil {
+		return err
+	}
+	w.shiftSizes()
+	return w.open()
+}
+
+// Rotate rotates the current file now, unless it holds nothing but
+// its header; the next file is started by the next write.
+func (w *RotatingQuotaWriter) Rotate() error {
+	if w.fp == nil || w.fresh {
+		return nil
+	}
+	if err := w.rotate(); err != nil {
+		return err
+	}
+	w.shiftSizes()
+	return nil
+}
+
+// shiftSizes drops the size of the oldest file for that of a new one.
+func (w *RotatingQuotaWriter) shiftSizes() {
+	// pop
+	w.sizes = w.sizes[0 : len(w.sizes)-1]
+	// push
+	new := make([]int, 1, 10)
+	w.sizes = append(new, w.sizes...)
+}
+
+// Close closes the current file and waits for the compression
+// of the rotated files to complete.
 func (w *RotatingQuotaWriter) Close() error {
-	err := w.fp.Close()
-	w.fp = nil
+	var err error
+	if w.fp != nil {
+		err = w.fp.Close()
+		w.fp = nil
+	}
+	w.compressing.Wait()
 	return err
 }
 
-func (w *RotatingQuotaWriter) rotate() {
+// Files returns the names of the file currently written to
+// and of the retained rotated files, newest first.
+func (w *RotatingQuotaWriter) Files() []string {
+	w.rotatedMutex.Lock()
+	defer w.rotatedMutex.Unlock()
+	files := []string{w.filename}
+	for _, rotated := range w.rotated {
+		files = append(files, rotated.name)
+	}
+	return files
+}
+
+// rotatedName returns the name of the rotated file at position n started at the given time.
+func (w *RotatingQuotaWriter) rotatedName(n int, started time.Time) string {
+	return strings.NewReplacer(
+		"{name}", w.filename,
+		"{n}", strconv.Itoa(n),
+		"{time}", started.UTC().Format(ROTATE_TIME_LAYOUT),
+	).Replace(w.Pattern)
+}
+
+// rotate moves the current file to the head of the rotated files,
+// removing the oldest rotated file if numLogs would be exceeded.
+func (w *RotatingQuotaWriter) rotate() error {
 	var err error
 	if w.fp != nil {
 		err = w.fp.Close()
 		w.fp = nil
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
-	for i := w.numLogs; i > 0; i-- {
-		w.shiftLog(i)
+	w.rotatedMutex.Lock()
+	defer w.rotatedMutex.Unlock()
+	w.rotations++
+	w.rotated = append([]rotatedLog{{id: w.rotations, name: w.filename, started: w.started}}, w.rotated...)
+	for len(w.rotated) > w.numLogs-1 && len(w.rotated) > 0 {
+		os.Remove(w.rotated[len(w.rotated)-1].name)
+		w.rotated = w.rotated[:len(w.rotated)-1]
 	}
-	newName := fmt.Sprintf("%s.1", w.filename)
-	err = os.Rename(w.filename, newName)
-	if err != nil {
-		panic(err)
+	// rename from the oldest so that no file is overwritten by the shift
+	for i := len(w.rotated) - 1; i >= 0; i-- {
+		newName := w.rotatedName(i+1, w.rotated[i].started) + w.rotated[i].suffix
+		if newName == w.rotated[i].name {
+			continue
+		}
+		err = os.Rename(w.rotated[i].name, newName)
+		if err != nil {
+			return err
+		}
+		w.rotated[i].name = newName
+	}
+	if len(w.rotated) == 0 {
+		return nil
 	}
+	if w.OnRotate != nil {
+		w.OnRotate(w.rotated[0].name)
+	}
+	if w.Compressor != nil {
+		w.compress(w.rotated[0].id, w.rotated[0].name)
+	}
+	return nil
 }
 
-func (w *RotatingQuotaWriter) shiftLog(logNum int) {
-	var err error
-	oldName := fmt.Sprintf("%s.%d", w.filename, logNum)
-	if logNum == w.numLogs {
-		os.Remove(oldName)
-		return
-	}
-	_, err = os.Stat(oldName)
-	if os.IsNotExist(err) {
+// compress hands a rotated file to the Compressor. The file is opened
+// now since later rotations may rename it before it is compressed, and
+// its compressed copy replaces it under whatever name it has by then.
+func (w *RotatingQuotaWriter) compress(id int, name string) {
+	src, err := os.Open(name)
+	if err != nil {
 		return
-	} else if err != nil {
-		panic(err)
 	}
-	newName := fmt.Sprintf("%s.%d", w.filename, logNum+1)
-	err = os.Rename(oldName, newName)
-	if err != nil {
-		panic(err)
+	dst := fmt.Sprintf("%s.compressing-%d", w.filename, id)
+	w.compressing.Add(1)
+	ok := w.Compressor.Compress(src, dst, func(err error) {
+		defer w.compressing.Done()
+		w.rotatedMutex.Lock()
+		defer w.rotatedMutex.Unlock()
+		for i := range w.rotated {
+			if w.rotated[i].id != id || err != nil {
+				continue
+			}
+			compressed := w.rotated[i].name + w.Compressor.Extension()
+			if os.Rename(dst, compressed) == nil {
+				os.Remove(w.rotated[i].name)
+				w.rotated[i].name = compressed
+				w.rotated[i].suffix = w.Compressor.Extension()
+			}
+			return
+		}
+		// the file was rotated out of retention or failed to compress
+		os.Remove(dst)
+	})
+	if !ok {
+		src.Close()
+		w.compressing.Done()
 	}
 }
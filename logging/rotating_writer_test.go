@@ -0,0 +1,177 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingQuotaWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatingWriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "flow.pcap")
+	var w *RotatingQuotaWriter
+	w = NewRotatingQuotaWriter(filename, 1, 3, func() error {
+		_, err := w.Write([]byte("HDR"))
+		return err
+	})
+	// room for the header and one split record per file
+	w.logSize = 10
+	for _, record := range []string{"aaaa", "bbbb", "cccc", "dddd", "eeee"} {
+		w.Reserve(len(record))
+		w.Write([]byte(record[:2]))
+		w.Write([]byte(record[2:]))
+	}
+	w.Close()
+
+	expected := map[string]string{
+		filename:        "HDReeee",
+		filename + ".1": "HDRdddd",
+		filename + ".2": "HDRcccc",
+	}
+	files := w.Files()
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files, got %v", files)
+	}
+	for _, name := range files {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != expected[name] {
+			t.Errorf("%s holds %q", name, contents)
+		}
+	}
+}
+
+func TestRotatingQuotaWriterRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatingWriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "flow.pcap")
+	var w *RotatingQuotaWriter
+	w = NewRotatingQuotaWriter(filename, 1000, 3, func() error {
+		_, err := w.Write([]byte("HDR"))
+		return err
+	})
+	w.Write([]byte("aaaa"))
+	for i := 0; i < 2; i++ {
+		// rotating again before anything is written leaves no empty file
+		if err := w.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Write([]byte("bbbb"))
+	w.Close()
+
+	for name, expected := range map[string]string{filename: "HDRbbbb", filename + ".1": "HDRaaaa"} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != expected {
+			t.Errorf("%s holds %q", name, contents)
+		}
+	}
+	if files := w.Files(); len(files) != 2 {
+		t.Errorf("expected 2 files, got %v", files)
+	}
+}
+
+func TestRotatingQuotaWriterAgePattern(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatingWriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "flow.pcap")
+	w := NewRotatingQuotaWriter(filename, 1, 2, func() error { return nil })
+	w.MaxAge = time.Millisecond
+	w.Pattern = "{name}-{time}"
+	var rotated []string
+	w.OnRotate = func(name string) {
+		rotated = append(rotated, name)
+	}
+	w.Write([]byte("a"))
+	time.Sleep(2 * time.Millisecond)
+	w.Write([]byte("b"))
+	w.Close()
+
+	if len(rotated) != 1 || !strings.HasPrefix(rotated[0], filename+"-") {
+		t.Fatalf("unexpected rotations %v", rotated)
+	}
+	if contents, _ := ioutil.ReadFile(rotated[0]); string(contents) != "a" {
+		t.Errorf("rotated file holds %q", contents)
+	}
+	if err := ValidRotatePattern("{name}.old"); err == nil {
+		t.Error("pattern without {n} or {time} accepted")
+	}
+}
+
+func TestRotatingQuotaWriterCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatingWriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	compressor, err := NewFileCompressor("gzip", 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compressor.Stop()
+	filename := filepath.Join(dir, "flow.pcap")
+	w := NewRotatingQuotaWriter(filename, 1, 3, func() error { return nil })
+	w.Compressor = compressor
+	w.logSize = 4
+	for _, record := range []string{"aaaa", "bbbb", "cccc"} {
+		w.Write([]byte(record))
+	}
+	w.Close()
+
+	expected := map[string]string{
+		filename:           "cccc",
+		filename + ".1.gz": "bbbb",
+		filename + ".2.gz": "aaaa",
+	}
+	for _, name := range w.Files() {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var contents []byte
+		if strings.HasSuffix(name, ".gz") {
+			r, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents, err = ioutil.ReadAll(r)
+		} else {
+			contents, err = ioutil.ReadAll(f)
+		}
+		f.Close()
+		if expectedContents, ok := expected[name]; !ok || string(contents) != expectedContents {
+			t.Errorf("%s holds %q", name, contents)
+		}
+		delete(expected, name)
+	}
+	if len(expected) != 0 {
+		t.Errorf("missing files %v", expected)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 3 {
+		t.Errorf("expected 3 files in the log dir, found %d", len(files))
+	}
+}
@@ -0,0 +1,436 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// S3_INTERVAL is the default interval between uploads of the archive dir.
+	S3_INTERVAL = time.Minute
+	// S3_SETTLE is the default time evidence files must not have been
+	// written to for to be uploaded.
+	S3_SETTLE = 5 * time.Minute
+	// S3_PREFIX is the default prefix of the keys of the uploaded evidence.
+	S3_PREFIX = "{sensor}/"
+)
+
+// S3Archiver uploads the evidence of the archive directory, the rotated
+// packet logs, stream files and attack report files, to a bucket of S3 or
+// of an S3 compatible object store such as MinIO or Ceph, and then removes
+// the local copies, so that sensors with small disks can retain evidence
+// off-box for as long as the bucket's lifecycle rules allow.
+//
+// Every Interval the files not written to for Settle are uploaded, each as
+// the object named by the prefix of its kind of evidence followed by its
+// path within the archive dir. Objects are never overwritten: a file
+// recreated since its upload, such as a report file, is uploaded with its
+// modification time appended to its name. Prefixes are path templates which may contain
+// {sensor}, {kind}, {date} and {hour}, the latter two of the time the file
+// was last written. The objects are tagged with their kind and Tags, and
+// the Tags of their kind, for lifecycle rules to filter on.
+//
+// Requests are signed with AWS Signature Version 4 and address the bucket
+// by path, which all S3 compatible stores support.
+type S3Archiver struct {
+	Dir          string
+	Endpoint     string
+	Bucket       string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	StorageClass string
+	Prefix       string
+	Prefixes     map[string]string
+	Tags         map[string]string
+	KindTags     map[string]map[string]string
+	Interval     time.Duration
+	Settle       time.Duration
+	Keep         bool
+	Client       *http.Client
+
+	stopChan chan bool
+	doneChan chan bool
+}
+
+func init() {
+	AttackLoggerRegister("s3", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewS3ArchiverFromOptions(options)
+	})
+}
+
+// NewS3Archiver returns a pointer to an S3Archiver struct uploading the
+// evidence of dir to the bucket of the object store at endpoint.
+func NewS3Archiver(dir, endpoint, bucket string) *S3Archiver {
+	return &S3Archiver{
+		Dir:          dir,
+		Endpoint:     strings.TrimRight(endpoint, "/"),
+		Bucket:       bucket,
+		Region:       "us-east-1",
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Prefix:       S3_PREFIX,
+		Prefixes:     make(map[string]string),
+		Tags:         make(map[string]string),
+		KindTags:     make(map[string]map[string]string),
+		Interval:     S3_INTERVAL,
+		Settle:       S3_SETTLE,
+		Client:       &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+// NewS3ArchiverFromOptions returns an S3Archiver of the archive dir configured
+// by the backend parameters endpoint, bucket, region, access_key, secret_key
+// and session_token, by default those of the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables,
+// storage_class, prefix, prefix.<kind>, tag.<key>, tag.<kind>.<key>,
+// interval, settle and keep, which keeps the local copies once uploaded.
+// The kinds of evidence are packets, streams and reports.
+func NewS3ArchiverFromOptions(options *AttackLoggerOptions) (*S3Archiver, error) {
+	if options.ArchiveDir == "" {
+		return nil, fmt.Errorf("s3: requires -archive_dir")
+	}
+	bucket := options.Param("bucket", "")
+	if bucket == "" {
+		return nil, fmt.Errorf("s3: no bucket")
+	}
+	s := NewS3Archiver(options.ArchiveDir, options.Param("endpoint", "https://s3.amazonaws.com"), bucket)
+	s.Region = options.Param("region", s.Region)
+	s.AccessKey = options.Param("access_key", s.AccessKey)
+	s.SecretKey = options.Param("secret_key", s.SecretKey)
+	s.SessionToken = options.Param("session_token", s.SessionToken)
+	s.StorageClass = options.Param("storage_class", "")
+	s.Prefix = options.Param("prefix", s.Prefix)
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return nil, fmt.Errorf("s3: no access_key and secret_key")
+	}
+	var err error
+	if s.Interval, err = time.ParseDuration(options.Param("interval", s.Interval.String())); err != nil {
+		return nil, fmt.Errorf("s3: invalid interval: %s", err)
+	}
+	if s.Settle, err = time.ParseDuration(options.Param("settle", s.Settle.String())); err != nil {
+		return nil, fmt.Errorf("s3: invalid settle: %s", err)
+	}
+	if s.Keep, err = strconv.ParseBool(options.Param("keep", "false")); err != nil {
+		return nil, fmt.Errorf("s3: invalid keep: %s", err)
+	}
+	kinds := map[string]bool{EVIDENCE_PACKETS: true, EVIDENCE_STREAMS: true, EVIDENCE_REPORTS: true}
+	for key, value := range options.Params {
+		switch {
+		case strings.HasPrefix(key, "prefix."):
+			kind := strings.TrimPrefix(key, "prefix.")
+			if !kinds[kind] {
+				return nil, fmt.Errorf("s3: unknown kind of evidence %q", kind)
+			}
+			s.Prefixes[kind] = value
+		case strings.HasPrefix(key, "tag."):
+			tag := strings.TrimPrefix(key, "tag.")
+			if dot := strings.Index(tag, "."); dot > 0 && kinds[tag[:dot]] {
+				if s.KindTags[tag[:dot]] == nil {
+					s.KindTags[tag[:dot]] = make(map[string]string)
+				}
+				s.KindTags[tag[:dot]][tag[dot+1:]] = value
+			} else {
+				s.Tags[tag] = value
+			}
+		}
+	}
+	for _, prefix := range append([]string{s.Prefix}, sortedValues(s.Prefixes)...) {
+		if err := ValidPathTemplate(prefix, false); err != nil {
+			return nil, fmt.Errorf("s3: %s", err)
+		}
+	}
+	return s, nil
+}
+
+// sortedValues returns the values of a map sorted.
+func sortedValues(m map[string]string) []string {
+	var values []string
+	for _, value := range m {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// Start starts uploading in the background.
+func (s *S3Archiver) Start() {
+	s.stopChan = make(chan bool)
+	s.doneChan = make(chan bool)
+	go s.run()
+}
+
+// Stop stops uploading, once the file being uploaded is.
+func (s *S3Archiver) Stop() {
+	close(s.stopChan)
+	<-s.doneChan
+}
+
+// Log does nothing; the archiver is an attack logger backend
+// so as to be configured and run alongside the others.
+func (s *S3Archiver) Log(event *types.Event) {}
+
+func (s *S3Archiver) run() {
+	defer close(s.doneChan)
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case now := <-ticker.C:
+			s.Archive(now)
+		}
+	}
+}
+
+// Archive uploads the evidence files which, by now, are settled, removes
+// them unless Keep is set and returns the paths of the uploaded files.
+func (s *S3Archiver) Archive(now time.Time) []string {
+	var uploaded []string
+	walkEvidence(s.Dir, func(file, rel string, info os.FileInfo) {
+		if now.Sub(info.ModTime()) < s.Settle {
+			return
+		}
+		select {
+		case <-s.stopChan:
+			return
+		default:
+		}
+		key, err := s.upload(file, rel, info)
+		if err != nil {
+			backendWarningf("s3", "failed to upload %s: %s\n", file, err)
+			return
+		}
+		uploaded = append(uploaded, file)
+		Infof("s3: uploaded %s (%d bytes) to %s/%s\n", file, info.Size(), s.Bucket, key)
+		if s.Keep {
+			return
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			backendWarningf("s3", "failed to remove %s: %s\n", file, err)
+			return
+		}
+		removeEmptyDirs(s.Dir, filepath.Dir(file))
+	})
+	return uploaded
+}
+
+// Key returns the object key of the evidence file of the given path
+// relative to the archive dir.
+func (s *S3Archiver) Key(rel string, info os.FileInfo) string {
+	kind := evidenceKind(info.Name())
+	prefix, ok := s.Prefixes[kind]
+	if !ok {
+		prefix = s.Prefix
+	}
+	t := info.ModTime().UTC()
+	prefix = strings.NewReplacer(
+		"{sensor}", pathEscaper.Replace(Sensor),
+		"{kind}", kind,
+		"{date}", t.Format("2006-01-02"),
+		"{hour}", t.Format("15"),
+	).Replace(prefix)
+	return strings.TrimLeft(path.Join(prefix, filepath.ToSlash(rel)), "/")
+}
+
+// tagging returns the x-amz-tagging header of the objects of a kind of evidence.
+func (s *S3Archiver) tagging(kind string) string {
+	tags := url.Values{}
+	tags.Set("kind", kind)
+	for key, value := range s.Tags {
+		tags.Set(key, value)
+	}
+	for key, value := range s.KindTags[kind] {
+		tags.Set(key, value)
+	}
+	return tags.Encode()
+}
+
+// upload puts an evidence file, unless its object exists, in which case
+// it is uploaded under its name suffixed by its modification time instead,
+// and returns the key of its object.
+func (s *S3Archiver) upload(file, rel string, info os.FileInfo) (string, error) {
+	key := s.Key(rel, info)
+	exists, err := s.exists(key)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		key += "." + info.ModTime().UTC().Format(ROTATE_TIME_LAYOUT)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return "", err
+	}
+	request, err := http.NewRequest("PUT", s.objectURL(key), ioutil.NopCloser(f))
+	if err != nil {
+		return "", err
+	}
+	request.ContentLength = size
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("X-Amz-Tagging", s.tagging(evidenceKind(info.Name())))
+	if s.StorageClass != "" {
+		request.Header.Set("X-Amz-Storage-Class", s.StorageClass)
+	}
+	if err := s.do(request, hex.EncodeToString(hash.Sum(nil))); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// exists returns true if the bucket holds an object of the given key.
+func (s *S3Archiver) exists(key string) (bool, error) {
+	request, err := http.NewRequest("HEAD", s.objectURL(key), nil)
+	if err != nil {
+		return false, err
+	}
+	err = s.do(request, emptyPayloadHash)
+	if status, ok := err.(s3StatusError); ok && status == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// objectURL returns the path style URL of an object.
+func (s *S3Archiver) objectURL(key string) string {
+	return s.Endpoint + "/" + s3Escape(s.Bucket+"/"+key)
+}
+
+// s3StatusError is the unexpected HTTP status of a response of the object store.
+type s3StatusError int
+
+func (e s3StatusError) Error() string {
+	return fmt.Sprintf("object store responded %d %s", int(e), http.StatusText(int(e)))
+}
+
+// do signs and sends a request of the given payload hash.
+func (s *S3Archiver) do(request *http.Request, payloadHash string) error {
+	if s.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	signS3Request(request, s.AccessKey, s.SecretKey, s.Region, payloadHash, time.Now())
+	response, err := s.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode/100 != 2 {
+		return s3StatusError(response.StatusCode)
+	}
+	return nil
+}
+
+// emptyPayloadHash is the SHA-256 hash of an empty payload.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signS3Request signs a request of no query for S3 with AWS Signature
+// Version 4 at the given time, signing its host and all of its headers.
+func signS3Request(request *http.Request, accessKey, secretKey, region, payloadHash string, t time.Time) {
+	t = t.UTC()
+	date := t.Format("20060102")
+	request.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		s3Escape(request.URL.Path),
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent encodes all but the unreserved characters and slashes of a path.
+func s3Escape(s string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
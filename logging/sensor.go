@@ -0,0 +1,92 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Sensor, Site and SensorTags identify this sensor in every attack report
+// and connection event, so that a collector gathering those of many
+// sensors can tell them apart. Sensor also names the sensor in path
+// templates; it defaults to the host name.
+var (
+	Sensor     = defaultSensor()
+	Site       string
+	SensorTags map[string]string
+)
+
+func defaultSensor() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "honeybadger"
+	}
+	return hostname
+}
+
+// ReportSensor identifies the sensor which made a report.
+type ReportSensor struct {
+	ID   string            `json:"id"`
+	Site string            `json:"site,omitempty"`
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// reportSensor returns the identity of this sensor.
+func reportSensor() *ReportSensor {
+	return &ReportSensor{
+		ID:   Sensor,
+		Site: Site,
+		Tags: SensorTags,
+	}
+}
+
+// ParseSensorTags parses a comma separated list of key=value sensor tags.
+func ParseSensorTags(tags string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, tag := range strings.Split(tags, ",") {
+		if strings.TrimSpace(tag) == "" {
+			continue
+		}
+		keyValue := strings.SplitN(tag, "=", 2)
+		key := strings.TrimSpace(keyValue[0])
+		if len(keyValue) != 2 || key == "" {
+			return nil, fmt.Errorf("invalid sensor tag %q", tag)
+		}
+		result[key] = strings.TrimSpace(keyValue[1])
+	}
+	return result, nil
+}
+
+// formatSensorTags returns the sensor tags as a
+// comma separated list of key=value sorted by key.
+func formatSensorTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		keys[i] = key + "=" + tags[key]
+	}
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,36 @@
+package logging
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSensorIdentity(t *testing.T) {
+	tags, err := ParseSensorTags("env=prod, rack = 4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 || tags["env"] != "prod" || tags["rack"] != "4" {
+		t.Errorf("got tags %v", tags)
+	}
+	if _, err := ParseSensorTags("env"); err == nil {
+		t.Error("tag without a value accepted")
+	}
+
+	sensor, site, sensorTags := Sensor, Site, SensorTags
+	Sensor, Site, SensorTags = "sensor1", "dc1", tags
+	defer func() { Sensor, Site, SensorTags = sensor, site, sensorTags }()
+	b, err := FormatJSON(testReportEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Sensor ReportSensor `json:"sensor"`
+	}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Sensor.ID != "sensor1" || decoded.Sensor.Site != "dc1" || decoded.Sensor.Tags["rack"] != "4" {
+		t.Errorf("unexpected sensor in report %s", b)
+	}
+}
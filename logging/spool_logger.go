@@ -0,0 +1,336 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// SPOOL_EXTENSION is the extension of the reports spooled.
+	SPOOL_EXTENSION = ".report"
+	// SPOOL_REJECTED is the subdirectory of the spool the reports
+	// rejected by the collector are moved to.
+	SPOOL_REJECTED = "rejected"
+	// SPOOL_ID_HEADER is the header carrying the ID of an uploaded report,
+	// the same for every attempt, by which resent reports can be recognized.
+	SPOOL_ID_HEADER = "X-HoneyBadger-Report-Id"
+)
+
+// SpoolAttackLogger stores and forwards attack reports to a central HTTPS
+// collector, by default the /api/v1/reports resource of a Collector, with no
+// report lost to an outage between the sensor and the collector, nor to the
+// sensor restarting meanwhile. Each report is synced to its own file in the
+// spool directory, Dir, before Log returns, and the spooled reports are
+// then POSTed in the order they were reported, rendered by Format, the
+// honeybadger.Event message unless set otherwise. A report is only removed
+// once the collector accepted it; failed uploads are retried for as long
+// as need be, after a Backoff doubled after each failure up to MaxBackoff.
+// Reports the collector rejects as invalid are moved to the rejected
+// subdirectory of the spool. As an upload whose response is lost is
+// retried, a report may be delivered twice, with the same SPOOL_ID_HEADER.
+type SpoolAttackLogger struct {
+	URL         string
+	Dir         string
+	Format      ReportFormatter
+	ContentType string
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Client      *http.Client
+
+	mutex    sync.Mutex
+	sequence int64
+	wake     chan bool
+	stopChan chan bool
+	wg       sync.WaitGroup
+}
+
+func init() {
+	AttackLoggerRegister("spool", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewSpoolAttackLoggerFromOptions(options)
+	})
+}
+
+// NewSpoolAttackLogger returns a pointer to a SpoolAttackLogger struct
+// spooling to dir the reports it uploads to url.
+func NewSpoolAttackLogger(url, dir string) *SpoolAttackLogger {
+	return &SpoolAttackLogger{
+		URL:         url,
+		Dir:         dir,
+		Format:      FormatProtobuf,
+		ContentType: reportContentTypes["protobuf"],
+		Backoff:     time.Second,
+		MaxBackoff:  5 * time.Minute,
+		Client:      &http.Client{Transport: &http.Transport{}, Timeout: 30 * time.Second},
+		wake:        make(chan bool, 1),
+		stopChan:    make(chan bool),
+	}
+}
+
+// NewSpoolAttackLoggerFromOptions returns a SpoolAttackLogger configured by the
+// backend parameters url, the https URL reports are posted to, dir, the spool
+// directory, format, one of the ReportFormats, backoff, max_backoff,
+// timeout and, as for the collector attack logger, ca, cert and key.
+func NewSpoolAttackLoggerFromOptions(options *AttackLoggerOptions) (*SpoolAttackLogger, error) {
+	url, dir := options.Param("url", ""), options.Param("dir", "")
+	if url == "" {
+		return nil, fmt.Errorf("spool: no url given")
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("spool: no dir given")
+	}
+	s := NewSpoolAttackLogger(url, dir)
+	format := options.Param("format", "protobuf")
+	var err error
+	if s.Format, err = reportFormat(format); err != nil {
+		return nil, fmt.Errorf("spool: %s", err)
+	}
+	s.ContentType = reportContentTypes[format]
+	if s.Backoff, err = time.ParseDuration(options.Param("backoff", s.Backoff.String())); err != nil || s.Backoff <= 0 {
+		return nil, fmt.Errorf("spool: invalid backoff %q", options.Param("backoff", ""))
+	}
+	if s.MaxBackoff, err = time.ParseDuration(options.Param("max_backoff", s.MaxBackoff.String())); err != nil {
+		return nil, fmt.Errorf("spool: invalid max_backoff: %s", err)
+	}
+	if s.Client.Timeout, err = time.ParseDuration(options.Param("timeout", s.Client.Timeout.String())); err != nil {
+		return nil, fmt.Errorf("spool: invalid timeout: %s", err)
+	}
+	config, err := clientTLSConfig(options)
+	if err != nil {
+		return nil, fmt.Errorf("spool: %s", err)
+	}
+	s.Client.Transport.(*http.Transport).TLSClientConfig = config
+	return s, nil
+}
+
+// Start uploads the reports spooled, including those left by an
+// earlier run, in the background.
+func (s *SpoolAttackLogger) Start() {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		backendWarningf("spool", "%s\n", err)
+	}
+	// sequence numbers keep increasing across restarts, even once
+	// the spool is emptied, so that report IDs are not reused
+	s.sequence = time.Now().UnixNano()
+	if spooled := s.spooled(); len(spooled) > 0 {
+		if last := spoolSequence(spooled[len(spooled)-1]); last >= s.sequence {
+			s.sequence = last
+		}
+		Infof("spool: %d reports left to upload\n", len(spooled))
+	}
+	s.wg.Add(1)
+	go s.upload()
+}
+
+// Stop stops uploading; the reports not yet uploaded remain spooled.
+func (s *SpoolAttackLogger) Stop() {
+	close(s.stopChan)
+	s.wg.Wait()
+}
+
+// Log spools a report, returning once it is synced to disk.
+func (s *SpoolAttackLogger) Log(event *types.Event) {
+	record, err := s.Format(event)
+	if err == nil {
+		err = s.spool(record)
+	}
+	if err != nil {
+		backendWarningf("spool", "failed to spool %s report: %s\n", event.Type, err)
+		return
+	}
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+// spool writes a record to the next file of the spool.
+func (s *SpoolAttackLogger) spool(record []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sequence++
+	name := filepath.Join(s.Dir, fmt.Sprintf("%020d%s", s.sequence, SPOOL_EXTENSION))
+	f, err := os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(record)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	return syncDir(s.Dir)
+}
+
+// syncDir syncs a directory, so that the files created in it survive.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// spooled returns the names of the files of the reports spooled, in order.
+func (s *SpoolAttackLogger) spooled() []string {
+	entries, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		backendWarningf("spool", "%s\n", err)
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), SPOOL_EXTENSION) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// spoolSequence returns the sequence number of a spooled report.
+func spoolSequence(name string) int64 {
+	sequence, _ := strconv.ParseInt(strings.TrimSuffix(name, SPOOL_EXTENSION), 10, 64)
+	return sequence
+}
+
+// upload posts the spooled reports until stopped, waiting for
+// reports to be spooled once the spool is empty.
+func (s *SpoolAttackLogger) upload() {
+	defer s.wg.Done()
+	backoff := s.Backoff
+	for {
+		spooled := s.spooled()
+		for len(spooled) > 0 {
+			if err := s.post(spooled[0]); err != nil {
+				backendWarningf("spool", "failed to upload %s: %s; %d reports spooled, retrying in %s\n", spooled[0], err, len(spooled), backoff)
+				select {
+				case <-s.stopChan:
+					return
+				case <-time.After(backoff):
+				}
+				if backoff *= 2; s.MaxBackoff > 0 && backoff > s.MaxBackoff {
+					backoff = s.MaxBackoff
+				}
+				continue
+			}
+			backoff = s.Backoff
+			spooled = spooled[1:]
+			select {
+			case <-s.stopChan:
+				return
+			default:
+			}
+		}
+		select {
+		case <-s.stopChan:
+			return
+		case <-s.wake:
+		}
+	}
+}
+
+// spoolRejectedStatuses are the statuses of the responses refusing a report
+// which retrying would not get accepted, unlike those of transient failures
+// or of a misconfigured sensor or collector.
+var spoolRejectedStatuses = map[int]bool{
+	http.StatusBadRequest:            true,
+	http.StatusRequestEntityTooLarge: true,
+	http.StatusUnsupportedMediaType:  true,
+	http.StatusUnprocessableEntity:   true,
+}
+
+// spoolRejected is a report the collector refused.
+type spoolRejected struct {
+	status string
+}
+
+func (e spoolRejected) Error() string {
+	return "rejected by the collector: " + e.status
+}
+
+// post uploads a spooled report and removes it once accepted, or moves it
+// to the rejected subdirectory if the collector refuses it.
+func (s *SpoolAttackLogger) post(name string) error {
+	path := filepath.Join(s.Dir, name)
+	record, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = s.send(strings.TrimSuffix(name, SPOOL_EXTENSION), record)
+	if rejected, ok := err.(spoolRejected); ok {
+		backendWarningf("spool", "%s %s; moved to %s\n", name, rejected, SPOOL_REJECTED)
+		if err := os.MkdirAll(filepath.Join(s.Dir, SPOOL_REJECTED), 0700); err != nil {
+			return err
+		}
+		return os.Rename(path, filepath.Join(s.Dir, SPOOL_REJECTED, name))
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// send posts a record, returning a spoolRejected error
+// if the collector refuses it as invalid.
+func (s *SpoolAttackLogger) send(id string, record []byte) error {
+	request, err := http.NewRequest("POST", s.URL, bytes.NewReader(record))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", s.ContentType)
+	request.Header.Set(SPOOL_ID_HEADER, Sensor+"-"+id)
+	response, err := s.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	switch {
+	case response.StatusCode/100 == 2:
+		return nil
+	case spoolRejectedStatuses[response.StatusCode]:
+		return spoolRejected{response.Status}
+	}
+	return fmt.Errorf("collector responded %s", response.Status)
+}
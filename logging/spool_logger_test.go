@@ -0,0 +1,112 @@
+package logging
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyHandler fails the requests while down, recording the
+// report IDs of those it hands on.
+type flakyHandler struct {
+	handler http.Handler
+	mutex   sync.Mutex
+	down    bool
+	ids     []string
+}
+
+func (f *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	down := f.down
+	if !down {
+		f.ids = append(f.ids, r.Header.Get(SPOOL_ID_HEADER))
+	}
+	f.mutex.Unlock()
+	if down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	f.handler.ServeHTTP(w, r)
+}
+
+func (f *flakyHandler) setDown(down bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.down = down
+}
+
+func TestSpoolAttackLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	collector := NewCollector(nil)
+	flaky := &flakyHandler{handler: collector, down: true}
+	server := httptest.NewTLSServer(flaky)
+	defer server.Close()
+	newLogger := func() *SpoolAttackLogger {
+		logger, err := NewSpoolAttackLoggerFromOptions(&AttackLoggerOptions{
+			Params: map[string]string{"url": server.URL + "/api/v1/reports", "dir": dir, "backoff": "10ms", "max_backoff": "20ms"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger.Client = server.Client()
+		return logger
+	}
+
+	// reports spooled while the collector is down survive a restart
+	logger := newLogger()
+	logger.Start()
+	logger.Log(testReportEvent())
+	other := testReportEvent()
+	other.Type = "injection"
+	logger.Log(other)
+	time.Sleep(50 * time.Millisecond)
+	logger.Stop()
+	spooled := logger.spooled()
+	if len(spooled) != 2 || spooled[0] >= spooled[1] {
+		t.Fatalf("spooled %v", spooled)
+	}
+
+	// an invalid report is set aside rather than holding up the others
+	if err := ioutil.WriteFile(filepath.Join(dir, "00000000000000000001"+SPOOL_EXTENSION), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	flaky.setDown(false)
+	logger = newLogger()
+	logger.Start()
+	defer logger.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(logger.spooled()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if spooled := logger.spooled(); len(spooled) != 0 {
+		t.Fatalf("%v left spooled", spooled)
+	}
+	attacks := collector.Attacks(AttackQuery{}, "")
+	if len(attacks) != 2 || attacks[0].Report.Type != "injection" || attacks[1].Report.Type != "handshake-hijack" {
+		t.Errorf("collected %+v", attacks)
+	}
+	if _, err := os.Stat(filepath.Join(dir, SPOOL_REJECTED, "00000000000000000001"+SPOOL_EXTENSION)); err != nil {
+		t.Errorf("invalid report not set aside: %s", err)
+	}
+	flaky.mutex.Lock()
+	defer flaky.mutex.Unlock()
+	if len(flaky.ids) != 3 || flaky.ids[1] != Sensor+"-"+spooled[0][:len(spooled[0])-len(SPOOL_EXTENSION)] {
+		t.Errorf("report IDs %v", flaky.ids)
+	}
+
+	// reports spooled later are numbered after those of earlier runs
+	logger.Log(testReportEvent())
+	if sequence := logger.sequence; sequence <= spoolSequence(spooled[1]) {
+		t.Errorf("sequence %d reused", sequence)
+	}
+}
@@ -0,0 +1,357 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// sqlDialect holds what differs between the SQL databases reports can be stored in.
+type sqlDialect struct {
+	// Driver is the database/sql driver name; the driver itself
+	// must be linked into the binary, see cmd/honeyBadger.
+	Driver string
+	// Placeholder returns the bind parameter for the nth (from 1) argument.
+	Placeholder func(n int) string
+	// Migrations are applied in order, each once, to bring the schema up to date.
+	Migrations []string
+	// MultiRowInsert is set if a batch is to be inserted
+	// by a single INSERT statement rather than one per report.
+	MultiRowInsert bool
+}
+
+var sqliteDialect = sqlDialect{
+	Driver:      "sqlite3",
+	Placeholder: func(n int) string { return "?" },
+	Migrations: []string{
+		`CREATE TABLE attack_reports (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time TIMESTAMP NOT NULL,
+	type TEXT NOT NULL,
+	detector TEXT NOT NULL,
+	flow TEXT NOT NULL,
+	src_ip TEXT NOT NULL,
+	src_port INTEGER NOT NULL,
+	dst_ip TEXT NOT NULL,
+	dst_port INTEGER NOT NULL,
+	packet_count INTEGER NOT NULL,
+	seq_start INTEGER,
+	seq_end INTEGER,
+	payload BLOB,
+	report TEXT NOT NULL
+);
+CREATE INDEX attack_reports_time ON attack_reports (time);
+CREATE INDEX attack_reports_dst_ip ON attack_reports (dst_ip, time);
+CREATE VIEW connection_summaries AS
+	SELECT flow, src_ip, src_port, dst_ip, dst_port,
+		MIN(time) AS first_report, MAX(time) AS last_report,
+		COUNT(*) AS reports, MAX(packet_count) AS packets
+	FROM attack_reports GROUP BY flow, src_ip, src_port, dst_ip, dst_port;`,
+	},
+}
+
+var postgresDialect = sqlDialect{
+	Driver:         "postgres",
+	Placeholder:    func(n int) string { return fmt.Sprintf("$%d", n) },
+	MultiRowInsert: true,
+	Migrations: []string{
+		`CREATE TABLE attack_reports (
+	id BIGSERIAL PRIMARY KEY,
+	time TIMESTAMPTZ NOT NULL,
+	type TEXT NOT NULL,
+	detector TEXT NOT NULL,
+	flow TEXT NOT NULL,
+	src_ip INET NOT NULL,
+	src_port INTEGER NOT NULL,
+	dst_ip INET NOT NULL,
+	dst_port INTEGER NOT NULL,
+	packet_count BIGINT NOT NULL,
+	seq_start BIGINT,
+	seq_end BIGINT,
+	payload BYTEA,
+	report JSONB NOT NULL
+);
+CREATE INDEX attack_reports_time ON attack_reports (time);
+CREATE INDEX attack_reports_dst_ip ON attack_reports (dst_ip, time);
+CREATE VIEW connection_summaries AS
+	SELECT flow, src_ip, src_port, dst_ip, dst_port,
+		MIN(time) AS first_report, MAX(time) AS last_report,
+		COUNT(*) AS reports, MAX(packet_count) AS packets
+	FROM attack_reports GROUP BY flow, src_ip, src_port, dst_ip, dst_port;`,
+	},
+}
+
+// SQLAttackLogger stores attack reports in the attack_reports table of an
+// SQL database; the connection_summaries view sums them up per flow.
+// The schema is created, and later migrated, on Start. Reports are
+// inserted in batches, one transaction per batch.
+type SQLAttackLogger struct {
+	DB            *sql.DB
+	BatchSize     int
+	FlushInterval time.Duration
+
+	dialect          sqlDialect
+	stopChan         chan bool
+	doneChan         chan bool
+	attackReportChan chan *types.Event
+}
+
+func init() {
+	AttackLoggerRegister("sqlite", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		filename := options.Param("file", filepath.Join(options.ArchiveDir, "honeybadger.db"))
+		return newSQLAttackLoggerFromOptions(sqliteDialect, filename, options)
+	})
+	AttackLoggerRegister("postgres", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return newSQLAttackLoggerFromOptions(postgresDialect, options.Param("dsn", "dbname=honeybadger"), options)
+	})
+}
+
+// NewSQLAttackLogger returns a pointer to a SQLAttackLogger struct storing
+// reports in the database of the given dialect named by dataSource.
+func NewSQLAttackLogger(dialect sqlDialect, dataSource string) (*SQLAttackLogger, error) {
+	db, err := sql.Open(dialect.Driver, dataSource)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", dialect.Driver, err)
+	}
+	return &SQLAttackLogger{
+		DB:               db,
+		BatchSize:        100,
+		FlushInterval:    time.Second,
+		dialect:          dialect,
+		stopChan:         make(chan bool),
+		doneChan:         make(chan bool),
+		attackReportChan: make(chan *types.Event, 1000),
+	}, nil
+}
+
+// newSQLAttackLoggerFromOptions returns a SQLAttackLogger configured by the
+// backend parameters batch_size, flush_interval and, for the connection pool,
+// max_open_conns, max_idle_conns and conn_max_lifetime.
+func newSQLAttackLoggerFromOptions(dialect sqlDialect, dataSource string, options *AttackLoggerOptions) (*SQLAttackLogger, error) {
+	s, err := NewSQLAttackLogger(dialect, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if s.BatchSize, err = strconv.Atoi(options.Param("batch_size", strconv.Itoa(s.BatchSize))); err != nil {
+		return nil, fmt.Errorf("%s: invalid batch_size: %s", dialect.Driver, err)
+	}
+	if s.FlushInterval, err = time.ParseDuration(options.Param("flush_interval", s.FlushInterval.String())); err != nil {
+		return nil, fmt.Errorf("%s: invalid flush_interval: %s", dialect.Driver, err)
+	}
+	maxOpen, err := strconv.Atoi(options.Param("max_open_conns", "4"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid max_open_conns: %s", dialect.Driver, err)
+	}
+	maxIdle, err := strconv.Atoi(options.Param("max_idle_conns", "2"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid max_idle_conns: %s", dialect.Driver, err)
+	}
+	lifetime, err := time.ParseDuration(options.Param("conn_max_lifetime", "1h"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid conn_max_lifetime: %s", dialect.Driver, err)
+	}
+	s.DB.SetMaxOpenConns(maxOpen)
+	s.DB.SetMaxIdleConns(maxIdle)
+	s.DB.SetConnMaxLifetime(lifetime)
+	return s, nil
+}
+
+func (s *SQLAttackLogger) Start() {
+	if err := s.Migrate(); err != nil {
+		Errorf("%s attack logger: schema migration failed: %s\n", s.dialect.Driver, err)
+	}
+	go s.receiveReports()
+}
+
+// Stop stores the queued reports and closes the database.
+func (s *SQLAttackLogger) Stop() {
+	s.stopChan <- true
+	<-s.doneChan
+	s.DB.Close()
+}
+
+func (s *SQLAttackLogger) Log(event *types.Event) {
+	s.attackReportChan <- event
+}
+
+func (s *SQLAttackLogger) receiveReports() {
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+	var batch []*types.Event
+	for {
+		select {
+		case <-s.stopChan:
+			for len(s.attackReportChan) > 0 {
+				batch = append(batch, <-s.attackReportChan)
+			}
+			s.flush(batch)
+			s.doneChan <- true
+			return
+		case event := <-s.attackReportChan:
+			batch = append(batch, event)
+			if len(batch) >= s.BatchSize {
+				s.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			s.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+func (s *SQLAttackLogger) flush(batch []*types.Event) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := s.insert(batch); err != nil {
+		backendWarningf(s.dialect.Driver, "failed to store %d reports: %s\n", len(batch), err)
+	}
+}
+
+// Migrate applies the dialect's migrations not yet recorded in the schema_migrations table.
+func (s *SQLAttackLogger) Migrate() error {
+	if _, err := s.DB.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)"); err != nil {
+		return err
+	}
+	var version int
+	if err := s.DB.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(s.dialect.Migrations); version++ {
+		tx, err := s.DB.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range strings.Split(s.dialect.Migrations[version], ";") {
+			if strings.TrimSpace(statement) == "" {
+				continue
+			}
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %s", version+1, err)
+			}
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES ("+s.dialect.Placeholder(1)+")", version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var attackReportColumns = []string{
+	"time", "type", "detector", "flow", "src_ip", "src_port", "dst_ip", "dst_port",
+	"packet_count", "seq_start", "seq_end", "payload", "report",
+}
+
+// reportRow returns the attack_reports column values of a report.
+func reportRow(event *types.Event) ([]interface{}, error) {
+	report := NewAttackReport(event)
+	b, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	var start, end interface{}
+	if report.Sequence != nil {
+		start, end = int64(report.Sequence.Start), int64(report.Sequence.End)
+	}
+	return []interface{}{
+		report.Time.UTC(), report.Type, report.Detector, event.Flow.String(),
+		report.Flow.SrcIP, int64(report.Flow.SrcPort), report.Flow.DstIP, int64(report.Flow.DstPort),
+		int64(report.PacketCount), start, end, report.Payload, string(b),
+	}, nil
+}
+
+// rowPlaceholders returns the bind parameters of the nth (from 0) row of an INSERT.
+func (s *SQLAttackLogger) rowPlaceholders(n int) string {
+	placeholders := make([]string, len(attackReportColumns))
+	for i := range placeholders {
+		placeholders[i] = s.dialect.Placeholder(n*len(attackReportColumns) + i + 1)
+	}
+	return "(" + strings.Join(placeholders, ", ") + ")"
+}
+
+func (s *SQLAttackLogger) insert(batch []*types.Event) error {
+	if s.dialect.MultiRowInsert {
+		return s.insertRows(batch)
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	statement, err := tx.Prepare(fmt.Sprintf("INSERT INTO attack_reports (%s) VALUES %s",
+		strings.Join(attackReportColumns, ", "), s.rowPlaceholders(0)))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer statement.Close()
+	for _, event := range batch {
+		row, err := reportRow(event)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := statement.Exec(row...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// maxBindParameters is the most bind parameters a PostgreSQL statement may have.
+const maxBindParameters = 65535
+
+// insertRows inserts a batch with a single multiple row INSERT statement,
+// or as few as the bind parameter limit allows.
+func (s *SQLAttackLogger) insertRows(batch []*types.Event) error {
+	if maxRows := maxBindParameters / len(attackReportColumns); len(batch) > maxRows {
+		if err := s.insertRows(batch[:maxRows]); err != nil {
+			return err
+		}
+		return s.insertRows(batch[maxRows:])
+	}
+	var rows []string
+	var args []interface{}
+	for i, event := range batch {
+		row, err := reportRow(event)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, s.rowPlaceholders(i))
+		args = append(args, row...)
+	}
+	_, err := s.DB.Exec(fmt.Sprintf("INSERT INTO attack_reports (%s) VALUES %s",
+		strings.Join(attackReportColumns, ", "), strings.Join(rows, ", ")), args...)
+	return err
+}
@@ -0,0 +1,134 @@
+package logging
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// recordingDriver is a database/sql driver which records the statements
+// executed and answers every query with the number of migrations recorded.
+type recordingDriver struct {
+	mutex      sync.Mutex
+	statements []string
+	args       [][]driver.Value
+	migrations int64
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) { return &recordingConn{d}, nil }
+
+type recordingConn struct{ d *recordingDriver }
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{c.d, query}, nil
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *recordingConn) Commit() error             { return nil }
+func (c *recordingConn) Rollback() error           { return errors.New("unexpected rollback") }
+
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mutex.Lock()
+	defer s.d.mutex.Unlock()
+	s.d.statements = append(s.d.statements, s.query)
+	s.d.args = append(s.d.args, args)
+	if strings.HasPrefix(s.query, "INSERT INTO schema_migrations") {
+		s.d.migrations++
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.mutex.Lock()
+	defer s.d.mutex.Unlock()
+	return &recordingRows{value: s.d.migrations}, nil
+}
+
+type recordingRows struct {
+	value int64
+	done  bool
+}
+
+func (r *recordingRows) Columns() []string { return []string{"value"} }
+func (r *recordingRows) Close() error      { return nil }
+func (r *recordingRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.value
+	return nil
+}
+
+var testDriver = &recordingDriver{}
+
+func init() {
+	sql.Register("recording", testDriver)
+}
+
+func TestSQLAttackLogger(t *testing.T) {
+	dialect := sqliteDialect
+	dialect.Driver = "recording"
+	logger, err := NewSQLAttackLogger(dialect, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	// migrations already applied are not applied again
+	applied := len(testDriver.statements)
+	if err := logger.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if testDriver.migrations != int64(len(dialect.Migrations)) || len(testDriver.statements) != applied+1 {
+		t.Fatalf("migrations applied %d times", testDriver.migrations)
+	}
+
+	if err := logger.insert([]*types.Event{testReportEvent(), testReportEvent()}); err != nil {
+		t.Fatal(err)
+	}
+	last := testDriver.statements[len(testDriver.statements)-1]
+	if !strings.HasPrefix(last, "INSERT INTO attack_reports (time, type, detector,") {
+		t.Errorf("unexpected insert statement %s", last)
+	}
+	args := testDriver.args[len(testDriver.args)-1]
+	if len(args) != len(attackReportColumns) || args[1] != "handshake-hijack" || args[6] != "2.3.4.5" {
+		t.Errorf("unexpected row %v", args)
+	}
+}
+
+func TestSQLAttackLoggerMultiRowInsert(t *testing.T) {
+	dialect := postgresDialect
+	dialect.Driver = "recording"
+	logger, err := NewSQLAttackLogger(dialect, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.insert([]*types.Event{testReportEvent(), testReportEvent()}); err != nil {
+		t.Fatal(err)
+	}
+	testDriver.mutex.Lock()
+	defer testDriver.mutex.Unlock()
+	last := testDriver.statements[len(testDriver.statements)-1]
+	if !strings.HasSuffix(last, "($14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26)") {
+		t.Errorf("unexpected insert statement %s", last)
+	}
+	if args := testDriver.args[len(testDriver.args)-1]; len(args) != 2*len(attackReportColumns) {
+		t.Errorf("expected a single statement inserting both rows, got %d arguments", len(args))
+	}
+}
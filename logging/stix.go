@@ -0,0 +1,292 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// STIX_TIME_FORMAT is the millisecond precision UTC timestamp layout of STIX 2.1.
+const STIX_TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+
+// stixSCONamespace is the UUIDv5 namespace STIX 2.1 derives the
+// deterministic IDs of cyber observable objects in.
+var stixSCONamespace = [16]byte{0x00, 0xab, 0xed, 0xb4, 0xaa, 0x42, 0x46, 0x6c, 0x9c, 0x01, 0xfe, 0xd2, 0x33, 0x15, 0xa9, 0xb7}
+
+// stixIdentityCreated is when the identity object of the sensor was created,
+// the same for all the bundles of a run.
+var stixIdentityCreated = time.Now()
+
+// StixBundle is a STIX 2.1 bundle of the objects of one attack report.
+type StixBundle struct {
+	Type    string        `json:"type"`
+	ID      string        `json:"id"`
+	Objects []interface{} `json:"objects"`
+}
+
+// StixCommon holds the properties common to all STIX 2.1 objects.
+type StixCommon struct {
+	Type        string `json:"type"`
+	SpecVersion string `json:"spec_version"`
+	ID          string `json:"id"`
+}
+
+// StixDomain holds the properties common to STIX 2.1 domain and relationship objects.
+type StixDomain struct {
+	StixCommon
+	CreatedByRef string `json:"created_by_ref,omitempty"`
+	Created      string `json:"created"`
+	Modified     string `json:"modified"`
+}
+
+// StixIdentity is the identity object of the sensor.
+type StixIdentity struct {
+	StixDomain
+	Name          string `json:"name"`
+	Description   string `json:"description,omitempty"`
+	IdentityClass string `json:"identity_class"`
+}
+
+// StixAddress is an ipv4-addr or ipv6-addr object.
+type StixAddress struct {
+	StixCommon
+	Value string `json:"value"`
+}
+
+// StixArtifact is the artifact object of a reported payload.
+type StixArtifact struct {
+	StixCommon
+	PayloadBin []byte `json:"payload_bin"`
+}
+
+// StixNetworkTraffic is the network-traffic object of the reported TCP connection.
+type StixNetworkTraffic struct {
+	StixCommon
+	SrcRef        string   `json:"src_ref"`
+	DstRef        string   `json:"dst_ref"`
+	SrcPort       uint16   `json:"src_port"`
+	DstPort       uint16   `json:"dst_port"`
+	Protocols     []string `json:"protocols"`
+	SrcPayloadRef string   `json:"src_payload_ref,omitempty"`
+}
+
+// StixObservedData is the observed-data object of an attack report.
+type StixObservedData struct {
+	StixDomain
+	FirstObserved  string   `json:"first_observed"`
+	LastObserved   string   `json:"last_observed"`
+	NumberObserved uint64   `json:"number_observed"`
+	ObjectRefs     []string `json:"object_refs"`
+}
+
+// StixIndicator is the indicator object of an attack report,
+// of which the pattern matches the attacked connection.
+type StixIndicator struct {
+	StixDomain
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	IndicatorTypes []string `json:"indicator_types"`
+	Pattern        string   `json:"pattern"`
+	PatternType    string   `json:"pattern_type"`
+	ValidFrom      string   `json:"valid_from"`
+	Labels         []string `json:"labels,omitempty"`
+}
+
+// StixRelationship relates the indicator to the observed data it is based on.
+type StixRelationship struct {
+	StixDomain
+	RelationshipType string `json:"relationship_type"`
+	SourceRef        string `json:"source_ref"`
+	TargetRef        string `json:"target_ref"`
+}
+
+func formatUUID(u [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// stixRandomID returns a STIX identifier of the given type with a random UUIDv4.
+func stixRandomID(objectType string) string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return objectType + "--" + formatUUID(u)
+}
+
+// stixObservableID returns the deterministic STIX identifier of a cyber
+// observable: a UUIDv5 of the canonical JSON of its ID contributing properties.
+func stixObservableID(objectType string, properties map[string]interface{}) string {
+	// json.Marshal sorts map keys and adds no whitespace
+	name, _ := json.Marshal(properties)
+	h := sha1.New()
+	h.Write(stixSCONamespace[:])
+	h.Write(name)
+	var u [16]byte
+	copy(u[:], h.Sum(nil))
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return objectType + "--" + formatUUID(u)
+}
+
+func stixTime(t time.Time) string {
+	return t.UTC().Format(STIX_TIME_FORMAT)
+}
+
+// stixAddress returns the ipv4-addr or ipv6-addr object of an address.
+func stixAddress(address string) *StixAddress {
+	objectType := "ipv4-addr"
+	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+		objectType = "ipv6-addr"
+	}
+	return &StixAddress{
+		StixCommon: StixCommon{
+			Type:        objectType,
+			SpecVersion: "2.1",
+			ID:          stixObservableID(objectType, map[string]interface{}{"value": address}),
+		},
+		Value: address,
+	}
+}
+
+// NewStixBundle returns the STIX 2.1 bundle of an event: an observed-data
+// object of the connection, its addresses and any payload, and for attack
+// reports an indicator based on it. The objects are attributed to the
+// identity of the sensor, which is included too.
+func NewStixBundle(event *types.Event) *StixBundle {
+	report := NewAttackReport(event)
+	now := stixTime(time.Now())
+	observed := stixTime(report.Time)
+
+	identity := &StixIdentity{
+		StixDomain: StixDomain{
+			StixCommon: StixCommon{
+				Type:        "identity",
+				SpecVersion: "2.1",
+				// derived like those of observables so that it is the same across runs
+				ID: stixObservableID("identity", map[string]interface{}{"name": report.Sensor.ID}),
+			},
+			Created:  stixTime(stixIdentityCreated),
+			Modified: stixTime(stixIdentityCreated),
+		},
+		Name:          report.Sensor.ID,
+		Description:   report.Sensor.Site,
+		IdentityClass: "system",
+	}
+	domain := func(objectType string) StixDomain {
+		return StixDomain{
+			StixCommon:   StixCommon{Type: objectType, SpecVersion: "2.1", ID: stixRandomID(objectType)},
+			CreatedByRef: identity.ID,
+			Created:      now,
+			Modified:     now,
+		}
+	}
+
+	src, dst := stixAddress(report.Flow.SrcIP), stixAddress(report.Flow.DstIP)
+	network := "ipv4"
+	if src.Type == "ipv6-addr" {
+		network = "ipv6"
+	}
+	protocols := []string{network, "tcp"}
+	traffic := &StixNetworkTraffic{
+		StixCommon: StixCommon{
+			Type:        "network-traffic",
+			SpecVersion: "2.1",
+			ID: stixObservableID("network-traffic", map[string]interface{}{
+				"src_ref":   src.ID,
+				"dst_ref":   dst.ID,
+				"src_port":  report.Flow.SrcPort,
+				"dst_port":  report.Flow.DstPort,
+				"protocols": protocols,
+			}),
+		},
+		SrcRef:    src.ID,
+		DstRef:    dst.ID,
+		SrcPort:   report.Flow.SrcPort,
+		DstPort:   report.Flow.DstPort,
+		Protocols: protocols,
+	}
+	objects := []interface{}{identity, src, dst, traffic}
+	refs := []string{traffic.ID, src.ID, dst.ID}
+	if len(report.Payload) > 0 {
+		artifact := &StixArtifact{
+			StixCommon: StixCommon{
+				Type:        "artifact",
+				SpecVersion: "2.1",
+				ID:          stixObservableID("artifact", map[string]interface{}{"payload_bin": report.Payload}),
+			},
+			PayloadBin: report.Payload,
+		}
+		traffic.SrcPayloadRef = artifact.ID
+		objects = append(objects, artifact)
+		refs = append(refs, artifact.ID)
+	}
+
+	number := report.Occurrences
+	if number == 0 {
+		number = 1
+	}
+	observedData := &StixObservedData{
+		StixDomain:     domain("observed-data"),
+		FirstObserved:  observed,
+		LastObserved:   observed,
+		NumberObserved: number,
+		ObjectRefs:     refs,
+	}
+	objects = append(objects, observedData)
+
+	if report.Detector != "dispatcher" {
+		indicator := &StixIndicator{
+			StixDomain: domain("indicator"),
+			Name:       "HoneyBadger " + report.Type,
+			Description: fmt.Sprintf("TCP %s attack, %s, detected on the connection %s:%d to %s:%d",
+				report.Detector, report.Type, report.Flow.SrcIP, report.Flow.SrcPort, report.Flow.DstIP, report.Flow.DstPort),
+			IndicatorTypes: []string{"malicious-activity"},
+			Pattern: fmt.Sprintf("[network-traffic:src_ref.value = '%s' AND network-traffic:src_port = %d AND network-traffic:dst_ref.value = '%s' AND network-traffic:dst_port = %d]",
+				report.Flow.SrcIP, report.Flow.SrcPort, report.Flow.DstIP, report.Flow.DstPort),
+			PatternType: "stix",
+			ValidFrom:   observed,
+			Labels:      []string{report.Detector},
+		}
+		relationship := &StixRelationship{
+			StixDomain:       domain("relationship"),
+			RelationshipType: "based-on",
+			SourceRef:        indicator.ID,
+			TargetRef:        observedData.ID,
+		}
+		objects = append(objects, indicator, relationship)
+	}
+	return &StixBundle{
+		Type:    "bundle",
+		ID:      stixRandomID("bundle"),
+		Objects: objects,
+	}
+}
+
+// FormatSTIX renders an attack report as a STIX 2.1 bundle.
+func FormatSTIX(event *types.Event) ([]byte, error) {
+	return json.Marshal(NewStixBundle(event))
+}
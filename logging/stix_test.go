@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFormatSTIX(t *testing.T) {
+	event := testReportEvent()
+	event.Payload = []byte("injected")
+	event.Occurrences = 3
+	record, err := FormatSTIX(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bundle struct {
+		Type    string                   `json:"type"`
+		ID      string                   `json:"id"`
+		Objects []map[string]interface{} `json:"objects"`
+	}
+	if err := json.Unmarshal(record, &bundle); err != nil {
+		t.Fatal(err)
+	}
+	if bundle.Type != "bundle" || !strings.HasPrefix(bundle.ID, "bundle--") {
+		t.Fatalf("bundle %s %s", bundle.Type, bundle.ID)
+	}
+	objects := make(map[string]map[string]interface{})
+	ids := make(map[string]bool)
+	for _, object := range bundle.Objects {
+		objects[object["type"].(string)] = object
+		ids[object["id"].(string)] = true
+		if object["spec_version"] != "2.1" {
+			t.Errorf("%s spec_version %v", object["id"], object["spec_version"])
+		}
+	}
+	for _, objectType := range []string{"identity", "ipv4-addr", "network-traffic", "artifact", "observed-data", "indicator", "relationship"} {
+		if objects[objectType] == nil {
+			t.Fatalf("no %s object in %s", objectType, record)
+		}
+	}
+
+	// observables have the UUIDv5 identifiers every STIX producer derives
+	addresses := 0
+	for _, object := range bundle.Objects {
+		if object["type"] == "ipv4-addr" && object["value"] == "1.2.3.4" {
+			addresses++
+			if object["id"] != "ipv4-addr--0198f97b-e65d-5025-87e5-58bc39d4bdb4" {
+				t.Errorf("1.2.3.4 has the id %s", object["id"])
+			}
+		}
+	}
+	if addresses != 1 {
+		t.Errorf("%d objects of 1.2.3.4", addresses)
+	}
+
+	observed := objects["observed-data"]
+	if observed["number_observed"] != 3.0 || observed["first_observed"] != "1970-01-01T00:00:01.000Z" {
+		t.Errorf("observed-data %v", observed)
+	}
+	for _, ref := range observed["object_refs"].([]interface{}) {
+		if !ids[ref.(string)] {
+			t.Errorf("observed-data refers to %s, which is not in the bundle", ref)
+		}
+	}
+	indicator := objects["indicator"]
+	pattern := "[network-traffic:src_ref.value = '1.2.3.4' AND network-traffic:src_port = 1 AND network-traffic:dst_ref.value = '2.3.4.5' AND network-traffic:dst_port = 2]"
+	if indicator["pattern"] != pattern || indicator["created_by_ref"] != objects["identity"]["id"] {
+		t.Errorf("indicator %v", indicator)
+	}
+	relationship := objects["relationship"]
+	if relationship["source_ref"] != indicator["id"] || relationship["target_ref"] != observed["id"] {
+		t.Errorf("relationship %v", relationship)
+	}
+
+	event.Type = "connection-opened"
+	if record, _ = FormatSTIX(event); strings.Contains(string(record), `"indicator"`) {
+		t.Errorf("indicator of a connection event: %s", record)
+	}
+}
@@ -0,0 +1,259 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3,
+	"warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// SyslogAttackLogger sends attack reports to a local or remote syslog
+// server as RFC 5424 messages whose MSG is the report rendered by Format,
+// AttackReport JSON unless set otherwise.
+//
+// Network is "udp", "tcp", "tls" or, for the local syslog daemon,
+// "unixgram"; messages sent over a stream transport are framed by octet
+// counting as RFC 6587 describes. The facility and severity of a report
+// are those set for its type, else those of its detector, else the defaults.
+type SyslogAttackLogger struct {
+	Network  string
+	Address  string
+	Hostname string
+	AppName  string
+	TLS      *tls.Config
+	Format   ReportFormatter
+
+	Facility   int
+	Severity   int
+	Facilities map[string]int
+	Severities map[string]int
+
+	conn             net.Conn
+	stopChan         chan bool
+	attackReportChan chan *types.Event
+}
+
+func init() {
+	AttackLoggerRegister("syslog", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewSyslogAttackLoggerFromOptions(options)
+	})
+}
+
+// NewSyslogAttackLogger returns a pointer to a SyslogAttackLogger struct
+// sending to address over network with the facility local0 and severity alert.
+func NewSyslogAttackLogger(network, address string) *SyslogAttackLogger {
+	return &SyslogAttackLogger{
+		Network:          network,
+		Address:          address,
+		Hostname:         Sensor,
+		AppName:          "honeybadger",
+		Format:           FormatJSON,
+		Facility:         syslogFacilities["local0"],
+		Severity:         syslogSeverities["alert"],
+		Facilities:       make(map[string]int),
+		Severities:       make(map[string]int),
+		stopChan:         make(chan bool),
+		attackReportChan: make(chan *types.Event),
+	}
+}
+
+// NewSyslogAttackLoggerFromOptions returns a SyslogAttackLogger configured by the
+// backend parameters network, address, format, facility, severity, hostname,
+// app_name, ca, facility.<type or detector> and severity.<type or detector>.
+// Without an address reports go to the local syslog daemon.
+func NewSyslogAttackLoggerFromOptions(options *AttackLoggerOptions) (*SyslogAttackLogger, error) {
+	network := options.Param("network", "udp")
+	address := options.Param("address", "")
+	if address == "" {
+		network, address = "unixgram", "/dev/log"
+	}
+	s := NewSyslogAttackLogger(network, address)
+	s.Hostname = options.Param("hostname", s.Hostname)
+	s.AppName = options.Param("app_name", s.AppName)
+	format, err := reportFormat(options.Param("format", "json"))
+	if err != nil {
+		return nil, err
+	}
+	s.Format = format
+	for key, value := range options.Params {
+		var err error
+		switch {
+		case key == "facility":
+			s.Facility, err = syslogFacility(value)
+		case key == "severity":
+			s.Severity, err = syslogSeverity(value)
+		case strings.HasPrefix(key, "facility."):
+			s.Facilities[strings.TrimPrefix(key, "facility.")], err = syslogFacility(value)
+		case strings.HasPrefix(key, "severity."):
+			s.Severities[strings.TrimPrefix(key, "severity.")], err = syslogSeverity(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch network {
+	case "udp", "tcp", "unixgram", "unix":
+	case "tls":
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		s.TLS = &tls.Config{ServerName: host}
+		if ca := options.Param("ca", ""); ca != "" {
+			pem, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return nil, err
+			}
+			s.TLS.RootCAs = x509.NewCertPool()
+			if !s.TLS.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("syslog: no certificates found in %s", ca)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("syslog: unsupported network %q", network)
+	}
+	return s, nil
+}
+
+func syslogFacility(name string) (int, error) {
+	if facility, ok := syslogFacilities[name]; ok {
+		return facility, nil
+	}
+	return 0, fmt.Errorf("syslog: unknown facility %q", name)
+}
+
+func syslogSeverity(name string) (int, error) {
+	if severity, ok := syslogSeverities[name]; ok {
+		return severity, nil
+	}
+	return 0, fmt.Errorf("syslog: unknown severity %q", name)
+}
+
+func (s *SyslogAttackLogger) Start() {
+	go s.receiveReports()
+}
+
+func (s *SyslogAttackLogger) Stop() {
+	s.stopChan <- true
+}
+
+func (s *SyslogAttackLogger) receiveReports() {
+	for {
+		select {
+		case <-s.stopChan:
+			if s.conn != nil {
+				s.conn.Close()
+				s.conn = nil
+			}
+			return
+		case event := <-s.attackReportChan:
+			if err := s.send(event); err != nil {
+				backendWarningf("syslog", "%s\n", err)
+			}
+		}
+	}
+}
+
+func (s *SyslogAttackLogger) Log(event *types.Event) {
+	s.attackReportChan <- event
+}
+
+// priority returns the PRI value of a report of the given type.
+func (s *SyslogAttackLogger) priority(eventType string) int {
+	facility, ok := s.Facilities[eventType]
+	if !ok {
+		if facility, ok = s.Facilities[detectorOf(eventType)]; !ok {
+			facility = s.Facility
+		}
+	}
+	severity, ok := s.Severities[eventType]
+	if !ok {
+		if severity, ok = s.Severities[detectorOf(eventType)]; !ok {
+			severity = s.Severity
+		}
+	}
+	return facility*8 + severity
+}
+
+// Message returns the RFC 5424 message of an attack report.
+func (s *SyslogAttackLogger) Message(event *types.Event) ([]byte, error) {
+	b, err := s.Format(event)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := event.Time
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	header := fmt.Sprintf("<%d>1 %s %s %s %d %s - ", s.priority(event.Type),
+		timestamp.Format(time.RFC3339Nano), s.Hostname, s.AppName, os.Getpid(), detectorOf(event.Type))
+	return append([]byte(header), b...), nil
+}
+
+func (s *SyslogAttackLogger) dial() (net.Conn, error) {
+	if s.Network == "tls" {
+		return tls.Dial("tcp", s.Address, s.TLS)
+	}
+	return net.Dial(s.Network, s.Address)
+}
+
+// send writes a report to the syslog server, connecting or, once,
+// reconnecting as needed.
+func (s *SyslogAttackLogger) send(event *types.Event) error {
+	message, err := s.Message(event)
+	if err != nil {
+		return err
+	}
+	if s.Network == "tcp" || s.Network == "tls" {
+		message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+	}
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			if s.conn, err = s.dial(); err != nil {
+				return err
+			}
+		}
+		if _, err = s.conn.Write(message); err == nil || attempt > 0 {
+			return err
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+}
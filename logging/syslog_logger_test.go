@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+func TestSyslogAttackLogger(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	options := AttackLoggerOptions{
+		Params: map[string]string{
+			"address":                  server.LocalAddr().String(),
+			"hostname":                 "sensor",
+			"facility":                 "local3",
+			"severity":                 "warning",
+			"severity.handshake":       "err",
+			"severity.handshake-reset": "notice",
+		},
+	}
+	logger, err := NewSyslogAttackLoggerFromOptions(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := logger.priority("handshake-hijack"); p != 19*8+3 {
+		t.Errorf("detector severity not applied, priority %d", p)
+	}
+	if p := logger.priority("handshake-reset"); p != 19*8+5 {
+		t.Errorf("type severity not applied, priority %d", p)
+	}
+
+	logger.Start()
+	defer logger.Stop()
+	logger.Log(&types.Event{Type: "censor-injection-RST_closing-sequence-overlap", Time: time.Unix(1, 0).UTC()})
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := string(buf[:n])
+	if !strings.HasPrefix(message, "<156>1 1970-01-01T00:00:01Z sensor honeybadger ") {
+		t.Errorf("unexpected syslog header %q", message)
+	}
+	if !strings.Contains(message, " censorship - {\"schema_version\":1") {
+		t.Errorf("unexpected syslog message %q", message)
+	}
+
+	if _, err := NewSyslogAttackLoggerFromOptions(&AttackLoggerOptions{Params: map[string]string{"facility": "bogus"}}); err == nil {
+		t.Error("expected an error for an unknown facility")
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	WEBHOOK_SIGNATURE_HEADER = "X-HoneyBadger-Signature"
+	WEBHOOK_TIMESTAMP_HEADER = "X-HoneyBadger-Timestamp"
+)
+
+// WebhookSignature returns the signature of a webhook request body sent at
+// the given unix timestamp: the hex HMAC-SHA256, keyed by the shared
+// secret, of the timestamp, a dot and the body. Receivers should recompute
+// it and also reject stale timestamps to prevent replays.
+func WebhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, timestamp+".")
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookAttackLogger POSTs each attack report, as AttackReport JSON unless
+// another Format is given, to each of its endpoints. Every endpoint has its own bounded queue so that
+// a slow or failing endpoint does not delay the others; reports arriving
+// at a full queue are dropped and counted. Failed deliveries are retried
+// up to Retries times with exponential backoff.
+type WebhookAttackLogger struct {
+	Secret      []byte
+	Retries     int
+	Backoff     time.Duration
+	Client      *http.Client
+	Format      ReportFormatter
+	ContentType string
+
+	endpoints []*webhookEndpoint
+	wg        sync.WaitGroup
+}
+
+type webhookEndpoint struct {
+	url     string
+	queue   chan []byte
+	dropped int
+}
+
+func init() {
+	AttackLoggerRegister("webhook", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewWebhookAttackLoggerFromOptions(options)
+	})
+}
+
+// NewWebhookAttackLogger returns a pointer to a WebhookAttackLogger struct
+// posting to the given urls with queues of the given size.
+func NewWebhookAttackLogger(urls []string, queue int) *WebhookAttackLogger {
+	w := WebhookAttackLogger{
+		Retries:     5,
+		Backoff:     time.Second,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Format:      FormatJSON,
+		ContentType: reportContentTypes["json"],
+	}
+	for _, url := range urls {
+		w.endpoints = append(w.endpoints, &webhookEndpoint{
+			url:   url,
+			queue: make(chan []byte, queue),
+		})
+	}
+	return &w
+}
+
+// NewWebhookAttackLoggerFromOptions returns a WebhookAttackLogger configured by the
+// backend parameters urls (separated by "|"), secret, queue, retries, backoff, timeout
+// and format, one of the ReportFormats.
+func NewWebhookAttackLoggerFromOptions(options *AttackLoggerOptions) (*WebhookAttackLogger, error) {
+	var urls []string
+	for _, url := range strings.Split(options.Param("urls", ""), "|") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("webhook: no urls given")
+	}
+	queue, err := strconv.Atoi(options.Param("queue", "1000"))
+	if err != nil {
+		return nil, fmt.Errorf("webhook: invalid queue: %s", err)
+	}
+	w := NewWebhookAttackLogger(urls, queue)
+	w.Secret = []byte(options.Param("secret", ""))
+	if w.Retries, err = strconv.Atoi(options.Param("retries", strconv.Itoa(w.Retries))); err != nil {
+		return nil, fmt.Errorf("webhook: invalid retries: %s", err)
+	}
+	if w.Backoff, err = time.ParseDuration(options.Param("backoff", w.Backoff.String())); err != nil {
+		return nil, fmt.Errorf("webhook: invalid backoff: %s", err)
+	}
+	if w.Client.Timeout, err = time.ParseDuration(options.Param("timeout", w.Client.Timeout.String())); err != nil {
+		return nil, fmt.Errorf("webhook: invalid timeout: %s", err)
+	}
+	format := options.Param("format", "json")
+	if w.Format, err = reportFormat(format); err != nil {
+		return nil, fmt.Errorf("webhook: %s", err)
+	}
+	w.ContentType = reportContentTypes[format]
+	return w, nil
+}
+
+func (w *WebhookAttackLogger) Start() {
+	for _, endpoint := range w.endpoints {
+		w.wg.Add(1)
+		go w.deliver(endpoint)
+	}
+}
+
+// Stop delivers the queued reports and returns once they are delivered or given up on.
+func (w *WebhookAttackLogger) Stop() {
+	for _, endpoint := range w.endpoints {
+		close(endpoint.queue)
+	}
+	w.wg.Wait()
+}
+
+func (w *WebhookAttackLogger) Log(event *types.Event) {
+	body, err := w.Format(event)
+	if err != nil {
+		backendWarningf("webhook", "%s\n", err)
+		return
+	}
+	for _, endpoint := range w.endpoints {
+		select {
+		case endpoint.queue <- body:
+		default:
+			endpoint.dropped++
+			if endpoint.dropped == 1 || endpoint.dropped%100 == 0 {
+				backendWarningf("webhook", "queue for %s full, %d reports dropped\n", endpoint.url, endpoint.dropped)
+			}
+		}
+	}
+}
+
+func (w *WebhookAttackLogger) deliver(endpoint *webhookEndpoint) {
+	defer w.wg.Done()
+	for body := range endpoint.queue {
+		backoff := w.Backoff
+		for attempt := 0; ; attempt++ {
+			err := w.post(endpoint.url, body)
+			if err == nil {
+				break
+			}
+			if attempt >= w.Retries {
+				backendWarningf("webhook", "giving up on a report for %s: %s\n", endpoint.url, err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (w *WebhookAttackLogger) post(url string, body []byte) error {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", w.ContentType)
+	if len(w.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(WEBHOOK_TIMESTAMP_HEADER, timestamp)
+		request.Header.Set(WEBHOOK_SIGNATURE_HEADER, WebhookSignature(w.Secret, timestamp, body))
+	}
+	response, err := w.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("status %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestWebhookAttackLogger(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := 0
+	delivered := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		signature := WebhookSignature([]byte("s3cret"), r.Header.Get(WEBHOOK_TIMESTAMP_HEADER), body)
+		if r.Header.Get(WEBHOOK_SIGNATURE_HEADER) != signature {
+			t.Error("invalid webhook signature")
+		}
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered++
+	}))
+	defer server.Close()
+
+	logger, err := NewWebhookAttackLoggerFromOptions(&AttackLoggerOptions{
+		Params: map[string]string{
+			"urls":    server.URL,
+			"secret":  "s3cret",
+			"backoff": "1ms",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Start()
+	logger.Log(testReportEvent())
+	logger.Log(testReportEvent())
+	logger.Stop()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if delivered != 2 || attempts != 3 {
+		t.Errorf("expected 2 reports delivered in 3 attempts, got %d in %d", delivered, attempts)
+	}
+}
+
+func TestWebhookAttackLoggerFormat(t *testing.T) {
+	var mutex sync.Mutex
+	var contentType string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		contentType = r.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	logger, err := NewWebhookAttackLoggerFromOptions(&AttackLoggerOptions{
+		Params: map[string]string{"urls": server.URL, "format": "stix"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Start()
+	logger.Log(testReportEvent())
+	logger.Stop()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if contentType != "application/stix+json;version=2.1" || !bytes.HasPrefix(body, []byte(`{"type":"bundle"`)) {
+		t.Errorf("posted %s %s", contentType, body)
+	}
+	if _, err := NewWebhookAttackLoggerFromOptions(&AttackLoggerOptions{
+		Params: map[string]string{"urls": server.URL, "format": "xml"},
+	}); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
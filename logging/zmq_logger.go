@@ -0,0 +1,322 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// This file holds a ZeroMQ PUB socket speaking ZMTP 3.0 and 3.1 with the
+// NULL security mechanism, for collectors built on zmq SUB sockets.
+
+const (
+	zmqFlagMore    = 0x01
+	zmqFlagLong    = 0x02
+	zmqFlagCommand = 0x04
+)
+
+// zmqGreeting returns the ZMTP 3.0 greeting of a peer using the NULL mechanism.
+func zmqGreeting(asServer bool) []byte {
+	greeting := make([]byte, 64)
+	greeting[0] = 0xff
+	greeting[9] = 0x7f
+	greeting[10] = 3 // major version
+	greeting[11] = 0 // minor version
+	copy(greeting[12:32], "NULL")
+	if asServer {
+		greeting[32] = 1
+	}
+	return greeting
+}
+
+func writeZMQFrame(w io.Writer, flags byte, body []byte) error {
+	var frame []byte
+	if len(body) > 255 {
+		frame = append([]byte{flags | zmqFlagLong}, binary.BigEndian.AppendUint64(nil, uint64(len(body)))...)
+	} else {
+		frame = []byte{flags, byte(len(body))}
+	}
+	_, err := w.Write(append(frame, body...))
+	return err
+}
+
+func readZMQFrame(r *bufio.Reader) (byte, []byte, error) {
+	flags, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var size uint64
+	if flags&zmqFlagLong != 0 {
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(b[:])
+	} else {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		size = uint64(b)
+	}
+	if size > 1024*1024 {
+		return 0, nil, fmt.Errorf("zmq: frame of %d bytes is too large", size)
+	}
+	body := make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	return flags, body, err
+}
+
+// zmqCommand returns the body of a command frame.
+func zmqCommand(name string, properties map[string]string) []byte {
+	body := append([]byte{byte(len(name))}, name...)
+	for key, value := range properties {
+		body = append(body, byte(len(key)))
+		body = append(body, key...)
+		body = binary.BigEndian.AppendUint32(body, uint32(len(value)))
+		body = append(body, value...)
+	}
+	return body
+}
+
+// zmqSubscriber is a connected SUB peer.
+type zmqSubscriber struct {
+	conn     net.Conn
+	mutex    sync.Mutex
+	prefixes map[string]bool
+	queue    chan [2][]byte
+	dropped  int
+}
+
+func (s *zmqSubscriber) subscribed(topic string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for prefix := range s.prefixes {
+		if len(topic) >= len(prefix) && topic[:len(prefix)] == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *zmqSubscriber) subscribe(topic []byte, subscribe bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if subscribe {
+		s.prefixes[string(topic)] = true
+	} else {
+		delete(s.prefixes, string(topic))
+	}
+}
+
+// ZMQAttackLogger is a ZeroMQ PUB socket bound to Address. Each report is
+// sent, rendered by Format, as a two part message of its type, the topic
+// subscribers filter on by prefix, and the formatted report. As with zmq's
+// high water mark, a subscriber more than HighWaterMark messages behind
+// misses messages rather than holding up the others.
+type ZMQAttackLogger struct {
+	Address       string
+	Format        ReportFormatter
+	HighWaterMark int
+
+	listener         net.Listener
+	mutex            sync.Mutex
+	subscribers      map[*zmqSubscriber]bool
+	stopChan         chan bool
+	attackReportChan chan *types.Event
+}
+
+func init() {
+	AttackLoggerRegister("zmq", func(options *AttackLoggerOptions) (AttackLogger, error) {
+		return NewZMQAttackLoggerFromOptions(options)
+	})
+}
+
+// NewZMQAttackLogger returns a pointer to a ZMQAttackLogger struct bound to address.
+func NewZMQAttackLogger(address string) *ZMQAttackLogger {
+	return &ZMQAttackLogger{
+		Address:          address,
+		Format:           FormatProtobuf,
+		HighWaterMark:    1000,
+		subscribers:      make(map[*zmqSubscriber]bool),
+		stopChan:         make(chan bool),
+		attackReportChan: make(chan *types.Event, 1000),
+	}
+}
+
+// NewZMQAttackLoggerFromOptions returns a ZMQAttackLogger configured by the
+// backend parameters bind, format and hwm.
+func NewZMQAttackLoggerFromOptions(options *AttackLoggerOptions) (*ZMQAttackLogger, error) {
+	z := NewZMQAttackLogger(options.Param("bind", "127.0.0.1:5556"))
+	var err error
+	if z.Format, err = reportFormat(options.Param("format", "protobuf")); err != nil {
+		return nil, err
+	}
+	if z.HighWaterMark, err = strconv.Atoi(options.Param("hwm", strconv.Itoa(z.HighWaterMark))); err != nil {
+		return nil, fmt.Errorf("zmq: invalid hwm: %s", err)
+	}
+	return z, nil
+}
+
+func (z *ZMQAttackLogger) Start() {
+	listener, err := net.Listen("tcp", z.Address)
+	if err != nil {
+		backendWarningf("zmq", "%s\n", err)
+	} else {
+		z.listener = listener
+		go z.accept()
+	}
+	go z.receiveReports()
+}
+
+func (z *ZMQAttackLogger) Stop() {
+	z.stopChan <- true
+}
+
+func (z *ZMQAttackLogger) Log(event *types.Event) {
+	z.attackReportChan <- event
+}
+
+func (z *ZMQAttackLogger) receiveReports() {
+	for {
+		select {
+		case <-z.stopChan:
+			if z.listener != nil {
+				z.listener.Close()
+			}
+			z.mutex.Lock()
+			for subscriber := range z.subscribers {
+				subscriber.conn.Close()
+			}
+			z.mutex.Unlock()
+			return
+		case event := <-z.attackReportChan:
+			message, err := z.Format(event)
+			if err != nil {
+				backendWarningf("zmq", "%s\n", err)
+				continue
+			}
+			z.publish(event.Type, message)
+		}
+	}
+}
+
+func (z *ZMQAttackLogger) publish(topic string, message []byte) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	for subscriber := range z.subscribers {
+		if !subscriber.subscribed(topic) {
+			continue
+		}
+		select {
+		case subscriber.queue <- [2][]byte{[]byte(topic), message}:
+		default:
+			subscriber.dropped++
+			if subscriber.dropped == 1 || subscriber.dropped%1000 == 0 {
+				backendWarningf("zmq", "subscriber %s behind, %d messages dropped\n", subscriber.conn.RemoteAddr(), subscriber.dropped)
+			}
+		}
+	}
+}
+
+func (z *ZMQAttackLogger) accept() {
+	for {
+		conn, err := z.listener.Accept()
+		if err != nil {
+			return
+		}
+		go z.serve(conn)
+	}
+}
+
+// serve handshakes with a peer, then sends it the messages it subscribes to
+// while reading its subscriptions.
+func (z *ZMQAttackLogger) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(zmqGreeting(true)); err != nil {
+		return
+	}
+	greeting := make([]byte, 64)
+	if _, err := io.ReadFull(reader, greeting); err != nil || greeting[0] != 0xff || greeting[9] != 0x7f || greeting[10] < 3 {
+		return
+	}
+	if !bytes.HasPrefix(greeting[12:32], []byte("NULL")) {
+		return
+	}
+	if err := writeZMQFrame(conn, zmqFlagCommand, zmqCommand("READY", map[string]string{"Socket-Type": "PUB"})); err != nil {
+		return
+	}
+	flags, ready, err := readZMQFrame(reader)
+	if err != nil || flags&zmqFlagCommand == 0 || !bytes.HasPrefix(ready, []byte("\x05READY")) {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	subscriber := &zmqSubscriber{
+		conn:     conn,
+		prefixes: make(map[string]bool),
+		queue:    make(chan [2][]byte, z.HighWaterMark),
+	}
+	z.mutex.Lock()
+	z.subscribers[subscriber] = true
+	z.mutex.Unlock()
+	defer func() {
+		z.mutex.Lock()
+		delete(z.subscribers, subscriber)
+		z.mutex.Unlock()
+		close(subscriber.queue)
+	}()
+
+	go func() {
+		for message := range subscriber.queue {
+			if writeZMQFrame(conn, zmqFlagMore, message[0]) != nil || writeZMQFrame(conn, 0, message[1]) != nil {
+				conn.Close()
+			}
+		}
+	}()
+	for {
+		flags, body, err := readZMQFrame(reader)
+		if err != nil {
+			return
+		}
+		switch {
+		case flags&zmqFlagCommand != 0 && bytes.HasPrefix(body, []byte("\x09SUBSCRIBE")):
+			// ZMTP 3.1
+			subscriber.subscribe(body[10:], true)
+		case flags&zmqFlagCommand != 0 && bytes.HasPrefix(body, []byte("\x06CANCEL")):
+			subscriber.subscribe(body[7:], false)
+		case flags&zmqFlagCommand == 0 && len(body) > 0:
+			// ZMTP 3.0 subscription messages
+			subscriber.subscribe(body[1:], body[0] == 1)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestZMQAttackLogger(t *testing.T) {
+	logger, err := NewZMQAttackLoggerFromOptions(&AttackLoggerOptions{
+		Params: map[string]string{
+			"bind":   "127.0.0.1:0",
+			"format": "json",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Start()
+	defer logger.Stop()
+
+	conn, err := net.Dial("tcp", logger.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	conn.Write(zmqGreeting(false))
+	greeting := make([]byte, 64)
+	if _, err := io.ReadFull(reader, greeting); err != nil || greeting[32] != 1 {
+		t.Fatalf("bad greeting %x: %v", greeting, err)
+	}
+	writeZMQFrame(conn, zmqFlagCommand, zmqCommand("READY", map[string]string{"Socket-Type": "SUB"}))
+	_, ready, err := readZMQFrame(reader)
+	if err != nil || !bytes.Contains(ready, []byte("PUB")) {
+		t.Fatalf("bad READY %q: %v", ready, err)
+	}
+	writeZMQFrame(conn, 0, []byte("\x01handshake"))
+
+	for i := 0; i < 100; i++ {
+		logger.mutex.Lock()
+		subscribed := false
+		for subscriber := range logger.subscribers {
+			subscribed = subscriber.subscribed("handshake-hijack")
+		}
+		logger.mutex.Unlock()
+		if subscribed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	event := testReportEvent()
+	event.Type = "injection"
+	logger.Log(event)
+	logger.Log(testReportEvent())
+
+	flags, topic, err := readZMQFrame(reader)
+	if err != nil || flags&zmqFlagMore == 0 || string(topic) != "handshake-hijack" {
+		t.Fatalf("got topic %q flags %x: %v", topic, flags, err)
+	}
+	flags, body, err := readZMQFrame(reader)
+	if err != nil || flags != 0 || !bytes.Contains(body, []byte(`"handshake-hijack"`)) {
+		t.Fatalf("got body %q flags %x: %v", body, flags, err)
+	}
+}
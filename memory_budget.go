@@ -0,0 +1,112 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	// Retention policies applied once the global memory budget is exceeded:
+	// evict the oldest pages of the stream being added to,
+	RETENTION_EVICT_OLDEST = 0
+	// retain no further pages until memory has been released,
+	RETENTION_STOP = 1
+	// or drop the connection whose stream data pushed us over the budget.
+	RETENTION_DROP_CONNECTION = 2
+)
+
+// ParseRetentionPolicy returns the retention policy for the given name;
+// one of "evict", "stop" or "drop".
+func ParseRetentionPolicy(name string) (int, error) {
+	switch name {
+	case "evict":
+		return RETENTION_EVICT_OLDEST, nil
+	case "stop":
+		return RETENTION_STOP, nil
+	case "drop":
+		return RETENTION_DROP_CONNECTION, nil
+	}
+	return 0, fmt.Errorf("unknown retention policy %q", name)
+}
+
+// MemoryBudget accounts for the stream bytes retained by all the
+// StreamBuffers sharing it. A nil MemoryBudget imposes no limit.
+type MemoryBudget struct {
+	MaxBytes int64
+	Policy   int
+	used     int64
+}
+
+// NewMemoryBudget returns a MemoryBudget allowing maxBytes of retained
+// stream data, enforced with the given retention policy.
+func NewMemoryBudget(maxBytes int64, policy int) *MemoryBudget {
+	return &MemoryBudget{
+		MaxBytes: maxBytes,
+		Policy:   policy,
+	}
+}
+
+// Used returns the number of bytes currently charged against the budget.
+func (b *MemoryBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.used)
+}
+
+// Exceeded returns true if more bytes are retained than the budget allows.
+func (b *MemoryBudget) Exceeded() bool {
+	if b == nil || b.MaxBytes <= 0 {
+		return false
+	}
+	return b.Used() > b.MaxBytes
+}
+
+func (b *MemoryBudget) charge(n int) {
+	if b == nil {
+		return
+	}
+	atomic.AddInt64(&b.used, int64(n))
+}
+
+func (b *MemoryBudget) release(n int) {
+	b.charge(-n)
+}
+
+// refuse returns true if n more bytes must not be retained.
+func (b *MemoryBudget) refuse(n int) bool {
+	if b == nil || b.MaxBytes <= 0 || b.Policy != RETENTION_STOP {
+		return false
+	}
+	return b.Used()+int64(n) > b.MaxBytes
+}
+
+// mustEvict returns true if retained pages must be evicted.
+func (b *MemoryBudget) mustEvict() bool {
+	return b != nil && b.Policy == RETENTION_EVICT_OLDEST && b.Exceeded()
+}
+
+// mustDrop returns true if a connection retaining further
+// stream data must be dropped.
+func (b *MemoryBudget) mustDrop() bool {
+	return b != nil && b.Policy == RETENTION_DROP_CONNECTION && b.Exceeded()
+}
@@ -0,0 +1,216 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+)
+
+// The memory of the process a MemoryWatermarkOptions ceiling applies to:
+const (
+	// the resident set size, as Linux's /proc/self/statm tells it,
+	MEMORY_RSS = iota
+	// or the bytes of the Go heap in use.
+	MEMORY_HEAP
+)
+
+// The stages of the responses to memory pressure, each applying those
+// of the stages before it:
+const (
+	MEMORY_NORMAL = iota
+	// closing the connections idle for the IdleTimeout,
+	MEMORY_EVICT_IDLE
+	// shrinking the streams retained to MEMORY_SHRINK_PAGES pages,
+	MEMORY_SHRINK_RETENTION
+	// and tracking no new connections.
+	MEMORY_REFUSE_CONNECTIONS
+)
+
+var memoryStageNames = []string{"", "evict-idle", "shrink-retention", "refuse-connections"}
+
+// memoryWatermarks are the fractions of the ceiling each stage is entered at.
+var memoryWatermarks = []float64{0, 0.8, 0.9, 1}
+
+const (
+	// MEMORY_CHECK_INTERVAL is the default interval memory is measured at.
+	MEMORY_CHECK_INTERVAL = time.Second
+	// MEMORY_IDLE_TIMEOUT is the default time connections must have
+	// been idle for to be closed under memory pressure.
+	MEMORY_IDLE_TIMEOUT = 30 * time.Second
+	// MEMORY_SHRINK_PAGES is the number of pages each stream of a
+	// connection retains once retention is shrunk.
+	MEMORY_SHRINK_PAGES = 4
+	// MEMORY_HYSTERESIS is the fraction of the ceiling memory must fall
+	// below a stage's watermark by for the stage to be left.
+	MEMORY_HYSTERESIS = 0.05
+)
+
+// ParseMemorySource returns the memory a ceiling applies to given by
+// name: "rss" or "heap".
+func ParseMemorySource(name string) (int, error) {
+	switch name {
+	case "rss":
+		return MEMORY_RSS, nil
+	case "heap":
+		return MEMORY_HEAP, nil
+	}
+	return 0, fmt.Errorf("unknown memory source %q; rss or heap", name)
+}
+
+// MemoryWatermarkOptions bound the memory of the process to Ceiling bytes,
+// of the Source, MEMORY_RSS or MEMORY_HEAP, measured every Interval, by
+// default MEMORY_CHECK_INTERVAL. Rather than the process being killed
+// once out of memory, mid-incident, the dispatcher responds in stages as
+// memory rises: at 80% of the ceiling it closes the connections idle for
+// IdleTimeout, by default MEMORY_IDLE_TIMEOUT, at 90% it also shrinks the
+// streams of the connections to MEMORY_SHRINK_PAGES pages and at the
+// ceiling it also stops tracking new connections. A stage is left once
+// memory falls MEMORY_HYSTERESIS of the ceiling below its watermark. A
+// Ceiling of zero applies no bound.
+type MemoryWatermarkOptions struct {
+	Ceiling     int64
+	Source      int
+	Interval    time.Duration
+	IdleTimeout time.Duration
+}
+
+// memoryWatermark is the memory pressure stage of the dispatcher.
+// Only stage is read by the workers.
+type memoryWatermark struct {
+	stage int32
+	// usage measures the memory the ceiling applies to; set for tests
+	usage func() (uint64, error)
+}
+
+// MemoryPressure returns the name of the stage of the responses to memory
+// pressure the dispatcher applies, empty if memory is below the watermarks.
+func (i *Dispatcher) MemoryPressure() string {
+	return memoryStageNames[atomic.LoadInt32(&i.watermark.stage)]
+}
+
+// memoryStage returns true if the given stage of the responses to
+// memory pressure is applied.
+func (i *Dispatcher) memoryStage(stage int) bool {
+	return int(atomic.LoadInt32(&i.watermark.stage)) >= stage
+}
+
+// memoryInterval returns the interval memory is measured at,
+// or zero if it is not bounded.
+func (i *Dispatcher) memoryInterval() time.Duration {
+	if i.options.MemoryWatermark.Ceiling <= 0 {
+		return 0
+	}
+	if i.options.MemoryWatermark.Interval > 0 {
+		return i.options.MemoryWatermark.Interval
+	}
+	return MEMORY_CHECK_INTERVAL
+}
+
+// checkMemory measures memory, moves on to the stage of the responses to
+// memory pressure it calls for and applies them. The workers must be paused.
+func (i *Dispatcher) checkMemory() {
+	options := i.options.MemoryWatermark
+	usage := i.watermark.usage
+	if usage == nil {
+		usage = func() (uint64, error) { return memoryUsage(options.Source) }
+	}
+	used, err := usage()
+	if err != nil {
+		logging.Debugf("failed to measure memory: %s", err)
+		return
+	}
+	fraction := float64(used) / float64(options.Ceiling)
+	stage := int(atomic.LoadInt32(&i.watermark.stage))
+	previous := stage
+	for stage < MEMORY_REFUSE_CONNECTIONS && fraction >= memoryWatermarks[stage+1] {
+		stage++
+	}
+	for stage > MEMORY_NORMAL && fraction < memoryWatermarks[stage]-MEMORY_HYSTERESIS {
+		stage--
+	}
+	atomic.StoreInt32(&i.watermark.stage, int32(stage))
+	switch {
+	case stage > previous:
+		logging.Warningf("%d bytes of memory used, %.0f%% of the ceiling; responding to memory pressure by %s", used, 100*fraction, memoryStageNames[stage])
+	case stage < previous && stage == MEMORY_NORMAL:
+		logging.Infof("%d bytes of memory used, %.0f%% of the ceiling; no longer under memory pressure", used, 100*fraction)
+	case stage < previous:
+		logging.Infof("%d bytes of memory used, %.0f%% of the ceiling; easing memory pressure responses to %s", used, 100*fraction, memoryStageNames[stage])
+	}
+
+	if stage >= MEMORY_EVICT_IDLE {
+		idle := options.IdleTimeout
+		if idle <= 0 {
+			idle = MEMORY_IDLE_TIMEOUT
+		}
+		if closed := i.CloseOlderThan(i.captureNow().Add(-idle)); closed != 0 {
+			logging.Infof("memory pressure closed %d idle connections", closed)
+		}
+	}
+	if stage >= MEMORY_SHRINK_RETENTION && previous < MEMORY_SHRINK_RETENTION {
+		i.tracker.Walk(func(conn ConnectionInterface) bool {
+			if shrinkable, ok := conn.(shrinkableConnection); ok {
+				shrinkable.ShrinkStreams(MEMORY_SHRINK_PAGES)
+			}
+			return true
+		})
+	}
+	if stage > previous && options.Source == MEMORY_RSS {
+		// the memory released is only returned to the system lazily
+		debug.FreeOSMemory()
+	}
+}
+
+// shrinkableConnection is a connection whose streams can be shrunk.
+type shrinkableConnection interface {
+	ShrinkStreams(maxPages int)
+}
+
+// memoryUsage returns the bytes of memory of the given source used.
+func memoryUsage(source int) (uint64, error) {
+	if source == MEMORY_HEAP {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return stats.HeapInuse, nil
+	}
+	statm, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("malformed /proc/self/statm %q", statm)
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed /proc/self/statm %q", statm)
+	}
+	return pages * uint64(os.Getpagesize()), nil
+}
@@ -0,0 +1,96 @@
+package HoneyBadger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+func TestParseMemorySource(t *testing.T) {
+	if source, err := ParseMemorySource("heap"); err != nil || source != MEMORY_HEAP {
+		t.Errorf("heap parsed as %d, %v", source, err)
+	}
+	if source, err := ParseMemorySource("rss"); err != nil || source != MEMORY_RSS {
+		t.Errorf("rss parsed as %d, %v", source, err)
+	}
+	if _, err := ParseMemorySource("swap"); err == nil {
+		t.Error("unknown memory source accepted")
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	for _, source := range []int{MEMORY_RSS, MEMORY_HEAP} {
+		used, err := memoryUsage(source)
+		if source == MEMORY_RSS && err != nil {
+			t.Skipf("no /proc/self/statm: %s", err)
+		}
+		if err != nil || used == 0 {
+			t.Errorf("memory source %d measured %d bytes used, %v", source, used, err)
+		}
+	}
+}
+
+func TestDispatcherMemoryWatermark(t *testing.T) {
+	options := DispatcherOptions{
+		MaxRingPackets: 40,
+		MemoryWatermark: MemoryWatermarkOptions{
+			Ceiling:     1000,
+			IdleTimeout: 30 * time.Second,
+		},
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	var used uint64
+	dispatcher.watermark.usage = func() (uint64, error) { return used, nil }
+	check := func(bytes uint64, pressure string) {
+		used = bytes
+		dispatcher.checkMemory()
+		if got := dispatcher.MemoryPressure(); got != pressure {
+			t.Fatalf("%d bytes used: memory pressure %q, expected %q", bytes, got, pressure)
+		}
+	}
+
+	captured := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	dispatch := func(port int, timestamp time.Time) *types.PacketManifest {
+		p := synPacket(port)
+		p.Timestamp = timestamp
+		dispatcher.dispatchPacket(p)
+		return p
+	}
+	dispatch(1000, captured)
+	busy := dispatch(1001, captured.Add(time.Minute))
+
+	check(700, "")
+	if dispatcher.tracker.Len() != 2 {
+		t.Fatalf("%d connections tracked below the watermarks", dispatcher.tracker.Len())
+	}
+	check(850, "evict-idle")
+	if dispatcher.tracker.Len() != 1 {
+		t.Fatalf("%d connections tracked once idle connections are evicted", dispatcher.tracker.Len())
+	}
+
+	check(950, "shrink-retention")
+	conn, _ := dispatcher.connectionFor(busy)
+	if pages := conn.(*Connection).ClientStreamBuffer.MaxPages; pages != MEMORY_SHRINK_PAGES {
+		t.Errorf("streams of a tracked connection retain %d pages", pages)
+	}
+	if pages := dispatcher.setupNewConnection(synPacket(1002).Flow).(*Connection).ClientStreamBuffer.MaxPages; pages != MEMORY_SHRINK_PAGES {
+		t.Errorf("streams of a new connection retain %d pages", pages)
+	}
+
+	check(1000, "refuse-connections")
+	if conn, _ := dispatcher.connectionFor(synPacket(1003)); conn != nil {
+		t.Error("new connection tracked at the memory ceiling")
+	}
+	if conn, _ := dispatcher.connectionFor(busy); conn == nil {
+		t.Error("tracked connection lost at the memory ceiling")
+	}
+
+	// stages are left only once memory falls clear of their watermarks
+	check(960, "refuse-connections")
+	check(940, "shrink-retention")
+	check(100, "")
+	if conn, _ := dispatcher.connectionFor(synPacket(1003)); conn == nil {
+		t.Error("new connection refused once memory pressure eased")
+	}
+}
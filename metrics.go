@@ -0,0 +1,245 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+// MetricsServer is a control plane service serving the sensor's counters
+// and histograms in the Prometheus text exposition format, at /metrics:
+//
+//	honeybadger_packets_total                 the packets dispatched
+//	honeybadger_packets_dropped_total         the packets dropped, by stage:
+//	                                          capture or workers
+//	honeybadger_connections                   the connections tracked, by state
+//	honeybadger_connections_opened_total      the connections opened, closed
+//	honeybadger_connections_closed_total      and evicted since start
+//	honeybadger_connections_evicted_total
+//	honeybadger_attacks_total                 the attacks reported, by type
+//	honeybadger_analysis_errors_total         the connections whose analysis failed
+//	honeybadger_detector_duration_seconds     a histogram of the time calls
+//	                                          into each detector take
+//	honeybadger_log_backend_errors_total      the errors of each attack
+//	                                          logger backend
+//
+// The attacks are those counted by Attacks, which must be one of the
+// pipeline's attack loggers; none are served if it is nil.
+type MetricsServer struct {
+	Addr    string
+	Attacks *logging.RecentAttacks
+
+	dispatcher *Dispatcher
+	supervisor *Supervisor
+	timings    *DetectorTimings
+	server     *http.Server
+}
+
+// NewMetricsServer returns a pointer to a MetricsServer struct which
+// will listen on addr and serve the attacks counted by attacks.
+func NewMetricsServer(addr string, attacks *logging.RecentAttacks) *MetricsServer {
+	return &MetricsServer{
+		Addr:    addr,
+		Attacks: attacks,
+	}
+}
+
+// SetSupervisor hands the server the pipeline whose capture drops it serves.
+func (m *MetricsServer) SetSupervisor(supervisor *Supervisor) {
+	m.supervisor = supervisor
+}
+
+// Start starts timing the detectors of dispatcher and serving; if it
+// fails to listen the error is logged and the metrics are not served.
+func (m *MetricsServer) Start(dispatcher *Dispatcher) {
+	m.dispatcher = dispatcher
+	m.timings = dispatcher.TimeDetectors()
+	listener, err := net.Listen("tcp", m.Addr)
+	if err != nil {
+		logging.Errorf("metrics server disabled: %s", err)
+		return
+	}
+	m.server = &http.Server{Handler: m}
+	go func() {
+		if err := m.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logging.Warningf("metrics server: %s", err)
+		}
+	}()
+}
+
+// Stop closes the listener and the connections of the server's clients.
+func (m *MetricsServer) Stop() {
+	if m.server != nil {
+		m.server.Close()
+	}
+}
+
+func (m *MetricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "only GET requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.metrics())
+}
+
+// sensorMetrics are the metrics of a sensor, as gathered at once for
+// the MetricsServer and the StatsdEmitter.
+type sensorMetrics struct {
+	Packets        uint64
+	CaptureDrops   uint64
+	WorkerDrops    uint64
+	Tracker        ConnTrackerMetrics
+	Attacks        map[string]uint64
+	AnalysisErrors uint64
+	Detectors      map[string]DetectorTiming
+	BackendErrors  map[string]uint64
+}
+
+// gatherMetrics returns the metrics of dispatcher, those of the capture of
+// supervisor if it is set and the attacks counted by attacks if it is set.
+func gatherMetrics(dispatcher *Dispatcher, supervisor *Supervisor, timings *DetectorTimings, attacks *logging.RecentAttacks) *sensorMetrics {
+	metrics := &sensorMetrics{
+		Packets:        dispatcher.Packets(),
+		WorkerDrops:    dispatcher.DroppedPackets(),
+		Tracker:        dispatcher.Metrics(),
+		Attacks:        map[string]uint64{},
+		AnalysisErrors: dispatcher.AnalysisErrors(),
+		Detectors:      timings.Timings(),
+		BackendErrors:  logging.BackendErrors(),
+	}
+	if supervisor != nil {
+		if counter, ok := supervisor.GetSniffer().(types.DropCounter); ok {
+			metrics.CaptureDrops, _ = counter.Drops()
+		}
+	}
+	if attacks != nil {
+		_, metrics.Attacks = attacks.Counts()
+	}
+	return metrics
+}
+
+// metrics returns the metrics of the sensor in the text exposition format.
+func (m *MetricsServer) metrics() []byte {
+	var out metricsWriter
+	metrics := gatherMetrics(m.dispatcher, m.supervisor, m.timings, m.Attacks)
+
+	out.family("honeybadger_packets_total", "counter", "Packets dispatched.")
+	out.sample("honeybadger_packets_total", "", float64(metrics.Packets))
+
+	out.family("honeybadger_packets_dropped_total", "counter", "Packets dropped, by stage.")
+	out.sample("honeybadger_packets_dropped_total", metricLabels("stage", "capture"), float64(metrics.CaptureDrops))
+	out.sample("honeybadger_packets_dropped_total", metricLabels("stage", "workers"), float64(metrics.WorkerDrops))
+
+	tracker := metrics.Tracker
+	out.family("honeybadger_connections", "gauge", "Connections tracked, by state.")
+	for _, state := range sortedKeys(tracker.ByState) {
+		out.sample("honeybadger_connections", metricLabels("state", state), float64(tracker.ByState[state]))
+	}
+	out.family("honeybadger_connections_opened_total", "counter", "Connections opened.")
+	out.sample("honeybadger_connections_opened_total", "", float64(tracker.Opened))
+	out.family("honeybadger_connections_closed_total", "counter", "Connections closed.")
+	out.sample("honeybadger_connections_closed_total", "", float64(tracker.Closed))
+	out.family("honeybadger_connections_evicted_total", "counter", "Connections evicted.")
+	out.sample("honeybadger_connections_evicted_total", "", float64(tracker.Evictions))
+
+	out.family("honeybadger_attacks_total", "counter", "Attacks reported, by type.")
+	for _, attack := range sortedCounts(metrics.Attacks) {
+		out.sample("honeybadger_attacks_total", metricLabels("type", attack), float64(metrics.Attacks[attack]))
+	}
+
+	out.family("honeybadger_analysis_errors_total", "counter", "Connections whose analysis failed.")
+	out.sample("honeybadger_analysis_errors_total", "", float64(metrics.AnalysisErrors))
+
+	out.family("honeybadger_detector_duration_seconds", "histogram", "Time calls into each detector took.")
+	for detector, name := range detectorNames {
+		labels := `detector="` + name + `"`
+		counts := m.timings.histogram(detector)
+		for bucket, bound := range detectorBuckets {
+			le := strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)
+			out.sample("honeybadger_detector_duration_seconds_bucket", "{"+labels+",le=\""+le+"\"}", float64(counts[bucket]))
+		}
+		timing := metrics.Detectors[name]
+		out.sample("honeybadger_detector_duration_seconds_bucket", "{"+labels+",le=\"+Inf\"}", float64(timing.Calls))
+		out.sample("honeybadger_detector_duration_seconds_sum", "{"+labels+"}", timing.Seconds)
+		out.sample("honeybadger_detector_duration_seconds_count", "{"+labels+"}", float64(timing.Calls))
+	}
+
+	out.family("honeybadger_log_backend_errors_total", "counter", "Errors of each attack logger backend.")
+	for _, backend := range sortedCounts(metrics.BackendErrors) {
+		out.sample("honeybadger_log_backend_errors_total", metricLabels("backend", backend), float64(metrics.BackendErrors[backend]))
+	}
+	return out.Bytes()
+}
+
+// metricsWriter writes metric families in the text exposition format.
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+// family writes the help and type lines of the named metric family.
+func (w *metricsWriter) family(name, kind, help string) {
+	w.WriteString("# HELP " + name + " " + help + "\n")
+	w.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// sample writes a sample of the named metric with the given labels,
+// as metricLabels formats them.
+func (w *metricsWriter) sample(name, labels string, value float64) {
+	w.WriteString(name + labels + " " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+// metricLabelEscaper escapes a label value of the text exposition format.
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricLabels formats a single label of a sample.
+func metricLabels(name, value string) string {
+	return "{" + name + "=\"" + metricLabelEscaper.Replace(value) + "\"}"
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedCounts(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,75 @@
+package HoneyBadger
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket/layers"
+)
+
+func TestMetricsServer(t *testing.T) {
+	options := DispatcherOptions{
+		Logger:          NewDummyAttackLogger(),
+		MaxRingPackets:  40,
+		DetectInjection: true,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+	attacks := logging.NewRecentAttacks(1)
+	metrics := NewMetricsServer("127.0.0.1:0", attacks)
+	metrics.Start(dispatcher)
+	defer metrics.Stop()
+
+	_, packet := newTestConnection(options.Logger)
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	dispatcher.ReceivePacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true}, []byte{}))
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{}))
+	dispatcher.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 100, ACK: true}, []byte{1, 2, 3}))
+	dispatcher.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 100, ACK: true}, []byte{1, 2, 3}))
+	attacks.Log(&types.Event{Type: "injection"})
+	attacks.Log(&types.Event{Type: "injection"})
+	attacks.Log(&types.Event{Type: "hijack"})
+
+	// the packets have been analysed once the connections are served
+	dispatcher.LiveConnections()
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != http.StatusOK || !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("GET /metrics: status %d, content type %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"# TYPE honeybadger_packets_total counter",
+		"honeybadger_packets_total 5",
+		`honeybadger_packets_dropped_total{stage="workers"} 0`,
+		`honeybadger_connections{state="data-transfer"} 1`,
+		`honeybadger_attacks_total{type="hijack"} 1`,
+		`honeybadger_attacks_total{type="injection"} 2`,
+		"# TYPE honeybadger_detector_duration_seconds histogram",
+		`honeybadger_detector_duration_seconds_bucket{detector="injection",le="+Inf"} 1`,
+		`honeybadger_detector_duration_seconds_count{detector="injection"} 1`,
+		"# TYPE honeybadger_log_backend_errors_total counter",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics lack %q:\n%s", line, body)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("GET /: status %d", recorder.Code)
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	if labels := metricLabels("backend", "a\"b\\c\nd"); labels != `{backend="a\"b\\c\nd"}` {
+		t.Errorf("labels %s", labels)
+	}
+}
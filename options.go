@@ -0,0 +1,384 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// The defaults of the pipeline built by New, also those of honeyBadger's flags.
+const (
+	DEFAULT_DAQ                        = "libpcap"
+	DEFAULT_INTERFACE                  = "eth0"
+	DEFAULT_SNAPLEN                    = 65536
+	DEFAULT_FILTER                     = "tcp"
+	DEFAULT_WIRE_TIMEOUT               = 3 * time.Second
+	DEFAULT_TCP_IDLE_TIMEOUT           = 10 * time.Minute
+	DEFAULT_BUFFERED_PER_CONNECTION    = 100
+	DEFAULT_BUFFERED_TOTAL             = 1000
+	DEFAULT_MAX_RING_PACKETS           = 40
+	DEFAULT_MAX_CONCURRENT_CONNECTIONS = 300
+)
+
+// AttackLogger is an attack report backend the Supervisor starts and stops;
+// logging.AttackLogger is one.
+type AttackLogger interface {
+	types.Logger
+	Service
+}
+
+// Option configures the pipeline built by New.
+type Option func(*SupervisorOptions) error
+
+// fanoutLogger hands each event to all of its loggers.
+type fanoutLogger []types.Logger
+
+func (f fanoutLogger) Log(event *types.Event) {
+	for _, logger := range f {
+		logger.Log(event)
+	}
+}
+
+// defaultSupervisorOptions returns the SupervisorOptions New starts out with:
+// capture with libpcap on eth0 and detect every kind of attack.
+func defaultSupervisorOptions() SupervisorOptions {
+	return SupervisorOptions{
+		SnifferDriverOptions: &types.SnifferDriverOptions{
+			DAQ:          DEFAULT_DAQ,
+			Device:       DEFAULT_INTERFACE,
+			WireDuration: DEFAULT_WIRE_TIMEOUT,
+			Snaplen:      DEFAULT_SNAPLEN,
+			Filter:       DEFAULT_FILTER,
+		},
+		DispatcherOptions: DispatcherOptions{
+			BufferedPerConnection:    DEFAULT_BUFFERED_PER_CONNECTION,
+			BufferedTotal:            DEFAULT_BUFFERED_TOTAL,
+			TcpIdleTimeout:           DEFAULT_TCP_IDLE_TIMEOUT,
+			MaxRingPackets:           DEFAULT_MAX_RING_PACKETS,
+			MaxConcurrentConnections: DEFAULT_MAX_CONCURRENT_CONNECTIONS,
+			EvictConnections:         true,
+			HijackDetectionPackets:   FIRST_FEW_PACKETS,
+			DetectHijack:             true,
+			DetectInjection:          true,
+			DetectCoalesceInjection:  true,
+		},
+		SnifferFactory:    NewSniffer,
+		ConnectionFactory: &DefaultConnFactory{},
+	}
+}
+
+// New returns a Supervisor of the pipeline configured by the given options,
+// applied in order over the defaults; at least one attack logger must be
+// given with WithAttackLogger.
+func New(opts ...Option) (*Supervisor, error) {
+	options := defaultSupervisorOptions()
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return nil, err
+		}
+	}
+	if options.DispatcherOptions.Logger == nil {
+		return nil, fmt.Errorf("no attack logger given")
+	}
+	driver := options.SnifferDriverOptions
+	if driver.Filename != "" && driver.DAQ != "libpcap" && driver.DAQ != "pcapgo" {
+		return nil, fmt.Errorf("only the pcapgo and libpcap DAQs read pcap files, not %s", driver.DAQ)
+	}
+	if driver.DAQ == "pcapgo" && driver.Filename == "" {
+		return nil, fmt.Errorf("the pcapgo DAQ only reads pcap files")
+	}
+	dispatcher := &options.DispatcherOptions
+	if dispatcher.MaxConcurrentConnections <= 0 {
+		return nil, fmt.Errorf("the maximum number of concurrent connections must be positive")
+	}
+	if dispatcher.BufferedPerConnection == 0 || dispatcher.BufferedTotal == 0 {
+		return nil, fmt.Errorf("packet buffers must not be zero")
+	}
+	if dispatcher.LogPackets && options.PacketLoggerFactory == nil {
+		return nil, fmt.Errorf("packet logging requires a packet logger factory")
+	}
+	return NewSupervisor(options), nil
+}
+
+// WithInterface captures packets on the named network interface.
+func WithInterface(device string) Option {
+	return func(o *SupervisorOptions) error {
+		o.SnifferDriverOptions.Device = device
+		o.SnifferDriverOptions.Filename = ""
+		return nil
+	}
+}
+
+// WithPcapFile reads packets from a pcap file rather than an interface.
+func WithPcapFile(filename string) Option {
+	return func(o *SupervisorOptions) error {
+		o.SnifferDriverOptions.Filename = filename
+		o.SnifferDriverOptions.Device = ""
+		return nil
+	}
+}
+
+// WithPacketFeed has the embedding program feed the packets it captures
+// itself, through the Supervisor's ReceivePacketData or ReceiveManifest,
+// rather than having them captured; they are recorded as seen on the
+// named interface, unless it is empty.
+func WithPacketFeed(iface string) Option {
+	return func(o *SupervisorOptions) error {
+		o.SnifferFactory = NewPacketFeed
+		o.SnifferDriverOptions.Device = iface
+		o.SnifferDriverOptions.Filename = ""
+		return nil
+	}
+}
+
+// WithDAQ selects the Data AcQuisition packet source, one of drivers.Drivers.
+func WithDAQ(daq string) Option {
+	return func(o *SupervisorOptions) error {
+		o.SnifferDriverOptions.DAQ = daq
+		return nil
+	}
+}
+
+// WithCapture sets the BPF filter, snap length and wire read timeout of the capture.
+func WithCapture(filter string, snaplen int, wireTimeout time.Duration) Option {
+	return func(o *SupervisorOptions) error {
+		if snaplen <= 0 || wireTimeout <= 0 {
+			return fmt.Errorf("invalid capture snaplen %d or wire timeout %s", snaplen, wireTimeout)
+		}
+		o.SnifferDriverOptions.Filter = filter
+		o.SnifferDriverOptions.Snaplen = int32(snaplen)
+		o.SnifferDriverOptions.WireDuration = wireTimeout
+		return nil
+	}
+}
+
+// WithBuffers sets the maximum number of out of order packets buffered for
+// one connection and in total before gaps in the streams are skipped over.
+func WithBuffers(perConnection, total int) Option {
+	return func(o *SupervisorOptions) error {
+		if perConnection == 0 || total == 0 {
+			return fmt.Errorf("packet buffers must not be zero")
+		}
+		o.DispatcherOptions.BufferedPerConnection = perConnection
+		o.DispatcherOptions.BufferedTotal = total
+		return nil
+	}
+}
+
+// WithStreamBuffers bounds the stream data kept of each direction of a
+// connection, by pages and payload bytes, and across all connections by
+// payload bytes, applying the retention policy, one of RETENTION_EVICT_OLDEST,
+// RETENTION_STOP or RETENTION_DROP_CONNECTION, once that is exceeded. Zero is unbounded.
+func WithStreamBuffers(packets, bytes, retainedBytes, policy int) Option {
+	return func(o *SupervisorOptions) error {
+		o.DispatcherOptions.MaxRingPackets = packets
+		o.DispatcherOptions.MaxRingBytes = bytes
+		o.DispatcherOptions.MaxRetainedBytes = retainedBytes
+		o.DispatcherOptions.RetentionPolicy = policy
+		return nil
+	}
+}
+
+// WithMaxConnections bounds the connections tracked at once; once there
+// are max the least recently active one is evicted for a new one if evict
+// is set, otherwise new connections are ignored.
+func WithMaxConnections(max int, evict bool) Option {
+	return func(o *SupervisorOptions) error {
+		o.DispatcherOptions.MaxConcurrentConnections = max
+		o.DispatcherOptions.EvictConnections = evict
+		return nil
+	}
+}
+
+// WithTcpIdleTimeout closes connections that have seen no packet for timeout.
+func WithTcpIdleTimeout(timeout time.Duration) Option {
+	return func(o *SupervisorOptions) error {
+		if timeout <= 0 {
+			return fmt.Errorf("invalid tcp idle timeout %s", timeout)
+		}
+		o.DispatcherOptions.TcpIdleTimeout = timeout
+		return nil
+	}
+}
+
+// WithDetectors enables or disables detecting handshake hijacks,
+// injections and ordered coalesce injections.
+func WithDetectors(hijack, injection, coalesceInjection bool) Option {
+	return func(o *SupervisorOptions) error {
+		o.DispatcherOptions.DetectHijack = hijack
+		o.DispatcherOptions.DetectInjection = injection
+		o.DispatcherOptions.DetectCoalesceInjection = coalesceInjection
+		return nil
+	}
+}
+
+// WithHijackDetectionPackets sets for how many packets after a connection's
+// handshake handshake hijacks are looked for, by default FIRST_FEW_PACKETS.
+func WithHijackDetectionPackets(packets int) Option {
+	return func(o *SupervisorOptions) error {
+		if packets <= 0 {
+			return fmt.Errorf("invalid hijack detection packets %d", packets)
+		}
+		o.DispatcherOptions.HijackDetectionPackets = packets
+		return nil
+	}
+}
+
+// WithAttackLogger adds an attack report backend, which the Supervisor
+// starts and stops; reports are sent to every backend added.
+func WithAttackLogger(logger AttackLogger) Option {
+	return func(o *SupervisorOptions) error {
+		switch current := o.DispatcherOptions.Logger.(type) {
+		case nil:
+			o.DispatcherOptions.Logger = logger
+		case fanoutLogger:
+			o.DispatcherOptions.Logger = append(current, logger)
+		default:
+			o.DispatcherOptions.Logger = fanoutLogger{current, logger}
+		}
+		o.Loggers = append(o.Loggers, logger)
+		return nil
+	}
+}
+
+// WithConnectionLogger sends connection events to logger, which, if it is
+// not one of the attack loggers, must be started and stopped by the caller.
+func WithConnectionLogger(logger types.Logger) Option {
+	return func(o *SupervisorOptions) error {
+		o.DispatcherOptions.ConnectionLogger = logger
+		return nil
+	}
+}
+
+// WithLogDirs sets the incoming log dir, where packet logs and spilled
+// streams are written, and the archive dir, where the evidence of
+// attacks is kept.
+func WithLogDirs(logDir, archiveDir string) Option {
+	return func(o *SupervisorOptions) error {
+		o.DispatcherOptions.LogDir = logDir
+		o.DispatcherOptions.ArchiveDir = archiveDir
+		return nil
+	}
+}
+
+// WithPacketLogger logs the packets of every tracked connection
+// with the packet loggers factory builds.
+func WithPacketLogger(factory types.PacketLoggerFactory) Option {
+	return func(o *SupervisorOptions) error {
+		o.PacketLoggerFactory = factory
+		o.DispatcherOptions.LogPackets = factory != nil
+		return nil
+	}
+}
+
+// WithControl adds a control plane service.
+func WithControl(control ControlService) Option {
+	return func(o *SupervisorOptions) error {
+		o.ControlPlane = append(o.ControlPlane, control)
+		return nil
+	}
+}
+
+// WithDispatcherOptions applies fn to the DispatcherOptions, for
+// the settings no other Option covers, such as sampling.
+func WithDispatcherOptions(fn func(*DispatcherOptions)) Option {
+	return func(o *SupervisorOptions) error {
+		fn(&o.DispatcherOptions)
+		return nil
+	}
+}
+
+// WithReload reconfigures the running pipeline with fn on SIGHUP,
+// see SupervisorOptions.OnReload.
+func WithReload(fn func(*Supervisor) error) Option {
+	return func(o *SupervisorOptions) error {
+		o.OnReload = fn
+		return nil
+	}
+}
+
+// WithDumpFile writes the diagnostic dumps of SIGUSR1 to file,
+// see SupervisorOptions.DumpFile.
+func WithDumpFile(file string) Option {
+	return func(o *SupervisorOptions) error {
+		o.DumpFile = file
+		return nil
+	}
+}
+
+// WithOnConnectionOpen calls hook with each connection once it is tracked, see Hooks.
+func WithOnConnectionOpen(hook ConnectionHook) Option {
+	return func(o *SupervisorOptions) error {
+		o.DispatcherOptions.Hooks.OnConnectionOpen = append(o.DispatcherOptions.Hooks.OnConnectionOpen, hook)
+		return nil
+	}
+}
+
+// WithOnConnectionClose calls hook with each connection before it is closed, see Hooks.
+func WithOnConnectionClose(hook ConnectionHook) Option {
+	return func(o *SupervisorOptions) error {
+		o.DispatcherOptions.Hooks.OnConnectionClose = append(o.DispatcherOptions.Hooks.OnConnectionClose, hook)
+		return nil
+	}
+}
+
+// WithOnAttack calls hook with each attack reported before it is logged, see Hooks.
+func WithOnAttack(hook AttackHook) Option {
+	return func(o *SupervisorOptions) error {
+		o.DispatcherOptions.Hooks.OnAttack = append(o.DispatcherOptions.Hooks.OnAttack, hook)
+		return nil
+	}
+}
+
+// WithDetectorPlugin adds an out-of-process detector running command,
+// sent segment events as well if segments is set; see DetectorPlugin.
+func WithDetectorPlugin(name string, segments bool, command ...string) Option {
+	return func(o *SupervisorOptions) error {
+		if len(command) == 0 {
+			return fmt.Errorf("detector plugin %s: no command", name)
+		}
+		o.DispatcherOptions.DetectorPlugins = append(o.DispatcherOptions.DetectorPlugins, &DetectorPlugin{
+			Name:     name,
+			Command:  command,
+			Segments: segments,
+		})
+		return nil
+	}
+}
+
+// WithTenant adds a tenant, an analysis context of its own for
+// the packets matching its rules; see Tenant and TenantRouter.
+func WithTenant(tenant Tenant) Option {
+	return func(o *SupervisorOptions) error {
+		if !tenantNamePattern.MatchString(tenant.Name) {
+			return fmt.Errorf("invalid tenant name %q", tenant.Name)
+		}
+		for _, other := range o.Tenants {
+			if other.Name == tenant.Name {
+				return fmt.Errorf("tenant %s added twice", tenant.Name)
+			}
+		}
+		o.Tenants = append(o.Tenants, tenant)
+		return nil
+	}
+}
@@ -0,0 +1,101 @@
+package HoneyBadger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+type recordedAttackLogger struct {
+	recordedService
+	count int
+}
+
+func (l *recordedAttackLogger) Log(event *types.Event) {
+	l.count += 1
+}
+
+func TestNewDefaults(t *testing.T) {
+	logger := &recordedAttackLogger{recordedService: recordedService{"attacks", &lifecycleRecorder{}}}
+	supervisor, err := New(WithAttackLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := supervisor.dispatcher.options
+	if options.BufferedPerConnection != DEFAULT_BUFFERED_PER_CONNECTION || options.BufferedTotal != DEFAULT_BUFFERED_TOTAL {
+		t.Errorf("buffers %d and %d", options.BufferedPerConnection, options.BufferedTotal)
+	}
+	if options.MaxConcurrentConnections != DEFAULT_MAX_CONCURRENT_CONNECTIONS || !options.EvictConnections {
+		t.Errorf("max connections %d, evict %v", options.MaxConcurrentConnections, options.EvictConnections)
+	}
+	if options.TcpIdleTimeout != DEFAULT_TCP_IDLE_TIMEOUT || options.HijackDetectionPackets != FIRST_FEW_PACKETS {
+		t.Errorf("idle timeout %s, hijack detection packets %d", options.TcpIdleTimeout, options.HijackDetectionPackets)
+	}
+	if !options.DetectHijack || !options.DetectInjection || !options.DetectCoalesceInjection {
+		t.Error("detectors disabled by default")
+	}
+	if options.Logger != logger || len(supervisor.loggers) != 1 {
+		t.Errorf("attack logger %v, loggers %v", options.Logger, supervisor.loggers)
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	recorder := &lifecycleRecorder{}
+	first := &recordedAttackLogger{recordedService: recordedService{"first", recorder}}
+	second := &recordedAttackLogger{recordedService: recordedService{"second", recorder}}
+	supervisor, err := New(
+		WithPcapFile("test.pcap"),
+		WithDAQ("pcapgo"),
+		WithBuffers(10, 20),
+		WithMaxConnections(5, false),
+		WithTcpIdleTimeout(time.Minute),
+		WithDetectors(true, false, false),
+		WithHijackDetectionPackets(7),
+		WithAttackLogger(first),
+		WithAttackLogger(second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := supervisor.dispatcher.options
+	if options.BufferedPerConnection != 10 || options.BufferedTotal != 20 || options.MaxConcurrentConnections != 5 || options.EvictConnections {
+		t.Errorf("unexpected dispatcher options %+v", options)
+	}
+	if options.TcpIdleTimeout != time.Minute || options.DetectInjection || options.DetectCoalesceInjection {
+		t.Errorf("unexpected dispatcher options %+v", options)
+	}
+	options.Logger.Log(&types.Event{})
+	if first.count != 1 || second.count != 1 {
+		t.Errorf("attack loggers logged %d and %d events", first.count, second.count)
+	}
+	if len(supervisor.loggers) != 2 {
+		t.Errorf("%d loggers supervised", len(supervisor.loggers))
+	}
+
+	factory := DefaultConnFactory{}
+	conn := factory.Build(ConnectionOptions{HijackDetectionPackets: options.HijackDetectionPackets}).(*Connection)
+	if conn.skipHijackDetectionCount != 7 {
+		t.Errorf("hijack detection count %d", conn.skipHijackDetectionCount)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	logger := WithAttackLogger(&recordedAttackLogger{recordedService: recordedService{"attacks", &lifecycleRecorder{}}})
+	invalid := [][]Option{
+		{},
+		{logger, WithPcapFile("test.pcap"), WithDAQ("AF_PACKET")},
+		{logger, WithDAQ("pcapgo")},
+		{logger, WithMaxConnections(0, true)},
+		{logger, WithBuffers(0, 10)},
+		{logger, WithTcpIdleTimeout(0)},
+		{logger, WithHijackDetectionPackets(-1)},
+		{logger, WithCapture("tcp", 0, time.Second)},
+		{logger, WithDispatcherOptions(func(o *DispatcherOptions) { o.LogPackets = true })},
+	}
+	for i, opts := range invalid {
+		if _, err := New(opts...); err == nil {
+			t.Errorf("options %d accepted", i)
+		}
+	}
+}
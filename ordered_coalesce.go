@@ -15,9 +15,10 @@
 package HoneyBadger
 
 import (
+	"fmt"
+	"github.com/david415/HoneyBadger/logging"
 	"github.com/david415/HoneyBadger/types"
 	"github.com/google/gopacket/layers"
-	"log"
 	"time"
 )
 
@@ -31,6 +32,7 @@ const memLog = true // XXX get rid of me later...
 // an OrderedCoalesce.
 type page struct {
 	types.Reassembly
+	fin        bool
 	index      int
 	prev, next *page
 	buf        [pageBytes]byte
@@ -66,7 +68,7 @@ func (c *pageCache) grow() {
 		c.free = append(c.free, &pages[i])
 	}
 	if memLog {
-		log.Println("PageCache: created", c.pcSize, "new pages")
+		logging.Debugf("PageCache: created %d new pages", c.pcSize)
 	}
 	c.pcSize *= 2
 }
@@ -76,7 +78,7 @@ func (c *pageCache) next(ts time.Time) (p *page) {
 	if memLog {
 		c.pageRequests++
 		if c.pageRequests&0xFFFF == 0 {
-			log.Println("PageCache:", c.pageRequests, "requested,", c.used, "used,", len(c.free), "free")
+			logging.Debugf("PageCache: %d requested, %d used, %d free", c.pageRequests, c.used, len(c.free))
 		}
 	}
 	if len(c.free) == 0 {
@@ -86,8 +88,11 @@ func (c *pageCache) next(ts time.Time) (p *page) {
 	p, c.free = c.free[i], c.free[:i]
 	p.prev = nil
 	p.next = nil
-	p.Seen = ts
-	p.Bytes = p.buf[:0]
+	p.fin = false
+	p.Reassembly = types.Reassembly{
+		Bytes: p.buf[:0],
+		Seen:  ts,
+	}
 	c.used++
 	return p
 }
@@ -131,22 +136,24 @@ type OrderedCoalesce struct {
 	MaxBufferedPagesPerFlow int
 
 	Flow                    *types.TcpIpFlow
-	StreamRing              *types.Ring
+	Stream                  *StreamBuffer
 	log                     types.Logger
 	pageCount               int
 	PageCache               *pageCache
 	first, last             *page
 	DetectCoalesceInjection bool
 	attackDetected          *bool
+	analysisError           func(error)
+	Timings                 *DetectorTimings
 }
 
-func NewOrderedCoalesce(logger types.Logger, flow *types.TcpIpFlow, pageCache *pageCache, streamRing *types.Ring, maxBufferedPagesTotal, maxBufferedPagesPerFlow int, DetectCoalesceInjection bool, attackDetected *bool) *OrderedCoalesce {
+func NewOrderedCoalesce(logger types.Logger, flow *types.TcpIpFlow, pageCache *pageCache, stream *StreamBuffer, maxBufferedPagesTotal, maxBufferedPagesPerFlow int, DetectCoalesceInjection bool, attackDetected *bool) *OrderedCoalesce {
 	return &OrderedCoalesce{
 		attackDetected: attackDetected,
 		log:            logger,
 		Flow:           flow,
 		PageCache:      pageCache,
-		StreamRing:     streamRing,
+		Stream:         stream,
 
 		MaxBufferedPagesTotal:   maxBufferedPagesTotal,
 		MaxBufferedPagesPerFlow: maxBufferedPagesPerFlow,
@@ -161,17 +168,20 @@ func (o *OrderedCoalesce) Close() {
 	}
 }
 
-func (o *OrderedCoalesce) insert(packetManifest *types.PacketManifest, nextSeq types.Sequence) (types.Sequence, bool) {
+// insert buffers an out-of-order packet. It returns the next Sequence, whether
+// the end of the connection was detected and an error if the buffered pages are
+// inconsistent; the packet is then not buffered.
+func (o *OrderedCoalesce) insert(packetManifest *types.PacketManifest, nextSeq types.Sequence) (types.Sequence, bool, error) {
 	isEnd := false
 	if o.first != nil && o.first.Seq == nextSeq {
-		panic("wtf")
+		return nextSeq, false, fmt.Errorf("OrderedCoalesce.insert first buffered page is at the next sequence %d", nextSeq)
 	}
 	// XXX for now we ignore zero size packets
 	if len(packetManifest.Payload) == 0 {
-		return nextSeq, false
+		return nextSeq, false, nil
 	}
 	if o.pageCount < 0 {
-		panic("OrderedCoalesce.insert pageCount less than zero")
+		return nextSeq, false, fmt.Errorf("OrderedCoalesce.insert pageCount %d less than zero", o.pageCount)
 	}
 	// XXX todo: handle out of order FIN and RST packets
 	p, p2, pcount := o.pagesFromTcp(packetManifest)
@@ -180,19 +190,16 @@ func (o *OrderedCoalesce) insert(packetManifest *types.PacketManifest, nextSeq t
 	o.pageCount += pcount
 	if (o.MaxBufferedPagesPerFlow > 0 && o.pageCount >= o.MaxBufferedPagesPerFlow) ||
 		(o.MaxBufferedPagesTotal > 0 && o.PageCache.used >= o.MaxBufferedPagesTotal) {
-		if o.pageCount < 0 {
-			panic("OrderedCoalesce.insert pageCount less than zero")
-		}
 		nextSeq, isEnd = o.flushUntilThreshold(nextSeq)
 	}
-	return nextSeq, isEnd
+	return nextSeq, isEnd, nil
 }
 
 // flushUntilThreshold will flush our cache until either we are within the threshold OR
 // our cache is empty.
 func (o *OrderedCoalesce) flushUntilThreshold(nextSeq types.Sequence) (types.Sequence, bool) {
 	isEnd := false
-	for o.first != nil && o.pageCount >= o.MaxBufferedPagesPerFlow || o.PageCache.used >= o.MaxBufferedPagesTotal {
+	for o.first != nil && (o.pageCount >= o.MaxBufferedPagesPerFlow || o.PageCache.used >= o.MaxBufferedPagesTotal) {
 		nextSeq, isEnd = o.addNext(nextSeq)
 		if isEnd {
 			break
@@ -230,6 +237,7 @@ func (o *OrderedCoalesce) pagesFromTcp(p *types.PacketManifest) (*page, *page, i
 		current = current.next
 	}
 	current.End = p.TCP.RST || p.TCP.FIN
+	current.fin = p.TCP.FIN
 	return first, current, count
 }
 
@@ -302,19 +310,13 @@ func (o *OrderedCoalesce) addNext(nextSeq types.Sequence) (types.Sequence, bool)
 	} else if diff > 0 {
 		o.first.Skip = int(diff)
 	}
-	if o.first.End {
-		o.freeNext()
-		return -1, true // after closing the connection our Sequence return value doesn't matter
-	}
 	if len(o.first.Bytes) == 0 {
-		o.freeNext()
-		return nextSeq, false
+		return o.freeEnd(nextSeq, o.first.Seq == nextSeq)
 	}
 	// ensure we do not add segments that end before nextSeq
 	diff = o.first.Seq.Add(len(o.first.Bytes)).Difference(nextSeq)
 	if diff > 0 {
-		o.freeNext()
-		return nextSeq, false
+		return o.freeEnd(nextSeq, false)
 	}
 	if o.DetectCoalesceInjection && len(o.first.Bytes) > 0 {
 		// XXX stream segment overlap condition
@@ -328,21 +330,22 @@ func (o *OrderedCoalesce) addNext(nextSeq types.Sequence) (types.Sequence, bool)
 			}
 			start := types.Sequence(p.TCP.Seq)
 			end := types.Sequence(p.TCP.Seq).Add(len(p.Payload))
-			events := checkForInjectionInRing(o.StreamRing, start, end, p.Payload)
+			started := o.Timings.start()
+			events, err := checkForInjection(o.Stream, start, end, p.Payload)
+			o.Timings.done(DETECTOR_COALESCE_INJECTION, started)
+			if err != nil && o.analysisError != nil {
+				o.analysisError(err)
+			}
 
 			// log events if any
 			for i := 0; i < len(events); i++ {
-				if events[i] == nil {
-					panic("wtf got nil event")
-				} else {
-					*o.attackDetected = true
-					events[i].Type = "ordered coalesce 1"
-					events[i].Time = o.first.Seen
-					events[i].Base = o.first.Seq
-					events[i].Flow = *o.Flow
-					log.Print("detected an ordered coalesce injection\n")
-					o.log.Log(events[i])
-				}
+				*o.attackDetected = true
+				events[i].Type = "ordered coalesce 1"
+				events[i].Time = o.first.Seen
+				events[i].Base = o.first.Seq
+				events[i].Flow = *o.Flow
+				logging.Logf(logging.LOG_INFO, &logging.LogFields{Flow: o.Flow, Detector: "coalesce"}, "detected an ordered coalesce injection")
+				o.log.Log(events[i])
 			}
 
 		}
@@ -351,15 +354,29 @@ func (o *OrderedCoalesce) addNext(nextSeq types.Sequence) (types.Sequence, bool)
 	if bytes != nil {
 		o.first.Bytes = bytes
 		nextSeq = seq
-		// append reassembly to the reassembly ring buffer
+		// append reassembly to the stream buffer
 		if len(o.first.Bytes) > 0 {
-			o.StreamRing.Reassembly = &o.first.Reassembly
-			o.StreamRing.Reassembly.IsCoalesce = true
-			o.StreamRing = o.StreamRing.Next()
+			// the page is about to be returned to the page cache;
+			// the stream buffer keeps its own copy of the segment
+			reassembly := o.first.Reassembly
+			reassembly.IsCoalesce = true
+			o.Stream.Add(&reassembly)
 		}
 	}
+	return o.freeEnd(nextSeq, bytes != nil)
+}
+
+// freeEnd frees the first page once its payload has been added to the
+// stream and returns the next Sequence and whether the page ended the
+// connection. A FIN found at nextSeq, following whatever payload it
+// carried, consumes a sequence number.
+func (o *OrderedCoalesce) freeEnd(nextSeq types.Sequence, finAtNextSeq bool) (types.Sequence, bool) {
+	isEnd, fin := o.first.End, o.first.fin
 	o.freeNext()
-	return nextSeq, false
+	if fin && finAtNextSeq && nextSeq != types.InvalidSequence {
+		nextSeq = nextSeq.Add(1)
+	}
+	return nextSeq, isEnd
 }
 
 // addContiguous adds contiguous byte-sets to a connection.
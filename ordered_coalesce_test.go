@@ -12,7 +12,7 @@ import (
 func TestOrderedCoalesceUsedPages(t *testing.T) {
 	maxBufferedPagesTotal := 1024
 	maxBufferedPagesPerFlow := 1024
-	streamRing := types.NewRing(40)
+	stream := NewStreamBuffer(40, 0)
 	PageCache := newPageCache()
 
 	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.IPv4(1, 2, 3, 4)), layers.NewIPEndpoint(net.IPv4(2, 3, 4, 5)))
@@ -21,7 +21,7 @@ func TestOrderedCoalesceUsedPages(t *testing.T) {
 
 	var nextSeq types.Sequence = types.Sequence(1)
 	attackDetected := false
-	coalesce := NewOrderedCoalesce(nil, &flow, PageCache, streamRing, maxBufferedPagesTotal, maxBufferedPagesPerFlow, false, &attackDetected)
+	coalesce := NewOrderedCoalesce(nil, &flow, PageCache, stream, maxBufferedPagesTotal, maxBufferedPagesPerFlow, false, &attackDetected)
 
 	ip := layers.IPv4{
 		SrcIP:    net.IP{1, 2, 3, 4},
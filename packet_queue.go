@@ -0,0 +1,211 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"sync/atomic"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// packetQueue is a fixed size ring of packets handed from a single producer
+// goroutine to a single consumer goroutine without locking; producers may
+// take turns if they are serialized by a lock of their own. Packets pushed
+// while the ring is full are dropped and counted as overflows, unless the
+// producer waits for room. Either side may wait for the other: the producer
+// for room, the consumer for a packet, being woken only if it is waiting.
+type packetQueue struct {
+	// head is written by the consumer only and tail by the producer
+	// only; they are kept apart so as not to share a cache line
+	head      uint64
+	_         [56]byte
+	tail      uint64
+	_         [56]byte
+	overflows uint64
+	closed    int32
+	woken     int32
+	// set while the consumer waits for a packet or the producer for room
+	consumerWaiting int32
+	producerWaiting int32
+	ready           chan struct{}
+	room            chan struct{}
+	slots           []*types.PacketManifest
+	mask            uint64
+}
+
+// newPacketQueue returns a packetQueue of size packets,
+// rounded up to a power of two.
+func newPacketQueue(size int) *packetQueue {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	return &packetQueue{
+		ready: make(chan struct{}, 1),
+		room:  make(chan struct{}, 1),
+		slots: make([]*types.PacketManifest, n),
+		mask:  uint64(n - 1),
+	}
+}
+
+// Len returns the number of packets queued.
+func (q *packetQueue) Len() int {
+	return int(atomic.LoadUint64(&q.tail) - atomic.LoadUint64(&q.head))
+}
+
+// Overflows returns the number of packets dropped as the queue was full.
+func (q *packetQueue) Overflows() uint64 {
+	return atomic.LoadUint64(&q.overflows)
+}
+
+// push queues as many of packets as there is room for, at once,
+// and returns how many it queued.
+func (q *packetQueue) push(packets []*types.PacketManifest) int {
+	tail := atomic.LoadUint64(&q.tail)
+	room := uint64(len(q.slots)) - (tail - atomic.LoadUint64(&q.head))
+	n := len(packets)
+	if uint64(n) > room {
+		n = int(room)
+	}
+	if n == 0 {
+		return 0
+	}
+	for j, p := range packets[:n] {
+		q.slots[(tail+uint64(j))&q.mask] = p
+	}
+	atomic.StoreUint64(&q.tail, tail+uint64(n))
+	wake(&q.consumerWaiting, q.ready)
+	return n
+}
+
+// Push queues a packet, or drops and counts it if the queue is full.
+// It returns false if the packet was dropped.
+func (q *packetQueue) Push(p *types.PacketManifest) bool {
+	return q.PushBatch([]*types.PacketManifest{p}) == 1
+}
+
+// PushBatch queues a batch of packets, dropping and counting those there
+// is no room for, the last of the batch, and returns how many it queued.
+func (q *packetQueue) PushBatch(packets []*types.PacketManifest) int {
+	n := q.push(packets)
+	if n < len(packets) {
+		atomic.AddUint64(&q.overflows, uint64(len(packets)-n))
+	}
+	return n
+}
+
+// PushWait queues a packet, waiting for room if the queue is full until
+// done is closed. It returns false if the packet was not queued.
+func (q *packetQueue) PushWait(p *types.PacketManifest, done <-chan struct{}) bool {
+	return q.PushBatchWait([]*types.PacketManifest{p}, done) == 1
+}
+
+// PushBatchWait queues a batch of packets, waiting for room whenever the
+// queue is full until done is closed, and returns how many it queued.
+func (q *packetQueue) PushBatchWait(packets []*types.PacketManifest, done <-chan struct{}) int {
+	queued := q.push(packets)
+	for queued < len(packets) {
+		atomic.StoreInt32(&q.producerWaiting, 1)
+		if n := q.push(packets[queued:]); n != 0 {
+			atomic.StoreInt32(&q.producerWaiting, 0)
+			queued += n
+			continue
+		}
+		select {
+		case <-q.room:
+		case <-done:
+			atomic.StoreInt32(&q.producerWaiting, 0)
+			return queued
+		}
+	}
+	return queued
+}
+
+// Pop returns the next packet queued, if there is one.
+func (q *packetQueue) Pop() (*types.PacketManifest, bool) {
+	var packets [1]*types.PacketManifest
+	if q.PopBatch(packets[:]) == 0 {
+		return nil, false
+	}
+	return packets[0], true
+}
+
+// PopBatch pops as many of the packets queued as fit in packets, at
+// once, and returns how many it popped.
+func (q *packetQueue) PopBatch(packets []*types.PacketManifest) int {
+	head := atomic.LoadUint64(&q.head)
+	n := int(atomic.LoadUint64(&q.tail) - head)
+	if n > len(packets) {
+		n = len(packets)
+	}
+	if n == 0 {
+		return 0
+	}
+	for j := range packets[:n] {
+		slot := (head + uint64(j)) & q.mask
+		packets[j] = q.slots[slot]
+		q.slots[slot] = nil
+	}
+	atomic.StoreUint64(&q.head, head+uint64(n))
+	wake(&q.producerWaiting, q.room)
+	return n
+}
+
+// Wait waits until a packet is queued, the queue is closed or Wake is
+// called; the consumer then checks which, as it may wake up spuriously.
+func (q *packetQueue) Wait() {
+	atomic.StoreInt32(&q.consumerWaiting, 1)
+	if q.Len() > 0 || q.Closed() || atomic.SwapInt32(&q.woken, 0) != 0 {
+		atomic.StoreInt32(&q.consumerWaiting, 0)
+		return
+	}
+	<-q.ready
+	atomic.StoreInt32(&q.woken, 0)
+}
+
+// Wake wakes the consumer if it is waiting, or keeps it from
+// waiting next time if it is not.
+func (q *packetQueue) Wake() {
+	atomic.StoreInt32(&q.woken, 1)
+	wake(&q.consumerWaiting, q.ready)
+}
+
+// Closed returns true once the queue has been closed.
+func (q *packetQueue) Closed() bool {
+	return atomic.LoadInt32(&q.closed) != 0
+}
+
+// Close tells the consumer no more packets are to be queued;
+// it goes on popping those already queued.
+func (q *packetQueue) Close() {
+	atomic.StoreInt32(&q.closed, 1)
+	wake(&q.consumerWaiting, q.ready)
+}
+
+// wake wakes the side of a queue waiting on ch, if it is waiting;
+// a wake up it misses as it stopped waiting is left in ch.
+func wake(waiting *int32, ch chan struct{}) {
+	if atomic.CompareAndSwapInt32(waiting, 1, 0) {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package HoneyBadger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+func TestPacketQueue(t *testing.T) {
+	q := newPacketQueue(3)
+	if len(q.slots) != 4 {
+		t.Fatalf("queue of %d slots, expected 4", len(q.slots))
+	}
+	packets := make([]*types.PacketManifest, 5)
+	for n := range packets {
+		packets[n] = &types.PacketManifest{}
+		q.Push(packets[n])
+	}
+	if q.Len() != 4 || q.Overflows() != 1 {
+		t.Errorf("%d packets queued, %d overflows", q.Len(), q.Overflows())
+	}
+	for n := 0; n < 4; n++ {
+		if p, ok := q.Pop(); !ok || p != packets[n] {
+			t.Fatalf("packet %d not popped in order", n)
+		}
+	}
+	if _, ok := q.Pop(); ok {
+		t.Error("packet popped off an empty queue")
+	}
+
+	// a consumer waiting is woken once a packet is queued
+	done := make(chan bool)
+	go func() {
+		q.Wait()
+		done <- true
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.Push(packets[0])
+	<-done
+	q.Pop()
+	q.Wake()
+	q.Wait()
+	q.Close()
+	q.Wait()
+	if !q.Closed() {
+		t.Error("queue not closed")
+	}
+}
+
+func TestPacketQueuePushWait(t *testing.T) {
+	q := newPacketQueue(1)
+	stop := make(chan struct{})
+	const count = 1000
+	go func() {
+		for n := 0; n < count; n++ {
+			if !q.PushWait(&types.PacketManifest{Payload: []byte{byte(n)}}, stop) {
+				t.Error("packet not queued")
+			}
+		}
+		q.Close()
+	}()
+	received := 0
+	for {
+		p, ok := q.Pop()
+		if !ok {
+			if q.Closed() && q.Len() == 0 {
+				break
+			}
+			q.Wait()
+			continue
+		}
+		if p.Payload[0] != byte(received) {
+			t.Fatalf("packet %d received out of order", received)
+		}
+		received++
+	}
+	if received != count || q.Overflows() != 0 {
+		t.Errorf("%d packets received, %d overflows", received, q.Overflows())
+	}
+
+	q = newPacketQueue(1)
+	q.Push(&types.PacketManifest{})
+	close(stop)
+	if q.PushWait(&types.PacketManifest{}, stop) {
+		t.Error("packet queued into a full queue")
+	}
+}
@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// rawSocketInjector sends IP packets, headers included,
+// over raw IPv4 and IPv6 sockets.
+type rawSocketInjector struct {
+	ipv4 int
+	ipv6 int
+}
+
+// NewRawSocketInjector returns a PacketInjector sending IP packets over
+// raw sockets, which requires root or the CAP_NET_RAW capability.
+func NewRawSocketInjector() (PacketInjector, error) {
+	ipv4, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raw IPv4 socket: %s", err)
+	}
+	ipv6, err := unix.Socket(unix.AF_INET6, unix.SOCK_RAW, unix.IPPROTO_RAW)
+	if err != nil {
+		unix.Close(ipv4)
+		return nil, fmt.Errorf("failed to open raw IPv6 socket: %s", err)
+	}
+	return &rawSocketInjector{ipv4: ipv4, ipv6: ipv6}, nil
+}
+
+func (r *rawSocketInjector) Inject(packet []byte, dst net.IP) error {
+	if ip := dst.To4(); ip != nil {
+		addr := unix.SockaddrInet4{}
+		copy(addr.Addr[:], ip)
+		return unix.Sendto(r.ipv4, packet, 0, &addr)
+	}
+	addr := unix.SockaddrInet6{}
+	copy(addr.Addr[:], dst.To16())
+	return unix.Sendto(r.ipv6, packet, 0, &addr)
+}
+
+func (r *rawSocketInjector) Close() error {
+	unix.Close(r.ipv6)
+	return unix.Close(r.ipv4)
+}
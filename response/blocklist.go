@@ -0,0 +1,292 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package response contains the attack logger backends which respond to
+// attacks to contain them, rather than report them.
+package response
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// BLOCKLIST_TIMEOUT is the default time an element stays in a blocklist.
+	BLOCKLIST_TIMEOUT = time.Hour
+	// BLOCKLIST_QUEUE is the default number of blocklist commands queued.
+	BLOCKLIST_QUEUE = 1000
+)
+
+// Blocklist adds the flow of each attack reported of at least the
+// Confidence, by default high, to a named set of the host's packet filter
+// with a Timeout, so that an inline sensor's firewall drops the further
+// packets of the attacked connection. Unless Flows is set, the suspected
+// injector, the source of the packet the attack was detected in, is added
+// instead. An off-path injector spoofs that source, the address of the
+// legitimate peer, so adding sources lets an attacker have any host whose
+// packets it can forge blocked; sources are only added with Exempt
+// networks, such as those of the monitored servers and their known peers,
+// whose sources are never added. Reports of the sensor's own state, such
+// as those of dropped packets or torn down connections, are not responded
+// to.
+//
+// The commands adding elements are run in turn from a bounded queue so that
+// a slow packet filter does not hold up the connections reporting attacks;
+// commands arriving at a full queue are dropped and counted. An element is
+// added once until its timeout elapses.
+type Blocklist struct {
+	Name       string
+	Confidence string
+	Timeout    time.Duration
+	Flows      bool
+	Exempt     []*net.IPNet
+
+	// Command returns the command adding an element to the set for IPv4,
+	// or for IPv6, with the given timeout, or nil if there is no such set.
+	Command func(element string, ipv6 bool, timeout time.Duration) []string
+	// Element returns the set element of a reported flow if flow is
+	// set, or else of its source.
+	Element func(report *logging.ReportFlow, flow bool) string
+	// Run runs a command, by default with os/exec.
+	Run func(command []string) error
+
+	now     func() time.Time
+	mutex   sync.Mutex
+	added   map[string]time.Time
+	queue   chan []string
+	dropped int
+	wg      sync.WaitGroup
+}
+
+func init() {
+	logging.AttackLoggerRegister("nftables", func(options *logging.AttackLoggerOptions) (logging.AttackLogger, error) {
+		return NewNftablesBlocklistFromOptions(options)
+	})
+	logging.AttackLoggerRegister("ipset", func(options *logging.AttackLoggerOptions) (logging.AttackLogger, error) {
+		return NewIpsetBlocklistFromOptions(options)
+	})
+}
+
+// newBlocklistFromOptions returns a Blocklist configured by the backend
+// parameters common to the packet filters: confidence, timeout, mode (flow,
+// the default, or source, which requires exempt), exempt (networks
+// separated by "|") and queue.
+func newBlocklistFromOptions(name string, options *logging.AttackLoggerOptions) (*Blocklist, error) {
+	b := Blocklist{
+		Name:  name,
+		Run:   runCommand,
+		now:   time.Now,
+		added: make(map[string]time.Time),
+	}
+	var err error
+	if b.Confidence, err = logging.ParseConfidence(options.Param("confidence", "high")); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	if b.Timeout, err = time.ParseDuration(options.Param("timeout", BLOCKLIST_TIMEOUT.String())); err != nil {
+		return nil, fmt.Errorf("%s: invalid timeout: %s", name, err)
+	}
+	if b.Timeout < time.Second {
+		return nil, fmt.Errorf("%s: timeout %s shorter than a second", name, b.Timeout)
+	}
+	mode := options.Param("mode", "flow")
+	switch mode {
+	case "source":
+	case "flow":
+		b.Flows = true
+	default:
+		return nil, fmt.Errorf("%s: unknown mode %q; flow or source", name, mode)
+	}
+	for _, cidr := range strings.Split(options.Param("exempt", ""), "|") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid exempt network: %s", name, err)
+		}
+		b.Exempt = append(b.Exempt, network)
+	}
+	if !b.Flows && len(b.Exempt) == 0 {
+		return nil, fmt.Errorf("%s: mode source blocks the spoofed sources of injections; it requires exempt", name)
+	}
+	queue, err := strconv.Atoi(options.Param("queue", strconv.Itoa(BLOCKLIST_QUEUE)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid queue: %s", name, err)
+	}
+	b.queue = make(chan []string, queue)
+	return &b, nil
+}
+
+// NewNftablesBlocklistFromOptions returns a Blocklist adding to the nftables
+// sets named by the backend parameters set and set6, for IPv4 and IPv6, of
+// the table, by default "inet filter". In flow mode the sets are
+// concatenations of the source address and port and the destination
+// address and port, such as ipv4_addr . inet_service . ipv4_addr .
+// inet_service; in source mode they are of type ipv4_addr or ipv6_addr. The sets need the
+// timeout flag. The common parameters are those of newBlocklistFromOptions.
+func NewNftablesBlocklistFromOptions(options *logging.AttackLoggerOptions) (*Blocklist, error) {
+	b, err := newBlocklistFromOptions("nftables", options)
+	if err != nil {
+		return nil, err
+	}
+	table := strings.Fields(options.Param("table", "inet filter"))
+	sets := [2]string{options.Param("set", ""), options.Param("set6", "")}
+	if sets[0] == "" && sets[1] == "" {
+		return nil, fmt.Errorf("nftables: no set given")
+	}
+	b.Command = func(element string, ipv6 bool, timeout time.Duration) []string {
+		set := sets[0]
+		if ipv6 {
+			set = sets[1]
+		}
+		if set == "" {
+			return nil
+		}
+		command := append([]string{"nft", "add", "element"}, table...)
+		return append(command, set, "{", element, "timeout", fmt.Sprintf("%ds", int(timeout.Seconds())), "}")
+	}
+	b.Element = func(report *logging.ReportFlow, flow bool) string {
+		if !flow {
+			return report.SrcIP
+		}
+		return fmt.Sprintf("%s . %d . %s . %d", report.SrcIP, report.SrcPort, report.DstIP, report.DstPort)
+	}
+	return b, nil
+}
+
+// NewIpsetBlocklistFromOptions returns a Blocklist adding to the ipsets named
+// by the backend parameters set and set6, for IPv4 and IPv6. In flow mode
+// the ipsets are of type hash:ip,port,ip, holding the source address and
+// port and the destination address of the flows; in source mode they are
+// of type hash:ip. The ipsets need the timeout option. The common
+// parameters are those of newBlocklistFromOptions.
+func NewIpsetBlocklistFromOptions(options *logging.AttackLoggerOptions) (*Blocklist, error) {
+	b, err := newBlocklistFromOptions("ipset", options)
+	if err != nil {
+		return nil, err
+	}
+	sets := [2]string{options.Param("set", ""), options.Param("set6", "")}
+	if sets[0] == "" && sets[1] == "" {
+		return nil, fmt.Errorf("ipset: no set given")
+	}
+	b.Command = func(element string, ipv6 bool, timeout time.Duration) []string {
+		set := sets[0]
+		if ipv6 {
+			set = sets[1]
+		}
+		if set == "" {
+			return nil
+		}
+		return []string{"ipset", "-exist", "add", set, element, "timeout", strconv.Itoa(int(timeout.Seconds()))}
+	}
+	b.Element = func(report *logging.ReportFlow, flow bool) string {
+		if !flow {
+			return report.SrcIP
+		}
+		return fmt.Sprintf("%s,tcp:%d,%s", report.SrcIP, report.SrcPort, report.DstIP)
+	}
+	return b, nil
+}
+
+func (b *Blocklist) Start() {
+	b.wg.Add(1)
+	go b.runQueued()
+}
+
+// Stop runs the queued commands and returns once they are run.
+func (b *Blocklist) Stop() {
+	close(b.queue)
+	b.wg.Wait()
+}
+
+func (b *Blocklist) Log(event *types.Event) {
+	if strings.HasPrefix(event.Type, "sensor-") || strings.HasPrefix(event.Type, "connection-") {
+		return
+	}
+	if !logging.Confident(event.Type, b.Confidence) {
+		return
+	}
+	report := logging.NewAttackReport(event).Flow
+	source := net.ParseIP(report.SrcIP)
+	if source == nil || b.exempt(source) {
+		return
+	}
+	element := b.Element(&report, b.Flows)
+	command := b.Command(element, source.To4() == nil, b.Timeout)
+	if command == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.now()
+	for added, expiry := range b.added {
+		if !now.Before(expiry) {
+			delete(b.added, added)
+		}
+	}
+	if _, ok := b.added[element]; ok {
+		return
+	}
+	select {
+	case b.queue <- command:
+		b.added[element] = now.Add(b.Timeout)
+	default:
+		b.dropped++
+		if b.dropped == 1 || b.dropped%100 == 0 {
+			logging.Warningf("%s attack logger: queue full, %d commands dropped\n", b.Name, b.dropped)
+		}
+	}
+}
+
+// exempt returns true if the address is within one of the Exempt networks.
+func (b *Blocklist) exempt(ip net.IP) bool {
+	for _, network := range b.Exempt {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Blocklist) runQueued() {
+	defer b.wg.Done()
+	for command := range b.queue {
+		if err := b.Run(command); err != nil {
+			logging.Warningf("%s attack logger: %s\n", b.Name, err)
+		}
+	}
+}
+
+// runCommand runs a command, returning an error holding its output if it fails.
+func runCommand(command []string) error {
+	output, err := exec.Command(command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s: %s", strings.Join(command, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package response
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+// recordingRunner records the commands it is given to run.
+type recordingRunner struct {
+	mutex    sync.Mutex
+	commands [][]string
+}
+
+func (r *recordingRunner) Run(command []string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.commands = append(r.commands, command)
+	return nil
+}
+
+func testEvent(t *testing.T, eventType, flow string) *types.Event {
+	parsed, err := types.ParseTcpIpFlow(flow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &types.Event{Type: eventType, Flow: *parsed}
+}
+
+func TestNftablesBlocklist(t *testing.T) {
+	blocklist, err := NewNftablesBlocklistFromOptions(&logging.AttackLoggerOptions{
+		Params: map[string]string{"set": "injectors", "set6": "injectors6", "mode": "source", "timeout": "10m", "exempt": "10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := &recordingRunner{}
+	blocklist.Run = runner.Run
+	now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	blocklist.now = func() time.Time { return now }
+	blocklist.Start()
+
+	blocklist.Log(testEvent(t, "injection", "1.2.3.4:80-2.3.4.5:1000"))
+	// a source already added is not added again until it times out
+	blocklist.Log(testEvent(t, "handshake-hijack", "1.2.3.4:80-2.3.4.5:1001"))
+	// attacks of lesser confidence, reports of the sensor's own state and
+	// exempt sources are not responded to
+	blocklist.Log(testEvent(t, "censor-injection-RST_data", "1.2.3.5:80-2.3.4.5:1000"))
+	blocklist.Log(testEvent(t, "sensor-rst-teardown", "1.2.3.6:80-2.3.4.5:1000"))
+	blocklist.Log(testEvent(t, "injection", "10.1.2.3:80-2.3.4.5:1000"))
+	blocklist.Log(testEvent(t, "injection", "2001:db8::1:80-2001:db8::2:1000"))
+	now = now.Add(10 * time.Minute)
+	blocklist.Log(testEvent(t, "injection", "1.2.3.4:80-2.3.4.5:1002"))
+	blocklist.Stop()
+
+	expected := [][]string{
+		{"nft", "add", "element", "inet", "filter", "injectors", "{", "1.2.3.4", "timeout", "600s", "}"},
+		{"nft", "add", "element", "inet", "filter", "injectors6", "{", "2001:db8::1", "timeout", "600s", "}"},
+		{"nft", "add", "element", "inet", "filter", "injectors", "{", "1.2.3.4", "timeout", "600s", "}"},
+	}
+	if !reflect.DeepEqual(runner.commands, expected) {
+		t.Errorf("ran %q", runner.commands)
+	}
+
+	if _, err := NewNftablesBlocklistFromOptions(&logging.AttackLoggerOptions{Params: map[string]string{}}); err == nil {
+		t.Error("expected an error for no set")
+	}
+	if _, err := NewNftablesBlocklistFromOptions(&logging.AttackLoggerOptions{Params: map[string]string{"set": "injectors", "mode": "port"}}); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+	// the spoofed sources of injections are not blocked without exemptions
+	if _, err := NewNftablesBlocklistFromOptions(&logging.AttackLoggerOptions{Params: map[string]string{"set": "injectors", "mode": "source"}}); err == nil {
+		t.Error("expected an error for mode source without exempt")
+	}
+}
+
+func TestIpsetBlocklist(t *testing.T) {
+	blocklist, err := NewIpsetBlocklistFromOptions(&logging.AttackLoggerOptions{
+		Params: map[string]string{"set": "attacked", "confidence": "medium"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := &recordingRunner{}
+	blocklist.Run = runner.Run
+	blocklist.Start()
+	blocklist.Log(testEvent(t, "censor-injection-RST_data", "1.2.3.4:80-2.3.4.5:1000"))
+	// there is no set for IPv6
+	blocklist.Log(testEvent(t, "injection", "2001:db8::1:80-2001:db8::2:1000"))
+	blocklist.Stop()
+
+	expected := [][]string{{"ipset", "-exist", "add", "attacked", "1.2.3.4,tcp:80,2.3.4.5", "timeout", "3600"}}
+	if !reflect.DeepEqual(runner.commands, expected) {
+		t.Errorf("ran %q", runner.commands)
+	}
+}
@@ -23,27 +23,32 @@ import (
 	"github.com/david415/HoneyBadger/types"
 	"github.com/david415/HoneyBadger/blocks"
 
-	"log"
 	"bytes"
-	"encoding/hex"
+	"fmt"
 )
 
 
-func checkForInjectionInRing(ringPtr *types.Ring, start, end types.Sequence, payload []byte) []*types.Event {
-	acc := []*types.Event{}
-	overlapBlockSegments := getOverlapsInRing(ringPtr, start, end)
+// checkForInjection compares the given packet payload spanning [start, end)
+// against the stream data already reassembled for that direction and
+// returns an Event for every overlapping range whose content differs.
+// An error is returned if an overlapping range lies outside of the payload.
+// Overlapping ranges are compared in place, bytes are only copied out
+// of the payload and the stream buffer for the events returned.
+func checkForInjection(stream *StreamBuffer, start, end types.Sequence, payload []byte) ([]*types.Event, error) {
+	var acc []*types.Event
+	overlapBlockSegments := stream.Overlaps(start, end)
 	for i := 0; i < len(overlapBlockSegments); i++ {
-		packetOverlapBytes := getOverlapBytesFromSlice(payload, start, overlapBlockSegments[i].Block)
+		packetOverlapBytes, err := getOverlapBytesFromSlice(payload, start, overlapBlockSegments[i].Block)
+		if err != nil {
+			return nil, err
+		}
 		if !bytes.Equal(packetOverlapBytes, overlapBlockSegments[i].Bytes) {
-			log.Printf("injection at TCP Sequence start %d end %d\n", start, end)
-			log.Print("race winner stream segment:")
-			log.Print(hex.Dump(overlapBlockSegments[i].Bytes))
-			log.Print("race loser stream segment:")
-			log.Print(hex.Dump(packetOverlapBytes))
-
+			// the losing bytes belong to the packet, released once
+			// analysed, and the winning ones to the stream buffer
+			// which may recycle them before the event has been logged
 			e := &types.Event{
-				Loser:   packetOverlapBytes,
-				Winner:  overlapBlockSegments[i].Bytes,
+				Loser:   append([]byte(nil), packetOverlapBytes...),
+				Winner:  append([]byte(nil), overlapBlockSegments[i].Bytes...),
 				Start:   overlapBlockSegments[i].Block.A,
 				End:     overlapBlockSegments[i].Block.B,
 			}
@@ -57,50 +62,17 @@ func checkForInjectionInRing(ringPtr *types.Ring, start, end types.Sequence, pay
 			acc = append(acc, e)
 		}
 	}
-	return acc
+	return acc, nil
 }
 
-func getOverlapBytesFromSlice(payload []byte, sequence types.Sequence, overlap blocks.Block) []byte {
+// getOverlapBytesFromSlice returns the bytes of payload, which begins at the
+// given sequence, covered by the overlap block. An error is returned if the
+// block is not within the payload.
+func getOverlapBytesFromSlice(payload []byte, sequence types.Sequence, overlap blocks.Block) ([]byte, error) {
 	start := sequence.Difference(overlap.A)
-	end := types.Sequence(start).Add(overlap.A.Difference(overlap.B))
-	return payload[start:end]
-}
-
-func getOverlapsInRing(ringPtr *types.Ring, start, end types.Sequence) []blocks.BlockSegment {
-	acc := []blocks.BlockSegment{}
-
-	target := blocks.Block {
-		A: start,
-		B: end,
-	}
-
-	// iterate for the entire ring
-	for current := ringPtr.Next(); current != ringPtr; current = current.Next() {
-		if current.Reassembly == nil {
-			continue
-		}
-
-		if len(current.Reassembly.Bytes) == 0 {
-			continue
-		}
-
-		new_start := types.Sequence(current.Reassembly.Seq)
-		new_end := types.Sequence(current.Reassembly.Seq).Add(len(current.Reassembly.Bytes))
-
-		overlap := target.Overlap(new_start, new_end)
-		if overlap == nil {
-			continue
-		} else {
-			// overlaps
-			overlapBytes := getOverlapBytesFromSlice(current.Reassembly.Bytes, current.Reassembly.Seq, *overlap)
-			blockSegment := blocks.BlockSegment {
-				Block: *overlap,
-				Bytes: overlapBytes,
-				IsCoalesce: current.Reassembly.IsCoalesce,
-				IsCoalesceGap: current.Reassembly.IsCoalesceGap,
-			}
-			acc = append(acc, blockSegment)
-		}
+	end := start + overlap.A.Difference(overlap.B)
+	if start < 0 || end < start || end > len(payload) {
+		return nil, fmt.Errorf("overlap [%d, %d) is outside of the %d payload bytes at sequence %d", overlap.A, overlap.B, len(payload), sequence)
 	}
-	return acc
+	return payload[start:end], nil
 }
@@ -24,6 +24,7 @@ type TestOverlapBytesWant struct {
 
 type DummyAttackLogger struct {
 	Count int
+	Last  *types.Event
 }
 
 func NewDummyAttackLogger() *DummyAttackLogger {
@@ -35,12 +36,13 @@ func NewDummyAttackLogger() *DummyAttackLogger {
 
 func (d *DummyAttackLogger) Log(event *types.Event) {
 	d.Count += 1
+	d.Last = event
 }
 
 func (d *DummyAttackLogger) Archive() {
 }
 
-func TestGetOverlapsInRing(t *testing.T) {
+func TestStreamBufferOverlaps(t *testing.T) {
 
 	overlapBlockTests := []struct {
 		in   blocks.Block
@@ -85,28 +87,25 @@ func TestGetOverlapsInRing(t *testing.T) {
 		},
 	}
 
-	// setup ring with some content and sequence numbers
-	var ringPtr *types.Ring = types.NewRing(40)
+	// setup stream buffer with some content and sequence numbers
+	stream := NewStreamBuffer(40, 0)
 	for j := 5; j < 40; j += 5 {
 		reassembly := types.Reassembly{
 			Seq:   types.Sequence(j),
 			Bytes: []byte{1, 2, 3, 4, 5},
 		}
-
-		ringPtr.Reassembly = &reassembly
-		ringPtr = ringPtr.Next()
+		stream.Add(&reassembly)
 	}
 	reassembly := types.Reassembly{
 		Seq:   types.Sequence(46),
 		Bytes: []byte{},
 	}
-	ringPtr.Reassembly = &reassembly
-	ringPtr = ringPtr.Next()
+	stream.Add(&reassembly)
 
 	// run tests
 	for i := 0; i < len(overlapBlockTests); i++ {
 		log.Printf("test # %d\n", i)
-		overlaps := getOverlapsInRing(ringPtr, overlapBlockTests[i].in.A, overlapBlockTests[i].in.B)
+		overlaps := stream.Overlaps(overlapBlockTests[i].in.A, overlapBlockTests[i].in.B)
 
 		if len(overlaps) != len(overlapBlockTests[i].want) {
 			t.Errorf("wanted %d overlaps, got %d\n", len(overlapBlockTests[i].want), len(overlaps))
@@ -142,10 +141,8 @@ func TestInjectionDetector(t *testing.T) {
 		Seq:   types.Sequence(5),
 		Bytes: []byte{1, 2, 3, 4, 5},
 	}
-	conn.ClientStreamRing.Reassembly = &reassembly
-	conn.ClientStreamRing = conn.ClientStreamRing.Next()
-	conn.ServerStreamRing.Reassembly = &reassembly
-	conn.ServerStreamRing = conn.ServerStreamRing.Next()
+	conn.ClientStreamBuffer.Add(&reassembly)
+	conn.ServerStreamBuffer.Add(&reassembly)
 
 	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.IPv4(1, 2, 3, 4)), layers.NewIPEndpoint(net.IPv4(2, 3, 4, 5)))
 	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(1)), layers.NewTCPPortEndpoint(layers.TCPPort(2)))
@@ -219,3 +216,16 @@ func TestInjectionDetector(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestGetOverlapBytesOutsidePayload(t *testing.T) {
+	payload := []byte{1, 2, 3, 4}
+	if overlap, err := getOverlapBytesFromSlice(payload, 10, blocks.Block{A: 11, B: 13}); err != nil || len(overlap) != 2 || overlap[0] != 2 {
+		t.Errorf("overlap %v error %v", overlap, err)
+	}
+	if _, err := getOverlapBytesFromSlice(payload, 10, blocks.Block{A: 12, B: 20}); err == nil {
+		t.Error("no error for an overlap beyond the payload")
+	}
+	if _, err := getOverlapBytesFromSlice(payload, 10, blocks.Block{A: 8, B: 12}); err == nil {
+		t.Error("no error for an overlap before the payload")
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/blocks"
+	"github.com/david415/HoneyBadger/types"
+)
+
+// sackPermitted returns true if the SACK permitted option is amongst the given TCP options.
+func sackPermitted(options []layers.TCPOption) bool {
+	for _, option := range options {
+		if option.OptionType == layers.TCPOptionKindSACKPermitted {
+			return true
+		}
+	}
+	return false
+}
+
+// sackBlocks returns the blocks of the SACK options amongst the given TCP options.
+func sackBlocks(options []layers.TCPOption) blocks.Blocks {
+	var result blocks.Blocks
+	for _, option := range options {
+		if option.OptionType != layers.TCPOptionKindSACK {
+			continue
+		}
+		for data := option.OptionData; len(data) >= 8; data = data[8:] {
+			result = append(result, blocks.Block{
+				A: types.Sequence(binary.BigEndian.Uint32(data[:4])),
+				B: types.Sequence(binary.BigEndian.Uint32(data[4:8])),
+			})
+		}
+	}
+	return result
+}
+
+// sackScoreboard records the stream data one endpoint has acknowledged
+// receiving, cumulatively and selectively, so that we know which out of
+// order ranges the receiver actually holds.
+type sackScoreboard struct {
+	ack    types.Sequence
+	valid  bool
+	blocks blocks.Blocks
+}
+
+// update records the cumulative ACK and SACK blocks sent by the endpoint.
+// SACK blocks at or below the cumulative ACK are discarded, as are
+// blocks which are not sensible; the rest are merged with those seen so far.
+func (s *sackScoreboard) update(ack types.Sequence, sacks blocks.Blocks) {
+	if !s.valid || ack.GreaterThan(s.ack) {
+		s.ack = ack
+	}
+	s.valid = true
+	var merged blocks.Blocks
+	for _, blk := range append(append(blocks.Blocks{}, s.blocks...), sacks...) {
+		if !blk.A.LessThan(blk.B) || !blk.B.GreaterThan(s.ack) {
+			continue
+		}
+		if blk.A.LessThan(s.ack) {
+			blk.A = s.ack
+		}
+		merged = append(merged, blk)
+	}
+	sort.Sort(merged)
+	s.blocks = nil
+	for _, blk := range merged {
+		if n := len(s.blocks); n > 0 && s.blocks[n-1].B.GreaterThanOrEqual(blk.A) {
+			if blk.B.GreaterThan(s.blocks[n-1].B) {
+				s.blocks[n-1].B = blk.B
+			}
+			continue
+		}
+		s.blocks = append(s.blocks, blk)
+	}
+}
+
+// holds returns true if the endpoint has acknowledged receiving
+// all of the stream range [start, end).
+func (s *sackScoreboard) holds(start, end types.Sequence) bool {
+	if !s.valid {
+		return false
+	}
+	if end.LessThanOrEqual(s.ack) {
+		return true
+	}
+	if start.LessThan(s.ack) {
+		start = s.ack
+	}
+	for _, blk := range s.blocks {
+		if blk.A.LessThanOrEqual(start) && end.LessThanOrEqual(blk.B) {
+			return true
+		}
+	}
+	return false
+}
+
+// highest returns the highest sequence the endpoint has acknowledged receiving.
+func (s *sackScoreboard) highest() types.Sequence {
+	highest := s.ack
+	if n := len(s.blocks); n > 0 && s.blocks[n-1].B.GreaterThan(highest) {
+		highest = s.blocks[n-1].B
+	}
+	return highest
+}
@@ -0,0 +1,77 @@
+package HoneyBadger
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/blocks"
+	"github.com/david415/HoneyBadger/types"
+)
+
+func sack(edges ...uint32) layers.TCPOption {
+	data := make([]byte, 4*len(edges))
+	for i, edge := range edges {
+		binary.BigEndian.PutUint32(data[4*i:], edge)
+	}
+	return layers.TCPOption{OptionType: layers.TCPOptionKindSACK, OptionLength: uint8(2 + len(data)), OptionData: data}
+}
+
+func TestSackBlocks(t *testing.T) {
+	options := []layers.TCPOption{wscale(7), sack(10, 20, 30, 40)}
+	got := sackBlocks(options)
+	if len(got) != 2 || got[0] != (blocks.Block{A: 10, B: 20}) || got[1] != (blocks.Block{A: 30, B: 40}) {
+		t.Errorf("SACK blocks %v, expected [10,20) and [30,40)", got)
+	}
+	if sackPermitted(options) {
+		t.Error("SACK permitted found without the option")
+	}
+	if !sackPermitted([]layers.TCPOption{{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2}}) {
+		t.Error("SACK permitted option not found")
+	}
+}
+
+func TestSackScoreboard(t *testing.T) {
+	s := sackScoreboard{}
+	if s.holds(0, 1) {
+		t.Error("an empty scoreboard must hold nothing")
+	}
+	s.update(0xFFFFFFF0, blocks.Blocks{{A: 0x10, B: 0x20}, {A: 0xFFFFFFF8, B: 0x8}})
+	s.update(0xFFFFFFF0, blocks.Blocks{{A: 0x8, B: 0x10}, {A: 0x30, B: 0x20}})
+	if len(s.blocks) != 1 || !s.holds(0xFFFFFFF8, 0x20) || s.holds(0xFFFFFFF0, 0x20) {
+		t.Errorf("blocks %v wrapping the sequence space merged incorrectly", s.blocks)
+	}
+	if s.highest() != 0x20 {
+		t.Errorf("highest %d, expected 0x20", s.highest())
+	}
+	s.update(0x10, nil)
+	if !s.holds(0xFFFFFFF0, 0x20) || len(s.blocks) != 1 || s.blocks[0].A != 0x10 {
+		t.Errorf("blocks %v not trimmed to the cumulative ACK", s.blocks)
+	}
+	s.update(0x8, nil)
+	if s.ack != 0x10 {
+		t.Error("cumulative ACK moved backwards")
+	}
+}
+
+func TestConnectionUnacknowledgedInjection(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	conn, packet := newTestConnection(attackLogger)
+	conn.sackPermitted = true
+
+	// the first segment is inserted at our vantage point only
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{1, 2, 3}))
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 103, Ack: 500, ACK: true}, []byte{4, 5, 6}))
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 100, ACK: true, Options: []layers.TCPOption{sack(103, 106)}}, []byte{}))
+	if !conn.serverScoreboard.holds(103, 106) || conn.serverScoreboard.holds(100, 103) {
+		t.Error("server scoreboard does not reflect its SACK")
+	}
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{7, 8, 9}))
+	if attackLogger.Count != 1 || attackLogger.Last.Type != "unacknowledged segment injection" {
+		t.Errorf("reported %d attacks, last %+v; expected an unacknowledged segment injection", attackLogger.Count, attackLogger.Last)
+	}
+	if attackLogger.Last.Start != types.Sequence(100) || attackLogger.Last.End != types.Sequence(103) {
+		t.Errorf("injection reported at [%d, %d), expected [100, 103)", attackLogger.Last.Start, attackLogger.Last.End)
+	}
+}
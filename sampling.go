@@ -0,0 +1,77 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// flowSampleHash returns a hash of the connection's 4-tuple which is the
+// same for both directions of the connection and, unlike gopacket's
+// FastHash, the same from one run to the next; so that a connection is
+// either sampled by every sensor and every run or by none.
+func flowSampleHash(flow *types.TcpIpFlow) uint64 {
+	key, _ := types.NewFlowKey(flow)
+	hash := fnv.New64a()
+	hash.Write(key.A[:])
+	hash.Write(key.B[:])
+	return hash.Sum64()
+}
+
+// sampleFlow returns true if the connection of the flow falls within
+// the sampled fraction rate of all connections.
+func sampleFlow(flow *types.TcpIpFlow, rate float64) bool {
+	if rate <= 0 || rate >= 1 {
+		return true
+	}
+	return float64(flowSampleHash(flow)) < rate*math.MaxUint64
+}
+
+// flowHasPort returns true if either end of the flow uses one of the given TCP ports.
+func flowHasPort(flow *types.TcpIpFlow, ports []int) bool {
+	if len(ports) == 0 {
+		return false
+	}
+	_, tcpFlow := flow.Flows()
+	src := int(binary.BigEndian.Uint16(tcpFlow.Src().Raw()))
+	dst := int(binary.BigEndian.Uint16(tcpFlow.Dst().Raw()))
+	for _, port := range ports {
+		if port == src || port == dst {
+			return true
+		}
+	}
+	return false
+}
+
+// sampledLogger notes the sampling rate in effect for a
+// connection in each event it reports before logging it.
+type sampledLogger struct {
+	types.Logger
+	SampleRate float64
+}
+
+func (l sampledLogger) Log(event *types.Event) {
+	event.SampleRate = l.SampleRate
+	l.Logger.Log(event)
+}
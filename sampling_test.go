@@ -0,0 +1,42 @@
+package HoneyBadger
+
+import (
+	"testing"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+func TestSampleFlow(t *testing.T) {
+	sampled := 0
+	for port := 1024; port < 3024; port++ {
+		flow := testFlow(port, 80)
+		reverse := flow.Reverse()
+		if sampleFlow(flow, 0.25) != sampleFlow(&reverse, 0.25) {
+			t.Fatalf("both directions of %s must be sampled alike", flow)
+		}
+		if sampleFlow(flow, 0.25) {
+			sampled++
+		}
+		if !sampleFlow(flow, 0) || !sampleFlow(flow, 1) {
+			t.Fatal("every connection must be tracked unless sampling")
+		}
+	}
+	if sampled < 400 || sampled > 600 {
+		t.Errorf("sampled %d of 2000 connections at a rate of 0.25", sampled)
+	}
+	if flowSampleHash(testFlow(1024, 80)) != flowSampleHash(testFlow(1024, 80)) {
+		t.Error("sampling is not deterministic")
+	}
+	if !flowHasPort(testFlow(1024, 25), []int{25}) || flowHasPort(testFlow(1024, 80), []int{25}) {
+		t.Error("priority port not matched")
+	}
+}
+
+func TestSampledLogger(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	logger := sampledLogger{Logger: attackLogger, SampleRate: 0.5}
+	logger.Log(&types.Event{Type: "test"})
+	if attackLogger.Count != 1 || attackLogger.Last.SampleRate != 0.5 {
+		t.Error("sampling rate not noted in the report")
+	}
+}
@@ -0,0 +1,316 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// SNAPSHOT_VERSION is the version of the snapshot file format;
+// snapshots of other versions are not restored.
+const SNAPSHOT_VERSION = 1
+
+// TrackerSnapshot is the state of all tracked connections saved on shutdown.
+type TrackerSnapshot struct {
+	Version     int
+	Time        time.Time
+	Connections []*ConnectionSnapshot
+}
+
+// FlowSnapshot is the serializable form of a TcpIpFlow.
+type FlowSnapshot struct {
+	IPv6             bool
+	SrcIP, DstIP     []byte
+	SrcPort, DstPort uint16
+}
+
+// WindowSnapshot is the serializable form of an endpoint's receive window.
+type WindowSnapshot struct {
+	Scale uint
+	Left  types.Sequence
+	Size  int
+	Valid bool
+}
+
+// SegmentSnapshot is a retained segment of stream data.
+type SegmentSnapshot struct {
+	Seq   types.Sequence
+	Bytes []byte
+}
+
+// ConnectionSnapshot is the state of a Connection's TCP finite state machine;
+// enough to carry on monitoring an established connection after a restart.
+// The retained stream data is included only if streams were snapshot;
+// out of order segments awaiting reassembly are never included.
+type ConnectionSnapshot struct {
+	ClientFlow               FlowSnapshot
+	State                    uint8
+	ClientState              uint8
+	ServerState              uint8
+	AttackDetected           bool
+	PacketCount              uint64
+	SkipHijackDetectionCount uint64
+	ClientNextSeq            types.Sequence
+	ServerNextSeq            types.Sequence
+	HijackNextAck            types.Sequence
+	FirstSynSeq              uint32
+	FirstSynAckSeq           uint32
+	SynOptions               []layers.TCPOption
+	SynAckOptions            []layers.TCPOption
+	ClosingClient            bool
+	ClosingRST               bool
+	HandshakeRST             bool
+	ClosingFIN               bool
+	ClosingSeq               types.Sequence
+	WindowsTracked           bool
+	ClientWindow             WindowSnapshot
+	ServerWindow             WindowSnapshot
+	SackPermitted            bool
+	ClientStream             []SegmentSnapshot
+	ServerStream             []SegmentSnapshot
+}
+
+func snapshotFlow(flow *types.TcpIpFlow) FlowSnapshot {
+	ipFlow, tcpFlow := flow.Flows()
+	return FlowSnapshot{
+		IPv6:    ipFlow.EndpointType() == layers.EndpointIPv6,
+		SrcIP:   ipFlow.Src().Raw(),
+		DstIP:   ipFlow.Dst().Raw(),
+		SrcPort: binary.BigEndian.Uint16(tcpFlow.Src().Raw()),
+		DstPort: binary.BigEndian.Uint16(tcpFlow.Dst().Raw()),
+	}
+}
+
+// Flow returns the TcpIpFlow of the snapshot.
+func (f FlowSnapshot) Flow() *types.TcpIpFlow {
+	endpointType := layers.EndpointIPv4
+	if f.IPv6 {
+		endpointType = layers.EndpointIPv6
+	}
+	ipFlow := gopacket.NewFlow(endpointType, f.SrcIP, f.DstIP)
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(f.SrcPort)), layers.NewTCPPortEndpoint(layers.TCPPort(f.DstPort)))
+	flow := types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	return &flow
+}
+
+func snapshotWindow(w *receiveWindow) WindowSnapshot {
+	return WindowSnapshot{Scale: w.scale, Left: w.left, Size: w.size, Valid: w.valid}
+}
+
+func (w WindowSnapshot) window() receiveWindow {
+	return receiveWindow{scale: w.Scale, left: w.Left, size: w.Size, valid: w.Valid}
+}
+
+func snapshotStream(stream *StreamBuffer) []SegmentSnapshot {
+	var segments []SegmentSnapshot
+	for _, page := range stream.Pages() {
+		segments = append(segments, SegmentSnapshot{
+			Seq:   page.Seq,
+			Bytes: append([]byte(nil), page.Bytes...),
+		})
+	}
+	return segments
+}
+
+func restoreStream(stream *StreamBuffer, segments []SegmentSnapshot, seen time.Time) {
+	for _, segment := range segments {
+		stream.Add(&types.Reassembly{
+			Seq:   segment.Seq,
+			Bytes: segment.Bytes,
+			Seen:  seen,
+		})
+	}
+}
+
+// Snapshot returns the state of the connection, including
+// its retained stream data if streams is set.
+func (c *Connection) Snapshot(streams bool) *ConnectionSnapshot {
+	s := ConnectionSnapshot{
+		ClientFlow:               snapshotFlow(c.clientFlow),
+		State:                    c.state,
+		ClientState:              c.clientState,
+		ServerState:              c.serverState,
+		AttackDetected:           c.attackDetected,
+		PacketCount:              c.packetCount,
+		SkipHijackDetectionCount: c.skipHijackDetectionCount,
+		ClientNextSeq:            c.clientNextSeq,
+		ServerNextSeq:            c.serverNextSeq,
+		HijackNextAck:            c.hijackNextAck,
+		FirstSynSeq:              c.firstSynSeq,
+		FirstSynAckSeq:           c.firstSynAckSeq,
+		SynOptions:               c.synOptions,
+		SynAckOptions:            c.synAckOptions,
+		ClosingClient:            c.closingFlow != nil && c.closingFlow.Equal(c.clientFlow),
+		ClosingRST:               c.closingRST,
+		HandshakeRST:             c.handshakeRST,
+		ClosingFIN:               c.closingFIN,
+		ClosingSeq:               c.closingSeq,
+		WindowsTracked:           c.windowsTracked,
+		ClientWindow:             snapshotWindow(&c.clientWindow),
+		ServerWindow:             snapshotWindow(&c.serverWindow),
+		SackPermitted:            c.sackPermitted,
+	}
+	if streams {
+		s.ClientStream = snapshotStream(c.ClientStreamBuffer)
+		s.ServerStream = snapshotStream(c.ServerStreamBuffer)
+	}
+	return &s
+}
+
+// Restore sets the state of a newly built connection to that of the snapshot.
+// The connection is considered last seen at now, the dispatcher's capture
+// time, so that it is not expired before its packets can again be received.
+// Until the capture clock has started it is restamped with Restamp.
+func (c *Connection) Restore(s *ConnectionSnapshot, now time.Time) {
+	c.clientFlow = s.ClientFlow.Flow()
+	serverFlow := c.clientFlow.Reverse()
+	c.serverFlow = &serverFlow
+	c.state = s.State
+	c.clientState = s.ClientState
+	c.serverState = s.ServerState
+	c.attackDetected = s.AttackDetected
+	c.packetCount = s.PacketCount
+	c.skipHijackDetectionCount = s.SkipHijackDetectionCount
+	c.clientNextSeq = s.ClientNextSeq
+	c.serverNextSeq = s.ServerNextSeq
+	c.hijackNextAck = s.HijackNextAck
+	c.firstSynSeq = s.FirstSynSeq
+	c.firstSynAckSeq = s.FirstSynAckSeq
+	c.synOptions = s.SynOptions
+	c.synAckOptions = s.SynAckOptions
+	c.closingRST = s.ClosingRST
+	c.handshakeRST = s.HandshakeRST
+	c.closingFIN = s.ClosingFIN
+	c.closingSeq = s.ClosingSeq
+	if s.ClosingRST || s.ClosingFIN {
+		c.closingFlow = c.serverFlow
+		if s.ClosingClient {
+			c.closingFlow = c.clientFlow
+		}
+	}
+	c.windowsTracked = s.WindowsTracked
+	c.clientWindow = s.ClientWindow.window()
+	c.serverWindow = s.ServerWindow.window()
+	c.sackPermitted = s.SackPermitted
+	restoreStream(c.ClientStreamBuffer, s.ClientStream, now)
+	restoreStream(c.ServerStreamBuffer, s.ServerStream, now)
+	c.updateLastSeen(now)
+}
+
+// Restamp sets the times a restored connection and its retained stream
+// data were seen to now, which may be earlier than when it was restored
+// when the capture clock is that of a pcap file.
+func (c *Connection) Restamp(now time.Time) {
+	c.lastSeenMutex.Lock()
+	c.firstSeen = now
+	c.lastSeen = now
+	c.lastSeenMutex.Unlock()
+	for _, stream := range []*StreamBuffer{c.ClientStreamBuffer, c.ServerStreamBuffer} {
+		for _, page := range stream.Pages() {
+			page.Seen = now
+		}
+	}
+}
+
+// snapshotConnection is implemented by connections
+// whose state can be saved and restored.
+type snapshotConnection interface {
+	Snapshot(streams bool) *ConnectionSnapshot
+	Restore(*ConnectionSnapshot, time.Time)
+	Restamp(time.Time)
+}
+
+// SaveSnapshot saves the state of the tracked connections to the given file;
+// those which have been closed are left out. It must not be called while
+// packets are being dispatched.
+func (i *Dispatcher) SaveSnapshot(filename string) error {
+	snapshot := TrackerSnapshot{
+		Version: SNAPSHOT_VERSION,
+		Time:    time.Now(),
+	}
+	for _, conn := range i.connections() {
+		if conn.GetState() == TCP_UNKNOWN || conn.IsClosed() {
+			continue
+		}
+		if s, ok := conn.(snapshotConnection); ok {
+			snapshot.Connections = append(snapshot.Connections, s.Snapshot(i.options.SnapshotStreams))
+		}
+	}
+	data, err := json.Marshal(&snapshot)
+	if err != nil {
+		return err
+	}
+	// write the snapshot aside and move it into place so that
+	// a failure never leaves a truncated snapshot behind
+	file, err := ioutil.TempFile(filepath.Dir(filename), "honeyBadger-snapshot-")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+// LoadSnapshot restores the connections saved to the given file and
+// returns the number of connections restored. It must be called before
+// packets are being dispatched.
+func (i *Dispatcher) LoadSnapshot(filename string) (int, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	snapshot := TrackerSnapshot{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return 0, err
+	}
+	if snapshot.Version != SNAPSHOT_VERSION {
+		return 0, fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+	count := 0
+	for _, s := range snapshot.Connections {
+		conn := i.setupNewConnection(s.ClientFlow.Flow())
+		if restorable, ok := conn.(snapshotConnection); ok {
+			restorable.Restore(s, i.captureNow())
+			if i.captureTime.IsZero() {
+				i.restored = append(i.restored, restorable)
+			}
+			i.connectionEvent("connection-opened", conn)
+			count += 1
+		}
+	}
+	return count, nil
+}
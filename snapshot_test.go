@@ -0,0 +1,65 @@
+package HoneyBadger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestDispatcherSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "snapshot.json")
+
+	attackLogger := NewDummyAttackLogger()
+	options := DispatcherOptions{
+		Logger:          attackLogger,
+		MaxRingPackets:  40,
+		DetectInjection: true,
+		SnapshotStreams: true,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	conn, packet := newTestConnection(attackLogger)
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{1, 2, 3}))
+	dispatcher.tracker.Put(conn.clientFlow, conn)
+	if err := dispatcher.SaveSnapshot(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	count, err := restarted.LoadSnapshot(filename)
+	if err != nil || count != 1 {
+		t.Fatalf("restored %d connections: %v", count, err)
+	}
+	tracked, ok := restarted.tracker.Get(conn.clientFlow)
+	if !ok {
+		t.Fatal("restored connection is not tracked")
+	}
+	restored := tracked.(*Connection)
+	if restored.state != TCP_DATA_TRANSFER || restored.clientNextSeq != 103 || restored.serverNextSeq != 500 {
+		t.Errorf("restored state %d client next %d server next %d", restored.state, restored.clientNextSeq, restored.serverNextSeq)
+	}
+	if !restored.serverFlow.Equal(conn.serverFlow) || restored.ServerStreamBuffer.Bytes() != 3 {
+		t.Error("restored connection lost its flows or stream")
+	}
+
+	// a pcap file's capture clock restamps what was restored before it started
+	captured := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	restarted.advanceCapture(captured)
+	if !restored.lastSeen.Equal(captured) || !restored.ServerStreamBuffer.Pages()[0].Seen.Equal(captured) {
+		t.Errorf("restored connection last seen %s, stream seen %s", restored.lastSeen, restored.ServerStreamBuffer.Pages()[0].Seen)
+	}
+
+	// monitoring carries on where it left off
+	restored.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{7, 8, 9}))
+	if attackLogger.Count != 1 {
+		t.Errorf("reported %d attacks after restoring, expected the injection", attackLogger.Count)
+	}
+}
@@ -20,16 +20,37 @@
 package HoneyBadger
 
 import (
+	"context"
 	"fmt"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"io"
 	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
 
 	"github.com/david415/HoneyBadger/drivers"
+	"github.com/david415/HoneyBadger/logging"
 	"github.com/david415/HoneyBadger/types"
 )
 
+// SNIFFER_QUEUE is the number of packets captured which may be queued
+// for decoding. Packets captured off the wire while the queue is full are
+// dropped, those read from a file wait for room.
+const SNIFFER_QUEUE = 4096
+
+// SNIFFER_BATCH and SNIFFER_FLUSH_INTERVAL are the default number of
+// packets read and decoded at once and the longest a batch waits to
+// be decoded once a packet has been read into it.
+const (
+	SNIFFER_BATCH          = 64
+	SNIFFER_FLUSH_INTERVAL = 10 * time.Millisecond
+)
+
+// SNIFFER_DROPS_INTERVAL is how often the packets dropped
+// by the packet source are counted, see Drops.
+const SNIFFER_DROPS_INTERVAL = time.Second
+
 // Sniffer sets up the connection pool and is an abstraction layer for dealing
 // with incoming packets weather they be from a pcap file or directly off the wire.
 type Sniffer struct {
@@ -37,18 +58,20 @@ type Sniffer struct {
 	supervisor       types.Supervisor
 	dispatcher       PacketDispatcher
 	packetDataSource types.PacketDataSourceCloser
-	isStopped        bool
-	decodePacketChan chan TimedRawPacket
-	stopDecodeChan   chan bool
+	decodeQueue      *packetQueue
+	cancel           context.CancelFunc
+	doneChan         chan bool
+	sourceDrops      uint64
+	dropsCounted     time.Time
 }
 
 // NewSniffer creates a new Sniffer struct
 func NewSniffer(options *types.SnifferDriverOptions, dispatcher PacketDispatcher) types.PacketSource {
 	i := Sniffer{
-		dispatcher:       dispatcher,
-		options:          options,
-		decodePacketChan: make(chan TimedRawPacket),
-		stopDecodeChan:   make(chan bool),
+		dispatcher:  dispatcher,
+		options:     options,
+		decodeQueue: newPacketQueue(SNIFFER_QUEUE),
+		doneChan:    make(chan bool),
 	}
 	return &i
 }
@@ -61,29 +84,45 @@ func (i *Sniffer) GetStartedChan() chan bool {
 	return make(chan bool)
 }
 
-// Start... starts the TCP attack inquisition!
-func (i *Sniffer) Start() {
+// Start... starts the TCP attack inquisition! Packets are captured
+// until ctx is cancelled, Stop is called or the packet source is
+// exhausted, when the supervisor is told it has stopped.
+func (i *Sniffer) Start(ctx context.Context) {
 	// XXX
 	i.setupHandle()
 
-	go i.capturePackets()
+	ctx, i.cancel = context.WithCancel(ctx)
+	go i.capturePackets(ctx)
 	go i.decodePackets()
 }
 
+// Stop stops the capture and returns once the packets
+// already captured have been handed to the dispatcher.
 func (i *Sniffer) Stop() {
-	log.Print("sniffer: sending stopCapureChan signal")
-	i.isStopped = true
-	i.stopDecodeChan <- true
+	logging.Infof("sniffer: stopping capture")
+	i.cancel()
+	<-i.doneChan
 }
 
 func (i *Sniffer) Close() {
 	if i.packetDataSource != nil {
-		log.Print("closing packet capture socket")
+		logging.Infof("closing packet capture socket")
 		i.packetDataSource.Close()
 	}
-	log.Print("stopping the sniffer decode loop")
-	i.isStopped = true
-	log.Print("done.")
+}
+
+// SetFilter replaces the BPF filter of a running capture,
+// if its DAQ supports that.
+func (i *Sniffer) SetFilter(filter string) error {
+	setter, ok := i.packetDataSource.(types.FilterSetter)
+	if !ok {
+		return fmt.Errorf("the %s DAQ cannot change the filter of a running capture", i.options.DAQ)
+	}
+	if err := setter.SetFilter(filter); err != nil {
+		return fmt.Errorf("failed to set filter %q: %s", filter, err)
+	}
+	i.options.Filter = filter
+	return nil
 }
 
 func (i *Sniffer) setupHandle() {
@@ -98,7 +137,7 @@ func (i *Sniffer) setupHandle() {
 
 	if err != nil {
 		if i.options.Filename != "" {
-			log.Printf("failed to read file %s", i.options.Filename)
+			logging.Errorf("failed to read file %s", i.options.Filename)
 		}
 		panic(fmt.Sprintf("Failed to acquire DataAcQuisition source: %s", err))
 	}
@@ -109,99 +148,136 @@ func (i *Sniffer) setupHandle() {
 		what = fmt.Sprintf("interface %s", i.options.Device)
 	}
 
-	log.Printf("Starting %s packet capture on %s", i.options.DAQ, what)
+	logging.Infof("Starting %s packet capture on %s", i.options.DAQ, what)
 }
 
-func (i *Sniffer) capturePackets() {
-	for {
-		rawPacket, captureInfo, err := i.packetDataSource.ReadPacketData()
+// capturePackets reads packets off the packet source in batches and hands
+// them to the decoder until ctx is cancelled or the source is exhausted,
+// then closes the source and lets the decoder finish. A batch is handed on
+// once BatchSize packets have been read, or once FlushInterval has passed
+// since its first was, as a read returns, or times out on a quiet link.
+func (i *Sniffer) capturePackets(ctx context.Context) {
+	pinGoroutine("packet capture", i.options.CPUs)
+	defer i.decodeQueue.Close()
+	defer i.Close()
+	defer func() {
+		if dropped := i.decodeQueue.Overflows(); dropped != 0 {
+			logging.Warningf("sniffer: %d packets dropped as decoding fell behind", dropped)
+		}
+	}()
+	// packets are copied out of the source's buffers rather than by it
+	read := i.packetDataSource.ReadPacketData
+	if source, ok := i.packetDataSource.(gopacket.ZeroCopyPacketDataSource); ok {
+		read = source.ZeroCopyReadPacketData
+	}
+	flush := i.options.FlushInterval
+	if flush <= 0 {
+		flush = SNIFFER_FLUSH_INTERVAL
+	}
+	batch := make([]*types.PacketManifest, 0, i.batchSize())
+	var first time.Time
+	for ctx.Err() == nil {
+		rawPacket, captureInfo, err := read()
 		if err == io.EOF {
-			log.Print("ReadPacketData got EOF\n")
-			i.Close()
-			i.Stop()
-			i.dispatcher.Stop()
-			i.supervisor.Stopped()
+			logging.Infof("ReadPacketData got EOF")
+			i.queueBatch(ctx, batch)
+			if i.supervisor != nil {
+				i.supervisor.Stopped()
+			}
 			return
 		}
-		if err != nil {
-			//log.Printf("packet capure read error: %s", err)
-			continue
-		}
-		timedPacket := TimedRawPacket{
-			Timestamp: captureInfo.Timestamp,
+		if err == nil {
+			packetManifest := types.GetPacketManifest(rawPacket)
+			packetManifest.Timestamp = captureInfo.Timestamp
+			if len(batch) == 0 {
+				first = time.Now()
+			}
+			batch = append(batch, packetManifest)
 		}
-		timedPacket.RawPacket = make([]byte, len(rawPacket))
-		copy(timedPacket.RawPacket, rawPacket)
-		i.decodePacketChan <- timedPacket
-		if i.isStopped {
-			break
+		if len(batch) == cap(batch) || len(batch) > 0 && (err != nil || time.Since(first) >= flush) {
+			batch = i.queueBatch(ctx, batch)
 		}
 	}
+	i.queueBatch(ctx, batch)
 }
 
-func (i *Sniffer) decodePackets() {
-	var eth layers.Ethernet
-	var ip4 layers.IPv4
-	var ip6 layers.IPv6
-	var tcp layers.TCP
-	var payload gopacket.Payload
+// batchSize returns the number of packets read and decoded at once.
+func (i *Sniffer) batchSize() int {
+	if i.options.BatchSize > 0 {
+		return i.options.BatchSize
+	}
+	return SNIFFER_BATCH
+}
+
+// queueBatch queues a batch of packets for decoding and returns the batch
+// emptied. Packets read off the wire are dropped if the queue is full,
+// those read from a file wait for room unless ctx is cancelled.
+func (i *Sniffer) queueBatch(ctx context.Context, batch []*types.PacketManifest) []*types.PacketManifest {
+	if time.Since(i.dropsCounted) >= SNIFFER_DROPS_INTERVAL {
+		i.countDrops()
+	}
+	var queued int
+	if i.options.Filename != "" {
+		queued = i.decodeQueue.PushBatchWait(batch, ctx.Done())
+	} else {
+		queued = i.decodeQueue.PushBatch(batch)
+	}
+	for _, packetManifest := range batch[queued:] {
+		packetManifest.Release()
+	}
+	return batch[:0]
+}
 
-	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &ip4, &ip6, &tcp, &payload)
-	decoded := make([]gopacket.LayerType, 0, 4)
+// countDrops counts the packets the packet source dropped, if it does.
+// It is called by the goroutine reading the source, which may close it.
+func (i *Sniffer) countDrops() {
+	i.dropsCounted = time.Now()
+	counter, ok := i.packetDataSource.(types.DropCounter)
+	if !ok {
+		return
+	}
+	drops, err := counter.Drops()
+	if err != nil {
+		logging.Debugf("sniffer: failed to count dropped packets: %s", err)
+		return
+	}
+	atomic.StoreUint64(&i.sourceDrops, drops)
+}
 
-	for {
-		select {
-		case <-i.stopDecodeChan:
-			return
-		case timedRawPacket := <-i.decodePacketChan:
-			newPayload := new(gopacket.Payload)
-			payload = *newPayload
-			err := parser.DecodeLayers(timedRawPacket.RawPacket, &decoded)
-			if err != nil {
-				continue
-			}
+// Drops returns the number of packets captured which were dropped, by
+// the packet source, as last counted, or as decoding fell behind.
+func (i *Sniffer) Drops() (uint64, error) {
+	return atomic.LoadUint64(&i.sourceDrops) + i.decodeQueue.Overflows(), nil
+}
 
-			packetManifest := types.PacketManifest{
-				Timestamp: timedRawPacket.Timestamp,
-				Payload:   payload,
-				IPv6:      &layers.IPv6{},
-				IPv4:      &layers.IPv4{},
-				TCP:       &layers.TCP{},
-			}
+// Queued returns the number of packets captured queued for decoding.
+func (i *Sniffer) Queued() int {
+	return i.decodeQueue.Len()
+}
+
+// decodePackets decodes the packets queued, a batch at a time, and hands
+// those carrying a TCP/IP packet to the dispatcher.
+func (i *Sniffer) decodePackets() {
+	iface := ""
+	if i.options.Filename == "" {
+		iface = i.options.Device
+	}
+	decoder := newPacketDecoder(iface)
+	pinGoroutine("packet decoding", i.options.CPUs)
 
-			foundNetLayer := false
-
-			for _, typ := range decoded {
-				switch typ {
-				case layers.LayerTypeIPv4:
-					*packetManifest.IPv4 = ip4
-					foundNetLayer = true
-				case layers.LayerTypeIPv6:
-					*packetManifest.IPv6 = ip6
-					foundNetLayer = true
-				case layers.LayerTypeTCP:
-					if foundNetLayer {
-						flow := types.TcpIpFlow{}
-
-						if packetManifest.IPv4.Version == 4 {
-							// IPv4 case
-							flow = types.NewTcpIpFlowFromFlows(ip4.NetworkFlow(), tcp.TransportFlow())
-						} else if packetManifest.IPv6.Version == 6 {
-							// IPv6 case
-							flow = types.NewTcpIpFlowFromFlows(ip6.NetworkFlow(), tcp.TransportFlow())
-						} else {
-							panic("wtf")
-						}
-
-						packetManifest.Flow = &flow
-						*packetManifest.TCP = tcp
-						i.dispatcher.ReceivePacket(&packetManifest)
-					} else {
-						log.Println("could not find IPv4 or IPv6 layer, inoring")
-					}
-				} // switch
-			} // for
-
-		} // select
-	} // for
+	defer close(i.doneChan)
+	batch := make([]*types.PacketManifest, i.batchSize())
+	for {
+		n := i.decodeQueue.PopBatch(batch)
+		if n == 0 {
+			if i.decodeQueue.Closed() && i.decodeQueue.Len() == 0 {
+				return
+			}
+			i.decodeQueue.Wait()
+			continue
+		}
+		for _, packetManifest := range decoder.decodeBatch(batch[:n]) {
+			i.dispatcher.ReceivePacket(packetManifest)
+		}
+	}
 }
@@ -0,0 +1,111 @@
+package HoneyBadger
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+var errReadTimeout = errors.New("read timeout")
+
+// replaySource hands out frames from a single buffer it reuses, as a
+// zero copy capture handle does, followed by err.
+type replaySource struct {
+	frames [][]byte
+	buf    []byte
+	err    error
+}
+
+func (s *replaySource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(s.frames) == 0 {
+		time.Sleep(time.Millisecond)
+		return nil, gopacket.CaptureInfo{}, s.err
+	}
+	s.buf = append(s.buf[:0], s.frames[0]...)
+	s.frames = s.frames[1:]
+	return s.buf, gopacket.CaptureInfo{Timestamp: time.Unix(int64(len(s.frames)), 0), CaptureLength: len(s.buf), Length: len(s.buf)}, nil
+}
+
+func (s *replaySource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.ZeroCopyReadPacketData()
+	return append([]byte(nil), data...), ci, err
+}
+
+func (s *replaySource) Close() error { return nil }
+
+// channelDispatcher sends the packets it receives down a channel.
+type channelDispatcher struct {
+	recordingDispatcher
+	packets chan *types.PacketManifest
+}
+
+func (d *channelDispatcher) ReceivePacket(p *types.PacketManifest) {
+	d.packets <- p
+}
+
+func replayFrames(t *testing.T, count int) [][]byte {
+	frames := make([][]byte, count)
+	for n := range frames {
+		ethernet := &layers.Ethernet{SrcMAC: ingressMAC, DstMAC: ingressMAC, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: []byte{1, 2, 3, 4}, DstIP: []byte{2, 3, 4, 5}}
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(n + 1), DstPort: 80, Seq: uint32(n), SYN: true}
+		tcp.SetNetworkLayerForChecksum(ip)
+		frames[n] = serializeIngressPacket(t, ethernet, ip, tcp)
+	}
+	return frames
+}
+
+func startReplay(source *replaySource, options *types.SnifferDriverOptions) (*Sniffer, *channelDispatcher, context.CancelFunc) {
+	dispatcher := &channelDispatcher{packets: make(chan *types.PacketManifest, len(source.frames))}
+	sniffer := NewSniffer(options, dispatcher).(*Sniffer)
+	sniffer.packetDataSource = source
+	ctx, cancel := context.WithCancel(context.Background())
+	go sniffer.capturePackets(ctx)
+	go sniffer.decodePackets()
+	return sniffer, dispatcher, cancel
+}
+
+func TestSnifferBatches(t *testing.T) {
+	source := &replaySource{frames: replayFrames(t, 10), err: io.EOF}
+	sniffer, dispatcher, cancel := startReplay(source, &types.SnifferDriverOptions{Filename: "replay.pcap", BatchSize: 4})
+	defer cancel()
+	<-sniffer.doneChan
+
+	if len(dispatcher.packets) != 10 {
+		t.Fatalf("dispatched %d packets, expected 10", len(dispatcher.packets))
+	}
+	for n := 0; n < 10; n++ {
+		p := <-dispatcher.packets
+		if p.TCP.SrcPort != layers.TCPPort(n+1) || p.Timestamp.Unix() != int64(9-n) {
+			t.Errorf("packet %d is from port %d captured at %s", n, p.TCP.SrcPort, p.Timestamp)
+		}
+		p.Release()
+	}
+}
+
+func TestSnifferFlushInterval(t *testing.T) {
+	source := &replaySource{frames: replayFrames(t, 3), err: errReadTimeout}
+	options := &types.SnifferDriverOptions{Device: "tap0", BatchSize: 64, FlushInterval: time.Hour}
+	sniffer, dispatcher, cancel := startReplay(source, options)
+
+	for n := 0; n < 3; n++ {
+		select {
+		case p := <-dispatcher.packets:
+			if p.TCP.SrcPort != layers.TCPPort(n+1) || p.Ingress == nil || p.Ingress.Interface != "tap0" {
+				t.Errorf("packet %d is from port %d seen on %+v", n, p.TCP.SrcPort, p.Ingress)
+			}
+			p.Release()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet %d not flushed as the link went quiet", n)
+		}
+	}
+	cancel()
+	<-sniffer.doneChan
+}
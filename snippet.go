@@ -0,0 +1,159 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+// attackSnippets keeps the last packets of a connection so that each attack
+// report can be accompanied by a standalone pcap, its snippet, of the
+// packets preceding the offending one, that packet and those following it.
+// The packets kept are retained, and released once no snippet needs them.
+type attackSnippets struct {
+	packets int
+	dir     string
+	recent  []*types.PacketManifest
+	next    int
+	pending []*attackSnippet
+}
+
+// attackSnippet is a snippet still waiting for its following packets.
+type attackSnippet struct {
+	filename string
+	packets  []*types.PacketManifest
+	awaiting int
+}
+
+// newAttackSnippets returns snippets of the given number of packets either
+// side of the offending packet, written to dir. It returns nil, which
+// records nothing, if packets <= 0.
+func newAttackSnippets(packets int, dir string) *attackSnippets {
+	if packets <= 0 {
+		return nil
+	}
+	return &attackSnippets{
+		packets: packets,
+		dir:     dir,
+		recent:  make([]*types.PacketManifest, 0, packets+1),
+	}
+}
+
+// record notes a packet received by the connection.
+func (s *attackSnippets) record(p *types.PacketManifest) {
+	if s == nil {
+		return
+	}
+	p.Retain()
+	if len(s.recent) < cap(s.recent) {
+		s.recent = append(s.recent, p)
+	} else {
+		s.recent[s.next].Release()
+		s.recent[s.next] = p
+		s.next = (s.next + 1) % len(s.recent)
+	}
+	remaining := s.pending[:0]
+	for _, snippet := range s.pending {
+		p.Retain()
+		snippet.packets = append(snippet.packets, p)
+		if snippet.awaiting--; snippet.awaiting > 0 {
+			remaining = append(remaining, snippet)
+		} else {
+			snippet.write()
+		}
+	}
+	s.pending = remaining
+}
+
+// open starts the snippet of an attack on the most recently recorded
+// packet and returns the name of the file it will be written to.
+func (s *attackSnippets) open(flow *types.TcpIpFlow, attack uint64) string {
+	if s == nil {
+		return ""
+	}
+	snippet := attackSnippet{
+		filename: filepath.Join(s.dir, fmt.Sprintf("%s.attack-%d.pcap", flow, attack)),
+		awaiting: s.packets,
+	}
+	snippet.packets = append(snippet.packets, s.recent[s.next:]...)
+	snippet.packets = append(snippet.packets, s.recent[:s.next]...)
+	for _, p := range snippet.packets {
+		p.Retain()
+	}
+	s.pending = append(s.pending, &snippet)
+	return snippet.filename
+}
+
+// flush writes the pending snippets with the packets they have so
+// far and releases the recent packets, as no more are recorded.
+func (s *attackSnippets) flush() {
+	if s == nil {
+		return
+	}
+	for _, snippet := range s.pending {
+		snippet.write()
+	}
+	s.pending = nil
+	for _, p := range s.recent {
+		p.Release()
+	}
+	s.recent = s.recent[:0]
+	s.next = 0
+}
+
+// write writes the snippet and releases its packets.
+func (s *attackSnippet) write() {
+	defer func() {
+		for _, p := range s.packets {
+			p.Release()
+		}
+		s.packets = nil
+	}()
+	f, err := os.Create(s.filename)
+	if err != nil {
+		logging.Warningf("failed to write attack snippet: %s", err)
+		return
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	err = w.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	for _, packet := range s.packets {
+		if err != nil {
+			break
+		}
+		err = w.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     packet.Timestamp,
+			CaptureLength: len(packet.RawPacket),
+			Length:        len(packet.RawPacket),
+		}, packet.RawPacket)
+	}
+	if err != nil {
+		logging.Warningf("failed to write attack snippet %s: %s", s.filename, err)
+	}
+}
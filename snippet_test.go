@@ -0,0 +1,58 @@
+package HoneyBadger
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+func TestAttackSnippets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attackSnippets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.IPv4(1, 2, 3, 4)), layers.NewIPEndpoint(net.IPv4(2, 3, 4, 5)))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(1)), layers.NewTCPPortEndpoint(layers.TCPPort(2)))
+	flow := types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	snippets := newAttackSnippets(1, dir)
+	for i := byte(1); i <= 3; i++ {
+		snippets.record(&types.PacketManifest{Timestamp: time.Unix(int64(i), 0), RawPacket: []byte{i}})
+	}
+	filename := snippets.open(&flow, 1)
+	snippets.record(&types.PacketManifest{Timestamp: time.Unix(4, 0), RawPacket: []byte{4}})
+	snippets.record(&types.PacketManifest{Timestamp: time.Unix(5, 0), RawPacket: []byte{5}})
+	if len(snippets.pending) != 0 {
+		t.Fatal("snippet still pending")
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packets []byte
+	for {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		packets = append(packets, data...)
+	}
+	if string(packets) != "\x02\x03\x04" {
+		t.Errorf("snippet holds packets %v, expected 2, 3 and 4", packets)
+	}
+}
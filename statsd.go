@@ -0,0 +1,245 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+)
+
+const (
+	// STATSD_INTERVAL is the default interval the StatsdEmitter sends metrics at.
+	STATSD_INTERVAL = 10 * time.Second
+	// STATSD_PREFIX is the default prefix of the names of the metrics sent.
+	STATSD_PREFIX = "honeybadger."
+	// STATSD_DATAGRAM_SIZE is the largest datagram of metrics sent, which
+	// fits the MTU of most networks.
+	STATSD_DATAGRAM_SIZE = 1432
+)
+
+// StatsdOptions are the options of a StatsdEmitter: the address of the
+// statsd server, the prefix of the metric names, the tags of all metrics,
+// such as "env:prod", whether the server is DogStatsD and the interval
+// metrics are sent at.
+type StatsdOptions struct {
+	Addr      string
+	Prefix    string
+	Tags      []string
+	DogStatsD bool
+	Interval  time.Duration
+}
+
+// StatsdEmitter is a control plane service sending the metrics the
+// MetricsServer serves to a statsd server every Interval, over UDP:
+//
+//	packets                   c  the packets dispatched
+//	packets.dropped           c  the packets dropped, by stage
+//	connections               g  the connections tracked, by state
+//	connections.opened        c  the connections opened, closed
+//	connections.closed        c  and evicted
+//	connections.evicted       c
+//	attacks                   c  the attacks reported, by type
+//	analysis_errors           c  the connections whose analysis failed
+//	detector.calls            c  the calls into each detector
+//	detector.duration         ms the mean time of the calls over the interval
+//	log_backend.errors        c  the errors of each attack logger backend
+//
+// A DogStatsD server is sent the stage, state, type, detector and
+// backend of a metric as a tag; plain statsd has no tags, so they are
+// appended to the name of the metric instead, as in
+// "honeybadger.connections.data-transfer", and Tags are not sent.
+type StatsdEmitter struct {
+	StatsdOptions
+	Attacks *logging.RecentAttacks
+
+	dispatcher *Dispatcher
+	supervisor *Supervisor
+	timings    *DetectorTimings
+	conn       net.Conn
+	last       *sensorMetrics
+	datagram   bytes.Buffer
+	stopChan   chan bool
+	doneChan   chan bool
+}
+
+// NewStatsdEmitter returns a pointer to a StatsdEmitter struct which will
+// send the metrics of the sensor and the attacks counted by attacks.
+func NewStatsdEmitter(options StatsdOptions, attacks *logging.RecentAttacks) *StatsdEmitter {
+	if options.Interval <= 0 {
+		options.Interval = STATSD_INTERVAL
+	}
+	return &StatsdEmitter{
+		StatsdOptions: options,
+		Attacks:       attacks,
+		stopChan:      make(chan bool),
+		doneChan:      make(chan bool),
+	}
+}
+
+// SetSupervisor hands the emitter the pipeline whose capture drops it sends.
+func (s *StatsdEmitter) SetSupervisor(supervisor *Supervisor) {
+	s.supervisor = supervisor
+}
+
+// Start starts timing the detectors of dispatcher and sending its
+// metrics; if the address does not resolve the error is logged and
+// nothing is sent.
+func (s *StatsdEmitter) Start(dispatcher *Dispatcher) {
+	s.dispatcher = dispatcher
+	s.timings = dispatcher.TimeDetectors()
+	conn, err := net.Dial("udp", s.Addr)
+	if err != nil {
+		logging.Errorf("statsd emitter disabled: %s", err)
+		close(s.doneChan)
+		return
+	}
+	s.conn = conn
+	go s.run()
+}
+
+// Stop stops sending metrics.
+func (s *StatsdEmitter) Stop() {
+	close(s.stopChan)
+	<-s.doneChan
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *StatsdEmitter) run() {
+	defer close(s.doneChan)
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case <-ticker.C:
+			s.emit()
+		}
+	}
+}
+
+// emit sends the metrics gathered now, the counters as their increments
+// since they were last sent.
+func (s *StatsdEmitter) emit() {
+	metrics := gatherMetrics(s.dispatcher, s.supervisor, s.timings, s.Attacks)
+	last := s.last
+	if last == nil {
+		last = &sensorMetrics{}
+	}
+	s.last = metrics
+
+	s.counter("packets", "", "", metrics.Packets, last.Packets)
+	s.counter("packets.dropped", "stage", "capture", metrics.CaptureDrops, last.CaptureDrops)
+	s.counter("packets.dropped", "stage", "workers", metrics.WorkerDrops, last.WorkerDrops)
+
+	for _, state := range sortedKeys(metrics.Tracker.ByState) {
+		s.send("connections", "state", state, strconv.Itoa(metrics.Tracker.ByState[state]), "g")
+	}
+	for _, state := range sortedKeys(last.Tracker.ByState) {
+		if _, ok := metrics.Tracker.ByState[state]; !ok {
+			s.send("connections", "state", state, "0", "g")
+		}
+	}
+	s.counter("connections.opened", "", "", metrics.Tracker.Opened, last.Tracker.Opened)
+	s.counter("connections.closed", "", "", metrics.Tracker.Closed, last.Tracker.Closed)
+	s.counter("connections.evicted", "", "", metrics.Tracker.Evictions, last.Tracker.Evictions)
+
+	for _, attack := range sortedCounts(metrics.Attacks) {
+		s.counter("attacks", "type", attack, metrics.Attacks[attack], last.Attacks[attack])
+	}
+	s.counter("analysis_errors", "", "", metrics.AnalysisErrors, last.AnalysisErrors)
+
+	for _, name := range detectorNames {
+		timing, previous := metrics.Detectors[name], last.Detectors[name]
+		calls := timing.Calls - previous.Calls
+		s.counter("detector.calls", "detector", name, timing.Calls, previous.Calls)
+		if calls != 0 && timing.Calls >= previous.Calls {
+			milliseconds := (timing.Seconds - previous.Seconds) * 1000 / float64(calls)
+			s.send("detector.duration", "detector", name, strconv.FormatFloat(milliseconds, 'f', -1, 64), "ms")
+		}
+	}
+
+	for _, backend := range sortedCounts(metrics.BackendErrors) {
+		s.counter("log_backend.errors", "backend", backend, metrics.BackendErrors[backend], last.BackendErrors[backend])
+	}
+	s.flush()
+}
+
+// counter sends the increment of a counter from previous to value, or
+// value if the counter was reset in between.
+func (s *StatsdEmitter) counter(name, key, label string, value, previous uint64) {
+	if value >= previous {
+		value -= previous
+	}
+	s.send(name, key, label, strconv.FormatUint(value, 10), "c")
+}
+
+// statsdEscaper replaces the characters of the statsd protocol in metric
+// names and tags.
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_")
+
+// send queues a metric of the given value and type, labelled key:label if
+// key is set, sending the datagram it is queued in once it is full.
+func (s *StatsdEmitter) send(name, key, label, value, kind string) {
+	var line bytes.Buffer
+	line.WriteString(s.Prefix + name)
+	var tags []string
+	if key != "" {
+		if s.DogStatsD {
+			tags = append(tags, key+":"+statsdEscaper.Replace(label))
+		} else {
+			line.WriteString("." + strings.Replace(statsdEscaper.Replace(label), ".", "_", -1))
+		}
+	}
+	line.WriteString(":" + value + "|" + kind)
+	if s.DogStatsD {
+		tags = append(tags, s.Tags...)
+		sort.Strings(tags)
+		if len(tags) != 0 {
+			line.WriteString("|#" + strings.Join(tags, ","))
+		}
+	}
+	if s.datagram.Len() != 0 && s.datagram.Len()+1+line.Len() > STATSD_DATAGRAM_SIZE {
+		s.flush()
+	}
+	if s.datagram.Len() != 0 {
+		s.datagram.WriteByte('\n')
+	}
+	s.datagram.Write(line.Bytes())
+}
+
+// flush sends the metrics queued.
+func (s *StatsdEmitter) flush() {
+	if s.datagram.Len() == 0 {
+		return
+	}
+	if _, err := s.conn.Write(s.datagram.Bytes()); err != nil {
+		logging.Warningf("statsd emitter: %s", err)
+	}
+	s.datagram.Reset()
+}
@@ -0,0 +1,117 @@
+package HoneyBadger
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket/layers"
+)
+
+// statsdLines returns the metrics of the datagrams received until none
+// arrive for a while.
+func statsdLines(t *testing.T, server net.PacketConn) map[string]bool {
+	lines := make(map[string]bool)
+	buffer := make([]byte, 65536)
+	for {
+		server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := server.ReadFrom(buffer)
+		if err != nil {
+			return lines
+		}
+		if n > STATSD_DATAGRAM_SIZE {
+			t.Errorf("datagram of %d bytes", n)
+		}
+		for _, line := range strings.Split(string(buffer[:n]), "\n") {
+			lines[line] = true
+		}
+	}
+}
+
+func TestStatsdEmitter(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	options := DispatcherOptions{
+		Logger:         NewDummyAttackLogger(),
+		MaxRingPackets: 40,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+	attacks := logging.NewRecentAttacks(1)
+	emitter := NewStatsdEmitter(StatsdOptions{
+		Addr:     server.LocalAddr().String(),
+		Prefix:   STATSD_PREFIX,
+		Interval: time.Hour,
+	}, attacks)
+	emitter.Start(dispatcher)
+	defer emitter.Stop()
+
+	_, packet := newTestConnection(options.Logger)
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	dispatcher.ReceivePacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true}, []byte{}))
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{}))
+	attacks.Log(&types.Event{Type: "injection"})
+	dispatcher.LiveConnections()
+
+	emitter.emit()
+	lines := statsdLines(t, server)
+	for _, line := range []string{
+		"honeybadger.packets:3|c",
+		"honeybadger.packets.dropped.workers:0|c",
+		"honeybadger.connections.data-transfer:1|g",
+		"honeybadger.attacks.injection:1|c",
+	} {
+		if !lines[line] {
+			t.Errorf("metrics lack %q: %v", line, lines)
+		}
+	}
+
+	// counters are sent as their increments, and with DogStatsD
+	// labelled with tags
+	emitter.DogStatsD = true
+	emitter.Tags = []string{"env:test"}
+	dispatcher.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 100, ACK: true}, []byte{}))
+	dispatcher.LiveConnections()
+	emitter.emit()
+	lines = statsdLines(t, server)
+	for _, line := range []string{
+		"honeybadger.packets:1|c|#env:test",
+		"honeybadger.connections:1|g|#env:test,state:data-transfer",
+		"honeybadger.attacks:0|c|#env:test,type:injection",
+	} {
+		if !lines[line] {
+			t.Errorf("metrics lack %q: %v", line, lines)
+		}
+	}
+}
+
+func TestStatsdDatagramSize(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	emitter := NewStatsdEmitter(StatsdOptions{Prefix: STATSD_PREFIX}, nil)
+	emitter.conn = conn
+	for i := 0; i < 200; i++ {
+		emitter.send("attacks", "type", "a.b:c", "1", "c")
+	}
+	emitter.flush()
+	lines := statsdLines(t, server)
+	if len(lines) != 1 || !lines["honeybadger.attacks.a_b_c:1|c"] {
+		t.Errorf("metrics %v", lines)
+	}
+}
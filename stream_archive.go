@@ -0,0 +1,230 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// StreamArchive retains the complete reassembled content of one direction
+// of a TCP connection so that the whole conversation preceding an attack
+// can be archived as evidence. Content is held in memory until it exceeds
+// SpillBytes, after which it is spilled to a temporary file in SpillDir.
+// A nil StreamArchive retains nothing.
+//
+// Stream data is recorded in sequence order; retransmitted bytes are
+// skipped and holes left by lost segments are skipped over and counted.
+type StreamArchive struct {
+	SpillBytes int
+	SpillDir   string
+
+	next   types.Sequence
+	size   int64
+	gaps   int
+	memory bytes.Buffer
+	file   *os.File
+	err    error
+}
+
+// NewStreamArchive returns a StreamArchive which spills to a temporary
+// file in spillDir once more than spillBytes have been recorded.
+// If spillBytes <= 0 the content is always kept in memory.
+func NewStreamArchive(spillBytes int, spillDir string) *StreamArchive {
+	return &StreamArchive{
+		SpillBytes: spillBytes,
+		SpillDir:   spillDir,
+		next:       types.InvalidSequence,
+	}
+}
+
+// Size returns the number of stream bytes recorded.
+func (a *StreamArchive) Size() int64 {
+	if a == nil {
+		return 0
+	}
+	return a.size
+}
+
+// Gaps returns the number of holes skipped over in the recorded stream.
+func (a *StreamArchive) Gaps() int {
+	if a == nil {
+		return 0
+	}
+	return a.gaps
+}
+
+// Spilled returns true if the content has been spilled to disk.
+func (a *StreamArchive) Spilled() bool {
+	return a != nil && a.file != nil
+}
+
+// Err returns the first error encountered while spilling to disk;
+// once it has occurred no further content is recorded.
+func (a *StreamArchive) Err() error {
+	if a == nil {
+		return nil
+	}
+	return a.err
+}
+
+// record appends the part of the segment beyond the content already recorded.
+func (a *StreamArchive) record(seq types.Sequence, payload []byte) {
+	if a == nil || a.err != nil {
+		return
+	}
+	payload, gap := advanceStream(&a.next, seq, payload)
+	if len(payload) == 0 {
+		return
+	}
+	if gap {
+		a.gaps++
+	}
+	a.size += int64(len(payload))
+
+	if a.file == nil {
+		a.memory.Write(payload)
+		if a.SpillBytes <= 0 || a.memory.Len() <= a.SpillBytes {
+			return
+		}
+		a.file, a.err = ioutil.TempFile(a.SpillDir, "honeyBadger-stream-")
+		if a.err != nil {
+			return
+		}
+		_, a.err = a.memory.WriteTo(a.file)
+		a.memory.Reset()
+		return
+	}
+	_, a.err = a.file.Write(payload)
+}
+
+// advanceStream returns the part of the segment starting at seq which lies
+// beyond next, the sequence following the stream content already consumed,
+// and advances next past it. gap is true if the segment starts beyond next.
+// A next of InvalidSequence accepts any segment.
+func advanceStream(next *types.Sequence, seq types.Sequence, payload []byte) (fresh []byte, gap bool) {
+	if len(payload) == 0 {
+		return nil, false
+	}
+	if *next != types.InvalidSequence {
+		diff := next.Difference(seq)
+		if diff < 0 {
+			if -diff >= len(payload) {
+				return nil, false
+			}
+			payload = payload[-diff:]
+			seq = *next
+		} else if diff > 0 {
+			gap = true
+		}
+	}
+	*next = seq.Add(len(payload))
+	return payload, gap
+}
+
+// WriteTo writes the recorded stream content to w.
+func (a *StreamArchive) WriteTo(w io.Writer) (int64, error) {
+	if a == nil {
+		return 0, nil
+	}
+	if a.err != nil {
+		return 0, a.err
+	}
+	if a.file == nil {
+		return io.Copy(w, bytes.NewReader(a.memory.Bytes()))
+	}
+	if _, err := a.file.Seek(0, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, a.file)
+	if _, seekErr := a.file.Seek(0, os.SEEK_END); err == nil {
+		err = seekErr
+	}
+	return n, err
+}
+
+// Save writes the recorded stream content to the named file.
+func (a *StreamArchive) Save(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	_, err = a.WriteTo(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// SaveCompressed hands the recorded stream content to compressor to be
+// written to the named file in the background, after which the content
+// is discarded. It returns false, leaving the content in place, if the
+// compressor can not take it.
+func (a *StreamArchive) SaveCompressed(compressor types.Compressor, filename string) bool {
+	if a == nil || a.err != nil {
+		return false
+	}
+	if a.file == nil {
+		content := append([]byte(nil), a.memory.Bytes()...)
+		if !compressor.Compress(ioutil.NopCloser(bytes.NewReader(content)), filename, nil) {
+			return false
+		}
+		a.memory.Reset()
+		return true
+	}
+	if _, err := a.file.Seek(0, os.SEEK_SET); err != nil {
+		return false
+	}
+	spill := &spillFile{a.file}
+	if !compressor.Compress(spill, filename, nil) {
+		a.file.Seek(0, os.SEEK_END)
+		return false
+	}
+	a.file = nil
+	return true
+}
+
+// spillFile is a spill file which is removed once closed.
+type spillFile struct {
+	*os.File
+}
+
+func (f *spillFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// Remove discards the recorded content and removes any spill file.
+func (a *StreamArchive) Remove() {
+	if a == nil {
+		return
+	}
+	a.memory.Reset()
+	if a.file != nil {
+		a.file.Close()
+		os.Remove(a.file.Name())
+		a.file = nil
+	}
+}
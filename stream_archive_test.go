@@ -0,0 +1,142 @@
+package HoneyBadger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+func TestStreamArchiveSpills(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := NewStreamArchive(4, dir)
+	stream := NewStreamBuffer(1, 0)
+	stream.Archive = archive
+	stream.Add(&types.Reassembly{Seq: 10, Bytes: []byte{1, 2, 3}})
+	if archive.Spilled() {
+		t.Error("archive spilled before reaching its threshold")
+	}
+	// retransmission overlapping recorded content
+	stream.Add(&types.Reassembly{Seq: 12, Bytes: []byte{3, 4, 5}})
+	if !archive.Spilled() {
+		t.Error("archive did not spill beyond its threshold")
+	}
+	// a hole in the stream
+	stream.Add(&types.Reassembly{Seq: 20, Bytes: []byte{6, 7}})
+	if archive.Size() != 7 || archive.Gaps() != 1 {
+		t.Errorf("archive has %d bytes and %d gaps, expected 7 and 1", archive.Size(), archive.Gaps())
+	}
+
+	filename := filepath.Join(dir, "stream")
+	if err := archive.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, []byte{1, 2, 3, 4, 5, 6, 7}) {
+		t.Errorf("archived stream %v not correct", contents)
+	}
+
+	archive.Remove()
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("spill file was not removed; %d files remain", len(files))
+	}
+}
+
+func TestStreamArchiveSaveCompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	compressor, err := logging.NewFileCompressor("gzip", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := NewStreamArchive(2, dir)
+	archive.record(10, []byte{1, 2, 3})
+	if !archive.Spilled() {
+		t.Fatal("archive did not spill beyond its threshold")
+	}
+	filename := filepath.Join(dir, "stream.gz")
+	if !archive.SaveCompressed(compressor, filename) {
+		t.Fatal("compressor refused the archive")
+	}
+	archive.Remove()
+	compressor.Stop()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(contents, []byte{1, 2, 3}) {
+		t.Errorf("archived stream %v not correct: %v", contents, err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("spill file was not removed; %d files remain", len(files))
+	}
+}
+
+func TestConnectionArchivesStreamsPerConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := DispatcherOptions{
+		MaxRingPackets: 40,
+		RetainStreams:  true,
+		LogDir:         dir,
+		ArchiveDir:     dir,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	_, packet := newTestConnection(nil)
+	// two attacked connections of the same flow, the port reused
+	started := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	for n := 0; n < 2; n++ {
+		dispatch := func(fromClient bool, tcp layers.TCP, payload []byte) {
+			p := packet(fromClient, tcp, payload)
+			p.Timestamp = started.Add(time.Duration(n) * time.Minute)
+			dispatcher.dispatchPacket(p)
+		}
+		dispatch(true, layers.TCP{Seq: 99, SYN: true}, []byte{})
+		dispatch(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true}, []byte{})
+		dispatch(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{})
+		dispatch(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte("honey"))
+		conn := dispatcher.Connections()[0].(*Connection)
+		conn.attackDetected = true
+		dispatcher.closeConnectionList([]ConnectionInterface{conn})
+	}
+
+	for n := 0; n < 2; n++ {
+		name := "1.2.3.4:1-2.3.4.5:2" + ".stream." + started.Add(time.Duration(n)*time.Minute).Format(logging.ROTATE_TIME_LAYOUT)
+		if content, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(content) != "honey" {
+			t.Errorf("stream %s archived as %q, %v", name, content, err)
+		}
+	}
+}
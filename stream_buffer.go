@@ -0,0 +1,310 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"time"
+
+	"github.com/david415/HoneyBadger/blocks"
+	"github.com/david415/HoneyBadger/types"
+)
+
+// StreamBuffer is a page based record of one direction of a TCP connection,
+// kept the way the receiving end would have reassembled it. Each page is a
+// segment of stream data; pages are kept in sequence order and never overlap,
+// the first copy of any stream byte wins just as it does for the receiver.
+// Holes left by lost or not yet received segments are tracked as gaps.
+//
+// The buffer grows as pages are added and sheds its lowest sequence pages
+// once it holds more than MaxPages pages or MaxBytes payload bytes.
+// Limits <= 0 are ignored. Retained bytes are also charged against Budget,
+// a memory budget shared with other buffers, if it is set.
+//
+// If Archive or Reader are set, every segment added is also recorded
+// there in full, regardless of the limits above.
+type StreamBuffer struct {
+	MaxPages int
+	MaxBytes int
+	Budget   *MemoryBudget
+	Archive  *StreamArchive
+	Reader   *StreamReader
+
+	pages     []*types.Reassembly
+	bytes     int
+	overlaps  []blocks.BlockSegment
+	spare     *types.Reassembly
+	overdrawn bool
+}
+
+// NewStreamBuffer returns a StreamBuffer bounded by the given page and byte limits.
+func NewStreamBuffer(maxPages, maxBytes int) *StreamBuffer {
+	return &StreamBuffer{
+		MaxPages: maxPages,
+		MaxBytes: maxBytes,
+		pages:    make([]*types.Reassembly, 0, initialRingSize(maxPages)),
+	}
+}
+
+// Len returns the number of pages currently retained.
+func (s *StreamBuffer) Len() int {
+	return len(s.pages)
+}
+
+// Bytes returns the number of payload bytes currently retained.
+func (s *StreamBuffer) Bytes() int {
+	return s.bytes
+}
+
+// Pages returns the retained pages in sequence order.
+// The returned slice must not be modified.
+func (s *StreamBuffer) Pages() []*types.Reassembly {
+	return s.pages
+}
+
+// Last returns the page with the highest sequence number or nil
+// if the buffer is empty.
+func (s *StreamBuffer) Last() *types.Reassembly {
+	if len(s.pages) == 0 {
+		return nil
+	}
+	return s.pages[len(s.pages)-1]
+}
+
+// Add records a stream segment. Any part of the segment that is already
+// covered by a retained page is discarded; if nothing needs to be discarded
+// the given Reassembly itself is retained so that callers may still
+// annotate it afterwards. Retained payload is always copied into a pooled
+// buffer owned by the StreamBuffer, so callers are free to reuse theirs.
+func (s *StreamBuffer) Add(reassembly *types.Reassembly) {
+	if len(reassembly.Bytes) == 0 {
+		return
+	}
+	s.Archive.record(reassembly.Seq, reassembly.Bytes)
+	s.Reader.record(reassembly.Seq, reassembly.Bytes)
+	if s.Budget.refuse(len(reassembly.Bytes)) {
+		return
+	}
+	start := reassembly.Seq
+	end := reassembly.Seq.Add(len(reassembly.Bytes))
+
+	// fast path: stream data arriving in order
+	last := s.Last()
+	if last == nil || last.Seq.Add(len(last.Bytes)).Difference(start) >= 0 {
+		reassembly.Bytes = getSegmentBuffer(reassembly.Bytes)
+		s.pages = append(s.pages, reassembly)
+		s.bytes += len(reassembly.Bytes)
+		s.charge(len(reassembly.Bytes))
+		s.trim()
+		return
+	}
+
+	// carve the segment into the pieces not yet covered by a page
+	i := s.search(start)
+	cursor := start
+	for ; i < len(s.pages) && cursor.Difference(end) > 0; i++ {
+		pageStart := s.pages[i].Seq
+		pageEnd := pageStart.Add(len(s.pages[i].Bytes))
+		if pageEnd.Difference(cursor) >= 0 {
+			continue
+		}
+		if cursor.Difference(pageStart) > 0 {
+			pieceEnd := pageStart
+			if pieceEnd.Difference(end) < 0 {
+				pieceEnd = end
+			}
+			s.insertAt(i, s.piece(reassembly, cursor, pieceEnd))
+			i++
+		}
+		cursor = pageEnd
+	}
+	if cursor.Difference(end) > 0 {
+		s.insertAt(i, s.piece(reassembly, cursor, end))
+	}
+	s.trim()
+}
+
+// Append records a segment of stream data seen at the given time,
+// reusing the record of the page shed last if there is one. It spares
+// the in-order packets of a connection an allocation each.
+func (s *StreamBuffer) Append(seq types.Sequence, bytes []byte, seen time.Time) {
+	page := s.spare
+	if page == nil {
+		page = &types.Reassembly{}
+	}
+	s.spare = nil
+	*page = types.Reassembly{
+		Seq:   seq,
+		Bytes: bytes,
+		Seen:  seen,
+	}
+	s.Add(page)
+}
+
+// piece returns a Reassembly covering the stream range [start, end) of
+// reassembly with its own pooled copy of the payload; when that
+// is the whole segment reassembly itself is returned.
+func (s *StreamBuffer) piece(reassembly *types.Reassembly, start, end types.Sequence) *types.Reassembly {
+	if start == reassembly.Seq && end == reassembly.Seq.Add(len(reassembly.Bytes)) {
+		reassembly.Bytes = getSegmentBuffer(reassembly.Bytes)
+		return reassembly
+	}
+	p := *reassembly
+	p.Seq = start
+	p.Bytes = getSegmentBuffer(reassembly.Bytes[reassembly.Seq.Difference(start):reassembly.Seq.Difference(end)])
+	return &p
+}
+
+func (s *StreamBuffer) insertAt(i int, page *types.Reassembly) {
+	s.pages = append(s.pages, nil)
+	copy(s.pages[i+1:], s.pages[i:])
+	s.pages[i] = page
+	s.bytes += len(page.Bytes)
+	s.charge(len(page.Bytes))
+}
+
+// charge charges n retained bytes against the budget, noting whether
+// they pushed it over under the drop connection policy.
+func (s *StreamBuffer) charge(n int) {
+	s.Budget.charge(n)
+	if s.Budget.mustDrop() {
+		s.overdrawn = true
+	}
+}
+
+// Overdrawn returns true if the buffer retained stream data which
+// exceeded the budget while its policy is to drop the connection.
+func (s *StreamBuffer) Overdrawn() bool {
+	return s.overdrawn
+}
+
+// search returns the index of the first page which ends after seq.
+func (s *StreamBuffer) search(seq types.Sequence) int {
+	lo, hi := 0, len(s.pages)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		pageEnd := s.pages[mid].Seq.Add(len(s.pages[mid].Bytes))
+		if pageEnd.Difference(seq) >= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// Shrink lowers the page limit of the buffer to maxPages if it is
+// higher or unlimited, shedding the lowest sequence pages beyond it.
+func (s *StreamBuffer) Shrink(maxPages int) {
+	if maxPages > 0 && (s.MaxPages <= 0 || s.MaxPages > maxPages) {
+		s.MaxPages = maxPages
+		s.trim()
+	}
+}
+
+// trim sheds the lowest sequence pages until the buffer is within its limits
+// and, if the budget's policy says so, until the shared budget is met.
+// The highest sequence page is always retained.
+func (s *StreamBuffer) trim() {
+	drop := 0
+	for drop < len(s.pages)-1 &&
+		((s.MaxPages > 0 && len(s.pages)-drop > s.MaxPages) || (s.MaxBytes > 0 && s.bytes > s.MaxBytes) || s.Budget.mustEvict()) {
+		s.bytes -= len(s.pages[drop].Bytes)
+		s.Budget.release(len(s.pages[drop].Bytes))
+		putSegmentBuffer(s.pages[drop].Bytes)
+		*s.pages[drop] = types.Reassembly{}
+		s.spare = s.pages[drop]
+		s.pages[drop] = nil
+		drop++
+	}
+	if drop > 0 {
+		s.pages = append(s.pages[:0], s.pages[drop:]...)
+	}
+}
+
+// Overlaps returns, in sequence order, the retained stream data
+// overlapping the range [start, end). The returned bytes alias pooled
+// page buffers and must be copied if they are to outlive the next Add.
+// The returned slice itself is reused by the next call to Overlaps.
+func (s *StreamBuffer) Overlaps(start, end types.Sequence) []blocks.BlockSegment {
+	acc := s.overlaps[:0]
+	for i := s.search(start); i < len(s.pages); i++ {
+		page := s.pages[i]
+		if page.Seq.Difference(end) <= 0 {
+			break
+		}
+		// the overlap of [start, end) with the page, which is contiguous
+		// so its bytes are sliced out of the page rather than copied
+		pageEnd := page.Seq.Add(len(page.Bytes))
+		left, right := start, end
+		if page.Seq.GreaterThan(left) {
+			left = page.Seq
+		}
+		if pageEnd.LessThan(right) {
+			right = pageEnd
+		}
+		if !right.GreaterThan(left) {
+			continue
+		}
+		acc = append(acc, blocks.BlockSegment{
+			Block:         blocks.Block{A: left, B: right},
+			Bytes:         page.Bytes[page.Seq.Difference(left):page.Seq.Difference(right)],
+			IsCoalesce:    page.IsCoalesce,
+			IsCoalesceGap: page.IsCoalesceGap,
+		})
+	}
+	s.overlaps = acc
+	return acc
+}
+
+// Contiguous returns the retained stream as ranges of contiguous data;
+// adjacent pages are merged into a single block.
+func (s *StreamBuffer) Contiguous() blocks.Blocks {
+	var result blocks.Blocks
+	for _, page := range s.pages {
+		pageEnd := page.Seq.Add(len(page.Bytes))
+		if n := len(result); n > 0 && result[n-1].B == page.Seq {
+			result[n-1].B = pageEnd
+			continue
+		}
+		result = append(result, blocks.Block{A: page.Seq, B: pageEnd})
+	}
+	return result
+}
+
+// Gaps returns the holes between the retained ranges of contiguous data.
+func (s *StreamBuffer) Gaps() blocks.Blocks {
+	var result blocks.Blocks
+	contiguous := s.Contiguous()
+	for i := 1; i < len(contiguous); i++ {
+		result = append(result, blocks.Block{A: contiguous[i-1].B, B: contiguous[i].A})
+	}
+	return result
+}
+
+// Reset releases all retained pages and returns their buffers to the pool.
+func (s *StreamBuffer) Reset() {
+	for i := range s.pages {
+		putSegmentBuffer(s.pages[i].Bytes)
+		s.pages[i] = nil
+	}
+	s.pages = s.pages[:0]
+	s.Budget.release(s.bytes)
+	s.bytes = 0
+}
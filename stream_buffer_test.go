@@ -0,0 +1,163 @@
+package HoneyBadger
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/blocks"
+	"github.com/david415/HoneyBadger/types"
+)
+
+func TestStreamBufferOutOfOrder(t *testing.T) {
+	stream := NewStreamBuffer(0, 0)
+	stream.Add(&types.Reassembly{Seq: 20, Bytes: []byte{20, 21, 22, 23, 24}})
+	stream.Add(&types.Reassembly{Seq: 10, Bytes: []byte{10, 11, 12, 13, 14}})
+	stream.Add(&types.Reassembly{Seq: 30, Bytes: []byte{30, 31}})
+
+	gaps := stream.Gaps()
+	want := blocks.Blocks{{A: 15, B: 20}, {A: 25, B: 30}}
+	if len(gaps) != len(want) || gaps[0] != want[0] || gaps[1] != want[1] {
+		t.Errorf("gaps %s, expected %s", gaps, want)
+		t.Fail()
+	}
+
+	// retransmission spanning a gap; only the gap is retained
+	stream.Add(&types.Reassembly{Seq: 12, Bytes: []byte{0, 0, 0, 15, 16, 17, 18, 19, 0, 0}})
+	if stream.Len() != 4 || stream.Bytes() != 17 {
+		t.Errorf("stream has %d pages and %d bytes, expected 4 and 17", stream.Len(), stream.Bytes())
+		t.Fail()
+	}
+	contiguous := stream.Contiguous()
+	if len(contiguous) != 2 || contiguous[0] != (blocks.Block{A: 10, B: 25}) {
+		t.Errorf("contiguous %s not correct", contiguous)
+		t.Fail()
+	}
+	overlaps := stream.Overlaps(13, 22)
+	acc := []byte{}
+	for _, overlap := range overlaps {
+		acc = append(acc, overlap.Bytes...)
+	}
+	if !bytes.Equal(acc, []byte{13, 14, 15, 16, 17, 18, 19, 20, 21}) {
+		t.Errorf("ordered view %v not correct", acc)
+		t.Fail()
+	}
+}
+
+func TestStreamBufferLimits(t *testing.T) {
+	stream := NewStreamBuffer(3, 8)
+	for i := 0; i < 5; i++ {
+		stream.Add(&types.Reassembly{Seq: types.Sequence(i * 2), Bytes: []byte{1, 2}})
+	}
+	if stream.Len() != 3 || stream.Pages()[0].Seq != 4 {
+		t.Errorf("stream retained %d pages starting at %d", stream.Len(), stream.Pages()[0].Seq)
+		t.Fail()
+	}
+	stream.Add(&types.Reassembly{Seq: 10, Bytes: []byte{1, 2, 3, 4, 5, 6}})
+	if stream.Bytes() > 8 || stream.Last().Seq != 10 {
+		t.Errorf("stream holds %d bytes", stream.Bytes())
+		t.Fail()
+	}
+}
+
+func TestStreamBufferBudget(t *testing.T) {
+	budget := NewMemoryBudget(6, RETENTION_STOP)
+	a := NewStreamBuffer(0, 0)
+	b := NewStreamBuffer(0, 0)
+	a.Budget = budget
+	b.Budget = budget
+	a.Add(&types.Reassembly{Seq: 0, Bytes: []byte{1, 2, 3, 4}})
+	b.Add(&types.Reassembly{Seq: 0, Bytes: []byte{1, 2, 3, 4}})
+	if b.Len() != 0 || budget.Used() != 4 {
+		t.Errorf("budget used %d, expected 4", budget.Used())
+		t.Fail()
+	}
+
+	budget.Policy = RETENTION_EVICT_OLDEST
+	b.Add(&types.Reassembly{Seq: 0, Bytes: []byte{1, 2}})
+	b.Add(&types.Reassembly{Seq: 2, Bytes: []byte{3, 4}})
+	if b.Len() != 1 || budget.Used() != 6 {
+		t.Errorf("stream has %d pages with budget used %d, expected 1 and 6", b.Len(), budget.Used())
+		t.Fail()
+	}
+	a.Reset()
+	if budget.Used() != 2 {
+		t.Errorf("budget used %d after reset, expected 2", budget.Used())
+		t.Fail()
+	}
+}
+
+func TestStreamBufferWraps(t *testing.T) {
+	stream := NewStreamBuffer(0, 0)
+	stream.Add(&types.Reassembly{Seq: 0xFFFFFFFC, Bytes: []byte{1, 2, 3, 4}})
+	stream.Add(&types.Reassembly{Seq: 4, Bytes: []byte{9, 10}})
+	stream.Add(&types.Reassembly{Seq: 0, Bytes: []byte{5, 6, 7, 8}})
+
+	contiguous := stream.Contiguous()
+	if len(contiguous) != 1 || contiguous[0] != (blocks.Block{A: 0xFFFFFFFC, B: 6}) {
+		t.Errorf("contiguous %s not correct", contiguous)
+		t.Fail()
+	}
+	acc := []byte{}
+	for _, overlap := range stream.Overlaps(0xFFFFFFFE, 5) {
+		acc = append(acc, overlap.Bytes...)
+	}
+	if !bytes.Equal(acc, []byte{3, 4, 5, 6, 7, 8, 9}) {
+		t.Errorf("overlap bytes %v not correct", acc)
+		t.Fail()
+	}
+
+	events, err := checkForInjection(stream, 0xFFFFFFFE, 2, []byte{3, 4, 0, 0})
+	if err != nil {
+		t.Fatalf("injection check failed: %s", err)
+	}
+	if len(events) != 1 || events[0].Start != 0 || events[0].End != 2 {
+		t.Errorf("expected a single injection at [0, 2) across the wrap, got %v", events)
+		t.Fail()
+	}
+}
+
+func TestStreamBufferOverlapAllocations(t *testing.T) {
+	stream := NewStreamBuffer(0, 0)
+	for i := 0; i < 4; i++ {
+		stream.Add(&types.Reassembly{Seq: types.Sequence(10 + i*4), Bytes: []byte{1, 2, 3, 4}})
+	}
+	retransmission := []byte{3, 4, 1, 2, 3, 4, 1, 2}
+	allocs := testing.AllocsPerRun(100, func() {
+		events, err := checkForInjection(stream, 12, 20, retransmission)
+		if err != nil || len(events) != 0 {
+			t.Fatalf("retransmission flagged: %v %s", events, err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("checking a retransmission allocated %.1f times", allocs)
+	}
+
+	retransmission[3] = 0
+	events, err := checkForInjection(stream, 12, 20, retransmission)
+	if err != nil || len(events) != 1 || events[0].Start != 14 || events[0].End != 18 {
+		t.Fatalf("expected a single injection at [14, 18), got %v %v", events, err)
+	}
+	retransmission[3] = 9
+	if !bytes.Equal(events[0].Loser, []byte{1, 0, 3, 4}) || !bytes.Equal(events[0].Winner, []byte{1, 2, 3, 4}) {
+		t.Errorf("event bytes alias the packet: loser %v winner %v", events[0].Loser, events[0].Winner)
+	}
+}
+
+func TestStreamBufferAppend(t *testing.T) {
+	stream := NewStreamBuffer(2, 0)
+	payload := []byte{1, 2}
+	stream.Append(10, payload, time.Time{})
+	stream.Append(12, payload, time.Time{})
+	shed := stream.Pages()[0]
+	stream.Append(14, payload, time.Time{})
+	stream.Append(16, payload, time.Time{})
+	payload[0] = 9
+	if stream.Len() != 2 || stream.Pages()[1] != shed || shed.Seq != 16 || !bytes.Equal(shed.Bytes, []byte{1, 2}) {
+		t.Errorf("page shed not reused for the segment appended: %+v", stream.Pages())
+	}
+	contiguous := stream.Contiguous()
+	if len(contiguous) != 1 || contiguous[0] != (blocks.Block{A: 14, B: 18}) {
+		t.Errorf("contiguous %s not correct", contiguous)
+	}
+}
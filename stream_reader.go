@@ -0,0 +1,112 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// ErrStreamReaderOverflow is returned by a StreamReader once its buffered
+// data has been read if stream data had to be dropped because the reader
+// was not keeping up.
+var ErrStreamReaderOverflow = errors.New("stream reader overflow: stream data was dropped")
+
+// StreamReader is an io.Reader over one direction of the stream data
+// reassembled by a Connection. Read blocks until stream data is available
+// or the connection is closed, after which it returns io.EOF.
+//
+// The connection never waits for the reader; data is buffered until it is
+// read, up to MaxBytes if that is > 0. Stream data beyond that is dropped
+// and reported by Read returning ErrStreamReaderOverflow.
+type StreamReader struct {
+	MaxBytes int
+
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	buffer   bytes.Buffer
+	next     types.Sequence
+	closed   bool
+	overflow bool
+}
+
+// NewStreamReader returns a StreamReader buffering at most maxBytes of unread data.
+func NewStreamReader(maxBytes int) *StreamReader {
+	r := StreamReader{
+		MaxBytes: maxBytes,
+		next:     types.InvalidSequence,
+	}
+	r.cond = sync.NewCond(&r.mutex)
+	return &r
+}
+
+// Read reads reassembled stream data into p.
+func (r *StreamReader) Read(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for r.buffer.Len() == 0 && !r.closed && !r.overflow {
+		r.cond.Wait()
+	}
+	if r.buffer.Len() > 0 {
+		return r.buffer.Read(p)
+	}
+	if r.overflow {
+		return 0, ErrStreamReaderOverflow
+	}
+	return 0, io.EOF
+}
+
+// record makes the part of the segment beyond the data already
+// delivered available to Read.
+func (r *StreamReader) record(seq types.Sequence, payload []byte) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed || r.overflow {
+		return
+	}
+	payload, _ = advanceStream(&r.next, seq, payload)
+	if len(payload) == 0 {
+		return
+	}
+	if r.MaxBytes > 0 && r.buffer.Len()+len(payload) > r.MaxBytes {
+		r.overflow = true
+	} else {
+		r.buffer.Write(payload)
+	}
+	r.cond.Broadcast()
+}
+
+// close causes Read to return io.EOF once the buffered data has been read.
+func (r *StreamReader) close() {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+}
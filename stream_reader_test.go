@@ -0,0 +1,90 @@
+package HoneyBadger
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket/layers"
+)
+
+func TestConnectionStreamReader(t *testing.T) {
+	options := ConnectionOptions{
+		MaxRingPackets: 40,
+		LogDir:         "fake-log-dir",
+		AttackLogger:   NewDummyAttackLogger(),
+		StreamReaders:  true,
+	}
+	f := &DefaultConnFactory{}
+	conn := f.Build(options).(*Connection)
+	if conn.ClientStream() == nil || conn.ServerStream() == nil {
+		t.Fatal("stream readers were not created")
+	}
+
+	conn.state = TCP_DATA_TRANSFER
+	ip := layers.IPv4{
+		SrcIP:    net.IP{1, 2, 3, 4},
+		DstIP:    net.IP{2, 3, 4, 5},
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+	}
+	flow := types.NewTcpIp4FlowFromLayers(ip, layers.TCP{SrcPort: 1, DstPort: 2})
+	conn.serverFlow = flow
+	flo := flow.Reverse()
+	conn.clientFlow = &flo
+	conn.clientNextSeq = 9666
+	conn.serverNextSeq = 3
+
+	done := make(chan []byte)
+	go func() {
+		contents, err := ioutil.ReadAll(conn.ServerStream())
+		if err != nil {
+			t.Error(err)
+		}
+		done <- contents
+	}()
+
+	for _, seq := range []uint32{3, 10, 5} {
+		tcp := layers.TCP{
+			Seq:     seq,
+			SrcPort: 1,
+			DstPort: 2,
+		}
+		p := types.PacketManifest{
+			Timestamp: time.Now(),
+			Flow:      flow,
+			IPv4:      &ip,
+			TCP:       &tcp,
+			Payload:   []byte{1, 2, 3, 4, 5, 6, 7},
+		}
+		conn.ReceivePacket(&p)
+	}
+	conn.Close()
+
+	contents := <-done
+	want := []byte{1, 2, 3, 4, 5, 6, 7, 1, 2, 3, 4, 5, 6, 7}
+	if !bytes.Equal(contents, want) {
+		t.Errorf("server stream %v, expected %v", contents, want)
+	}
+	if n, err := conn.ClientStream().Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("client stream read %d bytes and %v, expected io.EOF", n, err)
+	}
+}
+
+func TestStreamReaderOverflow(t *testing.T) {
+	r := NewStreamReader(4)
+	r.record(0, []byte{1, 2, 3})
+	r.record(3, []byte{4, 5})
+	buf := make([]byte, 8)
+	if n, err := r.Read(buf); n != 3 || err != nil {
+		t.Errorf("read %d bytes and %v, expected 3 bytes", n, err)
+	}
+	if _, err := r.Read(buf); err != ErrStreamReaderOverflow {
+		t.Errorf("read returned %v, expected ErrStreamReaderOverflow", err)
+	}
+}
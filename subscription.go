@@ -0,0 +1,260 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+// DEFAULT_SUBSCRIPTION_BUFFER is the number of events a Subscription buffers by default.
+const DEFAULT_SUBSCRIPTION_BUFFER = 1024
+
+// The policies of a Subscription towards the events which would
+// overflow its buffer, once its subscriber falls behind.
+const (
+	// SLOW_DROP_NEWEST drops the events which would overflow the buffer.
+	SLOW_DROP_NEWEST = iota
+	// SLOW_DROP_OLDEST drops the oldest buffered event to make room.
+	SLOW_DROP_OLDEST
+	// SLOW_BLOCK waits for the subscriber, holding up the dispatcher.
+	SLOW_BLOCK
+)
+
+// Event is an event delivered to a Subscription; one of AttackDetected,
+// ConnectionOpened, ConnectionClosed, LoadShedding or Summary.
+type Event interface {
+	// Raw returns the event as the loggers are given it.
+	Raw() *types.Event
+}
+
+// AttackDetected is an attack reported by a connection.
+type AttackDetected struct {
+	event *types.Event
+}
+
+func (e AttackDetected) Raw() *types.Event {
+	return e.event
+}
+
+// Report returns the attack report as report-json writes it.
+func (e AttackDetected) Report() *logging.AttackReport {
+	return logging.NewAttackReport(e.event)
+}
+
+// ConnectionOpened is a connection the dispatcher started tracking.
+type ConnectionOpened struct {
+	event *types.Event
+}
+
+func (e ConnectionOpened) Raw() *types.Event {
+	return e.event
+}
+
+// ConnectionClosed is a connection the dispatcher stopped tracking;
+// its PacketCount is the number of packets it received.
+type ConnectionClosed struct {
+	event *types.Event
+}
+
+func (e ConnectionClosed) Raw() *types.Event {
+	return e.event
+}
+
+// LoadShedding is the dispatcher starting or ceasing to shed load as
+// captured packets are dropped; while it does, detection is degraded
+// by the Policies it applies, named as ParseShedPolicies takes them.
+// DropRate is the rate at which packets were dropped, per second.
+type LoadShedding struct {
+	event    *types.Event
+	Active   bool
+	DropRate float64
+	Policies []string
+}
+
+func (e LoadShedding) Raw() *types.Event {
+	return e.event
+}
+
+// newEvent returns the Event of a logged event, or nil if it is
+// another of the dispatcher's events, such as an eviction.
+func newEvent(event *types.Event) Event {
+	switch {
+	case event.Type == "connection-opened":
+		return ConnectionOpened{event}
+	case event.Type == "connection-closed":
+		return ConnectionClosed{event}
+	case isConnectionEvent(event.Type):
+		return nil
+	}
+	return AttackDetected{event}
+}
+
+// SubscriptionOptions are the options of a Subscription: the events it
+// buffers, by default DEFAULT_SUBSCRIPTION_BUFFER, the policy, one of
+// SLOW_DROP_NEWEST, SLOW_DROP_OLDEST or SLOW_BLOCK, towards the events
+// which would overflow that buffer and, if set, the filter selecting
+// the events it receives.
+type SubscriptionOptions struct {
+	Buffer int
+	Policy int
+	Filter *logging.EventFilter
+}
+
+// Subscription receives the events of a running pipeline on Events, in
+// the order they happened, until it is unsubscribed or the dispatcher
+// stops, when Events is closed.
+type Subscription struct {
+	Events <-chan Event
+
+	events    chan Event
+	options   SubscriptionOptions
+	dropped   uint64
+	done      chan bool
+	closeOnce sync.Once
+}
+
+// Dropped returns the number of events dropped as the subscriber fell behind.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// deliver hands the event to the subscriber as its policy says.
+func (s *Subscription) deliver(event Event) {
+	select {
+	case s.events <- event:
+		return
+	default:
+	}
+	switch s.options.Policy {
+	case SLOW_BLOCK:
+		select {
+		case s.events <- event:
+		case <-s.done:
+		}
+		return
+	case SLOW_DROP_OLDEST:
+		select {
+		case <-s.events:
+		default:
+		}
+		select {
+		case s.events <- event:
+		default:
+		}
+	}
+	if dropped := atomic.AddUint64(&s.dropped, 1); dropped == 1 || dropped%1000 == 0 {
+		logging.Warningf("subscription: slow subscriber, %d events dropped", dropped)
+	}
+}
+
+// eventHub hands the events of a dispatcher to its subscriptions.
+type eventHub struct {
+	mutex         sync.Mutex
+	subscriptions map[*Subscription]bool
+	closed        bool
+}
+
+func (h *eventHub) subscribe(options SubscriptionOptions) *Subscription {
+	if options.Buffer <= 0 {
+		options.Buffer = DEFAULT_SUBSCRIPTION_BUFFER
+	}
+	s := &Subscription{
+		events:  make(chan Event, options.Buffer),
+		options: options,
+		done:    make(chan bool),
+	}
+	s.Events = s.events
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		close(s.events)
+		return s
+	}
+	if h.subscriptions == nil {
+		h.subscriptions = make(map[*Subscription]bool)
+	}
+	h.subscriptions[s] = true
+	return s
+}
+
+func (h *eventHub) unsubscribe(s *Subscription) {
+	// a blocked delivery to s gives up first
+	s.closeOnce.Do(func() { close(s.done) })
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.subscriptions[s] {
+		delete(h.subscriptions, s)
+		close(s.events)
+	}
+}
+
+// subscribed returns true if there are subscriptions.
+func (h *eventHub) subscribed() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.subscriptions) > 0
+}
+
+func (h *eventHub) publish(event *types.Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.subscriptions) == 0 {
+		return
+	}
+	typed := newEvent(event)
+	if typed == nil {
+		return
+	}
+	h.deliver(typed)
+}
+
+// deliver delivers an event to the subscriptions whose filter it matches.
+// The caller holds the mutex.
+func (h *eventHub) deliver(typed Event) {
+	event := typed.Raw()
+	for s := range h.subscriptions {
+		if s.options.Filter == nil || s.options.Filter.Matches(event) {
+			s.deliver(typed)
+		}
+	}
+}
+
+// publishEvent publishes one of the dispatcher's own events,
+// which loggers are not given.
+func (h *eventHub) publishEvent(typed Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.deliver(typed)
+}
+
+// close ends all subscriptions and those made afterwards.
+func (h *eventHub) close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.closed = true
+	for s := range h.subscriptions {
+		delete(h.subscriptions, s)
+		close(s.events)
+	}
+}
@@ -0,0 +1,116 @@
+package HoneyBadger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+func TestDispatcherSubscribe(t *testing.T) {
+	options := DispatcherOptions{
+		Logger:         NewDummyAttackLogger(),
+		MaxRingPackets: 40,
+	}
+	dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+	all := dispatcher.Subscribe(SubscriptionOptions{})
+	filter, _ := logging.ParseEventFilter([]string{"dispatcher"}, nil)
+	connections := dispatcher.Subscribe(SubscriptionOptions{Filter: filter})
+	dispatcher.Start()
+	_, packet := newTestConnection(options.Logger)
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	dispatcher.LiveConnections()
+	conn := dispatcher.Connections()[0].(*Connection)
+	conn.AttackLogger.Log(&types.Event{Type: "injection", Flow: *conn.clientFlow})
+	dispatcher.Stop()
+
+	var received []Event
+	for event := range all.Events {
+		received = append(received, event)
+	}
+	if len(received) != 3 {
+		t.Fatalf("received %d events, expected 3", len(received))
+	}
+	if _, ok := received[0].(ConnectionOpened); !ok {
+		t.Errorf("first event %T", received[0])
+	}
+	if attack, ok := received[1].(AttackDetected); !ok || attack.Report().Type != "injection" {
+		t.Errorf("second event %T", received[1])
+	}
+	if closed, ok := received[2].(ConnectionClosed); !ok || closed.Raw().PacketCount != 1 {
+		t.Errorf("third event %T %+v", received[2], received[2].Raw())
+	}
+
+	filtered := 0
+	for event := range connections.Events {
+		if _, ok := event.(AttackDetected); ok {
+			t.Error("filtered subscription received an attack")
+		}
+		filtered++
+	}
+	if filtered != 2 {
+		t.Errorf("filtered subscription received %d events", filtered)
+	}
+	if _, ok := <-dispatcher.Subscribe(SubscriptionOptions{}).Events; ok {
+		t.Error("subscription to a stopped dispatcher not closed")
+	}
+}
+
+func TestSubscriptionPolicies(t *testing.T) {
+	event := func(n uint64) *types.Event {
+		return &types.Event{Type: "injection", PacketCount: n}
+	}
+	hub := &eventHub{}
+	newest := hub.subscribe(SubscriptionOptions{Buffer: 2, Policy: SLOW_DROP_NEWEST})
+	oldest := hub.subscribe(SubscriptionOptions{Buffer: 2, Policy: SLOW_DROP_OLDEST})
+	for n := uint64(1); n <= 3; n++ {
+		hub.publish(event(n))
+	}
+	for _, test := range []struct {
+		name         string
+		subscription *Subscription
+		first        uint64
+	}{
+		{"drop newest", newest, 1},
+		{"drop oldest", oldest, 2},
+	} {
+		if test.subscription.Dropped() != 1 {
+			t.Errorf("%s: dropped %d events", test.name, test.subscription.Dropped())
+		}
+		if first := (<-test.subscription.Events).Raw().PacketCount; first != test.first {
+			t.Errorf("%s: first event %d, expected %d", test.name, first, test.first)
+		}
+		hub.unsubscribe(test.subscription)
+	}
+
+	blocking := hub.subscribe(SubscriptionOptions{Buffer: 1, Policy: SLOW_BLOCK})
+	hub.publish(event(1))
+	published := make(chan bool)
+	go func() {
+		hub.publish(event(2))
+		published <- true
+	}()
+	select {
+	case <-published:
+		t.Fatal("publish did not wait for the blocking subscriber")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-blocking.Events
+	<-published
+	if n := (<-blocking.Events).Raw().PacketCount; n != 2 || blocking.Dropped() != 0 {
+		t.Errorf("blocking subscriber received %d, dropped %d", n, blocking.Dropped())
+	}
+
+	// unsubscribing a subscriber blocking the hub releases it
+	hub.publish(event(3))
+	go func() {
+		hub.publish(event(4))
+		published <- true
+	}()
+	time.Sleep(10 * time.Millisecond)
+	hub.unsubscribe(blocking)
+	<-published
+}
@@ -0,0 +1,256 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// SUMMARY_TOP is the default number of services and fingerprints a
+	// Summary lists.
+	SUMMARY_TOP = 10
+	// SUMMARY_BUFFER is the number of events a SummaryReporter buffers.
+	SUMMARY_BUFFER = 4096
+)
+
+// SUMMARY_FINGERPRINT are the report properties, see
+// logging.ReportFingerprint, the suspected injectors of a Summary are
+// fingerprinted by.
+var SUMMARY_FINGERPRINT = []string{"type", "payload"}
+
+// ParseSummaryPeriod returns the period of a SummaryReporter given by
+// name: "hourly", "daily" or a duration such as "6h".
+func ParseSummaryPeriod(name string) (time.Duration, error) {
+	switch name {
+	case "hourly":
+		return time.Hour, nil
+	case "daily":
+		return 24 * time.Hour, nil
+	}
+	period, err := time.ParseDuration(name)
+	if err != nil || period <= 0 {
+		return 0, fmt.Errorf("invalid summary period %q; hourly, daily or a duration", name)
+	}
+	return period, nil
+}
+
+// SummaryCount is a service or fingerprint of a Summary and the
+// number of attacks reported of it.
+type SummaryCount struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// Summary is a SummaryReporter's summary of a period: the attacks reported
+// in total and by type, the services, as the destination address and port
+// of the attacks, most attacked, the suspected injectors, fingerprinted by
+// the SUMMARY_FINGERPRINT of their reports, reporting the most attacks,
+// and the traffic analysed. Attacks of the events dropped as the reporter
+// fell behind are not counted.
+type Summary struct {
+	event *types.Event
+
+	Start             time.Time             `json:"start"`
+	End               time.Time             `json:"end"`
+	Sensor            *logging.ReportSensor `json:"sensor"`
+	Attacks           uint64                `json:"attacks"`
+	AttacksByType     map[string]uint64     `json:"attacks_by_type"`
+	TopServices       []SummaryCount        `json:"top_services"`
+	TopFingerprints   []SummaryCount        `json:"top_fingerprints"`
+	Packets           uint64                `json:"packets"`
+	PayloadBytes      uint64                `json:"payload_bytes"`
+	ConnectionsOpened uint64                `json:"connections_opened"`
+	ConnectionsClosed uint64                `json:"connections_closed"`
+	DroppedEvents     uint64                `json:"dropped_events"`
+}
+
+func (e Summary) Raw() *types.Event {
+	return e.event
+}
+
+// SummaryOptions are the options of a SummaryReporter: the period it
+// summarizes, the directory its summaries are written to, if any, and
+// the number of services and fingerprints a summary lists, by default
+// SUMMARY_TOP.
+type SummaryOptions struct {
+	Period time.Duration
+	Dir    string
+	Top    int
+}
+
+// SummaryReporter is a control plane service summarizing the attacks and
+// traffic of each period, aligned to the clock such that hourly
+// summaries start on the hour and daily ones at midnight UTC, for sites
+// which only review their sensors daily. Each summary is delivered to the
+// dispatcher's subscriptions, logged and, if Dir is set, written to it as
+// JSON named after its start, such as summary-20150301T120000Z.json. The
+// summary of the period the reporter is stopped in is written when it
+// stops.
+type SummaryReporter struct {
+	SummaryOptions
+
+	dispatcher   *Dispatcher
+	subscription *Subscription
+	summary      *Summary
+	services     map[string]uint64
+	fingerprints map[string]uint64
+	packets      uint64
+	payloadBytes uint64
+	opened       uint64
+	closed       uint64
+	dropped      uint64
+	doneChan     chan bool
+}
+
+// NewSummaryReporter returns a pointer to a SummaryReporter struct.
+func NewSummaryReporter(options SummaryOptions) *SummaryReporter {
+	if options.Top <= 0 {
+		options.Top = SUMMARY_TOP
+	}
+	return &SummaryReporter{
+		SummaryOptions: options,
+		doneChan:       make(chan bool),
+	}
+}
+
+// Start starts summarizing the attacks and traffic of dispatcher.
+func (r *SummaryReporter) Start(dispatcher *Dispatcher) {
+	r.dispatcher = dispatcher
+	r.subscription = dispatcher.Subscribe(SubscriptionOptions{Buffer: SUMMARY_BUFFER})
+	r.begin(time.Now())
+	go r.run()
+}
+
+// Stop writes the summary of the period so far and stops.
+func (r *SummaryReporter) Stop() {
+	r.dispatcher.Unsubscribe(r.subscription)
+	<-r.doneChan
+}
+
+func (r *SummaryReporter) run() {
+	defer close(r.doneChan)
+	timer := time.NewTimer(time.Until(r.summary.End))
+	defer timer.Stop()
+	for {
+		select {
+		case event, ok := <-r.subscription.Events:
+			if !ok {
+				r.end(time.Now())
+				return
+			}
+			if attack, ok := event.(AttackDetected); ok {
+				r.count(attack.Report())
+			}
+		case now := <-timer.C:
+			r.end(now)
+			r.begin(now)
+			timer.Reset(time.Until(r.summary.End))
+		}
+	}
+}
+
+// begin starts the summary of the period of now.
+func (r *SummaryReporter) begin(now time.Time) {
+	start := now.UTC().Truncate(r.Period)
+	r.summary = &Summary{
+		Start:         start,
+		End:           start.Add(r.Period),
+		AttacksByType: make(map[string]uint64),
+	}
+	r.services = make(map[string]uint64)
+	r.fingerprints = make(map[string]uint64)
+	r.packets, r.payloadBytes = r.dispatcher.Packets(), r.dispatcher.PayloadBytes()
+	metrics := r.dispatcher.Metrics()
+	r.opened, r.closed = metrics.Opened, metrics.Closed
+	r.dropped = r.subscription.Dropped()
+}
+
+// count accounts for an attack report in the summary.
+func (r *SummaryReporter) count(report *logging.AttackReport) {
+	r.summary.Attacks++
+	r.summary.AttacksByType[report.Type]++
+	r.services[report.Flow.DstIP+":"+strconv.Itoa(int(report.Flow.DstPort))]++
+	r.fingerprints[logging.ReportFingerprint(report, SUMMARY_FINGERPRINT)]++
+}
+
+// end completes the summary of the period up to now and delivers it.
+func (r *SummaryReporter) end(now time.Time) {
+	summary := r.summary
+	if now.Before(summary.End) {
+		summary.End = now.UTC()
+	}
+	summary.event = &types.Event{Type: "summary", Time: summary.End}
+	summary.Sensor = &logging.ReportSensor{
+		ID:   logging.Sensor,
+		Site: logging.Site,
+		Tags: logging.SensorTags,
+	}
+	summary.TopServices = topCounts(r.services, r.Top)
+	summary.TopFingerprints = topCounts(r.fingerprints, r.Top)
+	summary.Packets = r.dispatcher.Packets() - r.packets
+	summary.PayloadBytes = r.dispatcher.PayloadBytes() - r.payloadBytes
+	metrics := r.dispatcher.Metrics()
+	summary.ConnectionsOpened = metrics.Opened - r.opened
+	summary.ConnectionsClosed = metrics.Closed - r.closed
+	summary.DroppedEvents = r.subscription.Dropped() - r.dropped
+
+	r.dispatcher.events.publishEvent(*summary)
+	logging.Infof("summary of %s to %s: %d attacks, %d packets, %d connections",
+		summary.Start.Format(time.RFC3339), summary.End.Format(time.RFC3339), summary.Attacks, summary.Packets, summary.ConnectionsOpened)
+	if r.Dir == "" {
+		return
+	}
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err == nil {
+		name := filepath.Join(r.Dir, "summary-"+summary.Start.Format("20060102T150405Z")+".json")
+		err = ioutil.WriteFile(name, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		logging.Warningf("failed to write summary: %s", err)
+	}
+}
+
+// topCounts returns the top of counts, the most counted first.
+func topCounts(counts map[string]uint64, top int) []SummaryCount {
+	result := make([]SummaryCount, 0, len(counts))
+	for name, count := range counts {
+		result = append(result, SummaryCount{Name: name, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Name < result[j].Name
+	})
+	if len(result) > top {
+		result = result[:top]
+	}
+	return result
+}
@@ -0,0 +1,84 @@
+package HoneyBadger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+func TestParseSummaryPeriod(t *testing.T) {
+	for name, expected := range map[string]time.Duration{"hourly": time.Hour, "daily": 24 * time.Hour, "6h": 6 * time.Hour} {
+		if period, err := ParseSummaryPeriod(name); err != nil || period != expected {
+			t.Errorf("%s: period %s error %v", name, period, err)
+		}
+	}
+	for _, name := range []string{"", "weekly", "-1h"} {
+		if _, err := ParseSummaryPeriod(name); err == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+}
+
+func summaryFlow(dstPort int) types.TcpIpFlow {
+	ipFlow := gopacket.NewFlow(layers.EndpointIPv4, net.IPv4(1, 2, 3, 4).To4(), net.IPv4(2, 3, 4, 5).To4())
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(1000), layers.NewTCPPortEndpoint(layers.TCPPort(dstPort)))
+	return types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+}
+
+func TestSummaryReporter(t *testing.T) {
+	logger := NewDummyAttackLogger()
+	dispatcher := NewDispatcher(DispatcherOptions{Logger: logger, MaxRingPackets: 40}, &DefaultConnFactory{}, nil)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+	subscription := dispatcher.Subscribe(SubscriptionOptions{})
+	dir := t.TempDir()
+	reporter := NewSummaryReporter(SummaryOptions{Period: time.Hour, Dir: dir, Top: 1})
+	reporter.Start(dispatcher)
+	started := time.Now().UTC().Truncate(time.Hour)
+
+	_, packet := newTestConnection(logger)
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+	dispatcher.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{1, 2, 3}))
+	dispatcher.LiveConnections()
+	for _, event := range []*types.Event{
+		{Type: "injection", Flow: summaryFlow(80), Payload: []byte("ad")},
+		{Type: "injection", Flow: summaryFlow(80), Payload: []byte("ad")},
+		{Type: "handshake-hijack", Flow: summaryFlow(443)},
+	} {
+		dispatcher.events.publish(event)
+	}
+	reporter.Stop()
+
+	var summary *Summary
+	for summary == nil {
+		if event, ok := (<-subscription.Events).(Summary); ok {
+			summary = &event
+		}
+	}
+	if !summary.Start.Equal(started) || summary.Attacks != 3 || summary.AttacksByType["injection"] != 2 || summary.Packets != 2 || summary.PayloadBytes != 3 {
+		t.Errorf("summary %+v", summary)
+	}
+	if len(summary.TopServices) != 1 || summary.TopServices[0] != (SummaryCount{Name: "2.3.4.5:80", Count: 2}) {
+		t.Errorf("top services %+v", summary.TopServices)
+	}
+	if len(summary.TopFingerprints) != 1 || summary.TopFingerprints[0].Count != 2 {
+		t.Errorf("top fingerprints %+v", summary.TopFingerprints)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "summary-"+started.Format("20060102T150405Z")+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written Summary
+	if err := json.Unmarshal(data, &written); err != nil || written.Attacks != 3 || written.Sensor == nil {
+		t.Errorf("summary written %s: %v", data, err)
+	}
+}
@@ -20,70 +20,368 @@
 package HoneyBadger
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/google/gopacket"
+
+	"github.com/david415/HoneyBadger/logging"
 	"github.com/david415/HoneyBadger/types"
 )
 
+// Service is a component of the pipeline the Supervisor starts and stops,
+// such as an attack logger; logging.AttackLogger is one.
+type Service interface {
+	Start()
+	Stop()
+}
+
+// ControlService is a control plane service, such as an API serving the
+// live connections and metrics of the dispatcher, which it is handed
+// when started.
+type ControlService interface {
+	Start(dispatcher *Dispatcher)
+	Stop()
+}
+
+// SupervisedControlService is a control plane service which manages the
+// pipeline as a whole, such as its capture filter; it is handed the
+// Supervisor before it is started.
+type SupervisedControlService interface {
+	ControlService
+	SetSupervisor(supervisor *Supervisor)
+}
+
+// SupervisorOptions are the pieces of the pipeline a Supervisor assembles.
+// Loggers are the attack report and connection event loggers the
+// DispatcherOptions send to, ControlPlane the services managing the
+// running pipeline. Signals are the signals shutting the pipeline down,
+// by default SIGINT and SIGTERM. OnReload, if set, is called on each of
+// the ReloadSignals, by default SIGHUP, to reconfigure the running
+// pipeline, with Reconfigure and SetFilter, without losing the
+// connections tracked; an error it returns is logged. On each of the
+// DumpSignals, by default SIGUSR1, a diagnostic dump of the pipeline, see
+// Dump, is written to DumpFile, or to the diagnostic log if it is empty.
+//
+// Tenants, if any, are analysis contexts of their own sharing the capture:
+// packets matching a tenant's rules are analysed by its dispatcher, the
+// others by the dispatcher of DispatcherOptions; see TenantRouter.
 type SupervisorOptions struct {
 	SnifferDriverOptions *types.SnifferDriverOptions
 	DispatcherOptions    DispatcherOptions
 	SnifferFactory       func(*types.SnifferDriverOptions, PacketDispatcher) types.PacketSource
 	ConnectionFactory    ConnectionFactory
 	PacketLoggerFactory  types.PacketLoggerFactory
+	Loggers              []Service
+	ControlPlane         []ControlService
+	Signals              []os.Signal
+	OnReload             func(*Supervisor) error
+	ReloadSignals        []os.Signal
+	DumpSignals          []os.Signal
+	DumpFile             string
+	Tenants              []Tenant
 }
 
+// Supervisor runs the whole detection pipeline: packet capture and
+// decoding, the dispatcher and its connection tracker, the loggers and the
+// control plane. It is the entry point for embedding HoneyBadger, most
+// easily built with New:
+//
+//	supervisor, err := HoneyBadger.New(
+//		HoneyBadger.WithInterface("eth1"),
+//		HoneyBadger.WithAttackLogger(attackLogger),
+//	)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	supervisor.Run()
+//
+// or from SupervisorOptions, which leave nothing to defaults:
+//
+//	supervisor := HoneyBadger.NewSupervisor(HoneyBadger.SupervisorOptions{
+//		SnifferDriverOptions: &snifferOptions,
+//		DispatcherOptions:    dispatcherOptions,
+//		SnifferFactory:       HoneyBadger.NewSniffer,
+//		ConnectionFactory:    &HoneyBadger.DefaultConnFactory{},
+//		Loggers:              []HoneyBadger.Service{attackLogger},
+//	})
+//	supervisor.Run()
+//
+// Run starts the loggers, the dispatcher, which restores its snapshot,
+// the control plane and finally the capture, so that nothing is captured
+// before it can be handled. It returns once the pipeline has shut down;
+// when the packet source is exhausted, on one of the Signals, on Stop or,
+// with RunContext, once its context is cancelled. Shutting down drains the
+// pipeline in the opposite order: capture stops and the packets already
+// captured are dispatched, the dispatcher then closes its connections on
+// its own goroutine, reporting any attacks they hold and closing their
+// packet logs, and the loggers are stopped last, delivering the reports
+// queued for them. Tenants' loggers and dispatchers are started and
+// stopped along with the pipeline's own; the control plane and
+// subscriptions serve the pipeline's own dispatcher.
 type Supervisor struct {
 	dispatcher       *Dispatcher
+	router           *TenantRouter
+	tenantLoggers    []Service
 	sniffer          types.PacketSource
+	loggers          []Service
+	controlPlane     []ControlService
+	signals          []os.Signal
+	onReload         func(*Supervisor) error
+	reloadSignals    []os.Signal
+	dumpSignals      []os.Signal
+	dumpFile         string
+	dumpTimeout      time.Duration
 	childStoppedChan chan bool
 	forceQuitChan    chan os.Signal
+	stopChan         chan bool
+	doneChan         chan bool
+	stopOnce         sync.Once
 }
 
 func NewSupervisor(options SupervisorOptions) *Supervisor {
 	dispatcher := NewDispatcher(options.DispatcherOptions, options.ConnectionFactory, options.PacketLoggerFactory)
-	sniffer := options.SnifferFactory(options.SnifferDriverOptions, dispatcher)
+	var packetDispatcher PacketDispatcher = dispatcher
+	var router *TenantRouter
+	var tenantLoggers []Service
+	if len(options.Tenants) > 0 {
+		router = NewTenantRouter(dispatcher)
+		for _, tenant := range options.Tenants {
+			connectionFactory := tenant.ConnectionFactory
+			if connectionFactory == nil {
+				connectionFactory = options.ConnectionFactory
+			}
+			packetLoggerFactory := tenant.PacketLoggerFactory
+			if packetLoggerFactory == nil {
+				packetLoggerFactory = options.PacketLoggerFactory
+			}
+			router.Add(tenant.Name, tenant.Rules, NewDispatcher(tenant.DispatcherOptions, connectionFactory, packetLoggerFactory))
+			tenantLoggers = append(tenantLoggers, tenant.Loggers...)
+		}
+		packetDispatcher = router
+	}
+	sniffer := options.SnifferFactory(options.SnifferDriverOptions, packetDispatcher)
+	if counter, ok := sniffer.(types.DropCounter); ok {
+		// the dispatchers shed load as the capture drops packets
+		dispatcher.SetDropCounter(counter)
+		if router != nil {
+			for _, tenant := range router.tenants {
+				tenant.dispatcher.SetDropCounter(counter)
+			}
+		}
+	}
+	signals := options.Signals
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	reloadSignals := options.ReloadSignals
+	if len(reloadSignals) == 0 {
+		reloadSignals = []os.Signal{syscall.SIGHUP}
+	}
+	dumpSignals := options.DumpSignals
+	if len(dumpSignals) == 0 {
+		dumpSignals = defaultDumpSignals
+	}
 	supervisor := Supervisor{
 		forceQuitChan:    make(chan os.Signal, 1),
-		childStoppedChan: make(chan bool, 0),
+		childStoppedChan: make(chan bool, 1),
+		stopChan:         make(chan bool, 1),
+		doneChan:         make(chan bool),
 		dispatcher:       dispatcher,
+		router:           router,
+		tenantLoggers:    tenantLoggers,
 		sniffer:          sniffer,
+		loggers:          options.Loggers,
+		controlPlane:     options.ControlPlane,
+		signals:          signals,
+		onReload:         options.OnReload,
+		reloadSignals:    reloadSignals,
+		dumpSignals:      dumpSignals,
+		dumpFile:         options.DumpFile,
+		dumpTimeout:      DUMP_QUERY_TIMEOUT,
 	}
-	sniffer.SetSupervisor(supervisor)
+	sniffer.SetSupervisor(&supervisor)
 	return &supervisor
 }
 
-func (b Supervisor) GetDispatcher() PacketDispatcher {
+// GetDispatcher returns the dispatcher the packets captured are
+// handed to; the TenantRouter if there are tenants.
+func (b *Supervisor) GetDispatcher() PacketDispatcher {
+	if b.router != nil {
+		return b.router
+	}
 	return b.dispatcher
 }
 
-func (b Supervisor) GetSniffer() types.PacketSource {
+// Tenant returns the dispatcher of the named tenant, or nil if there is none.
+func (b *Supervisor) Tenant(name string) *Dispatcher {
+	if b.router == nil {
+		return nil
+	}
+	return b.router.Tenant(name)
+}
+
+func (b *Supervisor) GetSniffer() types.PacketSource {
 	// XXX return types.PacketSource(b.sniffer)
 	return b.sniffer
 }
 
-func (b Supervisor) Stopped() {
-	log.Print("Supervisor.Stopped()")
-	b.childStoppedChan <- true
+// Stopped is called by the packet source once it is exhausted.
+func (b *Supervisor) Stopped() {
+	logging.Debugf("Supervisor.Stopped()")
+	select {
+	case b.childStoppedChan <- true:
+	default:
+	}
+}
+
+// Reconfigure applies the settings of options that may change while the
+// pipeline runs to the dispatcher, see Dispatcher.Reconfigure; the
+// tenants' dispatchers are left as they were, see ReconfigureTenant.
+func (b *Supervisor) Reconfigure(options DispatcherOptions) {
+	b.dispatcher.Reconfigure(options)
+}
+
+// ReconfigureTenant applies the settings of options that may change while
+// the pipeline runs to the dispatcher of the named tenant.
+func (b *Supervisor) ReconfigureTenant(name string, options DispatcherOptions) error {
+	dispatcher := b.Tenant(name)
+	if dispatcher == nil {
+		return fmt.Errorf("no tenant %q", name)
+	}
+	dispatcher.Reconfigure(options)
+	return nil
+}
+
+// SetFilter replaces the BPF filter of the capture, if its packet source supports that.
+func (b *Supervisor) SetFilter(filter string) error {
+	setter, ok := b.sniffer.(types.FilterSetter)
+	if !ok {
+		return fmt.Errorf("the packet source cannot change its filter")
+	}
+	return setter.SetFilter(filter)
+}
+
+// Subscribe returns a new subscription to the attack reports and
+// connection events of the pipeline, for programs embedding it to
+// react to them; see SubscriptionOptions. Subscriptions to a tenant's
+// are made from its dispatcher, see Tenant.
+func (b *Supervisor) Subscribe(options SubscriptionOptions) *Subscription {
+	return b.dispatcher.Subscribe(options)
+}
+
+// Unsubscribe ends a subscription, closing its Events channel.
+func (b *Supervisor) Unsubscribe(subscription *Subscription) {
+	b.dispatcher.Unsubscribe(subscription)
+}
+
+// ReceivePacketData hands a captured Ethernet frame to the pipeline,
+// as PacketFeed.ReceivePacketData does; the packet source must be a
+// PacketFeed, see WithPacketFeed.
+func (b *Supervisor) ReceivePacketData(data []byte, ci gopacket.CaptureInfo) error {
+	feed, ok := b.sniffer.(*PacketFeed)
+	if !ok {
+		return fmt.Errorf("the packet source is not a packet feed")
+	}
+	return feed.ReceivePacketData(data, ci)
+}
+
+// ReceiveManifest hands a decoded packet to the pipeline, as
+// PacketFeed.ReceiveManifest does; the packet source must be a
+// PacketFeed, see WithPacketFeed.
+func (b *Supervisor) ReceiveManifest(packetManifest *types.PacketManifest) error {
+	feed, ok := b.sniffer.(*PacketFeed)
+	if !ok {
+		return fmt.Errorf("the packet source is not a packet feed")
+	}
+	return feed.ReceiveManifest(packetManifest)
+}
+
+// Stop shuts the pipeline down as a signal would and
+// returns once Run has drained it.
+func (b *Supervisor) Stop() {
+	b.stopOnce.Do(func() { b.stopChan <- true })
+	<-b.doneChan
+}
+
+func (b *Supervisor) Run() {
+	b.RunContext(context.Background())
 }
 
-func (b Supervisor) Run() {
+// RunContext runs the pipeline as Run does, until ctx is cancelled at the latest.
+func (b *Supervisor) RunContext(ctx context.Context) {
+	defer close(b.doneChan)
+	loggers := append(append([]Service(nil), b.loggers...), b.tenantLoggers...)
+	for _, logger := range loggers {
+		logger.Start()
+	}
+	// the dispatchers are stopped once the capture has drained rather
+	// than on ctx, so that no packet captured is left undispatched
+	dispatcher := b.GetDispatcher()
+	if b.router != nil {
+		for _, tenant := range b.router.tenants {
+			tenant.dispatcher.Start()
+		}
+	}
 	b.dispatcher.Start()
-	b.sniffer.Start()
+	for _, control := range b.controlPlane {
+		if supervised, ok := control.(SupervisedControlService); ok {
+			supervised.SetSupervisor(b)
+		}
+		control.Start(b.dispatcher)
+	}
+	b.sniffer.Start(ctx)
 
-	signal.Notify(b.forceQuitChan, os.Interrupt)
+	signal.Notify(b.forceQuitChan, b.signals...)
+	defer signal.Stop(b.forceQuitChan)
+	reloadChan := make(chan os.Signal, 1)
+	if b.onReload != nil {
+		signal.Notify(reloadChan, b.reloadSignals...)
+		defer signal.Stop(reloadChan)
+	}
+	dumpChan := make(chan os.Signal, 1)
+	if len(b.dumpSignals) > 0 {
+		signal.Notify(dumpChan, b.dumpSignals...)
+		defer signal.Stop(dumpChan)
+	}
 
-	select {
-	case <-b.forceQuitChan:
-		log.Print("graceful shutdown: user force quit\n")
-		log.Print("stopping sniffer")
-		b.sniffer.Stop()
-		log.Print("stopping dispatcher")
-		b.dispatcher.Stop()
-		log.Print("supervisor waiting for child to stop\n")
-	case <-b.childStoppedChan:
-		log.Print("graceful shutdown: packet-source stopped")
+	for running := true; running; {
+		select {
+		case <-reloadChan:
+			logging.Infof("reloading configuration")
+			if err := b.onReload(b); err != nil {
+				logging.Warningf("failed to reload configuration: %s", err)
+			}
+		case <-dumpChan:
+			b.dump()
+		case <-b.forceQuitChan:
+			logging.Infof("graceful shutdown: user force quit")
+			running = false
+		case <-b.stopChan:
+			logging.Infof("graceful shutdown: stopped")
+			running = false
+		case <-ctx.Done():
+			logging.Infof("graceful shutdown: context cancelled")
+			running = false
+		case <-b.childStoppedChan:
+			logging.Infof("graceful shutdown: packet-source stopped")
+			running = false
+		}
+	}
+	logging.Infof("stopping sniffer")
+	b.sniffer.Stop()
+	for i := len(b.controlPlane) - 1; i >= 0; i-- {
+		b.controlPlane[i].Stop()
+	}
+	logging.Infof("stopping dispatcher")
+	dispatcher.Stop()
+	logging.Infof("stopping loggers")
+	for i := len(loggers) - 1; i >= 0; i-- {
+		loggers[i].Stop()
 	}
 }
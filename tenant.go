@@ -0,0 +1,280 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// TenantRule matches the packets of a tenant: those tagged with one of
+// the VLANs, encapsulated in a VXLAN of one of the VNIs and of which either
+// end is within one of the Networks; a rule without VLANs, VNIs or
+// Networks leaves that condition out.
+type TenantRule struct {
+	VLANs    []uint16
+	VNIs     []uint32
+	Networks []*net.IPNet
+}
+
+// Tenant is an analysis context of its own within a pipeline, for the
+// packets matching any of its Rules: a dispatcher of the DispatcherOptions,
+// whose attack reports and connection events go to the tenant's own
+// loggers, and the Loggers the Supervisor starts and stops for it.
+// ConnectionFactory and PacketLoggerFactory default to the Supervisor's.
+type Tenant struct {
+	Name                string
+	Rules               []TenantRule
+	DispatcherOptions   DispatcherOptions
+	ConnectionFactory   ConnectionFactory
+	PacketLoggerFactory types.PacketLoggerFactory
+	Loggers             []Service
+}
+
+var tenantNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ParseTenants parses a semicolon separated list of tenant rules; each
+// the name of a tenant, made of letters, digits, "-" and "_", followed by
+// the space separated conditions "vlan=<ID>[,<ID>...]", "vni=<VNI>[,...]"
+// and "net=<CIDR>[,...]". Tenants named more than once match the packets
+// of any of their rules. For example:
+// "acme vlan=100,101; globex vni=5001 net=10.1.0.0/16; acme vlan=300".
+// The tenants returned, in the order first named, only have their Name
+// and Rules set.
+func ParseTenants(tenants string) ([]Tenant, error) {
+	var result []Tenant
+	for _, text := range strings.Split(tenants, ";") {
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if !tenantNamePattern.MatchString(fields[0]) {
+			return nil, fmt.Errorf("invalid tenant name %q", fields[0])
+		}
+		rule := TenantRule{}
+		for _, field := range fields[1:] {
+			var err error
+			switch {
+			case strings.HasPrefix(field, "vlan="):
+				var ids []uint64
+				ids, err = parseIDs(strings.TrimPrefix(field, "vlan="), 12)
+				for _, id := range ids {
+					rule.VLANs = append(rule.VLANs, uint16(id))
+				}
+			case strings.HasPrefix(field, "vni="):
+				var ids []uint64
+				ids, err = parseIDs(strings.TrimPrefix(field, "vni="), 24)
+				for _, id := range ids {
+					rule.VNIs = append(rule.VNIs, uint32(id))
+				}
+			case strings.HasPrefix(field, "net="):
+				rule.Networks, err = parseNetworks(strings.TrimPrefix(field, "net="))
+			default:
+				err = fmt.Errorf("unknown tenant rule condition %q", field)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		i := 0
+		for i < len(result) && result[i].Name != fields[0] {
+			i++
+		}
+		if i == len(result) {
+			result = append(result, Tenant{Name: fields[0]})
+		}
+		result[i].Rules = append(result[i].Rules, rule)
+	}
+	return result, nil
+}
+
+// parseIDs parses a comma separated list of IDs of the given bit size.
+func parseIDs(list string, bitSize int) ([]uint64, error) {
+	var ids []uint64
+	for _, field := range strings.Split(list, ",") {
+		id, err := strconv.ParseUint(field, 10, bitSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID %q", field)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Matches returns true if the packet matches the rule.
+func (r *TenantRule) Matches(p *types.PacketManifest) bool {
+	if len(r.VLANs) > 0 {
+		if p.Ingress == nil || !anyVLAN(p.Ingress.VLANs, r.VLANs) {
+			return false
+		}
+	}
+	if len(r.VNIs) > 0 {
+		if p.Ingress == nil || p.Ingress.Tunnel != "vxlan" || !anyVNI(p.Ingress.TunnelID, r.VNIs) {
+			return false
+		}
+	}
+	if len(r.Networks) > 0 && !flowInNetworks(p.Flow, r.Networks) {
+		return false
+	}
+	return true
+}
+
+func anyVLAN(tags, vlans []uint16) bool {
+	for _, tag := range tags {
+		for _, vlan := range vlans {
+			if tag == vlan {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func anyVNI(id uint32, vnis []uint32) bool {
+	for _, vni := range vnis {
+		if id == vni {
+			return true
+		}
+	}
+	return false
+}
+
+// routedTenant is a tenant's dispatcher and the rules routing packets to it.
+type routedTenant struct {
+	name       string
+	rules      []TenantRule
+	dispatcher *Dispatcher
+}
+
+// TenantRouter is the PacketDispatcher of a pipeline shared by tenants:
+// it hands each packet to the dispatcher of the first tenant, in the
+// order added, with a rule the packet matches, or to the Default
+// dispatcher if it matches none. Each dispatcher tracks its connections
+// apart from the others', so tenants may use the same addresses on
+// different VLANs or VXLANs. Packets matching no tenant when there is no
+// Default dispatcher are dropped and counted.
+type TenantRouter struct {
+	Default  *Dispatcher
+	tenants  []*routedTenant
+	unrouted uint64
+}
+
+// NewTenantRouter returns a TenantRouter handing the packets
+// matching no tenant to the given dispatcher.
+func NewTenantRouter(defaultDispatcher *Dispatcher) *TenantRouter {
+	return &TenantRouter{
+		Default: defaultDispatcher,
+	}
+}
+
+// Add routes the packets matching any of the rules to a tenant's dispatcher.
+// Tenants must be added before packets are dispatched.
+func (r *TenantRouter) Add(name string, rules []TenantRule, dispatcher *Dispatcher) {
+	r.tenants = append(r.tenants, &routedTenant{
+		name:       name,
+		rules:      rules,
+		dispatcher: dispatcher,
+	})
+}
+
+// Tenant returns the dispatcher of the named tenant, or nil if there is none.
+func (r *TenantRouter) Tenant(name string) *Dispatcher {
+	for _, tenant := range r.tenants {
+		if tenant.name == name {
+			return tenant.dispatcher
+		}
+	}
+	return nil
+}
+
+// Tenants returns the names of the tenants in the order added.
+func (r *TenantRouter) Tenants() []string {
+	names := make([]string, len(r.tenants))
+	for i, tenant := range r.tenants {
+		names[i] = tenant.name
+	}
+	return names
+}
+
+// Unrouted returns the number of packets dropped as they matched no tenant.
+func (r *TenantRouter) Unrouted() uint64 {
+	return atomic.LoadUint64(&r.unrouted)
+}
+
+// route returns the dispatcher of the packet.
+func (r *TenantRouter) route(p *types.PacketManifest) *Dispatcher {
+	for _, tenant := range r.tenants {
+		for i := range tenant.rules {
+			if tenant.rules[i].Matches(p) {
+				return tenant.dispatcher
+			}
+		}
+	}
+	return r.Default
+}
+
+func (r *TenantRouter) ReceivePacket(p *types.PacketManifest) {
+	dispatcher := r.route(p)
+	if dispatcher == nil {
+		atomic.AddUint64(&r.unrouted, 1)
+		p.Release()
+		return
+	}
+	dispatcher.ReceivePacket(p)
+}
+
+// GetObservedConnectionsChan observes the connections of the Default dispatcher.
+func (r *TenantRouter) GetObservedConnectionsChan(count int) chan bool {
+	return r.Default.GetObservedConnectionsChan(count)
+}
+
+// Connections returns the connections of every dispatcher.
+func (r *TenantRouter) Connections() []ConnectionInterface {
+	var conns []ConnectionInterface
+	for _, dispatcher := range r.dispatchers() {
+		conns = append(conns, dispatcher.Connections()...)
+	}
+	return conns
+}
+
+// Stop stops every dispatcher.
+func (r *TenantRouter) Stop() {
+	for _, dispatcher := range r.dispatchers() {
+		dispatcher.Stop()
+	}
+}
+
+// dispatchers returns the Default dispatcher, if any, and those of the tenants.
+func (r *TenantRouter) dispatchers() []*Dispatcher {
+	var dispatchers []*Dispatcher
+	if r.Default != nil {
+		dispatchers = append(dispatchers, r.Default)
+	}
+	for _, tenant := range r.tenants {
+		dispatchers = append(dispatchers, tenant.dispatcher)
+	}
+	return dispatchers
+}
@@ -0,0 +1,128 @@
+package HoneyBadger
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+func tenantPacket(src net.IP, ingress *types.Ingress) *types.PacketManifest {
+	ip := layers.IPv4{
+		SrcIP:    src,
+		DstIP:    net.IP{2, 3, 4, 5},
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := layers.TCP{Seq: 3, SYN: true, SrcPort: 1, DstPort: 2}
+	ipFlow := gopacket.NewFlow(layers.EndpointIPv4, ip.SrcIP.To4(), ip.DstIP.To4())
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(tcp.SrcPort), layers.NewTCPPortEndpoint(tcp.DstPort))
+	flow := types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	return &types.PacketManifest{
+		Timestamp: time.Now(),
+		Ingress:   ingress,
+		Flow:      &flow,
+		IPv4:      &ip,
+		TCP:       &tcp,
+	}
+}
+
+func TestParseTenants(t *testing.T) {
+	tenants, err := ParseTenants("acme vlan=100,101; globex vni=5001 net=10.1.0.0/16; acme vlan=300;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tenants) != 2 || tenants[0].Name != "acme" || tenants[1].Name != "globex" {
+		t.Fatalf("parsed %+v", tenants)
+	}
+	if len(tenants[0].Rules) != 2 || !reflect.DeepEqual(tenants[0].Rules[0].VLANs, []uint16{100, 101}) || !reflect.DeepEqual(tenants[0].Rules[1].VLANs, []uint16{300}) {
+		t.Errorf("acme rules %+v", tenants[0].Rules)
+	}
+	if len(tenants[1].Rules) != 1 || !reflect.DeepEqual(tenants[1].Rules[0].VNIs, []uint32{5001}) || len(tenants[1].Rules[0].Networks) != 1 {
+		t.Errorf("globex rules %+v", tenants[1].Rules)
+	}
+	for _, invalid := range []string{"ac/me vlan=1", "acme vlan=4096", "acme vni=16777216", "acme net=10.0.0.1", "acme port=80"} {
+		if _, err := ParseTenants(invalid); err == nil {
+			t.Errorf("invalid tenant %q accepted", invalid)
+		}
+	}
+}
+
+func TestTenantRouter(t *testing.T) {
+	tenants, _ := ParseTenants("acme vlan=100; globex vni=5001 net=10.1.0.0/16")
+	options := DispatcherOptions{MaxRingPackets: 40, MaxConcurrentConnections: 10, Logger: NewDummyAttackLogger()}
+	router := NewTenantRouter(NewDispatcher(options, &DefaultConnFactory{}, nil))
+	for _, tenant := range tenants {
+		router.Add(tenant.Name, tenant.Rules, NewDispatcher(options, &DefaultConnFactory{}, nil))
+	}
+	for _, dispatcher := range router.dispatchers() {
+		dispatcher.Start()
+	}
+
+	vxlan := &types.Ingress{Tunnel: "vxlan", TunnelID: 5001}
+	router.ReceivePacket(tenantPacket(net.IP{1, 2, 3, 4}, &types.Ingress{VLANs: []uint16{100}}))
+	router.ReceivePacket(tenantPacket(net.IP{1, 2, 3, 4}, &types.Ingress{VLANs: []uint16{200, 100}}))
+	router.ReceivePacket(tenantPacket(net.IP{1, 2, 3, 4}, nil))
+	router.ReceivePacket(tenantPacket(net.IP{10, 1, 2, 3}, vxlan))
+	router.ReceivePacket(tenantPacket(net.IP{10, 2, 2, 3}, vxlan))
+
+	// the same 4-tuple is tracked apart by each tenant
+	counts := []int{len(router.Default.LiveConnections()), len(router.Tenant("acme").LiveConnections()), len(router.Tenant("globex").LiveConnections())}
+	if !reflect.DeepEqual(counts, []int{2, 1, 1}) {
+		t.Errorf("connections tracked by the default dispatcher, acme and globex: %v", counts)
+	}
+	if len(router.Connections()) != 4 {
+		t.Errorf("%d connections", len(router.Connections()))
+	}
+	if !reflect.DeepEqual(router.Tenants(), []string{"acme", "globex"}) || router.Tenant("initech") != nil {
+		t.Errorf("tenants %v", router.Tenants())
+	}
+	router.Stop()
+
+	router = NewTenantRouter(nil)
+	router.ReceivePacket(tenantPacket(net.IP{1, 2, 3, 4}, nil))
+	if router.Unrouted() != 1 {
+		t.Errorf("%d packets unrouted", router.Unrouted())
+	}
+}
+
+func TestSupervisorTenants(t *testing.T) {
+	recorder := &lifecycleRecorder{}
+	tenants, _ := ParseTenants("acme vlan=100")
+	tenant := tenants[0]
+	tenant.DispatcherOptions = DispatcherOptions{MaxRingPackets: 40, MaxConcurrentConnections: 10}
+	tenant.Loggers = []Service{recordedService{"acme attacks", recorder}}
+	supervisor := NewSupervisor(SupervisorOptions{
+		SnifferDriverOptions: &types.SnifferDriverOptions{},
+		DispatcherOptions:    DispatcherOptions{MaxRingPackets: 40, MaxConcurrentConnections: 10},
+		SnifferFactory:       NewMockSniffer,
+		ConnectionFactory:    &DefaultConnFactory{},
+		Loggers:              []Service{recordedService{"attacks", recorder}},
+		Tenants:              []Tenant{tenant},
+	})
+	go supervisor.Run()
+	<-supervisor.GetSniffer().GetStartedChan()
+	router, ok := supervisor.GetDispatcher().(*TenantRouter)
+	if !ok || supervisor.Tenant("acme") == nil || router.Default != supervisor.dispatcher {
+		t.Fatalf("packets dispatched by %T", supervisor.GetDispatcher())
+	}
+	router.ReceivePacket(tenantPacket(net.IP{1, 2, 3, 4}, &types.Ingress{VLANs: []uint16{100}}))
+	if len(supervisor.Tenant("acme").LiveConnections()) != 1 || len(supervisor.dispatcher.LiveConnections()) != 0 {
+		t.Error("packet not dispatched to its tenant")
+	}
+	if err := supervisor.ReconfigureTenant("initech", DispatcherOptions{}); err == nil {
+		t.Error("unknown tenant reconfigured")
+	}
+	supervisor.Stop()
+
+	expected := []string{"start attacks", "start acme attacks", "stop acme attacks", "stop attacks"}
+	if !reflect.DeepEqual(recorder.events, expected) {
+		t.Errorf("lifecycle %v, expected %v", recorder.events, expected)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// MAX_CLIENT_HELLO_BYTES bounds the client stream bytes buffered
+// while waiting for the rest of a TLS ClientHello.
+const MAX_CLIENT_HELLO_BYTES = 16 * 1024
+
+// TLS record and handshake constants used to recognize a ClientHello.
+const (
+	tlsRecordHandshake     = 22
+	tlsHandshakeHello      = 1
+	tlsExtServerName       = 0
+	tlsExtSupportedGroups  = 10
+	tlsExtPointFormats     = 11
+	tlsExtALPN             = 16
+	tlsExtSupportedVersion = 43
+)
+
+// clientHelloSniffer collects the first bytes the client sends until
+// they either make up a TLS ClientHello or are known not to.
+type clientHelloSniffer struct {
+	buffer []byte
+	done   bool
+	hello  *types.TLSClientHello
+}
+
+// feed adds in order client stream data; once enough has been seen hello
+// is set, unless the stream turns out not to start with a ClientHello.
+func (s *clientHelloSniffer) feed(data []byte) {
+	if s.done || len(data) == 0 {
+		return
+	}
+	s.buffer = append(s.buffer, data...)
+	hello, complete := parseClientHello(s.buffer)
+	if !complete && len(s.buffer) < MAX_CLIENT_HELLO_BYTES {
+		return
+	}
+	s.done = true
+	s.buffer = nil
+	s.hello = hello
+}
+
+// tlsReader reads the fields of a TLS message and
+// notes whether it ran out of data.
+type tlsReader struct {
+	b     []byte
+	short bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if r.short || len(r.b) < n {
+		r.short = true
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *tlsReader) uint8() int {
+	if b := r.bytes(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *tlsReader) uint16() int {
+	if b := r.bytes(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *tlsReader) uint24() int {
+	if b := r.bytes(3); b != nil {
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	}
+	return 0
+}
+
+// vector returns a reader of a vector of data with a length prefix of n bytes.
+func (r *tlsReader) vector(n int) *tlsReader {
+	var length int
+	switch n {
+	case 1:
+		length = r.uint8()
+	case 2:
+		length = r.uint16()
+	}
+	v := &tlsReader{b: r.bytes(length)}
+	v.short = r.short
+	return v
+}
+
+// parseClientHello parses the TLS ClientHello a client stream starts with.
+// complete is false if the stream may yet turn out to be a ClientHello
+// once more of it is seen; otherwise a nil hello means it is not one.
+func parseClientHello(stream []byte) (hello *types.TLSClientHello, complete bool) {
+	// the handshake message may be fragmented over several records
+	var message []byte
+	records := &tlsReader{b: stream}
+	for {
+		if len(records.b) == 0 {
+			return nil, false
+		}
+		if records.uint8() != tlsRecordHandshake {
+			return nil, true
+		}
+		if major := records.uint8(); !records.short && major != 3 {
+			return nil, true
+		}
+		records.uint8()
+		fragment := records.vector(2)
+		if records.short {
+			return nil, false
+		}
+		message = append(message, fragment.b...)
+		if len(message) >= 4 {
+			if message[0] != tlsHandshakeHello {
+				return nil, true
+			}
+			length := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+			if len(message) >= 4+length {
+				message = message[4 : 4+length]
+				break
+			}
+		}
+	}
+
+	r := &tlsReader{b: message}
+	clientVersion := r.uint16()
+	r.bytes(32) // random
+	r.vector(1) // session id
+	ciphers := r.vector(2)
+	r.vector(1) // compression methods
+	if r.short {
+		return nil, true
+	}
+	hello = &types.TLSClientHello{
+		Version: tlsVersionName(clientVersion),
+	}
+	var cipherList, extensionList, groupList, formatList []string
+	for len(ciphers.b) >= 2 {
+		if cipher := ciphers.uint16(); !tlsGrease(cipher) {
+			cipherList = append(cipherList, strconv.Itoa(cipher))
+		}
+	}
+	extensions := r.vector(2)
+	for len(extensions.b) >= 4 && !extensions.short {
+		extType := extensions.uint16()
+		data := extensions.vector(2)
+		if tlsGrease(extType) {
+			continue
+		}
+		extensionList = append(extensionList, strconv.Itoa(extType))
+		switch extType {
+		case tlsExtServerName:
+			names := data.vector(2)
+			for len(names.b) > 0 && !names.short {
+				nameType := names.uint8()
+				name := names.vector(2)
+				if nameType == 0 && !name.short {
+					hello.ServerName = string(name.b)
+				}
+			}
+		case tlsExtALPN:
+			protocols := data.vector(2)
+			for len(protocols.b) > 0 && !protocols.short {
+				if protocol := protocols.vector(1); !protocol.short {
+					hello.ALPN = append(hello.ALPN, string(protocol.b))
+				}
+			}
+		case tlsExtSupportedGroups:
+			groups := data.vector(2)
+			for len(groups.b) >= 2 {
+				if group := groups.uint16(); !tlsGrease(group) {
+					groupList = append(groupList, strconv.Itoa(group))
+				}
+			}
+		case tlsExtPointFormats:
+			formats := data.vector(1)
+			for len(formats.b) > 0 {
+				formatList = append(formatList, strconv.Itoa(formats.uint8()))
+			}
+		case tlsExtSupportedVersion:
+			versions := data.vector(1)
+			highest := 0
+			for len(versions.b) >= 2 {
+				if version := versions.uint16(); !tlsGrease(version) && version > highest {
+					highest = version
+				}
+			}
+			if highest != 0 {
+				hello.Version = tlsVersionName(highest)
+			}
+		}
+	}
+	hello.JA3 = fmt.Sprintf("%d,%s,%s,%s,%s", clientVersion,
+		strings.Join(cipherList, "-"), strings.Join(extensionList, "-"),
+		strings.Join(groupList, "-"), strings.Join(formatList, "-"))
+	digest := md5.Sum([]byte(hello.JA3))
+	hello.JA3Hash = hex.EncodeToString(digest[:])
+	return hello, true
+}
+
+// tlsGrease returns true for the GREASE values clients
+// advertise at random, which fingerprints leave out.
+func tlsGrease(v int) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func tlsVersionName(version int) string {
+	switch version {
+	case 0x0300:
+		return "SSL 3.0"
+	case 0x0301:
+		return "TLS 1.0"
+	case 0x0302:
+		return "TLS 1.1"
+	case 0x0303:
+		return "TLS 1.2"
+	case 0x0304:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
@@ -0,0 +1,106 @@
+package HoneyBadger
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// clientHelloBytes returns the ClientHello crypto/tls
+// sends to connect to the given server name.
+func clientHelloBytes(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	hello := make(chan []byte)
+	go func() {
+		buf := make([]byte, 64*1024)
+		n, _ := server.Read(buf)
+		// the record header tells how much of the hello is still to come
+		for n < 5 || n < 5+int(buf[3])<<8+int(buf[4]) {
+			m, err := server.Read(buf[n:])
+			if err != nil {
+				break
+			}
+			n += m
+		}
+		server.Close()
+		hello <- buf[:n]
+	}()
+	conn := tls.Client(client, &tls.Config{ServerName: serverName, NextProtos: []string{"h2", "http/1.1"}})
+	conn.Handshake()
+	conn.Close()
+	return <-hello
+}
+
+func TestClientHelloSniffer(t *testing.T) {
+	data := clientHelloBytes(t, "example.com")
+
+	sniffer := clientHelloSniffer{}
+	sniffer.feed(data[:20])
+	if sniffer.done {
+		t.Fatal("sniffer gave up on a partial ClientHello")
+	}
+	sniffer.feed(data[20:])
+	hello := sniffer.hello
+	if hello == nil {
+		t.Fatal("ClientHello not recognized")
+	}
+	if hello.ServerName != "example.com" || strings.Join(hello.ALPN, ",") != "h2,http/1.1" || hello.Version != "TLS 1.3" {
+		t.Errorf("got %+v", hello)
+	}
+	if !strings.HasPrefix(hello.JA3, "771,") || len(hello.JA3Hash) != 32 {
+		t.Errorf("got JA3 %s hash %s", hello.JA3, hello.JA3Hash)
+	}
+
+	sniffer = clientHelloSniffer{}
+	sniffer.feed([]byte("GET / HTTP/1.1\r\n"))
+	if !sniffer.done || sniffer.hello != nil {
+		t.Error("plain text stream taken for a ClientHello")
+	}
+}
+
+func TestTLSGrease(t *testing.T) {
+	for _, v := range []int{0x0a0a, 0x1a1a, 0xfafa} {
+		if !tlsGrease(v) {
+			t.Errorf("%04x is GREASE", v)
+		}
+	}
+	for _, v := range []int{0x0a1a, 0x1301, 0x0303} {
+		if tlsGrease(v) {
+			t.Errorf("%04x is not GREASE", v)
+		}
+	}
+}
+
+func TestConnectionReportsClientHello(t *testing.T) {
+	hello := clientHelloBytes(t, "example.com")
+	forged := append([]byte(nil), hello...)
+	forged[len(forged)-1] ^= 0xff
+	// in order stream data takes the fast path unless
+	// handshake hijacks are still being looked for
+	for _, detectHijack := range []bool{false, true} {
+		logger := NewDummyAttackLogger()
+		options := DispatcherOptions{
+			Logger:          logger,
+			MaxRingPackets:  40,
+			DetectHijack:    detectHijack,
+			DetectInjection: true,
+		}
+		dispatcher := NewDispatcher(options, &DefaultConnFactory{}, nil)
+		_, packet := newTestConnection(nil)
+		dispatcher.dispatchPacket(packet(true, layers.TCP{Seq: 99, SYN: true}, []byte{}))
+		dispatcher.dispatchPacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true}, []byte{}))
+		dispatcher.dispatchPacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true}, []byte{}))
+		dispatcher.dispatchPacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true, PSH: true}, hello))
+		dispatcher.dispatchPacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true, PSH: true}, forged))
+		dispatcher.closeConnectionList(dispatcher.Connections())
+		if logger.Count == 0 {
+			t.Fatalf("detect_hijack %v: injection not reported", detectHijack)
+		}
+		if logger.Last.TLS == nil || logger.Last.TLS.ServerName != "example.com" {
+			t.Errorf("detect_hijack %v: injection reported with ClientHello %+v", detectHijack, logger.Last.TLS)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// Tracking rule actions: always track matching connections,
+	// regardless of sampling,
+	TRACK_ALWAYS = 0
+	// or never track them.
+	TRACK_NEVER = 1
+)
+
+// PortRange is an inclusive range of TCP ports.
+type PortRange struct {
+	Low, High int
+}
+
+// TrackingRule decides whether new connections are tracked. A connection
+// matches the rule if either of its ends is within one of the rule's
+// networks and either of its ends uses a port within one of the rule's
+// port ranges; a rule without networks or without ports leaves that
+// condition out.
+type TrackingRule struct {
+	Action   int
+	Networks []*net.IPNet
+	Ports    []PortRange
+}
+
+// ParseTrackingRules parses a semicolon separated list of tracking rules;
+// each an action, "always" or "never", followed by the space separated
+// conditions "net=<CIDR>[,<CIDR>...]" and "port=<port|low-high>[,...]".
+// For example: "always net=10.0.0.25/32 port=25,465-587; never net=10.9.0.0/16".
+func ParseTrackingRules(rules string) ([]TrackingRule, error) {
+	var result []TrackingRule
+	for _, text := range strings.Split(rules, ";") {
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		rule := TrackingRule{}
+		switch fields[0] {
+		case "always":
+			rule.Action = TRACK_ALWAYS
+		case "never":
+			rule.Action = TRACK_NEVER
+		default:
+			return nil, fmt.Errorf("unknown tracking rule action %q", fields[0])
+		}
+		for _, field := range fields[1:] {
+			var err error
+			switch {
+			case strings.HasPrefix(field, "net="):
+				rule.Networks, err = parseNetworks(strings.TrimPrefix(field, "net="))
+			case strings.HasPrefix(field, "port="):
+				rule.Ports, err = parsePortRanges(strings.TrimPrefix(field, "port="))
+			default:
+				err = fmt.Errorf("unknown tracking rule condition %q", field)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func parsePortRanges(list string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, field := range strings.Split(list, ",") {
+		bounds := strings.SplitN(field, "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		high := low
+		if err == nil && len(bounds) == 2 {
+			high, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil || low <= 0 || high > 65535 || low > high {
+			return nil, fmt.Errorf("invalid port range %q", field)
+		}
+		ranges = append(ranges, PortRange{Low: low, High: high})
+	}
+	return ranges, nil
+}
+
+// Matches returns true if the connection of the given flow matches the rule.
+func (r *TrackingRule) Matches(flow *types.TcpIpFlow) bool {
+	_, tcpFlow := flow.Flows()
+	if len(r.Networks) > 0 && !flowInNetworks(flow, r.Networks) {
+		return false
+	}
+	if len(r.Ports) > 0 {
+		if len(tcpFlow.Src().Raw()) != 2 || len(tcpFlow.Dst().Raw()) != 2 {
+			return false
+		}
+		src := int(binary.BigEndian.Uint16(tcpFlow.Src().Raw()))
+		dst := int(binary.BigEndian.Uint16(tcpFlow.Dst().Raw()))
+		matched := false
+		for _, ports := range r.Ports {
+			if (ports.Low <= src && src <= ports.High) || (ports.Low <= dst && dst <= ports.High) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// flowInNetworks returns true if either end of the flow is within one of the networks.
+func flowInNetworks(flow *types.TcpIpFlow, networks []*net.IPNet) bool {
+	ipFlow, _ := flow.Flows()
+	src, dst := net.IP(ipFlow.Src().Raw()), net.IP(ipFlow.Dst().Raw())
+	for _, network := range networks {
+		if network.Contains(src) || network.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTrackingRules returns the action of the first of the given rules
+// matching the connection of the flow, if any does.
+func matchTrackingRules(rules []TrackingRule, flow *types.TcpIpFlow) (int, bool) {
+	for i := range rules {
+		if rules[i].Matches(flow) {
+			return rules[i].Action, true
+		}
+	}
+	return 0, false
+}
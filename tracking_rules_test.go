@@ -0,0 +1,45 @@
+package HoneyBadger
+
+import (
+	"testing"
+)
+
+func TestParseTrackingRules(t *testing.T) {
+	rules, err := ParseTrackingRules("always net=2.3.4.5/32 port=25,465-587; never net=1.2.3.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Action != TRACK_ALWAYS || rules[1].Action != TRACK_NEVER {
+		t.Fatalf("parsed %+v", rules)
+	}
+	if len(rules[0].Ports) != 2 || rules[0].Ports[1] != (PortRange{Low: 465, High: 587}) {
+		t.Errorf("port ranges %+v", rules[0].Ports)
+	}
+	for _, invalid := range []string{"sometimes", "always port=0", "never port=10-5", "always net=1.2.3.4", "always vlan=12"} {
+		if _, err := ParseTrackingRules(invalid); err == nil {
+			t.Errorf("invalid tracking rule %q accepted", invalid)
+		}
+	}
+}
+
+func TestTrackingRuleMatches(t *testing.T) {
+	rules, _ := ParseTrackingRules("always net=2.3.4.5/32 port=25,465-587; never net=1.2.3.0/24")
+	trackingRuleTests := []struct {
+		port    int
+		matched bool
+		action  int
+	}{
+		{25, true, TRACK_ALWAYS},
+		{500, true, TRACK_ALWAYS},
+		{80, true, TRACK_NEVER},
+	}
+	for _, test := range trackingRuleTests {
+		action, matched := matchTrackingRules(rules, testFlow(40000, test.port))
+		if matched != test.matched || action != test.action {
+			t.Errorf("port %d matched %v action %d, expected %v %d", test.port, matched, action, test.matched, test.action)
+		}
+	}
+	if _, matched := matchTrackingRules(rules[:1], testFlow(40000, 80)); matched {
+		t.Error("the rule's port condition was left out")
+	}
+}
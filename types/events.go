@@ -37,10 +37,48 @@ type PacketLogger interface {
 	SetFileWriter(io.WriteCloser)
 }
 
+// PacketManifestLogger is implemented by packet loggers which write
+// packets after WritePacketManifest returns; they retain the manifest
+// until its packet is written. Other packet loggers must copy a raw
+// packet they keep past WritePacket; see GetPacketManifest.
+type PacketManifestLogger interface {
+	WritePacketManifest(*PacketManifest)
+}
+
+// PacketAnnotator is implemented by packet loggers which can mark
+// the most recently written packet as having triggered an attack report.
+type PacketAnnotator interface {
+	AnnotatePacket(*Event)
+}
+
+// PacketLogErrorReporter is implemented by packet loggers which hand
+// the errors met writing their packets to the given function, which
+// may be called from the packet logger's own goroutine.
+type PacketLogErrorReporter interface {
+	SetErrorHandler(func(error))
+}
+
+// PacketLogRotator is implemented by packet loggers whose
+// current file can be rotated on request.
+type PacketLogRotator interface {
+	Rotate()
+}
+
 type PacketLoggerFactory interface {
 	Build(*TcpIpFlow) PacketLogger
 }
 
+// Compressor compresses log files in the background
+// so that the capture path is not held up.
+type Compressor interface {
+	// Extension returns the file name extension of the compressed format, such as ".gz".
+	Extension() string
+	// Compress writes the compressed content of src to the file dst, closes
+	// src and then calls done, if it is not nil, with the outcome. It returns
+	// false without taking src if the compressor is too far behind.
+	Compress(src io.ReadCloser, dst string, done func(error)) bool
+}
+
 type Event struct {
 	Type          string
 	PacketCount   uint64
@@ -54,4 +92,33 @@ type Event struct {
 	Base          Sequence
 	Start         Sequence
 	End           Sequence
+	SampleRate    float64
+	Snippet       string
+	Occurrences   uint64
+	TLS           *TLSClientHello
+	Ingress       *Ingress
+	SrcAS         *AutonomousSystem
+	DstAS         *AutonomousSystem
+}
+
+// AutonomousSystem is the network an address is routed to: the origin
+// AS number and the most specific routed prefix covering the address,
+// and, where known, the AS name and its registration country.
+type AutonomousSystem struct {
+	Number  uint32
+	Prefix  string
+	Name    string
+	Country string
+}
+
+// TLSClientHello is what the client's TLS ClientHello tells of the service
+// it connects to: the server name (SNI), the application protocols offered
+// (ALPN), the highest TLS version offered and the client's JA3 fingerprint,
+// both as the JA3 string and as its MD5 hash.
+type TLSClientHello struct {
+	ServerName string
+	ALPN       []string
+	Version    string
+	JA3        string
+	JA3Hash    string
 }
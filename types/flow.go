@@ -23,6 +23,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -71,13 +74,45 @@ func (t *TcpIpFlow) Reverse() TcpIpFlow {
 	return NewTcpIpFlowFromFlows(t.ipFlow.Reverse(), t.tcpFlow.Reverse())
 }
 
-// Equal returns true if TcpIpFlow structs t and s are equal. False otherwise.
-func (t *TcpIpFlow) Equal(s *TcpIpFlow) bool {
-	ipEndSrc1, _ := t.ipFlow.Endpoints()
-	ipEndSrc2, _ := s.ipFlow.Endpoints()
-	if ipEndSrc1.EndpointType() != ipEndSrc2.EndpointType() {
-		panic(fmt.Sprintf("TcpIpFlow.Equal fail: mismatched flow types %s != %s", ipEndSrc1.EndpointType(), ipEndSrc2.EndpointType()))
+// ParseTcpIpFlow parses a flow formatted by String, such as
+// 10.0.0.1:5000-10.0.0.2:80.
+func ParseTcpIpFlow(name string) (*TcpIpFlow, error) {
+	ends := strings.Split(name, "-")
+	if len(ends) != 2 {
+		return nil, fmt.Errorf("invalid flow %q", name)
+	}
+	var ips [2]net.IP
+	var ports [2]layers.TCPPort
+	for i, end := range ends {
+		colon := strings.LastIndex(end, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("invalid flow %q: missing port", name)
+		}
+		ips[i] = net.ParseIP(end[:colon])
+		if ips[i] == nil {
+			return nil, fmt.Errorf("invalid flow %q: invalid address %q", name, end[:colon])
+		}
+		if ip4 := ips[i].To4(); ip4 != nil {
+			ips[i] = ip4
+		}
+		port, err := strconv.ParseUint(end[colon+1:], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flow %q: invalid port %q", name, end[colon+1:])
+		}
+		ports[i] = layers.TCPPort(port)
+	}
+	if len(ips[0]) != len(ips[1]) {
+		return nil, fmt.Errorf("invalid flow %q: mixed address families", name)
 	}
+	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(ips[0]), layers.NewIPEndpoint(ips[1]))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(ports[0]), layers.NewTCPPortEndpoint(ports[1]))
+	flow := NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	return &flow, nil
+}
+
+// Equal returns true if TcpIpFlow structs t and s are equal. False otherwise;
+// flows of different address families are never equal.
+func (t *TcpIpFlow) Equal(s *TcpIpFlow) bool {
 	return t.ipFlow == s.ipFlow && t.tcpFlow == s.tcpFlow
 }
 
@@ -164,3 +199,32 @@ func NewHashedTcpIpv4Flow(flow *TcpIpFlow) HashedTcpIpv4Flow {
 		return hash
 	}
 }
+
+// FlowKey is a comparable key identifying a TCP connection of either address
+// family. The key's ends are kept in sorted order so that both flows of a
+// connection share the same key.
+type FlowKey struct {
+	// each end's IP address followed by its TCP port
+	A, B [18]byte
+	IPv6 bool
+}
+
+// NewFlowKey returns the connection key of the flow and whether the flow's
+// direction is the reverse of the key's; that is whether the flow's source
+// is the key's B end.
+func NewFlowKey(flow *TcpIpFlow) (FlowKey, bool) {
+	key := FlowKey{
+		IPv6: flow.ipFlow.EndpointType() == layers.EndpointIPv6,
+	}
+	src, dst := flow.ipFlow.Endpoints()
+	tcpSrc, tcpDst := flow.tcpFlow.Endpoints()
+	n := copy(key.A[:16], src.Raw())
+	copy(key.A[n:], tcpSrc.Raw())
+	n = copy(key.B[:16], dst.Raw())
+	copy(key.B[n:], tcpDst.Raw())
+	if bytes.Compare(key.A[:], key.B[:]) < 0 {
+		key.A, key.B = key.B, key.A
+		return key, true
+	}
+	return key, false
+}
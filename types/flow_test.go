@@ -29,6 +29,29 @@ func TestFlowString(t *testing.T) {
 	}
 }
 
+func TestParseTcpIpFlow(t *testing.T) {
+	for _, name := range []string{"1.2.3.4:1-2.3.4.5:2", "2001:db8::1:443-2001:db8::2:5000"} {
+		flow, err := ParseTcpIpFlow(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flow.String() != name {
+			t.Errorf("parsed %s as %s", name, flow)
+		}
+	}
+	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.IPv4(1, 2, 3, 4)), layers.NewIPEndpoint(net.IPv4(2, 3, 4, 5)))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(1)), layers.NewTCPPortEndpoint(layers.TCPPort(2)))
+	expected := NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	if flow, _ := ParseTcpIpFlow(expected.String()); flow == nil || !flow.Equal(&expected) {
+		t.Error("parsed flow not equal to the flow formatted")
+	}
+	for _, name := range []string{"", "1.2.3.4:1", "1.2.3.4-2.3.4.5:2", "1.2.3.4:1-2.3.4.5:99999", "1.2.3.4:1-2001:db8::2:2"} {
+		if _, err := ParseTcpIpFlow(name); err == nil {
+			t.Errorf("invalid flow %q parsed", name)
+		}
+	}
+}
+
 func TestFlowEqual(t *testing.T) {
 	ipFlow1, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.IPv4(1, 2, 3, 4)), layers.NewIPEndpoint(net.IPv4(2, 3, 4, 5)))
 	tcpFlow1, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(1)), layers.NewTCPPortEndpoint(layers.TCPPort(2)))
@@ -51,6 +74,12 @@ func TestFlowEqual(t *testing.T) {
 		t.Error("TcpIpFlow.Equal fail")
 		t.Fail()
 	}
+
+	ipFlow4, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.ParseIP("2001:db8::1")), layers.NewIPEndpoint(net.ParseIP("2001:db8::2")))
+	flow4 := NewTcpIpFlowFromFlows(ipFlow4, tcpFlow1)
+	if flow1.Equal(&flow4) || flow4.Equal(&TcpIpFlow{}) {
+		t.Error("flows of different address families are equal")
+	}
 }
 
 func TestNewTcpIpFlowFromPacket(t *testing.T) {
@@ -142,3 +171,24 @@ func TestHashedTcpIpv6Flow(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestFlowKey(t *testing.T) {
+	tcpIpFlow := FlowFromPacket()
+	key1, reversed1 := NewFlowKey(tcpIpFlow)
+	f := tcpIpFlow.Reverse()
+	key2, reversed2 := NewFlowKey(&f)
+	if key1 != key2 {
+		t.Error("both directions of a connection must share a key")
+	}
+	if reversed1 == reversed2 {
+		t.Error("the directions of a connection must be told apart")
+	}
+
+	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.ParseIP("::1")), layers.NewIPEndpoint(net.ParseIP("::2")))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(1)), layers.NewTCPPortEndpoint(layers.TCPPort(2)))
+	ipv6Flow := NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	key3, _ := NewFlowKey(&ipv6Flow)
+	if !key3.IPv6 || key3 == key1 {
+		t.Error("ipv6 connection key fail")
+	}
+}
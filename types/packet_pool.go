@@ -0,0 +1,110 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket/layers"
+)
+
+// POOLED_TCP_OPTIONS is the number of TCP options a pooled packet holds
+// without allocating; more than that, as NOPs count, are rare.
+const POOLED_TCP_OPTIONS = 8
+
+// pooledPacket is a PacketManifest together with the layers and flow it
+// points to and the buffer holding its raw packet, recycled by packetPool.
+type pooledPacket struct {
+	manifest   PacketManifest
+	ip4        layers.IPv4
+	ip6        layers.IPv6
+	tcp        layers.TCP
+	tcpOptions [POOLED_TCP_OPTIONS]layers.TCPOption
+	flow       TcpIpFlow
+	buf        []byte
+}
+
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		pooled := &pooledPacket{}
+		pooled.manifest.pooled = pooled
+		return pooled
+	},
+}
+
+// GetPacketManifest returns a PacketManifest from the pool of packets
+// whose RawPacket is a copy of rawPacket and whose IPv4, IPv6, TCP and
+// Flow point to zero values of its own; its TCP layer has room for
+// POOLED_TCP_OPTIONS options. It is referenced once.
+//
+// A pooled manifest, its layers, RawPacket and Payload are reused once
+// the last reference to it is released, so that steady-state processing
+// allocates nearly nothing per packet. Whoever hands a packet on hands on
+// its reference: the capture to the decoder, the decoder to the dispatcher,
+// which releases it once the connection has analysed it. Whatever keeps
+// the manifest or its bytes past that, as the packet loggers and the attack
+// snippets do, must Retain it and Release it once done; the rest copies
+// what it keeps, as the stream rings and reassembly pages do.
+func GetPacketManifest(rawPacket []byte) *PacketManifest {
+	pooled := packetPool.Get().(*pooledPacket)
+	if cap(pooled.buf) < len(rawPacket) {
+		pooled.buf = make([]byte, len(rawPacket))
+	}
+	pooled.buf = pooled.buf[:len(rawPacket)]
+	copy(pooled.buf, rawPacket)
+	p := &pooled.manifest
+	p.RawPacket = pooled.buf
+	p.IPv4, p.IPv6, p.TCP, p.Flow = &pooled.ip4, &pooled.ip6, &pooled.tcp, &pooled.flow
+	pooled.tcp.Options = pooled.tcpOptions[:0]
+	p.refs = 1
+	return p
+}
+
+// Retain references the packet once more, keeping it from being
+// reused until Release is called for this reference too.
+// Packets not taken from the pool are left to the garbage collector.
+func (p *PacketManifest) Retain() {
+	if p.pooled != nil {
+		atomic.AddInt32(&p.refs, 1)
+	}
+}
+
+// Release releases a reference to the packet, returning it to the pool
+// once none is left; the packet nor its bytes may be used afterwards.
+func (p *PacketManifest) Release() {
+	if p.pooled == nil {
+		return
+	}
+	refs := atomic.AddInt32(&p.refs, -1)
+	if refs > 0 {
+		return
+	}
+	if refs < 0 {
+		panic("packet manifest released more often than referenced")
+	}
+	pooled := p.pooled
+	*p = PacketManifest{pooled: pooled}
+	pooled.ip4 = layers.IPv4{}
+	pooled.ip6 = layers.IPv6{}
+	pooled.tcp = layers.TCP{}
+	pooled.tcpOptions = [POOLED_TCP_OPTIONS]layers.TCPOption{}
+	packetPool.Put(pooled)
+}
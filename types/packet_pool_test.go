@@ -0,0 +1,44 @@
+package types
+
+import (
+	"testing"
+)
+
+func TestPacketManifestPool(t *testing.T) {
+	raw := []byte{1, 2, 3}
+	p := GetPacketManifest(raw)
+	raw[0] = 9
+	if string(p.RawPacket) != "\x01\x02\x03" {
+		t.Errorf("raw packet %v not copied", p.RawPacket)
+	}
+	if p.IPv4 == nil || p.IPv6 == nil || p.TCP == nil || p.Flow == nil || cap(p.TCP.Options) != POOLED_TCP_OPTIONS {
+		t.Fatalf("pooled manifest layers not set up: %+v", p)
+	}
+	p.TCP.Seq = 7
+	p.Retain()
+	p.Release()
+	if p.TCP.Seq != 7 || p.RawPacket == nil {
+		t.Error("packet reset while still referenced")
+	}
+	p.Release()
+	if p.RawPacket != nil || p.pooled == nil {
+		t.Error("released packet not reset for reuse")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("releasing a packet twice did not panic")
+		}
+	}()
+	p.Release()
+}
+
+func TestPacketManifestNotPooled(t *testing.T) {
+	p := &PacketManifest{RawPacket: []byte{1}}
+	p.Retain()
+	p.Release()
+	p.Release()
+	if string(p.RawPacket) != "\x01" {
+		t.Error("manifest not taken from the pool reset")
+	}
+}
@@ -21,6 +21,7 @@ package types
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"time"
@@ -36,6 +37,13 @@ type SnifferDriverOptions struct {
 	Snaplen      int32
 	WireDuration time.Duration
 	Filter       string
+	// packets are read in batches of BatchSize, handed on to be decoded
+	// once full or once FlushInterval has passed since the first was read
+	BatchSize     int
+	FlushInterval time.Duration
+	// the goroutines reading and decoding packets run on threads bound
+	// to CPUs, if set; those the IRQs of the NIC's queues are bound to
+	CPUs []int
 }
 
 // PacketDataSource is an interface for some source of packet data.
@@ -51,21 +59,53 @@ type PacketDataSourceCloser interface {
 	Close() error
 }
 
+// FilterSetter is a PacketDataSourceCloser whose
+// BPF filter can be changed while it captures.
+type FilterSetter interface {
+	SetFilter(filter string) error
+}
+
+// DropCounter is a packet source, or a PacketDataSourceCloser, which
+// counts the packets dropped as they were not captured in time.
+type DropCounter interface {
+	// Drops returns the number of packets dropped since capture started.
+	Drops() (uint64, error)
+}
+
 type Supervisor interface {
 	Stopped()
 	Run()
 }
 
+// PacketSource captures packets until the context it is started with is
+// cancelled, Stop is called or it is exhausted, when it tells its
+// Supervisor it has stopped. Stop returns once the packets already
+// captured have been handed on.
 type PacketSource interface {
-	Start()
+	Start(ctx context.Context)
 	Stop()
 	SetSupervisor(Supervisor)
 	GetStartedChan() chan bool // used for unit tests
 }
 
+// Ingress is where a packet was seen: the capture interface, the VLAN IDs
+// it was tagged with, outermost first, and, if it was encapsulated, the
+// outermost tunnel: its type, "ipip", "gre", "erspan" or "vxlan", its ID,
+// the GRE key, ERSPAN session or VXLAN network identifier, and its
+// endpoints. An Ingress may be shared by many packets and must not be modified.
+type Ingress struct {
+	Interface string
+	VLANs     []uint16
+	Tunnel    string
+	TunnelID  uint32
+	TunnelSrc string
+	TunnelDst string
+}
+
 // PacketManifest is used to send parsed packets via channels to other goroutines
 type PacketManifest struct {
 	Timestamp time.Time
+	Ingress   *Ingress
 	Flow      *TcpIpFlow
 	RawPacket []byte
 	Ethernet  *layers.Ethernet
@@ -73,6 +113,10 @@ type PacketManifest struct {
 	IPv6      *layers.IPv6
 	TCP       *layers.TCP
 	Payload   gopacket.Payload
+
+	// set if the manifest was taken from the pool; see GetPacketManifest
+	pooled *pooledPacket
+	refs   int32
 }
 
 func (p PacketManifest) String() string {
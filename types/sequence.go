@@ -29,16 +29,13 @@ type Sequence int64
 // The number returned is the sequence difference, so 4.Difference(8) will
 // return 4.
 //
-// It handles rollovers by considering any sequence in the first quarter of the
-// uint32 space to be after any sequence in the last quarter of that space, thus
-// wrapping the uint32 space.
+// It handles rollovers using serial number arithmetic (RFC 1982): the
+// sequences are compared modulo 2^32, so t comes after s if it is less than
+// half of the sequence space ahead of s. Every ordering of sequences in
+// HoneyBadger should be made through Difference or the helpers below rather
+// than by comparing or subtracting Sequence values directly.
 func (s Sequence) Difference(t Sequence) int {
-	if s > uint32Max-uint32Max/4 && t < uint32Max/4 {
-		t += uint32Max
-	} else if t > uint32Max-uint32Max/4 && s < uint32Max/4 {
-		s += uint32Max
-	}
-	return int(t - s)
+	return int(int32(uint32(t) - uint32(s)))
 }
 
 // LessThan returns true if s < t
@@ -66,6 +63,11 @@ func (s Sequence) GreaterThanOrEqual(t Sequence) bool {
 	return s.Difference(t) <= 0
 }
 
+// Within returns true if s lies in the half open range [start, end).
+func (s Sequence) Within(start, end Sequence) bool {
+	return start.LessThanOrEqual(s) && s.LessThan(end)
+}
+
 // Add adds an integer to a sequence and returns the resulting sequence.
 func (s Sequence) Add(t int) Sequence {
 	return (s + Sequence(t)) & uint32Max
@@ -0,0 +1,50 @@
+package types
+
+import (
+	"testing"
+)
+
+func TestSequenceDifferenceWraps(t *testing.T) {
+	tests := []struct {
+		s, t Sequence
+		want int
+	}{
+		{4, 8, 4},
+		{8, 4, -4},
+		{0xFFFFFFFF, 0, 1},
+		{0, 0xFFFFFFFF, -1},
+		{0xFFFFFFF0, 0x10, 0x20},
+		{0x10, 0xFFFFFFF0, -0x20},
+		{0x7FFFFFF0, 0x80000010, 0x20},
+		{0xBFFFFFFF, 0x3FFFFFFF, -0x80000000},
+	}
+	for i, test := range tests {
+		if got := test.s.Difference(test.t); got != test.want {
+			t.Errorf("test %d: %d.Difference(%d) = %d, expected %d", i, test.s, test.t, got, test.want)
+		}
+	}
+}
+
+func TestSequenceAddWraps(t *testing.T) {
+	if got := Sequence(0xFFFFFFFE).Add(3); got != 1 {
+		t.Errorf("Add across the wrap gave %d, expected 1", got)
+	}
+	if got := Sequence(1).Add(-3); got != 0xFFFFFFFE {
+		t.Errorf("negative Add across the wrap gave %d, expected %d", got, Sequence(0xFFFFFFFE))
+	}
+}
+
+func TestSequenceWithin(t *testing.T) {
+	start := Sequence(0xFFFFFFF0)
+	end := start.Add(0x20)
+	for _, seq := range []Sequence{0xFFFFFFF0, 0xFFFFFFFF, 0, 0xF} {
+		if !seq.Within(start, end) {
+			t.Errorf("%d should be within [%d, %d)", seq, start, end)
+		}
+	}
+	for _, seq := range []Sequence{0xFFFFFFEF, 0x10, 0x80000000} {
+		if seq.Within(start, end) {
+			t.Errorf("%d should not be within [%d, %d)", seq, start, end)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// RFC 7323 limits the window scale shift count to 14
+const MAX_WINDOW_SCALE = 14
+
+// receiveWindow tracks the receive window last advertised by one endpoint
+// of a connection; the range of sequence numbers it is prepared to accept.
+type receiveWindow struct {
+	// scale is the endpoint's window scale shift count; it only
+	// applies if both endpoints sent the option during the handshake
+	scale uint
+	left  types.Sequence
+	size  int
+	valid bool
+}
+
+// windowScale returns the shift count of the window scale option
+// amongst the given TCP options, if there is one.
+func windowScale(options []layers.TCPOption) (uint, bool) {
+	for _, option := range options {
+		if option.OptionType == layers.TCPOptionKindWindowScale && len(option.OptionData) == 1 {
+			shift := uint(option.OptionData[0])
+			if shift > MAX_WINDOW_SCALE {
+				shift = MAX_WINDOW_SCALE
+			}
+			return shift, true
+		}
+	}
+	return 0, false
+}
+
+// advertise records the receive window advertised by a packet sent by the
+// endpoint. The window field of SYN segments is never scaled.
+func (w *receiveWindow) advertise(tcp *layers.TCP) {
+	if !tcp.ACK {
+		return
+	}
+	w.left = types.Sequence(tcp.Ack)
+	if tcp.SYN {
+		w.size = int(tcp.Window)
+	} else {
+		w.size = int(tcp.Window) << w.scale
+	}
+	w.valid = true
+}
+
+// contains returns true if seq lies within the window; a zero window
+// still admits a one byte window probe. Before any window has been
+// advertised every sequence is considered to be within it.
+func (w *receiveWindow) contains(seq types.Sequence) bool {
+	if !w.valid {
+		return true
+	}
+	size := w.size
+	if size == 0 {
+		size = 1
+	}
+	return seq.Within(w.left, w.left.Add(size))
+}
@@ -0,0 +1,68 @@
+package HoneyBadger
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func wscale(shift byte) layers.TCPOption {
+	return layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{shift}}
+}
+
+func TestWindowScale(t *testing.T) {
+	if shift, ok := windowScale([]layers.TCPOption{wscale(7)}); !ok || shift != 7 {
+		t.Errorf("window scale %d %v, expected 7", shift, ok)
+	}
+	if shift, _ := windowScale([]layers.TCPOption{wscale(20)}); shift != MAX_WINDOW_SCALE {
+		t.Errorf("window scale %d was not limited to %d", shift, MAX_WINDOW_SCALE)
+	}
+	if _, ok := windowScale(nil); ok {
+		t.Error("window scale found without the option")
+	}
+}
+
+func TestReceiveWindow(t *testing.T) {
+	w := receiveWindow{scale: 7}
+	if !w.contains(123456) {
+		t.Error("an unknown window must contain every sequence")
+	}
+	// SYN segments are never scaled
+	w.advertise(&layers.TCP{SYN: true, ACK: true, Ack: 100, Window: 1000})
+	if w.size != 1000 {
+		t.Errorf("SYN window %d, expected 1000", w.size)
+	}
+	w.advertise(&layers.TCP{ACK: true, Ack: 0xFFFFFF00, Window: 1000})
+	if w.size != 128000 {
+		t.Errorf("scaled window %d, expected 128000", w.size)
+	}
+	if !w.contains(0xFFFFFF00) || !w.contains(1000) || w.contains(128000) || w.contains(0xFFFFFEFF) {
+		t.Error("window wrapping the sequence space judged incorrectly")
+	}
+	w.advertise(&layers.TCP{ACK: true, Ack: 500, Window: 0})
+	if !w.contains(500) || w.contains(501) {
+		t.Error("a zero window must only admit a window probe")
+	}
+}
+
+func TestConnectionWindowScaling(t *testing.T) {
+	conn, packet := newTestConnection(NewDummyAttackLogger())
+	conn.state = TCP_UNKNOWN
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 99, SYN: true, Window: 65535, Options: []layers.TCPOption{wscale(2)}}, []byte{}))
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 499, Ack: 100, SYN: true, ACK: true, Window: 65535, Options: []layers.TCPOption{wscale(7)}}, []byte{}))
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 100, Ack: 500, ACK: true, Window: 100}, []byte{}))
+	conn.ReceivePacket(packet(false, layers.TCP{Seq: 500, Ack: 100, ACK: true, Window: 100}, []byte{}))
+	if conn.clientWindow.size != 400 || conn.serverWindow.size != 12800 {
+		t.Errorf("client window %d server window %d, expected 400 and 12800", conn.clientWindow.size, conn.serverWindow.size)
+	}
+
+	// beyond the server's receive window; the segment is not buffered
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 20000, Ack: 500, ACK: true, Window: 100}, []byte{1, 2, 3}))
+	if conn.ServerCoalesce.pageCount != 0 {
+		t.Error("segment beyond the receive window was buffered")
+	}
+	conn.ReceivePacket(packet(true, layers.TCP{Seq: 10000, Ack: 500, ACK: true, Window: 100}, []byte{1, 2, 3}))
+	if conn.ServerCoalesce.pageCount != 1 {
+		t.Error("segment within the receive window was not buffered")
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"sync/atomic"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// DISPATCHER_WORKER_QUEUE is the default number of packets queued
+// for each of the dispatcher's workers.
+const DISPATCHER_WORKER_QUEUE = 1024
+
+// dispatchWorker analyses the packets of the connections tracked by the
+// tracker shards it owns: those whose index modulo the number of workers
+// is its own. Its connections take their pages from its own page cache,
+// so workers never share a connection nor a page cache. Its packets are
+// queued by whoever calls the dispatcher's ReceivePacket, one at a time.
+type dispatchWorker struct {
+	dispatcher *Dispatcher
+	packets    *packetQueue
+	pausing    int32
+	resume     chan bool
+	pageCache  *pageCache
+	cpus       []int
+}
+
+// run analyses the packets queued for the worker until it is paused,
+// then analyses those queued when it was and waits to be resumed,
+// or stopped.
+func (w *dispatchWorker) run() {
+	pinGoroutine("worker", w.cpus)
+	for {
+		if atomic.LoadInt32(&w.pausing) != 0 {
+			for n := w.packets.Len(); n > 0; n-- {
+				p, _ := w.packets.Pop()
+				w.dispatcher.dispatchPacket(p)
+			}
+			atomic.StoreInt32(&w.pausing, 0)
+			w.dispatcher.workersPaused <- true
+			if !<-w.resume {
+				return
+			}
+			continue
+		}
+		if p, ok := w.packets.Pop(); ok {
+			w.dispatcher.dispatchPacket(p)
+			continue
+		}
+		w.packets.Wait()
+	}
+}
+
+// setupWorkers sets up Workers workers of WorkerQueue packet queues,
+// DISPATCHER_WORKER_QUEUE packets long if WorkerQueue is not set,
+// each bound to the next of the WorkerCPUs if set.
+func (i *Dispatcher) setupWorkers() {
+	queue := i.options.WorkerQueue
+	if queue <= 0 {
+		queue = DISPATCHER_WORKER_QUEUE
+	}
+	i.workersPaused = make(chan bool)
+	i.workers = make([]*dispatchWorker, i.options.Workers)
+	for n := range i.workers {
+		i.workers[n] = &dispatchWorker{
+			dispatcher: i,
+			packets:    newPacketQueue(queue),
+			resume:     make(chan bool),
+			pageCache:  newPageCache(),
+		}
+		if cpus := i.options.WorkerCPUs; len(cpus) > 0 {
+			i.workers[n].cpus = []int{cpus[n%len(cpus)]}
+		}
+	}
+}
+
+// startWorkers starts the dispatcher's workers, if it has any.
+func (i *Dispatcher) startWorkers() {
+	for _, w := range i.workers {
+		go w.run()
+	}
+}
+
+// pauseWorkers waits for the workers to analyse the packets queued so far
+// and then pauses them, so that the connections of every shard may be read
+// and changed from the dispatcher's goroutine until resumeWorkers is called.
+func (i *Dispatcher) pauseWorkers() {
+	for _, w := range i.workers {
+		atomic.StoreInt32(&w.pausing, 1)
+		w.packets.Wake()
+	}
+	for range i.workers {
+		<-i.workersPaused
+	}
+}
+
+// resumeWorkers resumes the paused workers, or stops them if running is false.
+func (i *Dispatcher) resumeWorkers(running bool) {
+	for _, w := range i.workers {
+		w.resume <- running
+	}
+}
+
+// paused runs fn with the workers paused.
+func (i *Dispatcher) paused(fn func()) {
+	i.pauseWorkers()
+	defer i.resumeWorkers(true)
+	fn()
+}
+
+// workerOf returns the worker analysing the connection of flow.
+func (i *Dispatcher) workerOf(flow *types.TcpIpFlow) *dispatchWorker {
+	return i.workers[i.tracker.ShardOf(flow)%len(i.workers)]
+}
+
+// pageCacheOf returns the page cache of the connection of flow.
+func (i *Dispatcher) pageCacheOf(flow *types.TcpIpFlow) *pageCache {
+	if i.workers == nil {
+		return i.pageCache
+	}
+	return i.workerOf(flow).pageCache
+}
+
+// queuePacket queues a packet for the worker of its connection,
+// dropping it if the worker's queue is full.
+func (i *Dispatcher) queuePacket(p *types.PacketManifest) {
+	if !i.workerOf(p.Flow).packets.Push(p) {
+		p.Release()
+	}
+}
+
+// DroppedPackets returns the number of packets dropped as the
+// queue of the worker which was to analyse them was full.
+func (i *Dispatcher) DroppedPackets() uint64 {
+	dropped := uint64(0)
+	for _, w := range i.workers {
+		dropped += w.packets.Overflows()
+	}
+	return dropped
+}
+
+// QueuedPackets returns the number of packets queued for each of the
+// workers, none if there are none.
+func (i *Dispatcher) QueuedPackets() []int {
+	queued := make([]int, len(i.workers))
+	for n, w := range i.workers {
+		queued[n] = w.packets.Len()
+	}
+	return queued
+}